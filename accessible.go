@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Transcripts published next to a recording have to meet accessibility
+// requirements such as WCAG 2.1 AA. The HTML export renders one as a
+// self-contained page: a heading structure screen readers can navigate,
+// the transcript as a definition list of speakers and what they said,
+// timestamps that link into the recording, and the transcript's language,
+// and that of every paragraph in another, marked up so it is read with the
+// right voice.
+
+// accessibleView is the data rendered by accessible.html
+type accessibleView struct {
+	Title string
+	Job   Job
+	// Lang is the language tag of the transcript, "" when not known
+	Lang       string
+	AudioURL   string
+	Entries    []accessibleEntry
+	Disclosure string
+}
+
+// accessibleEntry is a paragraph of the transcript. Link points into the
+// recording, or at the entry itself without one.
+type accessibleEntry struct {
+	ID       string
+	Speaker  string
+	Time     string
+	Datetime string
+	Link     string
+	Text     string
+	// Lang is the language tag of a paragraph in another language than
+	// the transcript
+	Lang string
+}
+
+// publishedAudioURL validates the ?audio= URL of the published recording.
+// The job's own audio URL is never used, as it may be private.
+func publishedAudioURL(value string) (string, bool) {
+	if value == "" {
+		return "", true
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	u.Fragment = ""
+	return u.String(), true
+}
+
+// fragmentSeconds formats a time in seconds to the hundredth, as media
+// fragments and durations take it
+func fragmentSeconds(t float64) string {
+	return strconv.FormatFloat(math.Round(t*100)/100, 'f', -1, 64)
+}
+
+// newAccessibleView lays out a completed job for the HTML export
+func newAccessibleView(job Job, audioURL string) accessibleView {
+	view := accessibleView{
+		Title:      jobTitle(job),
+		Job:        job,
+		AudioURL:   audioURL,
+		Disclosure: disclosureFooter(job.Consent),
+	}
+	if localePattern.MatchString(job.Language) {
+		view.Lang = job.Language
+	}
+	for i, p := range splitParagraphs(job.Segments) {
+		entry := accessibleEntry{
+			ID:       fmt.Sprintf("t%d", i+1),
+			Speaker:  p.Speaker,
+			Time:     formatTimestamp(p.Start),
+			Datetime: "PT" + fragmentSeconds(p.Start) + "S",
+			Text:     p.Text,
+		}
+		if p.Language != "" && !strings.EqualFold(p.Language, view.Lang) {
+			entry.Lang = p.Language
+		}
+		entry.Link = "#" + entry.ID
+		if audioURL != "" {
+			// A media fragment starts playback at the paragraph
+			entry.Link = fmt.Sprintf("%s#t=%s,%s", audioURL, fragmentSeconds(p.Start), fragmentSeconds(p.End))
+		}
+		view.Entries = append(view.Entries, entry)
+	}
+	return view
+}
+
+// writeAccessibleTranscript renders the HTML export of a completed job,
+// linking its timestamps to the recording at ?audio=
+func writeAccessibleTranscript(w http.ResponseWriter, r *http.Request, job Job) {
+	audioURL, ok := publishedAudioURL(r.URL.Query().Get("audio"))
+	if !ok {
+		integrationError(w, http.StatusBadRequest, "audio must be an http or https URL")
+		return
+	}
+	setAttachment(w, job.ID, ".html")
+	renderView(w, "accessible.html", newAccessibleView(job, audioURL))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The action_items pipeline step asks the LLM for the tasks, deadlines and
+// meetings mentioned in a transcript. Items with a date are published in
+// an iCalendar feed, so commitments made in meetings show up in the
+// calendars subscribed to it.
+
+// Kinds of action items
+const (
+	actionTask    = "task"
+	actionMeeting = "meeting"
+)
+
+// ActionItem is a commitment mentioned in a transcript
+type ActionItem struct {
+	Kind  string `json:"kind"`
+	Text  string `json:"text"`
+	Owner string `json:"owner,omitempty"`
+	// Due is a date (2006-01-02) or a local date and time (2006-01-02T15:04)
+	Due string `json:"due,omitempty"`
+}
+
+// Formats accepted for ActionItem.Due
+const (
+	dueDateFormat     = "2006-01-02"
+	dueDateTimeFormat = "2006-01-02T15:04"
+)
+
+// actionItemsPrompt instructs the LLM to answer with JSON only
+const actionItemsPrompt = `You extract action items from transcribed audio. Answer with a JSON array only, without any other text. Each element is an object with the fields:
+- "kind": "task" for something someone committed to do, or "meeting" for a scheduled meeting or call
+- "text": a short imperative description
+- "owner": the person responsible, if mentioned
+- "due": the deadline or meeting time as "YYYY-MM-DD" or "YYYY-MM-DDTHH:MM", if mentioned; resolve relative dates such as "next Friday" against the recording date
+Answer with [] when there are none.`
+
+// newActionItemsRequest builds the chat completion request extracting
+// action items from text recorded at recordedAt
+func newActionItemsRequest(model, text string, recordedAt time.Time) ChatCompletionRequest {
+	return ChatCompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: "system", Content: actionItemsPrompt},
+			{Role: "user", Content: fmt.Sprintf("Recording date: %s (%s)\n\nTranscription:\n\n%s", recordedAt.Format(dueDateFormat), recordedAt.Weekday(), text)},
+		},
+		Temperature: 0,
+	}
+}
+
+// extractActionItems asks the LLM for the action items in text
+func extractActionItems(ctx context.Context, up Upstream, text string, recordedAt time.Time) ([]ActionItem, error) {
+	var raw []ActionItem
+	if err := llmJSON(ctx, up, newActionItemsRequest(up.LLMModel, text, recordedAt), &raw); err != nil {
+		return nil, err
+	}
+	return cleanActionItems(raw), nil
+}
+
+// cleanActionItems drops items without text, and clears due dates that do
+// not parse rather than guess them
+func cleanActionItems(raw []ActionItem) []ActionItem {
+	items := []ActionItem{}
+	for _, item := range raw {
+		item.Text = strings.TrimSpace(item.Text)
+		if item.Text == "" {
+			continue
+		}
+		if item.Kind != actionMeeting {
+			item.Kind = actionTask
+		}
+		if _, _, ok := parseDue(item.Due); !ok {
+			item.Due = ""
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// parseDue parses an action item's due date, reporting whether it has a
+// time of day
+func parseDue(due string) (time.Time, bool, bool) {
+	if t, err := time.Parse(dueDateTimeFormat, due); err == nil {
+		return t, true, true
+	}
+	if t, err := time.Parse(dueDateFormat, due); err == nil {
+		return t, false, true
+	}
+	return time.Time{}, false, false
+}
+
+// icalEscape escapes a TEXT value (RFC 5545, section 3.3.11)
+func icalEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// icalLine writes a content line folded at 75 octets, without splitting
+// UTF-8 sequences
+func icalLine(b *strings.Builder, line string) {
+	// Continuation lines start with a space
+	for limit := 75; len(line) > limit; limit = 74 {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// handleCalendarFeed serves the dated action items of a feed's
+// transcriptions as an iCalendar feed. Times without a zone are floating,
+// so they show in each subscriber's local time.
+func handleCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	f, ok := resolveFeed(w, r)
+	if !ok {
+		return
+	}
+	var b strings.Builder
+	icalLine(&b, "BEGIN:VCALENDAR")
+	icalLine(&b, "VERSION:2.0")
+	icalLine(&b, "PRODID:-//transcription-app//action items//EN")
+	icalLine(&b, "CALSCALE:GREGORIAN")
+	icalLine(&b, "X-WR-CALNAME:"+icalEscape(f.Title))
+	for _, job := range feedJobs(f) {
+		for i, item := range job.ActionItems {
+			due, timed, ok := parseDue(item.Due)
+			if !ok {
+				continue
+			}
+			icalLine(&b, "BEGIN:VEVENT")
+			icalLine(&b, fmt.Sprintf("UID:%s-%d@transcription-app", job.ID, i))
+			icalLine(&b, "DTSTAMP:"+job.UpdatedAt.UTC().Format("20060102T150405Z"))
+			if timed {
+				icalLine(&b, "DTSTART:"+due.Format("20060102T150405"))
+				icalLine(&b, "DURATION:PT30M")
+			} else {
+				icalLine(&b, "DTSTART;VALUE=DATE:"+due.Format("20060102"))
+				icalLine(&b, "DTEND;VALUE=DATE:"+due.AddDate(0, 0, 1).Format("20060102"))
+			}
+			summary := item.Text
+			if item.Kind == actionTask {
+				summary = "Due: " + summary
+			}
+			icalLine(&b, "SUMMARY:"+icalEscape(summary))
+			description := "From " + jobTitle(job)
+			if item.Owner != "" {
+				description += "\nOwner: " + item.Owner
+			}
+			icalLine(&b, "DESCRIPTION:"+icalEscape(description))
+			icalLine(&b, "END:VEVENT")
+		}
+	}
+	icalLine(&b, "END:VCALENDAR")
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
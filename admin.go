@@ -0,0 +1,783 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The admin API manages integrations, alert rules, pipelines, API keys,
+// legal holds, UI translations, scorecards, meeting rooms and push-to-talk channels declaratively so deployments can be configured as code (e.g. from
+// Terraform). Every resource is addressed by an external ID chosen by the
+// caller and PUT is idempotent: applying the same definition twice leaves
+// the resource unchanged.
+
+// Resource kinds, used as the collection name in /admin/v1/{kind}/{id}
+const (
+	kindIntegrations = "integrations"
+	kindAlertRules   = "alert_rules"
+	kindPipelines    = "pipelines"
+	kindAPIKeys      = "api_keys"
+	kindLegalHolds   = "legal_holds"
+	kindWorkspaces   = "workspaces"
+	kindTranslations = "translations"
+	kindScorecards   = "scorecards"
+	kindRooms        = "rooms"
+	kindChannels     = "channels"
+)
+
+// externalIDPattern restricts IDs to characters that are safe in URLs
+var externalIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// adminResource is a declaratively managed object
+type adminResource interface {
+	// validate checks the definition and normalizes defaults
+	validate() error
+	// redacted returns the resource as shown to API clients
+	redacted() adminResource
+}
+
+// newAdminResource returns an empty resource of the given kind
+func newAdminResource(kind string) (adminResource, bool) {
+	switch kind {
+	case kindIntegrations:
+		return &Integration{}, true
+	case kindAlertRules:
+		return &AlertRule{}, true
+	case kindPipelines:
+		return &PipelineDefinition{}, true
+	case kindAPIKeys:
+		return &APIKey{}, true
+	case kindLegalHolds:
+		return &LegalHold{}, true
+	case kindWorkspaces:
+		return &Workspace{}, true
+	case kindTranslations:
+		return &Translation{}, true
+	case kindScorecards:
+		return &Scorecard{}, true
+	case kindRooms:
+		return &Room{}, true
+	case kindChannels:
+		return &Channel{}, true
+	}
+	return nil, false
+}
+
+// Integration delivers lifecycle events to an HTTP endpoint as CloudEvents
+type Integration struct {
+	ID         string   `json:"id"`
+	Type       string   `json:"type"`
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret,omitempty"`
+	EventTypes []string `json:"event_types,omitempty"`
+	Disabled   bool     `json:"disabled,omitempty"`
+}
+
+func (i *Integration) validate() error {
+	if i.Type == "" {
+		i.Type = "webhook"
+	}
+	if i.Type != "webhook" {
+		return fmt.Errorf("unsupported integration type %q (expected \"webhook\")", i.Type)
+	}
+	if u, err := url.Parse(i.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an http(s) URL")
+	}
+	if i.Secret != "" {
+		if err := validHMACKey(i.Secret); err != nil {
+			return fmt.Errorf("secret %v", err)
+		}
+	}
+	return nil
+}
+
+// redactedSecret stands in for an integration's signing secret, which is
+// write-only, in responses
+const redactedSecret = "********"
+
+// redacted hides the signing secret
+func (i *Integration) redacted() adminResource {
+	c := *i
+	if c.Secret != "" {
+		c.Secret = redactedSecret
+	}
+	return &c
+}
+
+// keepSecret keeps the secret of the integration being replaced when a
+// definition read back from the API is applied again, still carrying the
+// mask instead of the secret
+func (i *Integration) keepSecret() error {
+	if i.Secret != redactedSecret {
+		return nil
+	}
+	existing, ok := registry.integration(i.ID)
+	if !ok || existing.Secret == "" {
+		return errors.New("secret must be the signing secret, not " + redactedSecret)
+	}
+	i.Secret = existing.Secret
+	return nil
+}
+
+// wants reports whether the integration subscribes to eventType
+func (i *Integration) wants(eventType string) bool {
+	if i.Disabled {
+		return false
+	}
+	if len(i.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range i.EventTypes {
+		if t == eventType || cloudEventTypePrefix+t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// AlertRule notifies an integration when a metric on /debug/vars crosses a
+// threshold, and again when it recovers
+type AlertRule struct {
+	ID          string  `json:"id"`
+	Metric      string  `json:"metric"`
+	Operator    string  `json:"operator"`
+	Threshold   float64 `json:"threshold"`
+	Integration string  `json:"integration"`
+	Disabled    bool    `json:"disabled,omitempty"`
+}
+
+func (a *AlertRule) validate() error {
+	if a.Metric == "" {
+		return errors.New("metric is required")
+	}
+	if a.Operator == "" {
+		a.Operator = ">="
+	}
+	switch a.Operator {
+	case ">", ">=", "<", "<=":
+	default:
+		return fmt.Errorf("unsupported operator %q (expected >, >=, < or <=)", a.Operator)
+	}
+	if a.Integration == "" {
+		return errors.New("integration is required")
+	}
+	return nil
+}
+
+func (a *AlertRule) redacted() adminResource {
+	c := *a
+	return &c
+}
+
+// PipelineDefinition is a named pipeline that can be triggered like the
+// built-in ones
+type PipelineDefinition struct {
+	ID       string   `json:"id"`
+	Steps    []string `json:"steps"`
+	Language string   `json:"language,omitempty"`
+	// Scorecard is applied by the scorecard step
+	Scorecard string `json:"scorecard,omitempty"`
+	// TranslateTo is the language tag the translate step translates to
+	TranslateTo string `json:"translate_to,omitempty"`
+}
+
+// Pipeline steps, in execution order
+const (
+	stepTranscribe  = "transcribe"
+	stepSummarize   = "summarize"
+	stepActionItems = "action_items"
+	stepTags        = "tags"
+	stepDecisions   = "decisions"
+	stepRisks       = "risks"
+	stepFeedback    = "feedback"
+	stepScorecard   = "scorecard"
+	stepStudyNotes  = "study_notes"
+	stepFlashcards  = "flashcards"
+	stepQuiz        = "quiz"
+	stepOutline     = "outline"
+	stepTranslate   = "translate"
+)
+
+func (p *PipelineDefinition) validate() error {
+	if builtinPipeline(p.ID) {
+		return fmt.Errorf("%q is a built-in pipeline", p.ID)
+	}
+	if len(p.Steps) == 0 || p.Steps[0] != stepTranscribe {
+		return errors.New("steps must start with \"transcribe\"")
+	}
+	seen := make(map[string]bool)
+	for _, step := range p.Steps[1:] {
+		if _, ok := pipelineStepRunners[step]; !ok {
+			return fmt.Errorf("unsupported step %q", step)
+		}
+		if seen[step] {
+			return fmt.Errorf("step %q is repeated", step)
+		}
+		seen[step] = true
+	}
+	if seen[stepScorecard] != (p.Scorecard != "") {
+		return errors.New("the scorecard step and scorecard go together")
+	}
+	if seen[stepTranslate] != (p.TranslateTo != "") {
+		return errors.New("the translate step and translate_to go together")
+	}
+	if p.TranslateTo != "" && !localePattern.MatchString(p.TranslateTo) {
+		return fmt.Errorf("translate_to %q is not a language tag such as de or pt-BR", p.TranslateTo)
+	}
+	return nil
+}
+
+func (p *PipelineDefinition) redacted() adminResource {
+	c := *p
+	return &c
+}
+
+// APIKey grants access to the integrations API. Only a SHA-256 hash of the
+// key is kept; the key itself is accepted on PUT and never returned.
+type APIKey struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	Key         string `json:"key,omitempty"`
+	KeyHash     string `json:"key_sha256,omitempty"`
+	Tenant      string `json:"tenant,omitempty"`
+	Workspace   string `json:"workspace,omitempty"`
+	Role        string `json:"role"`
+	Disabled    bool   `json:"disabled,omitempty"`
+}
+
+func (k *APIKey) validate() error {
+	if k.Key != "" {
+		k.KeyHash = hashAPIKey(k.Key)
+		k.Key = ""
+	}
+	if len(k.KeyHash) != sha256.Size*2 {
+		return errors.New("key is required")
+	}
+	if k.Tenant != "" && !knownTenant(k.Tenant) {
+		return fmt.Errorf("tenant %q is not in TENANT_ROUTES", k.Tenant)
+	}
+	if k.Role == "" {
+		k.Role = roleEditor
+	}
+	if !validRole(k.Role) {
+		return fmt.Errorf("unknown role %q (expected viewer, editor or admin)", k.Role)
+	}
+	// The admin API is not scoped to a tenant
+	if k.Role == roleAdmin && k.Tenant != "" {
+		return errors.New("admin keys cannot belong to a tenant")
+	}
+	// A member's tenant is the workspace's
+	if k.Workspace != "" && (k.Role == roleAdmin || k.Tenant != "") {
+		return errors.New("workspace keys cannot be admin keys or name a tenant")
+	}
+	return nil
+}
+
+func (k *APIKey) redacted() adminResource {
+	c := *k
+	return &c
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// adminRegistry holds the declared resources, optionally persisted to a
+// JSON file so they survive restarts
+type adminRegistry struct {
+	path string
+
+	mu        sync.RWMutex
+	resources map[string]map[string]adminResource
+}
+
+var registry = newAdminRegistry("")
+
+func newAdminRegistry(path string) *adminRegistry {
+	r := &adminRegistry{path: path, resources: make(map[string]map[string]adminResource)}
+	for _, kind := range []string{kindIntegrations, kindAlertRules, kindPipelines, kindAPIKeys, kindLegalHolds, kindWorkspaces, kindTranslations, kindScorecards, kindRooms, kindChannels} {
+		r.resources[kind] = make(map[string]adminResource)
+	}
+	return r
+}
+
+// adminKeyPrefix namespaces resources in a shared state store
+const adminKeyPrefix = "admin:"
+
+// load reads the persisted state, if any, replacing what is in memory
+func (r *adminRegistry) load() error {
+	saved := make(map[string]map[string]json.RawMessage)
+	if state.shared() {
+		keys, err := state.keys(adminKeyPrefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			kind, id, _ := strings.Cut(strings.TrimPrefix(key, adminKeyPrefix), "/")
+			data, ok, err := state.get(key)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if saved[kind] == nil {
+				saved[kind] = make(map[string]json.RawMessage)
+			}
+			saved[kind][id] = data
+		}
+	} else if r.path != "" {
+		data, err := os.ReadFile(r.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return err
+		}
+	}
+
+	resources := newAdminRegistry(r.path).resources
+	for kind, items := range saved {
+		for id, raw := range items {
+			res, ok := newAdminResource(kind)
+			if !ok {
+				return fmt.Errorf("unknown resource kind %q", kind)
+			}
+			if err := json.Unmarshal(raw, res); err != nil {
+				return fmt.Errorf("%s/%s: %w", kind, id, err)
+			}
+			resources[kind][id] = res
+		}
+	}
+	r.mu.Lock()
+	r.resources = resources
+	r.mu.Unlock()
+	return nil
+}
+
+// refresh reloads resources changed by other replicas every interval
+func (r *adminRegistry) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := r.load(); err != nil {
+			logErrorf(context.Background(), "Error refreshing admin resources: %v", err)
+		}
+	}
+}
+
+// save persists one resource, or removes it when res is nil. A shared store
+// keeps each resource under its own key so concurrent changes from
+// different replicas do not overwrite each other; the file holds the whole
+// registry. The caller holds the lock.
+func (r *adminRegistry) save(kind, id string, res adminResource) error {
+	if state.shared() {
+		key := adminKeyPrefix + kind + "/" + id
+		if res == nil {
+			return state.delete(key)
+		}
+		data, err := json.Marshal(res)
+		if err != nil {
+			return err
+		}
+		return state.set(key, data, 0)
+	}
+
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.resources, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// put creates or replaces a resource and reports whether it was created
+func (r *adminRegistry) put(kind, id string, res adminResource) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous, exists := r.resources[kind][id]
+	r.resources[kind][id] = res
+	if err := r.save(kind, id, res); err != nil {
+		if exists {
+			r.resources[kind][id] = previous
+		} else {
+			delete(r.resources[kind], id)
+		}
+		return false, err
+	}
+	return !exists, nil
+}
+
+// delete removes a resource and reports whether it existed
+func (r *adminRegistry) delete(kind, id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous, exists := r.resources[kind][id]
+	if !exists {
+		return false, nil
+	}
+	delete(r.resources[kind], id)
+	if err := r.save(kind, id, nil); err != nil {
+		r.resources[kind][id] = previous
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *adminRegistry) get(kind, id string) (adminResource, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res, ok := r.resources[kind][id]
+	return res, ok
+}
+
+// list returns the resources of a kind ordered by ID
+func (r *adminRegistry) list(kind string) []adminResource {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.resources[kind]))
+	for id := range r.resources[kind] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	items := make([]adminResource, 0, len(ids))
+	for _, id := range ids {
+		items = append(items, r.resources[kind][id])
+	}
+	return items
+}
+
+// pipeline returns a declared pipeline definition
+func (r *adminRegistry) pipeline(id string) (*PipelineDefinition, bool) {
+	res, ok := r.get(kindPipelines, id)
+	if !ok {
+		return nil, false
+	}
+	return res.(*PipelineDefinition), true
+}
+
+// integration returns a declared integration
+func (r *adminRegistry) integration(id string) (*Integration, bool) {
+	res, ok := r.get(kindIntegrations, id)
+	if !ok {
+		return nil, false
+	}
+	return res.(*Integration), true
+}
+
+// integrations returns all declared integrations
+func (r *adminRegistry) integrations() []*Integration {
+	items := r.list(kindIntegrations)
+	integrations := make([]*Integration, 0, len(items))
+	for _, item := range items {
+		integrations = append(integrations, item.(*Integration))
+	}
+	return integrations
+}
+
+// alertRules returns all declared alert rules
+func (r *adminRegistry) alertRules() []*AlertRule {
+	items := r.list(kindAlertRules)
+	rules := make([]*AlertRule, 0, len(items))
+	for _, item := range items {
+		rules = append(rules, item.(*AlertRule))
+	}
+	return rules
+}
+
+// apiKey returns the enabled declared API key matching key
+func (r *adminRegistry) apiKey(key string) (*APIKey, bool) {
+	hash := []byte(hashAPIKey(key))
+	for _, item := range r.list(kindAPIKeys) {
+		k := item.(*APIKey)
+		if !k.Disabled && subtle.ConstantTimeCompare(hash, []byte(k.KeyHash)) == 1 {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// hasAdminKey reports whether an enabled API key with the admin role exists
+func (r *adminRegistry) hasAdminKey() bool {
+	for _, item := range r.list(kindAPIKeys) {
+		if k := item.(*APIKey); !k.Disabled && k.Role == roleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// registerAdminRoutes adds the /admin/v1 endpoints to mux
+func registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/v1/{kind}", requireAdmin(requireResourceKind(handleAdminList)))
+	mux.HandleFunc("GET /admin/v1/{kind}/{id}", requireAdmin(requireResourceKind(handleAdminGet)))
+	mux.HandleFunc("PUT /admin/v1/{kind}/{id}", requireAdmin(requireResourceKind(handleAdminPut)))
+	mux.HandleFunc("DELETE /admin/v1/{kind}/{id}", requireAdmin(requireResourceKind(handleAdminDelete)))
+	mux.HandleFunc("GET /admin/v1/selftest", requireAdmin(handleSelfTest))
+	mux.HandleFunc("POST /admin/v1/warmup", requireAdmin(handleWarmup))
+	mux.HandleFunc("GET /admin/v1/maintenance", requireAdmin(handleMaintenanceGet))
+	mux.HandleFunc("PUT /admin/v1/maintenance", requireAdmin(handleMaintenancePut))
+	mux.HandleFunc("DELETE /admin/v1/maintenance", requireAdmin(handleMaintenanceDelete))
+	mux.HandleFunc("GET /admin/v1/settings", requireAdmin(handleSettingsGet))
+	mux.HandleFunc("PATCH /admin/v1/settings", requireAdmin(handleSettingsPatch))
+	mux.HandleFunc("DELETE /admin/v1/settings", requireAdmin(handleSettingsDelete))
+	mux.HandleFunc("GET /admin/v1/drain", requireAdmin(handleDrainStatus))
+	mux.HandleFunc("POST /admin/v1/drain", requireAdmin(handleDrain))
+	mux.HandleFunc("POST /admin/v1/resume", requireAdmin(handleResume))
+	mux.HandleFunc("GET /admin/v1/telemetry", requireAdmin(handleTelemetry))
+	mux.HandleFunc("GET /admin/v1/users/{id}/export", requireAdmin(handleUserExport))
+	mux.HandleFunc("DELETE /admin/v1/users/{id}/data", requireAdmin(handleUserErase))
+	mux.HandleFunc("GET /admin/v1/workspaces/{id}/usage", requireAdmin(handleWorkspaceUsage))
+	mux.HandleFunc("GET /admin/v1/workspaces/{id}/invitations", requireAdmin(handleInvitationList))
+	mux.HandleFunc("POST /admin/v1/workspaces/{id}/invitations", requireAdmin(handleInvitationCreate))
+	mux.HandleFunc("DELETE /admin/v1/workspaces/{id}/invitations/{invitation}", requireAdmin(handleInvitationDelete))
+	mux.HandleFunc("POST /admin/v1/rooms/{id}/pairing", requireAdmin(handleRoomPairingCreate))
+	mux.HandleFunc("GET /admin/v1/rooms/{id}/devices", requireAdmin(handleRoomDeviceList))
+	mux.HandleFunc("DELETE /admin/v1/rooms/{id}/devices/{device}", requireAdmin(handleRoomDeviceDelete))
+}
+
+// requireAdmin admits the ADMIN_TOKEN or an API key with the admin role,
+// sent as "Authorization: Bearer" or X-API-Key. The admin API is hidden
+// entirely when there is neither a token nor an admin key.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminToken := config.AdminToken.Value()
+		token := requestAPIKey(r)
+		if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			next(w, withPrincipal(r, principal{ID: "admin-token", Role: roleAdmin}))
+			return
+		}
+		p, ok := principalForKey(token)
+		if ok && p.can(roleAdmin) {
+			next(w, withPrincipal(r, p))
+			return
+		}
+		if adminToken == "" && !registry.hasAdminKey() {
+			http.NotFound(w, r)
+			return
+		}
+		if ok {
+			integrationError(w, http.StatusForbidden, "API key role does not allow administration")
+			return
+		}
+		logf(r.Context(), "Rejected admin request with invalid token from %s", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		integrationError(w, http.StatusUnauthorized, "Invalid or missing admin token")
+	}
+}
+
+// requireResourceKind rejects requests for an unknown {kind}
+func requireResourceKind(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := newAdminResource(r.PathValue("kind")); !ok {
+			integrationError(w, http.StatusNotFound, "Unknown resource kind")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func handleAdminList(w http.ResponseWriter, r *http.Request) {
+	items := registry.list(r.PathValue("kind"))
+	redacted := make([]adminResource, 0, len(items))
+	for _, item := range items {
+		redacted = append(redacted, item.redacted())
+	}
+	writeJSON(w, http.StatusOK, redacted)
+}
+
+func handleAdminGet(w http.ResponseWriter, r *http.Request) {
+	res, ok := registry.get(r.PathValue("kind"), r.PathValue("id"))
+	if !ok {
+		integrationError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, res.redacted())
+}
+
+// handleAdminPut creates or replaces a resource under its external ID,
+// answering 201 when created and 200 when updated
+func handleAdminPut(w http.ResponseWriter, r *http.Request) {
+	kind, id := r.PathValue("kind"), r.PathValue("id")
+	if !externalIDPattern.MatchString(id) {
+		integrationError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHookPayloadSize))
+	if err != nil {
+		integrationError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		return
+	}
+	res, _ := newAdminResource(kind)
+	if err := json.Unmarshal(body, res); err != nil {
+		integrationError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	// The ID in the path is authoritative
+	setResourceID(res, id)
+	if integration, ok := res.(*Integration); ok {
+		if err := integration.keepSecret(); err != nil {
+			integrationError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if err := res.validate(); err != nil {
+		integrationError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if rule, ok := res.(*AlertRule); ok {
+		if _, exists := registry.integration(rule.Integration); !exists {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("integration %q does not exist", rule.Integration))
+			return
+		}
+	}
+	if pipeline, ok := res.(*PipelineDefinition); ok && pipeline.Scorecard != "" {
+		if _, exists := registry.scorecard(pipeline.Scorecard); !exists {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("scorecard %q does not exist", pipeline.Scorecard))
+			return
+		}
+	}
+	if key, ok := res.(*APIKey); ok && key.Workspace != "" {
+		if _, exists := registry.workspace(key.Workspace); !exists {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("workspace %q does not exist", key.Workspace))
+			return
+		}
+	}
+
+	if room, ok := res.(*Room); ok {
+		if !validPipeline(room.Pipeline) {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("pipeline %q does not exist", room.Pipeline))
+			return
+		}
+		if _, exists := registry.workspace(room.Workspace); room.Workspace != "" && !exists {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("workspace %q does not exist", room.Workspace))
+			return
+		}
+	}
+	if channel, ok := res.(*Channel); ok {
+		if _, exists := registry.workspace(channel.Workspace); channel.Workspace != "" && !exists {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("workspace %q does not exist", channel.Workspace))
+			return
+		}
+		if _, exists := registry.integration(channel.Integration); channel.Integration != "" && !exists {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("integration %q does not exist", channel.Integration))
+			return
+		}
+	}
+
+	created, err := registry.put(kind, id, res)
+	if err != nil {
+		logErrorf(r.Context(), "Error saving %s/%s: %v", kind, id, err)
+		integrationError(w, http.StatusInternalServerError, "Error saving configuration")
+		return
+	}
+
+	if hold, ok := res.(*LegalHold); ok {
+		placeLegalHold(hold, created)
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		logf(r.Context(), "Admin: created %s/%s", kind, id)
+	} else {
+		logf(r.Context(), "Admin: updated %s/%s", kind, id)
+	}
+	writeJSON(w, status, res.redacted())
+}
+
+// handleAdminDelete removes a resource; deleting a missing one succeeds so
+// that repeated applies converge
+func handleAdminDelete(w http.ResponseWriter, r *http.Request) {
+	kind, id := r.PathValue("kind"), r.PathValue("id")
+	deleted, err := registry.delete(kind, id)
+	if err != nil {
+		logErrorf(r.Context(), "Error saving configuration after deleting %s/%s: %v", kind, id, err)
+		integrationError(w, http.StatusInternalServerError, "Error saving configuration")
+		return
+	}
+	if deleted {
+		logf(r.Context(), "Admin: deleted %s/%s", kind, id)
+		if kind == kindLegalHolds {
+			releaseLegalHold(id)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setResourceID(res adminResource, id string) {
+	switch v := res.(type) {
+	case *Integration:
+		v.ID = id
+	case *AlertRule:
+		v.ID = id
+	case *PipelineDefinition:
+		v.ID = id
+	case *APIKey:
+		v.ID = id
+	case *LegalHold:
+		v.ID = id
+	case *Workspace:
+		v.ID = id
+	case *Translation:
+		v.ID = id
+	case *Scorecard:
+		v.ID = id
+	case *Room:
+		v.ID = id
+	case *Channel:
+		v.ID = id
+	}
+}
+
+// adminRefreshInterval is how quickly changes made through another replica
+// are picked up from a shared state store
+const adminRefreshInterval = 5 * time.Second
+
+// initAdmin loads declared resources and starts delivering to integrations
+func initAdmin() {
+	path := config.AdminStateFile
+	if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			log.Fatalf("Error creating directory for ADMIN_STATE_FILE: %v", err)
+		}
+	}
+	registry = newAdminRegistry(path)
+	if err := registry.load(); err != nil {
+		log.Fatalf("Error loading admin resources: %v", err)
+	}
+	if state.shared() {
+		go registry.refresh(adminRefreshInterval)
+	}
+	go runWebhookDelivery()
+	go runAlertRules(config.DiskCheckInterval)
+	go runFeedbackReports()
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An agenda report maps each item of a user-supplied agenda to where it
+// was discussed in a completed transcription, whether it was resolved and
+// what was decided. The LLM is given the transcript as numbered,
+// timestamped segments and answers with segment IDs, which are turned into
+// time ranges; IDs it invents are dropped. A transcript too long for one
+// call is cut down to the segments sharing the most words with the agenda,
+// with their neighbours for context.
+
+// Agenda item statuses
+const (
+	agendaResolved     = "resolved"
+	agendaUnresolved   = "unresolved"
+	agendaNotDiscussed = "not_discussed"
+)
+
+// Agenda limits
+const (
+	maxAgendaItems      = 30
+	maxAgendaItemLength = 200
+)
+
+// agendaContext is how many segments around a retrieved one are included
+const agendaContext = 2
+
+// agendaRequest is the body of POST .../agenda
+type agendaRequest struct {
+	Items []string `json:"items"`
+}
+
+// AgendaItem reports how one agenda item was covered
+type AgendaItem struct {
+	Item     string            `json:"item"`
+	Status   string            `json:"status"`
+	Decision string            `json:"decision,omitempty"`
+	Notes    string            `json:"notes,omitempty"`
+	Ranges   []TranscriptRange `json:"discussed_at"`
+}
+
+// AgendaReport aligns an agenda with a transcription
+type AgendaReport struct {
+	Items []AgendaItem `json:"items"`
+	Model string       `json:"model,omitempty"`
+	// Excerpted is set when only the segments related to the agenda were
+	// given to the LLM
+	Excerpted     bool           `json:"excerpted,omitempty"`
+	Timing        *Timing        `json:"timing,omitempty"`
+	QuotaWarnings []QuotaWarning `json:"quota_warnings,omitempty"`
+}
+
+// agendaPrompt instructs the LLM to answer with JSON only
+const agendaPrompt = `You compare a meeting agenda with the transcript of the meeting. The transcript is given as lines "[ID mm:ss] text", one per segment; segments may be left out. Answer with a JSON array only, without any other text, with one object per agenda item in agenda order:
+- "item": the number of the agenda item
+- "status": "resolved" if the item was discussed and concluded, "unresolved" if it was discussed without a conclusion, "not_discussed" otherwise
+- "segments": the IDs of the segments in which the item was discussed
+- "decision": what was decided, if anything
+- "notes": one sentence on the discussion, if it was discussed`
+
+// segmentLine formats a segment for the agenda prompt
+func segmentLine(s Segment) string {
+	return fmt.Sprintf("[%d %s] %s", s.ID, formatTimestamp(s.Start), strings.TrimSpace(s.Text))
+}
+
+// agendaPrefix shortens words so that simple inflections still match
+func agendaPrefix(word string) string {
+	runes := []rune(word)
+	return string(runes[:min(len(runes), 5)])
+}
+
+// retrieveAgendaSegments returns the segments to give the LLM within limit
+// characters: all of them when they fit, otherwise those sharing the most
+// words with each agenda item, taken in turns, with their neighbours
+func retrieveAgendaSegments(segments []Segment, items []string, limit int) ([]Segment, bool) {
+	total := 0
+	for _, s := range segments {
+		total += len([]rune(segmentLine(s))) + 1
+	}
+	if limit <= 0 || total <= limit {
+		return segments, false
+	}
+
+	// Rank the segments for each item by shared words
+	ranked := make([][]int, len(items))
+	for i, item := range items {
+		words := make(map[string]bool)
+		for word := range contentWords([]string{item}) {
+			words[agendaPrefix(word)] = true
+		}
+		type scored struct{ index, score int }
+		var matches []scored
+		for j, s := range segments {
+			score := 0
+			for word := range contentWords([]string{s.Text}) {
+				if words[agendaPrefix(word)] {
+					score++
+				}
+			}
+			if score > 0 {
+				matches = append(matches, scored{j, score})
+			}
+		}
+		sort.SliceStable(matches, func(a, b int) bool { return matches[a].score > matches[b].score })
+		for _, m := range matches {
+			ranked[i] = append(ranked[i], m.index)
+		}
+	}
+
+	chosen := make(map[int]bool)
+	used := 0
+	add := func(index int) bool {
+		for j := max(index-agendaContext, 0); j <= min(index+agendaContext, len(segments)-1); j++ {
+			if chosen[j] {
+				continue
+			}
+			length := len([]rune(segmentLine(segments[j]))) + 1
+			if used+length > limit {
+				return false
+			}
+			chosen[j] = true
+			used += length
+		}
+		return true
+	}
+	// Take each item's next best segment in turn, so that every item gets
+	// its share of the budget
+	for round, full := 0, false; !full; round++ {
+		progressed := false
+		for _, indexes := range ranked {
+			if round < len(indexes) {
+				progressed = true
+				if !add(indexes[round]) {
+					full = true
+					break
+				}
+			}
+		}
+		if !progressed {
+			break
+		}
+	}
+
+	var excerpt []Segment
+	for j, s := range segments {
+		if chosen[j] {
+			excerpt = append(excerpt, s)
+		}
+	}
+	return excerpt, true
+}
+
+// newAgendaRequest builds the chat completion request aligning items with
+// segments
+func newAgendaRequest(model string, items []string, segments []Segment) ChatCompletionRequest {
+	var agenda, transcript strings.Builder
+	for i, item := range items {
+		fmt.Fprintf(&agenda, "%d. %s\n", i+1, item)
+	}
+	for _, s := range segments {
+		transcript.WriteString(segmentLine(s))
+		transcript.WriteByte('\n')
+	}
+	return ChatCompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: "system", Content: agendaPrompt},
+			{Role: "user", Content: fmt.Sprintf("Agenda:\n\n%s\nTranscript:\n\n%s", agenda.String(), transcript.String())},
+		},
+		Temperature: 0,
+	}
+}
+
+// alignAgenda asks the LLM how the agenda items were covered in segments
+func alignAgenda(ctx context.Context, up Upstream, items []string, segments []Segment) (*AgendaReport, error) {
+	sent, excerpted := retrieveAgendaSegments(segments, items, config.SummaryMaxInputChars)
+	result, err := llmComplete(ctx, up, newAgendaRequest(up.LLMModel, items, sent))
+	if err != nil {
+		return nil, err
+	}
+	var raw []agendaAnswer
+	if err := decodeJSONAnswer(ctx, result.Summary, &raw); err != nil {
+		return nil, err
+	}
+	report := agendaReport(raw, items, sent)
+	report.Model = result.Model
+	report.Excerpted = excerpted
+	return report, nil
+}
+
+// agendaAnswer is one element of the LLM's answer
+type agendaAnswer struct {
+	Item     int    `json:"item"`
+	Status   string `json:"status"`
+	Segments []int  `json:"segments"`
+	Decision string `json:"decision"`
+	Notes    string `json:"notes"`
+}
+
+// agendaReport builds the report from the LLM's answer. Every agenda item
+// gets an entry; items the LLM skipped count as not discussed, and segment
+// IDs that were not sent are dropped.
+func agendaReport(raw []agendaAnswer, items []string, sent []Segment) *AgendaReport {
+	report := &AgendaReport{Items: make([]AgendaItem, len(items))}
+	for i, item := range items {
+		report.Items[i] = AgendaItem{Item: item, Status: agendaNotDiscussed, Ranges: []TranscriptRange{}}
+	}
+	byID := make(map[int]int, len(sent))
+	for i, s := range sent {
+		byID[s.ID] = i
+	}
+	for _, a := range raw {
+		if a.Item < 1 || a.Item > len(items) {
+			continue
+		}
+		entry := &report.Items[a.Item-1]
+		switch a.Status {
+		case agendaResolved, agendaUnresolved:
+			entry.Status = a.Status
+		default:
+			continue
+		}
+		entry.Decision = strings.TrimSpace(a.Decision)
+		entry.Notes = strings.TrimSpace(a.Notes)
+
+		// Consecutive segments form one range
+		var indexes []int
+		for _, id := range a.Segments {
+			if i, ok := byID[id]; ok {
+				indexes = append(indexes, i)
+			}
+		}
+		sort.Ints(indexes)
+		for n, i := range indexes {
+			s := sent[i]
+			if n > 0 && i == indexes[n-1] {
+				continue
+			}
+			if n > 0 && i == indexes[n-1]+1 {
+				last := &entry.Ranges[len(entry.Ranges)-1]
+				last.End, last.LastSegment = s.End, s.ID
+				continue
+			}
+			entry.Ranges = append(entry.Ranges, TranscriptRange{Start: s.Start, End: s.End, FirstSegment: s.ID, LastSegment: s.ID})
+		}
+	}
+	return report
+}
+
+// handleAgendaReport aligns a user-supplied agenda with a completed
+// transcription
+func handleAgendaReport(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !p.sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	if job.Status != jobCompleted {
+		integrationError(w, http.StatusConflict, "Transcription is not completed")
+		return
+	}
+	if len(job.Segments) == 0 {
+		integrationError(w, http.StatusConflict, "Transcription has no timestamped segments to align the agenda with")
+		return
+	}
+	var req agendaRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&req); err != nil {
+		integrationError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	var items []string
+	for _, item := range req.Items {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 || len(items) > maxAgendaItems {
+		integrationError(w, http.StatusBadRequest, fmt.Sprintf("items must list 1 to %d agenda items", maxAgendaItems))
+		return
+	}
+	for _, item := range items {
+		if len([]rune(item)) > maxAgendaItemLength {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("agenda items must be at most %d characters", maxAgendaItemLength))
+			return
+		}
+	}
+	if refuseWhileShuttingDown(w, true) || refuseDuringMaintenance(w, true) {
+		return
+	}
+	warnings, msg, ok := admitWorkspaceJob(w, p.Workspace)
+	if !ok {
+		integrationError(w, http.StatusTooManyRequests, msg)
+		return
+	}
+
+	up, err := upstreamFor(job.Tenant, job.Region)
+	if err != nil {
+		logErrorf(r.Context(), "Job %s: %v", job.ID, err)
+		integrationError(w, http.StatusServiceUnavailable, regionUnavailableMessage)
+		return
+	}
+
+	r, timer := startTiming(r)
+	report, err := alignAgenda(r.Context(), up, items, job.Segments)
+	if err != nil {
+		logErrorf(r.Context(), "Job %s: error aligning agenda: %v", job.ID, err)
+		if errors.Is(err, errUpstreamBusy) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(config.UpstreamQueueTimeout.Seconds())))
+			integrationError(w, http.StatusServiceUnavailable, "Server is busy, please retry later")
+			return
+		}
+		integrationError(w, http.StatusBadGateway, "Error calling the LLM for the agenda report")
+		return
+	}
+	logf(r.Context(), "Job %s: aligned %d agenda items", job.ID, len(items))
+	report.Timing = timer.timing()
+	report.QuotaWarnings = warnings
+	writeJSON(w, http.StatusOK, report)
+}
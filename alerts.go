@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"strconv"
+	"time"
+)
+
+// runAlertRules evaluates the declared alert rules every interval and
+// notifies the rule's integration when its condition starts or stops holding.
+// Only the leader evaluates rules so replicas do not send duplicate alerts.
+func runAlertRules(interval time.Duration) {
+	firing := make(map[string]bool)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !isLeader() {
+			clear(firing)
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, rule := range registry.alertRules() {
+			seen[rule.ID] = true
+			if rule.Disabled {
+				continue
+			}
+			value, ok := metricValue(rule.Metric)
+			if !ok {
+				continue
+			}
+			active := rule.matches(value)
+			if active == firing[rule.ID] {
+				continue
+			}
+			firing[rule.ID] = active
+			rule.notify(active, value)
+		}
+		for id := range firing {
+			if !seen[id] {
+				delete(firing, id)
+			}
+		}
+	}
+}
+
+// matches reports whether value satisfies the rule's condition
+func (a *AlertRule) matches(value float64) bool {
+	switch a.Operator {
+	case ">":
+		return value > a.Threshold
+	case ">=":
+		return value >= a.Threshold
+	case "<":
+		return value < a.Threshold
+	case "<=":
+		return value <= a.Threshold
+	}
+	return false
+}
+
+// notify sends alert.fired or alert.resolved to the rule's integration
+func (a *AlertRule) notify(active bool, value float64) {
+	eventType := EventAlertResolved
+	if active {
+		eventType = EventAlertFired
+	}
+	logWarnf(context.Background(), "Alert %s: %s %s %g (value %g)", a.ID, a.Metric, a.Operator, a.Threshold, value)
+
+	integration, ok := registry.integration(a.Integration)
+	if !ok || integration.Disabled {
+		return
+	}
+	event := newCloudEvent(eventType, a.ID, map[string]any{
+		"rule":      a.ID,
+		"metric":    a.Metric,
+		"operator":  a.Operator,
+		"threshold": a.Threshold,
+		"value":     value,
+	})
+	deliverWebhook(integration, event)
+}
+
+// metricValue reads a numeric metric exported on /debug/vars
+func metricValue(name string) (float64, bool) {
+	v := expvar.Get(name)
+	if v == nil {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(v.String(), 64)
+	return f, err == nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"os"
+)
+
+// The web UI's static files, the HTML templates and the UI catalogs are
+// built into the binary, so it runs from any working directory with nothing
+// installed beside it. For live editing during development, STATIC_DIR
+// names a directory laid out as the repository, usually a checkout, whose
+// static, templates and i18n directories are read instead: static files on
+// every request and templates on every render, catalogs at startup.
+
+//go:embed static templates i18n
+var embeddedAssets embed.FS
+
+// assets holds the static, templates and i18n directories
+var assets fs.FS = embeddedAssets
+
+// initAssets reads the assets from STATIC_DIR when it is set
+func initAssets() {
+	if config.StaticDir == "" {
+		return
+	}
+	assets = os.DirFS(config.StaticDir)
+	logf(context.Background(), "Serving assets from %s", config.StaticDir)
+}
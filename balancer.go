@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Several Whisper servers can share the transcription load: the audio URL
+// of the default configuration, tenant routes and regions may list a few,
+// separated by commas. Each request goes to one of them, in turn or, with
+// AUDIO_BALANCING=least-connections, to the one with the fewest requests
+// from this replica. A request that fails on a backend, with a connection
+// error, a 5xx answer or no answer within AUDIO_BACKEND_TIMEOUT, is sent to
+// the next one when its audio can be sent again, and a backend that fails
+// backendFailureThreshold times in a row is left out for backendCooldown.
+// Every AUDIO_HEALTH_CHECK_INTERVAL each backend is also asked for its
+// models, which takes a backend that stopped answering out before a request
+// runs into it and brings it back as soon as it answers again.
+
+// Balancing strategies
+const (
+	balanceRoundRobin       = "round-robin"
+	balanceLeastConnections = "least-connections"
+)
+
+const (
+	// backendFailureThreshold is how many failures in a row take a backend
+	// out
+	backendFailureThreshold = 3
+	// backendCooldown is how long a failed backend is left out before
+	// requests try it again
+	backendCooldown = 30 * time.Second
+	// backendCheckTimeout bounds a health check
+	backendCheckTimeout = 5 * time.Second
+)
+
+var (
+	audioBackendUp = expvar.NewMap("audio_backend_up")
+	audioFailovers = expvar.NewInt("audio_failovers_total")
+)
+
+// audioBackend is one Whisper server of a pool
+type audioBackend struct {
+	url      string
+	inFlight atomic.Int64
+
+	mu        sync.Mutex
+	failures  int
+	downUntil time.Time
+}
+
+// available reports whether requests may go to the backend
+func (b *audioBackend) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures < backendFailureThreshold || time.Now().After(b.downUntil)
+}
+
+// succeeded records an answer from the backend
+func (b *audioBackend) succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= backendFailureThreshold {
+		logf(context.Background(), "Audio backend %s is back", b.url)
+	}
+	b.failures = 0
+	audioBackendUp.Set(b.url, expvarInt(1))
+}
+
+// failed records a failure of the backend, n times over
+func (b *audioBackend) failed(err error, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasUp := b.failures < backendFailureThreshold
+	b.failures += n
+	if b.failures < backendFailureThreshold {
+		return
+	}
+	b.downUntil = time.Now().Add(backendCooldown)
+	if wasUp {
+		logWarnf(context.Background(), "Warning: audio backend %s is left out for %s: %v", b.url, backendCooldown, err)
+	}
+	audioBackendUp.Set(b.url, expvarInt(0))
+}
+
+// expvarInt returns an expvar holding n
+func expvarInt(n int64) *expvar.Int {
+	v := new(expvar.Int)
+	v.Set(n)
+	return v
+}
+
+// backendPool is the Whisper servers of one audio URL list
+type backendPool struct {
+	backends []*audioBackend
+	next     atomic.Uint64
+}
+
+// candidates returns the backends to try a request on, in order: the
+// available ones from the one balancing picks, or all of them when none is
+// available
+func (p *backendPool) candidates() []*audioBackend {
+	start := int(p.next.Add(1)-1) % len(p.backends)
+	var up, all []*audioBackend
+	for i := range p.backends {
+		b := p.backends[(start+i)%len(p.backends)]
+		all = append(all, b)
+		if b.available() {
+			up = append(up, b)
+		}
+	}
+	if len(up) == 0 {
+		return all
+	}
+	if config.AudioBalancing == balanceLeastConnections {
+		slices.SortStableFunc(up, func(a, b *audioBackend) int {
+			return int(a.inFlight.Load() - b.inFlight.Load())
+		})
+	}
+	return up
+}
+
+// audioPools are the pools of the audio URL lists in use, by list
+var audioPools = struct {
+	sync.Mutex
+	byList map[string]*backendPool
+}{byList: make(map[string]*backendPool)}
+
+// splitBackendURLs returns the base URLs of a comma-separated list
+func splitBackendURLs(list string) []string {
+	var urls []string
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, strings.TrimSuffix(u, "/"))
+		}
+	}
+	return urls
+}
+
+// validUpstreamURLs reports whether list holds one or more absolute
+// http(s) URLs
+func validUpstreamURLs(list string) bool {
+	urls := splitBackendURLs(list)
+	for _, u := range urls {
+		if !validUpstreamURL(u) {
+			return false
+		}
+	}
+	return len(urls) > 0
+}
+
+// audioPool returns the pool of an audio URL list, nil for a single URL
+func audioPool(list string) *backendPool {
+	urls := splitBackendURLs(list)
+	if len(urls) < 2 {
+		return nil
+	}
+	audioPools.Lock()
+	defer audioPools.Unlock()
+	if p, ok := audioPools.byList[list]; ok {
+		return p
+	}
+	p := &backendPool{}
+	for _, u := range urls {
+		p.backends = append(p.backends, &audioBackend{url: u})
+		audioBackendUp.Set(u, expvarInt(1))
+	}
+	audioPools.byList[list] = p
+	return p
+}
+
+type audioPoolContextKey struct{}
+
+// withAudioBackends balances the Whisper requests made with ctx over the
+// backends of up. Their URL is that of the first backend.
+func withAudioBackends(ctx context.Context, up Upstream) context.Context {
+	if p := audioPool(up.AudioURL); p != nil {
+		return context.WithValue(ctx, audioPoolContextKey{}, p)
+	}
+	return ctx
+}
+
+// balancedTransport sends requests tagged by withAudioBackends to a
+// backend of their pool, failing over to the others
+type balancedTransport struct {
+	next http.RoundTripper
+}
+
+// errBackendTimeout is returned when a backend did not answer within
+// AUDIO_BACKEND_TIMEOUT
+var errBackendTimeout = errors.New("no answer within AUDIO_BACKEND_TIMEOUT")
+
+func (t *balancedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pool, _ := req.Context().Value(audioPoolContextKey{}).(*backendPool)
+	if pool == nil {
+		return t.next.RoundTrip(req)
+	}
+	// A body that cannot be sent again still can when no backend has read
+	// any of it, as when the first could not be reached
+	var body *unsentBody
+	if req.Body != nil && req.GetBody == nil {
+		body = &unsentBody{ReadCloser: req.Body}
+	}
+	suffix := strings.TrimPrefix(req.URL.String(), pool.backends[0].url)
+
+	var lastErr error
+	candidates := pool.candidates()
+	for i, b := range candidates {
+		attempt := req.Clone(req.Context())
+		target, err := url.Parse(b.url + suffix)
+		if err != nil {
+			return nil, err
+		}
+		attempt.URL, attempt.Host = target, ""
+		switch {
+		case body != nil:
+			attempt.Body = body
+		case i > 0 && req.GetBody != nil:
+			if attempt.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := t.send(attempt, b)
+		last := i == len(candidates)-1 || (body != nil && body.read.Load()) || req.Context().Err() != nil
+		switch {
+		case err == nil && resp.StatusCode < http.StatusInternalServerError:
+			b.succeeded()
+			return resp, nil
+		case errors.Is(err, errUpstreamBusy):
+			// The backend is at its concurrency limit, not failing
+		case req.Context().Err() == nil:
+			if err == nil {
+				b.failed(fmt.Errorf("status %d", resp.StatusCode), 1)
+			} else {
+				b.failed(err, 1)
+			}
+		}
+		if last {
+			if body != nil && err != nil {
+				body.ReadCloser.Close()
+			}
+			return resp, err
+		}
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		lastErr = err
+		audioFailovers.Add(1)
+		logWarnf(req.Context(), "Audio backend %s failed (%v), trying %s", b.url, err, candidates[i+1].url)
+	}
+	return nil, lastErr
+}
+
+// send sends an attempt to backend b, giving up when it has not answered
+// within AUDIO_BACKEND_TIMEOUT
+func (t *balancedTransport) send(req *http.Request, b *audioBackend) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	var timer *time.Timer
+	if config.AudioBackendTimeout > 0 {
+		timer = time.AfterFunc(config.AudioBackendTimeout, cancel)
+	}
+	b.inFlight.Add(1)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	// A timer that already fired has canceled the attempt
+	timedOut := timer != nil && !timer.Stop()
+	if err != nil || timedOut {
+		b.inFlight.Add(-1)
+		cancel()
+		if timedOut {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, errBackendTimeout
+		}
+		return nil, err
+	}
+	// The answer is read within the client's timeout
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() {
+		b.inFlight.Add(-1)
+		cancel()
+	}}
+	return resp, nil
+}
+
+// unsentBody is a request body that can be tried on another backend until
+// one reads from it. Closing it is left to the caller.
+type unsentBody struct {
+	io.ReadCloser
+	read atomic.Bool
+}
+
+func (b *unsentBody) Read(p []byte) (int, error) {
+	b.read.Store(true)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *unsentBody) Close() error {
+	return nil
+}
+
+// checkBackend probes a backend, leaving it out when it cannot be reached
+func checkBackend(ctx context.Context, b *audioBackend) {
+	if err := probeBackend(ctx, b.url, backendCheckTimeout); err != nil {
+		// One failed check is enough to stop sending requests
+		b.failed(err, backendFailureThreshold)
+		return
+	}
+	b.succeeded()
+}
+
+// checkBackends checks every backend of the pools in use
+func checkBackends() {
+	audioPools.Lock()
+	var backends []*audioBackend
+	for _, p := range audioPools.byList {
+		backends = append(backends, p.backends...)
+	}
+	audioPools.Unlock()
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkBackend(context.Background(), b)
+		}()
+	}
+	wg.Wait()
+}
+
+// audioBackendsCheck is the /readyz check of the backend pools, reporting
+// which backends requests go to
+func audioBackendsCheck() (CheckResult, bool) {
+	audioPools.Lock()
+	defer audioPools.Unlock()
+	if len(audioPools.byList) == 0 {
+		return CheckResult{}, false
+	}
+	result := CheckResult{OK: true}
+	up := make(map[string]bool)
+	for _, p := range audioPools.byList {
+		available := 0
+		for _, b := range p.backends {
+			up[b.url] = b.available()
+			if up[b.url] {
+				available++
+			}
+		}
+		// Requests still try them all, so the replica stays ready
+		if available == 0 {
+			result.Detail = "every audio backend of a pool is failing"
+		}
+	}
+	result.Data = up
+	return result, true
+}
+
+// initAudioBackends sets up the pools of the configured audio URL lists
+// and starts their health checks
+func initAudioBackends() {
+	lists := []string{config.AudioInferenceURL}
+	for _, route := range tenantRoutes() {
+		lists = append(lists, route.AudioURL)
+	}
+	for _, region := range regions() {
+		lists = append(lists, region.AudioURL)
+	}
+	pools := 0
+	for _, list := range lists {
+		if audioPool(list) != nil {
+			pools++
+		}
+	}
+	if pools == 0 {
+		return
+	}
+	logf(context.Background(), "Audio backends: %d pool(s), balanced %s, failing over after %s", pools, config.AudioBalancing, config.AudioBackendTimeout)
+	if config.AudioHealthCheckInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			checkBackends()
+			time.Sleep(config.AudioHealthCheckInterval)
+		}
+	}()
+}
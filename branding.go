@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Deployments can be white-labeled from the environment: the product name,
+// logo, primary color and footer text are injected into the index page and
+// the server-rendered views, and served at /branding for other clients.
+
+// defaultProductName is shown when BRAND_PRODUCT_NAME is not set
+const defaultProductName = "Audio Transcription"
+
+// brandColorPattern accepts hex colors, the only form injected into CSS
+var brandColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// Branding is the look of the deployment
+type Branding struct {
+	ProductName  string `json:"product_name"`
+	LogoURL      string `json:"logo_url,omitempty"`
+	PrimaryColor string `json:"primary_color,omitempty"`
+	FooterText   string `json:"footer_text,omitempty"`
+	// PrimaryHover is the primary color darkened for hover states
+	PrimaryHover string `json:"-"`
+}
+
+// branding is set by initBranding
+var branding = Branding{ProductName: defaultProductName}
+
+// darken scales a hex color's channels by factor
+func darken(color string, factor float64) string {
+	hex := strings.TrimPrefix(color, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	out := "#"
+	for i := 0; i < 6; i += 2 {
+		v, _ := strconv.ParseUint(hex[i:i+2], 16, 8)
+		out += fmt.Sprintf("%02x", int(float64(v)*factor))
+	}
+	return out
+}
+
+// handleBranding returns the branding as JSON
+func handleBranding(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, branding)
+}
+
+// handleIndex renders the single-page app with the branding
+func handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	ensureBrowserSession(w, r)
+	renderView(w, "index.html", branding)
+}
+
+// initBranding applies the branding settings
+func initBranding() {
+	b := Branding{
+		ProductName:  strings.TrimSpace(config.BrandProductName),
+		LogoURL:      config.BrandLogoURL,
+		PrimaryColor: config.BrandPrimaryColor,
+		FooterText:   config.BrandFooterText,
+	}
+	if b.ProductName == "" {
+		b.ProductName = defaultProductName
+	}
+	if b.PrimaryColor != "" {
+		b.PrimaryHover = darken(b.PrimaryColor, 0.8)
+	}
+	branding = b
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The web UI has no accounts, so each browser gets its own owner ID from a
+// random session cookie, set with the page or on its first request without
+// an API key. Transcriptions, uploads and the history of a browser are
+// those made under its owner ID, and its requests from the app's own pages
+// are interactive (see upstreamlimit.go). The cookie itself is never
+// stored or shown: the owner ID is derived from it, so the created_by of a
+// job does not let anyone act as the browser that made it.
+
+// browserSessionCookie is the name of the session cookie
+const browserSessionCookie = "transcription_session"
+
+// browserSessionMaxAge is how long a browser keeps its session cookie
+const browserSessionMaxAge = 400 * 24 * time.Hour
+
+// browserSession returns the owner ID of the browser that sent r, or ""
+// when it presents no valid session cookie
+func browserSession(r *http.Request) string {
+	cookie, err := r.Cookie(browserSessionCookie)
+	if err != nil || !validBrowserSecret(cookie.Value) {
+		return ""
+	}
+	return browserOwner(cookie.Value)
+}
+
+// ensureBrowserSession returns the owner ID of the browser that sent r,
+// giving it a new session cookie when it has none
+func ensureBrowserSession(w http.ResponseWriter, r *http.Request) string {
+	if owner := browserSession(r); owner != "" {
+		return owner
+	}
+	secret := newID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     browserSessionCookie,
+		Value:    secret,
+		Path:     "/",
+		MaxAge:   int(browserSessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return browserOwner(secret)
+}
+
+// sameOriginRequest reports whether r was sent by a page of the app itself,
+// as browsers tell with Sec-Fetch-Site, or with Origin when they are too
+// old for it
+func sameOriginRequest(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin"
+	}
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && origin.Host != "" && strings.EqualFold(origin.Host, r.Host)
+}
+
+// browserOwner is the owner ID of a session secret
+func browserOwner(secret string) string {
+	return "browser-" + hashAPIKey(secret)[:16]
+}
+
+// validBrowserSecret reports whether secret looks like one made by newID;
+// other cookies are replaced
+func validBrowserSecret(secret string) bool {
+	if len(secret) != 32 {
+		return false
+	}
+	for _, c := range secret {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Offline-capable clients and mirrors keep a copy of the transcripts and
+// sync it incrementally instead of listing everything again. Every change to
+// a transcription is appended to a change log in the state store under the
+// next cursor, a number shared by all replicas, and GET /changes?since=
+// returns the changes after a cursor in order. A client lists the
+// transcriptions once, then polls /changes with the cursor of its last
+// response and fetches the transcriptions that changed. Changes are kept for
+// ARTIFACT_RETENTION; a cursor older than that gets 410 Gone, and the client
+// lists the transcriptions again.
+
+// Change types
+const (
+	changeCreated    = "created"
+	changeEdited     = "edited"
+	changeDeleted    = "deleted"
+	changeSummarized = "summarized"
+)
+
+// Change is an entry of the change log
+type Change struct {
+	Cursor          string `json:"cursor"`
+	Type            string `json:"type"`
+	TranscriptionID string `json:"transcription_id"`
+	// Status is the transcription's status after the change
+	Status    string    `json:"status,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Workspace string    `json:"workspace,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// ChangeFeed is the response of GET /changes
+type ChangeFeed struct {
+	Changes []Change `json:"changes"`
+	// Cursor is the since of the next request
+	Cursor  string `json:"cursor"`
+	HasMore bool   `json:"has_more"`
+}
+
+// changeKeyPrefix namespaces the change log in the state store, and
+// changeCursorKey is the counter the cursors are taken from
+const (
+	changeKeyPrefix = "change:"
+	changeCursorKey = "change-cursor"
+)
+
+// changeSettleTime is how long a cursor taken by another replica may go
+// missing from the log before its change is given up as lost: later changes
+// are held back until then, so a client does not skip past it
+const changeSettleTime = 5 * time.Second
+
+// Limits for listing changes
+const (
+	defaultChangeLimit = 100
+	maxChangeLimit     = 1000
+)
+
+// recordChange appends a change of job to the change log
+func recordChange(kind string, job *Job) {
+	cursor, err := state.incrBy(changeCursorKey, 1, 0)
+	if err != nil {
+		logErrorf(context.Background(), "Error recording %s change of job %s: %v", kind, job.ID, err)
+		return
+	}
+	change := Change{
+		Cursor:          strconv.FormatInt(cursor, 10),
+		Type:            kind,
+		TranscriptionID: job.ID,
+		Tenant:          job.Tenant,
+		Workspace:       job.Workspace,
+		Time:            time.Now().UTC(),
+	}
+	if kind != changeDeleted {
+		change.Status = job.Status
+	}
+	data, err := json.Marshal(change)
+	if err != nil {
+		logErrorf(context.Background(), "Error encoding %s change of job %s: %v", kind, job.ID, err)
+		return
+	}
+	if err := state.set(changeKey(cursor), data, pipelineJobs.retention); err != nil {
+		logErrorf(context.Background(), "Error recording %s change of job %s: %v", kind, job.ID, err)
+	}
+}
+
+// changeKey is the state store key of the change at cursor; cursors are
+// zero-padded so keys sort in order
+func changeKey(cursor int64) string {
+	return fmt.Sprintf("%s%020d", changeKeyPrefix, cursor)
+}
+
+// syncedState is the part of a job clients sync, leaving out the progress
+// of a running job
+func syncedState(job Job) []byte {
+	job.Step, job.Timing, job.QuotaWarnings, job.UpdatedAt = "", nil, nil, time.Time{}
+	data, _ := json.Marshal(job)
+	return data
+}
+
+// recordUpdate records the change an update made to a job, whose synced
+// state and summary were before and summary: summarized when the summary
+// changed, edited when anything else clients sync did
+func recordUpdate(before []byte, summary string, job *Job) {
+	switch {
+	case job.Summary != summary && job.Summary != "":
+		recordChange(changeSummarized, job)
+	case string(syncedState(*job)) != string(before):
+		recordChange(changeEdited, job)
+	}
+}
+
+// oldestChange returns the cursor of the oldest change kept, or the cursor
+// after latest when none is
+func oldestChange(latest int64) (int64, error) {
+	keys, err := state.keys(changeKeyPrefix)
+	if err != nil || len(keys) == 0 {
+		return latest + 1, err
+	}
+	sort.Strings(keys)
+	return strconv.ParseInt(strings.TrimPrefix(keys[0], changeKeyPrefix), 10, 64)
+}
+
+// handleChanges returns the changes to the transcriptions visible to the
+// caller after the cursor ?since=, from the oldest kept without it
+func handleChanges(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var since int64
+	if value := q.Get("since"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			integrationError(w, http.StatusBadRequest, "since must be a cursor returned by /changes")
+			return
+		}
+		since = n
+	}
+	limit := defaultChangeLimit
+	if value := q.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxChangeLimit {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxChangeLimit))
+			return
+		}
+		limit = n
+	}
+
+	latest, err := state.incrBy(changeCursorKey, 0, 0)
+	if err != nil {
+		logErrorf(r.Context(), "Error reading the change cursor: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error reading changes")
+		return
+	}
+	load := func(n int64) (Change, bool, error) {
+		var change Change
+		data, ok, err := state.get(changeKey(n))
+		if err != nil || !ok || json.Unmarshal(data, &change) != nil {
+			return Change{}, false, err
+		}
+		return change, true, nil
+	}
+	// Cursors are consecutive, so the changes after since are read by
+	// their keys; only a first sync looks for the oldest change kept. A
+	// cursor after the latest is from a log reset with the in-memory store.
+	next, gone := since+1, since > latest
+	if since == 0 {
+		next, err = oldestChange(latest)
+	} else if since < latest {
+		// The changes after since have expired when the next one is gone
+		// with since, rather than lost or still being written
+		var kept bool
+		if _, kept, err = load(next); err == nil && !kept {
+			_, kept, err = load(since)
+			gone = !kept
+		}
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Error reading changes: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error reading changes")
+		return
+	}
+	if gone {
+		integrationError(w, http.StatusGone, "The cursor is unknown or has expired; list the transcriptions again and sync from the cursor of a request without since")
+		return
+	}
+
+	p := principalFrom(r.Context())
+	feed := ChangeFeed{Changes: []Change{}}
+	cursor := since
+	for n := next; n <= latest; n++ {
+		if len(feed.Changes) == limit {
+			feed.HasMore = true
+			break
+		}
+		change, ok, err := load(n)
+		if err != nil {
+			logErrorf(r.Context(), "Error loading change %d: %v", n, err)
+			integrationError(w, http.StatusInternalServerError, "Error reading changes")
+			return
+		}
+		if !ok {
+			continue
+		}
+		// A change still being written by another replica is waited for
+		if n != next && time.Since(change.Time) < changeSettleTime {
+			feed.HasMore = true
+			break
+		}
+		cursor, next = n, n+1
+		if p.sees(Job{Tenant: change.Tenant, Workspace: change.Workspace}) {
+			feed.Changes = append(feed.Changes, change)
+		}
+	}
+	feed.Cursor = strconv.FormatInt(cursor, 10)
+	writeJSON(w, http.StatusOK, feed)
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Dispatch radio and push-to-talk apps send a stream of short clips from
+// several people talking in turn. Posted to a channel, each clip is
+// transcribed right away, like a memo, and appended to the channel's
+// rolling log instead of becoming a transcription of its own. The log can
+// be searched, and clips mentioning one of the channel's keywords are
+// flagged and sent to its integration as channel.alert.
+
+// Channel limits
+const (
+	maxChannelKeywords      = 50
+	maxChannelKeywordLength = 60
+	maxChannelSenderLength  = 60
+	defaultChannelLogLimit  = 50
+	maxChannelLogLimit      = 500
+)
+
+// State store namespaces: the clips of each channel's log, keyed by their
+// sequence number so they list in the order they arrived, and the counters
+// numbering them
+const (
+	channelLogKeyPrefix = "channel-log:"
+	channelSeqKeyPrefix = "channel-seq:"
+)
+
+// Channel is a push-to-talk channel whose clips form a rolling log
+type Channel struct {
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	Workspace string `json:"workspace,omitempty"`
+	Language  string `json:"language,omitempty"`
+	// Keywords flag the clips mentioning them, matched as whole words
+	// regardless of case
+	Keywords []string `json:"keywords,omitempty"`
+	// Integration receives channel.alert for flagged clips
+	Integration string `json:"integration,omitempty"`
+}
+
+func (c *Channel) validate() error {
+	if c.Tenant != "" && !knownTenant(c.Tenant) {
+		return fmt.Errorf("tenant %q is not in TENANT_ROUTES", c.Tenant)
+	}
+	// A workspace channel's tenant is the workspace's
+	if c.Workspace != "" && c.Tenant != "" {
+		return errors.New("workspace channels cannot name a tenant")
+	}
+	if c.Language != "" && !localePattern.MatchString(c.Language) {
+		return fmt.Errorf("language %q is not a language tag such as de or pt-BR", c.Language)
+	}
+	if len(c.Keywords) > maxChannelKeywords {
+		return fmt.Errorf("keywords can list at most %d keywords", maxChannelKeywords)
+	}
+	for i, keyword := range c.Keywords {
+		c.Keywords[i] = strings.TrimSpace(keyword)
+		if normalizeChannelText(keyword) == "" || len([]rune(c.Keywords[i])) > maxChannelKeywordLength {
+			return fmt.Errorf("keyword %d needs letters or digits and at most %d characters", i+1, maxChannelKeywordLength)
+		}
+	}
+	if c.Integration != "" && len(c.Keywords) == 0 {
+		return errors.New("integration needs keywords to alert on")
+	}
+	return nil
+}
+
+func (c *Channel) redacted() adminResource {
+	d := *c
+	return &d
+}
+
+// channel returns a declared channel
+func (r *adminRegistry) channel(id string) (*Channel, bool) {
+	res, ok := r.get(kindChannels, id)
+	if !ok {
+		return nil, false
+	}
+	return res.(*Channel), true
+}
+
+// tenant is the tenant the channel's log belongs to
+func (c *Channel) tenant() string {
+	if ws, ok := registry.workspace(c.Workspace); ok {
+		return ws.Tenant
+	}
+	return c.Tenant
+}
+
+// visibleTo reports whether p may see the channel and post to it
+func (c *Channel) visibleTo(p principal) bool {
+	return c.tenant() == p.Tenant && (p.Workspace == "" || c.Workspace == p.Workspace)
+}
+
+// normalizeChannelText lowercases text and turns everything but letters and
+// digits into single spaces, padding it with a space on either side so
+// that whole words can be found with strings.Contains
+func normalizeChannelText(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	return " " + strings.Join(words, " ") + " "
+}
+
+// matchKeywords returns the channel's keywords mentioned in text
+func (c *Channel) matchKeywords(text string) []string {
+	normalized := normalizeChannelText(text)
+	var matched []string
+	for _, keyword := range c.Keywords {
+		if strings.Contains(normalized, normalizeChannelText(keyword)) {
+			matched = append(matched, keyword)
+		}
+	}
+	return matched
+}
+
+// ChannelClip is a transcribed clip in a channel's log
+type ChannelClip struct {
+	Seq      int64     `json:"seq"`
+	Channel  string    `json:"channel"`
+	Sender   string    `json:"sender,omitempty"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration"`
+	Language string    `json:"language,omitempty"`
+	Text     string    `json:"text"`
+	// Alerts are the keywords the clip mentions
+	Alerts []string `json:"alerts,omitempty"`
+}
+
+// channelLogKey is the state store key of a clip; the sequence number is
+// padded so that keys sort in the order clips arrived
+func channelLogKey(channel string, seq int64) string {
+	return fmt.Sprintf("%s%s:%012d", channelLogKeyPrefix, channel, seq)
+}
+
+// channelLog returns a channel's clips, newest first
+func channelLog(channel string) ([]ChannelClip, error) {
+	keys, err := state.keys(channelLogKeyPrefix + channel + ":")
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	clips := make([]ChannelClip, 0, len(keys))
+	for _, key := range keys {
+		data, ok, err := state.get(key)
+		if err != nil {
+			return nil, err
+		}
+		var clip ChannelClip
+		if !ok || json.Unmarshal(data, &clip) != nil {
+			continue
+		}
+		clips = append(clips, clip)
+	}
+	return clips, nil
+}
+
+// alert sends channel.alert about a flagged clip to the channel's
+// integration
+func (c *Channel) alert(clip ChannelClip) {
+	logf(context.Background(), "Channel %s: clip %d mentions %s", c.ID, clip.Seq, strings.Join(clip.Alerts, ", "))
+	integration, ok := registry.integration(c.Integration)
+	if !ok || integration.Disabled {
+		return
+	}
+	event := newCloudEvent(EventChannelAlert, c.ID, map[string]any{
+		"channel":  c.ID,
+		"seq":      clip.Seq,
+		"sender":   clip.Sender,
+		"time":     clip.Time,
+		"text":     clip.Text,
+		"keywords": clip.Alerts,
+	})
+	deliverWebhook(integration, event)
+}
+
+// handleIntegrationChannels lists the channels the caller may see
+func handleIntegrationChannels(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	channels := []*Channel{}
+	for _, res := range registry.list(kindChannels) {
+		if c := res.(*Channel); c.visibleTo(p) {
+			channels = append(channels, c)
+		}
+	}
+	writeJSON(w, http.StatusOK, channels)
+}
+
+// handleChannelClip transcribes a clip posted to a channel and appends it
+// to the log. Form fields: file, and sender naming who spoke. Clips are
+// limited to MEMO_MAX_DURATION and transcribed with the memo models within
+// MEMO_TIMEOUT. A clip without speech is answered but not logged.
+func handleChannelClip(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	channel, ok := registry.channel(r.PathValue("id"))
+	if !ok || !channel.visibleTo(p) {
+		integrationError(w, http.StatusNotFound, "Channel not found")
+		return
+	}
+	if refuseWhileShuttingDown(w, true) || refuseDuringMaintenance(w, true) {
+		return
+	}
+	up, err := upstreamFor(channel.tenant(), tenantRegion(channel.tenant()))
+	if err != nil {
+		logErrorf(r.Context(), "Channel %s: %v", channel.ID, err)
+		integrationError(w, http.StatusServiceUnavailable, regionUnavailableMessage)
+		return
+	}
+	if config.MemoAudioModel != "" {
+		up.AudioModel = config.MemoAudioModel
+	}
+	if _, msg, ok := admitWorkspaceJob(w, channel.Workspace); !ok {
+		integrationError(w, http.StatusTooManyRequests, msg)
+		return
+	}
+	lease, err := requestMemory.tryAdmit(bodyEstimate(min(r.ContentLength, maxMemoSize)))
+	if err != nil {
+		logWarnf(r.Context(), "Channel %s: clip rejected: %v", channel.ID, err)
+		w.Header().Set("Retry-After", "1")
+		integrationError(w, http.StatusServiceUnavailable, "Server is busy, please retry later")
+		return
+	}
+	defer lease.release()
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.MemoTimeout)
+	defer cancel()
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxMemoSize)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		logErrorf(ctx, "Error parsing form: %v", err)
+		integrationError(w, http.StatusBadRequest, "Error parsing form data")
+		return
+	}
+	fields := make(map[string]string)
+	var filename string
+	var audio []byte
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			if part.FormName() == "file" {
+				filename = cleanFilename(part.FileName())
+				audio, err = io.ReadAll(lease.reader(part))
+			} else {
+				err = readFormField(part, fields)
+			}
+		}
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			switch {
+			case errors.As(err, &maxBytesErr):
+				integrationError(w, http.StatusRequestEntityTooLarge, "Clip too large")
+			case errors.Is(err, errMemoryBudgetExceeded):
+				integrationError(w, http.StatusServiceUnavailable, "Server is busy, please retry later")
+			default:
+				logErrorf(ctx, "Error parsing form: %v", err)
+				integrationError(w, http.StatusBadRequest, "Error parsing form data")
+			}
+			return
+		}
+	}
+	if audio == nil {
+		integrationError(w, http.StatusBadRequest, "Error getting file from form")
+		return
+	}
+	sender := strings.TrimSpace(fields["sender"])
+	if len([]rune(sender)) > maxChannelSenderLength {
+		integrationError(w, http.StatusBadRequest, fmt.Sprintf("sender must be at most %d characters", maxChannelSenderLength))
+		return
+	}
+	if sender == "" {
+		sender = p.ID
+	}
+
+	// Walkie apps often send Opus or AAC rather than WAV
+	dir, err := ingestDir(tenantRegion(channel.tenant()))
+	var upload *wavUpload
+	if err == nil {
+		upload, err = prepareUpload(ctx, bytes.NewReader(audio), filename, dir)
+	}
+	if err == nil {
+		audio, err = io.ReadAll(upload)
+		upload.Close()
+	}
+	var duration float64
+	if err == nil {
+		duration, err = wavDuration(audio)
+	}
+	if err != nil {
+		logWarnf(ctx, "Channel %s: clip %s: %v", channel.ID, filename, err)
+		switch {
+		case errors.Is(err, errRegionUnavailable):
+			integrationError(w, http.StatusServiceUnavailable, regionUnavailableMessage)
+		case errors.Is(err, errNoConverter):
+			integrationError(w, http.StatusUnsupportedMediaType, "Only WAV clips are supported: converting other formats requires ffmpeg on the server")
+		default:
+			integrationError(w, http.StatusBadRequest, "Unsupported audio format: send WAV, MP3, M4A, FLAC, OGG or WebM")
+		}
+		return
+	}
+	if duration > config.MemoMaxDuration.Seconds() {
+		integrationError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Clips are limited to %s", config.MemoMaxDuration))
+		return
+	}
+
+	// Number the clip as it arrives, so that the log keeps the order in
+	// which people spoke even when a later clip is transcribed first
+	seq, err := state.incrBy(channelSeqKeyPrefix+channel.ID, 1, 0)
+	if err != nil {
+		logErrorf(ctx, "Channel %s: error numbering clip: %v", channel.ID, err)
+		integrationError(w, http.StatusInternalServerError, "Error adding the clip to the log")
+		return
+	}
+	clip := ChannelClip{Seq: seq, Channel: channel.ID, Sender: sender, Time: time.Now().UTC(), Duration: duration}
+
+	result, err := transcribeAudio(ctx, up, bytes.NewReader(audio), upload.Filename, channel.Language)
+	if err != nil {
+		logErrorf(ctx, "Channel %s: clip %d: %v", channel.ID, seq, err)
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			integrationError(w, http.StatusGatewayTimeout, "Transcription service timed out")
+		case errors.Is(err, errUpstreamBusy):
+			w.Header().Set("Retry-After", strconv.Itoa(int(config.UpstreamQueueTimeout.Seconds())))
+			integrationError(w, http.StatusServiceUnavailable, "Server is busy, please retry later")
+		default:
+			integrationError(w, http.StatusBadGateway, "Error calling transcription service")
+		}
+		return
+	}
+	recordWorkspaceAudio(channel.Workspace, result.Duration)
+	clip.Text = strings.TrimSpace(result.Text)
+	clip.Language = result.Language
+	if result.Duration > 0 {
+		clip.Duration = result.Duration
+	}
+	if clip.Text == "" {
+		writeJSON(w, http.StatusOK, clip)
+		return
+	}
+	clip.Alerts = channel.matchKeywords(clip.Text)
+
+	data, err := json.Marshal(clip)
+	if err == nil {
+		err = state.set(channelLogKey(channel.ID, seq), data, config.ChannelLogRetention)
+	}
+	if err != nil {
+		logErrorf(ctx, "Channel %s: error saving clip %d: %v", channel.ID, seq, err)
+		integrationError(w, http.StatusInternalServerError, "Error adding the clip to the log")
+		return
+	}
+	if len(clip.Alerts) > 0 {
+		channel.alert(clip)
+	}
+	writeJSON(w, http.StatusCreated, clip)
+}
+
+// handleChannelLog returns a channel's log, newest first, as JSON or as
+// text. ?q= searches the text and senders, ?since= (RFC 3339) and
+// ?alerts=true narrow it down and ?limit= caps it.
+func handleChannelLog(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	channel, ok := registry.channel(r.PathValue("id"))
+	if !ok || !channel.visibleTo(p) {
+		integrationError(w, http.StatusNotFound, "Channel not found")
+		return
+	}
+	q := r.URL.Query()
+	limit := defaultChannelLogLimit
+	if value := q.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxChannelLogLimit {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxChannelLogLimit))
+			return
+		}
+		limit = n
+	}
+	var since time.Time
+	if value := q.Get("since"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			integrationError(w, http.StatusBadRequest, "since must be a time such as 2026-10-19T08:00:00Z")
+			return
+		}
+		since = t
+	}
+	search := normalizeChannelText(q.Get("q"))
+	alertsOnly := q.Get("alerts") == "true"
+	format := negotiate(r, mediaJSON, mediaText)
+	if format == "" {
+		integrationError(w, http.StatusNotAcceptable, notAcceptable(mediaJSON, mediaText))
+		return
+	}
+
+	clips, err := channelLog(channel.ID)
+	if err != nil {
+		logErrorf(r.Context(), "Error reading log of channel %s: %v", channel.ID, err)
+		integrationError(w, http.StatusInternalServerError, "Error reading the channel log")
+		return
+	}
+	clips = slices.DeleteFunc(clips, func(clip ChannelClip) bool {
+		return clip.Time.Before(since) ||
+			(alertsOnly && len(clip.Alerts) == 0) ||
+			(search != "" && !strings.Contains(normalizeChannelText(clip.Sender+" "+clip.Text), search))
+	})
+	clips = clips[:min(limit, len(clips))]
+
+	w.Header().Set("Vary", "Accept")
+	if format == mediaText {
+		var b strings.Builder
+		for _, clip := range clips {
+			// One line per clip, as in a radio log
+			fmt.Fprintf(&b, "%s  %s: %s", clip.Time.Format(time.RFC3339), clip.Sender, strings.Join(strings.Fields(clip.Text), " "))
+			if len(clip.Alerts) > 0 {
+				fmt.Fprintf(&b, "  [%s]", strings.Join(clip.Alerts, ", "))
+			}
+			b.WriteString("\n")
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(b.String()))
+		return
+	}
+	writeJSON(w, http.StatusOK, clips)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Whisper backends often reject recordings longer than about 25 minutes, or
+// transcribe them worse. Background jobs therefore split WAV audio longer
+// than AUDIO_CHUNK_DURATION into chunks of at most that length, each cut in
+// the longest pause before its limit so no word is split, send up to
+// AUDIO_CHUNK_PARALLELISM chunks to the backend at once, and stitch the
+// transcripts back together with every segment moved to its time in the
+// whole recording. Chunks are read from the stored file in place. Music
+// found in the recording (see music.go) is left out of the chunks.
+//
+// A chunk the backend fails on is sent once more after the others. If it
+// fails again, the rest of the recording is still transcribed: the chunk
+// becomes a gap, marked in the transcript and listed in its gaps, whose
+// audio can be transcribed again later (see gaps.go).
+
+// chunkSearchWindow is how far before a chunk's limit a pause to cut at is
+// looked for
+const chunkSearchWindow = 30 * time.Second
+
+// chunkRetryDelay is how long failed chunks wait before they are sent once
+// more
+const chunkRetryDelay = 5 * time.Second
+
+// TranscriptGap is a stretch of a recording that could not be transcribed,
+// in seconds
+type TranscriptGap struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// marker is the text standing for the gap in the transcript
+func (g TranscriptGap) marker() string {
+	return fmt.Sprintf("[%.0fs unintelligible/failed at %s]", g.End-g.Start, formatTimestamp(g.Start))
+}
+
+// isGapMarker reports whether text is the marker of a gap
+func isGapMarker(text string) bool {
+	return strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") && strings.Contains(text, " unintelligible/failed at ")
+}
+
+// wavAudio is the layout of a WAV file on disk
+type wavAudio struct {
+	file *os.File
+	// format is the body of the fmt chunk, copied into every chunk
+	format     []byte
+	dataOffset int64
+	dataSize   int64
+	sampleRate int
+	blockAlign int
+	// pcm16 is set for 16-bit PCM, the only encoding pauses are found in
+	pcm16 bool
+}
+
+// readWAV reads the layout of the WAV file f. The data of a streamed file
+// whose recorder never set its size runs to the end of the file.
+func readWAV(f *os.File) (*wavAudio, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	a := &wavAudio{file: f}
+	found, err := walkWAV(f, size, func(id string, body, length int64) (bool, error) {
+		switch id {
+		case "fmt ":
+			a.format = make([]byte, length)
+			if _, err := f.ReadAt(a.format, body); err != nil {
+				return false, err
+			}
+		case "data":
+			if a.format == nil {
+				return false, errWAVFormatLate
+			}
+			encoding := binary.LittleEndian.Uint16(a.format[0:])
+			a.sampleRate = int(binary.LittleEndian.Uint32(a.format[4:]))
+			a.blockAlign = int(binary.LittleEndian.Uint16(a.format[12:]))
+			bits := binary.LittleEndian.Uint16(a.format[14:])
+			if a.sampleRate <= 0 || a.blockAlign <= 0 {
+				return false, errors.New("WAV audio has no sample rate")
+			}
+			// 1 is PCM, 0xfffe the extensible format, PCM in practice
+			a.pcm16 = (encoding == 1 || encoding == 0xfffe) && bits == 16
+			a.dataOffset = body
+			a.dataSize = size - a.dataOffset
+			if length > 0 && length < a.dataSize {
+				a.dataSize = length
+			}
+			a.dataSize -= a.dataSize % int64(a.blockAlign)
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("WAV audio has no data chunk")
+	}
+	return a, nil
+}
+
+// bytesFor is the size of d of audio
+func (a *wavAudio) bytesFor(d time.Duration) int64 {
+	return int64(float64(a.sampleRate)*d.Seconds()) * int64(a.blockAlign)
+}
+
+// seconds is the duration of n bytes of audio
+func (a *wavAudio) seconds(n int64) float64 {
+	return float64(n) / float64(a.blockAlign*a.sampleRate)
+}
+
+// chunk returns the audio from byte start to end of the data as a WAV file
+func (a *wavAudio) chunk(start, end int64) io.Reader {
+	formatSize := len(a.format) + len(a.format)%2
+	var header bytes.Buffer
+	header.WriteString("RIFF")
+	binary.Write(&header, binary.LittleEndian, uint32(4+8+int64(formatSize)+8+end-start))
+	header.WriteString("WAVEfmt ")
+	binary.Write(&header, binary.LittleEndian, uint32(len(a.format)))
+	header.Write(a.format)
+	if len(a.format)%2 == 1 {
+		header.WriteByte(0)
+	}
+	header.WriteString("data")
+	binary.Write(&header, binary.LittleEndian, uint32(end-start))
+	chunk := &wavChunk{header: header.Bytes(), data: io.NewSectionReader(a.file, a.dataOffset+start, end-start)}
+	return io.NewSectionReader(chunk, 0, int64(header.Len())+end-start)
+}
+
+// wavChunk is a WAV header followed by a section of audio data, read at
+// any offset so a chunk can be sent again
+type wavChunk struct {
+	header []byte
+	data   *io.SectionReader
+}
+
+func (c *wavChunk) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	if off < int64(len(c.header)) {
+		n = copy(p, c.header[off:])
+	}
+	if n == len(p) {
+		return n, nil
+	}
+	m, err := c.data.ReadAt(p[n:], off+int64(n)-int64(len(c.header)))
+	return n + m, err
+}
+
+// audioSpan is the audio from byte start to end of the data
+type audioSpan struct {
+	start, end int64
+}
+
+// cuts returns the offsets into the data at which the audio of span is
+// split into chunks of at most length
+func (a *wavAudio) cuts(span audioSpan, length time.Duration) ([]int64, error) {
+	chunkBytes := a.bytesFor(length)
+	windowBytes := a.bytesFor(min(chunkSearchWindow, length/2))
+	frameBytes := max(a.bytesFor(liveFrame), int64(a.blockAlign))
+	window := make([]byte, windowBytes)
+	var cuts []int64
+	for start := span.start; span.end-start > chunkBytes; {
+		from := start + chunkBytes - windowBytes
+		if _, err := a.file.ReadAt(window, a.dataOffset+from); err != nil {
+			return nil, err
+		}
+		start = from + pauseOffset(window, frameBytes)
+		cuts = append(cuts, start)
+	}
+	return cuts, nil
+}
+
+// pauseOffset returns the offset of the middle of the longest run of frames
+// below liveSpeechLevel in audio, or of its quietest frame when nothing in
+// it is quiet enough to be a pause
+func pauseOffset(audio []byte, frameBytes int64) int64 {
+	var pause, pauseFrames, runStart, runFrames int64
+	quietest, quietestLevel := int64(0), math.Inf(1)
+	for offset := int64(0); offset+frameBytes <= int64(len(audio)); offset += frameBytes {
+		level := frameLevel(audio[offset : offset+frameBytes])
+		if level < quietestLevel {
+			quietest, quietestLevel = offset, level
+		}
+		if level >= liveSpeechLevel {
+			runFrames = 0
+			continue
+		}
+		if runFrames == 0 {
+			runStart = offset
+		}
+		runFrames++
+		if runFrames > pauseFrames {
+			pause, pauseFrames = runStart+runFrames/2*frameBytes, runFrames
+		}
+	}
+	if pauseFrames == 0 {
+		return quietest
+	}
+	return pause
+}
+
+// chunkName names chunk i of the audio for the backend
+func chunkName(filename string, i int) string {
+	ext := filepath.Ext(filename)
+	return fmt.Sprintf("%s.part%d%s", strings.TrimSuffix(filename, ext), i+1, ext)
+}
+
+// chunkSpans returns the chunks the audio around the music is transcribed
+// in: the stretches between music, each split when it is longer than
+// AUDIO_CHUNK_DURATION
+func chunkSpans(audio *wavAudio, music []audioSpan) ([]audioSpan, error) {
+	var chunks []audioSpan
+	start := int64(0)
+	for _, stretch := range append(music, audioSpan{audio.dataSize, audio.dataSize}) {
+		if stretch.start > start {
+			var cuts []int64
+			if config.AudioChunkDuration > 0 {
+				var err error
+				if cuts, err = audio.cuts(audioSpan{start, stretch.start}, config.AudioChunkDuration); err != nil {
+					return nil, err
+				}
+			}
+			for _, cut := range append(cuts, stretch.start) {
+				chunks = append(chunks, audioSpan{start, cut})
+				start = cut
+			}
+		}
+		start = stretch.end
+	}
+	return chunks, nil
+}
+
+// transcribeChunks transcribes long audio, or audio with music, in chunks
+// around the music, up to AUDIO_CHUNK_PARALLELISM at a time, and stitches
+// the results with a marker for each stretch of music. Chunks that fail
+// twice are left as gaps; the transcription fails only when all of them do.
+func transcribeChunks(ctx context.Context, up Upstream, audio *wavAudio, filename, language string, music []audioSpan) (*TranscriptionResult, error) {
+	chunks, err := chunkSpans(audio, music)
+	if err != nil {
+		return nil, err
+	}
+	n := len(chunks)
+	logf(ctx, "Transcribing %s (%.0fs) in %d chunks", filename, audio.seconds(audio.dataSize), n)
+
+	results := make([]*TranscriptionResult, n)
+	errs := make([]error, n)
+	transcribe := func(i int) {
+		results[i], errs[i] = transcribeAudio(ctx, up, audio.chunk(chunks[i].start, chunks[i].end), chunkName(filename, i), language)
+	}
+	slots := make(chan struct{}, config.AudioChunkParallelism)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			transcribe(i)
+		}(i)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// Failed chunks are sent once more, one at a time, once the backend
+	// had a moment to recover. When all failed the backend is down, and
+	// the transcription fails at once.
+	if !slices.Contains(errs, nil) {
+		return nil, fmt.Errorf("chunk 1 of %d: %w", n, errs[0])
+	}
+	if slices.ContainsFunc(errs, func(err error) bool { return err != nil }) {
+		select {
+		case <-time.After(chunkRetryDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		logWarnf(ctx, "Chunk %d of %d of %s failed, sending it again: %v", i+1, n, filename, err)
+		if transcribe(i); errs[i] != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			logErrorf(ctx, "Chunk %d of %d of %s failed again, leaving a gap: %v", i+1, n, filename, errs[i])
+			results[i] = nil
+		}
+	}
+	seconds := func(spans []audioSpan) []timeSpan {
+		times := make([]timeSpan, len(spans))
+		for i, s := range spans {
+			times[i] = timeSpan{audio.seconds(s.start), audio.seconds(s.end)}
+		}
+		return times
+	}
+	return stitchTranscripts(results, seconds(chunks), seconds(music), audio.seconds(audio.dataSize)), nil
+}
+
+// timeSpan is a stretch of a recording, in seconds
+type timeSpan struct {
+	start, end float64
+}
+
+// stitchTranscripts joins the transcripts of the chunks of a recording of
+// duration seconds, where chunk i runs over times[i], and marks the
+// stretches of music between them and the chunks that failed, whose
+// result is nil. The language is the first one detected, and the
+// confidence the mean of the chunks' weighted by their length.
+func stitchTranscripts(results []*TranscriptionResult, times, music []timeSpan, duration float64) *TranscriptionResult {
+	stitched := &TranscriptionResult{Duration: roundMillis(duration)}
+	var texts []string
+	var confidence, rated float64
+	// Music before the time at is added in time order
+	addMusicBefore := func(at float64) {
+		for len(music) > 0 && music[0].start < at {
+			texts = append(texts, musicMarker)
+			stitched.Segments = append(stitched.Segments, Segment{ID: len(stitched.Segments), Start: roundMillis(music[0].start), End: roundMillis(music[0].end), Text: musicMarker})
+			music = music[1:]
+		}
+	}
+	for i, result := range results {
+		addMusicBefore(times[i].start)
+		if result == nil {
+			gap := TranscriptGap{Start: roundMillis(times[i].start), End: roundMillis(times[i].end)}
+			texts = append(texts, gap.marker())
+			stitched.Segments = append(stitched.Segments, Segment{ID: len(stitched.Segments), Start: gap.Start, End: gap.End, Text: gap.marker()})
+			stitched.Gaps = append(stitched.Gaps, gap)
+			continue
+		}
+		if result.Confidence > 0 {
+			confidence += result.Confidence * (times[i].end - times[i].start)
+			rated += times[i].end - times[i].start
+		}
+		if text := strings.TrimSpace(result.Text); text != "" {
+			texts = append(texts, text)
+		}
+		if stitched.Language == "" {
+			stitched.Language = result.Language
+		}
+		for _, segment := range result.Segments {
+			segment.ID = len(stitched.Segments)
+			segment.Start = roundMillis(min(segment.Start+times[i].start, times[i].end))
+			segment.End = roundMillis(min(segment.End+times[i].start, times[i].end))
+			stitched.Segments = append(stitched.Segments, segment)
+		}
+	}
+	addMusicBefore(math.Inf(1))
+	stitched.Text = strings.Join(texts, " ")
+	if rated > 0 {
+		stitched.Confidence = math.Round(confidence/rated*1000) / 1000
+	}
+	tagSegmentLanguages(stitched)
+	return stitched
+}
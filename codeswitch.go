@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Speakers switch languages mid-recording, and Whisper reports only one
+// language for the whole transcript. Every segment is therefore tagged with
+// its own language: the one the backend reports for it, or one detected
+// from its text, by its script or, in Latin script, by its most frequent
+// function words. Segments too short to tell take the language around them.
+// A transcript in more than one language lists them in spoken_languages,
+// its paragraphs break where the language changes, and summaries of mixed
+// text are asked for in one language. CODE_SWITCHING=false turns it off.
+
+// Latin-script segments need this many words, and this many more function
+// word hits than any other language, to be detected; a language other than
+// the transcript's takes switchMinHits
+const (
+	detectMinWords = 3
+	detectMinHits  = 2
+	switchMinHits  = 3
+)
+
+// minLanguageShare is the share of the text a second language needs before
+// a text is taken to be mixed, so a borrowed phrase does not count
+const minLanguageShare = 0.1
+
+// languageNames maps the languages detected, and the names Whisper reports
+// languages by, to language codes
+var languageNames = map[string]string{
+	"english": "en", "german": "de", "spanish": "es", "french": "fr",
+	"italian": "it", "portuguese": "pt", "dutch": "nl", "russian": "ru",
+	"ukrainian": "uk", "greek": "el", "hebrew": "he", "arabic": "ar",
+	"hindi": "hi", "thai": "th", "japanese": "ja", "korean": "ko",
+	"chinese": "zh",
+}
+
+// functionWords are frequent short words that tell Latin-script languages
+// apart. Words shared by several languages count for each.
+var functionWords = map[string][]string{
+	"en": {"the", "and", "is", "are", "you", "that", "this", "was", "with", "have", "for", "not", "it", "we", "what", "of", "to", "in", "be", "they"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ich", "wir", "sie", "ein", "eine", "mit", "auf", "für", "auch", "es", "zu", "den", "dem", "sind"},
+	"es": {"el", "la", "los", "las", "que", "y", "es", "en", "de", "un", "una", "por", "con", "para", "no", "se", "lo", "pero", "está", "muy"},
+	"fr": {"le", "la", "les", "et", "est", "que", "un", "une", "des", "du", "pour", "pas", "je", "nous", "vous", "ce", "dans", "sur", "avec", "il"},
+	"it": {"il", "lo", "la", "che", "e", "è", "di", "un", "una", "per", "non", "sono", "con", "del", "della", "gli", "anche", "ma", "questo", "ho"},
+	"pt": {"o", "a", "os", "as", "que", "e", "é", "de", "um", "uma", "para", "não", "com", "do", "da", "em", "mas", "você", "está", "isso"},
+	"nl": {"de", "het", "een", "en", "is", "niet", "ik", "wij", "we", "je", "dat", "van", "op", "met", "voor", "ook", "zijn", "maar", "er", "wat"},
+}
+
+// functionWordLanguages indexes functionWords by word
+var functionWordLanguages = func() map[string][]string {
+	index := make(map[string][]string)
+	for language, words := range functionWords {
+		for _, word := range words {
+			index[word] = append(index[word], language)
+		}
+	}
+	return index
+}()
+
+// languageCode returns the code of a language as the backend reports it,
+// by code or by name, "" when it is not known
+func languageCode(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if code, ok := languageNames[language]; ok {
+		return code
+	}
+	if localePattern.MatchString(language) {
+		return language
+	}
+	return ""
+}
+
+// scriptLanguage returns the language of text written in a script used by
+// one language, "" for Latin script or when it cannot tell
+func scriptLanguage(text string) string {
+	counts := make(map[string]int)
+	letters := 0
+	kana := false
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana = true
+			counts["ja"]++
+		case unicode.Is(unicode.Han, r):
+			counts["zh"]++
+		case unicode.Is(unicode.Hangul, r):
+			counts["ko"]++
+		case strings.ContainsRune("іїєґІЇЄҐ", r):
+			counts["uk"]++
+		case unicode.Is(unicode.Cyrillic, r):
+			counts["ru"]++
+		case unicode.Is(unicode.Greek, r):
+			counts["el"]++
+		case unicode.Is(unicode.Hebrew, r):
+			counts["he"]++
+		case unicode.Is(unicode.Arabic, r):
+			counts["ar"]++
+		case unicode.Is(unicode.Devanagari, r):
+			counts["hi"]++
+		case unicode.Is(unicode.Thai, r):
+			counts["th"]++
+		}
+	}
+	// Japanese mixes kanji with kana, and Ukrainian is told from Russian
+	// by its own letters
+	if kana {
+		counts["ja"] += counts["zh"]
+		delete(counts, "zh")
+	}
+	if counts["uk"] > 0 {
+		counts["uk"] += counts["ru"]
+		delete(counts, "ru")
+	}
+	best, bestCount := "", 0
+	for language, count := range counts {
+		if count > bestCount || count == bestCount && language < best {
+			best, bestCount = language, count
+		}
+	}
+	if letters == 0 || bestCount*2 < letters {
+		return ""
+	}
+	return best
+}
+
+// detectLanguage returns the language of a piece of text and how sure the
+// guess is, in function word hits over the runner-up; "" when it cannot
+// tell
+func detectLanguage(text string) (string, int) {
+	if language := scriptLanguage(text); language != "" {
+		return language, switchMinHits
+	}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if len(words) < detectMinWords {
+		return "", 0
+	}
+	hits := make(map[string]int)
+	for _, word := range words {
+		for _, language := range functionWordLanguages[word] {
+			hits[language]++
+		}
+	}
+	best := ""
+	for language, n := range hits {
+		if best == "" || n > hits[best] || n == hits[best] && language < best {
+			best = language
+		}
+	}
+	second := 0
+	for language, n := range hits {
+		if language != best {
+			second = max(second, n)
+		}
+	}
+	if best == "" || hits[best] < detectMinHits || hits[best] == second {
+		return "", 0
+	}
+	return best, hits[best] - second
+}
+
+// tagSegmentLanguages sets the language of every segment of a transcript
+// and lists the languages of a mixed one in SpokenLanguages. Segments keep
+// the language the backend reported for them.
+func tagSegmentLanguages(result *TranscriptionResult) {
+	if !config.CodeSwitching || len(result.Segments) == 0 {
+		return
+	}
+	base := languageCode(result.Language)
+	for i := range result.Segments {
+		seg := &result.Segments[i]
+		if seg.Text == musicMarker || isGapMarker(seg.Text) {
+			// Music and gaps are in no language
+			continue
+		}
+		if seg.Language = languageCode(seg.Language); seg.Language != "" {
+			continue
+		}
+		language, margin := detectLanguage(seg.Text)
+		switch {
+		case language == "zh" && base == "ja":
+			// Kanji without kana
+			language = base
+		case language != base && margin < switchMinHits:
+			// Leaving the transcript's language takes more evidence
+			// than staying in it
+			language = ""
+		}
+		seg.Language = language
+	}
+
+	// Segments too short to tell take the language before them, and those
+	// before the first one told the language of that one
+	last := base
+	for _, seg := range result.Segments {
+		if seg.Language != "" {
+			last = seg.Language
+			break
+		}
+	}
+	for i := range result.Segments {
+		if result.Segments[i].Text == musicMarker || isGapMarker(result.Segments[i].Text) {
+			continue
+		}
+		if result.Segments[i].Language == "" {
+			result.Segments[i].Language = last
+		}
+		last = result.Segments[i].Language
+	}
+
+	shares := make(map[string]int)
+	for _, seg := range result.Segments {
+		if seg.Language != "" {
+			shares[seg.Language] += len([]rune(strings.TrimSpace(seg.Text)))
+		}
+	}
+	result.SpokenLanguages = mixedLanguages(shares)
+}
+
+// mixedLanguages returns the languages of a text with shares of it in
+// characters, most spoken first, when more than one has at least
+// minLanguageShare; nil otherwise
+func mixedLanguages(shares map[string]int) []string {
+	total := 0
+	for _, n := range shares {
+		total += n
+	}
+	var languages []string
+	for language, n := range shares {
+		if total > 0 && float64(n)/float64(total) >= minLanguageShare {
+			languages = append(languages, language)
+		}
+	}
+	if len(languages) < 2 {
+		return nil
+	}
+	sort.Slice(languages, func(i, j int) bool {
+		a, b := shares[languages[i]], shares[languages[j]]
+		return a > b || a == b && languages[i] < languages[j]
+	})
+	return languages
+}
+
+// textLanguages returns the languages of a mixed text, detected sentence by
+// sentence, most spoken first; nil when the text is in one language
+func textLanguages(text string) []string {
+	if !config.CodeSwitching {
+		return nil
+	}
+	shares := make(map[string]int)
+	for _, sentence := range strings.FieldsFunc(text, func(r rune) bool {
+		return strings.ContainsRune(".?!…。？！\n", r)
+	}) {
+		if language, margin := detectLanguage(sentence); language != "" && margin >= detectMinHits {
+			shares[language] += len([]rune(strings.TrimSpace(sentence)))
+		}
+	}
+	return mixedLanguages(shares)
+}
+
+// languageName names a language code in English for prompts
+func languageName(code string) string {
+	for name, c := range languageNames {
+		if c == code {
+			return strings.ToUpper(name[:1]) + name[1:]
+		}
+	}
+	return code
+}
+
+// mixedLanguageInstruction tells the LLM how to summarize text that
+// switches between languages, "" for text in one language
+func mixedLanguageInstruction(text string) string {
+	languages := textLanguages(text)
+	if languages == nil {
+		return ""
+	}
+	names := make([]string, len(languages))
+	for i, code := range languages {
+		names[i] = languageName(code)
+	}
+	return fmt.Sprintf(" The transcription switches between %s. Summarize all of it, whatever the language, and write the summary in %s, the language spoken most. Keep names and quoted terms as they were spoken.",
+		strings.Join(names, " and "), names[0])
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The configuration is checked as a whole before the server starts: values
+// that cannot be parsed, URLs, ports, settings outside their range and
+// settings that need another one are all collected, and the server exits
+// listing every problem with a hint on how to fix it, instead of stopping
+// at the first one and leaving the next for another restart.
+
+// configProblem is a setting that keeps the server from starting
+type configProblem struct {
+	Key     string
+	Problem string
+	Hint    string
+}
+
+// configProblems are the problems found while loading the configuration
+var configProblems []configProblem
+
+// addConfigProblem records a problem with the setting key
+func addConfigProblem(key, problem, hint string) {
+	configProblems = append(configProblems, configProblem{Key: key, Problem: problem, Hint: hint})
+}
+
+// checkConfig validates c and exits listing every problem, including those
+// found while parsing the environment
+func checkConfig(c *Config) {
+	validateConfig(c)
+	if len(configProblems) == 0 {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Invalid configuration, %d problem(s):", len(configProblems))
+	for _, p := range configProblems {
+		fmt.Fprintf(&b, "\n  %s: %s", p.Key, p.Problem)
+		if p.Hint != "" {
+			fmt.Fprintf(&b, "\n      %s", p.Hint)
+		}
+	}
+	log.Fatal(b.String())
+}
+
+// checkURL reports a value of key that is not an absolute URL with one of
+// the schemes
+func checkURL(key, value, hint string, schemes ...string) {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		addConfigProblem(key, fmt.Sprintf("%q is not an absolute URL", value), hint)
+		return
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return
+		}
+	}
+	addConfigProblem(key, fmt.Sprintf("scheme %q is not supported (expected %s)", u.Scheme, strings.Join(schemes, " or ")), hint)
+}
+
+// checkShare reports a value of key outside [0, 1]
+func checkShare(key string, value float64) {
+	if value < 0 || value > 1 {
+		addConfigProblem(key, fmt.Sprintf("%g is not between 0 and 1", value), "Use a share such as 0.25 for a quarter")
+	}
+}
+
+// validateConfig records the problems of settings that parsed but cannot
+// work, alone or together
+func validateConfig(c *Config) {
+	// Backends
+	if c.AudioInferenceURL == "" {
+		addConfigProblem("AUDIO_INFERENCE_URL", "is required", "Set it to the base URL of the Whisper API, such as http://localhost:8000")
+	} else {
+		for _, u := range splitBackendURLs(c.AudioInferenceURL) {
+			checkURL("AUDIO_INFERENCE_URL", u, "Use the base URL of the Whisper API, such as http://localhost:8000, or several separated by commas", "http", "https")
+		}
+	}
+	if c.LLMInferenceURL == "" {
+		addConfigProblem("LLM_INFERENCE_URL", "is required", "Set it to the base URL of the LLM API, such as http://localhost:8001")
+	} else {
+		checkURL("LLM_INFERENCE_URL", c.LLMInferenceURL, "Use the base URL of the LLM API, such as http://localhost:8001", "http", "https")
+	}
+	for _, h := range []struct{ key, value string }{{"AUDIO_API_KEY_HEADER", c.AudioAPIKeyHeader}, {"LLM_API_KEY_HEADER", c.LLMAPIKeyHeader}} {
+		if !headerNamePattern.MatchString(h.value) {
+			addConfigProblem(h.key, fmt.Sprintf("%q is not a header name", h.value), "Use a header name such as Authorization or api-key")
+		}
+	}
+	switch c.AudioResponseFormat {
+	case "verbose_json", "json", "text":
+	default:
+		addConfigProblem("AUDIO_RESPONSE_FORMAT", fmt.Sprintf("%q is not supported", c.AudioResponseFormat), "Use verbose_json, or json or text for backends without segment timestamps")
+	}
+	if c.AudioChunkDuration < 0 || c.AudioChunkDuration > 0 && c.AudioChunkDuration < time.Minute {
+		addConfigProblem("AUDIO_CHUNK_DURATION", fmt.Sprintf("%s is shorter than a minute", c.AudioChunkDuration), "Use a duration the backend accepts, such as 10m, or 0 to never split recordings")
+	}
+	if c.AudioChunkParallelism < 1 {
+		addConfigProblem("AUDIO_CHUNK_PARALLELISM", "must be at least 1", "Use the number of chunks of a recording transcribed at once, 2 by default")
+	}
+	switch c.AudioEnhancer {
+	case enhancerFFT:
+	case enhancerRNNoise:
+		if c.AudioEnhancerModel == "" {
+			addConfigProblem("AUDIO_ENHANCER_MODEL", "is required with AUDIO_ENHANCER=rnnoise", "Set it to an RNNoise model file (.rnnn), such as one from github.com/GregorR/rnnoise-models")
+		} else if _, err := os.Stat(c.AudioEnhancerModel); err != nil {
+			addConfigProblem("AUDIO_ENHANCER_MODEL", fmt.Sprintf("cannot be read: %v", err), "Set it to an RNNoise model file (.rnnn) the server can read")
+		}
+	case enhancerEndpoint:
+		if c.AudioEnhancerURL == "" {
+			addConfigProblem("AUDIO_ENHANCER_URL", "is required with AUDIO_ENHANCER=endpoint", "Set it to the URL WAV audio is posted to for enhancement")
+		} else {
+			checkURL("AUDIO_ENHANCER_URL", c.AudioEnhancerURL, "Use the URL WAV audio is posted to, such as http://enhancer:8000/enhance", "http", "https")
+		}
+	default:
+		addConfigProblem("AUDIO_ENHANCER", fmt.Sprintf("%q is not an enhancer", c.AudioEnhancer), "Use fft, rnnoise or endpoint")
+	}
+	if c.MusicSkipping && c.MusicMinDuration < 5*time.Second {
+		addConfigProblem("MUSIC_MIN_DURATION", fmt.Sprintf("%s is shorter than 5s", c.MusicMinDuration), "Use the shortest music left out of transcripts, 20s by default")
+	}
+	if c.ShutdownTimeout <= 0 {
+		addConfigProblem("SHUTDOWN_TIMEOUT", "must be positive", "Use how long uploads in flight may take to finish on shutdown, such as 2m")
+	}
+	if c.ShutdownDelay < 0 || c.ShutdownDelay >= c.ShutdownTimeout && c.ShutdownTimeout > 0 {
+		addConfigProblem("SHUTDOWN_DELAY", fmt.Sprintf("%s is not shorter than SHUTDOWN_TIMEOUT", c.ShutdownDelay), "Use a few seconds, such as 5s, or 0 to stop listening at once")
+	}
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		addConfigProblem("PORT", fmt.Sprintf("%q is not a port number", c.Port), "Use a number between 1 and 65535, such as 8080")
+	}
+	if c.StaticDir != "" {
+		for _, dir := range []string{"static", "templates", i18nDir} {
+			if info, err := os.Stat(filepath.Join(c.StaticDir, dir)); err != nil || !info.IsDir() {
+				addConfigProblem("STATIC_DIR", fmt.Sprintf("%q has no %s directory", c.StaticDir, dir), "Use a directory laid out as the repository, such as a checkout of it, or unset STATIC_DIR to use the built-in assets")
+				break
+			}
+		}
+	}
+
+	// Storage and shared state
+	if c.DiskUsageThreshold <= 0 || c.DiskUsageThreshold > 100 {
+		addConfigProblem("DISK_USAGE_THRESHOLD", fmt.Sprintf("%g is not a percentage", c.DiskUsageThreshold), "Use a percentage above 0 and up to 100, such as 90")
+	}
+	if c.ObjectStorageBucket != "" {
+		if c.ObjectStorageEndpoint != "" {
+			checkURL("OBJECT_STORAGE_ENDPOINT", c.ObjectStorageEndpoint, "Use the S3 API URL without the bucket, such as http://minio:9000, or leave it unset for AWS S3", "http", "https")
+		}
+		if c.ObjectStorageAccessKey.Value() == "" || c.ObjectStorageSecretKey.Value() == "" {
+			addConfigProblem("OBJECT_STORAGE_ACCESS_KEY", "OBJECT_STORAGE_ACCESS_KEY and OBJECT_STORAGE_SECRET_KEY are required with OBJECT_STORAGE_BUCKET", "Set the access key of a user allowed to put, get and delete objects in the bucket")
+		}
+		// The longest expiry Signature Version 4 allows
+		if c.ObjectStorageURLExpiry > 7*24*time.Hour {
+			addConfigProblem("OBJECT_STORAGE_URL_EXPIRY", fmt.Sprintf("%s is longer than 7 days", c.ObjectStorageURLExpiry), "Use how long clients have to upload a file, such as 1h")
+		}
+	}
+
+	// Data residency: content of a tenant pinned to an undeclared region is
+	// refused, so such a route is a mistake
+	declared, err := parseRegions(c.Regions.Value())
+	if err != nil {
+		addConfigProblem("REGIONS", err.Error(), `Use a JSON object of regions, such as {"eu": {"audio_url": "...", "llm_url": "...", "storage_dir": "/data/eu"}}`)
+	}
+	var pinned map[string]struct {
+		Region string `json:"region"`
+	}
+	if json.Unmarshal([]byte(c.TenantRoutes.Value()), &pinned) == nil {
+		for tenant, route := range pinned {
+			if _, ok := declared[route.Region]; route.Region != "" && err == nil && !ok {
+				addConfigProblem("TENANT_ROUTES", fmt.Sprintf("tenant %q is pinned to region %q, which REGIONS does not declare", tenant, route.Region), "Declare the region in REGIONS, or move the tenant's content and unpin it")
+			}
+		}
+	}
+
+	switch c.StateStore {
+	case "file", "memory":
+	case "redis":
+		if c.RedisURL.Value() == "" {
+			addConfigProblem("REDIS_URL", "is required with STATE_STORE=redis", "Set it to the Redis server, such as redis://redis:6379/0")
+		}
+	default:
+		addConfigProblem("STATE_STORE", fmt.Sprintf("%q is not supported", c.StateStore), "Use file, memory, or redis with REDIS_URL")
+	}
+	if c.TranscriptHistoryRetention < 0 {
+		addConfigProblem("TRANSCRIPT_HISTORY_RETENTION", "must not be negative", "Use how long the history is kept, such as 2160h, or 0 to keep it")
+	}
+	if c.ShareCacheTTL < 0 || c.ShareCacheSize < 0 {
+		addConfigProblem("SHARE_CACHE_TTL", "SHARE_CACHE_TTL and SHARE_CACHE_SIZE must not be negative", "Use how long share pages are cached, such as 1m, and how many, such as 1000; 0 turns the cache off")
+	}
+	if c.LiveMaxSessions < 0 {
+		addConfigProblem("LIVE_MAX_SESSIONS", "must not be negative", "Use the number of live sessions this replica may run at once, or 0 for no limit")
+	}
+	if c.LiveVADThreshold >= 0 || c.LiveVADThreshold < -90 {
+		addConfigProblem("LIVE_VAD_THRESHOLD", fmt.Sprintf("%g is not between -90 and 0 dBFS", c.LiveVADThreshold), "Use a level such as -36; lower values count quieter audio as speech")
+	}
+	if c.LiveMaxBitrate < 0 || (c.LiveMaxBitrate > 0 && c.LiveMaxBitrate < minLiveSampleRate*16/1000) {
+		addConfigProblem("LIVE_MAX_BITRATE", fmt.Sprintf("%d kbit/s is below the lowest live sample rate", c.LiveMaxBitrate), fmt.Sprintf("Use at least %d, 256 for 16 kHz audio, or 0 for no limit", minLiveSampleRate*16/1000))
+	}
+	if c.LivePartialInterval <= 0 {
+		addConfigProblem("LIVE_PARTIAL_INTERVAL", "must be positive", "Use how often partial live text is refreshed, such as 2s")
+	}
+	if c.ShareMaxRenders < 1 {
+		addConfigProblem("SHARE_MAX_RENDERS", "must be at least 1", "Use the number of share pages rendered at once, 8 by default")
+	}
+	switch c.ServeMode {
+	case serveModeAll:
+	case serveModeShares:
+		if c.StateStore != "redis" && c.ShareStoreURL.Value() == "" {
+			addConfigProblem("SERVE_MODE", "shares needs the Redis store of the app", "Set STATE_STORE=redis with the app's REDIS_URL, or SHARE_STORE_URL to a replica of it")
+		}
+	default:
+		addConfigProblem("SERVE_MODE", fmt.Sprintf("%q is not a serve mode", c.ServeMode), "Use all, or shares to serve nothing but share links")
+	}
+	switch c.LeaderElection {
+	case "", "file", "kubernetes":
+	default:
+		addConfigProblem("LEADER_ELECTION", fmt.Sprintf("%q is not supported", c.LeaderElection), "Use kubernetes or file, or leave it empty for a single replica")
+	}
+
+	// Events and webhooks
+	if busURL := c.EventBusURL.Value(); busURL != "" {
+		switch c.EventBus {
+		case "nats":
+			if _, _, err := parseNATSURL(busURL); err != nil {
+				addConfigProblem("EVENT_BUS_URL", "is not a NATS URL", "Use nats://[user:password@]host:4222")
+			}
+		case "kafka":
+			checkURL("EVENT_BUS_URL", busURL, "Use the URL of the Kafka REST proxy, such as http://kafka-rest:8082", "http", "https")
+		default:
+			addConfigProblem("EVENT_BUS", fmt.Sprintf("%q is not supported", c.EventBus), "Use nats or kafka")
+		}
+	}
+	if _, ok := hmacAlgorithms[c.HMACAlgorithm]; !ok {
+		addConfigProblem("HMAC_ALGORITHM", fmt.Sprintf("%q is not supported", c.HMACAlgorithm), "Use sha256, sha384 or sha512")
+	}
+	for _, entry := range strings.Split(c.EgressAllowlist, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(entry); err != nil {
+			addConfigProblem("EGRESS_ALLOWLIST", fmt.Sprintf("%q is not a host:port", entry), "List hosts with their port, such as nats:4222,hooks.example.com:443")
+		}
+	}
+
+	// Digest emails need a mail server, and their settings are unused
+	// without one
+	if smtpURL := c.SMTPURL.Value(); smtpURL != "" {
+		checkURL("SMTP_URL", smtpURL, "Use smtp://[user:password@]host:587, or smtps:// for implicit TLS", "smtp", "smtps")
+		if _, err := mail.ParseAddress(c.DigestFrom); err != nil {
+			addConfigProblem("DIGEST_FROM", fmt.Sprintf("%q is not an email address", c.DigestFrom), "Use an address such as transcripts@example.com")
+		}
+		if c.DigestHour < 0 || c.DigestHour > 23 {
+			addConfigProblem("DIGEST_HOUR", fmt.Sprintf("%d is not an hour", c.DigestHour), "Use an hour between 0 and 23 (UTC)")
+		}
+	} else {
+		for _, key := range []string{"DIGEST_FROM", "DIGEST_HOUR"} {
+			if os.Getenv(key) != "" {
+				addConfigProblem(key, "is set but SMTP_URL is not", "Set SMTP_URL to send digest emails, or unset "+key)
+			}
+		}
+	}
+	if c.PublicURL != "" {
+		checkURL("PUBLIC_URL", c.PublicURL, "Use the URL users reach the server at, such as https://transcripts.example.com", "http", "https")
+	}
+
+	// Web UI
+	if c.BrandLogoURL != "" {
+		u, err := url.Parse(c.BrandLogoURL)
+		if err != nil || !(u.Scheme == "https" || u.Scheme == "http" || (u.Scheme == "" && strings.HasPrefix(u.Path, "/"))) {
+			addConfigProblem("BRAND_LOGO_URL", fmt.Sprintf("%q is not an http(s) URL or an absolute path", c.BrandLogoURL), "Use a URL such as https://example.com/logo.svg or a path such as /static/logo.svg")
+		}
+	}
+	if c.BrandPrimaryColor != "" && !brandColorPattern.MatchString(c.BrandPrimaryColor) {
+		addConfigProblem("BRAND_PRIMARY_COLOR", fmt.Sprintf("%q is not a hex color", c.BrandPrimaryColor), "Use a color such as #0066cc")
+	}
+	if !localePattern.MatchString(c.UIDefaultLocale) {
+		addConfigProblem("UI_DEFAULT_LOCALE", fmt.Sprintf("%q is not a language tag", c.UIDefaultLocale), "Use a tag such as de or pt-BR")
+	}
+
+	// Workers and limits
+	if c.JobWorkers < 1 {
+		addConfigProblem("JOB_WORKERS", "must be at least 1", "Use the number of jobs transcribed at once, 4 by default")
+	}
+	if !validTruncation(c.SummaryTruncation) {
+		addConfigProblem("SUMMARY_TRUNCATION", fmt.Sprintf("%q is not a strategy", c.SummaryTruncation), "Use head, tail, smart-extract or chunked")
+	}
+	checkShare("INTERACTIVE_RESERVED_SHARE", c.InteractiveReservedShare)
+	if c.AudioBalancing != balanceRoundRobin && c.AudioBalancing != balanceLeastConnections {
+		addConfigProblem("AUDIO_BALANCING", fmt.Sprintf("%q is not a strategy", c.AudioBalancing), "Use round-robin or least-connections")
+	}
+	checkShare("QUOTA_WARNING_THRESHOLD", c.QuotaWarningThreshold)
+	checkShare("DUPLICATE_THRESHOLD", c.DuplicateThreshold)
+	checkShare("LANGUAGE_FALLBACK_CONFIDENCE", c.LanguageFallbackConfidence)
+
+	if !validLogLevel(c.LogLevel) {
+		addConfigProblem("LOG_LEVEL", fmt.Sprintf("%q is not a log level", c.LogLevel), "Use info, warn or error")
+	}
+	if !validLogFormat(c.LogFormat) {
+		addConfigProblem("LOG_FORMAT", fmt.Sprintf("%q is not a log format", c.LogFormat), "Use json, or text for key=value lines")
+	}
+
+	// Telemetry
+	if c.Telemetry && c.TelemetryRetentionDays < 1 {
+		addConfigProblem("TELEMETRY_RETENTION_DAYS", "must be at least 1", "Use the number of days counts are kept, 90 by default")
+	}
+	if c.TelemetryReportURL != "" {
+		checkURL("TELEMETRY_REPORT_URL", c.TelemetryReportURL, "Use the https URL reports are posted to", "http", "https")
+		if !c.Telemetry {
+			addConfigProblem("TELEMETRY_REPORT_URL", "is set but TELEMETRY is not enabled", "Set TELEMETRY=true to send reports, or unset TELEMETRY_REPORT_URL")
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EventConsentRecorded is recorded in the user's audit trail only
+const EventConsentRecorded = "consent.recorded"
+
+// Consent records who agreed to a recording being transcribed, when and
+// under which jurisdiction's rules
+type Consent struct {
+	ConsentedBy  string    `json:"consented_by"`
+	ConsentedAt  time.Time `json:"consented_at"`
+	Jurisdiction string    `json:"jurisdiction"`
+	// Method is how consent was collected, e.g. "verbal", "banner" or "ivr"
+	Method string `json:"method,omitempty"`
+}
+
+// maxConsentClockSkew tolerates callers whose clocks run slightly ahead
+const maxConsentClockSkew = 5 * time.Minute
+
+// validate checks the record and defaults the time to now
+func (c *Consent) validate() error {
+	if strings.TrimSpace(c.ConsentedBy) == "" {
+		return errors.New("consent.consented_by is required")
+	}
+	if strings.TrimSpace(c.Jurisdiction) == "" {
+		return errors.New("consent.jurisdiction is required")
+	}
+	if c.ConsentedAt.IsZero() {
+		c.ConsentedAt = time.Now().UTC()
+	}
+	if c.ConsentedAt.After(time.Now().Add(maxConsentClockSkew)) {
+		return errors.New("consent.consented_at is in the future")
+	}
+	return nil
+}
+
+// disclosureFooter is appended to exported transcripts when
+// RECORDING_DISCLOSURE is set: the disclosure followed by the consent
+// recorded for the transcript, if any
+func disclosureFooter(consent *Consent) string {
+	if config.RecordingDisclosure == "" {
+		return ""
+	}
+	line := "Consent: not recorded"
+	if consent != nil {
+		line = fmt.Sprintf("Consent: given by %s on %s (jurisdiction: %s", consent.ConsentedBy, consent.ConsentedAt.UTC().Format(time.RFC3339), consent.Jurisdiction)
+		if consent.Method != "" {
+			line += ", method: " + consent.Method
+		}
+		line += ")"
+	}
+	return config.RecordingDisclosure + "\n" + line
+}
+
+// handleDisclosure serves the disclosure the web UI shows as a banner
+// before anything is recorded
+func handleDisclosure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"disclosure": config.RecordingDisclosure})
+}
+
+// handleIntegrationConsent records consent for an existing transcription
+func handleIntegrationConsent(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	job, ok := pipelineJobs.get(id)
+	if !ok || !principalFrom(r.Context()).sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	if !principalFrom(r.Context()).owns(job) {
+		integrationError(w, http.StatusForbidden, "Only the creator of a transcription or an admin can change it")
+		return
+	}
+	var consent Consent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&consent); err != nil {
+		integrationError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if err := consent.validate(); err != nil {
+		integrationError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	pipelineJobs.update(id, func(j *Job) {
+		j.Consent = &consent
+		job = *j
+	})
+	logf(r.Context(), "Job %s: consent recorded (jurisdiction %s)", id, consent.Jurisdiction)
+	recordAudit(job.UserID, newCloudEvent(EventConsentRecorded, id, map[string]any{"consent": consent}))
+	writeJSON(w, http.StatusOK, job)
+}
+
+// handleIntegrationTranscript exports a completed transcription as plain
+// text, stamped with the disclosure footer, or as negotiated as captions,
+// the job's JSON or accessible HTML
+func handleIntegrationTranscript(w http.ResponseWriter, r *http.Request) {
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !principalFrom(r.Context()).sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	if job.Status != jobCompleted {
+		integrationError(w, http.StatusConflict, "Transcription is not completed")
+		return
+	}
+	w.Header().Set("Vary", "Accept")
+	switch negotiate(r, mediaText, mediaVTT, mediaJSON, mediaHTML) {
+	case "":
+		integrationError(w, http.StatusNotAcceptable, notAcceptable(mediaText, mediaVTT, mediaJSON, mediaHTML))
+		return
+	case mediaJSON:
+		writeJSON(w, http.StatusOK, job)
+		return
+	case mediaHTML:
+		writeAccessibleTranscript(w, r, job)
+		return
+	case mediaVTT:
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		setAttachment(w, job.ID, ".vtt")
+		w.Write([]byte(captions(job.Text, job.Duration, job.Segments, disclosureFooter(job.Consent))))
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(job.Text)
+	b.WriteString("\n")
+	if job.Summary != "" {
+		b.WriteString("\nSummary\n\n")
+		b.WriteString(job.Summary)
+		b.WriteString("\n")
+	}
+	if footer := disclosureFooter(job.Consent); footer != "" {
+		b.WriteString("\n---\n")
+		b.WriteString(footer)
+		b.WriteString("\n")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	setAttachment(w, job.ID, ".txt")
+	w.Write([]byte(b.String()))
+}
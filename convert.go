@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The Whisper backends are only guaranteed to accept WAV, so other common
+// formats are transcoded with ffmpeg to 16 kHz mono WAV before they are
+// forwarded. Formats are recognized by their magic bytes, whatever the
+// file is called. WAV audio is passed through untouched and still streams
+// to the backend while it is uploaded; other formats have to be received
+// in full first, as MP4 containers keep their index at the end.
+
+// Audio formats recognized by their magic bytes
+const (
+	audioWAV  = "wav"
+	audioMP3  = "mp3"
+	audioM4A  = "m4a"
+	audioFLAC = "flac"
+	audioOGG  = "ogg"
+	audioWebM = "webm"
+)
+
+// audioSniffLen is the number of bytes sniffAudio needs
+const audioSniffLen = 12
+
+// errUnsupportedAudio is returned for audio in none of the recognized
+// formats
+var errUnsupportedAudio = errors.New("unsupported audio format: upload WAV, MP3, M4A, FLAC, OGG or WebM")
+
+// errConversion is returned when ffmpeg cannot convert the audio, which
+// usually means it is damaged
+var errConversion = errors.New("converting audio failed")
+
+// errNoConverter is returned for audio that needs converting when ffmpeg
+// is not installed
+var errNoConverter = errors.New("only WAV audio is supported: converting other formats requires ffmpeg on the server")
+
+// sniffAudio returns the format of audio starting with header, "" when it
+// is not recognized
+func sniffAudio(header []byte) string {
+	if len(header) < audioSniffLen {
+		return ""
+	}
+	switch {
+	case string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+		return audioWAV
+	case string(header[0:4]) == "fLaC":
+		return audioFLAC
+	case string(header[0:4]) == "OggS":
+		return audioOGG
+	case string(header[0:4]) == "\x1a\x45\xdf\xa3":
+		return audioWebM
+	case string(header[4:8]) == "ftyp":
+		return audioM4A
+	case string(header[0:3]) == "ID3":
+		return audioMP3
+	case header[0] == 0xff && header[1]&0xe0 == 0xe0 && header[1]&0x06 != 0:
+		// An MPEG audio frame; layer bits of 0 would be AAC in ADTS
+		return audioMP3
+	}
+	return ""
+}
+
+// audioExtensions are the file extensions of the recognized formats
+var audioExtensions = map[string]bool{
+	".wav": true, ".mp3": true, ".m4a": true, ".mp4": true, ".aac": true,
+	".flac": true, ".ogg": true, ".oga": true, ".opus": true, ".webm": true,
+}
+
+// wavName names the WAV audio sent to the backend after the original
+// file, or after fallback when the file name is not that of audio
+func wavName(filename, fallback string) string {
+	filename = cleanFilename(filename)
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	if !audioExtensions[strings.ToLower(ext)] || base == "" {
+		base = fallback
+	}
+	return base + ".wav"
+}
+
+// convertToWAV transcodes the audio file src to 16 kHz mono WAV at dst,
+// with further ffmpeg options such as filters
+func convertToWAV(ctx context.Context, src, dst string, options ...string) error {
+	args := []string{"-nostdin", "-v", "error", "-y", "-i", src}
+	args = append(args, options...)
+	args = append(args, "-vn", "-ac", "1", "-ar", "16000", "-c:a", "pcm_s16le", "-f", "wav", dst)
+	cmd := exec.CommandContext(ctx, config.FFmpegPath, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("%w: %v: %s", errConversion, err, describeBody(string(out)))
+	}
+	return nil
+}
+
+// canConvertAudio reports whether ffmpeg is available to convert audio
+func canConvertAudio() bool {
+	_, err := exec.LookPath(config.FFmpegPath)
+	return err == nil
+}
+
+// wavUpload is an uploaded file ready to forward as WAV
+type wavUpload struct {
+	io.Reader
+	// Filename names the audio for the backend
+	Filename string
+	// Format is the format the file was uploaded in
+	Format string
+	file   *os.File
+	temp   []string
+}
+
+// Close closes and removes the files of a converted upload
+func (u *wavUpload) Close() error {
+	if u.file != nil {
+		u.file.Close()
+	}
+	for _, path := range u.temp {
+		os.Remove(path)
+	}
+	return nil
+}
+
+// prepareUpload sniffs an uploaded file and, unless it is WAV, receives it
+// into dir and converts it. A WAV upload is returned as a reader of the
+// rest of the upload.
+func prepareUpload(ctx context.Context, file io.Reader, filename, dir string) (*wavUpload, error) {
+	buffered := bufio.NewReaderSize(file, 64*1024)
+	header, _ := buffered.Peek(audioSniffLen)
+	format := sniffAudio(header)
+	switch {
+	case format == "":
+		return nil, errUnsupportedAudio
+	case format == audioWAV:
+		return &wavUpload{Reader: buffered, Filename: wavName(filename, "audio"), Format: format}, nil
+	case !canConvertAudio():
+		return nil, errNoConverter
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	src, err := os.CreateTemp(dir, "upload-*."+format)
+	if err != nil {
+		return nil, err
+	}
+	upload := &wavUpload{Filename: wavName(filename, "audio"), Format: format, temp: []string{src.Name()}}
+	_, err = io.Copy(src, buffered)
+	if cerr := src.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		upload.Close()
+		return nil, err
+	}
+	dst := strings.TrimSuffix(src.Name(), "."+format) + ".wav"
+	upload.temp = append(upload.temp, dst)
+	if err := convertToWAV(ctx, src.Name(), dst); err != nil {
+		upload.Close()
+		return nil, err
+	}
+	converted, err := os.Open(dst)
+	if err != nil {
+		upload.Close()
+		return nil, err
+	}
+	upload.Reader, upload.file = converted, converted
+	logf(ctx, "Converted %s upload %s to WAV", format, filename)
+	return upload, nil
+}
+
+// receiveAudio sniffs the audio read from body and stores it as it was sent
+// in a new file in dir, named after pattern and its format. When reading
+// fails partway, the file holding what arrived is returned with the error.
+func receiveAudio(body io.Reader, dir, pattern string) (string, error) {
+	header := make([]byte, audioSniffLen)
+	n, _ := io.ReadFull(body, header)
+	format := sniffAudio(header[:n])
+	switch {
+	case format == "":
+		return "", errUnsupportedAudio
+	case format != audioWAV && !canConvertAudio():
+		return "", errNoConverter
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(dir, pattern+"."+format)
+	if err != nil {
+		return "", err
+	}
+	file.Write(header)
+	_, err = io.Copy(file, body)
+	if cerr := file.Close(); cerr != nil {
+		os.Remove(file.Name())
+		return "", cerr
+	}
+	return file.Name(), err
+}
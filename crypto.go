@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"strings"
+)
+
+// The server's cryptography, in one place so it can be restricted for
+// government deployments:
+//
+//   - webhook signatures, inbound (HOOKS_SECRET) and outbound (integration
+//     secrets), are HMACs with HMAC_ALGORITHM
+//   - API keys are stored as SHA-256 hashes and export bundles list SHA-256
+//     checksums
+//   - share, feed, invitation and unsubscribe tokens are random values from
+//     crypto/rand, looked up in the state store rather than signed
+//   - connections to backends, webhooks, SMTP and the Kubernetes API use TLS
+//     as configured by tlsClientConfig
+//   - URLs of the object storage are signed with AWS Signature Version 4,
+//     an HMAC-SHA256 chain
+//
+// Nothing is encrypted at rest by the server; use encrypted volumes and an
+// encrypted state store. Duplicate detection hashes words with FNV, which is
+// not used for security.
+//
+// With FIPS_MODE=true the startup checks only accept FIPS-approved choices:
+// TLS 1.2 or later with AES-GCM suites on the P-256 and P-384 curves, and
+// HMAC keys of at least 112 bits. The Go cryptography itself is only a
+// validated module when the binary is built in FIPS mode (see the
+// Dockerfile's FIPS build argument) and runs on a host in FIPS mode.
+
+// hmacAlgorithms are the accepted HMAC_ALGORITHM values, all approved
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// minFIPSKeyLength is the shortest HMAC key allowed in FIPS mode (112 bits)
+const minFIPSKeyLength = 14
+
+// fipsCipherSuites are the approved TLS 1.2 suites; TLS 1.3 suites are
+// not configurable and all use approved ciphers
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// signPayload returns the "<algorithm>=<hex>" HMAC of payload
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(hmacAlgorithms[config.HMACAlgorithm], []byte(secret))
+	mac.Write(payload)
+	return config.HMACAlgorithm + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSignature checks an "<algorithm>=<hex>" HMAC of payload. Only
+// HMAC_ALGORITHM is accepted, so a sender cannot downgrade it.
+func validSignature(secret string, payload []byte, signature string) bool {
+	digest, ok := strings.CutPrefix(signature, config.HMACAlgorithm+"=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(digest)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(hmacAlgorithms[config.HMACAlgorithm], []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// validHMACKey reports why secret cannot be used as an HMAC key, if it
+// cannot
+func validHMACKey(secret string) error {
+	if config.FIPSMode && len(secret) < minFIPSKeyLength {
+		return fmt.Errorf("must be at least %d bytes in FIPS mode", minFIPSKeyLength)
+	}
+	return nil
+}
+
+// tlsClientConfig returns the TLS settings for outbound connections
+func tlsClientConfig() *tls.Config {
+	if !config.FIPSMode {
+		return &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CipherSuites:     fipsCipherSuites,
+		CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+	}
+}
+
+// kernelFIPSEnabled reports whether the host runs in FIPS mode
+func kernelFIPSEnabled() bool {
+	data, err := os.ReadFile("/proc/sys/crypto/fips_enabled")
+	return err == nil && strings.TrimSpace(string(data)) == "1"
+}
+
+// initCrypto validates the cryptographic settings and logs the choices
+func initCrypto() {
+	if secret := config.HooksSecret.Value(); secret != "" {
+		if err := validHMACKey(secret); err != nil {
+			log.Fatalf("HOOKS_SECRET %v", err)
+		}
+	}
+	logf(context.Background(), "Crypto: HMAC-%s webhook signatures, SHA-256 key hashes and export checksums, TLS 1.2+", strings.ToUpper(config.HMACAlgorithm))
+	if config.FIPSMode {
+		logf(context.Background(), "FIPS mode: TLS limited to AES-GCM suites on P-256/P-384, HMAC keys of at least %d bytes", minFIPSKeyLength)
+		if !kernelFIPSEnabled() {
+			logWarnf(context.Background(), "Warning: FIPS_MODE is set but the host is not in FIPS mode; the Go cryptographic module only runs validated when the host is")
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The decisions pipeline step asks the LLM for the decisions made in a
+// meeting: what was decided, by whom, why, and who disagreed. Each decision
+// gets a few topics, so the decision log can be queried across meetings,
+// e.g. all decisions about pricing this quarter.
+
+// maxDecisionTopics bounds the topics of one decision
+const maxDecisionTopics = 5
+
+// Decision is a decision made in a meeting
+type Decision struct {
+	Decision  string   `json:"decision"`
+	MadeBy    string   `json:"made_by,omitempty"`
+	Rationale string   `json:"rationale,omitempty"`
+	Dissent   string   `json:"dissent,omitempty"`
+	Topics    []string `json:"topics,omitempty"`
+}
+
+// decisionsPrompt instructs the LLM to answer with JSON only
+const decisionsPrompt = `You extract the decisions made in a meeting from its transcript. Only include what the participants agreed or decided, not proposals or open questions. Answer with a JSON array only, without any other text. Each element is an object with the fields:
+- "decision": what was decided, as one sentence
+- "made_by": who made or approved the decision, if mentioned
+- "rationale": the reasons given for it, if any
+- "dissent": who disagreed and why, if anyone did
+- "topics": one to three short lowercase topics, such as "pricing" or "hiring"
+Answer with [] when no decision was made.`
+
+// newDecisionsRequest builds the chat completion request extracting
+// decisions from text
+func newDecisionsRequest(model, text string) ChatCompletionRequest {
+	return ChatCompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: "system", Content: decisionsPrompt},
+			{Role: "user", Content: fmt.Sprintf("Transcription:\n\n%s", text)},
+		},
+		Temperature: 0,
+	}
+}
+
+// extractDecisions asks the LLM for the decisions made in text
+func extractDecisions(ctx context.Context, up Upstream, text string) ([]Decision, error) {
+	var raw []Decision
+	if err := llmJSON(ctx, up, newDecisionsRequest(up.LLMModel, text), &raw); err != nil {
+		return nil, err
+	}
+	return cleanDecisions(raw), nil
+}
+
+// cleanDecisions drops decisions without text, and normalizes topics like
+// tags
+func cleanDecisions(raw []Decision) []Decision {
+	decisions := []Decision{}
+	for _, d := range raw {
+		d.Decision = strings.TrimSpace(d.Decision)
+		if d.Decision == "" {
+			continue
+		}
+		d.MadeBy = strings.TrimSpace(d.MadeBy)
+		d.Rationale = strings.TrimSpace(d.Rationale)
+		d.Dissent = strings.TrimSpace(d.Dissent)
+		var topics []string
+		seen := make(map[string]bool)
+		for _, topic := range d.Topics {
+			if topic = normalizeTag(topic); topic != "" && !seen[topic] && len(topics) < maxDecisionTopics {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+		d.Topics = topics
+		decisions = append(decisions, d)
+	}
+	return decisions
+}
+
+// matches reports whether a decision is about topic and mentions every
+// word of query, case-insensitively
+func (d Decision) matches(topic string, query []string) bool {
+	if topic != "" {
+		found := false
+		for _, t := range d.Topics {
+			found = found || t == topic
+		}
+		if !found {
+			return false
+		}
+	}
+	text := strings.ToLower(strings.Join([]string{d.Decision, d.MadeBy, d.Rationale, d.Dissent, strings.Join(d.Topics, " ")}, " "))
+	for _, word := range query {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// DecisionRecord is a decision in the log, with the meeting it was made in
+type DecisionRecord struct {
+	Decision
+	TranscriptionID string `json:"transcription_id"`
+	Title           string `json:"title"`
+	RecordedAt      string `json:"recorded_at"`
+}
+
+// handleDecisionLog lists the decisions of the completed transcriptions
+// visible to the caller that were created between from and to, newest
+// first, optionally only those about ?topic= or mentioning ?q=
+func handleDecisionLog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, to, msg := reportPeriod(q)
+	if msg != "" {
+		integrationError(w, http.StatusBadRequest, msg)
+		return
+	}
+	filter := jobFilter{Status: jobCompleted}
+	if tag := q.Get("tag"); tag != "" {
+		if filter.Tag = normalizeTag(tag); filter.Tag == "" {
+			integrationError(w, http.StatusBadRequest, "Invalid tag")
+			return
+		}
+	}
+	topic := ""
+	if value := q.Get("topic"); value != "" {
+		if topic = normalizeTag(value); topic == "" {
+			integrationError(w, http.StatusBadRequest, "Invalid topic")
+			return
+		}
+	}
+	query := strings.Fields(strings.ToLower(q.Get("q")))
+	limit := defaultJobListLimit
+	if value := q.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxJobListLimit {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxJobListLimit))
+			return
+		}
+		limit = n
+	}
+
+	records := []DecisionRecord{}
+	total := 0
+	for _, job := range pipelineJobs.list(principalFrom(r.Context()), filter, maxReportJobs) {
+		if job.CreatedAt.Before(from) || !job.CreatedAt.Before(to) {
+			continue
+		}
+		for _, d := range job.Decisions {
+			if !d.matches(topic, query) {
+				continue
+			}
+			total++
+			if len(records) < limit {
+				records = append(records, DecisionRecord{
+					Decision:        d,
+					TranscriptionID: job.ID,
+					Title:           jobTitle(job),
+					RecordedAt:      job.CreatedAt.UTC().Format(dueDateFormat),
+				})
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"decisions": records, "total": total})
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Digest emails are a daily or weekly roundup of the transcriptions an API
+// key can see: their titles, durations and one-line summaries, and the
+// action items still ahead. Each API key has one subscription, which the
+// recipient can turn off from the API or from the link in every email.
+// Only the leader sends digests, at DIGEST_HOUR UTC.
+
+// Digest frequencies
+const (
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+	digestOff    = "off"
+)
+
+// digestKeyPrefix namespaces subscriptions in the state store, keyed by
+// the API key's principal ID
+const digestKeyPrefix = "digest:"
+
+// digestCheckInterval is how often the leader looks for digests to send
+const digestCheckInterval = time.Minute
+
+// DigestSubscription is an API key's digest email preference
+type DigestSubscription struct {
+	Email     string `json:"email"`
+	Frequency string `json:"frequency"`
+	// UserID limits the digest to one user's transcriptions
+	UserID     string    `json:"user_id,omitempty"`
+	LastSentAt time.Time `json:"last_sent_at"`
+}
+
+// digestRecord is how a subscription is kept in the state store, with the
+// identity of the key it was created with
+type digestRecord struct {
+	DigestSubscription
+	KeyID            string `json:"key_id"`
+	Tenant           string `json:"tenant,omitempty"`
+	Workspace        string `json:"workspace,omitempty"`
+	Role             string `json:"role"`
+	UnsubscribeToken string `json:"unsubscribe_token"`
+}
+
+func (d digestRecord) principal() principal {
+	return principal{ID: d.KeyID, Tenant: d.Tenant, Workspace: d.Workspace, Role: d.Role}
+}
+
+// lastSlot is the latest scheduled send time at or before now
+func (d digestRecord) lastSlot(now time.Time) time.Time {
+	now = now.UTC()
+	slot := time.Date(now.Year(), now.Month(), now.Day(), config.DigestHour, 0, 0, 0, time.UTC)
+	if now.Before(slot) {
+		slot = slot.AddDate(0, 0, -1)
+	}
+	if d.Frequency == digestWeekly {
+		for slot.Weekday() != time.Monday {
+			slot = slot.AddDate(0, 0, -1)
+		}
+	}
+	return slot
+}
+
+// due reports whether a digest should be sent now
+func (d digestRecord) due(now time.Time) bool {
+	if d.Frequency != digestDaily && d.Frequency != digestWeekly {
+		return false
+	}
+	return d.LastSentAt.Before(d.lastSlot(now))
+}
+
+func loadDigest(key string) (digestRecord, bool) {
+	data, ok, err := state.get(key)
+	if err != nil {
+		logErrorf(context.Background(), "Error reading digest subscription: %v", err)
+	}
+	var d digestRecord
+	if !ok || json.Unmarshal(data, &d) != nil {
+		return digestRecord{}, false
+	}
+	return d, true
+}
+
+func saveDigest(d digestRecord) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return state.set(digestKeyPrefix+d.KeyID, data, 0)
+}
+
+// handleDigestGet returns the caller's subscription
+func handleDigestGet(w http.ResponseWriter, r *http.Request) {
+	d, ok := loadDigest(digestKeyPrefix + principalFrom(r.Context()).ID)
+	if !ok {
+		writeJSON(w, http.StatusOK, DigestSubscription{Frequency: digestOff})
+		return
+	}
+	writeJSON(w, http.StatusOK, d.DigestSubscription)
+}
+
+// handleDigestPut subscribes the caller, changes the frequency or opts out
+// with "off"
+func handleDigestPut(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	var sub DigestSubscription
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&sub); err != nil {
+		integrationError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	switch sub.Frequency {
+	case digestDaily, digestWeekly, digestOff:
+	default:
+		integrationError(w, http.StatusBadRequest, "frequency must be daily, weekly or off")
+		return
+	}
+	addr, err := mail.ParseAddress(sub.Email)
+	if err != nil && sub.Frequency != digestOff {
+		integrationError(w, http.StatusBadRequest, "email must be a valid address")
+		return
+	}
+	if err == nil {
+		sub.Email = addr.Address
+	}
+	if sub.UserID != "" && !externalIDPattern.MatchString(sub.UserID) {
+		integrationError(w, http.StatusBadRequest, "Invalid user_id")
+		return
+	}
+	if sub.Frequency != digestOff && config.SMTPURL.Value() == "" {
+		integrationError(w, http.StatusNotImplemented, "Digest emails are not configured on this server")
+		return
+	}
+
+	// The first digest covers what completes from now on
+	sub.LastSentAt = time.Now().UTC()
+	d := digestRecord{DigestSubscription: sub, KeyID: p.ID, Tenant: p.Tenant, Workspace: p.Workspace, Role: p.Role}
+	if previous, ok := loadDigest(digestKeyPrefix + p.ID); ok {
+		d.UnsubscribeToken = previous.UnsubscribeToken
+	}
+	if d.UnsubscribeToken == "" {
+		d.UnsubscribeToken = randomToken("")
+	}
+	if err := saveDigest(d); err != nil {
+		logErrorf(r.Context(), "Error saving digest subscription of %s: %v", p.ID, err)
+		integrationError(w, http.StatusInternalServerError, "Error saving subscription")
+		return
+	}
+	logf(r.Context(), "Digest for %s set to %s", p.ID, sub.Frequency)
+	writeJSON(w, http.StatusOK, d.DigestSubscription)
+}
+
+// digestByUnsubscribeToken finds the subscription an unsubscribe link
+// belongs to. The token is kept when the subscription is changed, so links
+// in earlier digests keep working.
+func digestByUnsubscribeToken(token string) (digestRecord, bool) {
+	keys, err := state.keys(digestKeyPrefix)
+	if err != nil {
+		logErrorf(context.Background(), "Error listing digest subscriptions: %v", err)
+		return digestRecord{}, false
+	}
+	for _, key := range keys {
+		if d, ok := loadDigest(key); ok && d.UnsubscribeToken == token {
+			return d, true
+		}
+	}
+	return digestRecord{}, false
+}
+
+// handleDigestUnsubscribe opts out from the link in a digest. GET shows a
+// confirmation form, because mail scanners follow links; POST, also sent
+// by one-click unsubscribe in mail clients (RFC 8058), opts out.
+func handleDigestUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	d, ok := digestByUnsubscribeToken(r.PathValue("token"))
+	if !ok {
+		http.Error(w, "This link is invalid", http.StatusNotFound)
+		return
+	}
+	view := map[string]any{"Email": d.Email, "Unsubscribed": d.Frequency == digestOff}
+	if r.Method == http.MethodPost {
+		if d.Frequency != digestOff {
+			d.Frequency = digestOff
+			if err := saveDigest(d); err != nil {
+				logErrorf(r.Context(), "Error unsubscribing %s: %v", d.KeyID, err)
+				http.Error(w, "Error unsubscribing, please retry", http.StatusInternalServerError)
+				return
+			}
+			logf(r.Context(), "Digest for %s unsubscribed by link", d.KeyID)
+		}
+		view["Unsubscribed"] = true
+	}
+	renderView(w, "unsubscribe.html", view)
+}
+
+// oneLine returns the first line of a summary without list markers,
+// shortened to about a tweet
+func oneLine(summary string) string {
+	for _, line := range strings.Split(summary, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "-*•#"))
+		if line == "" {
+			continue
+		}
+		if runes := []rune(line); len(runes) > 160 {
+			line = string(runes[:159]) + "…"
+		}
+		return line
+	}
+	return ""
+}
+
+// composeDigest writes the digest covering since..now, or reports that
+// there is nothing to send
+func composeDigest(d digestRecord, since, now time.Time) (string, string, bool) {
+	jobs := pipelineJobs.list(d.principal(), jobFilter{Status: jobCompleted}, maxJobListLimit)
+	var b strings.Builder
+	count := 0
+	today := now.UTC().Format(dueDateFormat)
+	var upcoming []string
+	for _, job := range jobs {
+		if d.UserID != "" && job.UserID != d.UserID {
+			continue
+		}
+		if job.UpdatedAt.After(since) && !job.UpdatedAt.After(now) {
+			count++
+			fmt.Fprintf(&b, "- %s", jobTitle(job))
+			if job.Duration > 0 {
+				fmt.Fprintf(&b, " (%s)", formatTimestamp(job.Duration))
+			}
+			b.WriteString("\n")
+			if line := oneLine(job.Summary); line != "" {
+				fmt.Fprintf(&b, "  %s\n", line)
+			}
+		}
+		for _, item := range job.ActionItems {
+			// Undated items only while their transcription is new
+			if (item.Due == "" && job.UpdatedAt.After(since)) || (item.Due != "" && item.Due[:len(dueDateFormat)] >= today) {
+				line := "- " + item.Text
+				if item.Owner != "" {
+					line += " (" + item.Owner + ")"
+				}
+				if item.Due != "" {
+					line += ", due " + strings.Replace(item.Due, "T", " ", 1)
+				}
+				upcoming = append(upcoming, line)
+			}
+		}
+	}
+	if count == 0 && len(upcoming) == 0 {
+		return "", "", false
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "%d transcription(s) completed since the last digest.\n\n", count)
+	body.WriteString(b.String())
+	if len(upcoming) > 0 {
+		body.WriteString("\nOutstanding action items:\n")
+		body.WriteString(strings.Join(upcoming, "\n"))
+		body.WriteString("\n")
+	}
+	subject := fmt.Sprintf("Your %s transcript digest: %d transcription(s)", d.Frequency, count)
+	return subject, body.String(), true
+}
+
+// unsubscribeURL is the absolute opt-out link of a subscription, if the
+// server knows its public URL
+func unsubscribeURL(d digestRecord) string {
+	if config.PublicURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(config.PublicURL, "/") + "/digest/unsubscribe/" + d.UnsubscribeToken
+}
+
+// sendDigest emails one subscription's digest
+func sendDigest(d digestRecord, subject, body string) error {
+	headers := map[string]string{}
+	if link := unsubscribeURL(d); link != "" {
+		body += "\n--\nUnsubscribe: " + link + "\n"
+		headers["List-Unsubscribe"] = "<" + link + ">"
+		headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+	} else {
+		body += "\n--\nTo stop these emails, set your digest frequency to \"off\" in the integrations API.\n"
+	}
+	return sendMail(d.Email, subject, body, headers)
+}
+
+// sendMail sends a plain text email through SMTP_URL: smtp:// uses
+// STARTTLS when the server offers it, smtps:// implicit TLS
+func sendMail(to, subject, body string, headers map[string]string) error {
+	u, err := url.Parse(config.SMTPURL.Value())
+	if err != nil || (u.Scheme != "smtp" && u.Scheme != "smtps") || u.Hostname() == "" {
+		return errors.New("SMTP_URL must look like smtp://[user:password@]host:587")
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"smtp": "587", "smtps": "465"}[u.Scheme]
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", config.DigestFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	for name, value := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", name, value)
+	}
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	conn, err := dialEgress(context.Background(), &net.Dialer{Timeout: 30 * time.Second}, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "smtps" {
+		tlsConfig := tlsClientConfig()
+		tlsConfig.ServerName = u.Hostname()
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	c, err := smtp.NewClient(conn, u.Hostname())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && u.Scheme == "smtp" {
+		tlsConfig := tlsClientConfig()
+		tlsConfig.ServerName = u.Hostname()
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		// PlainAuth refuses to send credentials without TLS, except to localhost
+		if err := c.Auth(smtp.PlainAuth("", u.User.Username(), password, u.Hostname())); err != nil {
+			return err
+		}
+	}
+	from, _ := mail.ParseAddress(config.DigestFrom)
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// runDigests sends the digests that are due. Only the leader sends, and the
+// time of each send is stored, so a new leader does not repeat them.
+func runDigests() {
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !isLeader() {
+			continue
+		}
+		keys, err := state.keys(digestKeyPrefix)
+		if err != nil {
+			logErrorf(context.Background(), "Error listing digest subscriptions: %v", err)
+			continue
+		}
+		now := time.Now().UTC()
+		for _, key := range keys {
+			d, ok := loadDigest(key)
+			if !ok || !d.due(now) {
+				continue
+			}
+			if !keyActive(d.KeyID) {
+				continue
+			}
+			if subject, body, ok := composeDigest(d, d.LastSentAt, now); ok {
+				if err := sendDigest(d, subject, body); err != nil {
+					// Retried at the next check
+					logErrorf(context.Background(), "Error sending digest of %s: %v", d.KeyID, err)
+					continue
+				}
+				logf(context.Background(), "Sent %s digest of %s", d.Frequency, d.KeyID)
+			}
+			d.LastSentAt = now
+			if err := saveDigest(d); err != nil {
+				logErrorf(context.Background(), "Error saving digest subscription of %s: %v", d.KeyID, err)
+			}
+		}
+	}
+}
+
+// initDigests starts the digest worker when a mail server is set
+func initDigests() {
+	if config.SMTPURL.Value() == "" {
+		return
+	}
+	if config.PublicURL == "" {
+		logWarnf(context.Background(), "Warning: PUBLIC_URL is not set, digest emails will not contain an unsubscribe link")
+	}
+	go runDigests()
+	logf(context.Background(), "Sending digest emails at %02d:00 UTC", config.DigestHour)
+}
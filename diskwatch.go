@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Storage metrics exported on /debug/vars
+var (
+	diskUsedPercent      = expvar.NewFloat("disk_used_percent")
+	diskFreeBytes        = expvar.NewInt("disk_free_bytes")
+	diskPressure         = expvar.NewInt("disk_pressure")
+	diskCleanupRuns      = expvar.NewInt("disk_emergency_cleanups_total")
+	diskCleanupFreed     = expvar.NewInt("disk_emergency_cleanup_freed_bytes_total")
+	diskRejectedRequests = expvar.NewInt("disk_rejected_uploads_total")
+	orphansFreed         = expvar.NewInt("orphaned_artifacts_freed_bytes_total")
+)
+
+// orphanSweepInterval is how often the leader removes the files of jobs
+// whose records are gone
+const orphanSweepInterval = time.Hour
+
+// orphanGrace is how long a job's files may go without its record: a live
+// session records its audio before its transcript is saved
+const orphanGrace = time.Hour
+
+// DiskUsage describes the filesystem holding the storage directory
+type DiskUsage struct {
+	TotalBytes  uint64  `json:"total_bytes"`
+	FreeBytes   uint64  `json:"free_bytes"`
+	UsedPercent float64 `json:"used_percent"`
+}
+
+// statDisk reports usage of the filesystem containing dir
+func statDisk(dir string) (DiskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return DiskUsage{}, err
+	}
+	total := st.Blocks * uint64(st.Bsize)
+	free := st.Bavail * uint64(st.Bsize)
+	usage := DiskUsage{TotalBytes: total, FreeBytes: free}
+	if total > 0 {
+		usage.UsedPercent = float64(total-free) / float64(total) * 100
+	}
+	return usage, nil
+}
+
+// diskWatchdog periodically samples storage usage. Above the threshold the
+// leader removes expired artifacts and, if that is not enough, flags disk pressure
+// so new uploads are refused until space is available again.
+type diskWatchdog struct {
+	dir       string
+	threshold float64
+	retention time.Duration
+
+	mu       sync.RWMutex
+	usage    DiskUsage
+	pressure bool
+	err      error
+}
+
+var storageWatchdog *diskWatchdog
+
+func newDiskWatchdog(dir string, threshold float64, retention time.Duration) *diskWatchdog {
+	return &diskWatchdog{dir: dir, threshold: threshold, retention: retention}
+}
+
+// run samples disk usage every interval until the process exits
+func (d *diskWatchdog) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.check()
+	}
+}
+
+func (d *diskWatchdog) check() {
+	usage, err := statDisk(d.dir)
+	// Storage is shared between replicas: only the leader sweeps it, the
+	// others just refuse uploads while it is full
+	if err == nil && usage.UsedPercent >= d.threshold && isLeader() {
+		logf(context.Background(), "Disk usage %.1f%% exceeds %.1f%%, removing expired artifacts", usage.UsedPercent, d.threshold)
+		freed := d.cleanupExpired()
+		diskCleanupRuns.Add(1)
+		diskCleanupFreed.Add(freed)
+		logf(context.Background(), "Emergency cleanup freed %d bytes", freed)
+		usage, err = statDisk(d.dir)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.err = err
+	if err != nil {
+		logErrorf(context.Background(), "Error checking disk usage of %s: %v", d.dir, err)
+		return
+	}
+
+	pressure := usage.UsedPercent >= d.threshold
+	if pressure != d.pressure {
+		if pressure {
+			logWarnf(context.Background(), "Disk pressure: %.1f%% used, rejecting new uploads", usage.UsedPercent)
+		} else {
+			logf(context.Background(), "Disk pressure relieved: %.1f%% used", usage.UsedPercent)
+		}
+	}
+	d.usage = usage
+	d.pressure = pressure
+
+	diskUsedPercent.Set(usage.UsedPercent)
+	diskFreeBytes.Set(int64(usage.FreeBytes))
+	if pressure {
+		diskPressure.Set(1)
+	} else {
+		diskPressure.Set(0)
+	}
+}
+
+// roots returns the default and every region's storage directory
+func (d *diskWatchdog) roots() map[string]bool {
+	dirs := make(map[string]bool)
+	for _, dir := range append([]string{d.dir}, storageDirs()...) {
+		dirs[filepath.Clean(dir)] = true
+	}
+	return dirs
+}
+
+// cleanupExpired removes artifacts older than the retention period from
+// the default and every region's storage directory, sparing those of users
+// under legal hold, and returns the number of bytes freed
+func (d *diskWatchdog) cleanupExpired() int64 {
+	cutoff := time.Now().Add(-d.retention)
+	dirs := d.roots()
+	var freed int64
+	for root := range dirs {
+		filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if entry.IsDir() && path != root && dirs[path] {
+				// Another storage directory, swept on its own
+				return filepath.SkipDir
+			}
+			if stateFile(path) || heldArtifact(root, path) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				return nil
+			}
+			if err := os.Remove(path); err != nil {
+				logErrorf(context.Background(), "Error removing expired artifact %s: %v", path, err)
+				return nil
+			}
+			freed += info.Size()
+			return nil
+		})
+	}
+	return freed
+}
+
+// sweep removes the files of expired jobs every interval until the process
+// exits, on the leader
+func (d *diskWatchdog) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !isLeader() {
+			continue
+		}
+		if freed := d.sweepOrphans(); freed > 0 {
+			orphansFreed.Add(freed)
+			logf(context.Background(), "Removed %d bytes of clips, kept audio and recordings of expired jobs", freed)
+		}
+	}
+}
+
+// sweepOrphans removes the clips, kept audio and live recordings of jobs
+// whose records expired or were removed without them, and returns the
+// number of bytes freed. Audio under legal hold lives outside these
+// directories and is not touched.
+func (d *diskWatchdog) sweepOrphans() int64 {
+	cutoff := time.Now().Add(-orphanGrace)
+	var freed int64
+	remove := func(path, jobID string) {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().After(cutoff) {
+			return
+		}
+		// A store that cannot be read is no proof the job is gone
+		if _, ok, err := state.get(jobKeyPrefix + jobID); err != nil || ok {
+			return
+		}
+		size := treeSize(path)
+		if err := os.RemoveAll(path); err != nil {
+			logErrorf(context.Background(), "Error removing files of expired job %s: %v", jobID, err)
+			return
+		}
+		freed += size
+	}
+	for root := range d.roots() {
+		clips, _ := os.ReadDir(filepath.Join(root, "clips"))
+		for _, entry := range clips {
+			if entry.IsDir() {
+				remove(filepath.Join(root, "clips", entry.Name()), entry.Name())
+			}
+		}
+		recordings, _ := os.ReadDir(filepath.Join(root, "recordings"))
+		for _, entry := range recordings {
+			if entry.Type().IsRegular() {
+				remove(filepath.Join(root, "recordings", entry.Name()), strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))
+			}
+		}
+	}
+	return freed
+}
+
+// treeSize is the size of the files under path
+func treeSize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// stateFile reports whether path is the file store or the admin state
+// file, or one being written, which may live in the storage directory but
+// are not artifacts
+func stateFile(path string) bool {
+	var files []string
+	if f, ok := state.(*fileStore); ok {
+		files = append(files, f.path)
+	}
+	if config.AdminStateFile != "" {
+		files = append(files, config.AdminStateFile)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for _, file := range files {
+		if file, err := filepath.Abs(file); err == nil && (path == file || path == file+".tmp") {
+			return true
+		}
+	}
+	return false
+}
+
+// heldArtifact reports whether path, inside the storage directory root,
+// belongs to a user under legal hold: their held audio, or the clips,
+// recording or audio being processed of one of their jobs
+func heldArtifact(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	var jobID string
+	switch {
+	case parts[0] == legalHoldDir:
+		return true
+	case parts[0] == "clips" && len(parts) > 1:
+		jobID = parts[1]
+	case (parts[0] == "ingest" || parts[0] == "recordings") && len(parts) == 2:
+		jobID = strings.TrimSuffix(parts[1], filepath.Ext(parts[1]))
+	default:
+		return false
+	}
+	job, ok := pipelineJobs.get(jobID)
+	return ok && underLegalHold(job.UserID)
+}
+
+// refuseUnderDiskPressure answers 507 while the storage volume is nearly
+// full, as JSON on integration routes, and reports whether it did
+func refuseUnderDiskPressure(w http.ResponseWriter, integration bool) bool {
+	if !storageWatchdog.underPressure() {
+		return false
+	}
+	diskRejectedRequests.Add(1)
+	const msg = "Server storage is nearly full, please retry later"
+	if integration {
+		integrationError(w, http.StatusInsufficientStorage, msg)
+	} else {
+		http.Error(w, msg, http.StatusInsufficientStorage)
+	}
+	return true
+}
+
+// underPressure reports whether new uploads should be refused
+func (d *diskWatchdog) underPressure() bool {
+	if d == nil {
+		return false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.pressure
+}
+
+// status returns the last sample for the readiness endpoint
+func (d *diskWatchdog) status() (DiskUsage, bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.usage, d.pressure, d.err
+}
+
+// initStorage prepares the storage directory and starts the watchdog
+func initStorage() {
+	if err := os.MkdirAll(config.StorageDir, 0o750); err != nil {
+		log.Fatalf("Error creating storage directory %s: %v", config.StorageDir, err)
+	}
+	storageWatchdog = newDiskWatchdog(config.StorageDir, config.DiskUsageThreshold, config.ArtifactRetention)
+	storageWatchdog.check()
+	go storageWatchdog.run(config.DiskCheckInterval)
+	go storageWatchdog.sweep(orphanSweepInterval)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Files sent to browsers, such as exports and highlight clips, are always
+// downloads: their names go through setAttachment, so a title taken from an
+// uploaded file name cannot break out of the header, and every response
+// carries X-Content-Type-Options: nosniff, so a browser never runs a file
+// it was told is audio or text as HTML. A browser cannot send the API key
+// of an <audio> element or a download link, so clips and highlight exports
+// are also served through download links: short-lived tokens that grant one
+// file, like share links grant one transcript.
+
+// EventDownloadLinkCreated is recorded in the user's audit trail when a
+// download link is created
+const EventDownloadLinkCreated = "download.link_created"
+
+// DownloadLink grants one file of a transcription to anyone holding its
+// token: the clip of Highlight, or the highlight export when it is empty.
+// Only a hash of the token is stored.
+type DownloadLink struct {
+	JobID     string    `json:"job_id"`
+	Highlight string    `json:"highlight,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// downloadKeyPrefix namespaces download links in the state store, keyed by
+// the hash of their token
+const downloadKeyPrefix = "download:"
+
+// Lifetimes of download links, kept short as the link is the credential
+const (
+	defaultDownloadTTL = 15 * time.Minute
+	maxDownloadTTL     = 24 * time.Hour
+)
+
+// maxFilenameLength bounds the file names offered to browsers
+const maxFilenameLength = 120
+
+// withSecurityHeaders tells browsers to trust the Content-Type of every
+// response instead of sniffing it
+func withSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// safeFilename makes name usable as a file name on any system: it is
+// composed to NFC, path separators, control, formatting and other unsafe
+// characters become "_", and leading dots are dropped so the file is not
+// hidden
+func safeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r), unicode.Is(unicode.Cf, r), strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return r
+	}, composeNFC(name))
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if runes := []rune(name); len(runes) > maxFilenameLength {
+		name = string(runes[:maxFilenameLength])
+	}
+	return name
+}
+
+// asciiFilename is the fallback for clients that do not read filename*:
+// only letters, digits and ".-_ " are kept
+func asciiFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(".-_ ", r)) {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// encodeRFC5987 percent-encodes a UTF-8 value for an extended parameter
+// such as filename*
+func encodeRFC5987(value string) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		if c < utf8.RuneSelf && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// setAttachment makes the response a download named name, which may come
+// from user input. Names with characters outside ASCII are also sent in
+// filename* (RFC 6266), which browsers prefer.
+func setAttachment(w http.ResponseWriter, name, ext string) {
+	name = safeFilename(name)
+	if name == "" {
+		name = "download"
+	}
+	name += ext
+	ascii := asciiFilename(name)
+	disposition := fmt.Sprintf(`attachment; filename="%s"`, ascii)
+	if ascii != name {
+		disposition += "; filename*=UTF-8''" + encodeRFC5987(name)
+	}
+	w.Header().Set("Content-Disposition", disposition)
+}
+
+// handleDownloadLinkCreate creates a download link for a highlight's clip,
+// or for the highlight export when no highlight is given
+func handleDownloadLinkCreate(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !p.sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	var req struct {
+		Highlight string `json:"highlight"`
+		ExpiresIn string `json:"expires_in"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&req); err != nil {
+			integrationError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+	ttl := defaultDownloadTTL
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 || d > maxDownloadTTL {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("expires_in must be a positive duration of at most %s", maxDownloadTTL))
+			return
+		}
+		ttl = d
+	}
+	if req.Highlight == "" && len(job.Highlights) == 0 {
+		integrationError(w, http.StatusNotFound, "Transcription has no highlights")
+		return
+	}
+	if req.Highlight != "" {
+		if _, ok := findHighlight(job, req.Highlight); !ok {
+			integrationError(w, http.StatusNotFound, "Highlight not found")
+			return
+		}
+		path, err := clipPath(job, req.Highlight)
+		if err == nil {
+			_, err = os.Stat(path)
+		}
+		if err != nil {
+			integrationError(w, http.StatusNotFound, "The clip of this highlight is no longer available")
+			return
+		}
+	}
+
+	token := randomToken("")
+	now := time.Now().UTC()
+	link := DownloadLink{JobID: job.ID, Highlight: req.Highlight, CreatedBy: p.ID, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+	data, err := json.Marshal(link)
+	if err == nil {
+		err = state.set(downloadKeyPrefix+hashAPIKey(token), data, ttl)
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Error saving download link for job %s: %v", job.ID, err)
+		integrationError(w, http.StatusInternalServerError, "Error creating download link")
+		return
+	}
+	recordAudit(job.UserID, newCloudEvent(EventDownloadLinkCreated, job.ID, map[string]any{"created_by": p.ID, "highlight": req.Highlight, "expires_at": link.ExpiresAt}))
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"url":        "/downloads/" + token,
+		"expires_at": link.ExpiresAt,
+	})
+}
+
+// findHighlight returns the highlight of a job with the given ID
+func findHighlight(job Job, id string) (Highlight, bool) {
+	for _, h := range job.Highlights {
+		if h.ID == id {
+			return h, true
+		}
+	}
+	return Highlight{}, false
+}
+
+// handleDownload serves the file of a download link. Clips support range
+// requests, so they can be played in an <audio> element.
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	// The token is the credential: keep it out of caches, referrers and
+	// search engines
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+
+	const gone = "This link is invalid or has expired"
+	data, ok, err := state.get(downloadKeyPrefix + hashAPIKey(r.PathValue("token")))
+	if err != nil {
+		logErrorf(r.Context(), "Error reading download link: %v", err)
+	}
+	var link DownloadLink
+	if !ok || json.Unmarshal(data, &link) != nil {
+		http.Error(w, gone, http.StatusNotFound)
+		return
+	}
+	job, ok := pipelineJobs.get(link.JobID)
+	if !ok {
+		http.Error(w, gone, http.StatusNotFound)
+		return
+	}
+	if link.Highlight == "" {
+		if len(job.Highlights) == 0 {
+			http.Error(w, gone, http.StatusNotFound)
+			return
+		}
+		writeHighlightExport(w, job)
+		return
+	}
+
+	h, ok := findHighlight(job, link.Highlight)
+	if !ok {
+		http.Error(w, gone, http.StatusNotFound)
+		return
+	}
+	path, err := clipPath(job, h.ID)
+	var clip *os.File
+	if err == nil {
+		clip, err = os.Open(path)
+	}
+	if err != nil {
+		http.Error(w, "The clip of this highlight is no longer available", http.StatusNotFound)
+		return
+	}
+	defer clip.Close()
+	info, err := clip.Stat()
+	if err != nil {
+		logErrorf(r.Context(), "Error opening clip %s of job %s: %v", h.ID, job.ID, err)
+		http.Error(w, "Error reading clip", http.StatusInternalServerError)
+		return
+	}
+	name := jobTitle(job)
+	if h.Label != "" {
+		name += " - " + h.Label
+	}
+	w.Header().Set("Content-Type", "audio/wav")
+	setAttachment(w, name, ".wav")
+	http.ServeContent(w, r, "", info.ModTime(), clip)
+}
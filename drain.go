@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A model upgrade on a GPU node can be scripted against the admin API:
+//
+//	POST /admin/v1/drain?wait=10m   turn on maintenance mode and wait until no
+//	                                backend call is in flight or queued
+//	... upgrade and restart the backend ...
+//	POST /admin/v1/resume           end maintenance; queued jobs continue
+//
+// Draining relies on maintenance mode to stop new work: new jobs stay
+// queued and running jobs pause before their next backend call, so only the
+// calls already under way have to finish. Every replica reports its backend
+// load to the shared state store, and the drain is complete once each of
+// them has seen maintenance mode and has nothing in flight.
+
+// Kinds of backend calls
+const (
+	backendAudio = "audio"
+	backendLLM   = "llm"
+)
+
+// replicaReportPrefix keys the load reports of the replicas
+const replicaReportPrefix = "replicas/"
+
+// replicaReportInterval is how often a replica reports its load; reports
+// of replicas that stopped expire after three intervals
+const replicaReportInterval = 2 * time.Second
+
+// drainPollInterval is how often a waiting drain checks the load
+const drainPollInterval = time.Second
+
+// ReplicaLoad is the backend load of one replica
+type ReplicaLoad struct {
+	Replica string `json:"replica"`
+	// Backend calls in flight and waiting for a slot, by kind
+	InFlight    map[string]int64 `json:"in_flight"`
+	Queued      map[string]int64 `json:"queued"`
+	WaitingJobs int64            `json:"waiting_jobs"`
+	// MaintenanceSince is the start of the maintenance the replica has seen
+	MaintenanceSince *time.Time `json:"maintenance_since,omitempty"`
+	ReportedAt       time.Time  `json:"reported_at"`
+}
+
+// DrainStatus reports whether the backends can be upgraded safely
+type DrainStatus struct {
+	Maintenance Maintenance   `json:"maintenance"`
+	Drained     bool          `json:"drained"`
+	Replicas    []ReplicaLoad `json:"replicas"`
+}
+
+// sumByKind adds up the values of an expvar map keyed "<kind> <host>"
+func sumByKind(m *expvar.Map, kind string) int64 {
+	var n int64
+	m.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok && strings.HasPrefix(kv.Key, kind+" ") {
+			n += v.Value()
+		}
+	})
+	return n
+}
+
+// localLoad returns the backend load of this replica
+func localLoad() ReplicaLoad {
+	load := ReplicaLoad{
+		Replica:     replicaIdentity(),
+		InFlight:    make(map[string]int64),
+		Queued:      make(map[string]int64),
+		WaitingJobs: maintenanceWaitingJobs.Value(),
+		ReportedAt:  time.Now().UTC(),
+	}
+	for _, kind := range []string{backendAudio, backendLLM} {
+		load.InFlight[kind] = sumByKind(upstreamInFlight, kind)
+		load.Queued[kind] = sumByKind(upstreamQueued, kind)
+	}
+	if m := currentMaintenance(); m.Enabled {
+		load.MaintenanceSince = m.StartedAt
+	}
+	return load
+}
+
+// initReplicaReports publishes the load of this replica for drains started
+// on any replica. A single instance needs no reports.
+func initReplicaReports() {
+	if !state.shared() {
+		return
+	}
+	key := replicaReportPrefix + replicaIdentity()
+	go func() {
+		for {
+			if data, err := json.Marshal(localLoad()); err == nil {
+				if err := state.set(key, data, 3*replicaReportInterval); err != nil {
+					logErrorf(context.Background(), "Error reporting replica load: %v", err)
+				}
+			}
+			time.Sleep(replicaReportInterval)
+		}
+	}()
+}
+
+// replicaLoads returns the load of every live replica, this one first
+func replicaLoads() []ReplicaLoad {
+	loads := []ReplicaLoad{localLoad()}
+	if !state.shared() {
+		return loads
+	}
+	keys, err := state.keys(replicaReportPrefix)
+	if err != nil {
+		logErrorf(context.Background(), "Error listing replica reports: %v", err)
+		return loads
+	}
+	for _, key := range keys {
+		if key == replicaReportPrefix+loads[0].Replica {
+			continue
+		}
+		data, ok, err := state.get(key)
+		if err != nil || !ok {
+			continue
+		}
+		var load ReplicaLoad
+		if err := json.Unmarshal(data, &load); err != nil {
+			logErrorf(context.Background(), "Error decoding replica report %s: %v", key, err)
+			continue
+		}
+		loads = append(loads, load)
+	}
+	return loads
+}
+
+// drainStatus checks whether the backend calls of kinds have drained
+func drainStatus(kinds []string) DrainStatus {
+	m := currentMaintenance()
+	status := DrainStatus{Maintenance: m, Drained: m.Enabled, Replicas: replicaLoads()}
+	for _, load := range status.Replicas {
+		// A replica that has not seen maintenance mode yet may still start
+		// new calls
+		if load.MaintenanceSince == nil || m.StartedAt == nil || !load.MaintenanceSince.Equal(*m.StartedAt) {
+			status.Drained = false
+		}
+		for _, kind := range kinds {
+			if load.InFlight[kind]+load.Queued[kind] > 0 {
+				status.Drained = false
+			}
+		}
+	}
+	return status
+}
+
+// drainKinds returns the kinds of backend calls selected by ?backend=
+func drainKinds(r *http.Request) ([]string, bool) {
+	switch r.URL.Query().Get("backend") {
+	case "":
+		return []string{backendAudio, backendLLM}, true
+	case backendAudio:
+		return []string{backendAudio}, true
+	case backendLLM:
+		return []string{backendLLM}, true
+	}
+	return nil, false
+}
+
+// handleDrainStatus reports the backend calls left to drain
+func handleDrainStatus(w http.ResponseWriter, r *http.Request) {
+	kinds, ok := drainKinds(r)
+	if !ok {
+		integrationError(w, http.StatusBadRequest, "backend must be audio or llm")
+		return
+	}
+	writeJSON(w, http.StatusOK, drainStatus(kinds))
+}
+
+// handleDrain turns on maintenance mode, unless it is on already, and
+// waits up to ?wait= for the backend calls to drain. It answers 200 once
+// drained and 409 while calls are still in flight.
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	kinds, ok := drainKinds(r)
+	if !ok {
+		integrationError(w, http.StatusBadRequest, "backend must be audio or llm")
+		return
+	}
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			integrationError(w, http.StatusBadRequest, "wait must be a duration such as 10m")
+			return
+		}
+		wait = d
+	}
+
+	// The body is optional and sets the maintenance message and end
+	var req maintenanceRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&req)
+	hasBody := err == nil
+	if err != nil && !errors.Is(err, io.EOF) {
+		integrationError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if hasBody || !currentMaintenance().Enabled {
+		_, msg, err := startMaintenance(req)
+		if err != nil {
+			logErrorf(r.Context(), "Error saving maintenance state: %v", err)
+			integrationError(w, http.StatusInternalServerError, "Error saving maintenance state")
+			return
+		}
+		if msg != "" {
+			integrationError(w, http.StatusBadRequest, msg)
+			return
+		}
+	}
+	logf(r.Context(), "Draining %s backend calls", strings.Join(kinds, " and "))
+
+	status := drainStatus(kinds)
+	if !status.Drained && wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+	poll:
+		for !status.Drained {
+			select {
+			case <-ticker.C:
+				status = drainStatus(kinds)
+			case <-timer.C:
+				break poll
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+	if !status.Drained {
+		writeJSON(w, http.StatusConflict, status)
+		return
+	}
+	logf(r.Context(), "Drained: no %s backend calls in flight", strings.Join(kinds, " or "))
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleResume ends maintenance mode after an upgrade
+func handleResume(w http.ResponseWriter, r *http.Request) {
+	if err := endMaintenance(); err != nil {
+		logErrorf(r.Context(), "Error saving maintenance state: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error saving maintenance state")
+		return
+	}
+	writeJSON(w, http.StatusOK, drainStatus([]string{backendAudio, backendLLM}))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Localization teams work from a dubbing script: numbered cues with their
+// timecodes in and out, who speaks, and the line to record, flagged when it
+// cannot be read in the time the cue allows. The script is the original
+// transcript, or its translation by the translate step.
+
+// Limits of the dubbing script parameters
+const (
+	defaultDubFPS = 25
+	maxDubFPS     = 120
+)
+
+// DubCue is a line of a dubbing script
+type DubCue struct {
+	Number    int     `json:"number"`
+	In        string  `json:"in"`
+	Out       string  `json:"out"`
+	Start     float64 `json:"start"`
+	End       float64 `json:"end"`
+	Character string  `json:"character,omitempty"`
+	Text      string  `json:"text"`
+	// Original is the line in the language spoken, for translated scripts
+	Original string `json:"original,omitempty"`
+	// CPS is the reading speed the line needs, in characters per second
+	CPS     float64 `json:"cps"`
+	Warning string  `json:"warning,omitempty"`
+}
+
+// DubScript is a transcript laid out for dubbing
+type DubScript struct {
+	Title    string   `json:"title"`
+	Language string   `json:"language,omitempty"`
+	FPS      int      `json:"fps"`
+	MaxCPS   float64  `json:"max_cps"`
+	Cues     []DubCue `json:"cues"`
+	// Warnings counts the cues read too fast
+	Warnings int `json:"warnings"`
+}
+
+// timecode formats seconds as a non-drop-frame SMPTE timecode
+func timecode(seconds float64, fps int) string {
+	frames := int(math.Round(seconds * float64(fps)))
+	perHour := 3600 * fps
+	return fmt.Sprintf("%02d:%02d:%02d:%02d", frames/perHour, frames/(60*fps)%60, frames/fps%60, frames%fps)
+}
+
+// newDubScript lays out segments as cues. original holds the untranslated
+// segments of a translated script, nil otherwise.
+func newDubScript(title, language string, segments, original []Segment, fps int, maxCPS float64) DubScript {
+	script := DubScript{Title: title, Language: language, FPS: fps, MaxCPS: maxCPS, Cues: []DubCue{}}
+	for i, s := range segments {
+		text := strings.TrimSpace(s.Text)
+		if text == "" {
+			continue
+		}
+		cue := DubCue{
+			Number:    len(script.Cues) + 1,
+			In:        timecode(s.Start, fps),
+			Out:       timecode(s.End, fps),
+			Start:     s.Start,
+			End:       s.End,
+			Character: s.Speaker,
+			Text:      text,
+		}
+		if original != nil {
+			cue.Original = strings.TrimSpace(original[i].Text)
+		}
+		length := s.End - s.Start
+		if length <= 0 {
+			cue.Warning = "Cue has no duration"
+		} else {
+			cue.CPS = math.Round(float64(utf8.RuneCountInString(text))/length*10) / 10
+			if cue.CPS > maxCPS {
+				cue.Warning = fmt.Sprintf("Reading speed %.1f cps exceeds %g", cue.CPS, maxCPS)
+			}
+		}
+		if cue.Warning != "" {
+			script.Warnings++
+		}
+		script.Cues = append(script.Cues, cue)
+	}
+	return script
+}
+
+// dubCSVHeader names the columns of the CSV script
+var dubCSVHeader = []string{"cue", "tc_in", "tc_out", "character", "text", "original", "cps", "warning"}
+
+// writeDubCSV writes a script as CSV, one row per cue
+func writeDubCSV(w http.ResponseWriter, script DubScript) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(dubCSVHeader); err != nil {
+		return err
+	}
+	for _, c := range script.Cues {
+		row := []string{strconv.Itoa(c.Number), c.In, c.Out, csvCell(c.Character), csvCell(c.Text), csvCell(c.Original), strconv.FormatFloat(c.CPS, 'f', 1, 64), c.Warning}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// dubText renders a script to read or print
+func dubText(script DubScript) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", script.Title)
+	if script.Language != "" {
+		fmt.Fprintf(&b, "Language: %s\n", script.Language)
+	}
+	fmt.Fprintf(&b, "%d fps, reading speed up to %g cps, %d warnings\n", script.FPS, script.MaxCPS, script.Warnings)
+	for _, c := range script.Cues {
+		fmt.Fprintf(&b, "\n%03d  %s - %s", c.Number, c.In, c.Out)
+		if c.Character != "" {
+			fmt.Fprintf(&b, "  %s", strings.ToUpper(c.Character))
+		}
+		fmt.Fprintf(&b, "\n     %s\n", c.Text)
+		if c.Original != "" {
+			fmt.Fprintf(&b, "     (%s)\n", c.Original)
+		}
+		if c.Warning != "" {
+			fmt.Fprintf(&b, "     ! %s\n", c.Warning)
+		}
+	}
+	return b.String()
+}
+
+// handleDubScript exports a completed transcription as a dubbing script:
+// CSV by default, or as negotiated a text script or JSON. ?language= picks
+// the translation, ?fps= the frame rate of the timecodes and ?max_cps= the
+// reading speed above which cues are flagged.
+func handleDubScript(w http.ResponseWriter, r *http.Request) {
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !principalFrom(r.Context()).sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	if job.Status != jobCompleted {
+		integrationError(w, http.StatusConflict, "Transcription is not completed")
+		return
+	}
+	q := r.URL.Query()
+	fps := defaultDubFPS
+	if value := q.Get("fps"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxDubFPS {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("fps must be a whole number of frames per second up to %d", maxDubFPS))
+			return
+		}
+		fps = n
+	}
+	maxCPS := config.DubMaxCPS
+	if value := q.Get("max_cps"); value != "" {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || v <= 0 || math.IsInf(v, 0) {
+			integrationError(w, http.StatusBadRequest, "max_cps must be a positive number")
+			return
+		}
+		maxCPS = v
+	}
+	format := negotiate(r, mediaCSV, mediaText, mediaJSON)
+	if format == "" {
+		integrationError(w, http.StatusNotAcceptable, notAcceptable(mediaCSV, mediaText, mediaJSON))
+		return
+	}
+
+	segments := job.Segments
+	if len(segments) == 0 {
+		segments = []Segment{{Start: 0, End: job.Duration, Text: job.Text}}
+	}
+	language, original := job.Language, []Segment(nil)
+	if lang := q.Get("language"); lang != "" && !strings.EqualFold(lang, job.Language) {
+		if job.Translation == nil || !strings.EqualFold(lang, job.Translation.Language) {
+			integrationError(w, http.StatusNotFound, fmt.Sprintf("Transcription has no %s translation", lang))
+			return
+		}
+		language, original, segments = job.Translation.Language, segments, job.Translation.Segments
+		if len(original) != len(segments) {
+			original = nil
+		}
+	}
+	script := newDubScript(jobTitle(job), language, segments, original, fps, maxCPS)
+
+	w.Header().Set("Vary", "Accept")
+	name := job.ID
+	if language != "" {
+		name += "-" + language
+	}
+	switch format {
+	case mediaJSON:
+		writeJSON(w, http.StatusOK, script)
+	case mediaText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		setAttachment(w, name+"-dub", ".txt")
+		w.Write([]byte(dubText(script)))
+	default:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		setAttachment(w, name+"-dub", ".csv")
+		if err := writeDubCSV(w, script); err != nil {
+			logErrorf(r.Context(), "Error writing dub script of job %s: %v", job.ID, err)
+		}
+	}
+}
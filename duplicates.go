@@ -0,0 +1,108 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// When several attendees upload their own recording of a meeting, the
+// transcripts differ in wording and in where they start and stop, but
+// share most of their word sequences. A new transcript is compared with the
+// recent completed ones of the same tenant and workspace; when enough of it
+// matches, the job is linked to the earlier one with duplicate_of and hidden
+// from listings, feeds and digests.
+
+// shingleSize is the number of consecutive words compared
+const shingleSize = 3
+
+// minShingles is the shortest transcript, in shingles, that is compared;
+// short recordings share phrases by chance
+const minShingles = 50
+
+// shingles returns the hashes of the word sequences of text, ignoring case
+// and punctuation
+func shingles(text string) map[uint64]struct{} {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	set := make(map[uint64]struct{}, len(words))
+	for i := 0; i+shingleSize <= len(words); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(words[i:i+shingleSize], " ")))
+		set[h.Sum64()] = struct{}{}
+	}
+	return set
+}
+
+// overlap is the share of the smaller set found in the other, so a
+// recording that started late still matches the complete one
+func overlap(a, b map[uint64]struct{}) float64 {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	if len(a) == 0 {
+		return 0
+	}
+	common := 0
+	for h := range a {
+		if _, ok := b[h]; ok {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a))
+}
+
+// findDuplicate returns the earlier job of the same tenant and workspace
+// that text is a recording of, if any. Only jobs created within
+// DUPLICATE_WINDOW are compared.
+func findDuplicate(jobID string, req PipelineRequest, text string) (Job, float64, bool) {
+	if config.DuplicateThreshold <= 0 {
+		return Job{}, 0, false
+	}
+	own := shingles(text)
+	if len(own) < minShingles {
+		return Job{}, 0, false
+	}
+	scope := principal{Tenant: req.Tenant, Workspace: req.Workspace}
+	var best Job
+	bestScore := 0.0
+	for _, job := range pipelineJobs.list(scope, jobFilter{Status: jobCompleted}, maxJobListLimit) {
+		if job.ID == jobID || job.Workspace != req.Workspace || time.Since(job.CreatedAt) > config.DuplicateWindow {
+			continue
+		}
+		other := shingles(job.Text)
+		if len(other) < minShingles {
+			continue
+		}
+		if score := overlap(own, other); score > bestScore {
+			best, bestScore = job, score
+		}
+	}
+	if bestScore < config.DuplicateThreshold {
+		return Job{}, bestScore, false
+	}
+	return best, bestScore, true
+}
+
+// handleDuplicateUnlink clears a job's duplicate_of when it was linked by
+// mistake, returning it to listings
+func handleDuplicateUnlink(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !p.sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	if !p.owns(job) {
+		integrationError(w, http.StatusForbidden, "Only the creator of a transcription or an admin can unlink it")
+		return
+	}
+	if job.DuplicateOf != "" {
+		pipelineJobs.update(job.ID, func(j *Job) { j.DuplicateOf = "" })
+		logf(r.Context(), "Job %s: unlinked from %s by %s", job.ID, job.DuplicateOf, p.ID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
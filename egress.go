@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// In air-gapped deployments (AIRGAPPED=true) every outbound connection goes
+// through dialEgress, which only connects to the inference backends named in
+// the configuration (AUDIO_INFERENCE_URL, LLM_INFERENCE_URL, AUDIO_ENHANCER_URL,
+// TENANT_ROUTES and REGIONS), to OBJECT_STORAGE_ENDPOINT and to the
+// host:port pairs in EGRESS_ALLOWLIST. A host name is resolved once and its
+// addresses are pinned for the life of the process, so a DNS change cannot
+// redirect traffic elsewhere. Proxies from the
+// environment are ignored and features that fetch arbitrary URLs refuse to
+// run. Every refused connection is logged and counted.
+//
+// Outside air-gapped mode, audio URLs are still only fetched from public
+// addresses (see newFetchTransport), unless ALLOW_PRIVATE_AUDIO_URLS is set
+// for deployments that fetch from internal sources.
+
+// egressBlocked counts refused outbound connections, on /debug/vars
+var egressBlocked = expvar.NewInt("egress_blocked_total")
+
+// errEgressBlocked is returned when a destination is not allowed
+var errEgressBlocked = errors.New("outbound connection blocked in air-gapped mode")
+
+// pinnedHosts holds the addresses resolved for allowed host:port pairs
+var pinnedHosts = struct {
+	sync.Mutex
+	addrs map[string][]string
+}{addrs: make(map[string][]string)}
+
+// urlHostPort returns the host:port a URL connects to
+func urlHostPort(raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		return "", false
+	}
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https", "wss":
+			port = "443"
+		case "http", "ws":
+			port = "80"
+		default:
+			return "", false
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port), true
+}
+
+// egressAllowlist returns the destinations currently allowed. It is built
+// on every call so reloaded TENANT_ROUTES and REGIONS apply.
+func egressAllowlist() map[string]bool {
+	allowed := make(map[string]bool)
+	add := func(up Upstream) {
+		for _, raw := range append(splitBackendURLs(up.AudioURL), up.LLMURL) {
+			if addr, ok := urlHostPort(raw); ok {
+				allowed[addr] = true
+			}
+		}
+	}
+	add(defaultUpstream())
+	if addr, ok := urlHostPort(config.AudioEnhancerURL); ok {
+		allowed[addr] = true
+	}
+	if config.ObjectStorageBucket != "" {
+		if addr, ok := urlHostPort(objectEndpoint()); ok {
+			allowed[addr] = true
+		}
+	}
+	for _, route := range tenantRoutes() {
+		add(route.Upstream)
+	}
+	for _, region := range regions() {
+		add(region.Upstream)
+	}
+	for _, entry := range strings.Split(config.EgressAllowlist, ",") {
+		if host, port, err := net.SplitHostPort(strings.TrimSpace(entry)); err == nil {
+			allowed[net.JoinHostPort(strings.ToLower(host), port)] = true
+		}
+	}
+	return allowed
+}
+
+// pinnedAddrs returns the pinned addresses of an allowed host:port,
+// resolving it on first use
+func pinnedAddrs(ctx context.Context, hostport string) ([]string, error) {
+	pinnedHosts.Lock()
+	defer pinnedHosts.Unlock()
+	if addrs, ok := pinnedHosts.addrs[hostport]; ok {
+		return addrs, nil
+	}
+	host, port, _ := net.SplitHostPort(hostport)
+	var addrs []string
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []string{hostport}
+	} else {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.IP.String(), port))
+		}
+		logf(ctx, "Egress: pinned %s to %s", hostport, strings.Join(addrs, ", "))
+	}
+	pinnedHosts.addrs[hostport] = addrs
+	return addrs, nil
+}
+
+// dialEgress connects to addr with dialer, enforcing the allowlist in
+// air-gapped mode
+func dialEgress(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	if !config.Airgapped {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	hostport := net.JoinHostPort(strings.ToLower(host), port)
+	if !egressAllowlist()[hostport] {
+		egressBlocked.Add(1)
+		logf(ctx, "Egress blocked: connection to %s is not in the allowlist", hostport)
+		return nil, fmt.Errorf("%w: %s", errEgressBlocked, hostport)
+	}
+	addrs, err := pinnedAddrs(ctx, hostport)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, a := range addrs {
+		conn, err := dialer.DialContext(ctx, network, a)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// newEgressTransport returns an HTTP transport that dials through
+// dialEgress. Environment proxies are not used in air-gapped mode, as the
+// proxy would make the connections instead.
+func newEgressTransport(dialTimeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialEgress(ctx, dialer, network, addr)
+	}
+	transport.TLSClientConfig = tlsClientConfig()
+	if config.Airgapped {
+		transport.Proxy = nil
+	}
+	return transport
+}
+
+// privateFetchesBlocked counts refused connections to fetch audio URLs on
+// private addresses, on /debug/vars
+var privateFetchesBlocked = expvar.NewInt("audio_url_private_blocked_total")
+
+// errPrivateAddress is returned when an audio URL leads to an internal
+// address
+var errPrivateAddress = errors.New("audio URLs on private addresses are not fetched")
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), internal to
+// many cloud networks
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicAddress reports whether ip is on the internet rather than the
+// server's own networks: loopback, private, link-local (such as the
+// 169.254.169.254 metadata service), unspecified and multicast addresses
+// are not
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsUnspecified() && !ip.IsMulticast() && !sharedAddressSpace.Contains(ip)
+}
+
+// newFetchTransport returns the transport audio URLs from API keys and
+// hooks are fetched with. Unless ALLOW_PRIVATE_AUDIO_URLS is set, every
+// connection it makes, redirects included, is checked once the host name
+// is resolved and refused to addresses that are not public, so a URL cannot
+// reach the server's own network. Environment proxies are not used then, as
+// the proxy would make the connection instead.
+func newFetchTransport(dialTimeout time.Duration) *http.Transport {
+	transport := newEgressTransport(dialTimeout)
+	if config.AllowPrivateAudioURLs {
+		return transport
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+	dialer.Control = func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+			privateFetchesBlocked.Add(1)
+			return fmt.Errorf("%w: %s", errPrivateAddress, host)
+		}
+		return nil
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialEgress(ctx, dialer, network, addr)
+	}
+	transport.Proxy = nil
+	return transport
+}
+
+// initEgress pins the configured backends at startup
+func initEgress() {
+	if !config.Airgapped {
+		return
+	}
+	allowed := egressAllowlist()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for hostport := range allowed {
+		if _, err := pinnedAddrs(ctx, hostport); err != nil {
+			logWarnf(ctx, "Warning: could not resolve %s, it will be pinned on first use: %v", hostport, err)
+		}
+	}
+	logf(ctx, "Air-gapped mode: outbound connections limited to %d destination(s), URL ingest disabled", len(allowed))
+}
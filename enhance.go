@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Noisy recordings can be enhanced before they are transcribed. Enhancement
+// is on for every request with AUDIO_DENOISE=true, and a request can turn it
+// on or off with enhance. Only audio assessed as noisy is enhanced, with the
+// enhancer named by AUDIO_ENHANCER: ffmpeg's FFT denoiser (fft), the RNNoise
+// neural denoiser built into ffmpeg (rnnoise), or an external enhancement
+// model that receives the WAV audio and answers with the enhanced audio
+// (endpoint). The enhanced audio is assessed again, so the response reports
+// the quality before and after.
+
+// Speech enhancers
+const (
+	enhancerFFT      = "fft"
+	enhancerRNNoise  = "rnnoise"
+	enhancerEndpoint = "endpoint"
+)
+
+// denoiseFilter is the ffmpeg filter applied by the fft enhancer: rumble
+// below 80 Hz is cut, and FFT denoising tracks the noise floor as it changes
+const denoiseFilter = "highpass=f=80,afftdn=nr=20:tn=1"
+
+// enhanceClient calls the enhancement endpoint
+var enhanceClient *http.Client
+
+// validEnhancer reports whether name is a speech enhancer
+func validEnhancer(name string) bool {
+	return name == enhancerFFT || name == enhancerRNNoise || name == enhancerEndpoint
+}
+
+// enhanceRequested returns whether noisy audio is enhanced for a request
+// whose enhance field is value, AUDIO_DENOISE when it has none
+func enhanceRequested(value string) (bool, error) {
+	if value == "" {
+		return config.AudioDenoise, nil
+	}
+	enhance, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("enhance must be true or false")
+	}
+	return enhance, nil
+}
+
+// enhanceAudio writes the audio of the WAV file src, enhanced, to the WAV
+// file dst
+func enhanceAudio(ctx context.Context, src, dst string) error {
+	switch config.AudioEnhancer {
+	case enhancerEndpoint:
+		return enhanceWithEndpoint(ctx, src, dst)
+	case enhancerRNNoise:
+		if !canConvertAudio() {
+			return errNoConverter
+		}
+		return convertToWAV(ctx, src, dst, "-af", "highpass=f=80,arnndn=m="+filterQuote(config.AudioEnhancerModel))
+	default:
+		if !canConvertAudio() {
+			return errNoConverter
+		}
+		return convertToWAV(ctx, src, dst, "-af", denoiseFilter)
+	}
+}
+
+// filterQuote quotes s as a value in an ffmpeg filter graph
+func filterQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// enhanceWithEndpoint posts the WAV file src to AUDIO_ENHANCER_URL and
+// writes the audio it answers with to dst
+func enhanceWithEndpoint(ctx context.Context, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", config.AudioEnhancerURL, in)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "audio/wav")
+	req.Header.Set("Accept", "audio/wav")
+	if key := config.AudioEnhancerAPIKey.Value(); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	resp, err := enhanceClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling enhancement service: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("enhancement service error (status %d): %s", resp.StatusCode, describeBody(string(body)))
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, resp.Body)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = checkWAVFile(dst)
+	}
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("reading enhanced audio: %w", err)
+	}
+	return nil
+}
+
+// checkWAVFile reports an error when the file at path is not WAV audio
+func checkWAVFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = readWAV(f)
+	return err
+}
+
+// enhanceNoisyAudio enhances the WAV file at path into a new file next to
+// it when quality found it noisy. It returns the file to transcribe, which
+// the caller removes when it is not path, and records the enhancement and
+// the quality after it on quality.
+func enhanceNoisyAudio(ctx context.Context, path, name string, quality *AudioQuality) string {
+	if !quality.noisy() {
+		return path
+	}
+	start := time.Now()
+	enhanced := strings.TrimSuffix(path, ".wav") + ".enhanced.wav"
+	err := enhanceAudio(ctx, path, enhanced)
+	stageTimerFrom(ctx).since(stagePreprocess, start)
+	if errors.Is(err, errNoConverter) {
+		logf(ctx, "Not enhancing %s: the %s enhancer requires ffmpeg on the server", name, config.AudioEnhancer)
+		return path
+	}
+	if err != nil {
+		logErrorf(ctx, "Error enhancing %s: %v", name, err)
+		return path
+	}
+	quality.Denoised = true
+	quality.Enhancer = config.AudioEnhancer
+	if file, err := os.Open(enhanced); err == nil {
+		quality.Enhanced, _ = measureAudio(file)
+		file.Close()
+	}
+	if after := quality.Enhanced; after != nil {
+		logf(ctx, "Enhanced %s with %s: signal-to-noise ratio %.0f dB, %.0f dB before", name, config.AudioEnhancer, after.SNR, quality.SNR)
+	} else {
+		logf(ctx, "Enhanced %s with %s", name, config.AudioEnhancer)
+	}
+	return enhanced
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Before uploading an hour of audio, users want to know whether to wait for
+// the result or come back later. Estimates are based on the rolling
+// averages of the last transcriptions and LLM calls on this replica: how
+// long a second of audio takes to transcribe, how much text it yields, and
+// how long the LLM takes per character of prompt. Until there are samples,
+// conservative defaults are used. Tokens are approximated from characters,
+// and costs come from COST_PER_AUDIO_MINUTE and COST_PER_1K_TOKENS.
+
+// rollingWindow is the number of recent samples averaged
+const rollingWindow = 100
+
+// Defaults used until samples have been recorded
+const (
+	// defaultRealtimeFactor is the processing time per second of audio
+	defaultRealtimeFactor = 0.1
+	// defaultCharsPerSecond is about 150 spoken words a minute
+	defaultCharsPerSecond = 15
+	// defaultLLMSecondsPerChar is one second per 1,000 prompt characters
+	defaultLLMSecondsPerChar = 0.001
+)
+
+// charsPerToken approximates the tokens of English text
+const charsPerToken = 4
+
+// stepOutputTokens is the typical length of each LLM step's answer
+var stepOutputTokens = map[string]int{
+	stepSummarize:   300,
+	stepActionItems: 300,
+	stepTags:        30,
+	stepDecisions:   300,
+	stepRisks:       300,
+	stepFeedback:    300,
+	stepScorecard:   400,
+	stepStudyNotes:  800,
+	stepFlashcards:  800,
+	stepQuiz:        800,
+	stepOutline:     600,
+	stepTranslate:   0,
+	"title":         20,
+}
+
+// rollingRatio averages y per unit of x over the last samples
+type rollingRatio struct {
+	mu      sync.Mutex
+	samples [][2]float64
+	next    int
+}
+
+func (r *rollingRatio) add(x, y float64) {
+	if x <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.samples) < rollingWindow {
+		r.samples = append(r.samples, [2]float64{x, y})
+		return
+	}
+	r.samples[r.next] = [2]float64{x, y}
+	r.next = (r.next + 1) % rollingWindow
+}
+
+// ratio returns the sum of y over the sum of x, or fallback without samples
+func (r *rollingRatio) ratio(fallback float64) (float64, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sx, sy float64
+	for _, s := range r.samples {
+		sx += s[0]
+		sy += s[1]
+	}
+	if sx == 0 {
+		return fallback, 0
+	}
+	return sy / sx, len(r.samples)
+}
+
+var (
+	// transcriptionTime is seconds of processing per second of audio
+	transcriptionTime rollingRatio
+	// transcriptionChars is characters of text per second of audio
+	transcriptionChars rollingRatio
+	// llmTime is seconds per character of prompt
+	llmTime rollingRatio
+)
+
+// recordTranscription adds a completed transcription to the averages
+func recordTranscription(result *TranscriptionResult, elapsed time.Duration) {
+	transcriptionTime.add(result.Duration, elapsed.Seconds())
+	transcriptionChars.add(result.Duration, float64(len(result.Text)))
+}
+
+// timedTransport records the duration of successful LLM calls. Streamed
+// answers are skipped, as the response starts before generation ends.
+type timedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusOK && !strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+		llmTime.add(float64(req.ContentLength), time.Since(start).Seconds())
+	}
+	return resp, err
+}
+
+// StepEstimate is the predicted cost of one step
+type StepEstimate struct {
+	Step    string  `json:"step"`
+	Seconds float64 `json:"seconds"`
+	Tokens  int     `json:"tokens,omitempty"`
+	Cost    float64 `json:"cost,omitempty"`
+}
+
+// Estimate is the predicted processing time and cost of a job
+type Estimate struct {
+	Duration     float64        `json:"duration"`
+	Pipeline     string         `json:"pipeline,omitempty"`
+	Seconds      float64        `json:"seconds"`
+	AudioMinutes float64        `json:"audio_minutes"`
+	Tokens       int            `json:"tokens"`
+	Cost         float64        `json:"cost,omitempty"`
+	Currency     string         `json:"currency,omitempty"`
+	Steps        []StepEstimate `json:"steps"`
+	// Samples is how many recent transcriptions and LLM calls the
+	// averages are based on; 0 means defaults were used
+	Samples map[string]int `json:"samples"`
+}
+
+// round1 rounds to one decimal
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+// estimate predicts the processing of duration seconds of audio through
+// steps
+func estimate(duration float64, steps []string) Estimate {
+	realtime, nTranscriptions := transcriptionTime.ratio(defaultRealtimeFactor)
+	charsPerSecond, _ := transcriptionChars.ratio(defaultCharsPerSecond)
+	llmPerChar, nLLM := llmTime.ratio(defaultLLMSecondsPerChar)
+	priced := config.CostPerAudioMinute > 0 || config.CostPer1kTokens > 0
+
+	e := Estimate{
+		Duration:     duration,
+		AudioMinutes: round1(duration / 60),
+		Samples:      map[string]int{"transcriptions": nTranscriptions, "llm_calls": nLLM},
+	}
+	textChars := duration * charsPerSecond
+	for _, step := range steps {
+		s := StepEstimate{Step: step}
+		if step == stepTranscribe {
+			s.Seconds = duration * realtime
+			s.Cost = duration / 60 * config.CostPerAudioMinute
+		} else {
+			prompt := textChars
+			if step == "title" {
+				prompt = min(prompt, 4000)
+			}
+			s.Seconds = prompt * llmPerChar
+			s.Tokens = int(prompt/charsPerToken) + stepOutputTokens[step]
+			// The translation is about as long as the transcript
+			if step == stepTranslate {
+				s.Seconds *= 2
+				s.Tokens += int(prompt / charsPerToken)
+			}
+			s.Cost = float64(s.Tokens) / 1000 * config.CostPer1kTokens
+		}
+		e.Seconds += s.Seconds
+		e.Tokens += s.Tokens
+		e.Cost += s.Cost
+		s.Seconds = round1(s.Seconds)
+		s.Cost = math.Round(s.Cost*10000) / 10000
+		e.Steps = append(e.Steps, s)
+	}
+	e.Seconds = math.Ceil(e.Seconds)
+	if priced {
+		e.Cost = math.Round(e.Cost*10000) / 10000
+		e.Currency = config.CostCurrency
+	} else {
+		e.Cost = 0
+		for i := range e.Steps {
+			e.Steps[i].Cost = 0
+		}
+	}
+	return e
+}
+
+// estimateRequest reads the duration and steps of an estimate from the
+// query: duration in seconds or as a Go duration ("45m"), and either a
+// pipeline name or a comma-separated list of steps after transcription
+func estimateRequest(q url.Values) (Estimate, string, bool) {
+	raw := q.Get("duration")
+	duration, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		d, derr := time.ParseDuration(raw)
+		duration, err = d.Seconds(), derr
+	}
+	if err != nil || duration <= 0 || duration > (24*time.Hour).Seconds() || math.IsNaN(duration) {
+		return Estimate{}, "duration must be a positive number of seconds or a duration such as 45m, up to 24h", false
+	}
+
+	steps := []string{stepTranscribe}
+	pipeline := q.Get("pipeline")
+	switch {
+	case pipeline != "" && q.Get("steps") != "":
+		return Estimate{}, "pass either pipeline or steps", false
+	case pipeline != "":
+		if !validPipeline(pipeline) {
+			return Estimate{}, "Unknown pipeline", false
+		}
+		steps = pipelineSteps(pipeline)
+		// Pipelines also title their jobs
+		if config.AutoTitles {
+			steps = append(steps[:1:1], append([]string{"title"}, steps[1:]...)...)
+		}
+	case q.Get("steps") != "":
+		for _, step := range strings.Split(q.Get("steps"), ",") {
+			step = strings.TrimSpace(step)
+			if step == stepTranscribe {
+				continue
+			}
+			if _, ok := stepOutputTokens[step]; !ok {
+				return Estimate{}, "steps must be among summarize, action_items, tags, decisions, risks, feedback, scorecard, study_notes, flashcards, quiz, outline, translate and title", false
+			}
+			steps = append(steps, step)
+		}
+	}
+	e := estimate(duration, steps)
+	e.Pipeline = pipeline
+	return e, "", true
+}
+
+// handleEstimate predicts a web UI upload (GET /estimate)
+func handleEstimate(w http.ResponseWriter, r *http.Request) {
+	if _, ok := browserPrincipal(w, r); !ok {
+		return
+	}
+	e, msg, ok := estimateRequest(r.URL.Query())
+	if !ok {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+// handleIntegrationEstimate predicts a job of the integrations API
+func handleIntegrationEstimate(w http.ResponseWriter, r *http.Request) {
+	e, msg, ok := estimateRequest(r.URL.Query())
+	if !ok {
+		integrationError(w, http.StatusBadRequest, msg)
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
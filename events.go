@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lifecycle event types published to the event bus. On the wire they are
+// prefixed with cloudEventTypePrefix to form the CloudEvents "type".
+const (
+	EventJobCreated          = "job.created"
+	EventTranscriptCompleted = "transcript.completed"
+	EventSummaryCompleted    = "summary.completed"
+	EventJobFailed           = "job.failed"
+
+	// Sent only to the integration named by an alert rule
+	EventAlertFired    = "alert.fired"
+	EventAlertResolved = "alert.resolved"
+
+	// Sent only to the integration named by a channel
+	EventChannelAlert = "channel.alert"
+)
+
+// cloudEventTypePrefix namespaces event types in reverse-DNS form
+const cloudEventTypePrefix = "com.github.fjcloud.transcription."
+
+// Event bus metrics exported on /debug/vars
+var (
+	eventsPublished = expvar.NewInt("events_published_total")
+	eventsDropped   = expvar.NewInt("events_dropped_total")
+	eventsFailed    = expvar.NewInt("events_failed_total")
+)
+
+// CloudEvent is the CloudEvents 1.0 envelope used for every outbound
+// notification, serialized in structured mode
+type CloudEvent struct {
+	SpecVersion     string         `json:"specversion"`
+	ID              string         `json:"id"`
+	Source          string         `json:"source"`
+	Type            string         `json:"type"`
+	Subject         string         `json:"subject,omitempty"`
+	Time            time.Time      `json:"time"`
+	DataContentType string         `json:"datacontenttype"`
+	Data            map[string]any `json:"data,omitempty"`
+}
+
+// cloudEventContentType is the media type of a structured-mode event
+const cloudEventContentType = "application/cloudevents+json"
+
+// newCloudEvent wraps event data about a job in a CloudEvents envelope
+func newCloudEvent(eventType, jobID string, data map[string]any) CloudEvent {
+	return CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              newID(),
+		Source:          config.EventSource,
+		Type:            cloudEventTypePrefix + eventType,
+		Subject:         jobID,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+}
+
+// eventPublisher delivers serialized events to a bus
+type eventPublisher interface {
+	publish(key string, payload []byte) error
+}
+
+// eventBus queues events so publishing never blocks request handling
+type eventBus struct {
+	publisher eventPublisher
+	queue     chan CloudEvent
+}
+
+var bus *eventBus
+
+// eventQueueSize bounds events waiting for delivery; overflow is dropped
+const eventQueueSize = 1024
+
+// publishEvent queues a lifecycle event for delivery to subscribed
+// integrations and, when configured, the event bus, and returns it
+func publishEvent(eventType, jobID string, data map[string]any) CloudEvent {
+	event := newCloudEvent(eventType, jobID, data)
+	dispatchWebhooks(event)
+	if bus == nil {
+		return event
+	}
+	select {
+	case bus.queue <- event:
+	default:
+		eventsDropped.Add(1)
+		logWarnf(context.Background(), "Event queue full, dropping %s event for job %s", eventType, jobID)
+	}
+	return event
+}
+
+func (b *eventBus) run() {
+	for event := range b.queue {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			logErrorf(context.Background(), "Error encoding %s event: %v", event.Type, err)
+			continue
+		}
+		if err := b.publisher.publish(event.Subject, payload); err != nil {
+			eventsFailed.Add(1)
+			logErrorf(context.Background(), "Error publishing %s event for job %s: %v", event.Type, event.Subject, err)
+			continue
+		}
+		eventsPublished.Add(1)
+	}
+}
+
+// initEventBus connects the configured bus, if any
+func initEventBus() {
+	if config.EventBusURL.Value() == "" {
+		return
+	}
+
+	var publisher eventPublisher
+	switch config.EventBus {
+	case "nats":
+		publisher = newNATSPublisher(config.EventBusURL, config.EventBusTopic)
+	case "kafka":
+		publisher = newKafkaRESTPublisher(config.EventBusURL, config.EventBusTopic)
+	default:
+		log.Fatalf("Unsupported EVENT_BUS %q (expected \"nats\" or \"kafka\")", config.EventBus)
+	}
+
+	bus = &eventBus{publisher: publisher, queue: make(chan CloudEvent, eventQueueSize)}
+	go bus.run()
+	logf(context.Background(), "Publishing events to %s topic %q", config.EventBus, config.EventBusTopic)
+}
+
+// jobRecorder follows the outcome of a request handled as a job. It wraps
+// the handler's ResponseWriter so that, once the job has been created, any
+// error response is published as job.failed without touching every branch.
+type jobRecorder struct {
+	http.ResponseWriter
+	id      string
+	kind    string
+	created bool
+	failed  bool
+	status  int
+	errBody bytes.Buffer
+}
+
+// maxErrorCapture bounds how much of an error response is kept for events
+const maxErrorCapture = 512
+
+// startJob assigns a job ID, returned to the client in X-Job-ID
+func startJob(w http.ResponseWriter, kind string) *jobRecorder {
+	id := newID()
+	w.Header().Set("X-Job-ID", id)
+	return &jobRecorder{ResponseWriter: w, id: id, kind: kind, status: http.StatusOK}
+}
+
+// create marks the request as accepted and publishes job.created
+func (j *jobRecorder) create(data map[string]any) {
+	j.created = true
+	if data == nil {
+		data = make(map[string]any)
+	}
+	data["kind"] = j.kind
+	publishEvent(EventJobCreated, j.id, data)
+}
+
+// fail publishes job.failed for errors reported after the response started
+func (j *jobRecorder) fail(err error) {
+	if !j.created || j.failed {
+		return
+	}
+	j.failed = true
+	publishEvent(EventJobFailed, j.id, map[string]any{"kind": j.kind, "error": err.Error()})
+}
+
+// finish publishes job.failed if the handler answered with an error
+func (j *jobRecorder) finish() {
+	if j.status >= http.StatusBadRequest {
+		j.fail(fmt.Errorf("status %d: %s", j.status, strings.TrimSpace(j.errBody.String())))
+	}
+}
+
+func (j *jobRecorder) WriteHeader(code int) {
+	j.status = code
+	j.ResponseWriter.WriteHeader(code)
+}
+
+func (j *jobRecorder) Write(b []byte) (int, error) {
+	if j.status >= http.StatusBadRequest && j.errBody.Len() < maxErrorCapture {
+		j.errBody.Write(b[:min(len(b), maxErrorCapture-j.errBody.Len())])
+	}
+	return j.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses working through the wrapper
+func (j *jobRecorder) Flush() {
+	if flusher, ok := j.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// interactiveJob is a request answered directly, tracked as a job so its
+// outcome can be published
+type interactiveJob struct {
+	*jobRecorder
+	// r is the request, timed and marked interactive
+	r        *http.Request
+	timer    *stageTimer
+	caller   principal
+	up       Upstream
+	warnings []QuotaWarning
+}
+
+// startInteractiveJob admits a request of the web UI or an API client
+// answered directly: it identifies the caller, refuses the request while
+// the server is shutting down, under maintenance or, for uploads, nearly
+// out of storage, picks the caller's backends and counts the job against
+// its workspace's quota. It answers the request itself when it refuses it.
+func startInteractiveJob(w http.ResponseWriter, r *http.Request, kind string, upload bool) (*interactiveJob, bool) {
+	r, timer := startTiming(r)
+	job := &interactiveJob{jobRecorder: startJob(w, kind), timer: timer}
+	caller, ok := browserPrincipal(job, r)
+	if !ok {
+		return nil, false
+	}
+	job.caller = caller
+	job.r = markInteractive(r, caller)
+	if refuseWhileShuttingDown(job, false) || refuseDuringMaintenance(job, false) {
+		return nil, false
+	}
+	if job.up, ok = tenantUpstream(job, job.r, caller.Tenant); !ok {
+		return nil, false
+	}
+	if upload && refuseUnderDiskPressure(job, false) {
+		return nil, false
+	}
+	warnings, msg, ok := admitWorkspaceJob(job, caller.Workspace)
+	if !ok {
+		http.Error(job, msg, http.StatusTooManyRequests)
+		return nil, false
+	}
+	job.warnings = warnings
+	return job, true
+}
+
+// newID returns a random identifier for jobs and events
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// natsPublisher speaks the NATS text protocol directly over TCP
+type natsPublisher struct {
+	url     *Secret
+	subject string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newNATSPublisher(serverURL *Secret, subject string) *natsPublisher {
+	if _, _, err := parseNATSURL(serverURL.Value()); err != nil {
+		log.Fatalf("Invalid EVENT_BUS_URL: %v", err)
+	}
+	return &natsPublisher{url: serverURL, subject: subject}
+}
+
+// parseNATSURL returns the server address and credentials of a NATS URL
+func parseNATSURL(rawURL string) (string, *url.Userinfo, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "", nil, errors.New("expected nats://host:4222")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	return addr, u.User, nil
+}
+
+// connect performs the CONNECT handshake and starts answering server PINGs.
+// The URL is parsed on every connect so rotated credentials are picked up.
+func (n *natsPublisher) connect() (net.Conn, error) {
+	addr, user, err := parseNATSURL(n.url.Value())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialEgress(context.Background(), &net.Dialer{Timeout: 10 * time.Second}, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	info, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected NATS greeting %q: %v", strings.TrimSpace(info), err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	options := map[string]any{"verbose": false, "pedantic": false, "headers": true, "name": "transcription-app"}
+	if user != nil {
+		if password, ok := user.Password(); ok {
+			options["user"] = user.Username()
+			options["pass"] = password
+		} else {
+			options["auth_token"] = user.Username()
+		}
+	}
+	handshake, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", handshake); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go n.readLoop(conn, reader)
+	return conn, nil
+}
+
+// readLoop keeps the connection alive and surfaces server errors
+func (n *natsPublisher) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			n.reset(conn)
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			n.mu.Lock()
+			conn.Write([]byte("PONG\r\n"))
+			n.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			logErrorf(context.Background(), "NATS error: %s", strings.TrimSpace(line))
+		}
+	}
+}
+
+// reset drops a broken connection so the next publish reconnects
+func (n *natsPublisher) reset(conn net.Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	conn.Close()
+	if n.conn == conn {
+		n.conn = nil
+	}
+}
+
+func (n *natsPublisher) publish(key string, payload []byte) error {
+	n.mu.Lock()
+	conn := n.conn
+	n.mu.Unlock()
+
+	if conn == nil {
+		var err error
+		if conn, err = n.connect(); err != nil {
+			return err
+		}
+		n.mu.Lock()
+		n.conn = conn
+		n.mu.Unlock()
+	}
+
+	// Structured-mode CloudEvents carry their content type in a NATS header
+	headers := "NATS/1.0\r\nContent-Type: " + cloudEventContentType + "\r\n\r\n"
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "HPUB %s %d %d\r\n", n.subject, len(headers), len(headers)+len(payload))
+	msg.WriteString(headers)
+	msg.Write(payload)
+	msg.WriteString("\r\n")
+
+	n.mu.Lock()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := conn.Write(msg.Bytes())
+	n.mu.Unlock()
+	if err != nil {
+		n.reset(conn)
+	}
+	return err
+}
+
+// kafkaRESTPublisher produces records through a Kafka REST Proxy, which
+// keeps the server free of a native Kafka client dependency
+type kafkaRESTPublisher struct {
+	baseURL *Secret
+	topic   string
+	client  *http.Client
+}
+
+func newKafkaRESTPublisher(baseURL *Secret, topic string) *kafkaRESTPublisher {
+	return &kafkaRESTPublisher{baseURL: baseURL, topic: topic, client: &http.Client{Transport: newEgressTransport(10 * time.Second), Timeout: 10 * time.Second}}
+}
+
+// endpoint is resolved per publish so a rotated proxy URL takes effect
+func (k *kafkaRESTPublisher) endpoint() string {
+	return strings.TrimRight(k.baseURL.Value(), "/") + "/topics/" + url.PathEscape(k.topic)
+}
+
+func (k *kafkaRESTPublisher) publish(key string, payload []byte) error {
+	// The REST Proxy embeds the structured-mode event as the record value
+	body, err := json.Marshal(map[string]any{
+		"records": []map[string]any{{"key": key, "value": json.RawMessage(payload)}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := k.client.Post(k.endpoint(), "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kafka REST proxy returned status %d", resp.StatusCode)
+	}
+	return nil
+}
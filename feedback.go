@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The feedback pipeline step mines sales and support calls for the
+// objections customers raise, the questions they ask and the features they
+// request, each under a short theme. A feedback report ranks the themes of
+// all calls with one tag by how many calls mention them, e.g. the top
+// objections of the last 30 days of sales calls, with example quotes.
+// Reports are kept per API key and rebuilt daily or weekly by the leader,
+// so they are ready when read.
+
+// Kinds of customer feedback
+const (
+	feedbackObjection = "objection"
+	feedbackQuestion  = "question"
+	feedbackRequest   = "feature_request"
+)
+
+// feedbackReportKeyPrefix namespaces reports in the state store, keyed by
+// the API key's principal ID and the tag
+const feedbackReportKeyPrefix = "feedback-report:"
+
+// feedbackCheckInterval is how often the leader looks for reports to rebuild
+const feedbackCheckInterval = time.Minute
+
+// feedbackRefresh is the time between rebuilds of a report
+var feedbackRefresh = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// Feedback report limits
+const (
+	defaultFeedbackPeriodDays = 30
+	maxFeedbackPeriodDays     = 365
+	maxFeedbackThemes         = 25
+	feedbackExamples          = 3
+)
+
+// FeedbackItem is an objection, question or feature request raised in a call
+type FeedbackItem struct {
+	Kind string `json:"kind"`
+	Text string `json:"text"`
+	// Theme groups the same feedback across calls
+	Theme string `json:"theme"`
+}
+
+// feedbackPrompt instructs the LLM to answer with JSON only
+const feedbackPrompt = `You analyze the transcript of a sales or support call for what the customer raised. Answer with a JSON array only, without any other text. Each element is an object with the fields:
+- "kind": "objection" for a concern or reason not to buy or continue, "question" for something the customer asked, or "feature_request" for something the customer wants the product to do
+- "text": what the customer said, as one short sentence
+- "theme": one to three lowercase words naming the subject generically, such as "pricing", "data export" or "single sign-on", so the same feedback from different calls gets the same theme
+Only include what the customer raised, not the vendor. Answer with [] when there is nothing.`
+
+// newFeedbackRequest builds the chat completion request extracting customer
+// feedback from text
+func newFeedbackRequest(model, text string) ChatCompletionRequest {
+	return ChatCompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: "system", Content: feedbackPrompt},
+			{Role: "user", Content: fmt.Sprintf("Transcription:\n\n%s", text)},
+		},
+		Temperature: 0,
+	}
+}
+
+// extractFeedback asks the LLM for the objections, questions and feature
+// requests in text
+func extractFeedback(ctx context.Context, up Upstream, text string) ([]FeedbackItem, error) {
+	var raw []FeedbackItem
+	if err := llmJSON(ctx, up, newFeedbackRequest(up.LLMModel, text), &raw); err != nil {
+		return nil, err
+	}
+	return cleanFeedback(raw), nil
+}
+
+// cleanFeedback drops items without text or of an unknown kind, and
+// normalizes themes like tags, falling back to "other"
+func cleanFeedback(raw []FeedbackItem) []FeedbackItem {
+	items := []FeedbackItem{}
+	for _, item := range raw {
+		item.Text = strings.TrimSpace(item.Text)
+		item.Kind = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(item.Kind)), " ", "_")
+		if item.Text == "" || (item.Kind != feedbackObjection && item.Kind != feedbackQuestion && item.Kind != feedbackRequest) {
+			continue
+		}
+		if item.Theme = normalizeTag(item.Theme); item.Theme == "" {
+			item.Theme = "other"
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// FeedbackExample is a quote of a theme from one call
+type FeedbackExample struct {
+	Text            string `json:"text"`
+	TranscriptionID string `json:"transcription_id"`
+	Title           string `json:"title"`
+}
+
+// FeedbackTheme is how often a theme came up. Share is the fraction of the
+// report's calls that mention it.
+type FeedbackTheme struct {
+	Theme    string            `json:"theme"`
+	Calls    int               `json:"calls"`
+	Mentions int               `json:"mentions"`
+	Share    float64           `json:"share"`
+	Examples []FeedbackExample `json:"examples"`
+}
+
+// FeedbackReport ranks the feedback of the calls with a tag
+type FeedbackReport struct {
+	Tag             string          `json:"tag"`
+	From            time.Time       `json:"from"`
+	To              time.Time       `json:"to"`
+	Transcriptions  int             `json:"transcriptions"`
+	Objections      []FeedbackTheme `json:"objections"`
+	Questions       []FeedbackTheme `json:"questions"`
+	FeatureRequests []FeedbackTheme `json:"feature_requests"`
+}
+
+// buildFeedbackReport ranks the themes of jobs, newest first, created in
+// [from, to)
+func buildFeedbackReport(jobs []Job, tag string, from, to time.Time) FeedbackReport {
+	report := FeedbackReport{Tag: tag, From: from, To: to}
+	themes := map[string]map[string]*FeedbackTheme{
+		feedbackObjection: {},
+		feedbackQuestion:  {},
+		feedbackRequest:   {},
+	}
+	for _, job := range jobs {
+		if job.CreatedAt.Before(from) || !job.CreatedAt.Before(to) {
+			continue
+		}
+		report.Transcriptions++
+		counted := make(map[string]bool)
+		for _, item := range job.Feedback {
+			byTheme, ok := themes[item.Kind]
+			if !ok {
+				continue
+			}
+			t := byTheme[item.Theme]
+			if t == nil {
+				t = &FeedbackTheme{Theme: item.Theme, Examples: []FeedbackExample{}}
+				byTheme[item.Theme] = t
+			}
+			t.Mentions++
+			if key := item.Kind + "/" + item.Theme; !counted[key] {
+				counted[key] = true
+				t.Calls++
+				if len(t.Examples) < feedbackExamples {
+					t.Examples = append(t.Examples, FeedbackExample{Text: item.Text, TranscriptionID: job.ID, Title: jobTitle(job)})
+				}
+			}
+		}
+	}
+
+	ranked := func(byTheme map[string]*FeedbackTheme) []FeedbackTheme {
+		list := make([]FeedbackTheme, 0, len(byTheme))
+		for _, t := range byTheme {
+			t.Share = ratio(float64(t.Calls), float64(report.Transcriptions))
+			list = append(list, *t)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			a, b := list[i], list[j]
+			if a.Calls != b.Calls {
+				return a.Calls > b.Calls
+			}
+			if a.Mentions != b.Mentions {
+				return a.Mentions > b.Mentions
+			}
+			return a.Theme < b.Theme
+		})
+		return list[:min(len(list), maxFeedbackThemes)]
+	}
+	report.Objections = ranked(themes[feedbackObjection])
+	report.Questions = ranked(themes[feedbackQuestion])
+	report.FeatureRequests = ranked(themes[feedbackRequest])
+	return report
+}
+
+// feedbackReportRecord is a report as kept in the state store, with the
+// identity of the key it was created with and the last build
+type feedbackReportRecord struct {
+	Tag         string          `json:"tag"`
+	PeriodDays  int             `json:"period_days"`
+	Refresh     string          `json:"refresh"`
+	KeyID       string          `json:"key_id"`
+	Tenant      string          `json:"tenant,omitempty"`
+	Workspace   string          `json:"workspace,omitempty"`
+	Role        string          `json:"role"`
+	RefreshedAt time.Time       `json:"refreshed_at"`
+	Report      *FeedbackReport `json:"report,omitempty"`
+}
+
+func (f feedbackReportRecord) principal() principal {
+	return principal{ID: f.KeyID, Tenant: f.Tenant, Workspace: f.Workspace, Role: f.Role}
+}
+
+func (f feedbackReportRecord) key() string {
+	return feedbackReportKeyPrefix + f.KeyID + ":" + f.Tag
+}
+
+// nextRefresh is when the report is rebuilt next
+func (f feedbackReportRecord) nextRefresh() time.Time {
+	return f.RefreshedAt.Add(feedbackRefresh[f.Refresh])
+}
+
+// refresh rebuilds the report over the last PeriodDays up to now
+func (f *feedbackReportRecord) refresh(now time.Time) {
+	now = now.UTC()
+	from := now.AddDate(0, 0, -f.PeriodDays)
+	jobs := pipelineJobs.list(f.principal(), jobFilter{Status: jobCompleted, Tag: f.Tag}, maxReportJobs)
+	report := buildFeedbackReport(jobs, f.Tag, from, now)
+	f.Report = &report
+	f.RefreshedAt = now
+}
+
+// FeedbackReportInfo is a report as shown to clients
+type FeedbackReportInfo struct {
+	Tag           string          `json:"tag"`
+	PeriodDays    int             `json:"period_days"`
+	Refresh       string          `json:"refresh"`
+	RefreshedAt   time.Time       `json:"refreshed_at"`
+	NextRefreshAt time.Time       `json:"next_refresh_at"`
+	Report        *FeedbackReport `json:"report,omitempty"`
+}
+
+func (f feedbackReportRecord) info(withReport bool) FeedbackReportInfo {
+	info := FeedbackReportInfo{Tag: f.Tag, PeriodDays: f.PeriodDays, Refresh: f.Refresh, RefreshedAt: f.RefreshedAt, NextRefreshAt: f.nextRefresh()}
+	if withReport {
+		info.Report = f.Report
+	}
+	return info
+}
+
+func loadFeedbackReport(key string) (feedbackReportRecord, bool) {
+	data, ok, err := state.get(key)
+	if err != nil {
+		logErrorf(context.Background(), "Error reading feedback report: %v", err)
+	}
+	var f feedbackReportRecord
+	if !ok || json.Unmarshal(data, &f) != nil {
+		return feedbackReportRecord{}, false
+	}
+	return f, true
+}
+
+func saveFeedbackReport(f feedbackReportRecord) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return state.set(f.key(), data, 0)
+}
+
+// eraseUserFeedback removes the quotes of the user's calls from feedback
+// reports; the counts they contributed to stay until the next rebuild
+func eraseUserFeedback(user string, jobs []Job) (int, error) {
+	erased := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		erased[job.ID] = true
+	}
+	keys, err := state.keys(feedbackReportKeyPrefix)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, key := range keys {
+		f, ok := loadFeedbackReport(key)
+		if !ok || f.Report == nil {
+			continue
+		}
+		removed := 0
+		for _, themes := range [][]FeedbackTheme{f.Report.Objections, f.Report.Questions, f.Report.FeatureRequests} {
+			for i := range themes {
+				kept := themes[i].Examples[:0]
+				for _, example := range themes[i].Examples {
+					if erased[example.TranscriptionID] {
+						removed++
+					} else {
+						kept = append(kept, example)
+					}
+				}
+				themes[i].Examples = kept
+			}
+		}
+		if removed == 0 {
+			continue
+		}
+		if err := saveFeedbackReport(f); err != nil {
+			return deleted, err
+		}
+		deleted += removed
+	}
+	return deleted, nil
+}
+
+// handleFeedbackReportList lists the caller's reports, without their
+// contents
+func handleFeedbackReportList(w http.ResponseWriter, r *http.Request) {
+	keys, err := state.keys(feedbackReportKeyPrefix + principalFrom(r.Context()).ID + ":")
+	if err != nil {
+		logErrorf(r.Context(), "Error listing feedback reports: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error listing feedback reports")
+		return
+	}
+	items := []FeedbackReportInfo{}
+	for _, key := range keys {
+		if f, ok := loadFeedbackReport(key); ok {
+			items = append(items, f.info(false))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Tag < items[j].Tag })
+	writeJSON(w, http.StatusOK, items)
+}
+
+// handleFeedbackReportGet returns the last build of one of the caller's
+// reports
+func handleFeedbackReportGet(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	f, ok := loadFeedbackReport(feedbackReportKeyPrefix + p.ID + ":" + normalizeTag(r.PathValue("tag")))
+	if !ok {
+		integrationError(w, http.StatusNotFound, "Feedback report not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, f.info(true))
+}
+
+// handleFeedbackReportPut creates or changes the caller's report of the
+// calls with a tag and builds it right away
+func handleFeedbackReportPut(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	tag := normalizeTag(r.PathValue("tag"))
+	if tag == "" {
+		integrationError(w, http.StatusBadRequest, "Invalid tag")
+		return
+	}
+	var req struct {
+		PeriodDays int    `json:"period_days"`
+		Refresh    string `json:"refresh"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&req); err != nil {
+			integrationError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+	if req.PeriodDays == 0 {
+		req.PeriodDays = defaultFeedbackPeriodDays
+	}
+	if req.PeriodDays < 1 || req.PeriodDays > maxFeedbackPeriodDays {
+		integrationError(w, http.StatusBadRequest, fmt.Sprintf("period_days must be between 1 and %d", maxFeedbackPeriodDays))
+		return
+	}
+	if req.Refresh == "" {
+		req.Refresh = "daily"
+	}
+	if _, ok := feedbackRefresh[req.Refresh]; !ok {
+		integrationError(w, http.StatusBadRequest, "refresh must be daily or weekly")
+		return
+	}
+
+	f := feedbackReportRecord{Tag: tag, PeriodDays: req.PeriodDays, Refresh: req.Refresh, KeyID: p.ID, Tenant: p.Tenant, Workspace: p.Workspace, Role: p.Role}
+	f.refresh(time.Now())
+	if err := saveFeedbackReport(f); err != nil {
+		logErrorf(r.Context(), "Error saving feedback report %s of %s: %v", tag, p.ID, err)
+		integrationError(w, http.StatusInternalServerError, "Error saving feedback report")
+		return
+	}
+	logf(r.Context(), "Feedback report %s of %s set to %d days, refreshed %s", tag, p.ID, f.PeriodDays, f.Refresh)
+	writeJSON(w, http.StatusOK, f.info(true))
+}
+
+// handleFeedbackReportDelete stops one of the caller's reports
+func handleFeedbackReportDelete(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	key := feedbackReportKeyPrefix + p.ID + ":" + normalizeTag(r.PathValue("tag"))
+	if _, ok := loadFeedbackReport(key); ok {
+		if err := state.delete(key); err != nil {
+			logErrorf(r.Context(), "Error deleting feedback report: %v", err)
+			integrationError(w, http.StatusInternalServerError, "Error deleting feedback report")
+			return
+		}
+		logf(r.Context(), "Feedback report %s of %s deleted", r.PathValue("tag"), p.ID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runFeedbackReports rebuilds the reports that are due. Only the leader
+// rebuilds; reports of removed or disabled keys are left as they are.
+func runFeedbackReports() {
+	ticker := time.NewTicker(feedbackCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !isLeader() {
+			continue
+		}
+		keys, err := state.keys(feedbackReportKeyPrefix)
+		if err != nil {
+			logErrorf(context.Background(), "Error listing feedback reports: %v", err)
+			continue
+		}
+		now := time.Now().UTC()
+		for _, key := range keys {
+			f, ok := loadFeedbackReport(key)
+			if !ok || now.Before(f.nextRefresh()) || !keyActive(f.KeyID) {
+				continue
+			}
+			f.refresh(now)
+			if err := saveFeedbackReport(f); err != nil {
+				logErrorf(context.Background(), "Error saving feedback report %s of %s: %v", f.Tag, f.KeyID, err)
+				continue
+			}
+			logf(context.Background(), "Refreshed feedback report %s of %s: %d call(s)", f.Tag, f.KeyID, f.Report.Transcriptions)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Feeds let users follow completed transcriptions from any feed reader or
+// automation tool. Feed readers cannot send headers, so each feed has its
+// own token in its URL. A feed shows what the API key that created it can
+// see, and stops working when that key is removed or disabled.
+
+// feedKeyPrefix namespaces feeds in the state store, keyed by the hash of
+// their token
+const feedKeyPrefix = "feed:"
+
+// feedEntries is the number of transcriptions in a feed
+const feedEntries = 50
+
+// feedRecord is a feed as kept in the state store. The tenant, workspace
+// and role are those of the key that created it.
+type feedRecord struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title,omitempty"`
+	UserID    string    `json:"user_id,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Workspace string    `json:"workspace,omitempty"`
+	Role      string    `json:"role"`
+	TokenHash string    `json:"token_sha256"`
+}
+
+// feedInfo is a feed as shown to clients
+type feedInfo struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title,omitempty"`
+	UserID    string    `json:"user_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	AtomURL   string    `json:"atom_url,omitempty"`
+	RSSURL    string    `json:"rss_url,omitempty"`
+	ICalURL   string    `json:"ical_url,omitempty"`
+	KioskURL  string    `json:"kiosk_url,omitempty"`
+}
+
+func (f feedRecord) info() feedInfo {
+	return feedInfo{ID: f.ID, Title: f.Title, UserID: f.UserID, CreatedAt: f.CreatedAt}
+}
+
+func (f feedRecord) principal() principal {
+	return principal{ID: f.CreatedBy, Tenant: f.Tenant, Workspace: f.Workspace, Role: f.Role}
+}
+
+// keyActive reports whether the key a principal was resolved from still
+// authenticates
+func keyActive(id string) bool {
+	if res, ok := registry.get(kindAPIKeys, id); ok {
+		return !res.(*APIKey).Disabled
+	}
+	keys := config.IntegrationAPIKeys.List()
+	for _, route := range tenantRoutes() {
+		keys = append(keys, route.APIKeys...)
+	}
+	for _, key := range keys {
+		if keyFingerprint(key) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// loadFeed reads a feed by the hash of its token
+func loadFeed(hash string) (feedRecord, bool) {
+	data, ok, err := state.get(feedKeyPrefix + hash)
+	if err != nil {
+		logErrorf(context.Background(), "Error reading feed: %v", err)
+	}
+	var f feedRecord
+	if !ok || json.Unmarshal(data, &f) != nil {
+		return feedRecord{}, false
+	}
+	return f, true
+}
+
+// ownFeeds lists the feeds created by an API key
+func ownFeeds(p principal) ([]feedRecord, error) {
+	keys, err := state.keys(feedKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	feeds := []feedRecord{}
+	for _, key := range keys {
+		if f, ok := loadFeed(strings.TrimPrefix(key, feedKeyPrefix)); ok && f.CreatedBy == p.ID {
+			feeds = append(feeds, f)
+		}
+	}
+	return feeds, nil
+}
+
+// handleFeedCreate creates a feed of the transcriptions visible to the
+// caller, optionally only those of one user_id
+func handleFeedCreate(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	var req struct {
+		Title  string `json:"title"`
+		UserID string `json:"user_id"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&req); err != nil {
+			integrationError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+	if req.UserID != "" && !externalIDPattern.MatchString(req.UserID) {
+		integrationError(w, http.StatusBadRequest, "Invalid user_id")
+		return
+	}
+
+	token := randomToken("")
+	hash := hashAPIKey(token)
+	feed := feedRecord{
+		ID:        hash[:16],
+		Title:     strings.TrimSpace(req.Title),
+		UserID:    req.UserID,
+		CreatedBy: p.ID,
+		CreatedAt: time.Now().UTC(),
+		Tenant:    p.Tenant,
+		Workspace: p.Workspace,
+		Role:      p.Role,
+		TokenHash: hash,
+	}
+	data, err := json.Marshal(feed)
+	if err == nil {
+		err = state.set(feedKeyPrefix+hash, data, 0)
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Error saving feed: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error creating feed")
+		return
+	}
+	logf(r.Context(), "Feed %s created by %s", feed.ID, p.ID)
+	info := feed.info()
+	info.AtomURL, info.RSSURL, info.ICalURL = "/feeds/"+token, "/feeds/"+token+"/rss", "/feeds/"+token+"/ics"
+	info.KioskURL = "/feeds/" + token + "/kiosk"
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// handleFeedList lists the caller's feeds, without their tokens
+func handleFeedList(w http.ResponseWriter, r *http.Request) {
+	feeds, err := ownFeeds(principalFrom(r.Context()))
+	if err != nil {
+		logErrorf(r.Context(), "Error listing feeds: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error listing feeds")
+		return
+	}
+	items := make([]feedInfo, 0, len(feeds))
+	for _, f := range feeds {
+		items = append(items, f.info())
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// handleFeedDelete revokes one of the caller's feeds
+func handleFeedDelete(w http.ResponseWriter, r *http.Request) {
+	feeds, err := ownFeeds(principalFrom(r.Context()))
+	if err != nil {
+		logErrorf(r.Context(), "Error listing feeds: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error revoking feed")
+		return
+	}
+	for _, f := range feeds {
+		if f.ID == r.PathValue("id") {
+			if err := state.delete(feedKeyPrefix + f.TokenHash); err != nil {
+				logErrorf(r.Context(), "Error revoking feed %s: %v", f.ID, err)
+				integrationError(w, http.StatusInternalServerError, "Error revoking feed")
+				return
+			}
+			logf(r.Context(), "Feed %s revoked", f.ID)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// feedJobs returns the newest completed transcriptions of a feed
+func feedJobs(f feedRecord) []Job {
+	var jobs []Job
+	for _, job := range pipelineJobs.list(f.principal(), jobFilter{Status: jobCompleted}, maxJobListLimit) {
+		if f.UserID == "" || job.UserID == f.UserID {
+			jobs = append(jobs, job)
+		}
+		if len(jobs) == feedEntries {
+			break
+		}
+	}
+	return jobs
+}
+
+// feedEntryBody is the summary of a transcription, or the beginning of its
+// text when it was not summarized
+func feedEntryBody(job Job) string {
+	if job.Summary != "" {
+		return job.Summary
+	}
+	const excerpt = 1000
+	if text := []rune(job.Text); len(text) > excerpt {
+		return string(text[:excerpt]) + "…"
+	}
+	return job.Text
+}
+
+// atomFeed is an RFC 4287 feed
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID        string   `xml:"id"`
+	Title     string   `xml:"title"`
+	Updated   string   `xml:"updated"`
+	Published string   `xml:"published"`
+	Content   atomText `xml:"content"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// rssFeed is an RSS 2.0 channel
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	GUID        rssGUID `xml:"guid"`
+	Title       string  `xml:"title"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+// resolveFeed authenticates a feed request by the token in its path
+func resolveFeed(w http.ResponseWriter, r *http.Request) (feedRecord, bool) {
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	f, ok := loadFeed(hashAPIKey(r.PathValue("token")))
+	if !ok || !keyActive(f.CreatedBy) {
+		http.Error(w, "Feed not found", http.StatusNotFound)
+		return feedRecord{}, false
+	}
+	if f.Title == "" {
+		f.Title = "Completed transcriptions"
+	}
+	return f, true
+}
+
+// writeXML sends an XML document
+func writeXML(w http.ResponseWriter, contentType string, v any) {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		logErrorf(context.Background(), "Error encoding feed: %v", err)
+		http.Error(w, "Error encoding feed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// handleAtomFeed serves a feed as Atom
+func handleAtomFeed(w http.ResponseWriter, r *http.Request) {
+	f, ok := resolveFeed(w, r)
+	if !ok {
+		return
+	}
+	feed := atomFeed{
+		ID:      "urn:transcription-app:feed:" + f.ID,
+		Title:   f.Title,
+		Updated: f.CreatedAt.Format(time.RFC3339),
+		Author:  atomPerson{Name: "transcription-app"},
+	}
+	for _, job := range feedJobs(f) {
+		if len(feed.Entries) == 0 {
+			feed.Updated = job.UpdatedAt.Format(time.RFC3339)
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        "urn:transcription-app:job:" + job.ID,
+			Title:     jobTitle(job),
+			Updated:   job.UpdatedAt.Format(time.RFC3339),
+			Published: job.CreatedAt.Format(time.RFC3339),
+			Content:   atomText{Type: "text", Body: feedEntryBody(job)},
+		})
+	}
+	writeXML(w, "application/atom+xml; charset=utf-8", feed)
+}
+
+// handleRSSFeed serves a feed as RSS 2.0
+func handleRSSFeed(w http.ResponseWriter, r *http.Request) {
+	f, ok := resolveFeed(w, r)
+	if !ok {
+		return
+	}
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{
+		Title:       f.Title,
+		Link:        fmt.Sprintf("%s://%s/", requestScheme(r), r.Host),
+		Description: "Transcriptions completed by the transcription service",
+	}}
+	for _, job := range feedJobs(f) {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			GUID:        rssGUID{ID: "urn:transcription-app:job:" + job.ID},
+			Title:       jobTitle(job),
+			Description: feedEntryBody(job),
+			PubDate:     job.UpdatedAt.Format(time.RFC1123Z),
+		})
+	}
+	writeXML(w, "application/rss+xml; charset=utf-8", feed)
+}
+
+// requestScheme is the scheme the client used, behind a TLS-terminating
+// proxy as well
+func requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "https" || proto == "http" {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
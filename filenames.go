@@ -0,0 +1,118 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Uploaded file names come from the client and end up in job titles, logs
+// and the form sent to the Whisper backend, so they are cleaned as they
+// arrive: the directory part is dropped, text is composed to NFC, control
+// and invisible formatting characters (such as right-to-left overrides
+// that disguise an extension) are removed, and the name is capped at
+// maxUploadFilenameLength bytes. Stored files are always named after job
+// IDs or random names, never after the upload, so names cannot collide or
+// escape the storage directory; the cleaned name is kept as the job's
+// filename for display.
+
+// maxUploadFilenameLength bounds an uploaded file name in bytes, the limit
+// of most file systems
+const maxUploadFilenameLength = 255
+
+// maxExtensionLength is the longest extension kept when a name is cut
+const maxExtensionLength = 16
+
+// nfcCompositions lists, for each combining mark, pairs of a base letter
+// and the letter composed with the mark. They cover the Latin, Greek,
+// Cyrillic and kana letters that macOS and some browsers send decomposed;
+// the standard library has no Unicode normalization tables, and other
+// scripts are kept as sent.
+var nfcCompositions = map[rune]string{
+	0x0300: "AÀEÈIÌNǸOÒUÙWẀYỲaàeèiìnǹoòuùwẁyỳÂẦÊỀÔỒÜǛâầêềôồüǜĂẰăằĒḔēḕŌṐōṑƠỜơờƯỪưừЕЀИЍеѐиѝ",
+	0x0301: "AÁCĆEÉGǴIÍKḰLĹMḾNŃOÓPṔRŔSŚUÚWẂYÝZŹaácćeégǵiíkḱlĺmḿnńoópṕrŕsśuúwẃyýzźÂẤÅǺÆǼÇḈÊẾÏḮÔỐÕṌØǾÜǗâấåǻæǽçḉêếïḯôốõṍøǿüǘĂẮăắĒḖēḗŌṒōṓŨṸũṹƠỚơớƯỨưứΑΆΕΈΗΉΙΊΟΌΥΎΩΏαάεέηήιίοόυύωώϊΐϋΰϒϓГЃКЌгѓкќ",
+	0x0302: "AÂCĈEÊGĜHĤIÎJĴOÔSŜUÛWŴYŶZẐaâcĉeêgĝhĥiîjĵoôsŝuûwŵyŷzẑẠẬạậẸỆẹệỌỘọộ",
+	0x0303: "AÃEẼIĨNÑOÕUŨVṼYỸaãeẽiĩnñoõuũvṽyỹÂẪÊỄÔỖâẫêễôỗĂẴăẵƠỠơỡƯỮưữ",
+	0x0304: "AĀEĒGḠIĪOŌUŪYȲaāeēgḡiīoōuūyȳÄǞÆǢÕȬÖȪÜǕäǟæǣõȭöȫüǖǪǬǫǭȦǠȧǡȮȰȯȱИӢУӮиӣуӯḶḸḷḹṚṜṛṝ",
+	0x0306: "AĂEĔGĞIĬOŎUŬaăeĕgğiĭoŏuŭȨḜȩḝАӐЕӖЖӁИЙУЎаӑеӗжӂийуўẠẶạặ",
+	0x0307: "AȦBḂCĊDḊEĖFḞGĠHḢIİMṀNṄOȮPṖRṘSṠTṪWẆXẊYẎZŻaȧbḃcċdḋeėfḟgġhḣmṁnṅoȯpṗrṙsṡtṫwẇxẋyẏzżŚṤśṥŠṦšṧſẛṢṨṣṩ",
+	0x0308: "AÄEËHḦIÏOÖUÜWẄXẌYŸaäeëhḧiïoötẗuüwẅxẍyÿÕṎõṏŪṺūṻΙΪΥΫιϊυϋϒϔІЇАӒЕЁЖӜЗӞИӤОӦУӰЧӴЫӸЭӬаӓеёжӝзӟиӥоӧуӱчӵыӹэӭіїӘӚәӛӨӪөӫ",
+	0x0309: "AẢEẺIỈOỎUỦYỶaảeẻiỉoỏuủyỷÂẨÊỂÔỔâẩêểôổĂẲăẳƠỞơởƯỬưử",
+	0x030A: "AÅUŮaåuůwẘyẙ",
+	0x030B: "OŐUŰoőuűУӲуӳ",
+	0x030C: "AǍCČDĎEĚGǦHȞIǏKǨLĽNŇOǑRŘSŠTŤUǓZŽaǎcčdďeěgǧhȟiǐjǰkǩlľnňoǒrřsštťuǔzžÜǙüǚƷǮ",
+	0x030F: "AȀEȄIȈOȌRȐUȔaȁeȅiȉoȍrȑuȕѴѶѵѷ",
+	0x0311: "AȂEȆIȊOȎRȒUȖaȃeȇiȋoȏrȓuȗ",
+	0x031B: "OƠUƯoơuư",
+	0x0323: "AẠBḄDḌEẸHḤIỊKḲLḶMṂNṆOỌRṚSṢTṬUỤVṾWẈYỴZẒaạbḅdḍeẹhḥiịkḳlḷmṃnṇoọrṛsṣtṭuụvṿwẉyỵzẓƠỢơợƯỰưự",
+	0x0324: "UṲuṳ",
+	0x0325: "AḀaḁ",
+	0x0326: "SȘTȚsștț",
+	0x0327: "CÇDḐEȨGĢHḨKĶLĻNŅRŖSŞTŢcçdḑeȩgģhḩkķlļnņrŗsştţ",
+	0x0328: "AĄEĘIĮOǪUŲaąeęiįoǫuų",
+	0x032D: "DḒEḘLḼNṊTṰUṶdḓeḙlḽnṋtṱuṷ",
+	0x032E: "HḪhḫ",
+	0x0330: "EḚIḬUṴeḛiḭuṵ",
+	0x0331: "BḆDḎKḴLḺNṈRṞTṮZẔbḇdḏhẖkḵlḻnṉrṟtṯzẕ",
+	0x3099: "うゔかがきぎくぐけげこごさざしじすずせぜそぞただちぢつづてでとどはばひびふぶへべほぼゝゞウヴカガキギクグケゲコゴサザシジスズセゼソゾタダチヂツヅテデトドハバヒビフブヘベホボワヷヰヸヱヹヲヺヽヾ",
+	0x309A: "はぱひぴふぷへぺほぽハパヒピフプヘペホポ",
+}
+
+// nfcPairs maps a base letter and a combining mark to their composition
+var nfcPairs = func() map[[2]rune]rune {
+	pairs := make(map[[2]rune]rune)
+	for mark, letters := range nfcCompositions {
+		runes := []rune(letters)
+		for i := 0; i+1 < len(runes); i += 2 {
+			pairs[[2]rune{runes[i], mark}] = runes[i+1]
+		}
+	}
+	return pairs
+}()
+
+// composeNFC composes letters followed by combining marks into their
+// precomposed forms, as NFC does for the letters in nfcCompositions
+func composeNFC(s string) string {
+	out := make([]rune, 0, len(s))
+	for _, r := range s {
+		if n := len(out); n > 0 {
+			if composed, ok := nfcPairs[[2]rune{out[n-1], r}]; ok {
+				out[n-1] = composed
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// cleanFilename returns the name to use for an uploaded file, or "" when
+// nothing is left of it
+func cleanFilename(name string) string {
+	// Some clients send the full path, with either separator
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	name = composeNFC(strings.ToValidUTF8(name, ""))
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r):
+			return ' '
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.Join(strings.Fields(name), " ")
+	if len(name) <= maxUploadFilenameLength {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > maxExtensionLength {
+		ext = ""
+	}
+	base := name[:maxUploadFilenameLength-len(ext)]
+	for !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+	return strings.TrimSpace(base) + ext
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The file store is the default: the in-memory store, written to a JSON
+// file so a single instance keeps its jobs and transcript history across
+// restarts without Redis. Changes are written within a second, and when
+// the server stops; entries that expired are left out. Every write rewrites
+// the whole file, which suits a single instance but not a large archive.
+
+// fileStoreFlushInterval is how often changes are written to the file
+const fileStoreFlushInterval = time.Second
+
+// fileStore is a memoryStore kept in a file
+type fileStore struct {
+	*memoryStore
+	path  string
+	dirty atomic.Bool
+	// writing serializes writes of the file
+	writing sync.Mutex
+}
+
+// fileStoreEntry is a memoryEntry as written to the file
+type fileStoreEntry struct {
+	Value   []byte    `json:"value,omitempty"`
+	Counter int64     `json:"counter,omitempty"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// newFileStore loads the store kept at path, if any, and writes its changes
+// back in the background
+func newFileStore(path string) (*fileStore, error) {
+	f := &fileStore{memoryStore: newMemoryStore(), path: path}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var entries map[string]fileStoreEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for key, e := range entries {
+			entry := memoryEntry{value: e.Value, counter: e.Counter, expires: e.Expires}
+			if !entry.expired(now) {
+				f.entries[key] = entry
+			}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(fileStoreFlushInterval) {
+			if f.dirty.Load() {
+				f.flush()
+			}
+		}
+	}()
+	return f, nil
+}
+
+func (f *fileStore) set(key string, value []byte, ttl time.Duration) error {
+	defer f.dirty.Store(true)
+	return f.memoryStore.set(key, value, ttl)
+}
+
+func (f *fileStore) delete(key string) error {
+	defer f.dirty.Store(true)
+	return f.memoryStore.delete(key)
+}
+
+func (f *fileStore) incrBy(key string, n int64, ttl time.Duration) (int64, error) {
+	defer f.dirty.Store(true)
+	return f.memoryStore.incrBy(key, n, ttl)
+}
+
+// flush writes the entries that have not expired to the file
+func (f *fileStore) flush() {
+	f.writing.Lock()
+	defer f.writing.Unlock()
+	f.dirty.Store(false)
+
+	f.mu.Lock()
+	now := time.Now()
+	entries := make(map[string]fileStoreEntry, len(f.entries))
+	for key, entry := range f.entries {
+		if !entry.expired(now) {
+			entries[key] = fileStoreEntry{Value: entry.value, Counter: entry.counter, Expires: entry.expires}
+		}
+	}
+	f.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err == nil {
+		tmp := f.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, f.path)
+		}
+	}
+	if err != nil {
+		f.dirty.Store(true)
+		logErrorf(context.Background(), "Error writing the state file: %v", err)
+	}
+}
+
+// flushState writes the changes of the file store before the server exits
+func flushState() {
+	if f, ok := state.(*fileStore); ok {
+		f.flush()
+	}
+}
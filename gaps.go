@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A long recording whose chunk failed twice is still transcribed, with a
+// gap in place of the chunk (see chunking.go). The job keeps its audio so
+// its gaps can be transcribed again once the backend recovers, without
+// sending the whole recording again: GET .../gaps lists them and
+// POST .../gaps/retry transcribes their audio in the background, putting
+// the text in place of each gap's marker. Pipeline steps that ran on the
+// text with gaps are not run again.
+
+// gapRetryPrefix namespaces the claims of jobs whose gaps are being
+// transcribed again, so replicas do not retry the same gaps at once
+const gapRetryPrefix = "gap-retry:"
+
+// gapRetryTimeout bounds transcribing the gaps of a job again
+const gapRetryTimeout = time.Hour
+
+// gapReport is the answer of the gap endpoints
+type gapReport struct {
+	Gaps []TranscriptGap `json:"gaps"`
+	// Retrying is set while the gaps are transcribed again
+	Retrying bool `json:"retrying"`
+}
+
+// keepAudioForGaps keeps the audio at path of a job transcribed with gaps,
+// which would otherwise be removed once the job is done. Audio of users
+// under legal hold is kept under the hold instead.
+func keepAudioForGaps(ctx context.Context, job Job, path string) {
+	if underLegalHold(job.UserID) {
+		return
+	}
+	kept, err := keptAudioPath(job)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(kept), 0o750)
+	}
+	if err == nil {
+		err = os.Rename(path, kept)
+	}
+	if err != nil {
+		logErrorf(ctx, "Job %s: error keeping audio to transcribe its gaps again: %v", job.ID, err)
+	}
+}
+
+// gapsRetrying reports whether the gaps of a job are being transcribed
+// again
+func gapsRetrying(id string) bool {
+	_, ok, err := state.get(gapRetryPrefix + id)
+	return err == nil && ok
+}
+
+// handleGapList lists the gaps of a transcription
+func handleGapList(w http.ResponseWriter, r *http.Request) {
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !principalFrom(r.Context()).sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	gaps := job.Gaps
+	if gaps == nil {
+		gaps = []TranscriptGap{}
+	}
+	writeJSON(w, http.StatusOK, gapReport{Gaps: gaps, Retrying: gapsRetrying(job.ID)})
+}
+
+// handleGapRetry starts transcribing the gaps of a transcription again.
+// Its creator or an admin may retry them.
+func handleGapRetry(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !p.sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	if !p.owns(job) {
+		integrationError(w, http.StatusForbidden, "Only the creator of a transcription or an admin can retry its gaps")
+		return
+	}
+	if job.Status != jobCompleted || len(job.Gaps) == 0 {
+		integrationError(w, http.StatusConflict, "Transcription has no gaps to retry")
+		return
+	}
+	if refuseWhileShuttingDown(w, true) {
+		return
+	}
+	claims, err := state.incrBy(gapRetryPrefix+job.ID, 1, gapRetryTimeout)
+	if err != nil {
+		logErrorf(r.Context(), "Job %s: error claiming its gaps: %v", job.ID, err)
+		integrationError(w, http.StatusServiceUnavailable, "State store unavailable")
+		return
+	}
+	if claims != 1 {
+		integrationError(w, http.StatusConflict, "The gaps of this transcription are already being retried")
+		return
+	}
+
+	ctx := withRequestIDContext(context.Background(), requestIDFrom(r.Context()))
+	go func() {
+		defer state.delete(gapRetryPrefix + job.ID)
+		ctx, cancel := context.WithTimeout(ctx, gapRetryTimeout)
+		defer cancel()
+		retryGaps(ctx, job)
+	}()
+	logf(r.Context(), "Job %s: retrying %d gaps for %s", job.ID, len(job.Gaps), p.ID)
+	writeJSON(w, http.StatusAccepted, gapReport{Gaps: job.Gaps, Retrying: true})
+}
+
+// retryGaps transcribes the audio of each gap of job again, and puts the
+// text of those that succeed in place of their markers
+func retryGaps(ctx context.Context, job Job) {
+	up, err := upstreamFor(job.Tenant, job.Region)
+	if err != nil {
+		logErrorf(ctx, "Job %s: error retrying gaps: %v", job.ID, err)
+		return
+	}
+	path, err := jobAudio(ctx, job)
+	if err != nil {
+		logErrorf(ctx, "Job %s: error retrying gaps: no audio: %v", job.ID, err)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		logErrorf(ctx, "Job %s: error retrying gaps: %v", job.ID, err)
+		return
+	}
+	defer file.Close()
+	audio, err := readWAV(file)
+	if err != nil {
+		logErrorf(ctx, "Job %s: error retrying gaps: %v", job.ID, err)
+		return
+	}
+
+	filled := 0
+	for i, gap := range job.Gaps {
+		start := min(audio.bytesFor(secondsDuration(gap.Start)), audio.dataSize)
+		end := min(audio.bytesFor(secondsDuration(gap.End)), audio.dataSize)
+		if end <= start {
+			continue
+		}
+		result, err := transcribeAudio(ctx, up, audio.chunk(start, end), chunkName(jobTitle(job)+".wav", i), job.Language)
+		if err != nil {
+			logErrorf(ctx, "Job %s: gap at %s failed again: %v", job.ID, formatTimestamp(gap.Start), err)
+			continue
+		}
+		recordWorkspaceAudio(job.Workspace, gap.End-gap.Start)
+		found := false
+		pipelineJobs.update(job.ID, func(j *Job) {
+			found = fillGap(j, gap, result)
+		})
+		if found {
+			filled++
+		}
+	}
+	logf(ctx, "Job %s: %d of %d gaps transcribed again", job.ID, filled, len(job.Gaps))
+}
+
+// secondsDuration converts seconds to a duration
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// fillGap puts the transcript of the audio of gap in place of its marker in
+// job, and reports whether the gap was still there
+func fillGap(job *Job, gap TranscriptGap, result *TranscriptionResult) bool {
+	index := -1
+	for i, g := range job.Gaps {
+		if g == gap {
+			index = i
+		}
+	}
+	if index < 0 {
+		return false
+	}
+	// copies of the job share its gaps, so they are not removed in place
+	job.Gaps = slices.Concat(job.Gaps[:index], job.Gaps[index+1:])
+
+	marker := gap.marker()
+	text := strings.TrimSpace(result.Text)
+	switch {
+	case text != "":
+		job.Text = strings.Replace(job.Text, marker, text, 1)
+	case strings.Contains(job.Text, marker+" "):
+		job.Text = strings.Replace(job.Text, marker+" ", "", 1)
+	default:
+		job.Text = strings.TrimSpace(strings.Replace(job.Text, marker, "", 1))
+	}
+
+	var segments []Segment
+	for _, segment := range job.Segments {
+		if segment.Text != marker || segment.Start != gap.Start {
+			segments = append(segments, segment)
+			continue
+		}
+		for _, filled := range result.Segments {
+			filled.Start = roundMillis(min(filled.Start+gap.Start, gap.End))
+			filled.End = roundMillis(min(filled.End+gap.Start, gap.End))
+			segments = append(segments, filled)
+		}
+	}
+	for i := range segments {
+		segments[i].ID = i
+	}
+	job.Segments = segments
+	job.UpdatedAt = time.Now().UTC()
+	return true
+}
+
+// gapSummary describes the ranges of gaps for logs
+func gapSummary(gaps []TranscriptGap) string {
+	parts := make([]string, len(gaps))
+	for i, g := range gaps {
+		parts[i] = fmt.Sprintf("%s-%s", formatTimestamp(g.Start), formatTimestamp(g.End))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestFillGap(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+	config = &Config{}
+	chunk := func(text string) *TranscriptionResult {
+		return &TranscriptionResult{Text: text, Segments: []Segment{{Start: 1, End: 2, Text: " " + text}}}
+	}
+	times := []timeSpan{{0, 10}, {10, 20}, {20, 30}}
+	stitched := stitchTranscripts([]*TranscriptionResult{chunk("one."), nil, chunk("three.")}, times, nil, 30)
+	if len(stitched.Gaps) != 1 || stitched.Gaps[0] != (TranscriptGap{Start: 10, End: 20}) {
+		t.Fatalf("got gaps %v, want the second chunk", stitched.Gaps)
+	}
+	marker := stitched.Gaps[0].marker()
+	if want := "one. " + marker + " three."; stitched.Text != want {
+		t.Fatalf("got text %q, want %q", stitched.Text, want)
+	}
+
+	job := Job{Text: stitched.Text, Segments: stitched.Segments, Gaps: stitched.Gaps}
+	if !fillGap(&job, stitched.Gaps[0], chunk("two.")) {
+		t.Fatal("gap not found")
+	}
+	if job.Text != "one. two. three." || len(job.Gaps) != 0 {
+		t.Errorf("got text %q and gaps %v, want the gap filled", job.Text, job.Gaps)
+	}
+	if len(job.Segments) != 3 || job.Segments[1].ID != 1 || job.Segments[1].Start != 11 || job.Segments[1].Text != " two." {
+		t.Errorf("got segments %+v, want the gap's segment at 11s", job.Segments)
+	}
+	if len(stitched.Gaps) != 1 {
+		t.Error("filling a gap changed the gaps of another copy of the job")
+	}
+	if fillGap(&job, stitched.Gaps[0], chunk("two.")) {
+		t.Error("filled a gap twice")
+	}
+}
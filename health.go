@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// /healthz only tells whether the process is alive and serving HTTP, for a
+// liveness probe that restarts it otherwise. /readyz tells whether the
+// replica should get traffic: besides its disk, warm-up and shutdown, it
+// checks that the default audio and LLM backends can be reached, asking
+// each for /v1/models within READINESS_TIMEOUT. The outcome is cached for
+// READINESS_CACHE_TTL so frequent probes from several sources do not reach
+// the backends every time.
+
+// healthClient probes the backends; each probe sets its own timeout
+var healthClient *http.Client
+
+// backendReadiness is the cached reachability of the backends
+var backendReadiness struct {
+	sync.Mutex
+	checked time.Time
+	checks  map[string]CheckResult
+}
+
+// ReadinessStatus is the body returned by /readyz
+type ReadinessStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// CheckResult is the outcome of a single readiness check
+type CheckResult struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Data   any    `json:"data,omitempty"`
+}
+
+// probeBackend asks the backend at baseURL for its models. Any answer means
+// it can be reached, even from a server without the endpoint, but that of a
+// gateway whose server is gone.
+func probeBackend(ctx context.Context, baseURL string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/v1/models", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := healthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Errorf("answered status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// backendChecks returns the readiness checks of the default audio and LLM
+// backends, probing them at most once per READINESS_CACHE_TTL. One
+// reachable Whisper backend of several is enough.
+func backendChecks() map[string]CheckResult {
+	backendReadiness.Lock()
+	defer backendReadiness.Unlock()
+	if backendReadiness.checks != nil && time.Since(backendReadiness.checked) < config.ReadinessCacheTTL {
+		return backendReadiness.checks
+	}
+
+	up := defaultUpstream()
+	urls := append(splitBackendURLs(up.AudioURL), up.LLMURL)
+	errs := make([]error, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = probeBackend(context.Background(), u, config.ReadinessTimeout)
+		}()
+	}
+	wg.Wait()
+
+	audio := CheckResult{}
+	for i, err := range errs[:len(errs)-1] {
+		if err == nil {
+			audio = CheckResult{OK: true}
+			break
+		}
+		audio.Detail = fmt.Sprintf("%s cannot be reached: %v", urls[i], err)
+	}
+	llm := CheckResult{OK: true}
+	if err := errs[len(errs)-1]; err != nil {
+		llm = CheckResult{Detail: fmt.Sprintf("%s cannot be reached: %v", up.LLMURL, err)}
+	}
+	backendReadiness.checks = map[string]CheckResult{"audio_backend": audio, "llm_backend": llm}
+	backendReadiness.checked = time.Now()
+	return backendReadiness.checks
+}
+
+// handleHealthz reports that the process is alive
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the server can accept new work
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := ReadinessStatus{Status: "ready", Checks: make(map[string]CheckResult)}
+
+	usage, pressure, err := storageWatchdog.status()
+	switch {
+	case err != nil:
+		status.Checks["disk"] = CheckResult{OK: false, Detail: err.Error()}
+	case pressure:
+		status.Checks["disk"] = CheckResult{OK: false, Detail: "storage usage above threshold", Data: usage}
+	default:
+		status.Checks["disk"] = CheckResult{OK: true, Data: usage}
+	}
+
+	if check, ok := warmupCheck(); ok {
+		status.Checks["warmup"] = check
+	}
+
+	if check, ok := audioBackendsCheck(); ok {
+		status.Checks["audio_backends"] = check
+	}
+
+	if config.ReadinessCheckBackends {
+		for name, check := range backendChecks() {
+			status.Checks[name] = check
+		}
+	}
+
+	if shuttingDown.Load() {
+		status.Checks["shutdown"] = CheckResult{OK: false, Detail: "shutting down"}
+	}
+
+	code := http.StatusOK
+	for _, check := range status.Checks {
+		if !check.OK {
+			status.Status = "not ready"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, status)
+}
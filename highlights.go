@@ -0,0 +1,399 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Highlights mark time ranges of a completed transcription, such as the
+// key moments of a user research interview. Each highlight's audio is cut
+// into a clip with ffmpeg when it is created, and all of them can be
+// exported together with their text and the summary as a ZIP.
+
+// Highlight is a marked time range of a transcription
+type Highlight struct {
+	ID        string    `json:"id"`
+	Start     float64   `json:"start"`
+	End       float64   `json:"end"`
+	Label     string    `json:"label,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// maxHighlights bounds the highlights of one transcription
+const maxHighlights = 100
+
+// clipTimeout bounds fetching the audio, when not yet kept, and cutting
+// one clip
+const clipTimeout = 2 * time.Minute
+
+// clipsDir holds the clips of a job
+func clipsDir(job Job) (string, error) {
+	dir, err := regionStorageDir(job.Region)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "clips", job.ID), nil
+}
+
+func clipPath(job Job, highlightID string) (string, error) {
+	dir, err := clipsDir(job)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, highlightID+".wav"), nil
+}
+
+// removeClip deletes the clip of a highlight
+func removeClip(job Job, highlightID string) {
+	if path, err := clipPath(job, highlightID); err == nil {
+		os.Remove(path)
+	}
+}
+
+// removeClips deletes the clips of a job
+func removeClips(job Job) error {
+	dir, err := clipsDir(job)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// segmentText returns the transcript text spoken between start and end, or
+// "" when the backend returned no segments
+func segmentText(segments []Segment, start, end float64) string {
+	var parts []string
+	for _, s := range segments {
+		if s.End > start && s.Start < end {
+			parts = append(parts, strings.TrimSpace(s.Text))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// formatTimestamp formats seconds as [h:]mm:ss
+func formatTimestamp(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second)).Round(time.Second)
+	h, m, s := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%02d:%02d", m, s)
+}
+
+// keptAudioPath is where the audio of a job is kept, once fetched, to cut
+// its clips, and where a job with gaps keeps its audio to transcribe them
+// again
+func keptAudioPath(job Job) (string, error) {
+	dir, err := clipsDir(job)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "source.wav"), nil
+}
+
+// jobAudio returns the local audio of a job, to cut its clips from or
+// transcribe its gaps again. Audio kept under legal hold or recorded by a
+// live session is used when present. Otherwise the job's audio is fetched
+// from its URL the first time and kept with the clips, so later highlights
+// are cut from the same copy; it is deleted with them.
+func jobAudio(ctx context.Context, job Job) (string, error) {
+	if held, err := heldAudioPath(job); err == nil {
+		if _, err := os.Stat(held); err == nil {
+			return held, nil
+		}
+	}
+	if recording, err := recordingPath(job); err == nil && job.Recorded {
+		if _, err := os.Stat(recording); err == nil {
+			return recording, nil
+		}
+	}
+	src, err := keptAudioPath(job)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(src); err == nil {
+		return src, nil
+	}
+	storageDir, err := regionStorageDir(job.Region)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	path, _, err := downloadAudio(ctx, job.ID+"-clips-"+hex.EncodeToString(b), job.AudioURL, storageDir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(src), 0o750); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	// Highlights added at the same time may each fetch the audio; the
+	// copies are identical and the last one renamed into place is kept
+	if err := os.Rename(path, src); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return src, nil
+}
+
+// cutClip extracts a highlight's audio from the job's audio
+func cutClip(ctx context.Context, job Job, h Highlight) error {
+	src, err := jobAudio(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	dst, err := clipPath(job, h.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, config.FFmpegPath,
+		"-nostdin", "-v", "error", "-y",
+		"-ss", strconv.FormatFloat(h.Start, 'f', 3, 64),
+		"-t", strconv.FormatFloat(h.End-h.Start, 'f', 3, 64),
+		"-i", src,
+		"-c:a", "pcm_s16le", dst)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("ffmpeg: %v: %s", err, describeBody(string(out)))
+	}
+	return nil
+}
+
+// handleHighlightCreate marks a time range of a completed transcription
+// and cuts its clip
+func handleHighlightCreate(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !p.sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	if job.Status != jobCompleted {
+		integrationError(w, http.StatusConflict, "Transcription is not completed")
+		return
+	}
+	if len(job.Highlights) >= maxHighlights {
+		integrationError(w, http.StatusConflict, fmt.Sprintf("A transcription can have at most %d highlights", maxHighlights))
+		return
+	}
+	var h Highlight
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&h); err != nil {
+		integrationError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if h.Start < 0 || h.End <= h.Start || (job.Duration > 0 && h.Start >= job.Duration) {
+		integrationError(w, http.StatusBadRequest, "start and end must be a time range within the audio, in seconds")
+		return
+	}
+	if job.Duration > 0 {
+		h.End = min(h.End, job.Duration)
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	h.ID = hex.EncodeToString(b)
+	h.Text = segmentText(job.Segments, h.Start, h.End)
+	h.CreatedBy = p.ID
+	h.CreatedAt = time.Now().UTC()
+
+	ctx, cancel := context.WithTimeout(r.Context(), clipTimeout)
+	defer cancel()
+	if err := cutClip(ctx, job, h); err != nil {
+		logErrorf(ctx, "Job %s: error cutting clip: %v", job.ID, err)
+		switch {
+		case errors.Is(err, exec.ErrNotFound):
+			integrationError(w, http.StatusNotImplemented, "Clip extraction requires ffmpeg on the server")
+			return
+		case errors.Is(err, errRegionUnavailable):
+			integrationError(w, http.StatusServiceUnavailable, regionUnavailableMessage)
+			return
+		}
+		integrationError(w, http.StatusBadGateway, "Error extracting the audio clip")
+		return
+	}
+
+	found := false
+	pipelineJobs.update(job.ID, func(j *Job) {
+		j.Highlights = append(j.Highlights, h)
+		found = true
+	})
+	if !found {
+		// The job expired or was deleted meanwhile
+		removeClip(job, h.ID)
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	logf(ctx, "Job %s: highlight %s added (%s-%s)", job.ID, h.ID, formatTimestamp(h.Start), formatTimestamp(h.End))
+	writeJSON(w, http.StatusCreated, h)
+}
+
+// handleHighlightList returns the highlights of a transcription in the
+// order they were created
+func handleHighlightList(w http.ResponseWriter, r *http.Request) {
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !principalFrom(r.Context()).sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	highlights := job.Highlights
+	if highlights == nil {
+		highlights = []Highlight{}
+	}
+	writeJSON(w, http.StatusOK, highlights)
+}
+
+// handleHighlightDelete removes a highlight and its clip. Its creator, the
+// transcription's owner or an admin may delete it.
+func handleHighlightDelete(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !p.sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	id := r.PathValue("highlight")
+	for _, h := range job.Highlights {
+		if h.ID != id {
+			continue
+		}
+		if h.CreatedBy != p.ID && !p.owns(job) {
+			integrationError(w, http.StatusForbidden, "Only the creator of a highlight or an admin can delete it")
+			return
+		}
+		pipelineJobs.update(job.ID, func(j *Job) {
+			kept := j.Highlights[:0]
+			for _, h := range j.Highlights {
+				if h.ID != id {
+					kept = append(kept, h)
+				}
+			}
+			j.Highlights = kept
+		})
+		removeClip(job, id)
+		logf(r.Context(), "Job %s: highlight %s deleted", job.ID, id)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleHighlightExport streams a ZIP with the clips and a Markdown
+// document of the highlights, their text and the summary
+func handleHighlightExport(w http.ResponseWriter, r *http.Request) {
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !principalFrom(r.Context()).sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	if len(job.Highlights) == 0 {
+		integrationError(w, http.StatusNotFound, "Transcription has no highlights")
+		return
+	}
+	writeHighlightExport(w, job)
+}
+
+// writeHighlightExport writes the highlight export of a job with
+// highlights
+func writeHighlightExport(w http.ResponseWriter, job Job) {
+	var doc strings.Builder
+	fmt.Fprintf(&doc, "# Highlights of %s\n\n", jobTitle(job))
+	if job.AudioURL != "" {
+		fmt.Fprintf(&doc, "Source: %s\n\n", job.AudioURL)
+	}
+	var clips []string
+	for i, h := range job.Highlights {
+		title := h.Label
+		if title == "" {
+			title = fmt.Sprintf("Highlight %d", i+1)
+		}
+		fmt.Fprintf(&doc, "## %d. %s (%s–%s)\n\n", i+1, title, formatTimestamp(h.Start), formatTimestamp(h.End))
+		if h.Text != "" {
+			fmt.Fprintf(&doc, "> %s\n\n", h.Text)
+		}
+		if h.Note != "" {
+			fmt.Fprintf(&doc, "%s\n\n", h.Note)
+		}
+		name := fmt.Sprintf("clips/%02d-%s.wav", i+1, h.ID)
+		path, err := clipPath(job, h.ID)
+		if err == nil {
+			_, err = os.Stat(path)
+		}
+		if err == nil {
+			fmt.Fprintf(&doc, "Clip: [%s](%s)\n\n", name, name)
+			clips = append(clips, path)
+		} else {
+			doc.WriteString("Clip: no longer available\n\n")
+			clips = append(clips, "")
+		}
+	}
+	if job.Summary != "" {
+		fmt.Fprintf(&doc, "## Summary\n\n%s\n", job.Summary)
+	}
+	if footer := disclosureFooter(job.Consent); footer != "" {
+		fmt.Fprintf(&doc, "\n---\n\n%s\n", strings.ReplaceAll(footer, "\n", "  \n"))
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	setAttachment(w, job.ID+"-highlights", ".zip")
+	archive := zip.NewWriter(w)
+
+	// Errors past this point can only abort the response
+	fail := func(err error) {
+		logErrorf(context.Background(), "Error exporting highlights of job %s: %v", job.ID, err)
+		panic(http.ErrAbortHandler)
+	}
+	f, err := archive.Create("highlights.md")
+	if err == nil {
+		_, err = f.Write([]byte(doc.String()))
+	}
+	if err != nil {
+		fail(err)
+	}
+	for i, path := range clips {
+		if path == "" {
+			continue
+		}
+		clip, err := os.Open(path)
+		if err != nil {
+			fail(err)
+		}
+		f, err := archive.Create(fmt.Sprintf("clips/%02d-%s.wav", i+1, job.Highlights[i].ID))
+		if err == nil {
+			_, err = io.Copy(f, clip)
+		}
+		clip.Close()
+		if err != nil {
+			fail(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		fail(err)
+	}
+}
+
+// initHighlights reports whether clips can be cut
+func initHighlights() {
+	if _, err := exec.LookPath(config.FFmpegPath); err != nil {
+		logWarnf(context.Background(), "Warning: %s not found, highlight clips and conversion of audio other than WAV are disabled", config.FFmpegPath)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The web UI keeps a history of past work, so a transcript is not lost when
+// the page is reloaded. Every transcription made through /transcribe,
+// /memo and live sessions is saved as a completed job under its X-Job-ID,
+// next to the jobs of /jobs/transcribe, and a summary is saved with it when
+// /summarize is given its transcript_id. /api/transcripts lists, shows and
+// deletes the transcripts the caller made, with the API key presented or
+// in the same browser session, and serves the audio recorded by live
+// sessions. Like all jobs they are kept in the state store for
+// ARTIFACT_RETENTION, which survives restarts with the Redis store. TRANSCRIPT_HISTORY=false stops saving transcriptions that
+// are not jobs.
+
+// TranscriptEntry is a transcript as listed in the history
+type TranscriptEntry struct {
+	ID         string    `json:"id"`
+	Status     string    `json:"status"`
+	Title      string    `json:"title,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	Language   string    `json:"language,omitempty"`
+	Duration   float64   `json:"duration,omitempty"`
+	HasSummary bool      `json:"has_summary"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// inHistory reports whether job is in the caller's history: the web UI
+// without an API key shares the default tenant, so the history holds what
+// the caller made rather than everything they can see
+func inHistory(caller principal, job Job) bool {
+	return caller.ID != "" && caller.sees(job) && job.CreatedBy == caller.ID
+}
+
+// historyPrincipal authenticates the history endpoints like
+// browserPrincipal, but refuses browsers without a session, which have no
+// history yet
+func historyPrincipal(w http.ResponseWriter, r *http.Request) (principal, bool) {
+	if requestAPIKey(r) == "" && browserSession(r) == "" {
+		http.Error(w, "No browser session: open the web UI first", http.StatusForbidden)
+		return principal{}, false
+	}
+	return browserPrincipal(w, r)
+}
+
+// saveTranscript records a transcription made by caller as a completed
+// job with the given ID. Transcriptions without text are not kept.
+func saveTranscript(caller principal, id, filename string, result *TranscriptionResult, summary string) {
+	if !config.TranscriptHistory || strings.TrimSpace(result.Text) == "" {
+		return
+	}
+	pipelineJobs.add(transcriptJob(caller, id, filename, result, summary))
+}
+
+// transcriptJob returns the completed job recording a transcription made
+// by caller
+func transcriptJob(caller principal, id, filename string, result *TranscriptionResult, summary string) *Job {
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        id,
+		Status:    jobCompleted,
+		Pipeline:  pipelineTranscribe,
+		Title:     fallbackTitle(filename, now),
+		Tenant:    caller.Tenant,
+		Region:    tenantRegion(caller.Tenant),
+		Workspace: caller.Workspace,
+		Filename:  filename,
+		Language:  result.Language,
+		Text:      result.Text,
+		Duration:  result.Duration,
+		Segments:  result.Segments,
+		Summary:   summary,
+		CreatedBy: caller.ID,
+		History:   true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	job.AudioQuality = result.AudioQuality
+	return job
+}
+
+// saveSummary stores the summary of a transcript in the caller's history.
+// Unknown transcripts are ignored, as the summary was still answered.
+func saveSummary(caller principal, id, summary string) {
+	job, ok := pipelineJobs.get(id)
+	if !ok || !inHistory(caller, job) || job.Status != jobCompleted {
+		logWarnf(context.Background(), "Summary not saved: transcript %s not found", id)
+		return
+	}
+	pipelineJobs.update(id, func(job *Job) {
+		job.Summary = summary
+	})
+}
+
+// handleTranscriptList lists the caller's transcripts, newest first
+func handleTranscriptList(w http.ResponseWriter, r *http.Request) {
+	caller, ok := historyPrincipal(w, r)
+	if !ok {
+		return
+	}
+	limit := defaultJobListLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxJobListLimit)
+	}
+	jobs := pipelineJobs.list(caller, jobFilter{Mine: true, Duplicates: true}, limit)
+	entries := make([]TranscriptEntry, 0, len(jobs))
+	for _, job := range jobs {
+		entries = append(entries, TranscriptEntry{
+			ID:         job.ID,
+			Status:     job.Status,
+			Title:      jobTitle(job),
+			Filename:   job.Filename,
+			Language:   job.Language,
+			Duration:   job.Duration,
+			HasSummary: job.Summary != "",
+			CreatedAt:  job.CreatedAt,
+			UpdatedAt:  job.UpdatedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// handleTranscriptGet returns a transcript of the caller's history
+func handleTranscriptGet(w http.ResponseWriter, r *http.Request) {
+	caller, ok := historyPrincipal(w, r)
+	if !ok {
+		return
+	}
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !inHistory(caller, job) {
+		http.Error(w, "Transcript not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// recordingPath is where the audio recorded by a live session is kept
+func recordingPath(job Job) (string, error) {
+	dir, err := regionStorageDir(job.Region)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "recordings", job.ID+".wav"), nil
+}
+
+// removeRecording deletes the audio recorded for a job, if any
+func removeRecording(job Job) {
+	if path, err := recordingPath(job); err == nil {
+		os.Remove(path)
+	}
+}
+
+// handleTranscriptAudio serves the audio recorded by a live session of the
+// caller's history
+func handleTranscriptAudio(w http.ResponseWriter, r *http.Request) {
+	caller, ok := historyPrincipal(w, r)
+	if !ok {
+		return
+	}
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !inHistory(caller, job) {
+		http.Error(w, "Transcript not found", http.StatusNotFound)
+		return
+	}
+	path, err := recordingPath(job)
+	var audio *os.File
+	if err == nil && job.Recorded {
+		audio, err = os.Open(path)
+	}
+	if !job.Recorded || err != nil {
+		http.Error(w, "The audio of this transcript was not recorded or is no longer available", http.StatusNotFound)
+		return
+	}
+	defer audio.Close()
+	info, err := audio.Stat()
+	if err != nil {
+		logErrorf(r.Context(), "Error opening the recording of job %s: %v", job.ID, err)
+		http.Error(w, "Error reading audio", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("Cache-Control", "no-store")
+	setAttachment(w, jobTitle(job), ".wav")
+	http.ServeContent(w, r, "", info.ModTime(), audio)
+}
+
+// handleTranscriptExport downloads a transcript of the caller's history as
+// SubRip or WebVTT subtitles, SubRip unless ?format=vtt or Accept asks
+// otherwise
+func handleTranscriptExport(w http.ResponseWriter, r *http.Request) {
+	caller, ok := historyPrincipal(w, r)
+	if !ok {
+		return
+	}
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !inHistory(caller, job) {
+		http.Error(w, "Transcript not found", http.StatusNotFound)
+		return
+	}
+	format := negotiate(r, mediaSRT, mediaVTT)
+	if format == "" {
+		http.Error(w, notAcceptable(mediaSRT, mediaVTT), http.StatusNotAcceptable)
+		return
+	}
+	if job.Status != jobCompleted {
+		http.Error(w, "Transcript is not completed", http.StatusConflict)
+		return
+	}
+	setAttachment(w, jobTitle(job), "."+formatShorthands[format])
+	writeTranscriptAs(w, format, job.Text, job.Duration, job.Segments)
+}
+
+// handleTranscriptDelete deletes a transcript of the caller's history
+func handleTranscriptDelete(w http.ResponseWriter, r *http.Request) {
+	caller, ok := historyPrincipal(w, r)
+	if !ok {
+		return
+	}
+	id := r.PathValue("id")
+	job, ok := pipelineJobs.get(id)
+	if !ok || !inHistory(caller, job) {
+		http.Error(w, "Transcript not found", http.StatusNotFound)
+		return
+	}
+	if underLegalHold(job.UserID) {
+		http.Error(w, "Transcript is under legal hold", http.StatusConflict)
+		return
+	}
+	if err := pipelineJobs.remove(id); err != nil {
+		logErrorf(r.Context(), "Error deleting job %s: %v", id, err)
+		http.Error(w, "Error deleting transcript", http.StatusInternalServerError)
+		return
+	}
+	if err := removeClips(job); err != nil {
+		logErrorf(r.Context(), "Error deleting clips of job %s: %v", id, err)
+	}
+	removeRecording(job)
+	logf(r.Context(), "Job %s deleted from the history", id)
+	recordAudit(job.UserID, newCloudEvent(EventTranscriptDeleted, id, map[string]any{"deleted_by": caller.ID}))
+	w.WriteHeader(http.StatusNoContent)
+}
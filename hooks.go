@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHookPayloadSize bounds the JSON body of an inbound webhook
+const maxHookPayloadSize = 64 << 10
+
+// hookSignatureHeader carries the HMAC of the timestamp and the request
+// body, "<timestamp>.<body>", as "<algorithm>=<hex>" (sha256 by default),
+// computed with HOOKS_SECRET
+const hookSignatureHeader = "X-Signature"
+
+// hookTimestampHeader carries the Unix time in seconds the request was
+// signed at
+const hookTimestampHeader = "X-Signature-Timestamp"
+
+// hookMaxAge is how far a signed request's timestamp may be from now. The
+// signatures of this window are remembered, so a captured request cannot
+// start a job again.
+const hookMaxAge = 5 * time.Minute
+
+// hookSignaturePrefix namespaces the signatures seen in the state store
+const hookSignaturePrefix = "hook-signature:"
+
+// handleIngestHook lets external systems trigger a pipeline on audio
+// referenced by URL instead of uploading it. The job runs in the background
+// and reports its outcome through lifecycle events.
+func handleIngestHook(w http.ResponseWriter, r *http.Request) {
+	if config.HooksSecret.Value() == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHookPayloadSize))
+	if err != nil {
+		logErrorf(r.Context(), "Error reading hook payload: %v", err)
+		http.Error(w, "Payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	timestamp := r.Header.Get(hookTimestampHeader)
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(signedAt, 0)).Abs() > hookMaxAge {
+		logf(r.Context(), "Rejected hook with a missing or expired timestamp from %s", r.RemoteAddr)
+		http.Error(w, "Missing or expired "+hookTimestampHeader+": sign requests with the current Unix time", http.StatusUnauthorized)
+		return
+	}
+	signature := strings.ToLower(r.Header.Get(hookSignatureHeader))
+	if !validSignature(config.HooksSecret.Value(), append([]byte(timestamp+"."), body...), signature) {
+		logf(r.Context(), "Rejected hook with invalid signature from %s", r.RemoteAddr)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var req PipelineRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		logErrorf(r.Context(), "Error decoding hook payload: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if msg, ok := req.validate(); !ok {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if refuseUnderDiskPressure(w, false) || refuseWhileShuttingDown(w, false) || refuseJobDuringMaintenance(w, false) || refuseWhenQueueFull(w, false) {
+		return
+	}
+
+	// Refused requests may be sent again as they were. Timestamps may be
+	// up to hookMaxAge ahead too.
+	seen, err := state.incrBy(hookSignaturePrefix+signature, 1, 2*hookMaxAge)
+	if err != nil {
+		logErrorf(r.Context(), "Error checking hook signature: %v", err)
+		http.Error(w, "State store unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if seen != 1 {
+		logWarnf(r.Context(), "Rejected replayed hook from %s", r.RemoteAddr)
+		http.Error(w, "Request already received", http.StatusConflict)
+		return
+	}
+
+	job := startPipeline(r.Context(), req)
+	w.Header().Set("X-Job-ID", job.ID)
+	writeJSON(w, http.StatusAccepted, map[string]string{"job_id": job.ID, "status": "accepted"})
+}
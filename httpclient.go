@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Shared clients for the inference backends. Reusing them keeps connections
+// alive between requests instead of paying TCP/TLS setup on every call.
+var (
+	audioClient *http.Client
+	llmClient   *http.Client
+)
+
+// Concurrency limits of the backend clients, which runtime settings change
+var (
+	audioLimiter *limitedTransport
+	llmLimiter   *limitedTransport
+)
+
+// newUpstreamTransport builds a pooled transport tuned for a small number of
+// busy backend hosts
+func newUpstreamTransport() *http.Transport {
+	transport := newEgressTransport(config.UpstreamDialTimeout)
+	transport.ForceAttemptHTTP2 = config.UpstreamHTTP2
+	transport.MaxIdleConns = config.UpstreamMaxIdleConnsPerHost * 4
+	transport.MaxIdleConnsPerHost = config.UpstreamMaxIdleConnsPerHost
+	transport.IdleConnTimeout = config.UpstreamIdleConnTimeout
+	transport.TLSHandshakeTimeout = config.UpstreamTLSTimeout
+	transport.ExpectContinueTimeout = 1 * time.Second
+	return transport
+}
+
+// initUpstreamClients creates the shared backend clients
+func initUpstreamClients() {
+	// Backend requests carry the ID of the request they serve
+	transport := &requestIDTransport{next: newUpstreamTransport()}
+	audioReserved := reservedSlots(config.AudioMaxConcurrency, config.InteractiveReservedShare)
+	llmReserved := reservedSlots(config.LLMMaxConcurrency, config.InteractiveReservedShare)
+	// Backend calls wait for a slot under their kind's concurrency limit,
+	// then count toward the stages of the request's timing
+	audioLimiter = &limitedTransport{
+		kind: backendAudio, limit: config.AudioMaxConcurrency, reserved: audioReserved, queueTimeout: config.UpstreamQueueTimeout,
+		next: &stageTransport{stage: stageASR, split: true, next: transport},
+	}
+	llmLimiter = &limitedTransport{
+		kind: backendLLM, limit: config.LLMMaxConcurrency, reserved: llmReserved, queueTimeout: config.UpstreamQueueTimeout,
+		next: &stageTransport{stage: stageLLM, next: &timedTransport{next: transport}},
+	}
+	// Backends listed together share the audio requests
+	audioClient = &http.Client{Transport: &balancedTransport{next: audioLimiter}, Timeout: 5 * time.Minute}
+	llmClient = &http.Client{Transport: llmLimiter, Timeout: 2 * time.Minute}
+	enhanceClient = &http.Client{Transport: transport, Timeout: 5 * time.Minute}
+	fetchClient = &http.Client{Transport: newFetchTransport(30 * time.Second), Timeout: 10 * time.Minute}
+	objectClient = &http.Client{Transport: newEgressTransport(30 * time.Second), Timeout: 10 * time.Minute}
+	healthClient = &http.Client{Transport: newUpstreamTransport()}
+	webhookClient = &http.Client{Transport: newEgressTransport(10 * time.Second), Timeout: 10 * time.Second}
+	logf(context.Background(), "Upstream clients: %d idle connections per host, HTTP/2 %v", config.UpstreamMaxIdleConnsPerHost, config.UpstreamHTTP2)
+	if config.AudioMaxConcurrency > 0 || config.LLMMaxConcurrency > 0 {
+		logf(context.Background(), "Upstream concurrency per host: audio %s, LLM %s, queued for up to %s", concurrencyLimit(config.AudioMaxConcurrency, audioReserved), concurrencyLimit(config.LLMMaxConcurrency, llmReserved), config.UpstreamQueueTimeout)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The web UI is localized with strings served by GET /i18n/{locale}.json.
+// Built-in catalogs ship in i18n/, one file per locale; admins add
+// languages or override single strings by declaring translations through
+// the admin API, without rebuilding the frontend. A string missing in the
+// requested locale is taken from the next locale of its fallback chain:
+// the locale, its declared fallback, its base language, UI_DEFAULT_LOCALE
+// and finally English, in which every string exists.
+
+// sourceLocale is the locale the UI is written in
+const sourceLocale = "en"
+
+// i18nDir holds the built-in catalogs
+const i18nDir = "i18n"
+
+// localePattern accepts language tags such as de, pt-BR or zh-Hant-TW
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8}){0,3}$`)
+
+// builtinCatalogs are the catalogs in i18nDir by lowercase locale
+var builtinCatalogs = map[string]map[string]string{}
+
+// Translation adds or overrides the UI strings of a locale, identified by
+// its language tag
+type Translation struct {
+	ID string `json:"id"`
+	// Fallback is tried before the base language, e.g. es for ca
+	Fallback string            `json:"fallback,omitempty"`
+	Strings  map[string]string `json:"strings"`
+}
+
+func (t *Translation) validate() error {
+	if !localePattern.MatchString(t.ID) {
+		return fmt.Errorf("%q is not a language tag such as de or pt-BR", t.ID)
+	}
+	if t.Fallback != "" && !localePattern.MatchString(t.Fallback) {
+		return fmt.Errorf("fallback %q is not a language tag such as de or pt-BR", t.Fallback)
+	}
+	if len(t.Strings) == 0 {
+		return errors.New("strings are required")
+	}
+	for key := range t.Strings {
+		if _, ok := builtinCatalogs[sourceLocale][key]; !ok {
+			return fmt.Errorf("unknown string %q", key)
+		}
+	}
+	return nil
+}
+
+func (t *Translation) redacted() adminResource {
+	c := *t
+	return &c
+}
+
+// translation returns the declared translation of a locale
+func (r *adminRegistry) translation(locale string) (*Translation, bool) {
+	for _, item := range r.list(kindTranslations) {
+		if t := item.(*Translation); strings.EqualFold(t.ID, locale) {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// fallbackChain returns the locales consulted for a locale, most specific
+// first, in lowercase
+func fallbackChain(locale string) []string {
+	var chain []string
+	seen := make(map[string]bool)
+	var add func(locale string)
+	add = func(locale string) {
+		locale = strings.ToLower(locale)
+		if locale == "" || seen[locale] {
+			return
+		}
+		seen[locale] = true
+		chain = append(chain, locale)
+		if t, ok := registry.translation(locale); ok {
+			add(t.Fallback)
+		}
+		if i := strings.LastIndex(locale, "-"); i > 0 {
+			add(locale[:i])
+		}
+	}
+	add(locale)
+	add(config.UIDefaultLocale)
+	add(sourceLocale)
+	return chain
+}
+
+// catalogStrings returns the strings of one locale, declared ones taking
+// precedence over built-in ones
+func catalogStrings(locale string) map[string]string {
+	merged := make(map[string]string)
+	for key, value := range builtinCatalogs[locale] {
+		merged[key] = value
+	}
+	if t, ok := registry.translation(locale); ok {
+		for key, value := range t.Strings {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// resolveStrings returns every UI string in a locale and the most specific
+// locale that contributed any of them
+func resolveStrings(locale string) (map[string]string, string) {
+	resolved := make(map[string]string)
+	language := ""
+	for _, candidate := range fallbackChain(locale) {
+		catalog := catalogStrings(candidate)
+		if len(catalog) > 0 && language == "" {
+			language = candidate
+		}
+		for key, value := range catalog {
+			if _, ok := resolved[key]; !ok {
+				resolved[key] = value
+			}
+		}
+	}
+	return resolved, language
+}
+
+// availableLocales lists the locales with a built-in or declared catalog
+func availableLocales() []string {
+	seen := make(map[string]bool)
+	var locales []string
+	for locale := range builtinCatalogs {
+		seen[locale] = true
+		locales = append(locales, locale)
+	}
+	for _, item := range registry.list(kindTranslations) {
+		if locale := strings.ToLower(item.(*Translation).ID); !seen[locale] {
+			seen[locale] = true
+			locales = append(locales, locale)
+		}
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// handleLocales lists the available locales, for a language picker
+func handleLocales(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"default": strings.ToLower(config.UIDefaultLocale),
+		"locales": availableLocales(),
+	})
+}
+
+// handleStrings serves the UI strings of a locale as a flat JSON object
+func handleStrings(w http.ResponseWriter, r *http.Request) {
+	locale, ok := strings.CutSuffix(r.PathValue("file"), ".json")
+	if !ok || !localePattern.MatchString(locale) {
+		http.NotFound(w, r)
+		return
+	}
+	resolved, language := resolveStrings(locale)
+	w.Header().Set("Content-Language", language)
+	// Declared translations are picked up within minutes
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, resolved)
+}
+
+// initI18n loads the built-in catalogs
+func initI18n() {
+	paths, err := fs.Glob(assets, path.Join(i18nDir, "*.json"))
+	if err != nil {
+		log.Fatalf("Error listing UI catalogs: %v", err)
+	}
+	for _, name := range paths {
+		data, err := fs.ReadFile(assets, name)
+		if err != nil {
+			log.Fatalf("Error reading UI catalog %s: %v", name, err)
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			log.Fatalf("Error parsing UI catalog %s: %v", name, err)
+		}
+		builtinCatalogs[strings.ToLower(strings.TrimSuffix(path.Base(name), ".json"))] = catalog
+	}
+	if len(builtinCatalogs[sourceLocale]) == 0 {
+		log.Fatalf("UI catalog %s is missing", path.Join(i18nDir, sourceLocale+".json"))
+	}
+	logf(context.Background(), "Loaded %d UI catalog(s), default locale %s", len(builtinCatalogs), config.UIDefaultLocale)
+}
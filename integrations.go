@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// The integration API is a simplified surface for no-code platforms such as
+// Zapier and Make: one JSON request with an audio URL, a polling endpoint,
+// flat response fields and API-key authentication. It is described in
+// static/openapi.json.
+
+// Limits for listing jobs
+const (
+	defaultJobListLimit = 25
+	maxJobListLimit     = 100
+)
+
+// registerIntegrationRoutes adds the /integrations/v1 endpoints to mux
+func registerIntegrationRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /integrations/v1/me", requireAPIKey(roleViewer, handleIntegrationMe))
+	mux.HandleFunc("POST /integrations/v1/transcriptions", requireAPIKey(roleEditor, handleIntegrationCreate))
+	mux.HandleFunc("GET /integrations/v1/transcriptions", requireAPIKey(roleViewer, handleIntegrationList))
+	mux.HandleFunc("GET /integrations/v1/estimate", requireAPIKey(roleViewer, handleIntegrationEstimate))
+	mux.HandleFunc("GET /integrations/v1/transcriptions/{id}", requireAPIKey(roleViewer, handleIntegrationGet))
+	mux.HandleFunc("DELETE /integrations/v1/transcriptions/{id}", requireAPIKey(roleEditor, handleIntegrationDelete))
+	mux.HandleFunc("GET /integrations/v1/transcriptions/{id}/transcript", requireAPIKey(roleViewer, handleIntegrationTranscript))
+	mux.HandleFunc("POST /integrations/v1/transcriptions/{id}/summary", requireAPIKey(roleEditor, handleRangeSummary))
+	mux.HandleFunc("POST /integrations/v1/transcriptions/{id}/agenda", requireAPIKey(roleEditor, handleAgendaReport))
+	mux.HandleFunc("GET /integrations/v1/transcriptions/{id}/flashcards", requireAPIKey(roleViewer, handleFlashcardExport))
+	mux.HandleFunc("GET /integrations/v1/transcriptions/{id}/study-notes", requireAPIKey(roleViewer, handleStudyNotesExport))
+	mux.HandleFunc("GET /integrations/v1/transcriptions/{id}/outline", requireAPIKey(roleViewer, handleOutlineExport))
+	mux.HandleFunc("GET /integrations/v1/transcriptions/{id}/dub-script", requireAPIKey(roleViewer, handleDubScript))
+	mux.HandleFunc("DELETE /integrations/v1/transcriptions/{id}/duplicate_of", requireAPIKey(roleEditor, handleDuplicateUnlink))
+	mux.HandleFunc("PUT /integrations/v1/transcriptions/{id}/consent", requireAPIKey(roleEditor, handleIntegrationConsent))
+	mux.HandleFunc("POST /integrations/v1/transcriptions/{id}/shares", requireAPIKey(roleEditor, handleShareCreate))
+	mux.HandleFunc("GET /integrations/v1/transcriptions/{id}/highlights", requireAPIKey(roleViewer, handleHighlightList))
+	mux.HandleFunc("POST /integrations/v1/transcriptions/{id}/highlights", requireAPIKey(roleEditor, handleHighlightCreate))
+	mux.HandleFunc("DELETE /integrations/v1/transcriptions/{id}/highlights/{highlight}", requireAPIKey(roleEditor, handleHighlightDelete))
+	mux.HandleFunc("GET /integrations/v1/transcriptions/{id}/highlights/export", requireAPIKey(roleViewer, handleHighlightExport))
+	mux.HandleFunc("GET /integrations/v1/transcriptions/{id}/gaps", requireAPIKey(roleViewer, handleGapList))
+	mux.HandleFunc("POST /integrations/v1/transcriptions/{id}/gaps/retry", requireAPIKey(roleEditor, handleGapRetry))
+	mux.HandleFunc("POST /integrations/v1/transcriptions/{id}/downloads", requireAPIKey(roleViewer, handleDownloadLinkCreate))
+	mux.HandleFunc("GET /integrations/v1/feeds", requireAPIKey(roleViewer, handleFeedList))
+	mux.HandleFunc("POST /integrations/v1/feeds", requireAPIKey(roleViewer, handleFeedCreate))
+	mux.HandleFunc("DELETE /integrations/v1/feeds/{id}", requireAPIKey(roleViewer, handleFeedDelete))
+	mux.HandleFunc("GET /integrations/v1/digest", requireAPIKey(roleViewer, handleDigestGet))
+	mux.HandleFunc("PUT /integrations/v1/digest", requireAPIKey(roleViewer, handleDigestPut))
+	mux.HandleFunc("GET /reports/trends", requireAPIKey(roleViewer, handleTrendReport))
+	mux.HandleFunc("GET /changes", requireAPIKey(roleViewer, handleChanges))
+	mux.HandleFunc("GET /integrations/v1/decisions", requireAPIKey(roleViewer, handleDecisionLog))
+	mux.HandleFunc("GET /integrations/v1/risks", requireAPIKey(roleViewer, handleRiskRegister))
+	mux.HandleFunc("GET /integrations/v1/scorecards/{id}/scores", requireAPIKey(roleViewer, handleScoreList))
+	mux.HandleFunc("GET /integrations/v1/scorecards/{id}/trends", requireAPIKey(roleViewer, handleScoreTrends))
+	mux.HandleFunc("GET /integrations/v1/feedback-reports", requireAPIKey(roleViewer, handleFeedbackReportList))
+	mux.HandleFunc("GET /integrations/v1/feedback-reports/{tag}", requireAPIKey(roleViewer, handleFeedbackReportGet))
+	mux.HandleFunc("PUT /integrations/v1/feedback-reports/{tag}", requireAPIKey(roleViewer, handleFeedbackReportPut))
+	mux.HandleFunc("DELETE /integrations/v1/feedback-reports/{tag}", requireAPIKey(roleViewer, handleFeedbackReportDelete))
+	mux.HandleFunc("GET /integrations/v1/workspace", requireAPIKey(roleViewer, handleIntegrationWorkspace))
+	mux.HandleFunc("POST /integrations/v1/invitations/accept", handleInvitationAccept)
+	mux.HandleFunc("GET /integrations/v1/rooms", requireAPIKey(roleViewer, handleIntegrationRooms))
+	mux.HandleFunc("GET /integrations/v1/rooms/{id}/meetings", requireAPIKey(roleViewer, handleRoomMeetings))
+	mux.HandleFunc("GET /integrations/v1/channels", requireAPIKey(roleViewer, handleIntegrationChannels))
+	mux.HandleFunc("POST /integrations/v1/channels/{id}/clips", requireAPIKey(roleEditor, handleChannelClip))
+	mux.HandleFunc("GET /integrations/v1/channels/{id}/log", requireAPIKey(roleViewer, handleChannelLog))
+	mux.HandleFunc("POST /devices/v1/pair", handleDevicePair)
+	mux.HandleFunc("GET /devices/v1/schedule", requireRoomDevice(handleDeviceSchedule))
+	mux.HandleFunc("PUT /devices/v1/meetings/{meeting}/audio", requireRoomDevice(handleDeviceRecording))
+}
+
+// integrationError answers with a JSON error body, which no-code platforms
+// display more readably than plain text
+func integrationError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// requireAPIKey rejects requests without a valid API key holding at least
+// role, taken from the X-API-Key header or an "Authorization: Bearer" token,
+// and records who the key belongs to on the request. The endpoints are
+// hidden entirely when no keys are configured or declared.
+func requireAPIKey(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !apiKeysConfigured() {
+			http.NotFound(w, r)
+			return
+		}
+		p, ok := principalForKey(requestAPIKey(r))
+		if !ok {
+			logf(r.Context(), "Rejected integration request with invalid API key from %s", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="integrations"`)
+			integrationError(w, http.StatusUnauthorized, "Invalid or missing API key")
+			return
+		}
+		if !p.can(role) {
+			integrationError(w, http.StatusForbidden, "API key role does not allow this operation")
+			return
+		}
+		next(w, withPrincipal(r, p))
+	}
+}
+
+// handleIntegrationMe lets platforms verify credentials when connecting
+func handleIntegrationMe(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "service": "transcription-app", "tenant": p.Tenant, "workspace": p.Workspace, "role": p.Role})
+}
+
+// handleIntegrationCreate starts a pipeline on audio referenced by URL
+func handleIntegrationCreate(w http.ResponseWriter, r *http.Request) {
+	var req PipelineRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&req); err != nil {
+		logErrorf(r.Context(), "Error decoding integration request: %v", err)
+		integrationError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	// The tenant and owner always come from the API key
+	p := principalFrom(r.Context())
+	req.Tenant = p.Tenant
+	req.Workspace = p.Workspace
+	req.CreatedBy = p.ID
+	if msg, ok := req.validate(); !ok {
+		integrationError(w, http.StatusBadRequest, msg)
+		return
+	}
+	if refuseUnderDiskPressure(w, true) || refuseWhileShuttingDown(w, true) || refuseJobDuringMaintenance(w, true) || refuseWhenQueueFull(w, true) {
+		return
+	}
+	warnings, msg, ok := admitWorkspaceJob(w, req.Workspace)
+	if !ok {
+		integrationError(w, http.StatusTooManyRequests, msg)
+		return
+	}
+
+	job := startPipeline(r.Context(), req)
+	job.QuotaWarnings = warnings
+	w.Header().Set("Location", "/integrations/v1/transcriptions/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// handleIntegrationGet returns the current state of a job for polling
+func handleIntegrationGet(w http.ResponseWriter, r *http.Request) {
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !principalFrom(r.Context()).sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	format := negotiate(r, mediaJSON, mediaText, mediaVTT, mediaSRT)
+	switch {
+	case format == "":
+		integrationError(w, http.StatusNotAcceptable, notAcceptable(mediaJSON, mediaText, mediaVTT, mediaSRT))
+	case format == mediaJSON:
+		w.Header().Set("Vary", "Accept")
+		writeJSON(w, http.StatusOK, job)
+	case job.Status != jobCompleted:
+		integrationError(w, http.StatusConflict, "Transcription is not completed")
+	default:
+		writeTranscriptAs(w, format, job.Text, job.Duration, job.Segments)
+	}
+}
+
+// handleIntegrationDelete removes a transcription created by the caller
+func handleIntegrationDelete(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	job, ok := pipelineJobs.get(id)
+	if !ok || !principalFrom(r.Context()).sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	if !principalFrom(r.Context()).owns(job) {
+		integrationError(w, http.StatusForbidden, "Only the creator of a transcription or an admin can delete it")
+		return
+	}
+	if underLegalHold(job.UserID) {
+		integrationError(w, http.StatusConflict, "Transcription is under legal hold")
+		return
+	}
+	if err := pipelineJobs.remove(id); err != nil {
+		logErrorf(r.Context(), "Error deleting job %s: %v", id, err)
+		integrationError(w, http.StatusInternalServerError, "Error deleting transcription")
+		return
+	}
+	if err := removeClips(job); err != nil {
+		logErrorf(r.Context(), "Error deleting clips of job %s: %v", id, err)
+	}
+	removeRecording(job)
+	logf(r.Context(), "Job %s deleted by %s", id, principalFrom(r.Context()).ID)
+	recordAudit(job.UserID, newCloudEvent(EventTranscriptDeleted, id, map[string]any{"deleted_by": principalFrom(r.Context()).ID}))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleIntegrationList returns recent jobs, newest first. Polling triggers
+// use ?status=completed to pick up finished transcriptions.
+func handleIntegrationList(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", jobQueued, jobRunning, jobCompleted, jobFailed:
+	default:
+		integrationError(w, http.StatusBadRequest, "Unknown status")
+		return
+	}
+
+	limit := defaultJobListLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			integrationError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxJobListLimit)
+	}
+
+	filter := jobFilter{
+		Status:      status,
+		Duplicates:  r.URL.Query().Get("duplicates") == "true",
+		DuplicateOf: r.URL.Query().Get("duplicate_of"),
+		Room:        r.URL.Query().Get("room"),
+		Meeting:     r.URL.Query().Get("meeting"),
+	}
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		if filter.Tag = normalizeTag(tag); filter.Tag == "" {
+			integrationError(w, http.StatusBadRequest, "Invalid tag")
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, pipelineJobs.list(principalFrom(r.Context()), filter, limit))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Telephony integrations play a recorded disclosure to callers before their
+// call is recorded. The recordings are served from CONSENT_AUDIO_DIR, one
+// file per language named like en.wav or pt-BR.mp3, at a URL a Twilio
+// <Play> verb or any other IVR can fetch. Files are looked up on every
+// request, so recordings on a mounted volume can be replaced without a
+// restart.
+
+// consentAudioTypes are the formats telephony providers play
+var consentAudioTypes = map[string]string{
+	".wav": "audio/wav",
+	".mp3": "audio/mpeg",
+}
+
+// consentAudioFile is a disclosure recording
+type consentAudioFile struct {
+	Language    string `json:"language"`
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	path        string
+}
+
+// consentAudioFiles lists the recordings in CONSENT_AUDIO_DIR by lowercase
+// language
+func consentAudioFiles() (map[string]consentAudioFile, error) {
+	files := make(map[string]consentAudioFile)
+	if config.ConsentAudioDir == "" {
+		return files, nil
+	}
+	entries, err := os.ReadDir(config.ConsentAudioDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		contentType, ok := consentAudioTypes[ext]
+		if entry.IsDir() || !ok {
+			continue
+		}
+		language := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		files[strings.ToLower(language)] = consentAudioFile{
+			Language:    language,
+			URL:         "/consent/audio/" + language,
+			ContentType: contentType,
+			path:        filepath.Join(config.ConsentAudioDir, entry.Name()),
+		}
+	}
+	return files, nil
+}
+
+// resolveConsentAudio picks the recording for a language tag, falling back
+// from a regional variant to the base language and then to
+// CONSENT_AUDIO_DEFAULT_LANGUAGE
+func resolveConsentAudio(files map[string]consentAudioFile, language string) (consentAudioFile, bool) {
+	language = strings.ToLower(language)
+	candidates := []string{language}
+	if base, _, ok := strings.Cut(language, "-"); ok {
+		candidates = append(candidates, base)
+	}
+	candidates = append(candidates, strings.ToLower(config.ConsentAudioDefaultLanguage))
+	for _, candidate := range candidates {
+		if f, ok := files[candidate]; ok {
+			return f, true
+		}
+	}
+	return consentAudioFile{}, false
+}
+
+// handleConsentAudioList lists the available disclosure recordings
+func handleConsentAudioList(w http.ResponseWriter, r *http.Request) {
+	files, err := consentAudioFiles()
+	if err != nil {
+		logErrorf(r.Context(), "Error reading CONSENT_AUDIO_DIR: %v", err)
+		http.Error(w, "Error listing disclosure recordings", http.StatusInternalServerError)
+		return
+	}
+	list := make([]consentAudioFile, 0, len(files))
+	for _, f := range files {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Language < list[j].Language })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleConsentAudio serves the disclosure recording for a language. It is
+// public, as IVR platforms fetch it without credentials.
+func handleConsentAudio(w http.ResponseWriter, r *http.Request) {
+	files, err := consentAudioFiles()
+	if err != nil {
+		logErrorf(r.Context(), "Error reading CONSENT_AUDIO_DIR: %v", err)
+		http.Error(w, "Error reading disclosure recordings", http.StatusInternalServerError)
+		return
+	}
+	f, ok := resolveConsentAudio(files, r.PathValue("language"))
+	if !ok {
+		http.Error(w, "No disclosure recording for this language", http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		logErrorf(r.Context(), "Error opening disclosure recording %s: %v", f.path, err)
+		http.Error(w, "Error reading disclosure recording", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		logErrorf(r.Context(), "Error opening disclosure recording %s: %v", f.path, err)
+		http.Error(w, "Error reading disclosure recording", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", f.ContentType)
+	// Telephony providers cache by URL; keep the cache short so replaced
+	// recordings are picked up
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	http.ServeContent(w, r, filepath.Base(f.path), info.ModTime(), file)
+}
+
+// initConsentAudio reports the disclosure recordings found at startup
+func initConsentAudio() {
+	if config.ConsentAudioDir == "" {
+		return
+	}
+	files, err := consentAudioFiles()
+	if err != nil {
+		log.Fatalf("Error reading CONSENT_AUDIO_DIR: %v", err)
+	}
+	if _, ok := resolveConsentAudio(files, config.ConsentAudioDefaultLanguage); !ok {
+		logWarnf(context.Background(), "Warning: no disclosure recording for the default language %q in %s", config.ConsentAudioDefaultLanguage, config.ConsentAudioDir)
+	}
+	logf(context.Background(), "Serving %d disclosure recording(s) from %s", len(files), config.ConsentAudioDir)
+}
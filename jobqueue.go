@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Background jobs wait in a queue until one of JOB_WORKERS workers picks
+// them up, so a burst of long recordings is processed a few at a time
+// rather than all at once. This includes jobs started by the integrations
+// API, inbound webhooks, meeting room devices and uploads to
+// /jobs/transcribe. A long upload sent to /jobs/transcribe is answered
+// with a job ID as soon as it has arrived, instead of holding the request
+// open until it is transcribed; the browser then polls /jobs/{id}, and can
+// pick the job up again after a reload. The queue belongs to the replica
+// that accepted the job, while job records are in the shared state store.
+
+var (
+	jobQueueLength   = expvar.NewInt("job_queue_length")
+	jobWorkersBusy   = expvar.NewInt("job_workers_busy")
+	jobQueueRejected = expvar.NewInt("job_queue_rejected_total")
+)
+
+// queuedJob is a job waiting for a worker
+type queuedJob struct {
+	id  string
+	req PipelineRequest
+}
+
+var jobQueue chan queuedJob
+
+// enqueueJob hands a job to the workers. Jobs are never dropped: when the
+// queue is full the job waits for a place, as new work is refused up front
+// by jobQueueFull.
+func enqueueJob(id string, req PipelineRequest) {
+	jobQueueLength.Add(1)
+	j := queuedJob{id: id, req: req}
+	select {
+	case jobQueue <- j:
+	default:
+		go func() { jobQueue <- j }()
+	}
+}
+
+// jobQueueFull reports whether JOB_QUEUE_SIZE jobs are already waiting
+func jobQueueFull() bool {
+	return jobQueueLength.Value() >= int64(config.JobQueueSize)
+}
+
+// runJobWorker runs queued jobs one after the other
+func runJobWorker() {
+	for j := range jobQueue {
+		jobQueueLength.Add(-1)
+		jobWorkersBusy.Add(1)
+		runPipeline(j.id, j.req)
+		jobWorkersBusy.Add(-1)
+	}
+}
+
+// refuseWhenQueueFull answers 503 when too many jobs are waiting
+func refuseWhenQueueFull(w http.ResponseWriter, integration bool) bool {
+	if !jobQueueFull() {
+		return false
+	}
+	jobQueueRejected.Add(1)
+	w.Header().Set("Retry-After", "60")
+	const msg = "Too many jobs are queued, please retry later"
+	if integration {
+		integrationError(w, http.StatusServiceUnavailable, msg)
+	} else {
+		http.Error(w, msg, http.StatusServiceUnavailable)
+	}
+	return true
+}
+
+// JobProgress is how far a job has got through its pipeline's steps
+type JobProgress struct {
+	Step       string `json:"step,omitempty"`
+	StepsDone  int    `json:"steps_done"`
+	StepsTotal int    `json:"steps_total"`
+}
+
+// jobProgress works out a job's progress from its status and step
+func jobProgress(job Job) JobProgress {
+	steps := pipelineSteps(job.Pipeline)
+	p := JobProgress{StepsTotal: len(steps)}
+	switch job.Status {
+	case jobCompleted:
+		p.StepsDone = len(steps)
+	case jobRunning, jobFailed:
+		p.Step = job.Step
+		p.StepsDone = max(slices.Index(steps, job.Step), 0)
+	}
+	return p
+}
+
+// handleJobTranscribe receives an upload and queues it for transcription,
+// answering 202 with the job as soon as the upload has arrived. Form fields
+// sent before the file: language, title and pipeline (default transcribe).
+func handleJobTranscribe(w http.ResponseWriter, r *http.Request) {
+	caller, ok := browserPrincipal(w, r)
+	if !ok {
+		return
+	}
+	if refuseWhileShuttingDown(w, false) || refuseJobDuringMaintenance(w, false) || refuseWhenQueueFull(w, false) {
+		return
+	}
+	if refuseUnderDiskPressure(w, false) {
+		return
+	}
+	warnings, msg, ok := admitWorkspaceJob(w, caller.Workspace)
+	if !ok {
+		http.Error(w, msg, http.StatusTooManyRequests)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	r.Body = throttleUpload(r.Context(), r.Body)
+	reader, err := r.MultipartReader()
+	var filePart *multipart.Part
+	fields := make(map[string]string)
+	if err == nil {
+		filePart, err = readFieldsUntilFile(reader, fields)
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Error parsing form: %v", err)
+		http.Error(w, "Error parsing form data", http.StatusBadRequest)
+		return
+	}
+	if filePart == nil {
+		http.Error(w, "Error getting file from form", http.StatusBadRequest)
+		return
+	}
+
+	req, err := jobRequest(caller, fields, filePart.FileName())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Keep the upload as sent; the worker converts it
+	dir, err := ingestDir(req.Region)
+	if err != nil {
+		logErrorf(r.Context(), "Error receiving upload %s: %v", req.Filename, err)
+		http.Error(w, regionUnavailableMessage, http.StatusServiceUnavailable)
+		return
+	}
+	path, err := receiveAudio(filePart, dir, "upload-*")
+	if err != nil {
+		logErrorf(r.Context(), "Error receiving upload %s: %v", req.Filename, err)
+		if path != "" {
+			os.Remove(path)
+		}
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errUnsupportedAudio):
+			http.Error(w, "Unsupported audio format: upload WAV, MP3, M4A, FLAC, OGG or WebM", http.StatusBadRequest)
+		case errors.Is(err, errNoConverter):
+			http.Error(w, "Only WAV files are supported: converting other formats requires ffmpeg on the server", http.StatusUnsupportedMediaType)
+		default:
+			http.Error(w, "Error receiving upload", http.StatusInternalServerError)
+		}
+		return
+	}
+	req.Recording = path
+
+	job := startPipeline(r.Context(), req)
+	job.QuotaWarnings = warnings
+	logf(r.Context(), "Job %s: queued upload %s", job.ID, req.Filename)
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// jobRequest builds the request for a job of caller on a file uploaded
+// under filename, from the fields sent with it
+func jobRequest(caller principal, fields map[string]string, filename string) (PipelineRequest, error) {
+	req := PipelineRequest{
+		Pipeline:  fields["pipeline"],
+		Title:     strings.TrimSpace(fields["title"]),
+		Tenant:    caller.Tenant,
+		Region:    tenantRegion(caller.Tenant),
+		Workspace: caller.Workspace,
+		CreatedBy: caller.ID,
+		History:   config.TranscriptHistory,
+		Filename:  cleanFilename(filename),
+	}
+	req.Language, req.Languages = fields["language"], splitLanguages(fields["languages"])
+	if req.Pipeline == "" {
+		req.Pipeline = pipelineTranscribe
+	}
+	if !validPipeline(req.Pipeline) {
+		return req, errors.New("Unknown pipeline")
+	}
+	if len([]rune(req.Title)) > maxTitleLength {
+		return req, errors.New("Title is too long")
+	}
+	if err := req.checkLanguages(); err != nil {
+		return req, err
+	}
+	if value := fields["enhance"]; value != "" {
+		enhance, err := enhanceRequested(value)
+		if err != nil {
+			return req, err
+		}
+		req.Enhance = &enhance
+	}
+	return req, nil
+}
+
+// handleJobGet reports a job's status and progress, and its results once
+// it is completed
+func handleJobGet(w http.ResponseWriter, r *http.Request) {
+	caller, ok := browserPrincipal(w, r)
+	if !ok {
+		return
+	}
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !caller.sees(job) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Job
+		Progress JobProgress `json:"progress"`
+	}{job, jobProgress(job)})
+}
+
+// initJobQueue starts the job workers
+func initJobQueue() {
+	jobQueue = make(chan queuedJob, max(config.JobQueueSize, 1))
+	for i := 0; i < config.JobWorkers; i++ {
+		go runJobWorker()
+	}
+	logf(context.Background(), "Job workers: %d, queue size: %d", config.JobWorkers, config.JobQueueSize)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job states reported to polling clients
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+)
+
+// Job is the state of a background pipeline run. Fields are kept flat so
+// no-code platforms can map them without traversing nested objects.
+type Job struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	Pipeline  string    `json:"pipeline"`
+	Title     string    `json:"title,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Workspace string    `json:"workspace,omitempty"`
+	Region    string    `json:"region,omitempty"`
+	UserID    string    `json:"user_id,omitempty"`
+	AudioURL  string    `json:"audio_url"`
+	Filename  string    `json:"filename,omitempty"`
+	Language  string    `json:"language,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	Duration  float64   `json:"duration,omitempty"`
+	Segments  []Segment `json:"segments,omitempty"`
+	Summary   string    `json:"summary,omitempty"`
+	// Gaps are stretches of a long recording that could not be
+	// transcribed, marked in the text and segments
+	Gaps []TranscriptGap `json:"gaps,omitempty"`
+	// LanguageHint is the language of the request's list of languages the
+	// transcript was made with, and LanguagesTried the ones tried in order
+	LanguageHint   string   `json:"language_hint,omitempty"`
+	LanguagesTried []string `json:"languages_tried,omitempty"`
+	// SpokenLanguages lists the languages of a transcript that switches
+	// between them, most spoken first
+	SpokenLanguages []string `json:"spoken_languages,omitempty"`
+	// AudioQuality is the assessment of the recording
+	AudioQuality *AudioQuality `json:"audio_quality,omitempty"`
+	// SummaryTruncation reports how text too long to summarize in full
+	// was reduced
+	SummaryTruncation *Truncation `json:"summary_truncation,omitempty"`
+	// Tags are topics assigned by the tags step
+	Tags []string `json:"tags,omitempty"`
+	// DuplicateOf links another recording of the same meeting to the job
+	// completed first
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	// Decisions are set by the decisions step
+	Decisions []Decision `json:"decisions,omitempty"`
+	// Risks are risks, blockers and dependencies found by the risks step
+	Risks []Risk `json:"risks,omitempty"`
+	// Feedback is what customers raised, found by the feedback step
+	Feedback []FeedbackItem `json:"feedback,omitempty"`
+	// Scorecard is the call's rating by the scorecard step
+	Scorecard *CallScore `json:"scorecard,omitempty"`
+	// StudyNotes, Flashcards and Quiz are the study material of a lecture
+	StudyNotes *StudyNotes    `json:"study_notes,omitempty"`
+	Flashcards []Flashcard    `json:"flashcards,omitempty"`
+	Quiz       []QuizQuestion `json:"quiz,omitempty"`
+	// Outline is a speech's structure, set by the outline step
+	Outline *SpeechOutline `json:"outline,omitempty"`
+	// Translation is the transcript in the pipeline's translate_to language
+	Translation *TranscriptTranslation `json:"translation,omitempty"`
+	// ActionItems are tasks, deadlines and meetings mentioned in the audio
+	ActionItems []ActionItem `json:"action_items,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Consent     *Consent     `json:"consent,omitempty"`
+	// Highlights are marked time ranges with cut audio clips
+	Highlights []Highlight `json:"highlights,omitempty"`
+	// Bookmarks are moments flagged during a live session
+	Bookmarks []Bookmark `json:"bookmarks,omitempty"`
+	// Recorded is set when the audio of a live session was kept
+	Recorded bool `json:"recorded,omitempty"`
+	// History is set on jobs of the web UI's transcript history, kept for
+	// TRANSCRIPT_HISTORY_RETENTION rather than ARTIFACT_RETENTION
+	History bool `json:"history,omitempty"`
+	// QuotaWarnings are only returned when the job is created
+	QuotaWarnings []QuotaWarning `json:"quota_warnings,omitempty"`
+	// Step is the pipeline step running, or the last one run
+	Step string `json:"step,omitempty"`
+	// Timing is where the job's time went so far
+	Timing    *Timing `json:"timing,omitempty"`
+	CreatedBy string  `json:"created_by,omitempty"`
+	// Room and Meeting are the room and meeting a room device recorded
+	Room      string    `json:"room,omitempty"`
+	Meeting   string    `json:"meeting,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// jobStore keeps background jobs in the state store, so any replica can
+// answer a poll. Records expire after the retention period.
+type jobStore struct {
+	retention time.Duration
+	// historyRetention is the retention of the transcript history; 0
+	// keeps it
+	historyRetention time.Duration
+
+	// mu serializes updates from this replica; a job is only ever updated
+	// by the replica running it
+	mu sync.Mutex
+}
+
+var pipelineJobs = &jobStore{retention: 24 * time.Hour}
+
+// jobKeyPrefix namespaces job records in the state store, and
+// jobIndexPrefix the index listings page through: one key per job, named
+// after its tenant, workspace and creation time so that the keys of a
+// tenant or workspace share a prefix and sort by age
+const (
+	jobKeyPrefix   = "job:"
+	jobIndexPrefix = "job-index:"
+	// jobIndexBuilt counts the replicas that started with the index, so
+	// only the first indexes the jobs recorded before it existed
+	jobIndexBuilt = "job-index-built"
+)
+
+// jobScopePrefix is the index prefix of the jobs of a tenant and, unless
+// empty, workspace
+func jobScopePrefix(tenant, workspace string) string {
+	prefix := jobIndexPrefix + url.PathEscape(tenant) + "/"
+	if workspace != "" {
+		prefix += url.PathEscape(workspace) + "/"
+	}
+	return prefix
+}
+
+// jobIndexKey is the index key of a job
+func jobIndexKey(job *Job) string {
+	return fmt.Sprintf("%s%s/%020d/%s", jobScopePrefix(job.Tenant, ""), url.PathEscape(job.Workspace), job.CreatedAt.UnixNano(), job.ID)
+}
+
+// jobIndexEntry splits an index key into the job's creation time, as text
+// that sorts by age, and ID
+func jobIndexEntry(key string) (string, string) {
+	i := strings.LastIndex(key, "/")
+	j := strings.LastIndex(key[:i], "/")
+	return key[j+1 : i], key[i+1:]
+}
+
+// add records a new job
+func (s *jobStore) add(job *Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.save(job)
+	recordChange(changeCreated, job)
+}
+
+// save writes a job record; the caller holds the lock
+func (s *jobStore) save(job *Job) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		logErrorf(context.Background(), "Error encoding job %s: %v", job.ID, err)
+		return
+	}
+	ttl := s.ttl(job)
+	if err := state.set(jobKeyPrefix+job.ID, data, ttl); err != nil {
+		logErrorf(context.Background(), "Error saving job %s: %v", job.ID, err)
+		return
+	}
+	// Expires with the record
+	if err := state.set(jobIndexKey(job), []byte(job.ID), ttl); err != nil {
+		logErrorf(context.Background(), "Error indexing job %s: %v", job.ID, err)
+	}
+}
+
+// ttl is how long a job record is kept from now. Jobs of users under legal
+// hold are kept until the hold is released.
+func (s *jobStore) ttl(job *Job) time.Duration {
+	if underLegalHold(job.UserID) {
+		return 0
+	}
+	if job.History {
+		return s.historyRetention
+	}
+	return s.retention
+}
+
+// get returns the job with the given ID
+func (s *jobStore) get(id string) (Job, bool) {
+	return s.getFrom(state, id)
+}
+
+// getFrom returns the job with the given ID as kept in store
+func (s *jobStore) getFrom(store kvStore, id string) (Job, bool) {
+	data, ok, err := store.get(jobKeyPrefix + id)
+	if err != nil {
+		logErrorf(context.Background(), "Error loading job %s: %v", id, err)
+	}
+	if !ok {
+		return Job{}, false
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		logErrorf(context.Background(), "Error decoding job %s: %v", id, err)
+		return Job{}, false
+	}
+	return job, true
+}
+
+// update applies fn to the stored job
+func (s *jobStore) update(id string, fn func(*Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.get(id)
+	if !ok {
+		return
+	}
+	before, summary := syncedState(job), job.Summary
+	fn(&job)
+	job.UpdatedAt = time.Now().UTC()
+	s.save(&job)
+	recordUpdate(before, summary, &job)
+	sharePages.forget(id)
+}
+
+// retain rewrites a job record so its expiry follows the user's current
+// legal hold status
+func (s *jobStore) retain(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.get(id); ok {
+		s.save(&job)
+	}
+}
+
+// remove deletes a job record
+func (s *jobStore) remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.get(id)
+	if err := state.delete(jobKeyPrefix + id); err != nil || !ok {
+		return err
+	}
+	if err := state.delete(jobIndexKey(&job)); err != nil {
+		logErrorf(context.Background(), "Error removing job %s from the index: %v", id, err)
+	}
+	recordChange(changeDeleted, &job)
+	sharePages.forget(id)
+	return nil
+}
+
+// jobFilter selects jobs in listings; empty fields match any job.
+// Duplicates are left out unless asked for, while the job they duplicate is
+// kept: once it is deleted, erased or expired they are listed again.
+type jobFilter struct {
+	// Mine keeps only the jobs the listing principal created
+	Mine        bool
+	Status      string
+	Tag         string
+	Duplicates  bool
+	DuplicateOf string
+	Room        string
+	Meeting     string
+}
+
+func (f jobFilter) matches(job Job) bool {
+	if f.DuplicateOf != "" {
+		if job.DuplicateOf != f.DuplicateOf {
+			return false
+		}
+	} else if job.DuplicateOf != "" && !f.Duplicates {
+		if _, ok := pipelineJobs.get(job.DuplicateOf); ok {
+			return false
+		}
+	}
+	if (f.Room != "" && job.Room != f.Room) || (f.Meeting != "" && job.Meeting != f.Meeting) {
+		return false
+	}
+	return (f.Status == "" || job.Status == f.Status) && (f.Tag == "" || hasTag(job, f.Tag))
+}
+
+// list returns up to limit jobs visible to p and matching f, newest first.
+// It pages through the index of p's tenant or workspace, loading jobs only
+// until limit of them match.
+func (s *jobStore) list(p principal, f jobFilter, limit int) []Job {
+	keys, err := state.keys(jobScopePrefix(p.Tenant, p.Workspace))
+	if err != nil {
+		logErrorf(context.Background(), "Error listing jobs: %v", err)
+		return []Job{}
+	}
+	// By creation time, across the workspaces of a tenant
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := jobIndexEntry(keys[i])
+		b, _ := jobIndexEntry(keys[j])
+		return a > b
+	})
+
+	jobs := []Job{}
+	for _, key := range keys {
+		if len(jobs) == limit {
+			break
+		}
+		_, id := jobIndexEntry(key)
+		job, ok := s.get(id)
+		if ok && p.sees(job) && f.matches(job) && (!f.Mine || job.CreatedBy == p.ID) {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// userJobs returns all jobs of a user, oldest first
+func (s *jobStore) userJobs(user string) ([]Job, error) {
+	keys, err := state.keys(jobKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []Job
+	for _, key := range keys {
+		job, ok := s.get(strings.TrimPrefix(key, jobKeyPrefix))
+		if ok && job.UserID == user {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+// initJobs applies the configured retention to the job store, and indexes
+// the jobs recorded before listings used the index
+func initJobs() {
+	pipelineJobs.retention = config.ArtifactRetention
+	pipelineJobs.historyRetention = config.TranscriptHistoryRetention
+	n, err := state.incrBy(jobIndexBuilt, 1, 0)
+	if err != nil {
+		logErrorf(context.Background(), "Error checking the job index: %v", err)
+		return
+	}
+	if n != 1 {
+		return
+	}
+	keys, err := state.keys(jobKeyPrefix)
+	if err != nil {
+		logErrorf(context.Background(), "Error indexing jobs: %v", err)
+		return
+	}
+	pipelineJobs.mu.Lock()
+	defer pipelineJobs.mu.Unlock()
+	for _, key := range keys {
+		if job, ok := pipelineJobs.get(strings.TrimPrefix(key, jobKeyPrefix)); ok {
+			pipelineJobs.save(&job)
+		}
+	}
+	if len(keys) > 0 {
+		logf(context.Background(), "Indexed %d job(s) for listings", len(keys))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The kiosk view shows a feed on a wall display, such as in a control room
+// following transcribed radio or calls: the latest completed transcriptions
+// in large text, one at a time. Each page reloads itself to show the next,
+// so the display needs no JavaScript and picks up new transcriptions on its
+// own.
+
+// Kiosk rotation settings
+const (
+	defaultKioskInterval = 15 * time.Second
+	minKioskInterval     = 5 * time.Second
+	defaultKioskCount    = 10
+)
+
+// kioskView is the data rendered by kiosk.html
+type kioskView struct {
+	Title     string
+	Job       *Job
+	Index     int
+	Count     int
+	Positions []int
+	Interval  int
+	NextURL   string
+	Now       time.Time
+}
+
+// handleKiosk renders one transcription of a feed and refreshes to the
+// next. ?interval= sets the seconds per transcription and ?count= how many
+// of the latest are rotated.
+func handleKiosk(w http.ResponseWriter, r *http.Request) {
+	f, ok := resolveFeed(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	q := r.URL.Query()
+	interval := defaultKioskInterval
+	if value := q.Get("interval"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || time.Duration(seconds)*time.Second < minKioskInterval {
+			http.Error(w, fmt.Sprintf("interval must be at least %d seconds", int(minKioskInterval.Seconds())), http.StatusBadRequest)
+			return
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+	count := defaultKioskCount
+	if value := q.Get("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > feedEntries {
+			http.Error(w, fmt.Sprintf("count must be between 1 and %d", feedEntries), http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+	index, _ := strconv.Atoi(q.Get("i"))
+
+	jobs := feedJobs(f)
+	if len(jobs) > count {
+		jobs = jobs[:count]
+	}
+	view := kioskView{
+		Title:    f.Title,
+		Count:    len(jobs),
+		Interval: int(interval.Seconds()),
+		Now:      time.Now(),
+	}
+	next := url.Values{}
+	for key, values := range q {
+		next[key] = values
+	}
+	if len(jobs) > 0 {
+		index = ((index % len(jobs)) + len(jobs)) % len(jobs)
+		view.Job, view.Index = &jobs[index], index
+		for i := range jobs {
+			view.Positions = append(view.Positions, i)
+		}
+		next.Set("i", strconv.Itoa((index+1)%len(jobs)))
+	}
+	view.NextURL = r.URL.Path + "?" + next.Encode()
+	renderView(w, "kiosk.html", view)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Bilingual households and teams switch languages, and Whisper's detection
+// picks the wrong one on short or mixed recordings. A request may therefore
+// pass an ordered list of likely languages instead of one: the audio is
+// transcribed with the first as the hint, and when the transcript's
+// confidence is below LANGUAGE_FALLBACK_CONFIDENCE it is transcribed again
+// with the next. The most confident transcript is kept and reports the hint
+// it was made with and the hints tried.
+
+// maxLanguageHints bounds the languages tried for one recording, as each
+// costs a transcription
+const maxLanguageHints = 5
+
+// splitLanguages splits a comma-separated list of languages from a form
+func splitLanguages(value string) []string {
+	var languages []string
+	for _, language := range strings.Split(value, ",") {
+		if language = strings.TrimSpace(language); language != "" {
+			languages = append(languages, language)
+		}
+	}
+	return languages
+}
+
+// languageHints checks the language hints of a request, given as one
+// language or as an ordered list, and returns them: none for detection, or
+// the languages to try in order
+func languageHints(language string, languages []string) ([]string, error) {
+	if language == "auto" {
+		language = ""
+	}
+	if len(languages) == 0 {
+		if language == "" {
+			return nil, nil
+		}
+		return []string{language}, nil
+	}
+	if language != "" {
+		return nil, errors.New("send language or languages, not both")
+	}
+	if len(languages) > maxLanguageHints {
+		return nil, fmt.Errorf("languages lists at most %d languages", maxLanguageHints)
+	}
+	hints := make([]string, 0, len(languages))
+	seen := make(map[string]bool)
+	for _, hint := range languages {
+		if !localePattern.MatchString(hint) {
+			return nil, fmt.Errorf("%q in languages is not a language code such as en", hint)
+		}
+		if key := strings.ToLower(hint); !seen[key] {
+			seen[key] = true
+			hints = append(hints, hint)
+		}
+	}
+	return hints, nil
+}
+
+// transcribeUploadWithLanguages receives an upload into dir, as it may be
+// transcribed more than once or enhanced first, assesses it, enhances it
+// when asked to and transcribes it with the languages
+func transcribeUploadWithLanguages(ctx context.Context, up Upstream, audio *wavUpload, dir string, languages []string, enhance bool) (*TranscriptionResult, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, "upload-*.wav")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = io.Copy(file, audio)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	path, quality := assessAudioFile(ctx, file.Name(), audio.Filename, enhance)
+	if path != file.Name() {
+		defer os.Remove(path)
+	}
+	result, err := transcribeWithLanguages(ctx, languages, func(language string) (*TranscriptionResult, error) {
+		return transcribeFile(ctx, up, path, audio.Filename, language)
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.AudioQuality = quality
+	return result, nil
+}
+
+// transcribeWithLanguages calls transcribe with each language in turn until
+// a transcript is confident enough, and returns the most confident one.
+// Without a list transcribe is called once, with the language if there is
+// one. A backend that reports no confidence keeps the first transcript.
+func transcribeWithLanguages(ctx context.Context, languages []string, transcribe func(language string) (*TranscriptionResult, error)) (*TranscriptionResult, error) {
+	if len(languages) < 2 {
+		language := ""
+		if len(languages) == 1 {
+			language = languages[0]
+		}
+		return transcribe(language)
+	}
+	var best *TranscriptionResult
+	var hint string
+	var tried []string
+	for _, language := range languages {
+		result, err := transcribe(language)
+		if err != nil {
+			return nil, err
+		}
+		tried = append(tried, language)
+		if best == nil || result.Confidence > best.Confidence {
+			best, hint = result, language
+		}
+		if result.Confidence == 0 {
+			logf(ctx, "Language fallback: the backend reports no confidence, keeping %s", hint)
+			break
+		}
+		if result.Confidence >= config.LanguageFallbackConfidence {
+			break
+		}
+		logf(ctx, "Language fallback: confidence %.2f with %s is below %.2f", result.Confidence, language, config.LanguageFallbackConfidence)
+	}
+	best.LanguageHint, best.LanguagesTried = hint, tried
+	return best, nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// isLeaderMetric is 1 on the replica currently running singleton workers
+var isLeaderMetric = expvar.NewInt("leader")
+
+// Singleton background workers, such as alert rule evaluation, must run on
+// exactly one replica. Replicas compete for a lease; only the holder runs
+// them. Without election every replica considers itself the leader, which
+// is correct for a single instance.
+
+// leaderElector acquires and renews leadership
+type leaderElector interface {
+	// tryAcquire acquires or renews the lease and reports whether this
+	// replica holds it
+	tryAcquire() (bool, error)
+}
+
+var leading atomic.Bool
+
+// isLeader reports whether this replica should run singleton workers
+func isLeader() bool {
+	return leading.Load()
+}
+
+func setLeader(leader bool) {
+	if leading.Swap(leader) != leader {
+		if leader {
+			logf(context.Background(), "Acquired leadership as %s", replicaIdentity())
+		} else {
+			logWarnf(context.Background(), "Lost leadership")
+		}
+	}
+	if leader {
+		isLeaderMetric.Set(1)
+	} else {
+		isLeaderMetric.Set(0)
+	}
+}
+
+// runLeaderElection retries the lease every renew interval for the life of
+// the process. Errors cost leadership so two replicas never both lead.
+func runLeaderElection(elector leaderElector, renew time.Duration) {
+	for {
+		leader, err := elector.tryAcquire()
+		if err != nil {
+			logErrorf(context.Background(), "Leader election error: %v", err)
+			leader = false
+		}
+		setLeader(leader)
+		time.Sleep(renew)
+	}
+}
+
+// replicaIdentity names this replica as a lease holder
+func replicaIdentity() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// fileLockElector holds an exclusive flock on a file in a volume shared by
+// all replicas. The lock is released by the kernel if the process dies.
+type fileLockElector struct {
+	path string
+	file *os.File
+}
+
+func (f *fileLockElector) tryAcquire() (bool, error) {
+	if f.file != nil {
+		// Keep the lock file fresh so the retention cleanup never removes it
+		now := time.Now()
+		os.Chtimes(f.path, now, now)
+		return true, nil
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_RDWR, 0o640)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, err
+	}
+	file.Truncate(0)
+	file.WriteString(replicaIdentity() + "\n")
+	f.file = file
+	return true, nil
+}
+
+// kubernetesLeaseElector uses a coordination.k8s.io/v1 Lease through the
+// API server, authenticated with the pod's service account
+type kubernetesLeaseElector struct {
+	endpoint string
+	name     string
+	identity string
+	duration time.Duration
+	client   *http.Client
+}
+
+// serviceAccountDir holds the credentials mounted into every pod
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+func newKubernetesLeaseElector(name, namespace string, duration time.Duration) (*kubernetesLeaseElector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod (KUBERNETES_SERVICE_HOST is unset)")
+	}
+	if _, err := os.Stat(filepath.Join(serviceAccountDir, "token")); err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		ns, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid service account CA certificate")
+	}
+	transport := newEgressTransport(10 * time.Second)
+	transport.TLSClientConfig.RootCAs = pool
+	return &kubernetesLeaseElector{
+		endpoint: fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", net.JoinHostPort(host, port), namespace),
+		name:     name,
+		identity: replicaIdentity(),
+		duration: duration,
+		client:   &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}, nil
+}
+
+// lease is the subset of a Kubernetes Lease used for election
+type lease struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   map[string]any `json:"metadata"`
+	Spec       leaseSpec      `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// leaseTimeFormat is the MicroTime format used by Lease timestamps
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+func (k *kubernetesLeaseElector) tryAcquire() (bool, error) {
+	now := time.Now().UTC()
+	current, status, err := k.do("GET", k.endpoint+"/"+k.name, nil)
+	if status == http.StatusNotFound {
+		l := lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   map[string]any{"name": k.name},
+			Spec: leaseSpec{
+				HolderIdentity:       k.identity,
+				LeaseDurationSeconds: int(k.duration.Seconds()),
+				AcquireTime:          now.Format(leaseTimeFormat),
+				RenewTime:            now.Format(leaseTimeFormat),
+			},
+		}
+		_, status, err = k.do("POST", k.endpoint, &l)
+		if status == http.StatusConflict {
+			// Another replica created it first
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	spec := &current.Spec
+	if spec.HolderIdentity != k.identity {
+		renewed, _ := time.Parse(time.RFC3339Nano, spec.RenewTime)
+		expiry := renewed.Add(time.Duration(spec.LeaseDurationSeconds) * time.Second)
+		if spec.HolderIdentity != "" && now.Before(expiry) {
+			return false, nil
+		}
+		spec.HolderIdentity = k.identity
+		spec.AcquireTime = now.Format(leaseTimeFormat)
+		spec.LeaseTransitions++
+	}
+	spec.LeaseDurationSeconds = int(k.duration.Seconds())
+	spec.RenewTime = now.Format(leaseTimeFormat)
+
+	// metadata.resourceVersion makes the update fail if another replica
+	// changed the lease in the meantime
+	_, status, err = k.do("PUT", k.endpoint+"/"+k.name, current)
+	if status == http.StatusConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// do sends a request to the API server and decodes a Lease response
+func (k *kubernetesLeaseElector) do(method, url string, body *lease) (*lease, int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Projected service account tokens are rotated by the kubelet
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, resp.StatusCode, fmt.Errorf("%s lease: status %d: %s", method, resp.StatusCode, describeBody(string(data)))
+	}
+	var l lease
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, resp.StatusCode, err
+	}
+	return &l, resp.StatusCode, nil
+}
+
+// initLeaderElection starts competing for leadership, or makes this replica
+// the leader when election is disabled
+func initLeaderElection() {
+	var elector leaderElector
+	switch config.LeaderElection {
+	case "":
+		setLeader(true)
+		return
+	case "file":
+		elector = &fileLockElector{path: filepath.Join(config.StorageDir, config.LeaderElectionName+".lock")}
+	case "kubernetes":
+		k, err := newKubernetesLeaseElector(config.LeaderElectionName, config.LeaderElectionNamespace, config.LeaderLeaseDuration)
+		if err != nil {
+			log.Fatalf("Error setting up Kubernetes leader election: %v", err)
+		}
+		elector = k
+	default:
+		log.Fatalf("Unsupported LEADER_ELECTION %q (expected \"kubernetes\" or \"file\")", config.LeaderElection)
+	}
+
+	logf(context.Background(), "Leader election via %s as %s", config.LeaderElection, replicaIdentity())
+	// Renew well within the lease duration so a slow API call does not
+	// let the lease expire
+	go runLeaderElection(elector, config.LeaderLeaseDuration/3)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The lecture pipeline turns a recorded lecture into study material: notes
+// organized by section with the key terms defined, flashcards for spaced
+// repetition, downloadable as a TSV file Anki imports, and a multiple-choice
+// quiz with its answers. Each is also a step of its own, for declared
+// pipelines that only want some of them.
+
+// Lecture material limits
+const (
+	maxFlashcards    = 50
+	maxQuizQuestions = 20
+	maxQuizOptions   = 6
+)
+
+// StudyNotes are the notes of a lecture
+type StudyNotes struct {
+	Overview string        `json:"overview"`
+	Sections []NoteSection `json:"sections"`
+	KeyTerms []KeyTerm     `json:"key_terms,omitempty"`
+}
+
+// NoteSection is one topic of a lecture with its main points
+type NoteSection struct {
+	Heading string   `json:"heading"`
+	Points  []string `json:"points"`
+}
+
+// KeyTerm is a term the lecture defines
+type KeyTerm struct {
+	Term       string `json:"term"`
+	Definition string `json:"definition"`
+}
+
+// Flashcard is a question and answer to memorize
+type Flashcard struct {
+	Front string `json:"front"`
+	Back  string `json:"back"`
+}
+
+// QuizQuestion is a multiple-choice question. Answer is the index of the
+// correct option.
+type QuizQuestion struct {
+	Question    string   `json:"question"`
+	Options     []string `json:"options"`
+	Answer      int      `json:"answer"`
+	Explanation string   `json:"explanation,omitempty"`
+}
+
+// Prompts of the lecture steps, each instructing the LLM to answer with
+// JSON only
+const (
+	studyNotesPrompt = `You write study notes from the transcript of a lecture for a student who missed it. Answer with a JSON object only, without any other text, with the fields:
+- "overview": two or three sentences on what the lecture covered
+- "sections": the topics in the order they were taught, each an object with a "heading" and "points", a list of short sentences with the main facts, arguments and examples
+- "key_terms": the terms the lecture introduced, each an object with the "term" and its "definition"`
+
+	flashcardsPrompt = `You write flashcards for spaced repetition from the transcript of a lecture. Each card tests one fact, definition or idea from the lecture, with a question on the front and a short answer on the back. Answer with a JSON array only, without any other text, of 10 to 30 objects with the fields "front" and "back".`
+
+	quizPrompt = `You write a multiple-choice quiz testing the understanding of a lecture from its transcript. Answer with a JSON array only, without any other text, of 5 to 10 questions, each an object with the fields:
+- "question": the question
+- "options": four possible answers, exactly one of them correct
+- "answer": the index of the correct option, counting from 0
+- "explanation": one sentence on why it is correct, referring to the lecture`
+)
+
+// newLectureRequest builds the chat completion request of a lecture step
+func newLectureRequest(model, prompt, text string) ChatCompletionRequest {
+	return ChatCompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: "system", Content: prompt},
+			{Role: "user", Content: fmt.Sprintf("Transcription:\n\n%s", text)},
+		},
+		Temperature: 0,
+	}
+}
+
+// trimAll trims every string of list and drops the empty ones
+func trimAll(list []string) []string {
+	trimmed := []string{}
+	for _, s := range list {
+		if s = strings.TrimSpace(s); s != "" {
+			trimmed = append(trimmed, s)
+		}
+	}
+	return trimmed
+}
+
+// writeStudyNotes asks the LLM for study notes on a lecture
+func writeStudyNotes(ctx context.Context, up Upstream, text string) (*StudyNotes, error) {
+	var raw StudyNotes
+	if err := llmJSON(ctx, up, newLectureRequest(up.LLMModel, studyNotesPrompt, text), &raw); err != nil {
+		return nil, err
+	}
+	return cleanStudyNotes(raw)
+}
+
+// cleanStudyNotes drops sections without points and terms without a
+// definition
+func cleanStudyNotes(raw StudyNotes) (*StudyNotes, error) {
+	notes := &StudyNotes{Overview: strings.TrimSpace(raw.Overview), Sections: []NoteSection{}}
+	for _, section := range raw.Sections {
+		section.Heading = strings.TrimSpace(section.Heading)
+		if section.Points = trimAll(section.Points); len(section.Points) > 0 {
+			notes.Sections = append(notes.Sections, section)
+		}
+	}
+	for _, term := range raw.KeyTerms {
+		term.Term, term.Definition = strings.TrimSpace(term.Term), strings.TrimSpace(term.Definition)
+		if term.Term != "" && term.Definition != "" {
+			notes.KeyTerms = append(notes.KeyTerms, term)
+		}
+	}
+	if notes.Overview == "" && len(notes.Sections) == 0 {
+		return nil, &UpstreamError{Service: "LLM", Message: "study notes answer is empty"}
+	}
+	return notes, nil
+}
+
+// writeFlashcards asks the LLM for flashcards on a lecture
+func writeFlashcards(ctx context.Context, up Upstream, text string) ([]Flashcard, error) {
+	var raw []Flashcard
+	if err := llmJSON(ctx, up, newLectureRequest(up.LLMModel, flashcardsPrompt, text), &raw); err != nil {
+		return nil, err
+	}
+	return cleanFlashcards(raw), nil
+}
+
+// cleanFlashcards drops cards missing a side and keeps at most
+// maxFlashcards
+func cleanFlashcards(raw []Flashcard) []Flashcard {
+	cards := []Flashcard{}
+	for _, card := range raw {
+		card.Front, card.Back = strings.TrimSpace(card.Front), strings.TrimSpace(card.Back)
+		if card.Front != "" && card.Back != "" && len(cards) < maxFlashcards {
+			cards = append(cards, card)
+		}
+	}
+	return cards
+}
+
+// writeQuiz asks the LLM for a multiple-choice quiz on a lecture
+func writeQuiz(ctx context.Context, up Upstream, text string) ([]QuizQuestion, error) {
+	var raw []QuizQuestion
+	if err := llmJSON(ctx, up, newLectureRequest(up.LLMModel, quizPrompt, text), &raw); err != nil {
+		return nil, err
+	}
+	return cleanQuiz(raw), nil
+}
+
+// cleanQuiz drops questions with fewer than two or more than
+// maxQuizOptions options, repeated options or an answer that is not one of
+// them, and keeps at most maxQuizQuestions
+func cleanQuiz(raw []QuizQuestion) []QuizQuestion {
+	quiz := []QuizQuestion{}
+	for _, q := range raw {
+		q.Question, q.Explanation = strings.TrimSpace(q.Question), strings.TrimSpace(q.Explanation)
+		options := trimAll(q.Options)
+		if q.Question == "" || len(options) != len(q.Options) || len(options) < 2 || len(options) > maxQuizOptions {
+			continue
+		}
+		if q.Answer < 0 || q.Answer >= len(options) || len(quiz) == maxQuizQuestions {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, option := range options {
+			seen[strings.ToLower(option)] = true
+		}
+		if len(seen) != len(options) {
+			continue
+		}
+		q.Options = options
+		quiz = append(quiz, q)
+	}
+	return quiz
+}
+
+// ankiField makes text safe for a field of a tab-separated Anki import
+func ankiField(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// handleFlashcardExport downloads a job's flashcards as a tab-separated
+// file with Anki's import headers: one note per line with the front, the
+// back and a tag naming the lecture, into a deck named after it
+func handleFlashcardExport(w http.ResponseWriter, r *http.Request) {
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !principalFrom(r.Context()).sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	if len(job.Flashcards) == 0 {
+		integrationError(w, http.StatusNotFound, "Transcription has no flashcards")
+		return
+	}
+
+	title := ankiField(jobTitle(job))
+	tag := normalizeTag(title)
+	var tsv strings.Builder
+	tsv.WriteString("#separator:tab\n#html:false\n")
+	fmt.Fprintf(&tsv, "#deck:%s\n", title)
+	tsv.WriteString("#tags column:3\n")
+	for _, card := range job.Flashcards {
+		fmt.Fprintf(&tsv, "%s\t%s\t%s\n", ankiField(card.Front), ankiField(card.Back), tag)
+	}
+	w.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+	setAttachment(w, job.ID+"-flashcards", ".tsv")
+	io.WriteString(w, tsv.String())
+}
+
+// handleStudyNotesExport downloads a job's study notes and quiz as
+// Markdown, with the quiz's answers at the end
+func handleStudyNotesExport(w http.ResponseWriter, r *http.Request) {
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !principalFrom(r.Context()).sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	if job.StudyNotes == nil && len(job.Quiz) == 0 {
+		integrationError(w, http.StatusNotFound, "Transcription has no study notes or quiz")
+		return
+	}
+
+	var doc strings.Builder
+	fmt.Fprintf(&doc, "# %s\n\n", jobTitle(job))
+	if notes := job.StudyNotes; notes != nil {
+		if notes.Overview != "" {
+			fmt.Fprintf(&doc, "%s\n\n", notes.Overview)
+		}
+		for _, section := range notes.Sections {
+			if section.Heading != "" {
+				fmt.Fprintf(&doc, "## %s\n\n", section.Heading)
+			}
+			for _, point := range section.Points {
+				fmt.Fprintf(&doc, "- %s\n", point)
+			}
+			doc.WriteString("\n")
+		}
+		if len(notes.KeyTerms) > 0 {
+			doc.WriteString("## Key terms\n\n")
+			for _, term := range notes.KeyTerms {
+				fmt.Fprintf(&doc, "- **%s**: %s\n", term.Term, term.Definition)
+			}
+			doc.WriteString("\n")
+		}
+	}
+	if len(job.Quiz) > 0 {
+		doc.WriteString("## Quiz\n\n")
+		for i, q := range job.Quiz {
+			fmt.Fprintf(&doc, "%d. %s\n", i+1, q.Question)
+			for j, option := range q.Options {
+				fmt.Fprintf(&doc, "   %c) %s\n", 'a'+j, option)
+			}
+			doc.WriteString("\n")
+		}
+		doc.WriteString("### Answers\n\n")
+		for i, q := range job.Quiz {
+			fmt.Fprintf(&doc, "%d. %c) %s", i+1, 'a'+q.Answer, q.Options[q.Answer])
+			if q.Explanation != "" {
+				fmt.Fprintf(&doc, " – %s", q.Explanation)
+			}
+			doc.WriteString("\n")
+		}
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	setAttachment(w, job.ID+"-study-notes", ".md")
+	io.WriteString(w, doc.String())
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Live transcription shows the text while someone is still speaking. The
+// browser opens a WebSocket to /ws/transcribe and streams the microphone
+// as 16-bit mono PCM. The server cuts the audio into segments at pauses,
+// detected from the loudness of the signal, or every LIVE_SEGMENT_MAX when
+// there is no pause, and sends each segment to the Whisper backend as a
+// short WAV file. Segments are transcribed one after the other, and each
+// is pushed back over the socket as soon as its text is known. With
+// LIVE_FAST_MODEL_NAME, a smaller model meanwhile transcribes the segment
+// being spoken every LIVE_PARTIAL_INTERVAL, and its partial text is
+// replaced by the full model's once the segment ends. Silence is
+// never sent, LIVE_MAX_SESSIONS bounds the sessions of a replica and audio
+// is read no faster than it is spoken, so a GPU serves a known number of
+// speakers.
+//
+// With ?record=true the audio is also written to a WAV file, kept with the
+// transcript in the history.
+//
+// Client messages: binary messages carry audio, a text message
+// {"type": "bookmark", "note": "..."} flags the moment just spoken and
+// {"type": "stop"} ends the session once the audio sent so far has been
+// transcribed. Server messages, like the NDJSON events of /transcribe:
+//
+//	{"type": "partial", "data": {"id": 0, "start": 0, "end": 2, "text": "..."}}
+//	{"type": "segment", "data": {"id": 0, "start": 0, "end": 3.2, "text": "..."}}
+//	{"type": "bookmark", "data": {"time": 12.5, "note": "..."}}
+//	{"type": "error", "data": {"error": "..."}}
+//	{"type": "done", "data": {"id": "...", "text": "...", "language": "en", "duration": 42.5, "bookmarks": [...]}}
+//
+// A segment replaces the partials of the same id, and may have no text
+// when the partials turned out to be noise. The id of done names the
+// transcript in the history, when one was saved, and bookmarks carry the
+// text spoken before each of them.
+
+// Live audio limits
+const (
+	defaultLiveSampleRate = 16000
+	minLiveSampleRate     = 8000
+	maxLiveSampleRate     = 48000
+	// liveMaxMessage bounds one binary message, a second of 48kHz audio
+	// being 96kB
+	liveMaxMessage = 1 << 20
+	// liveIdleTimeout closes sessions whose client stopped sending
+	liveIdleTimeout = 30 * time.Second
+	// liveBacklog is the number of segments waiting to be transcribed
+	// before reading more audio waits for the backend
+	liveBacklog = 4
+	// liveBurst is how far ahead of real time a client may send audio,
+	// catching up after a network stall, before reading it waits
+	liveBurst = 5 * time.Second
+)
+
+// Bookmark limits. A bookmark's text is what was said in the
+// liveBookmarkLookback before it, as people flag a moment once they heard it.
+const (
+	liveMaxBookmarks     = 100
+	maxBookmarkNote      = 500
+	liveBookmarkLookback = 10 * time.Second
+)
+
+// Voice activity detection works on 30 ms frames. A frame whose RMS level
+// is above LIVE_VAD_THRESHOLD (-36 dBFS by default) counts as speech; a
+// segment needs liveMinSpeech of it. Silence before speech is dropped,
+// keeping liveLeadIn of it so the first word is not clipped. Chunking and
+// music detection use the default level, liveSpeechLevel.
+const (
+	liveFrame       = 30 * time.Millisecond
+	liveSpeechLevel = 500
+	liveMinSpeech   = 300 * time.Millisecond
+	liveLeadIn      = 300 * time.Millisecond
+)
+
+// Live transcription metrics exported on /debug/vars
+var (
+	liveSessions         = expvar.NewInt("live_sessions")
+	liveSessionsRejected = expvar.NewInt("live_sessions_rejected_total")
+	liveSegmentsTotal    = expvar.NewInt("live_segments_total")
+	livePartialsTotal    = expvar.NewInt("live_partials_total")
+	liveSilenceSkipped   = expvar.NewFloat("live_silence_skipped_seconds")
+)
+
+// liveSlots counts the sessions running on this replica
+var liveSlots atomic.Int64
+
+// acquireLiveSlot reserves a session within LIVE_MAX_SESSIONS
+func acquireLiveSlot() bool {
+	if n := liveSlots.Add(1); config.LiveMaxSessions > 0 && n > int64(config.LiveMaxSessions) {
+		liveSlots.Add(-1)
+		return false
+	}
+	return true
+}
+
+// liveMessage is a message sent to the client
+type liveMessage struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+// liveRequest is a text message from the client
+type liveRequest struct {
+	Type string `json:"type"`
+	Note string `json:"note"`
+}
+
+// Bookmark is a moment flagged during a live session
+type Bookmark struct {
+	// Time is the position in the session's audio, in seconds
+	Time      float64   `json:"time"`
+	Note      string    `json:"note,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// liveSegment is a stretch of audio cut by the segmenter
+type liveSegment struct {
+	id    int
+	start float64
+	pcm   []byte
+}
+
+// liveSegmenter cuts a stream of 16-bit mono PCM into segments at pauses
+type liveSegmenter struct {
+	sampleRate int
+	frameBytes int
+	// speechLevel is the RMS level of LIVE_VAD_THRESHOLD
+	speechLevel float64
+	// pending holds audio not yet making up a whole frame
+	pending []byte
+	// buf holds the current segment, which starts at offset bytes into
+	// the stream
+	buf    []byte
+	offset int64
+	// speech and silence are the amounts of audio in the segment above
+	// and, since the last speech, below liveSpeechLevel
+	speech  time.Duration
+	silence time.Duration
+	next    int
+	// skipped is the amount of audio dropped as silence, in bytes
+	skipped int64
+}
+
+func newLiveSegmenter(sampleRate int) *liveSegmenter {
+	return &liveSegmenter{
+		sampleRate:  sampleRate,
+		frameBytes:  int(int64(sampleRate)*int64(liveFrame)/int64(time.Second)) * 2,
+		speechLevel: math.MaxInt16 * math.Pow(10, config.LiveVADThreshold/20),
+	}
+}
+
+// bytesFor is the size of d of audio
+func (s *liveSegmenter) bytesFor(d time.Duration) int {
+	return int(int64(s.sampleRate)*int64(d)/int64(time.Second)) * 2
+}
+
+// seconds is the duration of n bytes of audio
+func (s *liveSegmenter) seconds(n int64) float64 {
+	return float64(n) / float64(2*s.sampleRate)
+}
+
+// liveRecorder writes the audio of a session to a WAV file, whose header
+// gets the sizes when it is closed
+type liveRecorder struct {
+	file *os.File
+	size int64
+	// stopped is set once audio could not be written
+	stopped bool
+}
+
+func newLiveRecorder(path string, sampleRate int) (*liveRecorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(pcmToWAV(nil, sampleRate)); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return &liveRecorder{file: file}, nil
+}
+
+// write appends audio. Once the recording would grow past maxUploadSize,
+// like uploads, or a write fails, the rest of the audio is left out.
+func (r *liveRecorder) write(pcm []byte) error {
+	if r.stopped {
+		return nil
+	}
+	if r.size+int64(len(pcm)) > maxUploadSize-44 {
+		r.stopped = true
+		return fmt.Errorf("recording larger than %d MB", maxUploadSize>>20)
+	}
+	n, err := r.file.Write(pcm)
+	r.size += int64(n)
+	r.stopped = err != nil
+	return err
+}
+
+// close completes the WAV header and closes the file
+func (r *liveRecorder) close() error {
+	_, err := r.file.WriteAt(binary.LittleEndian.AppendUint32(nil, uint32(36+r.size)), 4)
+	if err == nil {
+		_, err = r.file.WriteAt(binary.LittleEndian.AppendUint32(nil, uint32(r.size)), 40)
+	}
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// position is the duration of the audio received so far
+func (s *liveSegmenter) position() float64 {
+	return s.seconds(s.offset + int64(len(s.buf)) + int64(len(s.pending)))
+}
+
+// frameLevel returns the RMS level of a frame of samples
+func frameLevel(frame []byte) float64 {
+	var sum float64
+	for i := 0; i+1 < len(frame); i += 2 {
+		v := float64(int16(binary.LittleEndian.Uint16(frame[i:])))
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(frame)/2))
+}
+
+// write adds audio and returns the segments it completes
+func (s *liveSegmenter) write(audio []byte) []liveSegment {
+	var segments []liveSegment
+	s.pending = append(s.pending, audio...)
+	for len(s.pending) >= s.frameBytes {
+		frame := s.pending[:s.frameBytes]
+		s.buf = append(s.buf, frame...)
+		s.pending = s.pending[s.frameBytes:]
+		if frameLevel(frame) >= s.speechLevel {
+			s.speech += liveFrame
+			s.silence = 0
+		} else {
+			s.silence += liveFrame
+		}
+		switch {
+		case s.speech == 0 && len(s.buf) > s.bytesFor(liveLeadIn):
+			// Nothing said yet: keep only the lead-in
+			drop := len(s.buf) - s.bytesFor(liveLeadIn)
+			s.buf = append(s.buf[:0], s.buf[drop:]...)
+			s.offset += int64(drop)
+			s.skipped += int64(drop)
+		case s.speech > 0 && s.silence >= config.LiveSilence, len(s.buf) >= s.bytesFor(config.LiveSegmentMax):
+			if segment, ok := s.cut(); ok {
+				segments = append(segments, segment)
+			}
+		}
+	}
+	s.pending = append([]byte(nil), s.pending...)
+	return segments
+}
+
+// partial returns a copy of the segment being spoken, once it has speech
+func (s *liveSegmenter) partial() (liveSegment, bool) {
+	if s.speech < liveMinSpeech {
+		return liveSegment{}, false
+	}
+	return liveSegment{id: s.next, start: s.seconds(s.offset), pcm: bytes.Clone(s.buf)}, true
+}
+
+// flush returns the rest of the audio as a last segment, if it has speech
+func (s *liveSegmenter) flush() (liveSegment, bool) {
+	s.buf = append(s.buf, s.pending...)
+	s.pending = nil
+	return s.cut()
+}
+
+// cut ends the current segment, returning it unless it is too short to
+// hold any words. The pause that ended it is not sent, but for liveLeadIn
+// of it.
+func (s *liveSegmenter) cut() (liveSegment, bool) {
+	segment := liveSegment{id: s.next, start: s.seconds(s.offset), pcm: s.buf}
+	if trailing := s.bytesFor(s.silence - liveLeadIn); trailing > 0 && trailing < len(s.buf) {
+		segment.pcm = s.buf[:len(s.buf)-trailing]
+		s.skipped += int64(trailing)
+	}
+	hasSpeech := s.speech >= liveMinSpeech
+	s.offset += int64(len(s.buf))
+	s.buf, s.speech, s.silence = nil, 0, 0
+	if !hasSpeech {
+		s.skipped += int64(len(segment.pcm))
+		return liveSegment{}, false
+	}
+	s.next++
+	return segment, true
+}
+
+// roundMillis rounds seconds to milliseconds
+func roundMillis(seconds float64) float64 {
+	return math.Round(seconds*1000) / 1000
+}
+
+// pcmToWAV wraps 16-bit mono PCM in a WAV header
+func pcmToWAV(pcm []byte, sampleRate int) []byte {
+	var b bytes.Buffer
+	b.Grow(44 + len(pcm))
+	b.WriteString("RIFF")
+	b.Write(binary.LittleEndian.AppendUint32(nil, uint32(36+len(pcm))))
+	b.WriteString("WAVEfmt ")
+	// fmt chunk: PCM, one channel, the sample rate, the byte rate, the
+	// block size and 16 bits per sample
+	var format [16]byte
+	binary.LittleEndian.PutUint16(format[0:], 1)
+	binary.LittleEndian.PutUint16(format[2:], 1)
+	binary.LittleEndian.PutUint32(format[4:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(format[8:], uint32(2*sampleRate))
+	binary.LittleEndian.PutUint16(format[12:], 2)
+	binary.LittleEndian.PutUint16(format[14:], 16)
+	b.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(format))))
+	b.Write(format[:])
+	b.WriteString("data")
+	b.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(pcm))))
+	b.Write(pcm)
+	return b.Bytes()
+}
+
+// liveSession is a live transcription in progress
+type liveSession struct {
+	conn       *wsConn
+	up         Upstream
+	workspace  string
+	sampleRate int
+	segments   []Segment
+	bookmarks  []Bookmark
+	duration   float64
+
+	// mu guards what partials share with the transcription of segments:
+	// the language, the segments whose partials were sent and the next
+	// segment without a final
+	mu         sync.Mutex
+	language   string
+	previewed  map[int]bool
+	finalized  int
+	previewing atomic.Bool
+}
+
+// bookmark records a bookmark at the audio position at, in seconds, and
+// confirms it to the client
+func (s *liveSession) bookmark(at float64, note string) {
+	note = strings.TrimSpace(note)
+	switch {
+	case len(s.bookmarks) >= liveMaxBookmarks:
+		s.conn.writeJSON(liveMessage{Type: "error", Data: map[string]string{"error": fmt.Sprintf("A live session can have at most %d bookmarks", liveMaxBookmarks)}})
+		return
+	case utf8.RuneCountInString(note) > maxBookmarkNote:
+		s.conn.writeJSON(liveMessage{Type: "error", Data: map[string]string{"error": fmt.Sprintf("Bookmark notes are limited to %d characters", maxBookmarkNote)}})
+		return
+	}
+	b := Bookmark{Time: roundMillis(at), Note: note, CreatedAt: time.Now().UTC()}
+	s.bookmarks = append(s.bookmarks, b)
+	s.conn.writeJSON(liveMessage{Type: "bookmark", Data: b})
+}
+
+// spokenLanguage returns the session's language, "" until it is known
+func (s *liveSession) spokenLanguage() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.language
+}
+
+// transcribe sends each segment to the backend in turn and pushes the
+// text to the client. A failed segment is reported without ending the
+// session.
+func (s *liveSession) transcribe(ctx context.Context, segments <-chan liveSegment) {
+	for segment := range segments {
+		end := segment.start + float64(len(segment.pcm))/float64(2*s.sampleRate)
+		s.duration = end
+		result, err := transcribeAudio(ctx, s.up, bytes.NewReader(pcmToWAV(segment.pcm, s.sampleRate)), "live.wav", s.spokenLanguage())
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logErrorf(ctx, "Live transcription: segment %d: %v", segment.id, err)
+			msg := "Error calling transcription service"
+			if errors.Is(err, errUpstreamBusy) {
+				msg = "Server is busy, part of the audio was not transcribed"
+			}
+			s.conn.writeJSON(liveMessage{Type: "error", Data: map[string]string{"error": msg}})
+			s.finish(Segment{ID: segment.id, Start: roundMillis(segment.start), End: roundMillis(end)}, "")
+			continue
+		}
+		liveSegmentsTotal.Add(1)
+		recordWorkspaceAudio(s.workspace, end-segment.start)
+		transcribed := Segment{ID: segment.id, Start: roundMillis(segment.start), End: roundMillis(end), Text: strings.TrimSpace(result.Text)}
+		if transcribed.Text != "" {
+			s.segments = append(s.segments, transcribed)
+		}
+		s.finish(transcribed, result.Language)
+	}
+}
+
+// finish sends the final text of a segment, which replaces its partials.
+// A segment without text is only sent to clear partials shown for it.
+func (s *liveSession) finish(segment Segment, language string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Keep the language of the first segment, so that short segments are
+	// not taken for another language
+	if s.language == "" {
+		s.language = language
+	}
+	s.finalized = segment.ID + 1
+	if segment.Text != "" || s.previewed[segment.ID] {
+		s.conn.writeJSON(liveMessage{Type: "segment", Data: segment})
+	}
+	delete(s.previewed, segment.ID)
+}
+
+// preview transcribes a segment with LIVE_FAST_MODEL_NAME in the
+// background and sends its text as a partial, unless its final came first.
+// A session has one partial in progress at most; preview reports whether
+// it started one.
+func (s *liveSession) preview(ctx context.Context, segment liveSegment) bool {
+	if config.LiveFastModel == "" || !s.previewing.CompareAndSwap(false, true) {
+		return false
+	}
+	up := s.up
+	up.AudioModel = config.LiveFastModel
+	language := s.spokenLanguage()
+	go func() {
+		defer s.previewing.Store(false)
+		result, err := transcribeAudio(ctx, up, bytes.NewReader(pcmToWAV(segment.pcm, s.sampleRate)), "live.wav", language)
+		if err != nil {
+			// The final text follows; partials are a best effort
+			if ctx.Err() == nil {
+				logWarnf(ctx, "Live transcription: partial of segment %d: %v", segment.id, err)
+			}
+			return
+		}
+		text := strings.TrimSpace(result.Text)
+		if text == "" {
+			return
+		}
+		end := segment.start + float64(len(segment.pcm))/float64(2*s.sampleRate)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if segment.id < s.finalized {
+			return
+		}
+		livePartialsTotal.Add(1)
+		s.previewed[segment.id] = true
+		s.conn.writeJSON(liveMessage{Type: "partial", Data: Segment{ID: segment.id, Start: roundMillis(segment.start), End: roundMillis(end), Text: text}})
+	}()
+	return true
+}
+
+// handleLiveTranscribe runs a live transcription over a WebSocket.
+// ?language= is the spoken language (default detected from the first
+// segment) and ?sample_rate= the rate of the PCM audio (default 16000).
+func handleLiveTranscribe(w http.ResponseWriter, r *http.Request) {
+	caller, ok := browserPrincipal(w, r)
+	if !ok {
+		return
+	}
+	r = markInteractive(r, caller)
+	if refuseWhileShuttingDown(w, false) || refuseDuringMaintenance(w, false) {
+		return
+	}
+	q := r.URL.Query()
+	sampleRate := defaultLiveSampleRate
+	if value := q.Get("sample_rate"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < minLiveSampleRate || n > maxLiveSampleRate {
+			http.Error(w, fmt.Sprintf("sample_rate must be between %d and %d", minLiveSampleRate, maxLiveSampleRate), http.StatusBadRequest)
+			return
+		}
+		sampleRate = n
+	}
+	if config.LiveMaxBitrate > 0 && sampleRate*16 > config.LiveMaxBitrate*1000 {
+		http.Error(w, fmt.Sprintf("sample_rate must be at most %d", config.LiveMaxBitrate*1000/16), http.StatusBadRequest)
+		return
+	}
+	language := q.Get("language")
+	if language == "auto" {
+		language = ""
+	}
+	record := q.Get("record") == "true"
+	if record && !config.TranscriptHistory {
+		http.Error(w, "Audio can only be recorded with the transcript history enabled", http.StatusBadRequest)
+		return
+	}
+	up, ok := tenantUpstream(w, r, caller.Tenant)
+	if !ok {
+		return
+	}
+	if !acquireLiveSlot() {
+		liveSessionsRejected.Add(1)
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "Too many live transcriptions, please retry later", http.StatusServiceUnavailable)
+		return
+	}
+	defer liveSlots.Add(-1)
+	if _, msg, ok := admitWorkspaceJob(w, caller.Workspace); !ok {
+		http.Error(w, msg, http.StatusTooManyRequests)
+		return
+	}
+
+	conn, err := upgradeWebSocket(w, r, liveMaxMessage)
+	if err != nil {
+		logWarnf(r.Context(), "Live transcription: %v", err)
+		return
+	}
+	liveSessions.Add(1)
+	defer liveSessions.Add(-1)
+	start := time.Now()
+	ends := start.Add(config.LiveMaxDuration)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	session := &liveSession{
+		conn:       conn,
+		up:         up,
+		workspace:  caller.Workspace,
+		sampleRate: sampleRate,
+		language:   language,
+		previewed:  make(map[int]bool),
+	}
+	segments := make(chan liveSegment, liveBacklog)
+	transcribed := make(chan struct{})
+	go func() {
+		session.transcribe(ctx, segments)
+		close(transcribed)
+	}()
+	segmenter := newLiveSegmenter(sampleRate)
+	defer func() { liveSilenceSkipped.Add(segmenter.seconds(segmenter.skipped)) }()
+
+	// The transcript's ID is chosen now, to name the recording
+	id := newID()
+	recording := Job{ID: id, Region: tenantRegion(caller.Tenant)}
+	var recorder *liveRecorder
+	if record {
+		path, err := recordingPath(recording)
+		if err == nil && storageWatchdog.underPressure() {
+			err = errors.New("server storage is nearly full")
+		}
+		if err == nil {
+			recorder, err = newLiveRecorder(path, sampleRate)
+		}
+		if err != nil {
+			logErrorf(ctx, "Live transcription: error recording: %v", err)
+			conn.writeJSON(liveMessage{Type: "error", Data: map[string]string{"error": "The audio cannot be recorded, only the text is kept"}})
+		}
+	}
+	recorded := false
+	defer func() {
+		if recorder != nil {
+			recorder.close()
+		}
+		if record && !recorded {
+			removeRecording(recording)
+		}
+	}()
+	var received int64
+	var lastPartial time.Time
+
+	reason := ""
+	for reason == "" {
+		deadline := time.Now().Add(liveIdleTimeout)
+		if deadline.After(ends) {
+			deadline = ends
+		}
+		conn.setReadDeadline(deadline)
+		opcode, data, err := conn.readMessage()
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			reason = fmt.Sprintf("No audio received for %s", liveIdleTimeout)
+			if !time.Now().Before(ends) {
+				reason = fmt.Sprintf("Live transcriptions are limited to %s", config.LiveMaxDuration)
+			}
+		case err != nil:
+			// The client left or broke the protocol: stop transcribing
+			if !errors.Is(err, errWebSocketClosed) {
+				logWarnf(ctx, "Live transcription: %v", err)
+			}
+			close(segments)
+			cancel()
+			<-transcribed
+			return
+		case opcode == wsBinary:
+			if recorder != nil {
+				// What was recorded before an error is kept
+				if err := recorder.write(data); err != nil {
+					logErrorf(ctx, "Live transcription: error recording: %v", err)
+					conn.writeJSON(liveMessage{Type: "error", Data: map[string]string{"error": "The rest of the audio is not recorded"}})
+				}
+			}
+			for _, segment := range segmenter.write(data) {
+				// A quick partial of the whole segment, while its final
+				// waits for the full model
+				session.preview(ctx, segment)
+				segments <- segment
+			}
+			if time.Since(lastPartial) >= config.LivePartialInterval {
+				if partial, ok := segmenter.partial(); ok && session.preview(ctx, partial) {
+					lastPartial = time.Now()
+				}
+			}
+			// Audio sent faster than it is spoken is read at its pace
+			received += int64(len(data))
+			ahead := time.Duration(segmenter.seconds(received)*float64(time.Second)) - time.Since(start) - liveBurst
+			if ahead > 0 {
+				select {
+				case <-time.After(ahead):
+				case <-ctx.Done():
+				}
+			}
+		default:
+			var msg liveRequest
+			json.Unmarshal(data, &msg)
+			switch msg.Type {
+			case "bookmark":
+				session.bookmark(segmenter.position(), msg.Note)
+			case "stop":
+				reason = "stop"
+			default:
+				conn.writeJSON(liveMessage{Type: "error", Data: map[string]string{"error": `Expected audio, {"type": "bookmark"} or {"type": "stop"}`}})
+			}
+		}
+	}
+
+	if segment, ok := segmenter.flush(); ok {
+		segments <- segment
+	}
+	close(segments)
+	<-transcribed
+	if reason != "stop" {
+		conn.writeJSON(liveMessage{Type: "error", Data: map[string]string{"error": reason}})
+	}
+	session.duration = max(session.duration, segmenter.seconds(segmenter.offset))
+	texts := make([]string, len(session.segments))
+	for i, segment := range session.segments {
+		texts[i] = segment.Text
+	}
+	result := &TranscriptionResult{Text: strings.Join(texts, " "), Language: session.spokenLanguage(), Duration: session.duration, Segments: session.segments}
+	for i := range session.bookmarks {
+		b := &session.bookmarks[i]
+		b.Text = segmentText(session.segments, b.Time-liveBookmarkLookback.Seconds(), b.Time)
+	}
+	done := map[string]any{"text": result.Text, "language": result.Language, "duration": result.Duration}
+	if len(session.bookmarks) > 0 {
+		done["bookmarks"] = session.bookmarks
+	}
+	if config.TranscriptHistory && result.Text != "" {
+		job := transcriptJob(caller, id, "", result, "")
+		job.Bookmarks = session.bookmarks
+		if recorder != nil {
+			err := recorder.close()
+			recorder = nil
+			if err != nil {
+				logErrorf(ctx, "Live transcription: error recording: %v", err)
+			}
+			job.Recorded = err == nil
+		}
+		pipelineJobs.add(job)
+		recorded = job.Recorded
+		done["id"] = id
+		if job.Recorded {
+			done["audio_url"] = "/api/transcripts/" + id + "/audio"
+		}
+	}
+	conn.writeJSON(liveMessage{Type: "done", Data: done})
+	conn.close(wsCloseNormal, "")
+	logf(ctx, "Live transcription: %.1fs of audio in %d segments over %s, %.1fs of silence not sent", session.duration, len(session.segments), time.Since(start).Round(time.Second), segmenter.seconds(segmenter.skipped))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readWAVBytes reads the layout of the WAV file holding data
+func readWAVBytes(t *testing.T, data []byte) *wavAudio {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audio.wav")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	a, err := readWAV(f)
+	if err != nil {
+		t.Fatalf("readWAV: %v", err)
+	}
+	return a
+}
+
+func TestPCMToWAV(t *testing.T) {
+	pcm := make([]byte, 4800)
+	for i := range pcm {
+		pcm[i] = byte(i)
+	}
+	wav := pcmToWAV(pcm, 24000)
+	if len(wav) != 44+len(pcm) {
+		t.Fatalf("WAV is %d bytes, want %d", len(wav), 44+len(pcm))
+	}
+
+	a := readWAVBytes(t, wav)
+	if a.sampleRate != 24000 || a.blockAlign != 2 || !a.pcm16 {
+		t.Errorf("got sample rate %d, block size %d, 16-bit PCM %v; want 24000, 2, true", a.sampleRate, a.blockAlign, a.pcm16)
+	}
+	if a.dataSize != int64(len(pcm)) {
+		t.Fatalf("data is %d bytes, want %d", a.dataSize, len(pcm))
+	}
+	data, err := io.ReadAll(io.NewSectionReader(a.file, a.dataOffset, a.dataSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, pcm) {
+		t.Error("data differs from the PCM written")
+	}
+}
+
+func TestLiveSegmenterCutsAtPauses(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+	config = &Config{}
+	config.LiveSilence = 600 * time.Millisecond
+	config.LiveSegmentMax = 30 * time.Second
+	config.LiveVADThreshold = -36
+
+	s := newLiveSegmenter(16000)
+	speech := make([]byte, s.bytesFor(liveMinSpeech*2))
+	for i := 0; i+1 < len(speech); i += 2 {
+		// A square wave well above liveSpeechLevel
+		v := int16(8000)
+		if i/2%40 < 20 {
+			v = -v
+		}
+		speech[i], speech[i+1] = byte(v), byte(v>>8)
+	}
+	silence := make([]byte, s.bytesFor(config.LiveSilence+liveFrame))
+
+	var segments []liveSegment
+	segments = append(segments, s.write(silence)...)
+	segments = append(segments, s.write(speech)...)
+	segments = append(segments, s.write(silence)...)
+	if len(segments) != 1 {
+		t.Fatalf("got %d segments after speech and a pause, want 1", len(segments))
+	}
+	if segments[0].start <= 0 {
+		t.Errorf("segment starts at %v, want the leading silence dropped", segments[0].start)
+	}
+	if want := len(speech) + 2*s.bytesFor(liveLeadIn); len(segments[0].pcm) > want {
+		t.Errorf("segment is %d bytes, want at most %d with the pause dropped", len(segments[0].pcm), want)
+	}
+	if _, ok := s.flush(); ok {
+		t.Error("flush returned a segment of silence")
+	}
+}
+
+func TestLiveRecorderWritesWAV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recordings", "live.wav")
+	r, err := newLiveRecorder(path, 16000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm := make([]byte, 3200)
+	for i := range pcm {
+		pcm[i] = byte(i)
+	}
+	for _, part := range [][]byte{pcm[:1000], pcm[1000:]} {
+		if err := r.write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, pcmToWAV(pcm, 16000)) {
+		t.Error("recording differs from the WAV of the audio written")
+	}
+}
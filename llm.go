@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Pipeline steps and reports that ask the LLM for something other than a
+// summary go through llmText, or llmJSON when the answer is structured.
+// What the backend answers is logged rather than put into errors, which end
+// up in job records and responses.
+
+// maxLLMResponse bounds the chat completion read from the LLM backend
+const maxLLMResponse = 4 << 20
+
+// llmText sends a chat completion request and returns the answer
+func llmText(ctx context.Context, up Upstream, chatReq ChatCompletionRequest) (string, error) {
+	result, err := llmComplete(ctx, up, chatReq)
+	if err != nil {
+		return "", err
+	}
+	return result.Summary, nil
+}
+
+// llmComplete sends a chat completion request and returns the completion
+func llmComplete(ctx context.Context, up Upstream, chatReq ChatCompletionRequest) (*SummaryResult, error) {
+	jsonData, err := json.Marshal(chatReq)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", up.chatURL(), bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	up.authorizeLLM(req)
+
+	resp, err := llmClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling LLM: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxLLMResponse+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading LLM response: %w", err)
+	}
+	if len(body) > maxLLMResponse {
+		return nil, &UpstreamError{Service: "LLM", Message: fmt.Sprintf("response larger than %d MB", maxLLMResponse>>20)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		logErrorf(ctx, "LLM error (status %d): %s", resp.StatusCode, describeBody(string(body)))
+		return nil, fmt.Errorf("LLM error (status %d)", resp.StatusCode)
+	}
+	result, err := parseChatCompletionResponse(body)
+	if err != nil {
+		logErrorf(ctx, "Invalid LLM response: %v", err)
+		return nil, &UpstreamError{Service: "LLM", Message: "not a chat completion"}
+	}
+	if result.Summary == "" {
+		return nil, errors.New("LLM backend returned an empty completion")
+	}
+	return result, nil
+}
+
+// llmJSON sends a chat completion request asking for JSON and decodes the
+// answer into out
+func llmJSON(ctx context.Context, up Upstream, chatReq ChatCompletionRequest, out any) error {
+	answer, err := llmText(ctx, up, chatReq)
+	if err != nil {
+		return err
+	}
+	return decodeJSONAnswer(ctx, answer, out)
+}
+
+// decodeJSONAnswer decodes an LLM's answer into out. Models often wrap JSON
+// in prose or code fences, so the outermost array or object of the answer
+// is decoded.
+func decodeJSONAnswer(ctx context.Context, answer string, out any) error {
+	start := strings.IndexAny(answer, "[{")
+	end := -1
+	if start >= 0 {
+		closing := "]"
+		if answer[start] == '{' {
+			closing = "}"
+		}
+		end = strings.LastIndex(answer, closing)
+	}
+	if start < 0 || end < start {
+		logErrorf(ctx, "LLM answer is not JSON: %s", describeBody(answer))
+		return &UpstreamError{Service: "LLM", Message: "answer is not JSON"}
+	}
+	if err := json.Unmarshal([]byte(answer[start:end+1]), out); err != nil {
+		logErrorf(ctx, "LLM answer does not decode: %v: %s", err, describeBody(answer))
+		return &UpstreamError{Service: "LLM", Message: "answer is not JSON of the expected shape"}
+	}
+	return nil
+}
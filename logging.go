@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Logs are structured records written through log/slog: JSON lines by
+// default, or key=value text with LOG_FORMAT=text. Messages are logged at
+// an explicit level, through logf, logWarnf or logErrorf, and LOG_LEVEL
+// leaves out the levels below the one set. Every request gets an ID, taken
+// from its X-Request-ID header when it has a usable one and generated
+// otherwise. The ID is sent back in X-Request-ID, passed on to the
+// inference backends and to the background jobs the request starts, and
+// attached to the lines logged while handling it as request_id, so a
+// failure can be followed across the proxy and the backends.
+
+// Log formats
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// requestIDHeader carries request IDs in and out
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern is what a request ID sent by a client or proxy may look
+// like; others are replaced, so IDs are safe to log
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:+=/-]{1,128}$`)
+
+// logger writes the server's log records
+var logger = slog.Default()
+
+// initLogging routes the standard logger, and logf, through a structured
+// handler. Everything is written until the settings are applied.
+func initLogging() {
+	opts := &slog.HandlerOptions{Level: settingsLevel{}}
+	if config.LogFormat == logFormatText {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	} else {
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	log.SetFlags(0)
+	log.SetOutput(standardLogWriter{})
+}
+
+// settingsLevel is the least severe level written: that of the log level
+// setting once the log filter is installed, and everything before
+type settingsLevel struct{}
+
+func (settingsLevel) Level() slog.Level {
+	if !logFilterInstalled.Load() {
+		return slog.LevelInfo
+	}
+	switch level, _ := logLevel.Load().(string); level {
+	case logLevelWarn:
+		return slog.LevelWarn
+	case logLevelError:
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// validLogFormat reports whether format is a log format
+func validLogFormat(format string) bool {
+	return format == logFormatJSON || format == logFormatText
+}
+
+// logf logs an informational message like log.Printf, with the ID of the
+// request ctx belongs to
+func logf(ctx context.Context, format string, args ...any) {
+	logAt(ctx, slog.LevelInfo, format, args...)
+}
+
+// logWarnf logs a warning like logf
+func logWarnf(ctx context.Context, format string, args ...any) {
+	logAt(ctx, slog.LevelWarn, format, args...)
+}
+
+// logErrorf logs an error like logf
+func logErrorf(ctx context.Context, format string, args ...any) {
+	logAt(ctx, slog.LevelError, format, args...)
+}
+
+// logAt logs a message at level, with the ID of the request ctx belongs to
+func logAt(ctx context.Context, level slog.Level, format string, args ...any) {
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if id := requestIDFrom(ctx); id != "" {
+		logger.Log(ctx, level, msg, "request_id", id)
+		return
+	}
+	logger.Log(ctx, level, msg)
+}
+
+// standardLogWriter turns the lines of the standard logger into records.
+// The server logs through logf and its kin; what is left on the standard
+// logger, such as log.Fatal and the errors of net/http, is logged as an
+// error.
+type standardLogWriter struct{}
+
+func (standardLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	logger.Log(context.Background(), slog.LevelError, msg)
+	return len(p), nil
+}
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// withRequestIDContext returns ctx carrying the request ID id
+func withRequestIDContext(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID ctx carries, "" without one
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID gives every request an ID and returns it in X-Request-ID
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(withRequestIDContext(r.Context(), id)))
+	})
+}
+
+// requestIDTransport passes the request ID on to the backends
+type requestIDTransport struct {
+	next http.RoundTripper
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := requestIDFrom(req.Context()); id != "" && req.Header.Get(requestIDHeader) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(requestIDHeader, id)
+	}
+	return t.next.RoundTrip(req)
+}
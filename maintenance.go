@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Maintenance mode covers backend upgrades without raw 502s. An admin turns
+// it on with PUT /admin/v1/maintenance; every replica picks it up from the
+// state store within maintenanceCacheTTL. In "queue" mode background jobs
+// are still accepted but wait, queued, until maintenance ends, and jobs in
+// progress pause before their next backend call. In "reject" mode they are
+// refused too. Requests answered synchronously (/transcribe, /summarize and
+// /memo) cannot wait that long and are always refused, with 503, the
+// admin's message and a Retry-After derived from the expected end.
+
+// Maintenance modes
+const (
+	maintenanceQueue  = "queue"
+	maintenanceReject = "reject"
+)
+
+// maintenanceKey holds the maintenance state in the state store
+const maintenanceKey = "maintenance"
+
+// maintenanceCacheTTL is how long a replica reuses the state it read
+const maintenanceCacheTTL = 2 * time.Second
+
+// maintenancePollInterval is how often queued jobs check whether
+// maintenance has ended
+const maintenancePollInterval = 5 * time.Second
+
+// defaultMaintenanceRetry is the Retry-After without an expected end
+const defaultMaintenanceRetry = 5 * time.Minute
+
+// Maintenance is the maintenance state set by an admin
+type Maintenance struct {
+	Enabled bool   `json:"enabled"`
+	Mode    string `json:"mode,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Until is when maintenance is expected to end; it does not end it
+	Until     *time.Time `json:"until,omitempty"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+}
+
+// maintenanceRequest is the body of PUT /admin/v1/maintenance
+type maintenanceRequest struct {
+	Mode    string `json:"mode"`
+	Message string `json:"message"`
+	// Either an expected end or how long maintenance should take
+	Until    *time.Time `json:"until"`
+	Duration string     `json:"duration"`
+}
+
+var maintenanceCache struct {
+	sync.Mutex
+	value   Maintenance
+	expires time.Time
+}
+
+// currentMaintenance returns the maintenance state, cached briefly.
+// Errors reading the state store leave maintenance off.
+func currentMaintenance() Maintenance {
+	maintenanceCache.Lock()
+	defer maintenanceCache.Unlock()
+	if time.Now().Before(maintenanceCache.expires) {
+		return maintenanceCache.value
+	}
+	var m Maintenance
+	data, ok, err := state.get(maintenanceKey)
+	if err != nil {
+		logErrorf(context.Background(), "Error reading maintenance state: %v", err)
+	} else if ok {
+		if err := json.Unmarshal(data, &m); err != nil {
+			logErrorf(context.Background(), "Error decoding maintenance state: %v", err)
+		}
+	}
+	maintenanceCache.value = m
+	maintenanceCache.expires = time.Now().Add(maintenanceCacheTTL)
+	return m
+}
+
+// setMaintenance stores the maintenance state for all replicas
+func setMaintenance(m Maintenance) error {
+	var err error
+	if m.Enabled {
+		var data []byte
+		if data, err = json.Marshal(m); err == nil {
+			err = state.set(maintenanceKey, data, 0)
+		}
+	} else {
+		err = state.delete(maintenanceKey)
+	}
+	if err != nil {
+		return err
+	}
+	maintenanceCache.Lock()
+	maintenanceCache.value, maintenanceCache.expires = m, time.Now().Add(maintenanceCacheTTL)
+	maintenanceCache.Unlock()
+	return nil
+}
+
+// notice is the message shown to clients
+func (m Maintenance) notice() string {
+	msg := "The service is under maintenance"
+	if m.Until != nil && m.Until.After(time.Now()) {
+		msg += fmt.Sprintf(" until about %s", m.Until.UTC().Format("15:04 MST"))
+	}
+	msg += ", please try again later."
+	if m.Message != "" {
+		msg += " " + m.Message
+	}
+	return msg
+}
+
+// retryAfter returns the seconds until the expected end
+func (m Maintenance) retryAfter() string {
+	wait := defaultMaintenanceRetry
+	if m.Until != nil {
+		wait = max(time.Until(*m.Until), time.Minute)
+	}
+	return strconv.Itoa(int(wait.Seconds()))
+}
+
+// refuseDuringMaintenance answers 503 to a synchronous request while in
+// maintenance
+func refuseDuringMaintenance(w http.ResponseWriter, integration bool) bool {
+	m := currentMaintenance()
+	if !m.Enabled {
+		return false
+	}
+	w.Header().Set("Retry-After", m.retryAfter())
+	if integration {
+		integrationError(w, http.StatusServiceUnavailable, m.notice())
+	} else {
+		http.Error(w, m.notice(), http.StatusServiceUnavailable)
+	}
+	return true
+}
+
+// refuseJobDuringMaintenance answers 503 to a new background job in
+// reject mode
+func refuseJobDuringMaintenance(w http.ResponseWriter, integration bool) bool {
+	m := currentMaintenance()
+	if !m.Enabled || m.Mode != maintenanceReject {
+		return false
+	}
+	w.Header().Set("Retry-After", m.retryAfter())
+	if integration {
+		integrationError(w, http.StatusServiceUnavailable, m.notice())
+	} else {
+		http.Error(w, m.notice(), http.StatusServiceUnavailable)
+	}
+	return true
+}
+
+// maintenanceWaitingJobs counts the background jobs waiting for
+// maintenance to end
+var maintenanceWaitingJobs = expvar.NewInt("maintenance_waiting_jobs")
+
+// waitForMaintenance blocks a background job until maintenance ends
+func waitForMaintenance(ctx context.Context, jobID string) error {
+	if !currentMaintenance().Enabled {
+		return nil
+	}
+	logf(ctx, "Job %s: waiting for maintenance to end", jobID)
+	maintenanceWaitingJobs.Add(1)
+	defer maintenanceWaitingJobs.Add(-1)
+	defer stageTimerFrom(ctx).since(stageQueue, time.Now())
+	ticker := time.NewTicker(maintenancePollInterval)
+	defer ticker.Stop()
+	for currentMaintenance().Enabled {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	logf(ctx, "Job %s: maintenance ended, resuming", jobID)
+	return nil
+}
+
+// handleMaintenanceGet shows the maintenance state
+func handleMaintenanceGet(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentMaintenance())
+}
+
+// startMaintenance turns maintenance mode on as requested, or updates it.
+// It returns a message for the admin when the request is invalid.
+func startMaintenance(req maintenanceRequest) (Maintenance, string, error) {
+	if req.Mode == "" {
+		req.Mode = maintenanceQueue
+	}
+	if req.Mode != maintenanceQueue && req.Mode != maintenanceReject {
+		return Maintenance{}, "mode must be queue or reject", nil
+	}
+	m := Maintenance{Enabled: true, Mode: req.Mode, Message: req.Message, Until: req.Until}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 || req.Until != nil {
+			return Maintenance{}, "duration must be a positive duration such as 30m, and cannot be combined with until", nil
+		}
+		until := time.Now().Add(d).UTC().Truncate(time.Second)
+		m.Until = &until
+	}
+	now := time.Now().UTC()
+	m.StartedAt = &now
+	if previous := currentMaintenance(); previous.Enabled {
+		m.StartedAt = previous.StartedAt
+	}
+	if err := setMaintenance(m); err != nil {
+		return Maintenance{}, "", err
+	}
+	logf(context.Background(), "Maintenance mode on (%s)", m.Mode)
+	return m, "", nil
+}
+
+// handleMaintenancePut turns maintenance mode on or updates it
+func handleMaintenancePut(w http.ResponseWriter, r *http.Request) {
+	var req maintenanceRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&req); err != nil {
+		integrationError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	m, msg, err := startMaintenance(req)
+	if err != nil {
+		logErrorf(r.Context(), "Error saving maintenance state: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error saving maintenance state")
+		return
+	}
+	if msg != "" {
+		integrationError(w, http.StatusBadRequest, msg)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// endMaintenance turns maintenance mode off; queued jobs resume
+func endMaintenance() error {
+	if err := setMaintenance(Maintenance{}); err != nil {
+		return err
+	}
+	logf(context.Background(), "Maintenance mode off")
+	return nil
+}
+
+// handleMaintenanceDelete ends maintenance mode
+func handleMaintenanceDelete(w http.ResponseWriter, r *http.Request) {
+	if err := endMaintenance(); err != nil {
+		logErrorf(r.Context(), "Error saving maintenance state: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error saving maintenance state")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Memory budget metrics exported on /debug/vars
+var (
+	memoryBudgetBytes    = expvar.NewInt("memory_budget_bytes")
+	memoryInUseBytes     = expvar.NewInt("memory_in_use_bytes")
+	memoryQueuedRequests = expvar.NewInt("memory_queued_requests")
+	memoryRejected       = expvar.NewInt("memory_rejected_requests_total")
+)
+
+// errMemoryBudgetExceeded is returned when a request cannot fit in the budget
+var errMemoryBudgetExceeded = errors.New("memory budget exceeded")
+
+// uploadBufferEstimate is the memory reserved for a streamed upload: pipe and
+// copy buffers plus multipart bookkeeping, not the file itself
+const uploadBufferEstimate = 256 << 10
+
+// unknownBodyEstimate is reserved for request bodies without Content-Length
+const unknownBodyEstimate = 1 << 20
+
+// memoryBudget accounts for bytes buffered by in-flight requests. Requests
+// are admitted with an up-front reservation and queue until it fits; bytes
+// read beyond the reservation are charged as they arrive.
+type memoryBudget struct {
+	limit        int64
+	queueTimeout time.Duration
+
+	mu      sync.Mutex
+	used    int64
+	changed chan struct{}
+}
+
+var requestMemory *memoryBudget
+
+func newMemoryBudget(limit int64, queueTimeout time.Duration) *memoryBudget {
+	memoryBudgetBytes.Set(limit)
+	return &memoryBudget{limit: limit, queueTimeout: queueTimeout, changed: make(chan struct{})}
+}
+
+// memoryLease is the share of the budget held by one request
+type memoryLease struct {
+	budget *memoryBudget
+	mu     sync.Mutex
+	size   int64
+	// unspent is the part of the reservation not yet consumed by readers
+	unspent int64
+}
+
+// admit reserves n bytes, waiting up to the queue timeout for room
+func (b *memoryBudget) admit(ctx context.Context, n int64) (*memoryLease, error) {
+	if b.limit > 0 && n > b.limit {
+		memoryRejected.Add(1)
+		return nil, errMemoryBudgetExceeded
+	}
+
+	var deadline <-chan time.Time
+	queued := false
+	defer func() {
+		if queued {
+			memoryQueuedRequests.Add(-1)
+		}
+	}()
+
+	for {
+		b.mu.Lock()
+		if b.limit == 0 || b.used+n <= b.limit {
+			b.used += n
+			memoryInUseBytes.Set(b.used)
+			b.mu.Unlock()
+			return &memoryLease{budget: b, size: n, unspent: n}, nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		if !queued {
+			queued = true
+			memoryQueuedRequests.Add(1)
+			timer := time.NewTimer(b.queueTimeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			memoryRejected.Add(1)
+			return nil, errMemoryBudgetExceeded
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// tryAdmit reserves n bytes only if they fit right away, for requests that
+// would rather fail than queue
+func (b *memoryBudget) tryAdmit(n int64) (*memoryLease, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.used+n > b.limit {
+		memoryRejected.Add(1)
+		return nil, errMemoryBudgetExceeded
+	}
+	b.used += n
+	memoryInUseBytes.Set(b.used)
+	return &memoryLease{budget: b, size: n, unspent: n}, nil
+}
+
+// grow charges n more bytes to the lease without waiting
+func (l *memoryLease) grow(n int64) error {
+	b := l.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.used+n > b.limit {
+		return errMemoryBudgetExceeded
+	}
+	b.used += n
+	memoryInUseBytes.Set(b.used)
+	l.mu.Lock()
+	l.size += n
+	l.mu.Unlock()
+	return nil
+}
+
+// release returns the whole lease to the budget and wakes queued requests
+func (l *memoryLease) release() {
+	l.mu.Lock()
+	n := l.size
+	l.size = 0
+	l.mu.Unlock()
+
+	b := l.budget
+	b.mu.Lock()
+	b.used -= n
+	memoryInUseBytes.Set(b.used)
+	close(b.changed)
+	b.changed = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// reader counts bytes read from r against the lease. Bytes are first
+// taken from the reservation; anything beyond is charged as it is read.
+func (l *memoryLease) reader(r io.Reader) io.Reader {
+	return &countingReader{r: r, lease: l}
+}
+
+type countingReader struct {
+	r     io.Reader
+	lease *memoryLease
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		if cerr := c.lease.consume(int64(n)); cerr != nil {
+			return n, cerr
+		}
+	}
+	return n, err
+}
+
+// consume spends n bytes of the reservation, growing the lease if needed
+func (l *memoryLease) consume(n int64) error {
+	l.mu.Lock()
+	covered := min(n, l.unspent)
+	l.unspent -= covered
+	l.mu.Unlock()
+	if over := n - covered; over > 0 {
+		return l.grow(over)
+	}
+	return nil
+}
+
+// bodyEstimate is the reservation used when admitting a request body
+func bodyEstimate(contentLength int64) int64 {
+	if contentLength > 0 {
+		return contentLength
+	}
+	return unknownBodyEstimate
+}
+
+// admitRequest reserves n bytes for the request, answering 503 with a
+// Retry-After hint when the budget stays exhausted for the queue timeout
+func admitRequest(w http.ResponseWriter, r *http.Request, n int64) (*memoryLease, bool) {
+	start := time.Now()
+	lease, err := requestMemory.admit(r.Context(), n)
+	stageTimerFrom(r.Context()).since(stageQueue, start)
+	if err != nil {
+		logWarnf(r.Context(), "Request rejected: %v", err)
+		w.Header().Set("Retry-After", strconv.Itoa(int(requestMemory.queueTimeout.Seconds())))
+		http.Error(w, "Server is busy, please retry later", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return lease, true
+}
+
+// initMemoryBudget creates the global budget from the configuration
+func initMemoryBudget() {
+	requestMemory = newMemoryBudget(config.MemoryBudget, config.MemoryQueueTimeout)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Voice notes are short and someone is waiting for the text. POST /memo
+// buffers the clip in memory, fails fast instead of queueing when the server
+// is busy, and can use faster models than full transcriptions
+// (MEMO_AUDIO_MODEL_NAME, MEMO_LLM_MODEL_NAME). The one-line summary is
+// best effort: when it fails or runs out of time the text is returned alone.
+
+// maxMemoSize caps a memo upload; 60 seconds of 48kHz 16-bit stereo audio
+// is about 11MB
+const maxMemoSize = 16 << 20
+
+// MemoResult is the response of POST /memo
+type MemoResult struct {
+	Text     string  `json:"text"`
+	Language string  `json:"language,omitempty"`
+	Duration float64 `json:"duration"`
+	Summary  string  `json:"summary,omitempty"`
+	Timing   *Timing `json:"timing,omitempty"`
+	// LanguageHint and LanguagesTried report a list of languages, as in
+	// TranscriptionResult
+	LanguageHint   string   `json:"language_hint,omitempty"`
+	LanguagesTried []string `json:"languages_tried,omitempty"`
+	// AudioQuality is the assessment of the recording
+	AudioQuality *AudioQuality `json:"audio_quality,omitempty"`
+	// QuotaWarnings are set when the caller's workspace nearly used up
+	// a quota
+	QuotaWarnings []QuotaWarning `json:"quota_warnings,omitempty"`
+}
+
+// wavDuration reads the duration in seconds from a WAV file's fmt and data
+// chunks
+func wavDuration(data []byte) (float64, error) {
+	var byteRate uint32
+	var duration float64
+	found, err := walkWAV(bytes.NewReader(data), int64(len(data)), func(id string, body, length int64) (bool, error) {
+		switch id {
+		case "fmt ":
+			byteRate = binary.LittleEndian.Uint32(data[body+8:])
+		case "data":
+			if byteRate == 0 {
+				return false, errors.New("data chunk before a valid fmt chunk")
+			}
+			// Recorders that stream sometimes leave the size unset
+			duration = float64(min(length, int64(len(data))-body)) / float64(byteRate)
+			return true, nil
+		}
+		return false, nil
+	})
+	if err == nil && !found {
+		err = errors.New("no data chunk")
+	}
+	return duration, err
+}
+
+// newMemoSummaryRequest asks for a one-line summary of a voice note
+func newMemoSummaryRequest(model, text string) ChatCompletionRequest {
+	return ChatCompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{
+				Role:    "system",
+				Content: "You summarize voice notes. Answer with a single sentence of at most 20 words and nothing else.",
+			},
+			{
+				Role:    "user",
+				Content: text,
+			},
+		},
+		Temperature: 0.2,
+	}
+}
+
+// summarizeMemo asks the LLM API for a one-line summary of a memo
+func summarizeMemo(ctx context.Context, up Upstream, text string) (string, error) {
+	answer, err := llmText(ctx, up, newMemoSummaryRequest(up.LLMModel, text))
+	if err != nil {
+		return "", err
+	}
+	summary := oneLine(answer)
+	if summary == "" {
+		return "", errors.New("LLM backend returned an empty completion")
+	}
+	return summary, nil
+}
+
+// handleMemo transcribes a short voice note synchronously, optionally with a
+// one-line summary (form field summary=true)
+func handleMemo(w http.ResponseWriter, r *http.Request) {
+	job, ok := startInteractiveJob(w, r, "memo", false)
+	if !ok {
+		return
+	}
+	defer job.finish()
+	w, r = job, job.r
+	timer, caller, up, warnings := job.timer, job.caller, job.up, job.warnings
+	if config.MemoAudioModel != "" {
+		up.AudioModel = config.MemoAudioModel
+	}
+	if config.MemoLLMModel != "" {
+		up.LLMModel = config.MemoLLMModel
+	}
+
+	// Memos are answered right away or not at all
+	lease, err := requestMemory.tryAdmit(bodyEstimate(min(r.ContentLength, maxMemoSize)))
+	if err != nil {
+		logWarnf(r.Context(), "Memo rejected: %v", err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Server is busy, please retry later", http.StatusServiceUnavailable)
+		return
+	}
+	defer lease.release()
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.MemoTimeout)
+	defer cancel()
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxMemoSize)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		logErrorf(ctx, "Error parsing form: %v", err)
+		http.Error(w, "Error parsing form data", http.StatusBadRequest)
+		return
+	}
+	fields := make(map[string]string)
+	var filename string
+	var audio []byte
+	uploadStart := time.Now()
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			if part.FormName() == "file" {
+				filename = cleanFilename(part.FileName())
+				audio, err = io.ReadAll(lease.reader(part))
+			} else {
+				err = readFormField(part, fields)
+			}
+		}
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			switch {
+			case errors.As(err, &maxBytesErr):
+				http.Error(w, "Memo too large, use /transcribe for long recordings", http.StatusRequestEntityTooLarge)
+			case errors.Is(err, errMemoryBudgetExceeded):
+				http.Error(w, "Server is busy, please retry later", http.StatusServiceUnavailable)
+			default:
+				logErrorf(ctx, "Error parsing form: %v", err)
+				http.Error(w, "Error parsing form data", http.StatusBadRequest)
+			}
+			return
+		}
+	}
+	timer.since(stageUpload, uploadStart)
+	if audio == nil {
+		http.Error(w, "Error getting file from form", http.StatusBadRequest)
+		return
+	}
+	prepStart := time.Now()
+	duration, err := wavDuration(audio)
+	timer.since(stagePreprocess, prepStart)
+	if err != nil {
+		http.Error(w, "Only WAV files are supported", http.StatusBadRequest)
+		return
+	}
+	if duration > config.MemoMaxDuration.Seconds() {
+		http.Error(w, fmt.Sprintf("Memos are limited to %s, use /transcribe for longer recordings", config.MemoMaxDuration), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if filename == "" {
+		filename = "memo.wav"
+	}
+	languages, err := languageHints(fields["language"], splitLanguages(fields["languages"]))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job.create(map[string]any{"filename": filename})
+
+	start := time.Now()
+	result, err := transcribeWithLanguages(ctx, languages, func(language string) (*TranscriptionResult, error) {
+		return transcribeAudio(ctx, up, bytes.NewReader(audio), filename, language)
+	})
+	if err != nil {
+		logErrorf(ctx, "Memo %s: %v", job.id, err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			http.Error(w, "Transcription service timed out", http.StatusGatewayTimeout)
+			return
+		}
+		if upstreamBusy(w, err) {
+			return
+		}
+		http.Error(w, "Error calling transcription service", http.StatusBadGateway)
+		return
+	}
+	recordWorkspaceAudio(caller.Workspace, result.Duration)
+	publishTranscriptCompleted(job.id, filename, result)
+
+	memo := MemoResult{Text: result.Text, Language: result.Language, LanguageHint: result.LanguageHint, LanguagesTried: result.LanguagesTried, Duration: result.Duration}
+	if memo.AudioQuality, err = measureAudio(bytes.NewReader(audio)); err == nil {
+		logQuality(ctx, "Memo "+job.id, memo.AudioQuality)
+	}
+	if memo.Duration == 0 {
+		memo.Duration = duration
+	}
+	if fields["summary"] == "true" && strings.TrimSpace(result.Text) != "" {
+		if memo.Summary, err = summarizeMemo(ctx, up, result.Text); err != nil {
+			logWarnf(ctx, "Memo %s: summary skipped: %v", job.id, err)
+		}
+	}
+	saved := *result
+	saved.Duration = memo.Duration
+	saveTranscript(caller, job.id, filename, &saved, memo.Summary)
+	logf(ctx, "Memo %s: %.1fs of audio answered in %s", job.id, memo.Duration, time.Since(start).Round(time.Millisecond))
+	memo.Timing = timer.timing()
+	memo.QuotaWarnings = warnings
+	writeJSON(w, http.StatusOK, memo)
+}
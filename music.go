@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// Recorded calls open with hold music and podcasts with intros, and Whisper
+// turns music into invented lyrics or repeated phrases. With
+// MUSIC_SKIPPING=true, recordings on disk are therefore scanned for long
+// stretches of music before they are transcribed. Music is told from speech
+// by its lack of pauses and its steady loudness and timbre: speech stops
+// between phrases, rises and falls with every syllable, and alternates
+// voiced sounds with hissing ones. Stretches of at least MUSIC_MIN_DURATION
+// are left out of the audio sent to the backend and marked with a "[music]"
+// segment at their place in the transcript.
+
+// musicMarker is the text of the segments marking music
+const musicMarker = "[music]"
+
+// Limits within which a window of audio sounds like music rather than speech
+const (
+	// musicWindow is the length of the windows audio is judged in
+	musicWindow = time.Second
+	// musicMaxPauses is the share of quiet frames above which a window
+	// holds pauses
+	musicMaxPauses = 0.1
+	// musicLevelSpread is the standard deviation of frame levels in dB
+	// below which loudness is steady
+	musicLevelSpread = 4.0
+	// musicZCRSpread is the relative standard deviation of frames' zero
+	// crossing rates below which timbre is steady
+	musicZCRSpread = 0.5
+	// musicGapWindows is the number of windows that do not sound like
+	// music a stretch of music may hold, as in a drum break
+	musicGapWindows = 1
+	// musicEdge is the shortest audio left between music, or at either
+	// end of the recording, worth transcribing
+	musicEdge = time.Second
+)
+
+// musicWindowStats gathers the frames of a window
+type musicWindowStats struct {
+	frames, quiet int
+	// levels and crossings are those of the frames with sound
+	levels, crossings []float64
+}
+
+// add measures a frame of 16-bit PCM audio
+func (s *musicWindowStats) add(frame []byte, blockAlign int) {
+	s.frames++
+	rms := frameLevel(frame)
+	if rms < liveSpeechLevel {
+		s.quiet++
+		return
+	}
+	s.levels = append(s.levels, 20*math.Log10(rms))
+	s.crossings = append(s.crossings, zeroCrossingRate(frame, blockAlign))
+}
+
+// music reports whether the window sounds like music
+func (s *musicWindowStats) music() bool {
+	if len(s.levels) == 0 || float64(s.quiet) > musicMaxPauses*float64(s.frames) {
+		return false
+	}
+	_, levelSpread := meanDeviation(s.levels)
+	crossings, crossingSpread := meanDeviation(s.crossings)
+	return levelSpread < musicLevelSpread && crossings > 0 && crossingSpread/crossings < musicZCRSpread
+}
+
+// reset empties the window, keeping its buffers
+func (s *musicWindowStats) reset() {
+	s.frames, s.quiet = 0, 0
+	s.levels, s.crossings = s.levels[:0], s.crossings[:0]
+}
+
+// zeroCrossingRate is the share of consecutive samples of the first channel
+// of a frame whose sign differs
+func zeroCrossingRate(frame []byte, blockAlign int) float64 {
+	var crossings, pairs int
+	previous := int16(0)
+	for i := 0; i+1 < len(frame); i += blockAlign {
+		v := int16(binary.LittleEndian.Uint16(frame[i:]))
+		if i > 0 {
+			pairs++
+			if (v < 0) != (previous < 0) {
+				crossings++
+			}
+		}
+		previous = v
+	}
+	if pairs == 0 {
+		return 0
+	}
+	return float64(crossings) / float64(pairs)
+}
+
+// meanDeviation returns the mean and standard deviation of values
+func meanDeviation(values []float64) (float64, float64) {
+	var sum, squares float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(values)))
+}
+
+// findMusic returns the stretches of music of at least MUSIC_MIN_DURATION
+// in 16-bit PCM audio, in order
+func findMusic(audio *wavAudio) ([]audioSpan, error) {
+	frameBytes := max(audio.bytesFor(liveFrame), int64(audio.blockAlign))
+	windowFrames := int(musicWindow / liveFrame)
+	windowBytes := frameBytes * int64(windowFrames)
+
+	// Judge every whole window of the audio
+	var windows []bool
+	var stats musicWindowStats
+	frame := make([]byte, frameBytes)
+	r := bufio.NewReaderSize(io.NewSectionReader(audio.file, audio.dataOffset, audio.dataSize), 64<<10)
+	for {
+		if _, err := io.ReadFull(r, frame); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		stats.add(frame, audio.blockAlign)
+		if stats.frames == windowFrames {
+			windows = append(windows, stats.music())
+			stats.reset()
+		}
+	}
+
+	// Join runs of music windows across short gaps, keeping long ones
+	minWindows := int(math.Ceil(float64(config.MusicMinDuration) / float64(time.Duration(windowFrames)*liveFrame)))
+	var music []audioSpan
+	for i := 0; i < len(windows); {
+		if !windows[i] {
+			i++
+			continue
+		}
+		end := i + 1
+		for j := end; j < len(windows) && j-end < musicGapWindows+1; j++ {
+			if windows[j] {
+				end = j + 1
+			}
+		}
+		if end-i >= minWindows {
+			music = append(music, audioSpan{int64(i) * windowBytes, min(int64(end)*windowBytes, audio.dataSize)})
+		}
+		i = end
+	}
+
+	// Audio too short to transcribe between music, or before or after it,
+	// counts as music
+	edge := audio.bytesFor(musicEdge)
+	var joined []audioSpan
+	for _, stretch := range music {
+		if stretch.start < edge {
+			stretch.start = 0
+		}
+		if audio.dataSize-stretch.end < edge {
+			stretch.end = audio.dataSize
+		}
+		if n := len(joined); n > 0 && stretch.start-joined[n-1].end < edge {
+			joined[n-1].end = stretch.end
+			continue
+		}
+		joined = append(joined, stretch)
+	}
+	return joined, nil
+}
+
+// musicToSkip returns the music in the audio left out of its transcript,
+// none without MUSIC_SKIPPING
+func musicToSkip(ctx context.Context, audio *wavAudio, filename string) []audioSpan {
+	if !config.MusicSkipping {
+		return nil
+	}
+	start := time.Now()
+	music, err := findMusic(audio)
+	stageTimerFrom(ctx).since(stagePreprocess, start)
+	if err != nil {
+		logErrorf(ctx, "Error looking for music in %s: %v", filename, err)
+		return nil
+	}
+	if len(music) > 0 {
+		var skipped int64
+		for _, stretch := range music {
+			skipped += stretch.end - stretch.start
+		}
+		logf(ctx, "Skipping %d stretches of music (%.0fs) in %s", len(music), audio.seconds(skipped), filename)
+	}
+	return music
+}
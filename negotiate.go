@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Transcript endpoints answer in the format the client asks for, so a curl
+// pipeline can take the text or captions without parsing JSON: the Accept
+// header is negotiated against the formats an endpoint offers, and ?format=
+// (json, text, vtt, srt, csv or html) overrides it. Without either, or with */*, the first
+// format the endpoint offers is used, so existing clients are unaffected.
+
+// Media types of transcripts and exports
+const (
+	mediaJSON = "application/json"
+	mediaText = "text/plain"
+	mediaVTT  = "text/vtt"
+	mediaSRT  = "application/x-subrip"
+	mediaCSV  = "text/csv"
+	mediaHTML = "text/html"
+)
+
+// formatNames are the ?format= shorthands
+var formatNames = map[string]string{
+	"json": mediaJSON,
+	"text": mediaText,
+	"txt":  mediaText,
+	"vtt":  mediaVTT,
+	"srt":  mediaSRT,
+	"csv":  mediaCSV,
+	"html": mediaHTML,
+}
+
+// formatShorthands name the media types in messages
+var formatShorthands = map[string]string{
+	mediaJSON: "json",
+	mediaText: "text",
+	mediaVTT:  "vtt",
+	mediaSRT:  "srt",
+	mediaCSV:  "csv",
+	mediaHTML: "html",
+}
+
+// acceptQuality returns the quality the Accept header gives offer, -1 when
+// no media range matches. The most specific matching range wins.
+func acceptQuality(accept, offer string) float64 {
+	offerType, _, _ := strings.Cut(offer, "/")
+	quality, specificity := -1.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(name) == "q" {
+				if v, err := strconv.ParseFloat(value, 64); err == nil {
+					q = v
+				}
+			}
+		}
+		s := -1
+		switch mediaRange {
+		case offer:
+			s = 2
+		case offerType + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s > specificity {
+			quality, specificity = q, s
+		}
+	}
+	return quality
+}
+
+// negotiate picks the format of a response among offers, in order of the
+// server's preference. It returns "" when the client accepts none of them.
+func negotiate(r *http.Request, offers ...string) string {
+	if name := r.URL.Query().Get("format"); name != "" {
+		format := formatNames[strings.ToLower(name)]
+		for _, offer := range offers {
+			if offer == format {
+				return offer
+			}
+		}
+		return ""
+	}
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	best, bestQuality := "", 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQuality {
+			best, bestQuality = offer, q
+		}
+	}
+	return best
+}
+
+// notAcceptable explains which formats an endpoint offers
+func notAcceptable(offers ...string) string {
+	names := make([]string, len(offers))
+	for i, offer := range offers {
+		names[i] = formatShorthands[offer]
+	}
+	last := len(names) - 1
+	list := names[last]
+	if last > 0 {
+		list = strings.Join(names[:last], ", ") + " or " + list
+	}
+	return fmt.Sprintf("Not acceptable: this endpoint answers %s (or ?format=%s)", strings.Join(offers, ", "), list)
+}
+
+// Subtitle lines are wrapped to a length that can be read at a glance, and a
+// cue shows at most two of them
+const (
+	maxCaptionLineLength = 42
+	maxCaptionLines      = 2
+)
+
+// captionCue is a subtitle shown from Start to End
+type captionCue struct {
+	Start, End float64
+	Lines      []string
+}
+
+// formatVTTTime formats seconds as a WebVTT timestamp
+func formatVTTTime(seconds float64) string {
+	ms := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// formatSRTTime formats seconds as a SubRip timecode
+func formatSRTTime(seconds float64) string {
+	ms := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// wrapCaption breaks words into lines of at most maxCaptionLineLength
+// characters. Words longer than a line, as in scripts written without
+// spaces, are split.
+func wrapCaption(words []string) []string {
+	var lines []string
+	line, length := "", 0
+	for _, word := range words {
+		runes := []rune(word)
+		for len(runes) > maxCaptionLineLength {
+			if line != "" {
+				lines = append(lines, line)
+				line, length = "", 0
+			}
+			lines = append(lines, string(runes[:maxCaptionLineLength]))
+			runes = runes[maxCaptionLineLength:]
+		}
+		switch {
+		case len(runes) == 0:
+		case line == "":
+			line, length = string(runes), len(runes)
+		case length+1+len(runes) <= maxCaptionLineLength:
+			line += " " + string(runes)
+			length += 1 + len(runes)
+		default:
+			lines = append(lines, line)
+			line, length = string(runes), len(runes)
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// captionCues turns a transcript into cues, one or more per segment: the
+// text of a segment is wrapped, and a segment that needs more than
+// maxCaptionLines lines is split into cues sharing its time by their
+// length. Without segments the whole text spans the duration.
+func captionCues(text string, duration float64, segments []Segment) []captionCue {
+	if len(segments) == 0 && strings.TrimSpace(text) != "" {
+		segments = []Segment{{Start: 0, End: duration, Text: text}}
+	}
+	var cues []captionCue
+	for _, seg := range segments {
+		// "-->" would be read as a timing line
+		lines := wrapCaption(strings.Fields(strings.ReplaceAll(seg.Text, "-->", "->")))
+		total := 0
+		for _, line := range lines {
+			total += utf8.RuneCountInString(line)
+		}
+		start, done := seg.Start, 0
+		for i := 0; i < len(lines); i += maxCaptionLines {
+			group := lines[i:min(i+maxCaptionLines, len(lines))]
+			for _, line := range group {
+				done += utf8.RuneCountInString(line)
+			}
+			end := seg.Start + (seg.End-seg.Start)*float64(done)/float64(total)
+			if i+maxCaptionLines >= len(lines) {
+				end = seg.End
+			}
+			cues = append(cues, captionCue{Start: start, End: end, Lines: group})
+			start = end
+		}
+	}
+	return cues
+}
+
+// captions renders a transcript as WebVTT. A disclosure footer is added as
+// a note.
+func captions(text string, duration float64, segments []Segment, footer string) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	if footer != "" {
+		// Notes cannot contain "-->" or blank lines
+		note := strings.ReplaceAll(footer, "-->", "->")
+		note = strings.Join(strings.Fields(note), " ")
+		fmt.Fprintf(&b, "NOTE %s\n\n", note)
+	}
+	for i, cue := range captionCues(text, duration, segments) {
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", i+1, formatVTTTime(cue.Start), formatVTTTime(cue.End), strings.Join(cue.Lines, "\n"))
+	}
+	return b.String()
+}
+
+// subRip renders a transcript as SubRip (.srt) subtitles
+func subRip(text string, duration float64, segments []Segment) string {
+	var b strings.Builder
+	for i, cue := range captionCues(text, duration, segments) {
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", i+1, formatSRTTime(cue.Start), formatSRTTime(cue.End), strings.Join(cue.Lines, "\n"))
+	}
+	return b.String()
+}
+
+// writeTranscriptAs writes a transcript as bare text or subtitles
+func writeTranscriptAs(w http.ResponseWriter, format, text string, duration float64, segments []Segment) {
+	w.Header().Set("Vary", "Accept")
+	switch format {
+	case mediaVTT:
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		w.Write([]byte(captions(text, duration, segments, "")))
+	case mediaSRT:
+		w.Header().Set("Content-Type", "application/x-subrip; charset=utf-8")
+		w.Write([]byte(subRip(text, duration, segments)))
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(strings.TrimSpace(text) + "\n"))
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recordings of several hundred megabytes tie up a replica for as long as
+// they take to upload. With OBJECT_STORAGE_BUCKET set, clients can upload
+// them straight to an S3-compatible bucket (AWS S3, MinIO, Ceph) instead:
+// POST /uploads/presign returns a presigned PUT URL and a token, the client
+// uploads the file to the URL, and POST /uploads/complete with the token
+// queues the recording as a background job, as if it had been sent to
+// /jobs/transcribe. The job downloads the recording from the bucket and
+// deletes it there. URLs are signed with AWS Signature Version 4 and expire
+// after OBJECT_STORAGE_URL_EXPIRY; the signature covers the size declared
+// for the file, so the bucket refuses any other.
+
+// directUploadKeyPrefix namespaces presigned uploads in the state store,
+// and directUploadClaimPrefix the counters a completion claims them with
+const (
+	directUploadKeyPrefix   = "direct-upload:"
+	directUploadClaimPrefix = "direct-upload-claim:"
+)
+
+// objectRequestExpiry bounds the URLs the server signs for itself
+const objectRequestExpiry = 15 * time.Minute
+
+// objectClient talks to the object storage
+var objectClient *http.Client
+
+// PresignRequest asks for an upload URL: the file's name and size in
+// bytes, and the job's fields as those of /jobs/transcribe
+type PresignRequest struct {
+	Filename  string `json:"filename"`
+	Size      int64  `json:"size"`
+	Pipeline  string `json:"pipeline,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Language  string `json:"language,omitempty"`
+	Languages string `json:"languages,omitempty"`
+	Enhance   string `json:"enhance,omitempty"`
+}
+
+// PresignResponse is the URL to upload the file to with Method, and the
+// token to complete the upload with
+type PresignResponse struct {
+	URL       string    `json:"url"`
+	Method    string    `json:"method"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DirectUpload is an upload to the object storage, recorded under its
+// token until it is completed or its URL expires
+type DirectUpload struct {
+	Key      string            `json:"key"`
+	Size     int64             `json:"size"`
+	Filename string            `json:"filename,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	// Tenant, Workspace and CreatedBy are those of the principal that asked
+	// for the URL, the only one that may complete the upload
+	Tenant    string    `json:"tenant,omitempty"`
+	Workspace string    `json:"workspace,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// owner is the principal that asked for the upload URL
+func (d *DirectUpload) owner() principal {
+	return principal{ID: d.CreatedBy, Tenant: d.Tenant, Workspace: d.Workspace}
+}
+
+// objectEndpoint is the base URL of the S3 API, without a default port so
+// browsers send the Host it was signed with
+func objectEndpoint() string {
+	endpoint := strings.TrimSuffix(config.ObjectStorageEndpoint, "/")
+	if endpoint == "" {
+		return "https://s3." + config.ObjectStorageRegion + ".amazonaws.com"
+	}
+	if u, err := url.Parse(endpoint); err == nil {
+		if u.Scheme == "https" && u.Port() == "443" || u.Scheme == "http" && u.Port() == "80" {
+			u.Host = u.Hostname()
+		}
+		endpoint = u.String()
+	}
+	return endpoint
+}
+
+// uriEncode percent-encodes s as Signature Version 4 expects: everything
+// but unreserved characters, and slashes only when encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// hmacSHA256 is the HMAC-SHA256 of data under key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// presignObject returns a URL for method on the object key, valid for
+// expiry. A size above zero is signed as the Content-Length the request
+// must carry.
+func presignObject(method, key string, expiry time.Duration, size int64) (string, error) {
+	endpoint, err := url.Parse(objectEndpoint())
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + config.ObjectStorageRegion + "/s3/aws4_request"
+	path := uriEncode(strings.TrimSuffix(endpoint.Path, "/")+"/"+config.ObjectStorageBucket+"/"+key, false)
+
+	headers := "host:" + endpoint.Host + "\n"
+	signed := "host"
+	if size > 0 {
+		headers = "content-length:" + strconv.FormatInt(size, 10) + "\n" + headers
+		signed = "content-length;host"
+	}
+	params := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    config.ObjectStorageAccessKey.Value() + "/" + scope,
+		"X-Amz-Date":          now.Format("20060102T150405Z"),
+		"X-Amz-Expires":       strconv.Itoa(int(expiry.Seconds())),
+		"X-Amz-SignedHeaders": signed,
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var query []string
+	for _, name := range names {
+		query = append(query, uriEncode(name, true)+"="+uriEncode(params[name], true))
+	}
+
+	canonical := strings.Join([]string{method, path, strings.Join(query, "&"), headers, signed, "UNSIGNED-PAYLOAD"}, "\n")
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + params["X-Amz-Date"] + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+	signingKey := []byte("AWS4" + config.ObjectStorageSecretKey.Value())
+	for _, part := range []string{date, config.ObjectStorageRegion, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, toSign))
+	return endpoint.Scheme + "://" + endpoint.Host + path + "?" + strings.Join(query, "&") + "&X-Amz-Signature=" + signature, nil
+}
+
+// objectRequest sends method on the object key
+func objectRequest(ctx context.Context, method, key string) (*http.Response, error) {
+	signedURL, err := presignObject(method, key, objectRequestExpiry, 0)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, signedURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return objectClient.Do(req)
+}
+
+// downloadObject receives a job's audio from the object key into the
+// ingest directory and deletes it from the bucket
+func downloadObject(ctx context.Context, jobID, key, name, storageDir string) (string, string, error) {
+	defer deleteObject(ctx, key)
+	if storageWatchdog.underPressure() {
+		return "", "", fmt.Errorf("server storage is nearly full")
+	}
+	resp, err := objectRequest(ctx, "GET", key)
+	if err != nil {
+		return "", "", fmt.Errorf("downloading audio from object storage: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("downloading audio from object storage: status %d", resp.StatusCode)
+	}
+	return storeAudio(ctx, jobID, resp.Body, wavName(name, jobID), storageDir)
+}
+
+// deleteObject removes the object key from the bucket
+func deleteObject(ctx context.Context, key string) {
+	resp, err := objectRequest(context.WithoutCancel(ctx), "DELETE", key)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusMultipleChoices && resp.StatusCode != http.StatusNotFound {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		logErrorf(ctx, "Error deleting %s from object storage: %v", key, err)
+	}
+}
+
+// loadDirectUpload returns the upload of token when caller asked for it
+func loadDirectUpload(caller principal, token string) (*DirectUpload, bool) {
+	data, ok, err := state.get(directUploadKeyPrefix + token)
+	if err != nil {
+		logErrorf(context.Background(), "Error loading direct upload: %v", err)
+		return nil, false
+	}
+	var d DirectUpload
+	if !ok || json.Unmarshal(data, &d) != nil || d.CreatedBy != caller.ID || d.Tenant != caller.Tenant || d.Workspace != caller.Workspace {
+		return nil, false
+	}
+	return &d, true
+}
+
+// objectStorageEnabled reports whether direct uploads are configured, and
+// answers 501 when they are not
+func objectStorageEnabled(w http.ResponseWriter) bool {
+	if config.ObjectStorageBucket == "" {
+		http.Error(w, "Direct uploads to object storage are not configured", http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
+
+// handleUploadPresign returns a presigned URL the caller uploads a
+// recording to, and the token to complete the upload with
+func handleUploadPresign(w http.ResponseWriter, r *http.Request) {
+	caller, ok := browserPrincipal(w, r)
+	if !ok || !objectStorageEnabled(w) {
+		return
+	}
+	if refuseWhileShuttingDown(w, false) || refuseJobDuringMaintenance(w, false) || refuseWhenQueueFull(w, false) || refuseUnderDiskPressure(w, false) {
+		return
+	}
+	var body PresignRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if body.Size < 1 {
+		http.Error(w, "size must be the size of the file in bytes", http.StatusBadRequest)
+		return
+	}
+	if body.Size > maxUploadSize {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	fields := map[string]string{
+		"pipeline":  body.Pipeline,
+		"title":     body.Title,
+		"language":  body.Language,
+		"languages": body.Languages,
+		"enhance":   body.Enhance,
+	}
+	req, err := jobRequest(caller, fields, body.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The bucket is not in the tenant's region
+	if req.Region != "" {
+		http.Error(w, "Direct uploads are not available with data residency; upload to /files/ instead", http.StatusNotImplemented)
+		return
+	}
+	if _, msg, ok := admitWorkspaceJob(w, caller.Workspace); !ok {
+		http.Error(w, msg, http.StatusTooManyRequests)
+		return
+	}
+
+	token := newID()
+	d := &DirectUpload{
+		Key:       config.ObjectStoragePrefix + newID(),
+		Size:      body.Size,
+		Filename:  body.Filename,
+		Fields:    fields,
+		Tenant:    caller.Tenant,
+		Workspace: caller.Workspace,
+		CreatedBy: caller.ID,
+		ExpiresAt: time.Now().UTC().Add(config.ObjectStorageURLExpiry),
+	}
+	uploadURL, err := presignObject("PUT", d.Key, config.ObjectStorageURLExpiry, d.Size)
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(d); err == nil {
+			err = state.set(directUploadKeyPrefix+token, data, config.ObjectStorageURLExpiry)
+		}
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Error presigning upload of %s: %v", req.Filename, err)
+		http.Error(w, "Error creating upload", http.StatusInternalServerError)
+		return
+	}
+	logf(r.Context(), "Direct upload of %s (%d bytes) to %s", req.Filename, d.Size, d.Key)
+	writeJSON(w, http.StatusOK, PresignResponse{URL: uploadURL, Method: "PUT", Token: token, ExpiresAt: d.ExpiresAt})
+}
+
+// handleUploadComplete queues the job of a recording uploaded to the URL
+// of a token, once the bucket holds all of it
+func handleUploadComplete(w http.ResponseWriter, r *http.Request) {
+	caller, ok := browserPrincipal(w, r)
+	if !ok || !objectStorageEnabled(w) {
+		return
+	}
+	if refuseWhileShuttingDown(w, false) || refuseJobDuringMaintenance(w, false) {
+		return
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&body); err != nil || body.Token == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	d, ok := loadDirectUpload(caller, body.Token)
+	if !ok {
+		http.Error(w, "Unknown or expired upload token", http.StatusNotFound)
+		return
+	}
+
+	resp, err := objectRequest(r.Context(), "HEAD", d.Key)
+	if err != nil {
+		logErrorf(r.Context(), "Error checking %s in object storage: %v", d.Key, err)
+		http.Error(w, "Error reaching object storage", http.StatusBadGateway)
+		return
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		http.Error(w, "The file has not been uploaded yet", http.StatusConflict)
+		return
+	case resp.StatusCode != http.StatusOK:
+		logErrorf(r.Context(), "Error checking %s in object storage: status %d", d.Key, resp.StatusCode)
+		http.Error(w, "Error reaching object storage", http.StatusBadGateway)
+		return
+	case resp.ContentLength != d.Size:
+		http.Error(w, "The file uploaded is not the size declared", http.StatusConflict)
+		return
+	}
+
+	// Only one request completes an upload, even on several replicas
+	if n, err := state.incrBy(directUploadClaimPrefix+body.Token, 1, config.ObjectStorageURLExpiry); err != nil || n != 1 {
+		if err != nil {
+			logErrorf(r.Context(), "Error completing direct upload %s: %v", d.Key, err)
+		}
+		http.Error(w, "Unknown or expired upload token", http.StatusNotFound)
+		return
+	}
+	if err := state.delete(directUploadKeyPrefix + body.Token); err != nil {
+		logErrorf(r.Context(), "Error removing direct upload %s: %v", d.Key, err)
+	}
+	req, err := jobRequest(d.owner(), d.Fields, d.Filename)
+	if err != nil {
+		// The pipeline was removed while the file was uploaded
+		deleteObject(r.Context(), d.Key)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Object = d.Key
+	job := startPipeline(r.Context(), req)
+	logf(r.Context(), "Job %s: queued direct upload %s", job.ID, req.Filename)
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
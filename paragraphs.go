@@ -0,0 +1,182 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Whisper returns a transcript as one run of text, which is hard to read
+// once it goes past a few minutes. When the backend reports segments, the
+// text is broken into paragraphs where the speaker changes, if the backend
+// identifies speakers, at sentence ends where the speaker paused (speaker
+// changes usually come with one), where the vocabulary of what follows
+// barely overlaps with what came before, or when a paragraph grows too
+// long. Paragraphs are separated by a blank line in the text, so the web
+// UI, exports and API clients all get them.
+
+const (
+	// minParagraphWords keeps pauses from producing one-line paragraphs
+	minParagraphWords = 8
+	// minTopicWords is the shortest paragraph split at a topic shift
+	minTopicWords = 30
+	// maxParagraphWords forces a break at the next sentence end
+	maxParagraphWords = 120
+	// topicWindowWords is how much text on each side is compared
+	topicWindowWords = 60
+	// topicShiftOverlap is the share of shared content words below which
+	// the text is taken to change topic
+	topicShiftOverlap = 0.1
+)
+
+// stopWords are frequent words of four letters or more that say nothing
+// about the topic; shorter words are ignored anyway
+var stopWords = map[string]bool{
+	"about": true, "also": true, "because": true, "been": true, "could": true,
+	"does": true, "doing": true, "dont": true, "from": true, "going": true,
+	"have": true, "here": true, "into": true, "just": true, "know": true,
+	"like": true, "make": true, "more": true, "okay": true, "only": true,
+	"other": true, "really": true, "right": true, "said": true, "should": true,
+	"some": true, "than": true, "that": true, "their": true, "them": true,
+	"then": true, "there": true, "these": true, "they": true, "think": true,
+	"this": true, "those": true, "very": true, "want": true, "well": true,
+	"were": true, "what": true, "when": true, "which": true, "will": true,
+	"with": true, "would": true, "yeah": true, "your": true,
+}
+
+// Paragraph is a run of segments rendered together
+type Paragraph struct {
+	Start    float64
+	End      float64
+	Text     string
+	Speaker  string
+	Language string
+}
+
+// endsSentence reports whether text ends with sentence punctuation
+func endsSentence(text string) bool {
+	text = strings.TrimRight(strings.TrimSpace(text), `"'”’)`)
+	return strings.HasSuffix(text, ".") || strings.HasSuffix(text, "?") || strings.HasSuffix(text, "!") ||
+		strings.HasSuffix(text, "…") || strings.HasSuffix(text, "。") || strings.HasSuffix(text, "？") || strings.HasSuffix(text, "！")
+}
+
+// contentWords returns the topical words of texts
+func contentWords(texts []string) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, text := range texts {
+		for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			if len([]rune(word)) >= 4 && !stopWords[word] {
+				set[word] = struct{}{}
+			}
+		}
+	}
+	return set
+}
+
+// topicWindow returns the texts of segments, walking from index i in steps
+// of dir, until about topicWindowWords words are collected
+func topicWindow(segments []Segment, i, dir int) []string {
+	var texts []string
+	words := 0
+	for ; i >= 0 && i < len(segments) && words < topicWindowWords; i += dir {
+		texts = append(texts, segments[i].Text)
+		words += len(strings.Fields(segments[i].Text))
+	}
+	return texts
+}
+
+// topicShift reports whether the text starting at segment i has little
+// vocabulary in common with the text before it
+func topicShift(segments []Segment, i int) bool {
+	before := contentWords(topicWindow(segments, i-1, -1))
+	after := contentWords(topicWindow(segments, i, 1))
+	if len(before) < 5 || len(after) < 5 {
+		return false
+	}
+	if len(before) > len(after) {
+		before, after = after, before
+	}
+	shared := 0
+	for word := range before {
+		if _, ok := after[word]; ok {
+			shared++
+		}
+	}
+	return float64(shared)/float64(len(before)) < topicShiftOverlap
+}
+
+// splitParagraphs groups segments into paragraphs. With PARAGRAPHS=false
+// every segment is its own paragraph.
+func splitParagraphs(segments []Segment) []Paragraph {
+	var paragraphs []Paragraph
+	var texts []string
+	start, words := 0, 0
+	flush := func(end int) {
+		if len(texts) == 0 {
+			return
+		}
+		paragraphs = append(paragraphs, Paragraph{
+			Start:    segments[start].Start,
+			End:      segments[end].End,
+			Text:     strings.Join(texts, " "),
+			Speaker:  segments[start].Speaker,
+			Language: segments[start].Language,
+		})
+		texts, words = nil, 0
+	}
+	for i, seg := range segments {
+		if i > 0 && paragraphBreak(segments, i, words) {
+			flush(i - 1)
+			start = i
+		}
+		if text := strings.TrimSpace(seg.Text); text != "" {
+			texts = append(texts, text)
+			words += len(strings.Fields(text))
+		}
+	}
+	flush(len(segments) - 1)
+	return paragraphs
+}
+
+// paragraphBreak reports whether a paragraph of words words ends before
+// segment i
+func paragraphBreak(segments []Segment, i, words int) bool {
+	if !config.Paragraphs {
+		return true
+	}
+	prev := segments[i-1]
+	if prev.Speaker != segments[i].Speaker || prev.Language != segments[i].Language {
+		return true
+	}
+	sentence := endsSentence(prev.Text)
+	if pause := config.ParagraphPause.Seconds(); pause > 0 && words >= minParagraphWords {
+		gap := segments[i].Start - prev.End
+		if gap >= 2*pause || (gap >= pause && sentence) {
+			return true
+		}
+	}
+	if !sentence {
+		return false
+	}
+	return words >= maxParagraphWords || (words >= minTopicWords && topicShift(segments, i))
+}
+
+// formatParagraphs rewrites a transcription's text with blank lines between
+// paragraphs. Text that is not the concatenation of the segments, such as
+// text post-processed by the backend, is kept as is.
+func formatParagraphs(result *TranscriptionResult) {
+	if !config.Paragraphs || len(result.Segments) < 2 {
+		return
+	}
+	paragraphs := splitParagraphs(result.Segments)
+	texts := make([]string, len(paragraphs))
+	for i, p := range paragraphs {
+		texts[i] = p.Text
+	}
+	text := strings.Join(texts, "\n\n")
+	if strings.Join(strings.Fields(text), " ") != strings.Join(strings.Fields(result.Text), " ") {
+		return
+	}
+	result.Text = text
+}
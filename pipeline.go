@@ -0,0 +1,745 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Built-in pipelines that can be triggered without an interactive upload
+const (
+	pipelineTranscribe          = "transcribe"
+	pipelineTranscribeSummarize = "transcribe_summarize"
+	pipelineLecture             = "lecture"
+	pipelineSpeech              = "speech"
+)
+
+// PipelineRequest describes background work on an audio file fetched from a URL
+type PipelineRequest struct {
+	AudioURL string `json:"audio_url"`
+	Pipeline string `json:"pipeline"`
+	// Title names the job instead of a generated title
+	Title    string `json:"title,omitempty"`
+	Language string `json:"language,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+	Region   string `json:"region,omitempty"`
+	// Languages are likely languages tried in order instead of Language
+	Languages []string `json:"languages,omitempty"`
+	// Workspace is the workspace of the API key starting the job
+	Workspace string `json:"-"`
+	// UserID is the caller's identifier for the person the audio belongs
+	// to, used for legal holds and exports
+	UserID string `json:"user_id,omitempty"`
+	// Consent optionally records the participants' consent up front
+	Consent *Consent `json:"consent,omitempty"`
+	// Truncation is the summary strategy for text over the input limit
+	Truncation string `json:"truncation,omitempty"`
+	// SummaryStyle is the style of the summary step's summary
+	SummaryStyle string `json:"summary_style,omitempty"`
+	// Enhance turns enhancement of noisy audio on or off instead of
+	// AUDIO_DENOISE
+	Enhance *bool `json:"enhance,omitempty"`
+	// CreatedBy is the principal starting the job, never read from the body
+	CreatedBy string `json:"-"`
+	// History files a job of the web UI in the transcript history
+	History bool `json:"-"`
+	// Recording is audio received with the request, read instead of
+	// AudioURL, and Filename the name it was uploaded under
+	Recording string `json:"-"`
+	Filename  string `json:"-"`
+	// Object is the key of audio uploaded to the object storage, read
+	// instead of AudioURL
+	Object string `json:"-"`
+	// Room and Meeting file a room device's recording under the meeting
+	Room    string `json:"-"`
+	Meeting string `json:"-"`
+	// RequestID is the ID of the request that started the job, logged
+	// with its lines and sent to the backends
+	RequestID string `json:"-"`
+}
+
+// builtinPipeline reports whether name is one of the built-in pipelines
+func builtinPipeline(name string) bool {
+	return name == pipelineTranscribe || name == pipelineTranscribeSummarize || name == pipelineLecture || name == pipelineSpeech
+}
+
+// validPipeline reports whether name is a built-in or declared pipeline
+func validPipeline(name string) bool {
+	if builtinPipeline(name) {
+		return true
+	}
+	_, ok := registry.pipeline(name)
+	return ok
+}
+
+// pipelineSteps returns the steps of the named pipeline in execution order
+func pipelineSteps(name string) []string {
+	if definition, ok := registry.pipeline(name); ok {
+		return definition.Steps
+	}
+	if name == pipelineTranscribeSummarize {
+		return []string{stepTranscribe, stepSummarize}
+	}
+	if name == pipelineLecture {
+		return []string{stepTranscribe, stepStudyNotes, stepFlashcards, stepQuiz}
+	}
+	if name == pipelineSpeech {
+		return []string{stepTranscribe, stepOutline}
+	}
+	return []string{stepTranscribe}
+}
+
+// validate fills in defaults and checks the request, returning a message
+// suitable for the client when it is invalid
+func (req *PipelineRequest) validate() (string, bool) {
+	if req.Pipeline == "" {
+		req.Pipeline = pipelineTranscribe
+	}
+	if !validPipeline(req.Pipeline) {
+		return "Unknown pipeline", false
+	}
+	if req.Tenant != "" && !knownTenant(req.Tenant) {
+		return "Unknown tenant", false
+	}
+	region, err := resolveRegion(req.Tenant, req.Region)
+	if err != nil {
+		return "Invalid region: " + err.Error(), false
+	}
+	req.Region = region
+	if err := req.checkLanguages(); err != nil {
+		return err.Error(), false
+	}
+	if req.UserID != "" && !externalIDPattern.MatchString(req.UserID) {
+		return "Invalid user_id", false
+	}
+	req.Title = strings.TrimSpace(req.Title)
+	if len([]rune(req.Title)) > maxTitleLength {
+		return fmt.Sprintf("title must be at most %d characters", maxTitleLength), false
+	}
+	if req.Consent != nil {
+		if err := req.Consent.validate(); err != nil {
+			return err.Error(), false
+		}
+	}
+	if req.Truncation != "" && !validTruncation(req.Truncation) {
+		return "truncation must be head, tail, smart-extract or chunked", false
+	}
+	if req.SummaryStyle != "" && !validSummaryStyle(req.SummaryStyle) {
+		return "summary_style must be bullet_points, executive, detailed, action_items or meeting_minutes", false
+	}
+	if config.Airgapped {
+		return "audio_url ingest is disabled in air-gapped mode", false
+	}
+	if u, err := url.Parse(req.AudioURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "audio_url must be an http(s) URL", false
+	}
+	return "", true
+}
+
+// checkLanguages checks the language hints, keeping a list of one language
+// as Language, and falls back to the language of a declared pipeline
+func (req *PipelineRequest) checkLanguages() error {
+	hints, err := languageHints(req.Language, req.Languages)
+	if err != nil {
+		return err
+	}
+	req.Language, req.Languages = "", nil
+	switch {
+	case len(hints) > 1:
+		req.Languages = hints
+	case len(hints) == 1:
+		req.Language = hints[0]
+	default:
+		if definition, ok := registry.pipeline(req.Pipeline); ok {
+			req.Language = definition.Language
+		}
+	}
+	return nil
+}
+
+// languageHints returns the languages to transcribe the request's audio with
+func (req *PipelineRequest) languageHints() []string {
+	if len(req.Languages) > 0 {
+		return req.Languages
+	}
+	if req.Language == "" {
+		return nil
+	}
+	return []string{req.Language}
+}
+
+// enhance reports whether noisy audio of the request is enhanced
+func (req *PipelineRequest) enhance() bool {
+	if req.Enhance != nil {
+		return *req.Enhance
+	}
+	return config.AudioDenoise
+}
+
+// fetchClient downloads audio referenced by URL
+var fetchClient *http.Client
+
+// startPipeline records a job for req and runs it in the background under
+// the request ID of ctx, returning the job as initially stored
+func startPipeline(ctx context.Context, req PipelineRequest) Job {
+	req.RequestID = requestIDFrom(ctx)
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        newID(),
+		Status:    jobQueued,
+		Pipeline:  req.Pipeline,
+		Title:     req.Title,
+		Tenant:    req.Tenant,
+		Region:    req.Region,
+		Workspace: req.Workspace,
+		UserID:    req.UserID,
+		Consent:   req.Consent,
+		CreatedBy: req.CreatedBy,
+		History:   req.History,
+		Room:      req.Room,
+		Meeting:   req.Meeting,
+		AudioURL:  req.AudioURL,
+		Filename:  req.Filename,
+		Language:  req.Language,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if job.Title == "" {
+		name := req.Filename
+		if req.Recording == "" && req.Object == "" {
+			name = lastPathSegment(req.AudioURL)
+		}
+		job.Title = fallbackTitle(name, now)
+	}
+	pipelineJobs.add(job)
+	snapshot := *job
+	for _, step := range pipelineSteps(req.Pipeline) {
+		countTelemetry(telemetryFeatures, "pipeline."+step)
+	}
+
+	recordAudit(req.UserID, publishEvent(EventJobCreated, job.ID, map[string]any{"kind": req.Pipeline, "audio_url": req.AudioURL}))
+	enqueueJob(job.ID, req)
+	return snapshot
+}
+
+// runPipeline fetches the audio and runs the requested pipeline, reporting
+// progress through the job store and lifecycle events
+func runPipeline(jobID string, req PipelineRequest) {
+	timer := newStageTimer()
+	ctx := withStageTimer(withRequestIDContext(context.Background(), req.RequestID), timer)
+	source := req.AudioURL
+	switch {
+	case req.Room != "":
+		source = fmt.Sprintf("the recording of meeting %s in room %s", req.Meeting, req.Room)
+	case req.Recording != "":
+		source = fmt.Sprintf("uploaded %q", req.Filename)
+	case req.Object != "":
+		source = fmt.Sprintf("%q uploaded to object storage", req.Filename)
+	}
+	logf(ctx, "Job %s: running pipeline %q on %s", jobID, req.Pipeline, source)
+
+	fail := func(err error) {
+		logErrorf(ctx, "Job %s failed: %v", jobID, err)
+		pipelineJobs.update(jobID, func(job *Job) {
+			job.Status = jobFailed
+			job.Error = err.Error()
+			job.Timing = timer.timing()
+		})
+		recordAudit(req.UserID, publishEvent(EventJobFailed, jobID, map[string]any{"kind": req.Pipeline, "error": err.Error()}))
+	}
+
+	// Jobs accepted during maintenance stay queued until it ends
+	if err := waitForMaintenance(ctx, jobID); err != nil {
+		fail(err)
+		return
+	}
+	// A job in a region dropped from REGIONS since it was queued is refused
+	// rather than processed by the default backends
+	up, err := upstreamFor(req.Tenant, req.Region)
+	if err != nil {
+		fail(err)
+		return
+	}
+	storageDir, err := regionStorageDir(req.Region)
+	if err != nil {
+		fail(err)
+		return
+	}
+	pipelineJobs.update(jobID, func(job *Job) {
+		job.Status = jobRunning
+		job.Step = stepTranscribe
+	})
+
+	downloadStart := time.Now()
+	var path, filename string
+	if req.Recording != "" {
+		path, filename, err = storeRecording(ctx, jobID, req.Recording, req.Filename, storageDir)
+	} else if req.Object != "" {
+		path, filename, err = downloadObject(ctx, jobID, req.Object, req.Filename, storageDir)
+	} else {
+		path, filename, err = downloadAudio(ctx, jobID, req.AudioURL, storageDir)
+	}
+	timer.since(stageUpload, downloadStart)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer releaseAudio(jobID, req, path)
+
+	if err := waitForMaintenance(ctx, jobID); err != nil {
+		fail(err)
+		return
+	}
+	audioPath, quality := assessAudioFile(ctx, path, "Job "+jobID, req.enhance())
+	if audioPath != path {
+		defer os.Remove(audioPath)
+	}
+	result, err := transcribeWithLanguages(ctx, req.languageHints(), func(language string) (*TranscriptionResult, error) {
+		return transcribeFile(ctx, up, audioPath, filename, language)
+	})
+	if err != nil {
+		fail(err)
+		return
+	}
+	result.AudioQuality = quality
+	if len(result.Gaps) > 0 {
+		logWarnf(ctx, "Job %s: transcribed with gaps at %s", jobID, gapSummary(result.Gaps))
+		keepAudioForGaps(ctx, Job{ID: jobID, Region: req.Region, UserID: req.UserID}, audioPath)
+	} else {
+		logf(ctx, "Job %s: transcription successful", jobID)
+	}
+	recordWorkspaceAudio(req.Workspace, result.Duration)
+	recordAudit(req.UserID, publishTranscriptCompleted(jobID, filename, result))
+
+	title := ""
+	if req.Title == "" && config.AutoTitles {
+		if title, err = generateTitle(ctx, up, result.Text); err != nil {
+			// The title from the file name stays
+			logErrorf(ctx, "Job %s: error generating title: %v", jobID, err)
+		}
+	}
+
+	duplicateOf := ""
+	duplicateStart := time.Now()
+	if original, score, ok := findDuplicate(jobID, req, result.Text); ok {
+		logf(ctx, "Job %s: same recording as job %s (%.0f%% overlap)", jobID, original.ID, score*100)
+		duplicateOf = original.ID
+	}
+	timer.since(stagePostprocess, duplicateStart)
+
+	steps := pipelineSteps(req.Pipeline)[1:]
+	pipelineJobs.update(jobID, func(job *Job) {
+		if title != "" {
+			job.Title = title
+		}
+		job.DuplicateOf = duplicateOf
+		job.Text = result.Text
+		job.Duration = result.Duration
+		job.Segments = result.Segments
+		job.Gaps = result.Gaps
+		if result.Language != "" {
+			job.Language = result.Language
+		}
+		job.LanguageHint, job.LanguagesTried = result.LanguageHint, result.LanguagesTried
+		job.SpokenLanguages = result.SpokenLanguages
+		job.AudioQuality = result.AudioQuality
+		job.Timing = timer.timing()
+		if len(steps) == 0 {
+			job.Status = jobCompleted
+		}
+	})
+
+	for i, step := range steps {
+		if err := waitForMaintenance(ctx, jobID); err != nil {
+			fail(err)
+			return
+		}
+		pipelineJobs.update(jobID, func(job *Job) { job.Step = step })
+		run, ok := pipelineStepRunners[step]
+		if !ok {
+			fail(fmt.Errorf("unsupported step %q", step))
+			return
+		}
+		apply, msg, err := run(ctx, up, stepInput{req: req, result: result})
+		if err != nil {
+			fail(err)
+			return
+		}
+		logf(ctx, "Job %s: %s", jobID, msg)
+		last := i == len(steps)-1
+		pipelineJobs.update(jobID, func(job *Job) {
+			apply(job)
+			job.Timing = timer.timing()
+			if last {
+				job.Status = jobCompleted
+			}
+		})
+	}
+}
+
+// stepInput is what the steps after transcription work on
+type stepInput struct {
+	req    PipelineRequest
+	result *TranscriptionResult
+}
+
+// pipelineStepRunner runs a step after transcription, returning how to
+// store its output in the job and what to log about it
+type pipelineStepRunner func(ctx context.Context, up Upstream, in stepInput) (apply func(*Job), msg string, err error)
+
+// pipelineStepRunners runs each step after transcription
+var pipelineStepRunners = map[string]pipelineStepRunner{
+	stepSummarize: func(ctx context.Context, up Upstream, in stepInput) (func(*Job), string, error) {
+		summary, err := summarizeText(ctx, up, in.result.Text, in.req.Truncation, summaryPrompt(in.req.SummaryStyle, ""))
+		if err != nil {
+			return nil, "", err
+		}
+		return func(job *Job) {
+			job.Summary = summary.Summary
+			job.SummaryTruncation = summary.Truncation
+			recordAudit(job.UserID, publishSummaryCompleted(job.ID, summary))
+		}, "summarization successful", nil
+	},
+	stepActionItems: func(ctx context.Context, up Upstream, in stepInput) (func(*Job), string, error) {
+		items, err := extractActionItems(ctx, up, in.result.Text, time.Now().UTC())
+		if err != nil {
+			return nil, "", err
+		}
+		return func(job *Job) { job.ActionItems = items }, fmt.Sprintf("extracted %d action items", len(items)), nil
+	},
+	stepTags: func(ctx context.Context, up Upstream, in stepInput) (func(*Job), string, error) {
+		tags, err := classifyText(ctx, up, in.result.Text)
+		if err != nil {
+			return nil, "", err
+		}
+		return func(job *Job) { job.Tags = tags }, "tagged " + strings.Join(tags, ", "), nil
+	},
+	stepDecisions: func(ctx context.Context, up Upstream, in stepInput) (func(*Job), string, error) {
+		decisions, err := extractDecisions(ctx, up, in.result.Text)
+		if err != nil {
+			return nil, "", err
+		}
+		return func(job *Job) { job.Decisions = decisions }, fmt.Sprintf("extracted %d decisions", len(decisions)), nil
+	},
+	stepRisks: func(ctx context.Context, up Upstream, in stepInput) (func(*Job), string, error) {
+		risks, err := extractRisks(ctx, up, in.result.Text)
+		if err != nil {
+			return nil, "", err
+		}
+		return func(job *Job) { job.Risks = risks }, fmt.Sprintf("found %d risks, blockers and dependencies", len(risks)), nil
+	},
+	stepFeedback: func(ctx context.Context, up Upstream, in stepInput) (func(*Job), string, error) {
+		feedback, err := extractFeedback(ctx, up, in.result.Text)
+		if err != nil {
+			return nil, "", err
+		}
+		return func(job *Job) { job.Feedback = feedback }, fmt.Sprintf("found %d objections, questions and feature requests", len(feedback)), nil
+	},
+	stepScorecard: func(ctx context.Context, up Upstream, in stepInput) (func(*Job), string, error) {
+		definition, _ := registry.pipeline(in.req.Pipeline)
+		card, ok := registry.scorecard(definition.Scorecard)
+		if !ok {
+			return nil, "", fmt.Errorf("scorecard %q does not exist", definition.Scorecard)
+		}
+		score, err := scoreCall(ctx, up, card, in.result.Text)
+		if err != nil {
+			return nil, "", err
+		}
+		return func(job *Job) {
+			job.Scorecard = score
+			if err := saveScore(*job, score); err != nil {
+				logErrorf(ctx, "Job %s: error saving score: %v", job.ID, err)
+			}
+		}, fmt.Sprintf("scored %.0f on scorecard %s", score.Score, card.ID), nil
+	},
+	stepStudyNotes: func(ctx context.Context, up Upstream, in stepInput) (func(*Job), string, error) {
+		notes, err := writeStudyNotes(ctx, up, in.result.Text)
+		if err != nil {
+			return nil, "", err
+		}
+		return func(job *Job) { job.StudyNotes = notes }, fmt.Sprintf("wrote study notes in %d sections", len(notes.Sections)), nil
+	},
+	stepFlashcards: func(ctx context.Context, up Upstream, in stepInput) (func(*Job), string, error) {
+		cards, err := writeFlashcards(ctx, up, in.result.Text)
+		if err != nil {
+			return nil, "", err
+		}
+		return func(job *Job) { job.Flashcards = cards }, fmt.Sprintf("wrote %d flashcards", len(cards)), nil
+	},
+	stepQuiz: func(ctx context.Context, up Upstream, in stepInput) (func(*Job), string, error) {
+		quiz, err := writeQuiz(ctx, up, in.result.Text)
+		if err != nil {
+			return nil, "", err
+		}
+		return func(job *Job) { job.Quiz = quiz }, fmt.Sprintf("wrote a quiz of %d questions", len(quiz)), nil
+	},
+	stepTranslate: func(ctx context.Context, up Upstream, in stepInput) (func(*Job), string, error) {
+		definition, _ := registry.pipeline(in.req.Pipeline)
+		translation, err := translateSegments(ctx, up, in.result.Text, in.result.Duration, in.result.Segments, definition.TranslateTo)
+		if err != nil {
+			return nil, "", err
+		}
+		return func(job *Job) { job.Translation = translation }, fmt.Sprintf("translated %d segments to %s", len(translation.Segments), translation.Language), nil
+	},
+	stepOutline: func(ctx context.Context, up Upstream, in stepInput) (func(*Job), string, error) {
+		outline, err := outlineSpeech(ctx, up, in.result.Text, in.result.Segments)
+		if err != nil {
+			return nil, "", err
+		}
+		return func(job *Job) { job.Outline = outline }, fmt.Sprintf("outlined %d points and %d references", len(outline.Points), len(outline.References)), nil
+	},
+}
+
+// downloadAudio stores the audio at audioURL in the storage directory
+// storageDir and returns its path and a display filename
+func downloadAudio(ctx context.Context, jobID, audioURL, storageDir string) (string, string, error) {
+	if storageWatchdog.underPressure() {
+		return "", "", fmt.Errorf("server storage is nearly full")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", audioURL, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid audio URL: %w", err)
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("downloading audio: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("downloading audio: status %d", resp.StatusCode)
+	}
+
+	return storeAudio(ctx, jobID, resp.Body, wavName(filepath.Base(req.URL.Path), jobID), storageDir)
+}
+
+// storeAudio receives a job's audio from body into the ingest directory,
+// converting it to WAV, and returns its path and the file name to send
+func storeAudio(ctx context.Context, jobID string, body io.Reader, filename, storageDir string) (string, string, error) {
+	dir := filepath.Join(storageDir, "ingest")
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", "", err
+	}
+	path := filepath.Join(dir, jobID+".wav")
+
+	// Check the magic bytes before accepting the rest of the body
+	header := make([]byte, audioSniffLen)
+	n, _ := io.ReadFull(body, header)
+	format := sniffAudio(header[:n])
+	if format == "" {
+		return "", "", fmt.Errorf("audio is not WAV, MP3, M4A, FLAC, OGG or WebM")
+	}
+	if format != audioWAV && !canConvertAudio() {
+		return "", "", errNoConverter
+	}
+	received := path
+	if format != audioWAV {
+		received = filepath.Join(dir, jobID+"."+format)
+	}
+	file, err := os.Create(received)
+	if err != nil {
+		return "", "", err
+	}
+	_, err = file.Write(header[:n])
+	var size int64
+	if err == nil {
+		// Hooks, downloads and object storage are not read through
+		// MaxBytesReader: read past the limit to refuse larger audio
+		// rather than process part of it
+		size, err = io.Copy(file, io.LimitReader(body, maxUploadSize-int64(n)+1))
+	}
+	if err == nil && int64(n)+size > maxUploadSize {
+		err = fmt.Errorf("audio larger than %d MB", maxUploadSize>>20)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(received)
+		return "", "", fmt.Errorf("receiving audio: %w", err)
+	}
+	logf(ctx, "Job %s: received %d bytes", jobID, size+int64(n))
+
+	if format != audioWAV {
+		err := convertToWAV(ctx, received, path)
+		os.Remove(received)
+		if err != nil {
+			return "", "", err
+		}
+		logf(ctx, "Job %s: converted %s audio to WAV", jobID, format)
+	}
+	return path, filename, nil
+}
+
+// storeRecording moves audio received with the request in as a job's
+// audio, converting it to WAV
+func storeRecording(ctx context.Context, jobID, recording, name, storageDir string) (string, string, error) {
+	defer os.Remove(recording)
+	filename := wavName(name, jobID)
+	if filepath.Ext(recording) == "."+audioWAV {
+		path := filepath.Join(storageDir, "ingest", jobID+".wav")
+		return path, filename, os.Rename(recording, path)
+	}
+	file, err := os.Open(recording)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+	return storeAudio(ctx, jobID, file, filename, storageDir)
+}
+
+// transcribeFile sends a WAV file on disk to the Whisper API, in chunks
+// when it is longer than AUDIO_CHUNK_DURATION or holds music to skip
+func transcribeFile(ctx context.Context, up Upstream, path, filename, language string) (*TranscriptionResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if config.AudioChunkDuration > 0 || config.MusicSkipping {
+		audio, err := readWAV(file)
+		if err != nil {
+			logWarnf(ctx, "Not chunking %s: %v", filename, err)
+			return transcribeAudio(ctx, up, file, filename, language)
+		}
+		long := config.AudioChunkDuration > 0 && audio.dataSize > audio.bytesFor(config.AudioChunkDuration)
+		if !audio.pcm16 {
+			if long {
+				logf(ctx, "Not chunking %s: only 16-bit PCM audio is split", filename)
+			}
+		} else if music := musicToSkip(ctx, audio, filename); long || len(music) > 0 {
+			return transcribeChunks(ctx, up, audio, filename, language, music)
+		}
+	}
+	return transcribeAudio(ctx, up, file, filename, language)
+}
+
+// transcribeAudio sends WAV audio read from audio to the Whisper API
+func transcribeAudio(ctx context.Context, up Upstream, audio io.Reader, filename, language string) (*TranscriptionResult, error) {
+	return sendAudio(ctx, up, up.transcriptionURL(), audio, filename, language)
+}
+
+// translateAudio sends WAV audio read from audio to the Whisper API's
+// translation endpoint, which transcribes it into English
+func translateAudio(ctx context.Context, up Upstream, audio io.Reader, filename string) (*TranscriptionResult, error) {
+	return sendAudio(ctx, up, up.translationURL(), audio, filename, "")
+}
+
+// sendAudio posts WAV audio read from audio to the Whisper endpoint url
+func sendAudio(ctx context.Context, up Upstream, url string, audio io.Reader, filename, language string) (*TranscriptionResult, error) {
+	start := time.Now()
+	// Audio that can be read again is sent again when a backend fails
+	seeker, _ := audio.(io.Seeker)
+	var offset int64
+	if seeker != nil {
+		var err error
+		if offset, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		}
+	}
+
+	var boundary string
+	var done chan struct{}
+	form := func() *io.PipeReader {
+		pipeReader, pipeWriter := io.Pipe()
+		writer := multipart.NewWriter(pipeWriter)
+		if boundary == "" {
+			boundary = writer.Boundary()
+		} else {
+			writer.SetBoundary(boundary)
+		}
+		done = make(chan struct{})
+		go func() {
+			defer close(done)
+			err := func() error {
+				if err := writer.WriteField("model", up.AudioModel); err != nil {
+					return err
+				}
+				if err := writer.WriteField("response_format", config.AudioResponseFormat); err != nil {
+					return err
+				}
+				if language != "" && language != "auto" {
+					if err := writer.WriteField("language", language); err != nil {
+						return err
+					}
+				}
+				part, err := writer.CreateFormFile("file", filename)
+				if err != nil {
+					return err
+				}
+				if _, err := io.Copy(part, audio); err != nil {
+					return err
+				}
+				return writer.Close()
+			}()
+			pipeWriter.CloseWithError(err)
+		}()
+		return pipeReader
+	}
+	pipeReader := form()
+	defer func() { pipeReader.Close() }()
+
+	req, err := http.NewRequestWithContext(withAudioBackends(ctx, up), "POST", url, pipeReader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+	up.authorizeAudio(req)
+	if seeker != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			pipeReader.Close()
+			<-done
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return nil, err
+			}
+			pipeReader = form()
+			return pipeReader, nil
+		}
+	}
+
+	resp, err := audioClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling transcription service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading transcription response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The body stays in the log, out of the job record
+		logErrorf(ctx, "Transcription service error (status %d): %s", resp.StatusCode, describeBody(string(body)))
+		return nil, fmt.Errorf("transcription service error (status %d)", resp.StatusCode)
+	}
+	parseStart := time.Now()
+	result, err := parseTranscriptionResponse(resp.Header.Get("Content-Type"), body)
+	if err != nil {
+		return nil, err
+	}
+	stageTimerFrom(ctx).since(stagePostprocess, parseStart)
+	recordTranscription(result, time.Since(start))
+	return result, nil
+}
+
+// summarizeText asks the LLM API for a summary of text under the system
+// prompt, reducing text over the input limit with strategy
+func summarizeText(ctx context.Context, up Upstream, text, strategy, prompt string) (*SummaryResult, error) {
+	chatReq, truncation, err := prepareSummary(ctx, up, text, strategy, prompt)
+	if err != nil {
+		return nil, err
+	}
+	result, err := llmComplete(ctx, up, chatReq)
+	if err != nil {
+		return nil, err
+	}
+	result.Truncation = truncation
+	return result, nil
+}
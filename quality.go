@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// Noisy, clipped or narrowband recordings transcribe badly, and users blame
+// the transcriber. Audio is therefore assessed as it is transcribed: its
+// sample rate, the share of samples clipped at full scale, and its
+// signal-to-noise ratio, estimated as the gap between the loudness of its
+// loud frames (speech) and its quiet ones (the noise floor in pauses). Poor
+// audio gets warnings in the response's audio_quality, so users understand
+// a bad transcript. Noisy audio received in full can be enhanced before it
+// is transcribed (see enhance.go).
+
+// Limits beyond which audio is poor
+const (
+	// clipLevel is the sample value taken as full scale
+	clipLevel = 32700
+	// clippingWarn and clippingHeavy are the shares of clipped samples
+	// worth a warning, and a strong one
+	clippingWarn  = 0.001
+	clippingHeavy = 0.01
+	// noisySNR is the signal-to-noise ratio in dB below which audio is
+	// noisy
+	noisySNR = 15
+	// minSampleRate is the sample rate Whisper models are trained on
+	minSampleRate = 16000
+	// silentLevel is the level in dB below which a recording holds no
+	// speech to judge noise against
+	silentLevel = 20
+)
+
+// Percentiles of frame levels taken as speech and as the noise floor
+const (
+	speechPercentile = 0.95
+	noisePercentile  = 0.1
+)
+
+// errNotMeasured stops reading the header of audio other than 16-bit PCM
+var errNotMeasured = errors.New("audio is not 16-bit PCM")
+
+// maxWAVHeader bounds the bytes before the data chunk the meter waits for
+const maxWAVHeader = 64 << 10
+
+// levelBins is the number of 1 dB bins frame levels are counted in; 16-bit
+// samples span about 90 dB
+const levelBins = 91
+
+// Codes of quality warnings
+const (
+	qualityClipping   = "clipping"
+	qualityNoise      = "noise"
+	qualitySampleRate = "sample_rate"
+)
+
+// QualityWarning is a problem with a recording that may hurt its transcript
+type QualityWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// AudioQuality is the assessment of a recording
+type AudioQuality struct {
+	SampleRate int `json:"sample_rate"`
+	// SNR is the estimated signal-to-noise ratio in dB, 0 for silence
+	SNR float64 `json:"snr_db"`
+	// Clipping is the share of samples clipped at full scale
+	Clipping float64          `json:"clipping"`
+	Warnings []QualityWarning `json:"warnings,omitempty"`
+	// Denoised is set when the audio was enhanced before it was
+	// transcribed, by Enhancer
+	Denoised bool   `json:"denoised,omitempty"`
+	Enhancer string `json:"enhancer,omitempty"`
+	// Enhanced is the assessment of the enhanced audio
+	Enhanced *AudioQuality `json:"enhanced,omitempty"`
+}
+
+// noisy reports whether denoising may help the audio
+func (q *AudioQuality) noisy() bool {
+	for _, w := range q.Warnings {
+		if w.Code == qualityNoise {
+			return true
+		}
+	}
+	return false
+}
+
+// qualityMeter measures WAV audio written to it, as it streams to the
+// backend or is read from a file. Audio other than 16-bit PCM is not
+// measured.
+type qualityMeter struct {
+	// header holds the bytes before the data chunk until it is found
+	header  []byte
+	inData  bool
+	skip    bool
+	rate    int
+	frame   int
+	pending []byte
+	levels  [levelBins]int64
+	frames  int64
+	samples int64
+	clipped int64
+}
+
+// Write measures p; it never fails
+func (m *qualityMeter) Write(p []byte) (int, error) {
+	switch {
+	case m.skip:
+	case m.inData:
+		m.measure(p)
+	default:
+		m.header = append(m.header, p...)
+		m.parseHeader()
+	}
+	return len(p), nil
+}
+
+// parseHeader looks for the fmt and data chunks in the bytes received so
+// far, and measures the audio after them once they are found
+func (m *qualityMeter) parseHeader() {
+	h := m.header
+	var data int64
+	found, err := walkWAV(bytes.NewReader(h), int64(len(h)), func(id string, body, length int64) (bool, error) {
+		switch id {
+		case "fmt ":
+			format := h[body:]
+			encoding := binary.LittleEndian.Uint16(format[0:])
+			m.rate = int(binary.LittleEndian.Uint32(format[4:]))
+			blockAlign := int(binary.LittleEndian.Uint16(format[12:]))
+			bits := binary.LittleEndian.Uint16(format[14:])
+			// 1 is PCM, 0xfffe the extensible format, PCM in practice
+			if (encoding != 1 && encoding != 0xfffe) || bits != 16 || m.rate <= 0 || blockAlign <= 0 {
+				return false, errNotMeasured
+			}
+			m.frame = max(int(int64(m.rate)*int64(liveFrame)/int64(time.Second)), 1) * blockAlign
+		case "data":
+			if m.frame == 0 {
+				return false, errWAVFormatLate
+			}
+			data = body
+			return true, nil
+		}
+		return false, nil
+	})
+	switch {
+	case found:
+		m.inData, m.header = true, nil
+		m.measure(h[data:])
+	case err != nil && !errors.Is(err, errWAVShort), len(h) > maxWAVHeader:
+		m.skip, m.header = true, nil
+	}
+}
+
+// measure counts the clipped samples and the levels of whole frames of
+// audio
+func (m *qualityMeter) measure(p []byte) {
+	if len(m.pending) > 0 {
+		p = append(m.pending, p...)
+		m.pending = nil
+	}
+	for len(p) >= m.frame {
+		frame := p[:m.frame]
+		for i := 0; i+1 < len(frame); i += 2 {
+			v := int16(binary.LittleEndian.Uint16(frame[i:]))
+			if v >= clipLevel || v <= -clipLevel {
+				m.clipped++
+			}
+		}
+		m.samples += int64(len(frame) / 2)
+		level := 0
+		if rms := frameLevel(frame); rms > 1 {
+			level = min(int(20*math.Log10(rms)), levelBins-1)
+		}
+		m.levels[level]++
+		m.frames++
+		p = p[m.frame:]
+	}
+	m.pending = append(m.pending, p...)
+}
+
+// percentile returns the frame level in dB below which the share p of
+// frames lie
+func (m *qualityMeter) percentile(p float64) int {
+	target := int64(math.Ceil(p * float64(m.frames)))
+	var seen int64
+	for level, n := range m.levels {
+		if seen += n; seen >= max(target, 1) {
+			return level
+		}
+	}
+	return levelBins - 1
+}
+
+// quality returns the assessment of the audio measured, nil when none was
+func (m *qualityMeter) quality() *AudioQuality {
+	if !m.inData || m.frames == 0 {
+		return nil
+	}
+	q := &AudioQuality{
+		SampleRate: m.rate,
+		Clipping:   math.Round(float64(m.clipped)/float64(m.samples)*10000) / 10000,
+	}
+	speech := m.percentile(speechPercentile)
+	if speech >= silentLevel {
+		q.SNR = float64(speech - m.percentile(noisePercentile))
+	}
+	switch {
+	case q.Clipping >= clippingHeavy:
+		q.Warnings = append(q.Warnings, QualityWarning{qualityClipping, "audio heavily clipped — accuracy may suffer"})
+	case q.Clipping >= clippingWarn:
+		q.Warnings = append(q.Warnings, QualityWarning{qualityClipping, "audio clipped in places — accuracy may suffer"})
+	}
+	if speech >= silentLevel && q.SNR < noisySNR {
+		q.Warnings = append(q.Warnings, QualityWarning{qualityNoise, fmt.Sprintf("audio is noisy (signal-to-noise ratio %.0f dB) — accuracy may suffer", q.SNR)})
+	}
+	if q.SampleRate < minSampleRate {
+		q.Warnings = append(q.Warnings, QualityWarning{qualitySampleRate, fmt.Sprintf("sample rate of %g kHz is below 16 kHz — accuracy may suffer", float64(q.SampleRate)/1000)})
+	}
+	return q
+}
+
+// measureAudio assesses the WAV audio read from r, nil when it is not
+// 16-bit PCM
+func measureAudio(r io.Reader) (*AudioQuality, error) {
+	var m qualityMeter
+	if _, err := io.Copy(&m, r); err != nil {
+		return nil, err
+	}
+	return m.quality(), nil
+}
+
+// logQuality logs the warnings about a recording
+func logQuality(ctx context.Context, name string, q *AudioQuality) {
+	if q == nil {
+		return
+	}
+	for _, w := range q.Warnings {
+		logWarnf(ctx, "%s: %s", name, w.Message)
+	}
+}
+
+// assessAudioFile assesses the WAV file at path and, with enhance, enhances
+// noisy audio into a new file next to it. It returns the file to
+// transcribe, which the caller removes when it is not path, and the
+// assessment, nil when the audio could not be measured.
+func assessAudioFile(ctx context.Context, path, name string, enhance bool) (string, *AudioQuality) {
+	file, err := os.Open(path)
+	if err != nil {
+		logErrorf(ctx, "Error assessing %s: %v", name, err)
+		return path, nil
+	}
+	quality, err := measureAudio(file)
+	file.Close()
+	if err != nil || quality == nil {
+		if err != nil {
+			logErrorf(ctx, "Error assessing %s: %v", name, err)
+		}
+		return path, nil
+	}
+	logQuality(ctx, name, quality)
+	if !enhance {
+		return path, quality
+	}
+	return enhanceNoisyAudio(ctx, path, name, quality), quality
+}
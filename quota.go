@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Clients of a workspace with a quota can warn their users before uploads
+// are rejected. Responses to requests that count against the quota, and
+// GET /integrations/v1/workspace, carry X-Quota-Limit-* and
+// X-Quota-Remaining-* headers for each limited quota and X-Quota-Reset.
+// From QUOTA_WARNING_THRESHOLD (80%) of a quota on, JSON responses include
+// a quota_warnings list, and the first request past the threshold in a
+// month publishes a workspace.quota_warning event.
+
+// EventQuotaWarning is published when a workspace crosses the warning
+// threshold of a quota, once per quota and month
+const EventQuotaWarning = "workspace.quota_warning"
+
+// Quotas of a workspace
+const (
+	quotaJobs         = "jobs"
+	quotaAudioMinutes = "audio_minutes"
+)
+
+// QuotaWarning tells a client that a quota is nearly used up
+type QuotaWarning struct {
+	Quota   string  `json:"quota"`
+	Used    float64 `json:"used"`
+	Limit   float64 `json:"limit"`
+	Message string  `json:"message"`
+}
+
+// nextMonth returns the start of the month after t, when quotas reset
+func nextMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// setQuotaHeaders reports the limited quotas of a workspace and what is
+// left of them
+func setQuotaHeaders(w http.ResponseWriter, ws *Workspace, usage WorkspaceUsage) {
+	limited := false
+	if limit := ws.Quota.JobsPerMonth; limit > 0 {
+		w.Header().Set("X-Quota-Limit-Jobs", strconv.FormatInt(limit, 10))
+		w.Header().Set("X-Quota-Remaining-Jobs", strconv.FormatInt(max(limit-usage.Jobs, 0), 10))
+		limited = true
+	}
+	if limit := ws.Quota.AudioMinutesPerMonth; limit > 0 {
+		w.Header().Set("X-Quota-Limit-Audio-Minutes", strconv.FormatFloat(limit, 'f', -1, 64))
+		w.Header().Set("X-Quota-Remaining-Audio-Minutes", strconv.FormatFloat(math.Max(limit-usage.AudioMinutes, 0), 'f', 1, 64))
+		limited = true
+	}
+	if limited {
+		w.Header().Set("X-Quota-Reset", nextMonth(time.Now()).Format(time.RFC3339))
+	}
+}
+
+// quotaWarnings lists the quotas of a workspace used beyond the warning
+// threshold
+func quotaWarnings(ws *Workspace, usage WorkspaceUsage) []QuotaWarning {
+	var warnings []QuotaWarning
+	check := func(quota, unit string, used, limit float64) {
+		if limit <= 0 || used < limit*config.QuotaWarningThreshold {
+			return
+		}
+		warnings = append(warnings, QuotaWarning{
+			Quota:   quota,
+			Used:    math.Round(used*10) / 10,
+			Limit:   limit,
+			Message: fmt.Sprintf("Workspace has used %.0f%% of its %s for this month", math.Min(used/limit, 1)*100, unit),
+		})
+	}
+	check(quotaJobs, "job quota", float64(usage.Jobs), float64(ws.Quota.JobsPerMonth))
+	check(quotaAudioMinutes, "audio quota", usage.AudioMinutes, ws.Quota.AudioMinutesPerMonth)
+	return warnings
+}
+
+// announceQuotaWarnings publishes the first warning of each quota this
+// month
+func announceQuotaWarnings(ws *Workspace, warnings []QuotaWarning) {
+	for _, warning := range warnings {
+		n, err := state.incrBy(usageKey(ws.ID, "warned_"+warning.Quota), 1, usageRetention)
+		if err != nil {
+			logErrorf(context.Background(), "Error recording quota warning of workspace %s: %v", ws.ID, err)
+			continue
+		}
+		if n != 1 {
+			continue
+		}
+		logWarnf(context.Background(), "Workspace %s crossed the warning threshold of its %s quota (%g of %g)", ws.ID, warning.Quota, warning.Used, warning.Limit)
+		publishEvent(EventQuotaWarning, ws.ID, map[string]any{
+			"workspace": ws.ID,
+			"quota":     warning.Quota,
+			"used":      warning.Used,
+			"limit":     warning.Limit,
+		})
+	}
+}
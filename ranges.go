@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Part of a transcript can be summarized on its own, such as the
+// decision-making half hour of a long meeting. The part is selected by
+// segment IDs (?segments=12..80) or by time (?from=00:10:00&to=00:25:00),
+// for completed jobs and for /summarize requests that send the segments
+// returned by /transcribe.
+
+// TranscriptRange is the part of a transcript a summary covers
+type TranscriptRange struct {
+	// Start and End are in seconds, from the selected segments
+	Start        float64 `json:"start"`
+	End          float64 `json:"end"`
+	FirstSegment int     `json:"first_segment"`
+	LastSegment  int     `json:"last_segment"`
+}
+
+// parseOffset parses a position in the audio given as seconds, [hh:]mm:ss
+// or a duration such as 10m
+func parseOffset(v string) (float64, error) {
+	if seconds, err := strconv.ParseFloat(v, 64); err == nil && seconds >= 0 {
+		return seconds, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return d.Seconds(), nil
+	}
+	parts := strings.Split(v, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("%q is not a time such as 00:10:00, 600 or 10m", v)
+	}
+	seconds := 0.0
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		// Only the seconds may have a fraction
+		if err != nil || n < 0 || (i < len(parts)-1 && n != float64(int(n))) {
+			return 0, fmt.Errorf("%q is not a time such as 00:10:00, 600 or 10m", v)
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
+
+// parseSegmentRange parses segment IDs given as 12..80, [12..80], 12.. or
+// 12; an open range ends at the last segment
+func parseSegmentRange(v string) (int, int, error) {
+	invalid := fmt.Errorf("segments must be a range of segment IDs such as 12..80, not %q", v)
+	v = strings.TrimSuffix(strings.TrimPrefix(v, "["), "]")
+	firstValue, lastValue, isRange := strings.Cut(v, "..")
+	first, err := strconv.Atoi(firstValue)
+	if err != nil || first < 0 {
+		return 0, 0, invalid
+	}
+	if !isRange {
+		return first, first, nil
+	}
+	if lastValue == "" {
+		return first, -1, nil
+	}
+	last, err := strconv.Atoi(lastValue)
+	if err != nil || last < first {
+		return 0, 0, invalid
+	}
+	return first, last, nil
+}
+
+// selectRange returns the text of the segments selected by the from, to
+// and segments parameters of q. The range is nil when none is given.
+func selectRange(segments []Segment, q url.Values) (string, *TranscriptRange, error) {
+	from, to, ids := q.Get("from"), q.Get("to"), q.Get("segments")
+	if from == "" && to == "" && ids == "" {
+		return "", nil, nil
+	}
+	if ids != "" && (from != "" || to != "") {
+		return "", nil, errors.New("select a range either by segments or by from and to")
+	}
+	if len(segments) == 0 {
+		return "", nil, errors.New("the transcript has no segments to select a range from")
+	}
+
+	var selected func(s Segment) bool
+	if ids != "" {
+		first, last, err := parseSegmentRange(ids)
+		if err != nil {
+			return "", nil, err
+		}
+		selected = func(s Segment) bool {
+			return s.ID >= first && (last < 0 || s.ID <= last)
+		}
+	} else {
+		start, end := 0.0, segments[len(segments)-1].End
+		var err error
+		if from != "" {
+			if start, err = parseOffset(from); err != nil {
+				return "", nil, err
+			}
+		}
+		if to != "" {
+			if end, err = parseOffset(to); err != nil {
+				return "", nil, err
+			}
+		}
+		if end <= start {
+			if to == "" {
+				return "", nil, errors.New("from is past the end of the transcript")
+			}
+			return "", nil, errors.New("to must be after from")
+		}
+		// Segments overlapping the range are included whole
+		selected = func(s Segment) bool {
+			return s.End > start && s.Start < end
+		}
+	}
+
+	var parts []string
+	var rng *TranscriptRange
+	for _, s := range segments {
+		if !selected(s) {
+			continue
+		}
+		if rng == nil {
+			rng = &TranscriptRange{Start: s.Start, FirstSegment: s.ID}
+		}
+		rng.End, rng.LastSegment = s.End, s.ID
+		parts = append(parts, strings.TrimSpace(s.Text))
+	}
+	text := strings.TrimSpace(strings.Join(parts, " "))
+	if text == "" {
+		return "", nil, errors.New("no speech in the selected range")
+	}
+	return text, rng, nil
+}
+
+// handleRangeSummary summarizes a completed transcription, or the part
+// selected by ?segments= or ?from=&to=
+func handleRangeSummary(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !p.sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	if job.Status != jobCompleted {
+		integrationError(w, http.StatusConflict, "Transcription is not completed")
+		return
+	}
+	strategy := r.URL.Query().Get("truncation")
+	if strategy != "" && !validTruncation(strategy) {
+		integrationError(w, http.StatusBadRequest, "truncation must be head, tail, smart-extract or chunked")
+		return
+	}
+	style := r.URL.Query().Get("style")
+	if err := checkSummaryPrompt(style, ""); err != nil {
+		integrationError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	text, rng, err := selectRange(job.Segments, r.URL.Query())
+	if err != nil {
+		integrationError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if rng == nil {
+		text = job.Text
+	}
+	if strings.TrimSpace(text) == "" {
+		integrationError(w, http.StatusConflict, "Transcription has no text to summarize")
+		return
+	}
+	if refuseWhileShuttingDown(w, true) || refuseDuringMaintenance(w, true) {
+		return
+	}
+	warnings, msg, ok := admitWorkspaceJob(w, p.Workspace)
+	if !ok {
+		integrationError(w, http.StatusTooManyRequests, msg)
+		return
+	}
+
+	r, timer := startTiming(r)
+	if rng != nil {
+		logf(r.Context(), "Job %s: summarizing segments %d to %d", job.ID, rng.FirstSegment, rng.LastSegment)
+	}
+	up, err := upstreamFor(job.Tenant, job.Region)
+	if err != nil {
+		logErrorf(r.Context(), "Job %s: %v", job.ID, err)
+		integrationError(w, http.StatusServiceUnavailable, regionUnavailableMessage)
+		return
+	}
+	result, err := summarizeText(r.Context(), up, text, strategy, summaryPrompt(style, ""))
+	if err != nil {
+		logErrorf(r.Context(), "Job %s: error summarizing: %v", job.ID, err)
+		switch {
+		case errors.Is(err, errTextTooLong):
+			integrationError(w, http.StatusRequestEntityTooLarge, err.Error())
+		case errors.Is(err, errUpstreamBusy):
+			w.Header().Set("Retry-After", strconv.Itoa(int(config.UpstreamQueueTimeout.Seconds())))
+			integrationError(w, http.StatusServiceUnavailable, "Server is busy, please retry later")
+		default:
+			integrationError(w, http.StatusBadGateway, "Error calling summarization service")
+		}
+		return
+	}
+	result.Range = rng
+	result.Timing = timer.timing()
+	result.QuotaWarnings = warnings
+	writeJSON(w, http.StatusOK, result)
+}
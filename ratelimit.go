@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits throughput to a fixed number of bytes per second.
+// Callers reserve tokens up front and sleep off any debt, which keeps
+// concurrent readers of a shared bucket roughly first-come first-served.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int64) *tokenBucket {
+	rate := float64(bytesPerSecond)
+	burst := rate
+	if burst < 64<<10 {
+		burst = 64 << 10
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until n bytes may pass or ctx is cancelled
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	debt := b.tokens
+	b.mu.Unlock()
+
+	if debt >= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(-debt / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimiter delays callers so throughput stays under a limit
+type rateLimiter interface {
+	wait(ctx context.Context, n int) error
+}
+
+// sharedRateLimiter enforces a limit across replicas by counting bytes per
+// one-second window in the shared state store. A read is booked into the
+// first window that still has budget and waits until that window starts.
+type sharedRateLimiter struct {
+	key   string
+	limit int64
+}
+
+func (l *sharedRateLimiter) wait(ctx context.Context, n int) error {
+	now := time.Now()
+	for window := now.Unix(); ; window++ {
+		ttl := time.Duration(window-now.Unix()+2) * time.Second
+		total, err := state.incrBy(fmt.Sprintf("%s:%d", l.key, window), int64(n), ttl)
+		if err != nil {
+			// Fail open: a store outage should not stall every upload
+			return nil
+		}
+		if total-int64(n) >= l.limit {
+			// Window already full; bytes counted here do no harm
+			continue
+		}
+
+		delay := time.Until(time.Unix(window, 0))
+		if delay <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// throttledReader reads through one or more limiters
+type throttledReader struct {
+	ctx     context.Context
+	body    io.ReadCloser
+	buckets []rateLimiter
+}
+
+// throttleChunk bounds a single read so the limiter reacts smoothly
+const throttleChunk = 32 << 10
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.body.Read(p)
+	for _, bucket := range t.buckets {
+		if werr := bucket.wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (t *throttledReader) Close() error {
+	return t.body.Close()
+}
+
+// uploadLimits are the upload bandwidth limits in effect, which runtime
+// settings change: the per-connection limit, and the limiter shared by
+// every upload (nil means unlimited)
+var uploadLimits struct {
+	sync.RWMutex
+	perConnection int64
+	global        int64
+	globalLimiter rateLimiter
+}
+
+// initUploadLimits applies the limits of the configuration
+func initUploadLimits() {
+	setUploadLimits(config.UploadRateLimit, config.GlobalUploadRateLimit)
+}
+
+// setUploadLimits changes the upload bandwidth limits for uploads that start
+// afterwards. With a shared state store the global limit applies to all
+// replicas together.
+func setUploadLimits(perConnection, global int64) {
+	uploadLimits.Lock()
+	defer uploadLimits.Unlock()
+	uploadLimits.perConnection = perConnection
+	if global == uploadLimits.global {
+		return
+	}
+	uploadLimits.global = global
+	switch {
+	case global <= 0:
+		uploadLimits.globalLimiter = nil
+	case state.shared():
+		uploadLimits.globalLimiter = &sharedRateLimiter{key: "ratelimit:upload", limit: global}
+	default:
+		uploadLimits.globalLimiter = newTokenBucket(global)
+	}
+}
+
+// throttleUpload wraps a request body with the per-connection and global
+// upload bandwidth limits. Bodies are returned unchanged when no limit is set.
+func throttleUpload(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	uploadLimits.RLock()
+	perConnection, global := uploadLimits.perConnection, uploadLimits.globalLimiter
+	uploadLimits.RUnlock()
+	var buckets []rateLimiter
+	if perConnection > 0 {
+		buckets = append(buckets, newTokenBucket(perConnection))
+	}
+	if global != nil {
+		buckets = append(buckets, global)
+	}
+	if len(buckets) == 0 {
+		return body
+	}
+	return &throttledReader{ctx: ctx, body: body, buckets: buckets}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisStore is a kvStore backed by Redis. It speaks RESP directly over a
+// small pool of connections so the server stays free of client libraries.
+type redisStore struct {
+	url  *Secret
+	pool chan *redisConn
+}
+
+// redisPoolSize bounds concurrent Redis connections
+const redisPoolSize = 8
+
+// redisTimeout bounds a single command round trip
+const redisTimeout = 5 * time.Second
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func newRedisStore(serverURL *Secret) (*redisStore, error) {
+	r := &redisStore{url: serverURL, pool: make(chan *redisConn, redisPoolSize)}
+	// Connect once up front so a misconfiguration fails at startup
+	conn, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	r.put(conn)
+	return r, nil
+}
+
+// dial connects, authenticates and selects the database from the URL,
+// which is re-read so a rotated password is used for new connections
+func (r *redisStore) dial() (*redisConn, error) {
+	u, err := url.Parse(r.url.Value())
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "") || u.Host == "" {
+		return nil, errors.New("REDIS_URL must look like redis://[:password@]host:6379[/db]")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	conn, err := dialEgress(context.Background(), &net.Dialer{Timeout: redisTimeout}, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if u.User != nil {
+		args := []string{"AUTH"}
+		if password, ok := u.User.Password(); ok {
+			if name := u.User.Username(); name != "" {
+				args = append(args, name)
+			}
+			args = append(args, password)
+		} else {
+			args = append(args, u.User.Username())
+		}
+		if _, err := c.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" && db != "0" {
+		if _, err := c.do("SELECT", db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (r *redisStore) take() (*redisConn, error) {
+	select {
+	case c := <-r.pool:
+		return c, nil
+	default:
+		return r.dial()
+	}
+}
+
+func (r *redisStore) put(c *redisConn) {
+	select {
+	case r.pool <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// do runs a command on a pooled connection. Connections that fail at the
+// transport level are discarded; error replies leave them usable.
+func (r *redisStore) do(args ...string) (any, error) {
+	c, err := r.take()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		c.conn.Close()
+		return nil, err
+	}
+	r.put(c)
+	return reply, err
+}
+
+// do writes a command as a RESP array of bulk strings and reads the reply
+func (c *redisConn) do(args ...string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply decodes one RESP2 reply: strings and nil as []byte, integers as
+// int64 and arrays as []any
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (r *redisStore) get(key string) ([]byte, bool, error) {
+	reply, err := r.do("GET", key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, _ := reply.([]byte)
+	return value, true, nil
+}
+
+func (r *redisStore) set(key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := r.do(args...)
+	return err
+}
+
+func (r *redisStore) delete(key string) error {
+	_, err := r.do("DEL", key)
+	return err
+}
+
+// keys walks the keyspace with SCAN, which unlike KEYS does not block the
+// server on large databases
+func (r *redisStore) keys(prefix string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := r.do("SCAN", cursor, "MATCH", redisGlobEscape(prefix)+"*", "COUNT", "500")
+		if err != nil {
+			return nil, err
+		}
+		parts, _ := reply.([]any)
+		if len(parts) != 2 {
+			return nil, errors.New("redis: malformed SCAN reply")
+		}
+		next, _ := parts[0].([]byte)
+		batch, _ := parts[1].([]any)
+		for _, item := range batch {
+			if key, ok := item.([]byte); ok {
+				keys = append(keys, string(key))
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+func (r *redisStore) incrBy(key string, n int64, ttl time.Duration) (int64, error) {
+	reply, err := r.do("INCRBY", key, strconv.FormatInt(n, 10))
+	if err != nil {
+		return 0, err
+	}
+	total, _ := reply.(int64)
+	// The first increment creates the key and starts its expiry
+	if total == n && ttl > 0 {
+		if _, err := r.do("PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (r *redisStore) shared() bool {
+	return true
+}
+
+// redisGlobEscape escapes glob metacharacters for SCAN MATCH
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, ch := range s {
+		if strings.ContainsRune(`*?[]\`, ch) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(ch)
+	}
+	return b.String()
+}
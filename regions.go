@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// regionConfig is a data residency region: the storage volume audio is
+// written to and the backends that process it. Content tagged with a region
+// is only ever sent to that region's backends, never to the server-wide
+// defaults, so every region declares both of them.
+type regionConfig struct {
+	Upstream
+	StorageDir string `json:"storage_dir"`
+}
+
+// regionTable is the parsed REGIONS
+var regionTable = &secretTable[regionConfig]{name: "REGIONS", parse: parseRegions}
+
+// parseRegions decodes and validates the region table
+func parseRegions(raw string) (map[string]regionConfig, error) {
+	regions := make(map[string]regionConfig)
+	if strings.TrimSpace(raw) == "" {
+		return regions, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &regions); err != nil {
+		return nil, err
+	}
+	for name, region := range regions {
+		if !externalIDPattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid region name %q", name)
+		}
+		if region.AudioURL == "" || region.LLMURL == "" || region.StorageDir == "" {
+			return nil, fmt.Errorf("region %q must set audio_url, llm_url and storage_dir", name)
+		}
+		if !validUpstreamURLs(region.AudioURL) {
+			return nil, fmt.Errorf("region %q: %q is not a list of http(s) URLs", name, region.AudioURL)
+		}
+		if !validUpstreamURL(region.LLMURL) {
+			return nil, fmt.Errorf("region %q: %q is not an http(s) URL", name, region.LLMURL)
+		}
+		if err := region.validateHeaders(); err != nil {
+			return nil, fmt.Errorf("region %q: %v", name, err)
+		}
+	}
+	return regions, nil
+}
+
+// regions returns the current region table
+func regions() map[string]regionConfig {
+	return regionTable.get(config.Regions.Value())
+}
+
+// knownRegion reports whether name is a configured region
+func knownRegion(name string) bool {
+	_, ok := regions()[name]
+	return ok
+}
+
+// resolveRegion picks the region a tenant's request is processed in. A
+// tenant pinned to a region cannot ask for another one; other tenants may
+// tag individual requests.
+func resolveRegion(tenant, requested string) (string, error) {
+	pinned := tenantRegion(tenant)
+	if err := checkRegion(pinned); err != nil {
+		return "", err
+	}
+	switch {
+	case requested == "":
+		return pinned, nil
+	case pinned != "" && requested != pinned:
+		return "", fmt.Errorf("tenant data must stay in region %q", pinned)
+	case !knownRegion(requested):
+		return "", fmt.Errorf("unknown region %q", requested)
+	}
+	return requested, nil
+}
+
+// tenantRegion is the region a tenant is pinned to, if any
+func tenantRegion(tenant string) string {
+	return tenantRoutes()[tenant].Region
+}
+
+// errRegionUnavailable is returned for content tagged with a region that
+// is no longer configured. Such content is refused rather than processed by
+// the server-wide backends or written to the default storage.
+var errRegionUnavailable = errors.New("region is not configured")
+
+// checkRegion fails for a region tag naming no configured region; "" is the
+// default region
+func checkRegion(region string) error {
+	if region != "" && !knownRegion(region) {
+		return fmt.Errorf("%w: %q", errRegionUnavailable, region)
+	}
+	return nil
+}
+
+// regionUnavailableMessage answers requests for content in a region that is
+// no longer configured
+const regionUnavailableMessage = "The data residency region of this content is not available"
+
+// regionStorageDir is where audio tagged with region is written
+func regionStorageDir(region string) (string, error) {
+	if err := checkRegion(region); err != nil {
+		return "", err
+	}
+	if region == "" {
+		return config.StorageDir, nil
+	}
+	return regions()[region].StorageDir, nil
+}
+
+// ingestDir is where uploads tagged with region are received
+func ingestDir(region string) (string, error) {
+	dir, err := regionStorageDir(region)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ingest"), nil
+}
+
+// tenantUpstream returns the backends for a tenant's request in the
+// tenant's region, answering 503 when the region is no longer configured
+func tenantUpstream(w http.ResponseWriter, r *http.Request, tenant string) (Upstream, bool) {
+	up, err := upstreamFor(tenant, tenantRegion(tenant))
+	if err != nil {
+		logErrorf(r.Context(), "Tenant %s: %v", tenant, err)
+		http.Error(w, regionUnavailableMessage, http.StatusServiceUnavailable)
+		return Upstream{}, false
+	}
+	return up, true
+}
+
+// initRegions validates the region table and prepares each storage volume
+func initRegions() {
+	table, err := parseRegions(config.Regions.Value())
+	if err != nil {
+		log.Fatalf("Invalid REGIONS: %v", err)
+	}
+	for name, region := range table {
+		if err := os.MkdirAll(region.StorageDir, 0o750); err != nil {
+			log.Fatalf("Error creating storage directory for region %s: %v", name, err)
+		}
+		logf(context.Background(), "Region %s: storage %s, audio %s, LLM %s", name, region.StorageDir, region.AudioURL, region.LLMURL)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Trend reports aggregate a set of completed transcriptions, such as all
+// weekly 1:1s of a quarter: their topics, volume per week, action items and
+// how much of the audio is speech. They are served as JSON, or as a PDF to
+// pass around.
+
+// maxReportJobs bounds the transcriptions aggregated by one report
+const maxReportJobs = 5000
+
+// defaultReportPeriod is covered when from is not given
+const defaultReportPeriod = 90 * 24 * time.Hour
+
+// TrendReport aggregates the completed transcriptions of a period
+type TrendReport struct {
+	From           time.Time     `json:"from"`
+	To             time.Time     `json:"to"`
+	Tag            string        `json:"tag,omitempty"`
+	Transcriptions int           `json:"transcriptions"`
+	Topics         []TopicCount  `json:"topics"`
+	Weeks          []WeekStats   `json:"weeks"`
+	ActionItems    ActionStats   `json:"action_items"`
+	TalkTime       TalkTimeStats `json:"talk_time"`
+}
+
+// TopicCount is how many transcriptions have a tag
+type TopicCount struct {
+	Tag   string  `json:"tag"`
+	Count int     `json:"count"`
+	Share float64 `json:"share"`
+}
+
+// WeekStats is the volume of an ISO week
+type WeekStats struct {
+	Week           string  `json:"week"`
+	Transcriptions int     `json:"transcriptions"`
+	AudioSeconds   float64 `json:"audio_seconds"`
+}
+
+// ActionStats counts action items by kind and by due date relative to the
+// time of the report. Completion is not tracked, so items past their due
+// date are reported as past due rather than as missed.
+type ActionStats struct {
+	Total            int     `json:"total"`
+	Tasks            int     `json:"tasks"`
+	Meetings         int     `json:"meetings"`
+	PastDue          int     `json:"past_due"`
+	Upcoming         int     `json:"upcoming"`
+	Undated          int     `json:"undated"`
+	PerTranscription float64 `json:"per_transcription"`
+	WithOwner        int     `json:"with_owner"`
+	InTranscriptions int     `json:"in_transcriptions"`
+}
+
+// TalkTimeStats describes the audio. Speech is the time covered by
+// transcript segments; the remainder is silence or inaudible.
+type TalkTimeStats struct {
+	AudioSeconds   float64 `json:"audio_seconds"`
+	AverageSeconds float64 `json:"average_seconds"`
+	SpeechSeconds  float64 `json:"speech_seconds"`
+	SpeechRatio    float64 `json:"speech_ratio"`
+	Words          int     `json:"words"`
+	WordsPerMinute float64 `json:"words_per_minute"`
+}
+
+// parseReportTime accepts a date, read as midnight UTC, or an RFC 3339 time
+func parseReportTime(value string) (time.Time, error) {
+	if t, err := time.Parse(dueDateFormat, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// reportPeriod returns the period [from, to) given by the from and to
+// parameters of q, the last defaultReportPeriod by default, or a message
+// for the client when they are invalid
+func reportPeriod(q url.Values) (time.Time, time.Time, string) {
+	to := time.Now().UTC()
+	if value := q.Get("to"); value != "" {
+		t, err := parseReportTime(value)
+		if err != nil {
+			return time.Time{}, time.Time{}, "to must be a date (2006-01-02) or an RFC 3339 time"
+		}
+		if len(value) == len(dueDateFormat) {
+			// A date includes its whole day
+			t = t.AddDate(0, 0, 1)
+		}
+		to = t
+	}
+	from := to.Add(-defaultReportPeriod)
+	if value := q.Get("from"); value != "" {
+		t, err := parseReportTime(value)
+		if err != nil {
+			return time.Time{}, time.Time{}, "from must be a date (2006-01-02) or an RFC 3339 time"
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, "from must be before to"
+	}
+	return from, to, ""
+}
+
+// buildTrendReport aggregates jobs created in [from, to) at now
+func buildTrendReport(jobs []Job, from, to time.Time, tag string, now time.Time) TrendReport {
+	report := TrendReport{From: from, To: to, Tag: tag, Topics: []TopicCount{}, Weeks: []WeekStats{}}
+	topics := make(map[string]int)
+	weeks := make(map[string]*WeekStats)
+	today := now.UTC().Format(dueDateFormat)
+	for _, job := range jobs {
+		report.Transcriptions++
+		for _, t := range job.Tags {
+			topics[t]++
+		}
+
+		year, week := job.CreatedAt.UTC().ISOWeek()
+		key := fmt.Sprintf("%d-W%02d", year, week)
+		if weeks[key] == nil {
+			weeks[key] = &WeekStats{Week: key}
+		}
+		weeks[key].Transcriptions++
+		weeks[key].AudioSeconds += job.Duration
+
+		if len(job.ActionItems) > 0 {
+			report.ActionItems.InTranscriptions++
+		}
+		for _, item := range job.ActionItems {
+			report.ActionItems.Total++
+			if item.Kind == actionMeeting {
+				report.ActionItems.Meetings++
+			} else {
+				report.ActionItems.Tasks++
+			}
+			if item.Owner != "" {
+				report.ActionItems.WithOwner++
+			}
+			switch {
+			case item.Due == "":
+				report.ActionItems.Undated++
+			case item.Due[:len(dueDateFormat)] < today:
+				report.ActionItems.PastDue++
+			default:
+				report.ActionItems.Upcoming++
+			}
+		}
+
+		report.TalkTime.AudioSeconds += job.Duration
+		report.TalkTime.Words += len(strings.Fields(job.Text))
+		for _, s := range job.Segments {
+			report.TalkTime.SpeechSeconds += max(s.End-s.Start, 0)
+		}
+	}
+
+	for t, count := range topics {
+		report.Topics = append(report.Topics, TopicCount{Tag: t, Count: count, Share: ratio(float64(count), float64(report.Transcriptions))})
+	}
+	sort.Slice(report.Topics, func(i, j int) bool {
+		a, b := report.Topics[i], report.Topics[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.Tag < b.Tag)
+	})
+	for _, w := range weeks {
+		report.Weeks = append(report.Weeks, *w)
+	}
+	sort.Slice(report.Weeks, func(i, j int) bool { return report.Weeks[i].Week < report.Weeks[j].Week })
+
+	n := float64(report.Transcriptions)
+	report.ActionItems.PerTranscription = ratio(float64(report.ActionItems.Total), n)
+	report.TalkTime.AverageSeconds = ratio(report.TalkTime.AudioSeconds, n)
+	report.TalkTime.SpeechRatio = ratio(report.TalkTime.SpeechSeconds, report.TalkTime.AudioSeconds)
+	report.TalkTime.WordsPerMinute = ratio(float64(report.TalkTime.Words), report.TalkTime.SpeechSeconds/60)
+	return report
+}
+
+// ratio divides, rounding to two decimals, and is 0 for an empty set
+func ratio(a, b float64) float64 {
+	if b <= 0 {
+		return 0
+	}
+	return float64(int(a/b*100+0.5)) / 100
+}
+
+// handleTrendReport aggregates the completed transcriptions visible to the
+// caller that were created between from and to, optionally only those with
+// a tag. ?format=pdf, or Accept: application/pdf, downloads a PDF.
+func handleTrendReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, to, msg := reportPeriod(q)
+	if msg != "" {
+		integrationError(w, http.StatusBadRequest, msg)
+		return
+	}
+	filter := jobFilter{Status: jobCompleted}
+	if tag := q.Get("tag"); tag != "" {
+		if filter.Tag = normalizeTag(tag); filter.Tag == "" {
+			integrationError(w, http.StatusBadRequest, "Invalid tag")
+			return
+		}
+	}
+
+	var jobs []Job
+	for _, job := range pipelineJobs.list(principalFrom(r.Context()), filter, maxReportJobs) {
+		if !job.CreatedAt.Before(from) && job.CreatedAt.Before(to) {
+			jobs = append(jobs, job)
+		}
+	}
+	report := buildTrendReport(jobs, from.UTC(), to.UTC(), filter.Tag, time.Now())
+
+	if q.Get("format") == "pdf" || strings.Contains(r.Header.Get("Accept"), "application/pdf") {
+		w.Header().Set("Content-Type", "application/pdf")
+		setAttachment(w, "trends-"+from.Format("20060102")+"-"+to.Format("20060102"), ".pdf")
+		w.Write(renderPDF(report.lines()))
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// pdfLine is a line of text in a PDF report
+type pdfLine struct {
+	Text    string
+	Heading bool
+}
+
+// lines lays out the report for the PDF
+func (t TrendReport) lines() []pdfLine {
+	var lines []pdfLine
+	add := func(format string, args ...any) { lines = append(lines, pdfLine{Text: fmt.Sprintf(format, args...)}) }
+	heading := func(text string) {
+		lines = append(lines, pdfLine{}, pdfLine{Text: text, Heading: true})
+	}
+
+	lines = append(lines, pdfLine{Text: "Transcript trends", Heading: true})
+	add("%s to %s", t.From.Format("Jan 2, 2006"), t.To.Add(-time.Nanosecond).Format("Jan 2, 2006"))
+	if t.Tag != "" {
+		add("Transcriptions tagged %q", t.Tag)
+	}
+	add("%d transcription(s), %s of audio", t.Transcriptions, formatTimestamp(t.TalkTime.AudioSeconds))
+
+	heading("Topics")
+	if len(t.Topics) == 0 {
+		add("No tagged transcriptions")
+	}
+	for _, topic := range t.Topics {
+		add("%-32s %5d   %3.0f%%", topic.Tag, topic.Count, topic.Share*100)
+	}
+
+	heading("Transcriptions per week")
+	for _, week := range t.Weeks {
+		add("%-10s %5d   %s", week.Week, week.Transcriptions, formatTimestamp(week.AudioSeconds))
+	}
+
+	heading("Action items")
+	a := t.ActionItems
+	add("%d action item(s) in %d transcription(s), %.2f per transcription", a.Total, a.InTranscriptions, a.PerTranscription)
+	add("%d task(s), %d meeting(s), %d with an owner", a.Tasks, a.Meetings, a.WithOwner)
+	add("%d past due, %d upcoming, %d undated", a.PastDue, a.Upcoming, a.Undated)
+
+	heading("Talk time")
+	tt := t.TalkTime
+	add("Average length: %s", formatTimestamp(tt.AverageSeconds))
+	add("Speech: %s (%.0f%% of the audio)", formatTimestamp(tt.SpeechSeconds), tt.SpeechRatio*100)
+	add("%d words, %.0f words per minute of speech", tt.Words, tt.WordsPerMinute)
+	return lines
+}
+
+// renderPDF writes lines as a plain A4 PDF. Text is set in Courier, so
+// columns line up, and headings in Helvetica Bold; both are standard fonts
+// that need no embedding. Characters outside Latin-1 are replaced.
+func renderPDF(lines []pdfLine) []byte {
+	const (
+		pageWidth, pageHeight = 595, 842
+		margin                = 56
+		lineHeight            = 15
+		linesPerPage          = (pageHeight - 2*margin) / lineHeight
+	)
+	var pages [][]pdfLine
+	for len(lines) > linesPerPage {
+		pages = append(pages, lines[:linesPerPage])
+		lines = lines[linesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	var buf bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1-4 are the catalog, the page tree and the fonts; each page
+	// then takes two objects, the page and its content
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range pages {
+		var content strings.Builder
+		content.WriteString("BT\n")
+		fmt.Fprintf(&content, "%d %d Td\n", margin, pageHeight-margin)
+		for _, line := range page {
+			font := "/F1 10"
+			if line.Heading {
+				font = "/F2 12"
+			}
+			fmt.Fprintf(&content, "%s Tf (%s) Tj 0 -%d Td\n", font, pdfString(line.Text), lineHeight)
+		}
+		content.WriteString("ET")
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pageWidth, pageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
+
+// pdfString escapes text for a PDF string literal in WinAnsiEncoding
+func pdfString(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '–' || r == '—':
+			b.WriteByte('-')
+		case r == '…':
+			b.WriteString("...")
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		case r >= 160 && r < 256:
+			b.WriteByte(byte(r))
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
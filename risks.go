@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The risks pipeline step analyzes project meetings such as standups and
+// reviews for risks, blockers and dependencies, with a guessed severity and
+// the owning team. The risk register of a period is served as JSON, or as
+// CSV to import into issue trackers and spreadsheets.
+
+// Kinds of risk items
+const (
+	riskRisk       = "risk"
+	riskBlocker    = "blocker"
+	riskDependency = "dependency"
+)
+
+// Severities of risk items
+const (
+	severityLow    = "low"
+	severityMedium = "medium"
+	severityHigh   = "high"
+)
+
+// Risk is a risk, blocker or dependency raised in a meeting
+type Risk struct {
+	Kind     string `json:"kind"`
+	Text     string `json:"text"`
+	Severity string `json:"severity,omitempty"`
+	Team     string `json:"team,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+	// DependsOn is who or what a dependency waits for
+	DependsOn string `json:"depends_on,omitempty"`
+}
+
+// risksPrompt instructs the LLM to answer with JSON only
+const risksPrompt = `You analyze the transcript of a project meeting, such as a standup or a review, for risks, blockers and dependencies. Answer with a JSON array only, without any other text. Each element is an object with the fields:
+- "kind": "blocker" for something currently stopping work, "dependency" for work waiting on another team, person or delivery, or "risk" for something that may go wrong
+- "text": a short description
+- "severity": your estimate of the impact, "low", "medium" or "high"
+- "team": the team that owns it, if it can be told
+- "owner": the person who owns it, if mentioned
+- "depends_on": for dependencies, who or what the work waits for
+Answer with [] when there are none.`
+
+// newRisksRequest builds the chat completion request extracting risks from
+// text
+func newRisksRequest(model, text string) ChatCompletionRequest {
+	return ChatCompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: "system", Content: risksPrompt},
+			{Role: "user", Content: fmt.Sprintf("Transcription:\n\n%s", text)},
+		},
+		Temperature: 0,
+	}
+}
+
+// extractRisks asks the LLM for the risks, blockers and dependencies in
+// text
+func extractRisks(ctx context.Context, up Upstream, text string) ([]Risk, error) {
+	var raw []Risk
+	if err := llmJSON(ctx, up, newRisksRequest(up.LLMModel, text), &raw); err != nil {
+		return nil, err
+	}
+	return cleanRisks(raw), nil
+}
+
+// cleanRisks drops items without text, treats unknown kinds as risks and
+// clears unknown severities
+func cleanRisks(raw []Risk) []Risk {
+	risks := []Risk{}
+	for _, risk := range raw {
+		risk.Text = strings.TrimSpace(risk.Text)
+		if risk.Text == "" {
+			continue
+		}
+		risk.Kind = strings.ToLower(strings.TrimSpace(risk.Kind))
+		if risk.Kind != riskBlocker && risk.Kind != riskDependency {
+			risk.Kind = riskRisk
+		}
+		risk.Severity = strings.ToLower(strings.TrimSpace(risk.Severity))
+		if risk.Severity != severityLow && risk.Severity != severityMedium && risk.Severity != severityHigh {
+			risk.Severity = ""
+		}
+		risk.Team = strings.TrimSpace(risk.Team)
+		risk.Owner = strings.TrimSpace(risk.Owner)
+		risk.DependsOn = strings.TrimSpace(risk.DependsOn)
+		if risk.Kind != riskDependency {
+			risk.DependsOn = ""
+		}
+		risks = append(risks, risk)
+	}
+	return risks
+}
+
+// RiskRecord is a risk in the register, with the meeting it was raised in
+type RiskRecord struct {
+	Risk
+	TranscriptionID string `json:"transcription_id"`
+	Title           string `json:"title"`
+	RecordedAt      string `json:"recorded_at"`
+}
+
+// riskCSVHeader names the columns of the CSV export
+var riskCSVHeader = []string{"kind", "severity", "text", "team", "owner", "depends_on", "meeting", "recorded_at", "transcription_id"}
+
+// csvCell keeps spreadsheets from evaluating text taken from a transcript
+// as a formula
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// writeRisksCSV writes the register as CSV, one row per item
+func writeRisksCSV(w io.Writer, records []RiskRecord) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(riskCSVHeader); err != nil {
+		return err
+	}
+	for _, r := range records {
+		row := []string{r.Kind, r.Severity, r.Text, r.Team, r.Owner, r.DependsOn, r.Title, r.RecordedAt, r.TranscriptionID}
+		for i := range row {
+			row[i] = csvCell(row[i])
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// handleRiskRegister lists the risks of the completed transcriptions
+// visible to the caller that were created between from and to, newest
+// meeting first, optionally of one ?kind=, ?severity= or ?team=, or of one
+// ?transcription=. ?format=csv, or Accept: text/csv, downloads a CSV.
+func handleRiskRegister(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, to, msg := reportPeriod(q)
+	if msg != "" {
+		integrationError(w, http.StatusBadRequest, msg)
+		return
+	}
+	filter := jobFilter{Status: jobCompleted}
+	if tag := q.Get("tag"); tag != "" {
+		if filter.Tag = normalizeTag(tag); filter.Tag == "" {
+			integrationError(w, http.StatusBadRequest, "Invalid tag")
+			return
+		}
+	}
+	kind, severity, team := q.Get("kind"), q.Get("severity"), q.Get("team")
+	if kind != "" && kind != riskRisk && kind != riskBlocker && kind != riskDependency {
+		integrationError(w, http.StatusBadRequest, "kind must be risk, blocker or dependency")
+		return
+	}
+	if severity != "" && severity != severityLow && severity != severityMedium && severity != severityHigh {
+		integrationError(w, http.StatusBadRequest, "severity must be low, medium or high")
+		return
+	}
+	format := negotiate(r, mediaJSON, mediaCSV)
+	if format == "" {
+		integrationError(w, http.StatusNotAcceptable, notAcceptable(mediaJSON, mediaCSV))
+		return
+	}
+
+	var jobs []Job
+	if id := q.Get("transcription"); id != "" {
+		job, ok := pipelineJobs.get(id)
+		if !ok || !principalFrom(r.Context()).sees(job) {
+			integrationError(w, http.StatusNotFound, "Transcription not found")
+			return
+		}
+		jobs = []Job{job}
+	} else {
+		for _, job := range pipelineJobs.list(principalFrom(r.Context()), filter, maxReportJobs) {
+			if !job.CreatedAt.Before(from) && job.CreatedAt.Before(to) {
+				jobs = append(jobs, job)
+			}
+		}
+	}
+
+	records := []RiskRecord{}
+	for _, job := range jobs {
+		for _, risk := range job.Risks {
+			if (kind != "" && risk.Kind != kind) || (severity != "" && risk.Severity != severity) || (team != "" && !strings.EqualFold(risk.Team, team)) {
+				continue
+			}
+			records = append(records, RiskRecord{
+				Risk:            risk,
+				TranscriptionID: job.ID,
+				Title:           jobTitle(job),
+				RecordedAt:      job.CreatedAt.UTC().Format(dueDateFormat),
+			})
+		}
+	}
+
+	w.Header().Set("Vary", "Accept")
+	if format == mediaCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		setAttachment(w, "risks-"+from.Format("20060102")+"-"+to.Format("20060102"), ".csv")
+		if err := writeRisksCSV(w, records); err != nil {
+			logErrorf(r.Context(), "Error writing risks CSV: %v", err)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"risks": records})
+}
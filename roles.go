@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+)
+
+// Roles granted to API keys, from least to most privileged. Viewers read
+// their tenant's transcriptions, editors also start jobs and change or
+// delete the ones they created, and admins manage any job as well as users,
+// integrations and retention through the admin API.
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleEditor: 2, roleAdmin: 3}
+
+// validRole reports whether role is one of the known roles
+func validRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// principal is the identity an API key authenticates as
+type principal struct {
+	// ID is the declared key's ID, a fingerprint of a configured key, or
+	// the owner ID of a browser session
+	ID        string
+	Tenant    string
+	Workspace string
+	Role      string
+}
+
+// can reports whether the principal holds at least role
+func (p principal) can(role string) bool {
+	return roleRank[p.Role] >= roleRank[role]
+}
+
+// sees reports whether the principal may read job: keys of a workspace see
+// its shared library, other keys everything in their tenant
+func (p principal) sees(job Job) bool {
+	return job.Tenant == p.Tenant && (p.Workspace == "" || job.Workspace == p.Workspace)
+}
+
+// owns reports whether the principal may change or delete job: admins any
+// job, editors the ones they created
+func (p principal) owns(job Job) bool {
+	return p.can(roleAdmin) || (p.can(roleEditor) && job.CreatedBy != "" && job.CreatedBy == p.ID)
+}
+
+// keyFingerprint identifies a configured key without revealing it
+func keyFingerprint(key string) string {
+	return "key-" + hashAPIKey(key)[:12]
+}
+
+// principalForKey resolves an API key. Keys from TENANT_ROUTES and
+// INTEGRATION_API_KEYS are editors; INTEGRATION_API_KEYS and declared keys
+// without a tenant belong to the default tenant "".
+func principalForKey(key string) (principal, bool) {
+	if key == "" {
+		return principal{}, false
+	}
+	for name, route := range tenantRoutes() {
+		for _, candidate := range route.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(candidate)) == 1 {
+				return principal{ID: keyFingerprint(key), Tenant: name, Role: roleEditor}, true
+			}
+		}
+	}
+	if k, ok := registry.apiKey(key); ok {
+		role := k.Role
+		if role == "" {
+			// Declared before roles existed
+			role = roleEditor
+		}
+		p := principal{ID: k.ID, Tenant: k.Tenant, Role: role}
+		if k.Workspace != "" {
+			// Members act in their workspace's tenant; keys of a deleted
+			// workspace no longer authenticate
+			ws, ok := registry.workspace(k.Workspace)
+			if !ok {
+				return principal{}, false
+			}
+			p.Tenant, p.Workspace = ws.Tenant, ws.ID
+		}
+		return p, true
+	}
+	for _, candidate := range config.IntegrationAPIKeys.List() {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(candidate)) == 1 {
+			return principal{ID: keyFingerprint(key), Role: roleEditor}, true
+		}
+	}
+	return principal{}, false
+}
+
+type principalContextKey struct{}
+
+// withPrincipal records who a request was authenticated as
+func withPrincipal(r *http.Request, p principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p))
+}
+
+// principalFrom returns the principal recorded by withPrincipal
+func principalFrom(ctx context.Context) principal {
+	p, _ := ctx.Value(principalContextKey{}).(principal)
+	return p
+}
+
+// browserPrincipal authenticates the web UI endpoints, which upload
+// content: anonymous requests use the default tenant under the owner ID of
+// their browser session, while a presented API key must be valid and hold
+// the editor role
+func browserPrincipal(w http.ResponseWriter, r *http.Request) (principal, bool) {
+	key := requestAPIKey(r)
+	if key == "" {
+		return principal{ID: ensureBrowserSession(w, r)}, true
+	}
+	p, ok := principalForKey(key)
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return principal{}, false
+	}
+	if !p.can(roleEditor) {
+		http.Error(w, "API key role does not allow uploads", http.StatusForbidden)
+		return principal{}, false
+	}
+	return p, true
+}
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	// Rooms keep their schedule in local time, and the runtime image
+	// ships without a time zone database
+	_ "time/tzdata"
+)
+
+// Meeting rooms record their scheduled meetings with a device installed in
+// the room, such as a tablet or a Raspberry Pi with a conference
+// microphone. Rooms and their weekly calendar are declared through the
+// admin API. An admin issues a short-lived PIN that is entered on the
+// device, which trades it for a device token. During each meeting the
+// device streams the room audio as one long chunked upload; once the
+// stream ends, the recording is transcribed by the room's pipeline and
+// filed under the room and the meeting.
+
+// Room limits
+const (
+	maxRoomEvents          = 50
+	maxRoomEventTitle      = 60
+	defaultScheduleHours   = 24
+	maxScheduleHours       = 7 * 24
+	defaultMeetingListDays = 7
+	maxMeetingListDays     = 92
+	// maxPairingFailures is the number of wrong PINs accepted across all
+	// rooms per ROOM_PAIRING_TTL, which keeps PINs from being guessed
+	maxPairingFailures = 20
+)
+
+// A device may start streaming roomRecordingLead before a meeting starts,
+// and its stream is cut off once the meeting has overrun by
+// roomRecordingGrace
+const (
+	roomRecordingLead  = 5 * time.Minute
+	roomRecordingGrace = 15 * time.Minute
+)
+
+// roomRecordingRetention keeps the marker of a recorded meeting until
+// after the meeting can no longer be streamed
+const roomRecordingRetention = 48 * time.Hour
+
+// State store namespaces: pairings by the hash of their PIN, devices by the
+// hash of their token, and meetings whose recording has started
+const (
+	roomPairingKeyPrefix   = "room-pairing:"
+	roomPairingFailureKey  = "room-pairing-failures"
+	roomDeviceKeyPrefix    = "room-device:"
+	roomRecordingKeyPrefix = "room-recording:"
+)
+
+// meetingDateFormat is the date in meeting IDs and schedules
+const meetingDateFormat = "2006-01-02"
+
+// roomWeekdays are the days a weekly event can repeat on
+var roomWeekdays = map[string]time.Weekday{
+	"mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday,
+	"fri": time.Friday, "sat": time.Saturday, "sun": time.Sunday,
+}
+
+// RoomEvent is a meeting on a room's calendar: weekly on Days, or once on
+// Date. Start and End are local times such as "09:30".
+type RoomEvent struct {
+	ID    string   `json:"id"`
+	Title string   `json:"title"`
+	Days  []string `json:"days,omitempty"`
+	Date  string   `json:"date,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// Room is a meeting room whose meetings are recorded by a paired device
+type Room struct {
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	Workspace string `json:"workspace,omitempty"`
+	// Pipeline processes the recordings, transcribe_summarize by default
+	Pipeline string      `json:"pipeline,omitempty"`
+	Language string      `json:"language,omitempty"`
+	TimeZone string      `json:"time_zone,omitempty"`
+	Events   []RoomEvent `json:"events"`
+}
+
+func (room *Room) validate() error {
+	if room.Tenant != "" && !knownTenant(room.Tenant) {
+		return fmt.Errorf("tenant %q is not in TENANT_ROUTES", room.Tenant)
+	}
+	// A workspace room's tenant is the workspace's
+	if room.Workspace != "" && room.Tenant != "" {
+		return errors.New("workspace rooms cannot name a tenant")
+	}
+	if room.Pipeline == "" {
+		room.Pipeline = pipelineTranscribeSummarize
+	}
+	if room.Language != "" && !localePattern.MatchString(room.Language) {
+		return fmt.Errorf("language %q is not a language tag such as de or pt-BR", room.Language)
+	}
+	if room.TimeZone == "" {
+		room.TimeZone = "UTC"
+	}
+	if _, err := time.LoadLocation(room.TimeZone); err != nil {
+		return fmt.Errorf("time_zone %q is not a time zone such as Europe/Berlin", room.TimeZone)
+	}
+	if len(room.Events) > maxRoomEvents {
+		return fmt.Errorf("events can list at most %d events", maxRoomEvents)
+	}
+	seen := make(map[string]bool)
+	for i := range room.Events {
+		e := &room.Events[i]
+		if !externalIDPattern.MatchString(e.ID) {
+			return fmt.Errorf("event %d needs an id of letters, digits, dots, dashes or underscores", i+1)
+		}
+		if seen[e.ID] {
+			return fmt.Errorf("event %q is repeated", e.ID)
+		}
+		seen[e.ID] = true
+		e.Title = strings.TrimSpace(e.Title)
+		if e.Title == "" || len([]rune(e.Title)) > maxRoomEventTitle {
+			return fmt.Errorf("event %q needs a title of at most %d characters", e.ID, maxRoomEventTitle)
+		}
+		start, err1 := time.Parse("15:04", e.Start)
+		end, err2 := time.Parse("15:04", e.End)
+		if err1 != nil || err2 != nil || !end.After(start) {
+			return fmt.Errorf("event %q needs a start and a later end such as 09:30 and 10:15", e.ID)
+		}
+		if (len(e.Days) > 0) == (e.Date != "") {
+			return fmt.Errorf("event %q needs either days to repeat on or a date", e.ID)
+		}
+		for j, day := range e.Days {
+			e.Days[j] = strings.ToLower(day)
+			if _, ok := roomWeekdays[e.Days[j]]; !ok {
+				return fmt.Errorf("event %q has unknown day %q (expected mon to sun)", e.ID, day)
+			}
+		}
+		if _, err := time.Parse(meetingDateFormat, e.Date); e.Date != "" && err != nil {
+			return fmt.Errorf("event %q has date %q, expected YYYY-MM-DD", e.ID, e.Date)
+		}
+	}
+	return nil
+}
+
+func (room *Room) redacted() adminResource {
+	c := *room
+	return &c
+}
+
+// room returns a declared room
+func (r *adminRegistry) room(id string) (*Room, bool) {
+	res, ok := r.get(kindRooms, id)
+	if !ok {
+		return nil, false
+	}
+	return res.(*Room), true
+}
+
+// tenant is the tenant the room's recordings belong to
+func (room *Room) tenant() string {
+	if ws, ok := registry.workspace(room.Workspace); ok {
+		return ws.Tenant
+	}
+	return room.Tenant
+}
+
+// visibleTo reports whether p may see the room and its meetings, like the
+// jobs it files
+func (room *Room) visibleTo(p principal) bool {
+	return room.tenant() == p.Tenant && (p.Workspace == "" || room.Workspace == p.Workspace)
+}
+
+// location returns the room's time zone, validated when it was declared
+func (room *Room) location() *time.Location {
+	loc, err := time.LoadLocation(room.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// RoomMeeting is one occurrence of a room's event. Its ID is the event's
+// followed by the local date, such as "standup@2026-10-19".
+type RoomMeeting struct {
+	ID    string    `json:"id"`
+	Event string    `json:"event"`
+	Title string    `json:"title"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Recorded reports whether a device has started recording it
+	Recorded bool `json:"recorded"`
+	// Transcriptions are the IDs of the jobs filed under the meeting
+	Transcriptions []string `json:"transcriptions,omitempty"`
+}
+
+// occurrence returns the meeting of event e on day, midnight in the room's
+// time zone, if the event takes place that day
+func (e RoomEvent) occurrence(day time.Time) (RoomMeeting, bool) {
+	date := day.Format(meetingDateFormat)
+	occurs := e.Date == date
+	for _, d := range e.Days {
+		occurs = occurs || roomWeekdays[d] == day.Weekday()
+	}
+	if !occurs {
+		return RoomMeeting{}, false
+	}
+	start, _ := time.Parse("15:04", e.Start)
+	end, _ := time.Parse("15:04", e.End)
+	at := func(clock time.Time) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, day.Location())
+	}
+	return RoomMeeting{ID: e.ID + "@" + date, Event: e.ID, Title: e.Title, Start: at(start), End: at(end)}, true
+}
+
+// meetings returns the meetings overlapping from to to, in order
+func (room *Room) meetings(from, to time.Time) []RoomMeeting {
+	loc := room.location()
+	local := from.In(loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	meetings := []RoomMeeting{}
+	for ; day.Before(to); day = time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, loc) {
+		for _, e := range room.Events {
+			if m, ok := e.occurrence(day); ok && m.End.After(from) && m.Start.Before(to) {
+				meetings = append(meetings, m)
+			}
+		}
+	}
+	sort.SliceStable(meetings, func(i, j int) bool { return meetings[i].Start.Before(meetings[j].Start) })
+	return meetings
+}
+
+// meeting looks up a meeting by ID
+func (room *Room) meeting(id string) (RoomMeeting, bool) {
+	eventID, date, _ := strings.Cut(id, "@")
+	day, err := time.ParseInLocation(meetingDateFormat, date, room.location())
+	if err != nil {
+		return RoomMeeting{}, false
+	}
+	for _, e := range room.Events {
+		if e.ID == eventID {
+			return e.occurrence(day)
+		}
+	}
+	return RoomMeeting{}, false
+}
+
+// recordingKey marks a meeting whose recording has started
+func recordingKey(room, meeting string) string {
+	return roomRecordingKeyPrefix + room + ":" + meeting
+}
+
+// markRecorded fills in which meetings have been recorded
+func markRecorded(room string, meetings []RoomMeeting) {
+	for i := range meetings {
+		_, ok, err := state.get(recordingKey(room, meetings[i].ID))
+		meetings[i].Recorded = ok && err == nil
+	}
+}
+
+// RoomDevice is a device paired to a room. Only a hash of its token is
+// stored; the token is returned once, when the device is paired.
+type RoomDevice struct {
+	ID       string    `json:"id"`
+	Room     string    `json:"room"`
+	Name     string    `json:"name,omitempty"`
+	PairedAt time.Time `json:"paired_at"`
+}
+
+// roomDeviceRecord is how a device is kept in the state store
+type roomDeviceRecord struct {
+	RoomDevice
+	TokenHash string `json:"token_sha256"`
+}
+
+// roomPairing is a PIN waiting to be entered on a device
+type roomPairing struct {
+	Room      string    `json:"room"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// pairingPIN returns a random six-digit PIN
+func pairingPIN() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%06d", n.Int64())
+}
+
+// roomDevices lists the devices paired to a room
+func roomDevices(room string) ([]roomDeviceRecord, error) {
+	keys, err := state.keys(roomDeviceKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	devices := []roomDeviceRecord{}
+	for _, key := range keys {
+		data, ok, err := state.get(key)
+		if err != nil {
+			return nil, err
+		}
+		var d roomDeviceRecord
+		if !ok || json.Unmarshal(data, &d) != nil || d.Room != room {
+			continue
+		}
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].PairedAt.Before(devices[j].PairedAt) })
+	return devices, nil
+}
+
+// handleRoomPairingCreate issues a PIN that pairs a device to a room
+func handleRoomPairingCreate(w http.ResponseWriter, r *http.Request) {
+	room, ok := registry.room(r.PathValue("id"))
+	if !ok {
+		integrationError(w, http.StatusNotFound, "Room not found")
+		return
+	}
+	pairing := roomPairing{Room: room.ID, ExpiresAt: time.Now().UTC().Add(config.RoomPairingTTL)}
+	data, err := json.Marshal(pairing)
+	if err != nil {
+		logErrorf(r.Context(), "Error encoding pairing for room %s: %v", room.ID, err)
+		integrationError(w, http.StatusInternalServerError, "Error saving pairing")
+		return
+	}
+	// Draw again rather than replace another room's pending PIN
+	for attempt := 0; attempt < 5; attempt++ {
+		pin := pairingPIN()
+		key := roomPairingKeyPrefix + hashAPIKey(pin)
+		_, taken, err := state.get(key)
+		if err == nil && taken {
+			continue
+		}
+		if err == nil {
+			err = state.set(key, data, config.RoomPairingTTL)
+		}
+		if err != nil {
+			logErrorf(r.Context(), "Error saving pairing for room %s: %v", room.ID, err)
+			integrationError(w, http.StatusInternalServerError, "Error saving pairing")
+			return
+		}
+		logf(r.Context(), "Admin: issued a pairing PIN for room %s", room.ID)
+		writeJSON(w, http.StatusCreated, map[string]any{"pin": pin, "room": room.ID, "expires_at": pairing.ExpiresAt})
+		return
+	}
+	integrationError(w, http.StatusServiceUnavailable, "Too many pending pairings, please retry later")
+}
+
+// handleRoomDeviceList lists the devices paired to a room
+func handleRoomDeviceList(w http.ResponseWriter, r *http.Request) {
+	devices, err := roomDevices(r.PathValue("id"))
+	if err != nil {
+		logErrorf(r.Context(), "Error listing devices: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error listing devices")
+		return
+	}
+	items := make([]RoomDevice, 0, len(devices))
+	for _, d := range devices {
+		items = append(items, d.RoomDevice)
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// handleRoomDeviceDelete unpairs a device, revoking its token
+func handleRoomDeviceDelete(w http.ResponseWriter, r *http.Request) {
+	devices, err := roomDevices(r.PathValue("id"))
+	if err != nil {
+		logErrorf(r.Context(), "Error listing devices: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error unpairing device")
+		return
+	}
+	for _, d := range devices {
+		if d.ID == r.PathValue("device") {
+			if err := state.delete(roomDeviceKeyPrefix + d.TokenHash); err != nil {
+				logErrorf(r.Context(), "Error unpairing device %s: %v", d.ID, err)
+				integrationError(w, http.StatusInternalServerError, "Error unpairing device")
+				return
+			}
+			logf(r.Context(), "Admin: unpaired device %s from room %s", d.ID, d.Room)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDevicePair redeems a pairing PIN for a device token. The PIN is the
+// credential, so no API key is needed; wrong PINs are counted so that they
+// cannot be guessed.
+func handleDevicePair(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PIN  string `json:"pin"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&req); err != nil || req.PIN == "" {
+		integrationError(w, http.StatusBadRequest, "pin is required")
+		return
+	}
+	if failures, err := state.incrBy(roomPairingFailureKey, 0, config.RoomPairingTTL); err == nil && failures >= maxPairingFailures {
+		integrationError(w, http.StatusTooManyRequests, "Too many wrong PINs, please retry later")
+		return
+	}
+	key := roomPairingKeyPrefix + hashAPIKey(strings.TrimSpace(req.PIN))
+	data, ok, err := state.get(key)
+	var pairing roomPairing
+	if err == nil && ok {
+		err = json.Unmarshal(data, &pairing)
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Error reading pairing: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error reading pairing")
+		return
+	}
+	if !ok {
+		state.incrBy(roomPairingFailureKey, 1, config.RoomPairingTTL)
+		integrationError(w, http.StatusNotFound, "PIN not found or expired")
+		return
+	}
+	room, ok := registry.room(pairing.Room)
+	if !ok {
+		integrationError(w, http.StatusNotFound, "Room no longer exists")
+		return
+	}
+	// Redeem once: the first request to delete the pairing wins
+	if err := state.delete(key); err != nil {
+		logErrorf(r.Context(), "Error redeeming pairing for room %s: %v", room.ID, err)
+		integrationError(w, http.StatusInternalServerError, "Error redeeming pairing")
+		return
+	}
+
+	token := randomToken("dev_")
+	hash := hashAPIKey(token)
+	device := roomDeviceRecord{
+		RoomDevice: RoomDevice{ID: hash[:16], Room: room.ID, Name: strings.TrimSpace(req.Name), PairedAt: time.Now().UTC()},
+		TokenHash:  hash,
+	}
+	data, err = json.Marshal(device)
+	if err == nil {
+		err = state.set(roomDeviceKeyPrefix+hash, data, 0)
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Error saving device for room %s: %v", room.ID, err)
+		integrationError(w, http.StatusInternalServerError, "Error pairing device")
+		return
+	}
+	logf(r.Context(), "Device %s paired to room %s", device.ID, room.ID)
+	writeJSON(w, http.StatusCreated, struct {
+		RoomDevice
+		Token    string `json:"token"`
+		TimeZone string `json:"time_zone"`
+	}{device.RoomDevice, token, room.TimeZone})
+}
+
+// requireRoomDevice authenticates a paired device by its token. Devices of
+// a deleted room no longer authenticate.
+func requireRoomDevice(next func(http.ResponseWriter, *http.Request, RoomDevice, *Room)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := requestAPIKey(r)
+		if token == "" {
+			integrationError(w, http.StatusUnauthorized, "Missing device token")
+			return
+		}
+		data, ok, err := state.get(roomDeviceKeyPrefix + hashAPIKey(token))
+		if err != nil {
+			logErrorf(r.Context(), "Error reading device: %v", err)
+			integrationError(w, http.StatusInternalServerError, "Error reading device")
+			return
+		}
+		var device roomDeviceRecord
+		if ok && json.Unmarshal(data, &device) != nil {
+			ok = false
+		}
+		room, exists := registry.room(device.Room)
+		if !ok || !exists {
+			integrationError(w, http.StatusUnauthorized, "Invalid device token")
+			return
+		}
+		next(w, r, device.RoomDevice, room)
+	}
+}
+
+// handleDeviceSchedule tells a device when to record: the meetings in
+// progress or starting in the next ?hours= (default 24)
+func handleDeviceSchedule(w http.ResponseWriter, r *http.Request, device RoomDevice, room *Room) {
+	hours := defaultScheduleHours
+	if value := r.URL.Query().Get("hours"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxScheduleHours {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("hours must be a whole number up to %d", maxScheduleHours))
+			return
+		}
+		hours = n
+	}
+	now := time.Now()
+	meetings := room.meetings(now, now.Add(time.Duration(hours)*time.Hour))
+	markRecorded(room.ID, meetings)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"room":      room.ID,
+		"name":      room.Name,
+		"time_zone": room.TimeZone,
+		"now":       now.UTC(),
+		"meetings":  meetings,
+	})
+}
+
+// handleDeviceRecording receives the audio a device streams during a
+// meeting and, once the stream ends, transcribes it. A meeting is recorded
+// once; when the stream breaks off, what arrived is transcribed.
+func handleDeviceRecording(w http.ResponseWriter, r *http.Request, device RoomDevice, room *Room) {
+	meeting, ok := room.meeting(r.PathValue("meeting"))
+	if !ok {
+		integrationError(w, http.StatusNotFound, "Meeting not found")
+		return
+	}
+	now := time.Now()
+	if now.Before(meeting.Start.Add(-roomRecordingLead)) || !now.Before(meeting.End) {
+		integrationError(w, http.StatusConflict, "Meeting is not in progress")
+		return
+	}
+	if !validPipeline(room.Pipeline) {
+		integrationError(w, http.StatusConflict, fmt.Sprintf("Room's pipeline %q no longer exists", room.Pipeline))
+		return
+	}
+	tenant := room.tenant()
+	region, err := resolveRegion(tenant, "")
+	if err != nil {
+		integrationError(w, http.StatusConflict, "Invalid region: "+err.Error())
+		return
+	}
+	if refuseUnderDiskPressure(w, true) || refuseWhileShuttingDown(w, true) || refuseJobDuringMaintenance(w, true) || refuseWhenQueueFull(w, true) {
+		return
+	}
+	warnings, msg, ok := admitWorkspaceJob(w, room.Workspace)
+	if !ok {
+		integrationError(w, http.StatusTooManyRequests, msg)
+		return
+	}
+
+	// Claim the meeting: the first stream to count it records it
+	marker := recordingKey(room.ID, meeting.ID)
+	if n, err := state.incrBy(marker, 1, roomRecordingRetention); err != nil {
+		logErrorf(r.Context(), "Error claiming meeting %s in room %s: %v", meeting.ID, room.ID, err)
+		integrationError(w, http.StatusInternalServerError, "Error starting recording")
+		return
+	} else if n > 1 {
+		integrationError(w, http.StatusConflict, "Meeting is already being recorded")
+		return
+	}
+	path, err := receiveRoomStream(w, r, meeting, region)
+	if err != nil {
+		// Nothing was recorded, so the device may try again
+		state.delete(marker)
+		switch {
+		case errors.Is(err, errRegionUnavailable):
+			integrationError(w, http.StatusServiceUnavailable, regionUnavailableMessage)
+		case errors.Is(err, errUnsupportedAudio):
+			integrationError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, errNoConverter):
+			integrationError(w, http.StatusUnsupportedMediaType, err.Error())
+		default:
+			logErrorf(r.Context(), "Error receiving meeting %s in room %s: %v", meeting.ID, room.ID, err)
+			integrationError(w, http.StatusInternalServerError, "Error receiving audio")
+		}
+		return
+	}
+
+	req := PipelineRequest{
+		Pipeline:  room.Pipeline,
+		Title:     meeting.Title + ", " + meeting.Start.Format("2 January 2006"),
+		Language:  room.Language,
+		Tenant:    tenant,
+		Region:    region,
+		Workspace: room.Workspace,
+		CreatedBy: device.ID,
+		Room:      room.ID,
+		Meeting:   meeting.ID,
+		Recording: path,
+	}
+	if definition, ok := registry.pipeline(req.Pipeline); ok && req.Language == "" {
+		req.Language = definition.Language
+	}
+	job := startPipeline(r.Context(), req)
+	job.QuotaWarnings = warnings
+	w.Header().Set("Location", "/integrations/v1/transcriptions/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// receiveRoomStream stores the audio streamed for a meeting in the ingest
+// directory and returns its path. The stream is cut off once the meeting
+// has overrun by roomRecordingGrace.
+func receiveRoomStream(w http.ResponseWriter, r *http.Request, meeting RoomMeeting, region string) (string, error) {
+	http.NewResponseController(w).SetReadDeadline(meeting.End.Add(roomRecordingGrace))
+	body := http.MaxBytesReader(w, r.Body, maxUploadSize)
+	dir, err := ingestDir(region)
+	if err != nil {
+		return "", err
+	}
+	path, err := receiveAudio(body, dir, "room-*")
+	if path == "" {
+		return "", err
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		logf(r.Context(), "Meeting %s: recording cut off at %d bytes", meeting.ID, maxUploadSize)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		logf(r.Context(), "Meeting %s: recording cut off %s after the meeting ended", meeting.ID, roomRecordingGrace)
+	case err != nil:
+		logWarnf(r.Context(), "Meeting %s: stream broke off: %v", meeting.ID, err)
+	}
+	if filepath.Ext(path) == "."+audioWAV {
+		if err := fixStreamedWAV(path); err != nil {
+			os.Remove(path)
+			return "", fmt.Errorf("%w: %v", errUnsupportedAudio, err)
+		}
+	}
+	return path, nil
+}
+
+// fixStreamedWAV sets the sizes in the header of WAV audio that was
+// streamed, which a recorder cannot know when it writes the header
+func fixStreamedWAV(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	found, err := walkWAV(f, size, func(id string, body, length int64) (bool, error) {
+		if id != "data" {
+			return false, nil
+		}
+		if length > 0 && body+length <= size {
+			// Sized by a recorder that finished the file
+			return true, nil
+		}
+		field := make([]byte, 4)
+		binary.LittleEndian.PutUint32(field, uint32(size-body))
+		if _, err := f.WriteAt(field, body-4); err != nil {
+			return false, err
+		}
+		binary.LittleEndian.PutUint32(field, uint32(size-8))
+		_, err := f.WriteAt(field, 4)
+		return true, err
+	})
+	if err == nil && !found {
+		err = errors.New("WAV audio has no data chunk")
+	}
+	return err
+}
+
+// handleIntegrationRooms lists the rooms visible to the caller
+func handleIntegrationRooms(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	rooms := []*Room{}
+	for _, res := range registry.list(kindRooms) {
+		if room := res.(*Room); room.visibleTo(p) {
+			rooms = append(rooms, room)
+		}
+	}
+	writeJSON(w, http.StatusOK, rooms)
+}
+
+// handleRoomMeetings lists a room's meetings between ?from= and ?to=
+// (dates in the room's time zone, default the last 7 days) with the
+// transcriptions filed under each
+func handleRoomMeetings(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	room, ok := registry.room(r.PathValue("id"))
+	if !ok || !room.visibleTo(p) {
+		integrationError(w, http.StatusNotFound, "Room not found")
+		return
+	}
+	loc := room.location()
+	now := time.Now().In(loc)
+	to := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, loc)
+	from := to.AddDate(0, 0, -defaultMeetingListDays)
+	if value := r.URL.Query().Get("to"); value != "" {
+		day, err := time.ParseInLocation(meetingDateFormat, value, loc)
+		if err != nil {
+			integrationError(w, http.StatusBadRequest, "to must be a date such as 2026-10-19")
+			return
+		}
+		to = day.AddDate(0, 0, 1)
+		from = to.AddDate(0, 0, -defaultMeetingListDays)
+	}
+	if value := r.URL.Query().Get("from"); value != "" {
+		day, err := time.ParseInLocation(meetingDateFormat, value, loc)
+		if err != nil {
+			integrationError(w, http.StatusBadRequest, "from must be a date such as 2026-10-19")
+			return
+		}
+		from = day
+	}
+	if !from.Before(to) || to.Sub(from) > maxMeetingListDays*24*time.Hour {
+		integrationError(w, http.StatusBadRequest, fmt.Sprintf("from must be before to, at most %d days apart", maxMeetingListDays))
+		return
+	}
+
+	meetings := room.meetings(from, to)
+	markRecorded(room.ID, meetings)
+	filed := make(map[string][]string)
+	for _, job := range pipelineJobs.list(p, jobFilter{Room: room.ID, Duplicates: true}, maxJobListLimit) {
+		filed[job.Meeting] = append(filed[job.Meeting], job.ID)
+	}
+	for i := range meetings {
+		meetings[i].Transcriptions = filed[meetings[i].ID]
+	}
+	writeJSON(w, http.StatusOK, meetings)
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Scorecards are the criteria call reviews are judged on, such as "greets
+// the customer by name" or "confirms the next steps", each with a weight.
+// They are declared through the admin API and applied by pipelines with the
+// scorecard step: the LLM rates every criterion from 0 to 10 and quotes the
+// transcript in support. Quotes that are not in the transcript are dropped.
+// Scores outlive their jobs for SCORECARD_RETENTION_DAYS, by agent (the
+// job's user_id), so managers can follow them over time.
+
+// Scorecard limits
+const (
+	maxScorecardCriteria    = 20
+	maxCriterionDescription = 500
+	maxCriterionQuotes      = 3
+	maxCriterionQuoteLength = 300
+	maxCriterionScore       = 10
+	defaultScoreListLimit   = 100
+)
+
+// scorecardScoreKeyPrefix namespaces scores in the state store, keyed by
+// scorecard and job
+const scorecardScoreKeyPrefix = "scorecard-score:"
+
+// ScorecardCriterion is one thing a call is judged on
+type ScorecardCriterion struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	// Weight is the criterion's share of the total, relative to the others
+	Weight float64 `json:"weight,omitempty"`
+}
+
+// Scorecard is a declared set of weighted criteria
+type Scorecard struct {
+	ID          string               `json:"id"`
+	Description string               `json:"description,omitempty"`
+	Criteria    []ScorecardCriterion `json:"criteria"`
+}
+
+func (s *Scorecard) validate() error {
+	if len(s.Criteria) == 0 || len(s.Criteria) > maxScorecardCriteria {
+		return fmt.Errorf("criteria must list 1 to %d criteria", maxScorecardCriteria)
+	}
+	seen := make(map[string]bool)
+	for i := range s.Criteria {
+		c := &s.Criteria[i]
+		if !externalIDPattern.MatchString(c.ID) {
+			return fmt.Errorf("criterion %d needs an id of letters, digits, dots, dashes or underscores", i+1)
+		}
+		if seen[c.ID] {
+			return fmt.Errorf("criterion %q is repeated", c.ID)
+		}
+		seen[c.ID] = true
+		c.Description = strings.TrimSpace(c.Description)
+		if c.Description == "" || len([]rune(c.Description)) > maxCriterionDescription {
+			return fmt.Errorf("criterion %q needs a description of at most %d characters", c.ID, maxCriterionDescription)
+		}
+		if c.Weight == 0 {
+			c.Weight = 1
+		}
+		if c.Weight < 0 {
+			return fmt.Errorf("criterion %q has a negative weight", c.ID)
+		}
+	}
+	return nil
+}
+
+func (s *Scorecard) redacted() adminResource {
+	c := *s
+	return &c
+}
+
+// scorecard returns a declared scorecard
+func (r *adminRegistry) scorecard(id string) (*Scorecard, bool) {
+	res, ok := r.get(kindScorecards, id)
+	if !ok {
+		return nil, false
+	}
+	return res.(*Scorecard), true
+}
+
+// CriterionScore is the rating of one criterion for a call
+type CriterionScore struct {
+	Criterion string   `json:"criterion"`
+	Score     int      `json:"score"`
+	Weight    float64  `json:"weight"`
+	Rationale string   `json:"rationale,omitempty"`
+	Quotes    []string `json:"quotes"`
+}
+
+// CallScore is a call rated against a scorecard. Score is the weighted
+// average of the rated criteria, from 0 to 100.
+type CallScore struct {
+	Scorecard string           `json:"scorecard"`
+	Score     float64          `json:"score"`
+	Criteria  []CriterionScore `json:"criteria"`
+}
+
+// scorecardPrompt instructs the LLM to answer with JSON only
+const scorecardPrompt = `You review a recorded call against a scorecard. Rate how well the agent met each criterion from 0 (not at all) to 10 (fully). Answer with a JSON array only, without any other text, with one object per criterion:
+- "criterion": the id of the criterion
+- "score": the rating, a whole number from 0 to 10
+- "rationale": one sentence explaining the rating
+- "quotes": up to three short passages copied word for word from the transcript that support the rating`
+
+// newScorecardRequest builds the chat completion request rating text
+// against a scorecard
+func newScorecardRequest(model string, card *Scorecard, text string) ChatCompletionRequest {
+	var criteria strings.Builder
+	for _, c := range card.Criteria {
+		fmt.Fprintf(&criteria, "- %s: %s\n", c.ID, c.Description)
+	}
+	return ChatCompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: "system", Content: scorecardPrompt},
+			{Role: "user", Content: fmt.Sprintf("Criteria:\n\n%s\nTranscription:\n\n%s", criteria.String(), text)},
+		},
+		Temperature: 0,
+	}
+}
+
+// scoreCall asks the LLM to rate text against a scorecard
+func scoreCall(ctx context.Context, up Upstream, card *Scorecard, text string) (*CallScore, error) {
+	var raw []criterionRating
+	if err := llmJSON(ctx, up, newScorecardRequest(up.LLMModel, card, text), &raw); err != nil {
+		return nil, err
+	}
+	return rateCall(raw, card, text)
+}
+
+// criterionRating is how the LLM rates one criterion
+type criterionRating struct {
+	Criterion string      `json:"criterion"`
+	Score     json.Number `json:"score"`
+	Rationale string      `json:"rationale"`
+	Quotes    []string    `json:"quotes"`
+}
+
+// quoteKey lowercases text and reduces it to its letters and digits, so
+// quotes match the transcript despite punctuation and spacing
+func quoteKey(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// rateCall scores a call from the LLM's ratings. Unknown criteria are
+// dropped, as are criteria rated more than once after the first; criteria
+// the LLM did not rate are left out of the total. Scores are clamped to
+// 0..10, and quotes not found in text are dropped.
+func rateCall(raw []criterionRating, card *Scorecard, text string) (*CallScore, error) {
+	transcript := quoteKey(text)
+	rated := make(map[string]CriterionScore)
+	for _, r := range raw {
+		if _, ok := rated[r.Criterion]; ok {
+			continue
+		}
+		value, err := r.Score.Float64()
+		if err != nil {
+			continue
+		}
+		score := CriterionScore{
+			Criterion: r.Criterion,
+			Score:     min(max(int(value+0.5), 0), maxCriterionScore),
+			Rationale: strings.TrimSpace(r.Rationale),
+			Quotes:    []string{},
+		}
+		for _, quote := range r.Quotes {
+			quote = strings.TrimSpace(quote)
+			key := quoteKey(quote)
+			if key == "" || !strings.Contains(transcript, key) || len(score.Quotes) == maxCriterionQuotes {
+				continue
+			}
+			if runes := []rune(quote); len(runes) > maxCriterionQuoteLength {
+				quote = string(runes[:maxCriterionQuoteLength-1]) + "…"
+			}
+			score.Quotes = append(score.Quotes, quote)
+		}
+		rated[r.Criterion] = score
+	}
+
+	result := &CallScore{Scorecard: card.ID, Criteria: []CriterionScore{}}
+	total, weights := 0.0, 0.0
+	for _, c := range card.Criteria {
+		score, ok := rated[c.ID]
+		if !ok {
+			continue
+		}
+		score.Weight = c.Weight
+		result.Criteria = append(result.Criteria, score)
+		total += float64(score.Score) * c.Weight
+		weights += c.Weight
+	}
+	if len(result.Criteria) == 0 {
+		return nil, &UpstreamError{Service: "LLM", Message: "scorecard answer rates none of the criteria"}
+	}
+	result.Score = ratio(total*100/maxCriterionScore, weights)
+	return result, nil
+}
+
+// ScoredCall is a call's score as kept over time
+type ScoredCall struct {
+	CallScore
+	TranscriptionID string    `json:"transcription_id"`
+	Title           string    `json:"title"`
+	Agent           string    `json:"agent,omitempty"`
+	RecordedAt      time.Time `json:"recorded_at"`
+}
+
+// scoreRecord is a score in the state store, with the visibility of its job
+type scoreRecord struct {
+	ScoredCall
+	Tenant    string `json:"tenant,omitempty"`
+	Workspace string `json:"workspace,omitempty"`
+}
+
+// saveScore keeps a job's score for SCORECARD_RETENTION_DAYS
+func saveScore(job Job, score *CallScore) error {
+	record := scoreRecord{
+		ScoredCall: ScoredCall{
+			CallScore:       *score,
+			TranscriptionID: job.ID,
+			Title:           jobTitle(job),
+			Agent:           job.UserID,
+			RecordedAt:      job.CreatedAt,
+		},
+		Tenant:    job.Tenant,
+		Workspace: job.Workspace,
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	retention := time.Duration(config.ScorecardRetentionDays) * 24 * time.Hour
+	return state.set(scorecardScoreKeyPrefix+score.Scorecard+":"+job.ID, data, retention)
+}
+
+// eraseUserScores removes the scores of the user's calls, which outlive
+// their jobs
+func eraseUserScores(user string, jobs []Job) (int, error) {
+	keys, err := state.keys(scorecardScoreKeyPrefix)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, key := range keys {
+		data, ok, err := state.get(key)
+		if err != nil {
+			return deleted, err
+		}
+		var record scoreRecord
+		if !ok || json.Unmarshal(data, &record) != nil || record.Agent != user {
+			continue
+		}
+		if err := state.delete(key); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// visibleScores returns the scores of a scorecard visible to p that were
+// recorded in [from, to), of one agent if given, newest first
+func visibleScores(p principal, scorecard, agent string, from, to time.Time) ([]ScoredCall, error) {
+	keys, err := state.keys(scorecardScoreKeyPrefix + scorecard + ":")
+	if err != nil {
+		return nil, err
+	}
+	var scores []ScoredCall
+	for _, key := range keys {
+		data, ok, err := state.get(key)
+		if err != nil {
+			logErrorf(context.Background(), "Error reading score: %v", err)
+		}
+		var record scoreRecord
+		if !ok || json.Unmarshal(data, &record) != nil {
+			continue
+		}
+		if !p.sees(Job{Tenant: record.Tenant, Workspace: record.Workspace}) || (agent != "" && record.Agent != agent) {
+			continue
+		}
+		if record.RecordedAt.Before(from) || !record.RecordedAt.Before(to) {
+			continue
+		}
+		scores = append(scores, record.ScoredCall)
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].RecordedAt.After(scores[j].RecordedAt) })
+	return scores, nil
+}
+
+// scorecardQuery reads the scorecard, period and agent of a scorecard
+// request, answering the client when they are invalid
+func scorecardQuery(w http.ResponseWriter, r *http.Request) (string, string, time.Time, time.Time, bool) {
+	id := r.PathValue("id")
+	if _, ok := registry.scorecard(id); !ok {
+		integrationError(w, http.StatusNotFound, "Scorecard not found")
+		return "", "", time.Time{}, time.Time{}, false
+	}
+	q := r.URL.Query()
+	from, to, msg := reportPeriod(q)
+	if msg != "" {
+		integrationError(w, http.StatusBadRequest, msg)
+		return "", "", time.Time{}, time.Time{}, false
+	}
+	agent := q.Get("agent")
+	if agent != "" && !externalIDPattern.MatchString(agent) {
+		integrationError(w, http.StatusBadRequest, "Invalid agent")
+		return "", "", time.Time{}, time.Time{}, false
+	}
+	return id, agent, from, to, true
+}
+
+// handleScoreList lists the scored calls of a scorecard between from and
+// to, newest first, optionally of one ?agent=
+func handleScoreList(w http.ResponseWriter, r *http.Request) {
+	id, agent, from, to, ok := scorecardQuery(w, r)
+	if !ok {
+		return
+	}
+	limit := defaultScoreListLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxJobListLimit {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxJobListLimit))
+			return
+		}
+		limit = n
+	}
+	scores, err := visibleScores(principalFrom(r.Context()), id, agent, from, to)
+	if err != nil {
+		logErrorf(r.Context(), "Error listing scores of %s: %v", id, err)
+		integrationError(w, http.StatusInternalServerError, "Error listing scores")
+		return
+	}
+	total := len(scores)
+	if scores == nil {
+		scores = []ScoredCall{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"scores": scores[:min(total, limit)], "total": total})
+}
+
+// WeekScore is an agent's average in an ISO week
+type WeekScore struct {
+	Week    string  `json:"week"`
+	Calls   int     `json:"calls"`
+	Average float64 `json:"average"`
+}
+
+// AgentTrend is how an agent scored over a period
+type AgentTrend struct {
+	Agent   string  `json:"agent"`
+	Calls   int     `json:"calls"`
+	Average float64 `json:"average"`
+	// Criteria are the average ratings of each criterion, from 0 to 10
+	Criteria map[string]float64 `json:"criteria"`
+	Weeks    []WeekScore        `json:"weeks"`
+}
+
+// ScoreTrends are the agents' scores on a scorecard over a period
+type ScoreTrends struct {
+	Scorecard string       `json:"scorecard"`
+	From      time.Time    `json:"from"`
+	To        time.Time    `json:"to"`
+	Agents    []AgentTrend `json:"agents"`
+}
+
+// buildAgentTrends averages scores per agent and week, agents ordered by
+// name; calls without a user_id are grouped under an empty agent
+func buildAgentTrends(scores []ScoredCall) []AgentTrend {
+	type sums struct {
+		calls    int
+		total    float64
+		criteria map[string][2]float64
+		weeks    map[string][2]float64
+	}
+	byAgent := make(map[string]*sums)
+	for _, s := range scores {
+		a := byAgent[s.Agent]
+		if a == nil {
+			a = &sums{criteria: make(map[string][2]float64), weeks: make(map[string][2]float64)}
+			byAgent[s.Agent] = a
+		}
+		a.calls++
+		a.total += s.Score
+		for _, c := range s.Criteria {
+			sum := a.criteria[c.Criterion]
+			a.criteria[c.Criterion] = [2]float64{sum[0] + float64(c.Score), sum[1] + 1}
+		}
+		year, week := s.RecordedAt.UTC().ISOWeek()
+		key := fmt.Sprintf("%d-W%02d", year, week)
+		sum := a.weeks[key]
+		a.weeks[key] = [2]float64{sum[0] + s.Score, sum[1] + 1}
+	}
+
+	trends := make([]AgentTrend, 0, len(byAgent))
+	for agent, a := range byAgent {
+		trend := AgentTrend{Agent: agent, Calls: a.calls, Average: ratio(a.total, float64(a.calls)), Criteria: make(map[string]float64), Weeks: []WeekScore{}}
+		for id, sum := range a.criteria {
+			trend.Criteria[id] = ratio(sum[0], sum[1])
+		}
+		for week, sum := range a.weeks {
+			trend.Weeks = append(trend.Weeks, WeekScore{Week: week, Calls: int(sum[1]), Average: ratio(sum[0], sum[1])})
+		}
+		sort.Slice(trend.Weeks, func(i, j int) bool { return trend.Weeks[i].Week < trend.Weeks[j].Week })
+		trends = append(trends, trend)
+	}
+	sort.Slice(trends, func(i, j int) bool { return trends[i].Agent < trends[j].Agent })
+	return trends
+}
+
+// handleScoreTrends averages the scores of a scorecard between from and to
+// per agent and ISO week, optionally of one ?agent=
+func handleScoreTrends(w http.ResponseWriter, r *http.Request) {
+	id, agent, from, to, ok := scorecardQuery(w, r)
+	if !ok {
+		return
+	}
+	scores, err := visibleScores(principalFrom(r.Context()), id, agent, from, to)
+	if err != nil {
+		logErrorf(r.Context(), "Error listing scores of %s: %v", id, err)
+		integrationError(w, http.StatusInternalServerError, "Error listing scores")
+		return
+	}
+	writeJSON(w, http.StatusOK, ScoreTrends{Scorecard: id, From: from.UTC(), To: to.UTC(), Agents: buildAgentTrends(scores)})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secret is a credential read from an environment variable NAME or from the
+// file named by NAME_FILE. File-backed secrets are re-read when the file
+// changes, which is how Kubernetes rotates mounted Secrets, so keys can be
+// rotated without a restart.
+type Secret struct {
+	name string
+	path string
+
+	mu      sync.RWMutex
+	value   string
+	content []byte
+}
+
+// fileSecrets are the secrets watched for changes
+var (
+	fileSecretsMu sync.Mutex
+	fileSecrets   []*Secret
+)
+
+// getEnvSecret loads the secret named key from key or key_FILE
+func getEnvSecret(key string) *Secret {
+	s := &Secret{name: key}
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		s.value = os.Getenv(key)
+		return s
+	}
+	if os.Getenv(key) != "" {
+		addConfigProblem(key, fmt.Sprintf("both %s and %s_FILE are set", key, key), "Unset one of them")
+		return s
+	}
+
+	s.path = path
+	if err := s.reload(); err != nil {
+		addConfigProblem(key+"_FILE", err.Error(), "Check that the file exists and the server can read it")
+		return s
+	}
+	fileSecretsMu.Lock()
+	fileSecrets = append(fileSecrets, s)
+	fileSecretsMu.Unlock()
+	return s
+}
+
+// Value returns the current secret, or "" when it is unset
+func (s *Secret) Value() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+// List splits a comma-separated secret, ignoring empty entries
+func (s *Secret) List() []string {
+	var values []string
+	for _, value := range strings.Split(s.Value(), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// reload re-reads a file-backed secret and reports whether it changed
+func (s *Secret) reload() error {
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.content != nil && bytes.Equal(content, s.content) {
+		return nil
+	}
+	if s.content != nil {
+		logf(context.Background(), "Reloaded %s from %s", s.name, s.path)
+	}
+	s.content = content
+	// Editors and kubectl leave a trailing newline that is not part of the key
+	s.value = strings.TrimRight(string(content), "\r\n")
+	return nil
+}
+
+// watchSecrets re-reads file-backed secrets every interval. Kubernetes
+// replaces the mounted file atomically, so the content is compared rather
+// than relying on file events.
+func watchSecrets(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		fileSecretsMu.Lock()
+		secrets := append([]*Secret(nil), fileSecrets...)
+		fileSecretsMu.Unlock()
+		for _, s := range secrets {
+			if err := s.reload(); err != nil {
+				// Keep the last good value while the volume is being updated
+				logErrorf(context.Background(), "Error reloading %s from %s: %v", s.name, s.path, err)
+			}
+		}
+	}
+}
+
+// initSecrets starts watching file-backed secrets, if any
+func initSecrets() {
+	fileSecretsMu.Lock()
+	n := len(fileSecrets)
+	fileSecretsMu.Unlock()
+	if n == 0 {
+		return
+	}
+	logf(context.Background(), "Watching %d secret files for changes every %s", n, config.SecretReloadInterval)
+	go watchSecrets(config.SecretReloadInterval)
+}
+
+// secretTable caches a table parsed from a secret until the secret changes.
+// A table that fails to parse after a reload is ignored in favor of the last
+// good one.
+type secretTable[T any] struct {
+	name  string
+	parse func(string) (map[string]T, error)
+
+	mu    sync.Mutex
+	raw   string
+	table map[string]T
+}
+
+// get returns the table parsed from raw, the secret's current value
+func (t *secretTable[T]) get(raw string) map[string]T {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.table != nil && raw == t.raw {
+		return t.table
+	}
+	t.raw = raw
+	table, err := t.parse(raw)
+	if err != nil {
+		logErrorf(context.Background(), "Ignoring invalid %s: %v", t.name, err)
+		if t.table == nil {
+			t.table = make(map[string]T)
+		}
+		return t.table
+	}
+	t.table = table
+	return table
+}
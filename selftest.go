@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The self-test checks the configuration end to end before the first
+// request does: every configured backend is reachable and serves its
+// model, storage and the state store accept writes, and ffmpeg runs. It is
+// served at GET /admin/v1/selftest and run from the command line with
+// --doctor, which prints the report and exits non-zero on failure.
+
+// selfTestTimeout bounds each check
+const selfTestTimeout = 10 * time.Second
+
+// Check outcomes; a warning does not fail the self-test
+const (
+	checkPass = "pass"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// SelfTestCheck is the outcome of one check
+type SelfTestCheck struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Detail   string `json:"detail"`
+	Duration string `json:"duration"`
+}
+
+// SelfTestReport is the outcome of all checks
+type SelfTestReport struct {
+	Passed bool            `json:"passed"`
+	Checks []SelfTestCheck `json:"checks"`
+}
+
+// modelList is the OpenAI /v1/models response; Ollama lists "models"
+type modelList struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+	Models []struct {
+		Name string `json:"name"`
+	} `json:"models"`
+}
+
+// checkModel verifies that the backend at baseURL answers and lists model
+func checkModel(ctx context.Context, client *http.Client, baseURL string, authorize func(*http.Request), model string) (string, string) {
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/v1/models", nil)
+	if err != nil {
+		return checkFail, fmt.Sprintf("invalid URL %s: %v", baseURL, err)
+	}
+	authorize(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return checkFail, fmt.Sprintf("%s is unreachable: %v", baseURL, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return checkFail, fmt.Sprintf("%s rejected the API key (status %d)", baseURL, resp.StatusCode)
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed:
+		return checkWarn, fmt.Sprintf("%s is reachable but does not list models; model %s not verified", baseURL, model)
+	case resp.StatusCode != http.StatusOK:
+		return checkFail, fmt.Sprintf("%s answered status %d: %s", baseURL, resp.StatusCode, describeBody(string(body)))
+	}
+
+	var list modelList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return checkWarn, fmt.Sprintf("%s is reachable but its model list is %s; model %s not verified", baseURL, describeBody(string(body)), model)
+	}
+	var ids []string
+	for _, m := range list.Data {
+		ids = append(ids, m.ID)
+	}
+	for _, m := range list.Models {
+		ids = append(ids, m.Name)
+	}
+	for _, id := range ids {
+		if id == model {
+			return checkPass, fmt.Sprintf("%s serves %s", baseURL, model)
+		}
+	}
+	if len(ids) == 0 {
+		return checkWarn, fmt.Sprintf("%s is reachable but lists no models; model %s not verified", baseURL, model)
+	}
+	sort.Strings(ids)
+	if len(ids) > 10 {
+		ids = append(ids[:10], "...")
+	}
+	return checkFail, fmt.Sprintf("%s does not serve %s (available: %s)", baseURL, model, strings.Join(ids, ", "))
+}
+
+// selfTestUpstreams returns the distinct backends to check, by the scope
+// that uses them
+func selfTestUpstreams() ([]string, map[string]Upstream) {
+	scopes := []string{"default"}
+	ups := map[string]Upstream{"default": defaultUpstream()}
+	var tenants, regionNames []string
+	for name := range tenantRoutes() {
+		tenants = append(tenants, name)
+	}
+	for name := range regions() {
+		regionNames = append(regionNames, name)
+	}
+	sort.Strings(tenants)
+	sort.Strings(regionNames)
+	for _, name := range regionNames {
+		scope := "region " + name
+		scopes = append(scopes, scope)
+		ups[scope], _ = upstreamFor("", name)
+	}
+	for _, name := range tenants {
+		up, err := upstreamFor(name, tenantRegion(name))
+		if err != nil {
+			// Nothing of a tenant pinned to a missing region is processed
+			continue
+		}
+		scope := "tenant " + name
+		scopes = append(scopes, scope)
+		ups[scope] = up
+	}
+	return scopes, ups
+}
+
+// checkStorage writes and removes a file in dir
+func checkStorage(dir string) (string, string) {
+	f, err := os.CreateTemp(dir, ".selftest-*")
+	if err != nil {
+		return checkFail, fmt.Sprintf("%s is not writable: %v", dir, err)
+	}
+	_, err = f.WriteString("selftest")
+	closeErr := f.Close()
+	os.Remove(f.Name())
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return checkFail, fmt.Sprintf("writing to %s failed: %v", dir, err)
+	}
+	return checkPass, fmt.Sprintf("%s is writable", dir)
+}
+
+// checkStateStore writes, reads back and deletes a key
+func checkStateStore() (string, string) {
+	key := "selftest:" + newID()
+	if err := state.set(key, []byte("ok"), time.Minute); err != nil {
+		return checkFail, fmt.Sprintf("%s state store rejected a write: %v", config.StateStore, err)
+	}
+	defer state.delete(key)
+	value, ok, err := state.get(key)
+	if err != nil || !ok || string(value) != "ok" {
+		return checkFail, fmt.Sprintf("%s state store did not return a written key (err: %v)", config.StateStore, err)
+	}
+	if !state.shared() {
+		return checkPass, "memory state store is writable (not shared between replicas)"
+	}
+	return checkPass, fmt.Sprintf("%s state store is writable", config.StateStore)
+}
+
+// checkFFmpeg runs ffmpeg -version
+func checkFFmpeg(ctx context.Context) (string, string) {
+	path, err := exec.LookPath(config.FFmpegPath)
+	if err != nil {
+		return checkWarn, fmt.Sprintf("%s not found; only WAV audio is accepted and highlight clips cannot be cut", config.FFmpegPath)
+	}
+	out, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		return checkWarn, fmt.Sprintf("%s -version failed: %v; only WAV audio is accepted and highlight clips cannot be cut", path, err)
+	}
+	version, _, _ := strings.Cut(string(out), "\n")
+	return checkPass, strings.TrimSpace(version)
+}
+
+// runSelfTest runs all checks
+func runSelfTest(ctx context.Context) SelfTestReport {
+	report := SelfTestReport{Passed: true}
+	run := func(name string, check func(ctx context.Context) (string, string)) {
+		ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+		defer cancel()
+		start := time.Now()
+		status, detail := check(ctx)
+		if status == checkFail {
+			report.Passed = false
+		}
+		report.Checks = append(report.Checks, SelfTestCheck{
+			Name:     name,
+			Status:   status,
+			Detail:   detail,
+			Duration: time.Since(start).Round(time.Millisecond).String(),
+		})
+	}
+
+	// Backends shared by several scopes are checked once
+	checked := make(map[string]bool)
+	scopes, ups := selfTestUpstreams()
+	for _, scope := range scopes {
+		up := ups[scope]
+		backends := up.audioBackends()
+		for _, audio := range backends {
+			if key := "audio " + audio.AudioURL + " " + audio.AudioModel; !checked[key] {
+				checked[key] = true
+				name := fmt.Sprintf("Audio backend (%s)", scope)
+				if len(backends) > 1 {
+					name = fmt.Sprintf("Audio backend %s (%s)", audio.AudioURL, scope)
+				}
+				run(name, func(ctx context.Context) (string, string) {
+					return checkModel(ctx, audioClient, audio.AudioURL, audio.authorizeAudio, audio.AudioModel)
+				})
+			}
+		}
+		if key := "llm " + up.LLMURL + " " + up.LLMModel; !checked[key] {
+			checked[key] = true
+			run(fmt.Sprintf("LLM backend (%s)", scope), func(ctx context.Context) (string, string) {
+				return checkModel(ctx, llmClient, up.LLMURL, up.authorizeLLM, up.LLMModel)
+			})
+		}
+	}
+
+	dirs := []string{config.StorageDir}
+	for _, r := range regions() {
+		dirs = append(dirs, r.StorageDir)
+	}
+	for _, dir := range dirs {
+		if checked["storage "+dir] {
+			continue
+		}
+		checked["storage "+dir] = true
+		run("Storage", func(context.Context) (string, string) { return checkStorage(dir) })
+	}
+	run("State store", func(context.Context) (string, string) { return checkStateStore() })
+	run("ffmpeg", checkFFmpeg)
+	return report
+}
+
+// writeText prints the report as an aligned table
+func (r SelfTestReport) writeText(w io.Writer) {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	counts := make(map[string]int)
+	for _, c := range r.Checks {
+		counts[c.Status]++
+		fmt.Fprintf(tw, "%s\t%s\t%s (%s)\n", strings.ToUpper(c.Status), c.Name, c.Detail, c.Duration)
+	}
+	tw.Flush()
+	fmt.Fprintf(&buf, "\n%d passed, %d warning(s), %d failed\n", counts[checkPass], counts[checkWarn], counts[checkFail])
+	w.Write(buf.Bytes())
+}
+
+// handleSelfTest runs the self-test, answering JSON or, with
+// ?format=text, the table printed by --doctor
+func handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	report := runSelfTest(r.Context())
+	if !report.Passed {
+		logErrorf(r.Context(), "Self-test failed")
+	}
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		report.writeText(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// runDoctor prepares what the checks need, prints the report and exits
+func runDoctor() {
+	initSecrets()
+	initCrypto()
+	initStateStore()
+	initRegions()
+	initTenants()
+	initEgress()
+	initUpstreamClients()
+	if err := os.MkdirAll(config.StorageDir, 0o750); err != nil {
+		logErrorf(context.Background(), "Error creating storage directory %s: %v", config.StorageDir, err)
+	}
+
+	report := runSelfTest(context.Background())
+	fmt.Printf("\n%s\n\n", versionLine())
+	report.writeText(os.Stdout)
+	if !report.Passed {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -2,15 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -22,6 +27,291 @@ type Config struct {
 	LLMInferenceURL   string
 	LLMModelName      string
 	Port              string
+
+	// Directory holding static, templates and i18n to read instead of the
+	// assets built into the binary (empty = built in)
+	StaticDir string
+
+	// API keys sent to the inference backends, if they require one, as
+	// bearer tokens or in a header of their own
+	AudioAPIKey       *Secret
+	LLMAPIKey         *Secret
+	AudioAPIKeyHeader string
+	LLMAPIKeyHeader   string
+
+	// How often secrets read from *_FILE variables are checked for changes
+	SecretReloadInterval time.Duration
+
+	// Response format asked of the Whisper API: verbose_json carries the
+	// segment timestamps that subtitles and paragraphs are timed with
+	AudioResponseFormat string
+
+	// Recordings longer than AudioChunkDuration are transcribed in chunks,
+	// AudioChunkParallelism at a time (0 = never split)
+	AudioChunkDuration    time.Duration
+	AudioChunkParallelism int
+
+	// Confidence below which the next of a list of languages is tried
+	LanguageFallbackConfidence float64
+
+	// Tag segments with their language and handle mixed-language text
+	CodeSwitching bool
+
+	// Enhance audio assessed as noisy before it is transcribed, unless a
+	// request says otherwise
+	AudioDenoise bool
+	// How noisy audio is enhanced: fft, rnnoise with the model file
+	// AudioEnhancerModel, or by the endpoint AudioEnhancerURL
+	AudioEnhancer       string
+	AudioEnhancerModel  string
+	AudioEnhancerURL    string
+	AudioEnhancerAPIKey *Secret
+
+	// Leave music of at least MusicMinDuration out of transcripts
+	MusicSkipping    bool
+	MusicMinDuration time.Duration
+
+	// On SIGTERM new work is refused for ShutdownDelay while load balancers
+	// notice, and work in flight gets up to ShutdownTimeout in all
+	ShutdownTimeout time.Duration
+	ShutdownDelay   time.Duration
+
+	// Upload bandwidth limits in bytes per second (0 = unlimited)
+	UploadRateLimit       int64
+	GlobalUploadRateLimit int64
+
+	// Storage for temporary files and artifacts, guarded by the disk watchdog
+	StorageDir         string
+	DiskUsageThreshold float64
+	DiskCheckInterval  time.Duration
+	ArtifactRetention  time.Duration
+
+	// S3-compatible bucket clients upload recordings to directly, with
+	// presigned URLs valid for ObjectStorageURLExpiry (empty bucket =
+	// disabled)
+	ObjectStorageEndpoint  string
+	ObjectStorageRegion    string
+	ObjectStorageBucket    string
+	ObjectStoragePrefix    string
+	ObjectStorageAccessKey *Secret
+	ObjectStorageSecretKey *Secret
+	ObjectStorageURLExpiry time.Duration
+
+	// Global budget for request buffers in bytes (0 = unlimited)
+	MemoryBudget       int64
+	MemoryQueueTimeout time.Duration
+
+	// Event bus for lifecycle events ("nats" or "kafka")
+	EventBus      string
+	EventBusURL   *Secret
+	EventBusTopic string
+	EventSource   string
+
+	// Shared secret for signed inbound webhooks (empty = disabled)
+	HooksSecret *Secret
+
+	// HMAC algorithm of webhook signatures, and FIPS-approved crypto only
+	HMACAlgorithm string
+	FIPSMode      bool
+
+	// API keys accepted by the /integrations/v1 endpoints (empty = disabled)
+	IntegrationAPIKeys *Secret
+
+	// Store for state shared by replicas ("file", "memory" or "redis"),
+	// and the file of the file store (STORAGE_DIR/state.json by default)
+	StateStore string
+	StateFile  string
+	RedisURL   *Secret
+
+	// Rendered share pages are cached for ShareCacheTTL, up to
+	// ShareCacheSize of them, and at most ShareMaxRenders are rendered at
+	// once. ShareStoreURL is a read-only Redis replica share links are read
+	// from, and ServeMode "shares" serves nothing but share pages.
+	ShareCacheTTL   time.Duration
+	ShareCacheSize  int
+	ShareMaxRenders int
+	ShareStoreURL   *Secret
+	ServeMode       string
+
+	// Routing of tenants to their own upstreams and data residency
+	// regions (JSON, see README)
+	TenantRoutes *Secret
+	Regions      *Secret
+
+	// Leader election for singleton background workers ("kubernetes",
+	// "file" or empty to disable)
+	LeaderElection          string
+	LeaderElectionName      string
+	LeaderElectionNamespace string
+	LeaderLeaseDuration     time.Duration
+
+	// Bearer token for the /admin/v1 API (empty = disabled) and the file
+	// where declared resources are kept (empty = memory only)
+	AdminToken     *Secret
+	AdminStateFile string
+
+	// Air-gapped mode: outbound connections only to the inference backends
+	// and EgressAllowlist (comma-separated host:port)
+	Airgapped       bool
+	EgressAllowlist string
+
+	// Fetch audio URLs that resolve to loopback, private and link-local
+	// addresses, which are refused by default
+	AllowPrivateAudioURLs bool
+
+	// Recording disclosure shown before recording and stamped on exported
+	// transcripts (empty = none)
+	RecordingDisclosure string
+
+	// Disclosure recordings for telephony, one file per language
+	ConsentAudioDir             string
+	ConsentAudioDefaultLanguage string
+
+	// ffmpeg binary used to cut highlight clips
+	FFmpegPath string
+
+	// White-labeling of the web UI
+	BrandProductName  string
+	BrandLogoURL      string
+	BrandPrimaryColor string
+	BrandFooterText   string
+
+	// Locale of the web UI when the browser's is not available
+	UIDefaultLocale string
+
+	// Opt-in anonymous usage counters, kept locally unless a report URL
+	// is set
+	Telemetry              bool
+	TelemetryRetentionDays int
+	TelemetryReportURL     string
+
+	// Longest text summarized in one LLM call, in characters, and the
+	// default strategy for longer text
+	SummaryMaxInputChars int
+	SummaryTruncation    string
+	// System prompt of summaries without a style or custom prompt
+	SummarySystemPrompt string
+
+	// Days the scores of scorecard reviews are kept
+	ScorecardRetentionDays int
+
+	// What the speech pipeline lists as references, and the longest
+	// shareable excerpt of a speech in seconds
+	SpeechReferences     string
+	SpeechExcerptSeconds float64
+
+	// Reading speed above which dubbing script cues are flagged, in
+	// characters per second
+	DubMaxCPS float64
+
+	// How long a PIN pairing a room device can be entered
+	RoomPairingTTL time.Duration
+
+	// Background job workers, and the number of jobs that may wait for one
+	JobWorkers   int
+	JobQueueSize int
+
+	// How long clips stay in a channel's log
+	ChannelLogRetention time.Duration
+
+	// Live transcription: longest segment sent to the backend, pause that
+	// ends a segment, and longest session
+	LiveSegmentMax  time.Duration
+	LiveSilence     time.Duration
+	LiveMaxDuration time.Duration
+	// Live sessions at once on this replica (0 for unlimited), the level
+	// in dBFS above which audio counts as speech, and the highest bitrate
+	// of a session's audio in kbit/s (0 for any sample rate)
+	LiveMaxSessions  int
+	LiveVADThreshold float64
+	LiveMaxBitrate   int
+	// Faster Whisper model for partial live text (empty = no partials),
+	// and how often the segment being spoken is transcribed with it
+	LiveFastModel       string
+	LivePartialInterval time.Duration
+
+	// Ask the LLM for a title for each transcribed job
+	AutoTitles bool
+
+	// Save transcriptions made in the web UI to the history, kept for
+	// TranscriptHistoryRetention (0 keeps them)
+	TranscriptHistory          bool
+	TranscriptHistoryRetention time.Duration
+
+	// Break transcripts into paragraphs, at pauses of at least
+	// ParagraphPause among other cues
+	Paragraphs     bool
+	ParagraphPause time.Duration
+
+	// Share of a workspace quota from which clients are warned
+	QuotaWarningThreshold float64
+
+	// Warm-up of the backends: at startup, and how long to wait for models
+	// to load
+	WarmupOnStartup bool
+	WarmupTimeout   time.Duration
+
+	// Whether /readyz checks that the backends can be reached, how long
+	// each may take to answer and how long the outcome is reused
+	ReadinessCheckBackends bool
+	ReadinessTimeout       time.Duration
+	ReadinessCacheTTL      time.Duration
+
+	// Prices used by the estimate endpoint (0 = no cost shown)
+	CostPerAudioMinute float64
+	CostPer1kTokens    float64
+	CostCurrency       string
+
+	// Quick voice memos: longest clip, deadline and faster models (empty =
+	// the usual ones)
+	MemoMaxDuration time.Duration
+	MemoTimeout     time.Duration
+	MemoAudioModel  string
+	MemoLLMModel    string
+
+	// Tags the tags pipeline step may assign (empty = open vocabulary), and
+	// how many it assigns at most
+	TagTaxonomy string
+	MaxTags     int
+
+	// Share of word sequences two transcripts must have in common to be
+	// linked as recordings of the same meeting (0 = disabled), and how far
+	// apart they may have been started
+	DuplicateThreshold float64
+	DuplicateWindow    time.Duration
+
+	// Digest emails: SMTP server (empty = disabled), sender, hour of day
+	// (UTC) they are sent, and the public URL their unsubscribe links use
+	SMTPURL    *Secret
+	DigestFrom string
+	DigestHour int
+	PublicURL  string
+
+	// Connection tuning for the inference backend clients
+	UpstreamDialTimeout         time.Duration
+	UpstreamTLSTimeout          time.Duration
+	UpstreamIdleConnTimeout     time.Duration
+	UpstreamMaxIdleConnsPerHost int
+	UpstreamHTTP2               bool
+
+	// Concurrent requests per backend host (0 is unlimited) and how long
+	// requests over the limit wait
+	AudioMaxConcurrency  int
+	LLMMaxConcurrency    int
+	UpstreamQueueTimeout time.Duration
+	// Share of each backend's slots kept for web UI requests
+	InteractiveReservedShare float64
+	// How requests are spread over the Whisper backends of a list, how often
+	// each is checked and how long one may take to answer before the next is
+	// tried
+	AudioBalancing           string
+	AudioHealthCheckInterval time.Duration
+	AudioBackendTimeout      time.Duration
+
+	// Least severe log messages written: info, warn or error
+	LogLevel string
+	// Log records as JSON lines or key=value text
+	LogFormat string
 }
 
 // LoadConfig loads configuration from environment variables
@@ -32,16 +322,193 @@ func LoadConfig() *Config {
 		LLMInferenceURL:   os.Getenv("LLM_INFERENCE_URL"),
 		LLMModelName:      getEnvOrDefault("LLM_MODEL_NAME", "gpt-3.5-turbo"),
 		Port:              getEnvOrDefault("PORT", "8080"),
-	}
+		StaticDir:         getEnvOrDefault("STATIC_DIR", ""),
 
-	// Validate required environment variables
-	if config.AudioInferenceURL == "" {
-		log.Fatal("AUDIO_INFERENCE_URL environment variable is required")
-	}
-	if config.LLMInferenceURL == "" {
-		log.Fatal("LLM_INFERENCE_URL environment variable is required")
+		AudioAPIKey:          getEnvSecret("AUDIO_API_KEY"),
+		LLMAPIKey:            getEnvSecret("LLM_API_KEY"),
+		AudioAPIKeyHeader:    getEnvOrDefault("AUDIO_API_KEY_HEADER", "Authorization"),
+		LLMAPIKeyHeader:      getEnvOrDefault("LLM_API_KEY_HEADER", "Authorization"),
+		SecretReloadInterval: getEnvDuration("SECRET_RELOAD_INTERVAL", 30*time.Second),
+
+		AudioResponseFormat: getEnvOrDefault("AUDIO_RESPONSE_FORMAT", "verbose_json"),
+
+		AudioChunkDuration:    getEnvDuration("AUDIO_CHUNK_DURATION", 10*time.Minute),
+		AudioChunkParallelism: getEnvInt("AUDIO_CHUNK_PARALLELISM", 2),
+
+		LanguageFallbackConfidence: getEnvFloat("LANGUAGE_FALLBACK_CONFIDENCE", 0.6),
+
+		CodeSwitching: getEnvBool("CODE_SWITCHING", true),
+
+		AudioDenoise:        getEnvBool("AUDIO_DENOISE", false),
+		AudioEnhancer:       strings.ToLower(getEnvOrDefault("AUDIO_ENHANCER", enhancerFFT)),
+		AudioEnhancerModel:  os.Getenv("AUDIO_ENHANCER_MODEL"),
+		AudioEnhancerURL:    os.Getenv("AUDIO_ENHANCER_URL"),
+		AudioEnhancerAPIKey: getEnvSecret("AUDIO_ENHANCER_API_KEY"),
+
+		MusicSkipping:    getEnvBool("MUSIC_SKIPPING", false),
+		MusicMinDuration: getEnvDuration("MUSIC_MIN_DURATION", 20*time.Second),
+
+		ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", 2*time.Minute),
+		ShutdownDelay:   getEnvDuration("SHUTDOWN_DELAY", 5*time.Second),
+
+		UploadRateLimit:       getEnvBytes("UPLOAD_RATE_LIMIT", 0),
+		GlobalUploadRateLimit: getEnvBytes("UPLOAD_GLOBAL_RATE_LIMIT", 0),
+
+		StorageDir:         getEnvOrDefault("STORAGE_DIR", filepath.Join(os.TempDir(), "transcription-app")),
+		DiskUsageThreshold: getEnvFloat("DISK_USAGE_THRESHOLD", 90),
+		DiskCheckInterval:  getEnvDuration("DISK_CHECK_INTERVAL", 30*time.Second),
+		ArtifactRetention:  getEnvDuration("ARTIFACT_RETENTION", 24*time.Hour),
+
+		ObjectStorageEndpoint:  getEnvOrDefault("OBJECT_STORAGE_ENDPOINT", ""),
+		ObjectStorageRegion:    getEnvOrDefault("OBJECT_STORAGE_REGION", "us-east-1"),
+		ObjectStorageBucket:    getEnvOrDefault("OBJECT_STORAGE_BUCKET", ""),
+		ObjectStoragePrefix:    getEnvOrDefault("OBJECT_STORAGE_PREFIX", "uploads/"),
+		ObjectStorageAccessKey: getEnvSecret("OBJECT_STORAGE_ACCESS_KEY"),
+		ObjectStorageSecretKey: getEnvSecret("OBJECT_STORAGE_SECRET_KEY"),
+		ObjectStorageURLExpiry: getEnvDuration("OBJECT_STORAGE_URL_EXPIRY", time.Hour),
+
+		MemoryBudget:       getEnvBytes("MEMORY_BUDGET", 0),
+		MemoryQueueTimeout: getEnvDuration("MEMORY_QUEUE_TIMEOUT", 30*time.Second),
+
+		EventBus:      getEnvOrDefault("EVENT_BUS", "nats"),
+		EventBusURL:   getEnvSecret("EVENT_BUS_URL"),
+		EventBusTopic: getEnvOrDefault("EVENT_BUS_TOPIC", "transcription.events"),
+		EventSource:   getEnvOrDefault("EVENT_SOURCE", "/transcription-app"),
+
+		HooksSecret:        getEnvSecret("HOOKS_SECRET"),
+		HMACAlgorithm:      strings.ToLower(getEnvOrDefault("HMAC_ALGORITHM", "sha256")),
+		FIPSMode:           getEnvBool("FIPS_MODE", false),
+		IntegrationAPIKeys: getEnvSecret("INTEGRATION_API_KEYS"),
+
+		StateStore: getEnvOrDefault("STATE_STORE", "file"),
+		StateFile:  os.Getenv("STATE_FILE"),
+		RedisURL:   getEnvSecret("REDIS_URL"),
+
+		ShareCacheTTL:   getEnvDuration("SHARE_CACHE_TTL", time.Minute),
+		ShareCacheSize:  getEnvInt("SHARE_CACHE_SIZE", 1000),
+		ShareMaxRenders: getEnvInt("SHARE_MAX_RENDERS", 8),
+		ShareStoreURL:   getEnvSecret("SHARE_STORE_URL"),
+		ServeMode:       strings.ToLower(getEnvOrDefault("SERVE_MODE", serveModeAll)),
+
+		TenantRoutes: getEnvSecret("TENANT_ROUTES"),
+		Regions:      getEnvSecret("REGIONS"),
+
+		LeaderElection:          os.Getenv("LEADER_ELECTION"),
+		LeaderElectionName:      getEnvOrDefault("LEADER_ELECTION_NAME", "transcription-app"),
+		LeaderElectionNamespace: os.Getenv("LEADER_ELECTION_NAMESPACE"),
+		LeaderLeaseDuration:     getEnvDuration("LEADER_LEASE_DURATION", 15*time.Second),
+
+		AdminToken:     getEnvSecret("ADMIN_TOKEN"),
+		AdminStateFile: os.Getenv("ADMIN_STATE_FILE"),
+
+		Airgapped:       getEnvBool("AIRGAPPED", false),
+		EgressAllowlist: os.Getenv("EGRESS_ALLOWLIST"),
+
+		AllowPrivateAudioURLs: getEnvBool("ALLOW_PRIVATE_AUDIO_URLS", false),
+
+		RecordingDisclosure: os.Getenv("RECORDING_DISCLOSURE"),
+
+		ConsentAudioDir:             os.Getenv("CONSENT_AUDIO_DIR"),
+		ConsentAudioDefaultLanguage: getEnvOrDefault("CONSENT_AUDIO_DEFAULT_LANGUAGE", "en"),
+
+		FFmpegPath: getEnvOrDefault("FFMPEG_PATH", "ffmpeg"),
+
+		BrandProductName:  os.Getenv("BRAND_PRODUCT_NAME"),
+		BrandLogoURL:      os.Getenv("BRAND_LOGO_URL"),
+		BrandPrimaryColor: os.Getenv("BRAND_PRIMARY_COLOR"),
+		BrandFooterText:   os.Getenv("BRAND_FOOTER_TEXT"),
+
+		UIDefaultLocale: getEnvOrDefault("UI_DEFAULT_LOCALE", sourceLocale),
+
+		Telemetry:              getEnvBool("TELEMETRY", false),
+		TelemetryRetentionDays: getEnvInt("TELEMETRY_RETENTION_DAYS", 90),
+		TelemetryReportURL:     os.Getenv("TELEMETRY_REPORT_URL"),
+
+		SummaryMaxInputChars: getEnvInt("SUMMARY_MAX_INPUT_CHARS", 48000),
+		SummaryTruncation:    getEnvOrDefault("SUMMARY_TRUNCATION", truncateChunked),
+		SummarySystemPrompt:  getEnvOrDefault("SUMMARY_SYSTEM_PROMPT", defaultSummaryPrompt),
+
+		ScorecardRetentionDays: getEnvInt("SCORECARD_RETENTION_DAYS", 365),
+
+		SpeechReferences:     getEnvOrDefault("SPEECH_REFERENCES", "scripture passages, books and other works"),
+		SpeechExcerptSeconds: getEnvFloat("SPEECH_EXCERPT_SECONDS", 90),
+
+		DubMaxCPS: getEnvFloat("DUB_MAX_CPS", 17),
+
+		RoomPairingTTL: getEnvDuration("ROOM_PAIRING_TTL", 10*time.Minute),
+
+		JobWorkers:   getEnvInt("JOB_WORKERS", 4),
+		JobQueueSize: getEnvInt("JOB_QUEUE_SIZE", 100),
+
+		ChannelLogRetention: getEnvDuration("CHANNEL_LOG_RETENTION", 7*24*time.Hour),
+
+		LiveSegmentMax:  getEnvDuration("LIVE_SEGMENT_MAX", 15*time.Second),
+		LiveSilence:     getEnvDuration("LIVE_SILENCE", 700*time.Millisecond),
+		LiveMaxDuration: getEnvDuration("LIVE_MAX_DURATION", time.Hour),
+
+		LiveMaxSessions:  getEnvInt("LIVE_MAX_SESSIONS", 0),
+		LiveVADThreshold: getEnvFloat("LIVE_VAD_THRESHOLD", -36),
+		LiveMaxBitrate:   getEnvInt("LIVE_MAX_BITRATE", 0),
+
+		LiveFastModel:       os.Getenv("LIVE_FAST_MODEL_NAME"),
+		LivePartialInterval: getEnvDuration("LIVE_PARTIAL_INTERVAL", 2*time.Second),
+
+		AutoTitles: getEnvBool("AUTO_TITLES", true),
+
+		TranscriptHistory:          getEnvBool("TRANSCRIPT_HISTORY", true),
+		TranscriptHistoryRetention: getEnvDuration("TRANSCRIPT_HISTORY_RETENTION", 0),
+
+		Paragraphs:     getEnvBool("PARAGRAPHS", true),
+		ParagraphPause: getEnvDuration("PARAGRAPH_PAUSE", 2*time.Second),
+
+		QuotaWarningThreshold: getEnvFloat("QUOTA_WARNING_THRESHOLD", 0.8),
+
+		WarmupOnStartup: getEnvBool("WARMUP_ON_STARTUP", false),
+		WarmupTimeout:   getEnvDuration("WARMUP_TIMEOUT", 10*time.Minute),
+
+		ReadinessCheckBackends: getEnvBool("READINESS_CHECK_BACKENDS", true),
+		ReadinessTimeout:       getEnvDuration("READINESS_TIMEOUT", 2*time.Second),
+		ReadinessCacheTTL:      getEnvDuration("READINESS_CACHE_TTL", 10*time.Second),
+
+		CostPerAudioMinute: getEnvFloat("COST_PER_AUDIO_MINUTE", 0),
+		CostPer1kTokens:    getEnvFloat("COST_PER_1K_TOKENS", 0),
+		CostCurrency:       getEnvOrDefault("COST_CURRENCY", "USD"),
+
+		MemoMaxDuration: getEnvDuration("MEMO_MAX_DURATION", 60*time.Second),
+		MemoTimeout:     getEnvDuration("MEMO_TIMEOUT", 10*time.Second),
+		MemoAudioModel:  os.Getenv("MEMO_AUDIO_MODEL_NAME"),
+		MemoLLMModel:    os.Getenv("MEMO_LLM_MODEL_NAME"),
+
+		TagTaxonomy: os.Getenv("TAG_TAXONOMY"),
+		MaxTags:     getEnvInt("MAX_TAGS", 5),
+
+		DuplicateThreshold: getEnvFloat("DUPLICATE_THRESHOLD", 0.5),
+		DuplicateWindow:    getEnvDuration("DUPLICATE_WINDOW", 12*time.Hour),
+
+		SMTPURL:    getEnvSecret("SMTP_URL"),
+		DigestFrom: getEnvOrDefault("DIGEST_FROM", "transcripts@localhost"),
+		DigestHour: getEnvInt("DIGEST_HOUR", 7),
+		PublicURL:  os.Getenv("PUBLIC_URL"),
+
+		UpstreamDialTimeout:         getEnvDuration("UPSTREAM_DIAL_TIMEOUT", 10*time.Second),
+		UpstreamTLSTimeout:          getEnvDuration("UPSTREAM_TLS_TIMEOUT", 10*time.Second),
+		UpstreamIdleConnTimeout:     getEnvDuration("UPSTREAM_IDLE_CONN_TIMEOUT", 90*time.Second),
+		UpstreamMaxIdleConnsPerHost: getEnvInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", 16),
+		UpstreamHTTP2:               getEnvBool("UPSTREAM_HTTP2", true),
+
+		AudioMaxConcurrency:      getEnvInt("AUDIO_MAX_CONCURRENCY", 0),
+		LLMMaxConcurrency:        getEnvInt("LLM_MAX_CONCURRENCY", 0),
+		UpstreamQueueTimeout:     getEnvDuration("UPSTREAM_QUEUE_TIMEOUT", time.Minute),
+		InteractiveReservedShare: getEnvFloat("INTERACTIVE_RESERVED_SHARE", 0.25),
+		AudioBalancing:           strings.ToLower(getEnvOrDefault("AUDIO_BALANCING", balanceRoundRobin)),
+		AudioHealthCheckInterval: getEnvDuration("AUDIO_HEALTH_CHECK_INTERVAL", 10*time.Second),
+		AudioBackendTimeout:      getEnvDuration("AUDIO_BACKEND_TIMEOUT", 2*time.Minute),
+
+		LogLevel:  strings.ToLower(getEnvOrDefault("LOG_LEVEL", logLevelInfo)),
+		LogFormat: strings.ToLower(getEnvOrDefault("LOG_FORMAT", logFormatJSON)),
 	}
 
+	checkConfig(config)
 	return config
 }
 
@@ -52,54 +519,237 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvDuration parses a Go duration such as "30s" or "24h"
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		addConfigProblem(key, fmt.Sprintf("%q is not a positive duration", value), "Use a Go duration such as 30s, 15m or 24h")
+		return defaultValue
+	}
+	return d
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		addConfigProblem(key, fmt.Sprintf("%q is not a non-negative integer", value), "Use a whole number such as 0, 4 or 100")
+		return defaultValue
+	}
+	return n
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		addConfigProblem(key, fmt.Sprintf("%q is not a boolean", value), "Use true or false")
+		return defaultValue
+	}
+	return b
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		addConfigProblem(key, fmt.Sprintf("%q is not a number", value), "Use a number such as 0.5 or 90")
+		return defaultValue
+	}
+	return f
+}
+
+// getEnvBytes parses a byte size such as "512KB", "10MB" or "1048576"
+func getEnvBytes(key string, defaultValue int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	size, err := parseByteSize(value)
+	if err != nil {
+		addConfigProblem(key, err.Error(), "Use a size such as 512KB, 10MB or 1048576")
+		return defaultValue
+	}
+	return size
+}
+
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		factor int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			multiplier = unit.factor
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a valid byte size", value)
+	}
+	return n * multiplier, nil
+}
+
 var config *Config
 
 func main() {
+	doctor := flag.Bool("doctor", false, "check the configuration, backends and storage, print a report and exit")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionLine())
+		os.Exit(0)
+	}
+
 	config = LoadConfig()
+	if *doctor {
+		runDoctor()
+	}
+	initLogging()
 
-	log.Printf("Starting Audio Transcription Server")
-	log.Printf("Audio Inference URL: %s", config.AudioInferenceURL)
-	log.Printf("Audio Model: %s", config.AudioModelName)
-	log.Printf("LLM Inference URL: %s", config.LLMInferenceURL)
-	log.Printf("LLM Model: %s", config.LLMModelName)
-	log.Printf("Port: %s", config.Port)
+	logf(context.Background(), "Starting Audio Transcription Server: %s", versionLine())
+	logf(context.Background(), "Audio Inference URL: %s", config.AudioInferenceURL)
+	logf(context.Background(), "Audio Model: %s", config.AudioModelName)
+	logf(context.Background(), "LLM Inference URL: %s", config.LLMInferenceURL)
+	logf(context.Background(), "LLM Model: %s", config.LLMModelName)
+	logf(context.Background(), "Port: %s", config.Port)
+	if config.UploadRateLimit > 0 {
+		logf(context.Background(), "Upload rate limit per connection: %d bytes/s", config.UploadRateLimit)
+	}
+	if config.GlobalUploadRateLimit > 0 {
+		logf(context.Background(), "Global upload rate limit: %d bytes/s", config.GlobalUploadRateLimit)
+	}
+
+	logf(context.Background(), "Storage directory: %s", config.StorageDir)
+	if config.MemoryBudget > 0 {
+		logf(context.Background(), "Request memory budget: %d bytes", config.MemoryBudget)
+	}
+
+	initSecrets()
+	initCrypto()
+	initStateStore()
+	initAssets()
+	if config.ServeMode == serveModeShares {
+		serveShares()
+		return
+	}
+	initShareCache()
+	initRegions()
+	initTenants()
+	initEgress()
+	initUploadLimits()
+	initStorage()
+	initMemoryBudget()
+	initUpstreamClients()
+	initAudioBackends()
+	initSettings()
+	initTruncation()
+	initWarmup()
+	initEventBus()
+	initJobs()
+	initJobQueue()
+	initLeaderElection()
+	initReplicaReports()
+	initAdmin()
+	initHighlights()
+	initViews()
+	initDigests()
+	initBranding()
+	initI18n()
+	initTelemetry()
+	initConsentAudio()
 
 	http.HandleFunc("/", handleIndex)
 	http.HandleFunc("/static/", handleStatic)
 	http.HandleFunc("/transcribe", handleTranscribe)
 	http.HandleFunc("/summarize", handleSummarize)
+	http.HandleFunc("POST /memo", handleMemo)
+	http.HandleFunc("POST /translate", handleTranslate)
+	http.HandleFunc("POST /jobs/transcribe", handleJobTranscribe)
+	http.HandleFunc("GET /jobs/{id}", handleJobGet)
+	http.HandleFunc("OPTIONS /files/", handleUploadOptions)
+	http.HandleFunc("POST /files/{$}", handleUploadCreate)
+	http.HandleFunc("HEAD /files/{id}", handleUploadHead)
+	http.HandleFunc("PATCH /files/{id}", handleUploadPatch)
+	http.HandleFunc("DELETE /files/{id}", handleUploadDelete)
+	http.HandleFunc("POST /uploads/presign", handleUploadPresign)
+	http.HandleFunc("POST /uploads/complete", handleUploadComplete)
+	http.HandleFunc("GET /api/transcripts", handleTranscriptList)
+	http.HandleFunc("GET /api/transcripts/{id}", handleTranscriptGet)
+	http.HandleFunc("DELETE /api/transcripts/{id}", handleTranscriptDelete)
+	http.HandleFunc("GET /api/transcripts/{id}/export", handleTranscriptExport)
+	http.HandleFunc("GET /api/transcripts/{id}/audio", handleTranscriptAudio)
+	http.HandleFunc("GET /ws/transcribe", handleLiveTranscribe)
+	http.HandleFunc("GET /estimate", handleEstimate)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.HandleFunc("GET /version", handleVersion)
+	http.HandleFunc("/disclosure", handleDisclosure)
+	http.HandleFunc("GET /consent/audio", handleConsentAudioList)
+	http.HandleFunc("GET /consent/audio/{language}", handleConsentAudio)
+	http.HandleFunc("GET /branding", handleBranding)
+	http.HandleFunc("GET /i18n", handleLocales)
+	http.HandleFunc("GET /i18n/{file}", handleStrings)
+	http.HandleFunc("/hooks/ingest", handleIngestHook)
+	http.HandleFunc("GET /shared/{token}", handleSharedView)
+	http.HandleFunc("GET /shared/{token}/print", handleSharedPrint)
+	http.HandleFunc("GET /downloads/{token}", handleDownload)
+	http.HandleFunc("GET /feeds/{token}", handleAtomFeed)
+	http.HandleFunc("GET /feeds/{token}/rss", handleRSSFeed)
+	http.HandleFunc("GET /feeds/{token}/ics", handleCalendarFeed)
+	http.HandleFunc("GET /feeds/{token}/kiosk", handleKiosk)
+	http.HandleFunc("GET /digest/unsubscribe/{token}", handleDigestUnsubscribe)
+	http.HandleFunc("POST /digest/unsubscribe/{token}", handleDigestUnsubscribe)
+	registerIntegrationRoutes(http.DefaultServeMux)
+	registerAdminRoutes(http.DefaultServeMux)
 
 	addr := ":" + config.Port
-	log.Printf("Server listening on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatal(err)
+	logf(context.Background(), "Server listening on %s", addr)
+	var handler http.Handler = withVersion(withSecurityHeaders(http.DefaultServeMux))
+	if config.Telemetry {
+		handler = withTelemetry(handler)
 	}
-}
-
-// handleIndex serves the main HTML page
-func handleIndex(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
-		return
-	}
-
-	http.ServeFile(w, r, "static/index.html")
+	handler = withRequestID(handler)
+	installLogFilter()
+	serve(addr, handler)
 }
 
 // handleStatic serves static files with proper Content-Type headers
 func handleStatic(w http.ResponseWriter, r *http.Request) {
 	// Remove /static/ prefix and prevent directory traversal
-	path := strings.TrimPrefix(r.URL.Path, "/static/")
-	if strings.Contains(path, "..") {
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	if strings.Contains(name, "..") {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
 
-	// Build full file path
-	filePath := filepath.Join("static", path)
+	// Build the path within the assets
+	filePath := path.Join("static", name)
 
 	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	if info, err := fs.Stat(assets, filePath); err != nil || info.IsDir() {
 		http.NotFound(w, r)
 		return
 	}
@@ -111,134 +761,388 @@ func handleStatic(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", contentType)
 	}
 
-	http.ServeFile(w, r, filePath)
+	http.ServeFileFS(w, r, assets, filePath)
 }
 
-// handleTranscribe proxies transcription requests to the Whisper API
+// maxUploadSize caps the size of an uploaded audio file (500MB)
+const maxUploadSize = 500 << 20
+
+// handleTranscribe streams uploaded audio to the Whisper API. The file part
+// is piped straight into the upstream request instead of being buffered, so
+// large uploads cost neither memory nor temporary disk space.
 func handleTranscribe(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	log.Println("Received transcription request")
+	logf(r.Context(), "Received transcription request")
 
-	// Parse multipart form (max 500MB)
-	if err := r.ParseMultipartForm(500 << 20); err != nil {
-		log.Printf("Error parsing form: %v", err)
-		http.Error(w, "Error parsing form data", http.StatusBadRequest)
-		return
+	// Answer the finished transcript in the negotiated format
+	format := mediaJSON
+	if streamFormat(r) == streamNone {
+		if format = negotiate(r, mediaJSON, mediaText, mediaVTT, mediaSRT); format == "" {
+			http.Error(w, notAcceptable(mediaJSON, mediaText, mediaVTT, mediaSRT), http.StatusNotAcceptable)
+			return
+		}
 	}
 
-	// Get the uploaded file
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		log.Printf("Error getting file: %v", err)
-		http.Error(w, "Error getting file from form", http.StatusBadRequest)
+	job, ok := startInteractiveJob(w, r, "transcription", true)
+	if !ok {
 		return
 	}
-	defer file.Close()
+	defer job.finish()
+	w, r = job, job.r
+	timer, caller, up, warnings := job.timer, job.caller, job.up, job.warnings
 
-	// Validate file extension
-	if !strings.HasSuffix(strings.ToLower(header.Filename), ".wav") {
-		http.Error(w, "Only WAV files are supported", http.StatusBadRequest)
+	// Queue or reject the upload when request buffers are over budget
+	lease, ok := admitRequest(w, r, uploadBufferEstimate)
+	if !ok {
 		return
 	}
+	defer lease.release()
+	prepStart := time.Now()
 
-	log.Printf("Processing file: %s (size: %d bytes)", header.Filename, header.Size)
+	// Limit and throttle the incoming upload
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	r.Body = throttleUpload(r.Context(), r.Body)
 
-	// Get optional language parameter
-	language := r.FormValue("language")
-
-	// Create multipart form for the API request
-	var requestBody bytes.Buffer
-	writer := multipart.NewWriter(&requestBody)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		logErrorf(r.Context(), "Error parsing form: %v", err)
+		http.Error(w, "Error parsing form data", http.StatusBadRequest)
+		return
+	}
 
-	// Add file field
-	filePart, err := writer.CreateFormFile("file", header.Filename)
+	// Collect the form fields sent before the file
+	fields := make(map[string]string)
+	filePart, err := readFieldsUntilFile(reader, fields)
 	if err != nil {
-		log.Printf("Error creating form file: %v", err)
-		http.Error(w, "Error creating request", http.StatusInternalServerError)
+		logErrorf(r.Context(), "Error parsing form: %v", err)
+		http.Error(w, "Error parsing form data", http.StatusBadRequest)
 		return
 	}
 
-	if _, err := io.Copy(filePart, file); err != nil {
-		log.Printf("Error copying file: %v", err)
-		http.Error(w, "Error processing file", http.StatusInternalServerError)
+	// Get the uploaded file
+	if filePart == nil {
+		logErrorf(r.Context(), "Error getting file: no file part in form")
+		http.Error(w, "Error getting file from form", http.StatusBadRequest)
+		return
+	}
+	filename := cleanFilename(filePart.FileName())
+	languages, err := languageHints(fields["language"], splitLanguages(fields["languages"]))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	delete(fields, "languages")
+	enhance, err := enhanceRequested(fields["enhance"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Add model field
-	if err := writer.WriteField("model", config.AudioModelName); err != nil {
-		log.Printf("Error adding model field: %v", err)
-		http.Error(w, "Error creating request", http.StatusInternalServerError)
+	// Check the format by the magic bytes and convert audio other than WAV
+	dir, err := ingestDir(tenantRegion(caller.Tenant))
+	if err != nil {
+		logErrorf(r.Context(), "Error preparing upload %s: %v", filename, err)
+		http.Error(w, regionUnavailableMessage, http.StatusServiceUnavailable)
+		return
+	}
+	audio, err := prepareUpload(r.Context(), filePart, filename, dir)
+	if err != nil {
+		logErrorf(r.Context(), "Error preparing upload %s: %v", filename, err)
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errUnsupportedAudio):
+			http.Error(w, "Unsupported audio format: upload WAV, MP3, M4A, FLAC, OGG or WebM", http.StatusBadRequest)
+		case errors.Is(err, errNoConverter):
+			http.Error(w, "Only WAV files are supported: converting other formats requires ffmpeg on the server", http.StatusUnsupportedMediaType)
+		case errors.Is(err, errConversion):
+			http.Error(w, "The audio could not be converted, it may be damaged", http.StatusBadRequest)
+		default:
+			http.Error(w, "Error receiving upload", http.StatusInternalServerError)
+		}
 		return
 	}
+	defer audio.Close()
 
-	// Add language field if provided
-	if language != "" && language != "auto" {
-		if err := writer.WriteField("language", language); err != nil {
-			log.Printf("Error adding language field: %v", err)
-			http.Error(w, "Error creating request", http.StatusInternalServerError)
+	logf(r.Context(), "Processing file: %s", filename)
+	job.create(map[string]any{"filename": filename})
+	complete := func(result *TranscriptionResult) {
+		recordWorkspaceAudio(caller.Workspace, result.Duration)
+		publishTranscriptCompleted(job.id, filename, result)
+		saveTranscript(caller, job.id, filename, result, "")
+	}
+
+	// Stream segments back as they are transcribed when the client asks for it
+	streamAs := streamFormat(r)
+	stream := streamAs != streamNone
+
+	// A list of languages may need the audio more than once, noisy audio
+	// is enhanced first, and music is looked for first, so it is received
+	// in full before it is transcribed
+	if len(languages) > 1 || enhance || config.MusicSkipping {
+		timer.since(stagePreprocess, prepStart)
+		result, err := transcribeUploadWithLanguages(r.Context(), up, audio, dir, languages, enhance)
+		if err != nil {
+			logErrorf(r.Context(), "Error transcribing %s: %v", filename, err)
+			var maxBytesErr *http.MaxBytesError
+			switch {
+			case errors.As(err, &maxBytesErr):
+				http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+			case upstreamBusy(w, err):
+			default:
+				http.Error(w, "Error calling transcription service", http.StatusBadGateway)
+			}
 			return
 		}
-		log.Printf("Language hint: %s", language)
+		logf(r.Context(), "Transcription successful")
+		complete(result)
+		switch {
+		case stream:
+			replayTranscription(newEventWriter(w, streamAs), result)
+		case format != mediaJSON:
+			writeTranscriptAs(w, format, result.Text, result.Duration, result.Segments)
+		default:
+			result.Timing = timer.timing()
+			result.QuotaWarnings = warnings
+			writeJSON(w, http.StatusOK, result)
+		}
+		return
 	}
 
-	if err := writer.Close(); err != nil {
-		log.Printf("Error closing writer: %v", err)
-		http.Error(w, "Error creating request", http.StatusInternalServerError)
-		return
+	// Build the API request body on the fly while the upload is still
+	// arriving, assessing the audio as it passes
+	pipeReader, pipeWriter := io.Pipe()
+	writer := multipart.NewWriter(pipeWriter)
+	var copyErr error
+	copyDone := make(chan struct{})
+	meter := &qualityMeter{}
+	go func() {
+		copyErr = streamTranscriptionForm(r.Context(), writer, reader, io.TeeReader(audio, meter), audio.Filename, fields, up.AudioModel, stream)
+		pipeWriter.CloseWithError(copyErr)
+		close(copyDone)
+	}()
+	defer func() {
+		// Unblock the copier if the API stopped reading early
+		pipeReader.Close()
+		<-copyDone
+	}()
+	// assess adds the assessment of the audio once the backend has answered
+	assess := func(result *TranscriptionResult) {
+		pipeReader.Close()
+		<-copyDone
+		result.AudioQuality = meter.quality()
+		logQuality(r.Context(), filename, result.AudioQuality)
 	}
 
 	// Forward request to Whisper API
-	apiURL := config.AudioInferenceURL + "/v1/audio/transcriptions"
-	log.Printf("Forwarding to: %s", apiURL)
+	apiURL := up.transcriptionURL()
+	logf(r.Context(), "Forwarding to: %s", apiURL)
 
-	req, err := http.NewRequest("POST", apiURL, &requestBody)
+	req, err := http.NewRequestWithContext(withAudioBackends(r.Context(), up), "POST", apiURL, pipeReader)
 	if err != nil {
-		log.Printf("Error creating request: %v", err)
+		logErrorf(r.Context(), "Error creating request: %v", err)
 		http.Error(w, "Error creating request", http.StatusInternalServerError)
 		return
 	}
 
 	req.Header.Set("Content-Type", writer.FormDataContentType())
+	up.authorizeAudio(req)
 
-	client := &http.Client{Timeout: 5 * time.Minute}
-	resp, err := client.Do(req)
+	timer.since(stagePreprocess, prepStart)
+	start := time.Now()
+	resp, err := audioClient.Do(req)
 	if err != nil {
-		log.Printf("Error calling API: %v", err)
+		// Tell a failed upload apart from an unreachable backend
+		pipeReader.Close()
+		<-copyDone
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(copyErr, &maxBytesErr) {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		logErrorf(r.Context(), "Error calling API: %v", err)
+		if upstreamBusy(w, err) {
+			return
+		}
 		http.Error(w, "Error calling transcription service", http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
+	if stream && resp.StatusCode == http.StatusOK {
+		result, err := relayTranscription(r.Context(), newEventWriter(w, streamAs), resp.Header.Get("Content-Type"), lease.reader(resp.Body), assess)
+		if err != nil {
+			job.fail(err)
+			return
+		}
+		recordTranscription(result, time.Since(start))
+		complete(result)
+		return
+	}
+
 	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	body, err := io.ReadAll(lease.reader(resp.Body))
 	if err != nil {
-		log.Printf("Error reading response: %v", err)
+		logErrorf(r.Context(), "Error reading response: %v", err)
+		if errors.Is(err, errMemoryBudgetExceeded) {
+			http.Error(w, "Server is busy, please retry later", http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "Error reading response", http.StatusInternalServerError)
 		return
 	}
 
 	// Check response status
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("API error (status %d): %s", resp.StatusCode, string(body))
-		http.Error(w, fmt.Sprintf("Transcription service error: %s", string(body)), resp.StatusCode)
+		logErrorf(r.Context(), "Transcription service error (status %d): %s", resp.StatusCode, describeBody(string(body)))
+		http.Error(w, backendErrorMessage("transcription", resp.StatusCode), http.StatusBadGateway)
+		return
+	}
+
+	// Normalize the backend's response before handing it to the client
+	parseStart := time.Now()
+	result, err := parseTranscriptionResponse(resp.Header.Get("Content-Type"), body)
+	if err != nil {
+		logErrorf(r.Context(), "Invalid API response: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
+	timer.since(stagePostprocess, parseStart)
+	assess(result)
 
-	log.Println("Transcription successful")
+	logf(r.Context(), "Transcription successful")
+	recordTranscription(result, time.Since(start))
+	complete(result)
 
-	// Forward response to client
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(body)
+	if format != mediaJSON {
+		writeTranscriptAs(w, format, result.Text, result.Duration, result.Segments)
+		return
+	}
+	result.Timing = timer.timing()
+	result.QuotaWarnings = warnings
+	writeJSON(w, http.StatusOK, result)
+}
+
+// publishTranscriptCompleted announces a finished transcription on the bus
+func publishTranscriptCompleted(jobID, filename string, result *TranscriptionResult) CloudEvent {
+	return publishEvent(EventTranscriptCompleted, jobID, map[string]any{
+		"filename": filename,
+		"language": result.Language,
+		"duration": result.Duration,
+		"text":     result.Text,
+	})
+}
+
+// maxFormFieldSize caps non-file form fields, which are held in memory
+const maxFormFieldSize = 64 << 10
+
+// readFormField stores a small form field value in fields
+func readFormField(part *multipart.Part, fields map[string]string) error {
+	value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+	if err != nil {
+		return err
+	}
+	if len(value) > maxFormFieldSize {
+		return fmt.Errorf("form field %q is too large", part.FormName())
+	}
+	fields[part.FormName()] = string(value)
+	return nil
+}
+
+// readFieldsUntilFile stores the form fields sent before the "file" part in
+// fields and returns the file part, nil when the form has none
+func readFieldsUntilFile(reader *multipart.Reader, fields map[string]string) (*multipart.Part, error) {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+		if err := readFormField(part, fields); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// streamTranscriptionForm writes the upstream multipart body: the model, the
+// audio as uploaded or converted, and any fields that follow the file
+func streamTranscriptionForm(ctx context.Context, writer *multipart.Writer, reader *multipart.Reader, audio io.Reader, filename string, fields map[string]string, model string, stream bool) error {
+	// Add model field
+	if err := writer.WriteField("model", model); err != nil {
+		return fmt.Errorf("adding model field: %w", err)
+	}
+
+	// Ask streaming-capable backends to send segments as they are decoded,
+	// and others for the segments' timestamps
+	if stream {
+		if err := writer.WriteField("stream", "true"); err != nil {
+			return fmt.Errorf("adding stream field: %w", err)
+		}
+	} else if err := writer.WriteField("response_format", config.AudioResponseFormat); err != nil {
+		return fmt.Errorf("adding response format field: %w", err)
+	}
+
+	// Add file field
+	dst, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return fmt.Errorf("creating form file: %w", err)
+	}
+	size, err := io.Copy(dst, audio)
+	if err != nil {
+		return fmt.Errorf("copying file: %w", err)
+	}
+	logf(ctx, "Uploaded %d bytes", size)
+
+	// Fields may also follow the file part
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading form: %w", err)
+		}
+		if err := readFormField(part, fields); err != nil {
+			return err
+		}
+	}
+
+	// Add language field if provided
+	if language := fields["language"]; language != "" && language != "auto" {
+		if err := writer.WriteField("language", language); err != nil {
+			return fmt.Errorf("adding language field: %w", err)
+		}
+		logf(ctx, "Language hint: %s", language)
+	}
+
+	return writer.Close()
 }
 
 // SummarizeRequest represents the request body for summarization
 type SummarizeRequest struct {
 	Text string `json:"text"`
+	// Truncation is the strategy for text over the input limit
+	Truncation string `json:"truncation,omitempty"`
+	// Segments of the transcript, to summarize the range selected by
+	// ?segments= or ?from=&to= instead of text
+	Segments []Segment `json:"segments,omitempty"`
+	// TranscriptID saves the summary of the whole text with the
+	// transcript in the history
+	TranscriptID string `json:"transcript_id,omitempty"`
+	// Style picks a built-in prompt, and CustomPrompt replaces the system
+	// prompt altogether
+	Style        string `json:"style,omitempty"`
+	CustomPrompt string `json:"custom_prompt,omitempty"`
 }
 
 // ChatCompletionRequest represents OpenAI-compatible chat completion request
@@ -246,6 +1150,8 @@ type ChatCompletionRequest struct {
 	Model       string    `json:"model"`
 	Messages    []Message `json:"messages"`
 	Temperature float64   `json:"temperature"`
+	Stream      bool      `json:"stream,omitempty"`
+	MaxTokens   int       `json:"max_tokens,omitempty"`
 }
 
 // Message represents a chat message
@@ -254,6 +1160,30 @@ type Message struct {
 	Content string `json:"content"`
 }
 
+// newSummaryRequest builds the chat completion request summarizing text
+// under the system prompt
+func newSummaryRequest(model, prompt, text string) ChatCompletionRequest {
+	return newSummaryPromptRequest(model, prompt, "Please summarize the following transcription:", text)
+}
+
+// newSummaryPromptRequest builds a summary request with its own instruction
+func newSummaryPromptRequest(model, prompt, instruction, text string) ChatCompletionRequest {
+	return ChatCompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{
+				Role:    "system",
+				Content: prompt + mixedLanguageInstruction(text),
+			},
+			{
+				Role:    "user",
+				Content: fmt.Sprintf("%s\n\n%s", instruction, text),
+			},
+		},
+		Temperature: 0.7,
+	}
+}
+
 // handleSummarize proxies summarization requests to the LLM API
 func handleSummarize(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -261,90 +1191,184 @@ func handleSummarize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Println("Received summarization request")
+	logf(r.Context(), "Received summarization request")
+	job, ok := startInteractiveJob(w, r, "summary", false)
+	if !ok {
+		return
+	}
+	defer job.finish()
+	w, r = job, job.r
+	timer, caller, up, warnings := job.timer, job.caller, job.up, job.warnings
+
+	// Queue or reject the request when request buffers are over budget
+	lease, ok := admitRequest(w, r, bodyEstimate(r.ContentLength))
+	if !ok {
+		return
+	}
+	defer lease.release()
 
 	// Parse JSON request
 	var req SummarizeRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("Error parsing JSON: %v", err)
+	if err := json.NewDecoder(lease.reader(r.Body)).Decode(&req); err != nil {
+		logErrorf(r.Context(), "Error parsing JSON: %v", err)
 		http.Error(w, "Error parsing request body", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
 
+	text, rng, err := selectRange(req.Segments, r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rng != nil {
+		req.Text = text
+	}
 	if req.Text == "" {
 		http.Error(w, "Text field is required", http.StatusBadRequest)
 		return
 	}
+	if req.Truncation != "" && !validTruncation(req.Truncation) {
+		http.Error(w, "truncation must be head, tail, smart-extract or chunked", http.StatusBadRequest)
+		return
+	}
+	if err := checkSummaryPrompt(req.Style, req.CustomPrompt); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	log.Printf("Summarizing text (length: %d characters)", len(req.Text))
+	logf(r.Context(), "Summarizing text (length: %d characters)", len(req.Text))
+	job.create(map[string]any{"text_length": len(req.Text)})
 
-	// Create chat completion request
-	chatReq := ChatCompletionRequest{
-		Model: config.LLMModelName,
-		Messages: []Message{
-			{
-				Role:    "system",
-				Content: "You are a helpful assistant that summarizes transcribed audio. Provide a clear, concise summary of the main points.",
-			},
-			{
-				Role:    "user",
-				Content: fmt.Sprintf("Please summarize the following transcription:\n\n%s", req.Text),
-			},
-		},
-		Temperature: 0.7,
+	// Create chat completion request, reducing text over the input limit
+	chatReq, truncation, err := prepareSummary(r.Context(), up, req.Text, req.Truncation, summaryPrompt(req.Style, req.CustomPrompt))
+	if err != nil {
+		logErrorf(r.Context(), "Error preparing summary: %v", err)
+		if errors.Is(err, errTextTooLong) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if upstreamBusy(w, err) {
+			return
+		}
+		http.Error(w, "Error calling summarization service", http.StatusBadGateway)
+		return
+	}
+	if truncation != nil {
+		logf(r.Context(), "Text over %d characters, summarizing with the %s strategy", config.SummaryMaxInputChars, truncation.Strategy)
+	}
+	decorate := func(result *SummaryResult) {
+		result.Truncation = truncation
+		result.Range = rng
 	}
 
+	// Stream the completion back token by token when the client asks for it
+	format := streamFormat(r)
+	chatReq.Stream = format != streamNone
+
 	// Marshal request to JSON
 	jsonData, err := json.Marshal(chatReq)
 	if err != nil {
-		log.Printf("Error marshaling JSON: %v", err)
+		logErrorf(r.Context(), "Error marshaling JSON: %v", err)
 		http.Error(w, "Error creating request", http.StatusInternalServerError)
 		return
 	}
 
 	// Forward request to LLM API
-	apiURL := config.LLMInferenceURL + "/v1/chat/completions"
-	log.Printf("Forwarding to: %s", apiURL)
+	apiURL := up.chatURL()
+	logf(r.Context(), "Forwarding to: %s", apiURL)
 
-	apiReq, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonData))
+	apiReq, err := http.NewRequestWithContext(r.Context(), "POST", apiURL, bytes.NewBuffer(jsonData))
 	if err != nil {
-		log.Printf("Error creating request: %v", err)
+		logErrorf(r.Context(), "Error creating request: %v", err)
 		http.Error(w, "Error creating request", http.StatusInternalServerError)
 		return
 	}
 
 	apiReq.Header.Set("Content-Type", "application/json")
+	up.authorizeLLM(apiReq)
 
-	client := &http.Client{Timeout: 2 * time.Minute}
-	resp, err := client.Do(apiReq)
+	resp, err := llmClient.Do(apiReq)
 	if err != nil {
-		log.Printf("Error calling API: %v", err)
+		logErrorf(r.Context(), "Error calling API: %v", err)
+		if upstreamBusy(w, err) {
+			return
+		}
 		http.Error(w, "Error calling summarization service", http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
+	if chatReq.Stream && resp.StatusCode == http.StatusOK {
+		result, err := relaySummary(r.Context(), newEventWriter(w, format), resp.Header.Get("Content-Type"), lease.reader(resp.Body), decorate)
+		if err != nil {
+			job.fail(err)
+			return
+		}
+		publishSummaryCompleted(job.id, result)
+		if req.TranscriptID != "" && rng == nil {
+			saveSummary(caller, req.TranscriptID, result.Summary)
+		}
+		return
+	}
+
 	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	body, err := io.ReadAll(lease.reader(resp.Body))
 	if err != nil {
-		log.Printf("Error reading response: %v", err)
+		logErrorf(r.Context(), "Error reading response: %v", err)
+		if errors.Is(err, errMemoryBudgetExceeded) {
+			http.Error(w, "Server is busy, please retry later", http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "Error reading response", http.StatusInternalServerError)
 		return
 	}
 
 	// Check response status
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("API error (status %d): %s", resp.StatusCode, string(body))
-		http.Error(w, fmt.Sprintf("Summarization service error: %s", string(body)), resp.StatusCode)
+		logErrorf(r.Context(), "Summarization service error (status %d): %s", resp.StatusCode, describeBody(string(body)))
+		http.Error(w, backendErrorMessage("summarization", resp.StatusCode), http.StatusBadGateway)
 		return
 	}
 
-	log.Println("Summarization successful")
+	// Normalize the backend's response before handing it to the client
+	result, err := parseChatCompletionResponse(body)
+	if err != nil {
+		logErrorf(r.Context(), "Invalid API response: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if result.Summary == "" {
+		logf(r.Context(), "API returned an empty summary")
+		http.Error(w, "LLM backend returned an empty completion", http.StatusBadGateway)
+		return
+	}
 
-	// Forward response to client
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(body)
+	logf(r.Context(), "Summarization successful")
+	publishSummaryCompleted(job.id, result)
+	if req.TranscriptID != "" && rng == nil {
+		saveSummary(caller, req.TranscriptID, result.Summary)
+	}
+
+	result.Timing = timer.timing()
+	result.QuotaWarnings = warnings
+	decorate(result)
+	writeJSON(w, http.StatusOK, result)
 }
 
+// publishSummaryCompleted announces a finished summary on the bus
+func publishSummaryCompleted(jobID string, result *SummaryResult) CloudEvent {
+	return publishEvent(EventSummaryCompleted, jobID, map[string]any{
+		"model":   result.Model,
+		"summary": result.Summary,
+	})
+}
+
+// writeJSON encodes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logErrorf(context.Background(), "Error writing response: %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A few operational settings can be changed while the server runs, without
+// a restart: the backend concurrency limits, the upload bandwidth limits,
+// the log level and maintenance mode. GET /admin/v1/settings shows them and
+// PATCH changes some of them; DELETE goes back to the environment's values.
+// Changes are kept in the state store, so every replica applies them within
+// settingsPollInterval and, with Redis, they survive restarts. Maintenance
+// mode is the one of maintenance.go, shown here so all of them are in one
+// place.
+
+// settingsKey holds the settings changed at runtime in the state store
+const settingsKey = "settings"
+
+// settingsPollInterval is how often replicas pick up changed settings
+const settingsPollInterval = 5 * time.Second
+
+// Log levels, from the most verbose
+const (
+	logLevelInfo  = "info"
+	logLevelWarn  = "warn"
+	logLevelError = "error"
+)
+
+// Settings are the settings that can be changed at runtime, as in effect
+type Settings struct {
+	AudioMaxConcurrency   int    `json:"audio_max_concurrency"`
+	LLMMaxConcurrency     int    `json:"llm_max_concurrency"`
+	UploadRateLimit       int64  `json:"upload_rate_limit"`
+	GlobalUploadRateLimit int64  `json:"upload_global_rate_limit"`
+	LogLevel              string `json:"log_level"`
+}
+
+// settingsOverrides are the settings changed at runtime; the others keep
+// the environment's values
+type settingsOverrides struct {
+	AudioMaxConcurrency   *int       `json:"audio_max_concurrency,omitempty"`
+	LLMMaxConcurrency     *int       `json:"llm_max_concurrency,omitempty"`
+	UploadRateLimit       *int64     `json:"upload_rate_limit,omitempty"`
+	GlobalUploadRateLimit *int64     `json:"upload_global_rate_limit,omitempty"`
+	LogLevel              *string    `json:"log_level,omitempty"`
+	UpdatedAt             *time.Time `json:"updated_at,omitempty"`
+}
+
+// settingsPatch is the body of PATCH /admin/v1/settings
+type settingsPatch struct {
+	settingsOverrides
+	// "off", "queue" or "reject"
+	MaintenanceMode *string `json:"maintenance_mode,omitempty"`
+}
+
+// settingsView is the answer of the settings endpoints
+type settingsView struct {
+	Settings
+	MaintenanceMode string `json:"maintenance_mode"`
+	// Overridden lists the settings changed at runtime
+	Overridden []string   `json:"overridden"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+}
+
+// appliedSettings are the settings this replica applies
+var appliedSettings struct {
+	sync.Mutex
+	value Settings
+}
+
+// logLevel is the log level of the settings applied, used once the log
+// filter is installed
+var logLevel atomic.Value
+
+// logFilterInstalled is set once the log level applies
+var logFilterInstalled atomic.Bool
+
+// validLogLevel reports whether level is a log level
+func validLogLevel(level string) bool {
+	switch level {
+	case logLevelInfo, logLevelWarn, logLevelError:
+		return true
+	}
+	return false
+}
+
+// environmentSettings are the settings of the environment
+func environmentSettings() Settings {
+	return Settings{
+		AudioMaxConcurrency:   config.AudioMaxConcurrency,
+		LLMMaxConcurrency:     config.LLMMaxConcurrency,
+		UploadRateLimit:       config.UploadRateLimit,
+		GlobalUploadRateLimit: config.GlobalUploadRateLimit,
+		LogLevel:              config.LogLevel,
+	}
+}
+
+// merge returns s with the overrides applied
+func (o settingsOverrides) merge(s Settings) Settings {
+	if o.AudioMaxConcurrency != nil {
+		s.AudioMaxConcurrency = *o.AudioMaxConcurrency
+	}
+	if o.LLMMaxConcurrency != nil {
+		s.LLMMaxConcurrency = *o.LLMMaxConcurrency
+	}
+	if o.UploadRateLimit != nil {
+		s.UploadRateLimit = *o.UploadRateLimit
+	}
+	if o.GlobalUploadRateLimit != nil {
+		s.GlobalUploadRateLimit = *o.GlobalUploadRateLimit
+	}
+	if o.LogLevel != nil {
+		s.LogLevel = *o.LogLevel
+	}
+	return s
+}
+
+// names lists the overridden settings
+func (o settingsOverrides) names() []string {
+	names := []string{}
+	if o.AudioMaxConcurrency != nil {
+		names = append(names, "audio_max_concurrency")
+	}
+	if o.LLMMaxConcurrency != nil {
+		names = append(names, "llm_max_concurrency")
+	}
+	if o.UploadRateLimit != nil {
+		names = append(names, "upload_rate_limit")
+	}
+	if o.GlobalUploadRateLimit != nil {
+		names = append(names, "upload_global_rate_limit")
+	}
+	if o.LogLevel != nil {
+		names = append(names, "log_level")
+	}
+	return names
+}
+
+// validate returns a message for the admin listing the invalid overrides
+func (o settingsOverrides) validate() string {
+	var problems []string
+	if o.AudioMaxConcurrency != nil && *o.AudioMaxConcurrency < 0 {
+		problems = append(problems, "audio_max_concurrency must be 0 (unlimited) or more")
+	}
+	if o.LLMMaxConcurrency != nil && *o.LLMMaxConcurrency < 0 {
+		problems = append(problems, "llm_max_concurrency must be 0 (unlimited) or more")
+	}
+	if o.UploadRateLimit != nil && *o.UploadRateLimit < 0 {
+		problems = append(problems, "upload_rate_limit must be 0 (unlimited) or bytes per second")
+	}
+	if o.GlobalUploadRateLimit != nil && *o.GlobalUploadRateLimit < 0 {
+		problems = append(problems, "upload_global_rate_limit must be 0 (unlimited) or bytes per second")
+	}
+	if o.LogLevel != nil && !validLogLevel(*o.LogLevel) {
+		problems = append(problems, "log_level must be info, warn or error")
+	}
+	return strings.Join(problems, "; ")
+}
+
+// loadSettingsOverrides reads the settings changed at runtime
+func loadSettingsOverrides() (settingsOverrides, error) {
+	var o settingsOverrides
+	data, ok, err := state.get(settingsKey)
+	if err != nil || !ok {
+		return o, err
+	}
+	return o, json.Unmarshal(data, &o)
+}
+
+// applySettings puts s into effect on this replica
+func applySettings(s Settings) {
+	appliedSettings.Lock()
+	defer appliedSettings.Unlock()
+	previous := appliedSettings.value
+	if s == previous {
+		return
+	}
+	if s.AudioMaxConcurrency != previous.AudioMaxConcurrency {
+		audioLimiter.setLimit(s.AudioMaxConcurrency, reservedSlots(s.AudioMaxConcurrency, config.InteractiveReservedShare))
+	}
+	if s.LLMMaxConcurrency != previous.LLMMaxConcurrency {
+		llmLimiter.setLimit(s.LLMMaxConcurrency, reservedSlots(s.LLMMaxConcurrency, config.InteractiveReservedShare))
+	}
+	setUploadLimits(s.UploadRateLimit, s.GlobalUploadRateLimit)
+	logLevel.Store(s.LogLevel)
+	appliedSettings.value = s
+	logf(context.Background(), "Settings applied: audio concurrency %d, LLM concurrency %d, upload limits %d/%d bytes/s, log level %s", s.AudioMaxConcurrency, s.LLMMaxConcurrency, s.UploadRateLimit, s.GlobalUploadRateLimit, s.LogLevel)
+}
+
+// currentSettings returns the settings in effect on this replica
+func currentSettings() Settings {
+	appliedSettings.Lock()
+	defer appliedSettings.Unlock()
+	return appliedSettings.value
+}
+
+// refreshSettings applies the settings of the state store. Errors keep the
+// settings in effect.
+func refreshSettings() {
+	o, err := loadSettingsOverrides()
+	if err != nil {
+		logErrorf(context.Background(), "Error reading settings: %v", err)
+		return
+	}
+	applySettings(o.merge(environmentSettings()))
+}
+
+// initSettings applies the settings changed at runtime, then follows them
+func initSettings() {
+	appliedSettings.value = environmentSettings()
+	refreshSettings()
+	go func() {
+		for range time.Tick(settingsPollInterval) {
+			refreshSettings()
+		}
+	}()
+}
+
+// settingsResponse describes the settings in effect
+func settingsResponse(o settingsOverrides) settingsView {
+	view := settingsView{Settings: currentSettings(), MaintenanceMode: "off", Overridden: o.names(), UpdatedAt: o.UpdatedAt}
+	if m := currentMaintenance(); m.Enabled {
+		view.MaintenanceMode = m.Mode
+	}
+	return view
+}
+
+// handleSettingsGet shows the runtime settings
+func handleSettingsGet(w http.ResponseWriter, r *http.Request) {
+	o, err := loadSettingsOverrides()
+	if err != nil {
+		logErrorf(r.Context(), "Error reading settings: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error reading settings")
+		return
+	}
+	writeJSON(w, http.StatusOK, settingsResponse(o))
+}
+
+// handleSettingsPatch changes runtime settings. Settings left out of the
+// body keep their value.
+func handleSettingsPatch(w http.ResponseWriter, r *http.Request) {
+	var patch settingsPatch
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		integrationError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if msg := patch.validate(); msg != "" {
+		integrationError(w, http.StatusBadRequest, msg)
+		return
+	}
+	if mode := patch.MaintenanceMode; mode != nil && *mode != "off" && *mode != maintenanceQueue && *mode != maintenanceReject {
+		integrationError(w, http.StatusBadRequest, "maintenance_mode must be off, queue or reject")
+		return
+	}
+
+	o, err := loadSettingsOverrides()
+	if err == nil {
+		changed := patch.settingsOverrides
+		if changed.AudioMaxConcurrency != nil {
+			o.AudioMaxConcurrency = changed.AudioMaxConcurrency
+		}
+		if changed.LLMMaxConcurrency != nil {
+			o.LLMMaxConcurrency = changed.LLMMaxConcurrency
+		}
+		if changed.UploadRateLimit != nil {
+			o.UploadRateLimit = changed.UploadRateLimit
+		}
+		if changed.GlobalUploadRateLimit != nil {
+			o.GlobalUploadRateLimit = changed.GlobalUploadRateLimit
+		}
+		if changed.LogLevel != nil {
+			o.LogLevel = changed.LogLevel
+		}
+		now := time.Now().UTC()
+		o.UpdatedAt = &now
+		var data []byte
+		if data, err = json.Marshal(o); err == nil {
+			err = state.set(settingsKey, data, 0)
+		}
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Error saving settings: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error saving settings")
+		return
+	}
+	applySettings(o.merge(environmentSettings()))
+
+	if mode := patch.MaintenanceMode; mode != nil {
+		current := currentMaintenance()
+		switch {
+		case *mode == "off" && current.Enabled:
+			err = endMaintenance()
+		case *mode != "off" && (!current.Enabled || current.Mode != *mode):
+			_, _, err = startMaintenance(maintenanceRequest{Mode: *mode, Message: current.Message, Until: current.Until})
+		}
+		if err != nil {
+			logErrorf(r.Context(), "Error saving maintenance state: %v", err)
+			integrationError(w, http.StatusInternalServerError, "Error saving maintenance state")
+			return
+		}
+	}
+	logf(r.Context(), "Admin changed settings: %s", strings.Join(patchedNames(patch), ", "))
+	writeJSON(w, http.StatusOK, settingsResponse(o))
+}
+
+// patchedNames lists the settings a patch changes
+func patchedNames(patch settingsPatch) []string {
+	names := patch.settingsOverrides.names()
+	if patch.MaintenanceMode != nil {
+		names = append(names, "maintenance_mode")
+	}
+	return names
+}
+
+// handleSettingsDelete goes back to the environment's settings. Maintenance
+// mode is left as it is.
+func handleSettingsDelete(w http.ResponseWriter, r *http.Request) {
+	if err := state.delete(settingsKey); err != nil {
+		logErrorf(r.Context(), "Error deleting settings: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error saving settings")
+		return
+	}
+	applySettings(environmentSettings())
+	logf(r.Context(), "Admin reset the settings to the environment's")
+	writeJSON(w, http.StatusOK, settingsResponse(settingsOverrides{}))
+}
+
+// installLogFilter applies the log level once the server has started, so
+// startup messages are always shown
+func installLogFilter() {
+	logLevel.Store(currentSettings().LogLevel)
+	logFilterInstalled.Store(true)
+}
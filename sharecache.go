@@ -0,0 +1,194 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Share links get posted publicly and can draw far more traffic than the
+// app itself. Rendered share pages are therefore cached in memory for
+// SHARE_CACHE_TTL, up to SHARE_CACHE_SIZE pages, so a popular link costs
+// one state store read and one render per replica and period, and requests
+// for a page being rendered wait for that render. At most SHARE_MAX_RENDERS
+// pages are rendered at once; requests beyond that get 503 rather than load
+// the state store. With SHARE_STORE_URL, links and transcriptions are read
+// from a read-only Redis replica instead of the primary, and SERVE_MODE=shares
+// runs a replica of the app that serves nothing but share pages, to deploy
+// apart from it behind the public hostname.
+
+// Serve modes
+const (
+	serveModeAll    = "all"
+	serveModeShares = "shares"
+)
+
+// shareState is the store share links and their transcriptions are read
+// from: the state store, or the replica at SHARE_STORE_URL
+var shareState kvStore
+
+// errShareBusy is returned when SHARE_MAX_RENDERS pages are being rendered
+var errShareBusy = errors.New("too many share pages being rendered")
+
+// sharePage is a rendered share page, or the record that its link is
+// invalid when body is nil
+type sharePage struct {
+	key     string
+	jobID   string
+	body    []byte
+	expires time.Time
+}
+
+// shareRender is a render in progress that other requests for the page
+// wait for
+type shareRender struct {
+	done chan struct{}
+	page *sharePage
+	err  error
+}
+
+// shareCache holds rendered share pages, least recently used first out
+type shareCache struct {
+	mu       sync.Mutex
+	pages    map[string]*list.Element
+	order    *list.List
+	inflight map[string]*shareRender
+	// renders limits the pages rendered at once
+	renders chan struct{}
+}
+
+var sharePages = newShareCache(1)
+
+func newShareCache(maxRenders int) *shareCache {
+	return &shareCache{
+		pages:    make(map[string]*list.Element),
+		order:    list.New(),
+		inflight: make(map[string]*shareRender),
+		renders:  make(chan struct{}, maxRenders),
+	}
+}
+
+// page returns the cached page under key, or renders it with render
+func (c *shareCache) page(key string, render func() (*sharePage, error)) (*sharePage, error) {
+	c.mu.Lock()
+	if e, ok := c.pages[key]; ok {
+		page := e.Value.(*sharePage)
+		if time.Now().Before(page.expires) {
+			c.order.MoveToFront(e)
+			c.mu.Unlock()
+			return page, nil
+		}
+		c.order.Remove(e)
+		delete(c.pages, key)
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.page, call.err
+	}
+	select {
+	case c.renders <- struct{}{}:
+	default:
+		c.mu.Unlock()
+		return nil, errShareBusy
+	}
+	call := &shareRender{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	call.page, call.err = render()
+	<-c.renders
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if call.err == nil && config.ShareCacheTTL > 0 && config.ShareCacheSize > 0 {
+		call.page.key = key
+		c.pages[key] = c.order.PushFront(call.page)
+		for c.order.Len() > config.ShareCacheSize {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.pages, oldest.Value.(*sharePage).key)
+		}
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.page, call.err
+}
+
+// forget drops the cached pages of a job, so a change made through this
+// replica shows at once
+func (c *shareCache) forget(jobID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		if page := e.Value.(*sharePage); page.jobID == jobID {
+			c.order.Remove(e)
+			delete(c.pages, page.key)
+		}
+		e = next
+	}
+}
+
+// initShareCache sizes the share page cache and connects to the share
+// store replica
+func initShareCache() {
+	sharePages = newShareCache(config.ShareMaxRenders)
+	shareState = state
+	if config.ShareStoreURL.Value() == "" {
+		return
+	}
+	store, err := newRedisStore(config.ShareStoreURL)
+	if err != nil {
+		log.Fatalf("Error connecting to the share store replica: %v", err)
+	}
+	shareState = store
+	logf(context.Background(), "Share links read from the share store replica")
+}
+
+// serveShares runs the app as a public replica serving only share pages
+func serveShares() {
+	initSettings()
+	initShareCache()
+	initViews()
+	initBranding()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/static/", handleStatic)
+	mux.HandleFunc("GET /shared/{token}", handleSharedView)
+	mux.HandleFunc("GET /shared/{token}/print", handleSharedPrint)
+	mux.HandleFunc("GET /version", handleVersion)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleSharesReadyz)
+
+	addr := ":" + config.Port
+	logf(context.Background(), "Serving share pages only, listening on %s", addr)
+	handler := withRequestID(withVersion(withSecurityHeaders(mux)))
+	installLogFilter()
+	serve(addr, handler)
+}
+
+// handleSharesReadyz reports whether a share replica can read links
+func handleSharesReadyz(w http.ResponseWriter, r *http.Request) {
+	status := ReadinessStatus{Status: "ready", Checks: make(map[string]CheckResult)}
+	if _, _, err := shareState.get(shareKeyPrefix); err != nil {
+		status.Checks["store"] = CheckResult{OK: false, Detail: err.Error()}
+	} else {
+		status.Checks["store"] = CheckResult{OK: true}
+	}
+	if shuttingDown.Load() {
+		status.Checks["shutdown"] = CheckResult{OK: false, Detail: "shutting down"}
+	}
+	code := http.StatusOK
+	for _, check := range status.Checks {
+		if !check.OK {
+			status.Status = "not ready"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, status)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// On SIGTERM the server drains instead of dying with uploads half received.
+// /readyz fails at once so load balancers stop routing to the replica, and
+// new uploads, jobs and live sessions are refused with 503 while it keeps
+// listening for SHUTDOWN_DELAY, the time load balancers take to notice. The
+// server then stops listening and gives the requests in flight, and the
+// background jobs running, what is left of SHUTDOWN_TIMEOUT to finish. A
+// second signal exits at once; Ctrl-C (SIGINT) skips the delay.
+
+// shutdownPollInterval is how often running background jobs are checked
+const shutdownPollInterval = time.Second
+
+// shuttingDown is set once the server has been told to stop
+var shuttingDown atomic.Bool
+
+// shutdownRejected counts the requests refused while shutting down
+var shutdownRejected = expvar.NewInt("shutdown_rejected_total")
+
+// serve serves handler on addr until a signal stops it, then drains
+func serve(addr string, handler http.Handler) {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+
+	var sig os.Signal
+	select {
+	case err := <-errc:
+		log.Fatalf("Error listening on %s: %v", addr, err)
+	case sig = <-signals:
+	}
+	shuttingDown.Store(true)
+	go func() {
+		<-signals
+		logWarnf(context.Background(), "Warning: second signal received, exiting without draining")
+		os.Exit(1)
+	}()
+	logf(context.Background(), "Received %v, shutting down within %s", sig, config.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if sig != os.Interrupt && config.ShutdownDelay > 0 {
+		select {
+		case <-time.After(config.ShutdownDelay):
+		case <-ctx.Done():
+		}
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		logWarnf(ctx, "Warning: requests still in flight after %s are cut off: %v", config.ShutdownTimeout, err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		logErrorf(ctx, "Error listening on %s: %v", addr, err)
+	}
+	waitForJobWorkers(ctx)
+	flushState()
+	logf(ctx, "Server stopped")
+}
+
+// waitForJobWorkers waits until no background job is running or queued on
+// this replica, or ctx ends
+func waitForJobWorkers(ctx context.Context) {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for jobWorkersBusy.Value() > 0 || jobQueueLength.Value() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logWarnf(ctx, "Warning: %d background jobs running and %d queued are cut off", jobWorkersBusy.Value(), jobQueueLength.Value())
+			return
+		}
+	}
+}
+
+// refuseWhileShuttingDown answers 503 to new work once the server is
+// shutting down, and closes the connection so the client's retry reaches
+// another replica
+func refuseWhileShuttingDown(w http.ResponseWriter, integration bool) bool {
+	if !shuttingDown.Load() {
+		return false
+	}
+	shutdownRejected.Add(1)
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(config.ShutdownDelay.Seconds()), 1)))
+	const msg = "The server is shutting down, please retry"
+	if integration {
+		integrationError(w, http.StatusServiceUnavailable, msg)
+	} else {
+		http.Error(w, msg, http.StatusServiceUnavailable)
+	}
+	return true
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The speech pipeline is for sermons, talks and other prepared speeches:
+// its outline step asks the LLM for the main message, the outline, the
+// passages and works the speaker cited, and a short excerpt worth sharing.
+// What counts as a reference is SPEECH_REFERENCES, e.g. Bible verses. As
+// for agenda reports, the LLM points at numbered segments, so every point
+// and reference gets its time in the recording, and the excerpt is the
+// speaker's exact words, at most SPEECH_EXCERPT_SECONDS long.
+
+// SpeechOutline is the structure of a speech
+type SpeechOutline struct {
+	// Message is the speech's main message in one sentence
+	Message    string            `json:"message"`
+	Points     []OutlinePoint    `json:"points"`
+	References []SpeechReference `json:"references"`
+	Excerpt    *Excerpt          `json:"excerpt,omitempty"`
+}
+
+// OutlinePoint is a main point of a speech. Start is when it begins in the
+// recording, if known.
+type OutlinePoint struct {
+	Heading   string   `json:"heading"`
+	Subpoints []string `json:"subpoints,omitempty"`
+	Start     *float64 `json:"start,omitempty"`
+}
+
+// SpeechReference is a passage or work the speaker cited, with the words
+// quoted from it
+type SpeechReference struct {
+	Reference string   `json:"reference"`
+	Quote     string   `json:"quote,omitempty"`
+	Start     *float64 `json:"start,omitempty"`
+}
+
+// Excerpt is a passage of the speech to share, in the speaker's words
+type Excerpt struct {
+	TranscriptRange
+	Text string `json:"text"`
+}
+
+// speechPrompt instructs the LLM to answer with JSON only; %s is
+// SPEECH_REFERENCES and %d SPEECH_EXCERPT_SECONDS
+const speechPrompt = `You outline the transcript of a speech, such as a sermon or a talk. The transcript is given as lines "[ID mm:ss] text", one per segment. Answer with a JSON object only, without any other text, with the fields:
+- "message": the main message of the speech in one sentence
+- "points": the main points in order, each an object with a "heading", "subpoints", a list of short sentences, and "segment", the ID of the segment where the point begins
+- "references": the %s the speaker cited, each an object with the "reference" in its usual form, the "quote" the speaker read or quoted from it, if any, and the "segment" where it was cited
+- "excerpt": the passage most worth sharing on its own, as an object with the "first_segment" and "last_segment" IDs, at most about %d seconds long`
+
+// newSpeechRequest builds the chat completion request outlining segments
+func newSpeechRequest(model string, segments []Segment) ChatCompletionRequest {
+	var transcript strings.Builder
+	for _, s := range segments {
+		transcript.WriteString(segmentLine(s))
+		transcript.WriteByte('\n')
+	}
+	return ChatCompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: "system", Content: fmt.Sprintf(speechPrompt, config.SpeechReferences, int(config.SpeechExcerptSeconds))},
+			{Role: "user", Content: fmt.Sprintf("Transcript:\n\n%s", transcript.String())},
+		},
+		Temperature: 0,
+	}
+}
+
+// outlineSpeech asks the LLM for the outline of a speech. A transcript
+// without segments is sent as one segment, so nothing is timed.
+func outlineSpeech(ctx context.Context, up Upstream, text string, segments []Segment) (*SpeechOutline, error) {
+	timed := len(segments) > 0
+	if !timed {
+		segments = []Segment{{Text: text}}
+	}
+	var raw speechAnswer
+	if err := llmJSON(ctx, up, newSpeechRequest(up.LLMModel, segments), &raw); err != nil {
+		return nil, err
+	}
+	if !timed {
+		segments = nil
+	}
+	return speechOutline(raw, segments)
+}
+
+// speechAnswer is the LLM's answer
+type speechAnswer struct {
+	Message string `json:"message"`
+	Points  []struct {
+		Heading   string   `json:"heading"`
+		Subpoints []string `json:"subpoints"`
+		Segment   *int     `json:"segment"`
+	} `json:"points"`
+	References []struct {
+		Reference string `json:"reference"`
+		Quote     string `json:"quote"`
+		Segment   *int   `json:"segment"`
+	} `json:"references"`
+	Excerpt *struct {
+		FirstSegment int `json:"first_segment"`
+		LastSegment  int `json:"last_segment"`
+	} `json:"excerpt"`
+}
+
+// speechOutline builds the outline from the LLM's answer. Segment IDs that
+// were not sent are ignored, and an excerpt longer than
+// SPEECH_EXCERPT_SECONDS is cut short after its first segment.
+func speechOutline(raw speechAnswer, segments []Segment) (*SpeechOutline, error) {
+	byID := make(map[int]int, len(segments))
+	for i, s := range segments {
+		byID[s.ID] = i
+	}
+	startOf := func(id *int) *float64 {
+		if id == nil {
+			return nil
+		}
+		i, ok := byID[*id]
+		if !ok {
+			return nil
+		}
+		start := segments[i].Start
+		return &start
+	}
+
+	outline := &SpeechOutline{Message: strings.TrimSpace(raw.Message), Points: []OutlinePoint{}, References: []SpeechReference{}}
+	for _, p := range raw.Points {
+		point := OutlinePoint{Heading: strings.TrimSpace(p.Heading), Subpoints: trimAll(p.Subpoints), Start: startOf(p.Segment)}
+		if point.Heading != "" {
+			outline.Points = append(outline.Points, point)
+		}
+	}
+	for _, r := range raw.References {
+		ref := SpeechReference{Reference: strings.TrimSpace(r.Reference), Quote: strings.TrimSpace(r.Quote), Start: startOf(r.Segment)}
+		if ref.Reference != "" {
+			outline.References = append(outline.References, ref)
+		}
+	}
+	if outline.Message == "" && len(outline.Points) == 0 {
+		return nil, &UpstreamError{Service: "LLM", Message: "outline answer is empty"}
+	}
+
+	if raw.Excerpt != nil {
+		first, okFirst := byID[raw.Excerpt.FirstSegment]
+		last, okLast := byID[raw.Excerpt.LastSegment]
+		if okFirst && okLast && last >= first {
+			var parts []string
+			excerpt := &Excerpt{TranscriptRange: TranscriptRange{Start: segments[first].Start, FirstSegment: segments[first].ID}}
+			for _, s := range segments[first : last+1] {
+				if len(parts) > 0 && s.End-excerpt.Start > config.SpeechExcerptSeconds {
+					break
+				}
+				excerpt.End, excerpt.LastSegment = s.End, s.ID
+				parts = append(parts, strings.TrimSpace(s.Text))
+			}
+			excerpt.Text = strings.Join(parts, " ")
+			outline.Excerpt = excerpt
+		}
+	}
+	return outline, nil
+}
+
+// handleOutlineExport downloads a job's speech outline as Markdown, ready
+// to post
+func handleOutlineExport(w http.ResponseWriter, r *http.Request) {
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !principalFrom(r.Context()).sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	outline := job.Outline
+	if outline == nil {
+		integrationError(w, http.StatusNotFound, "Transcription has no outline")
+		return
+	}
+	at := func(start *float64) string {
+		if start == nil {
+			return ""
+		}
+		return fmt.Sprintf(" (%s)", formatTimestamp(*start))
+	}
+
+	var doc strings.Builder
+	fmt.Fprintf(&doc, "# %s\n\n", jobTitle(job))
+	if outline.Message != "" {
+		fmt.Fprintf(&doc, "*%s*\n\n", outline.Message)
+	}
+	if len(outline.Points) > 0 {
+		doc.WriteString("## Outline\n\n")
+		for i, p := range outline.Points {
+			fmt.Fprintf(&doc, "%d. %s%s\n", i+1, p.Heading, at(p.Start))
+			for _, sub := range p.Subpoints {
+				fmt.Fprintf(&doc, "   - %s\n", sub)
+			}
+		}
+		doc.WriteString("\n")
+	}
+	if len(outline.References) > 0 {
+		doc.WriteString("## References\n\n")
+		for _, ref := range outline.References {
+			fmt.Fprintf(&doc, "- **%s**%s", ref.Reference, at(ref.Start))
+			if ref.Quote != "" {
+				fmt.Fprintf(&doc, ": “%s”", ref.Quote)
+			}
+			doc.WriteString("\n")
+		}
+		doc.WriteString("\n")
+	}
+	if e := outline.Excerpt; e != nil {
+		fmt.Fprintf(&doc, "## Excerpt (%s–%s)\n\n> %s\n", formatTimestamp(e.Start), formatTimestamp(e.End), e.Text)
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	setAttachment(w, job.ID+"-outline", ".md")
+	io.WriteString(w, doc.String())
+}
@@ -5,15 +5,21 @@ let recordingStartTime = null;
 let timerInterval = null;
 let currentAudioBlob = null;
 let currentTranscription = null;
+let currentTranscriptId = null;
+let recordingDisclosure = '';
 
 // DOM Elements
 const startRecordBtn = document.getElementById('startRecordBtn');
 const stopRecordBtn = document.getElementById('stopRecordBtn');
 const recordingTimer = document.getElementById('recordingTimer');
+const liveToggle = document.getElementById('liveToggle');
+const bookmarkBtn = document.getElementById('bookmarkBtn');
+const bookmarkLabel = document.getElementById('bookmarkLabel');
 const timerDisplay = document.getElementById('timerDisplay');
 const audioPlayback = document.getElementById('audioPlayback');
 const fileInput = document.getElementById('fileInput');
 const languageSelect = document.getElementById('languageSelect');
+const enhanceToggle = document.getElementById('enhanceToggle');
 const transcribeBtn = document.getElementById('transcribeBtn');
 const loadingSpinner = document.getElementById('loadingSpinner');
 const loadingMessage = document.getElementById('loadingMessage');
@@ -22,23 +28,71 @@ const errorMessage = document.getElementById('errorMessage');
 const closeErrorBtn = document.getElementById('closeErrorBtn');
 const transcriptionCard = document.getElementById('transcriptionCard');
 const transcriptionText = document.getElementById('transcriptionText');
+const qualityAlert = document.getElementById('qualityAlert');
+const qualityWarnings = document.getElementById('qualityWarnings');
 const summarizeBtn = document.getElementById('summarizeBtn');
+const summaryStyle = document.getElementById('summaryStyle');
 const copyTranscriptionBtn = document.getElementById('copyTranscriptionBtn');
+const srtLink = document.getElementById('srtLink');
+const vttLink = document.getElementById('vttLink');
 const newTranscriptionBtn = document.getElementById('newTranscriptionBtn');
 const summaryCard = document.getElementById('summaryCard');
 const summaryText = document.getElementById('summaryText');
 const copySummaryBtn = document.getElementById('copySummaryBtn');
+const disclosureBanner = document.getElementById('disclosureBanner');
+const disclosureText = document.getElementById('disclosureText');
+const acknowledgeDisclosureBtn = document.getElementById('acknowledgeDisclosureBtn');
+const historyCard = document.getElementById('historyCard');
+const historyList = document.getElementById('historyList');
 
 // Event Listeners
 startRecordBtn.addEventListener('click', startRecording);
 stopRecordBtn.addEventListener('click', stopRecording);
+bookmarkBtn.addEventListener('click', bookmarkMoment);
 transcribeBtn.addEventListener('click', transcribeAudio);
 summarizeBtn.addEventListener('click', summarizeTranscription);
 copyTranscriptionBtn.addEventListener('click', copyTranscription);
+srtLink.addEventListener('click', (event) => downloadSubtitles(event, 'srt'));
+vttLink.addEventListener('click', (event) => downloadSubtitles(event, 'vtt'));
 copySummaryBtn.addEventListener('click', copySummary);
 newTranscriptionBtn.addEventListener('click', resetForm);
 closeErrorBtn.addEventListener('click', hideError);
 fileInput.addEventListener('change', handleFileSelect);
+acknowledgeDisclosureBtn.addEventListener('click', acknowledgeDisclosure);
+
+// Localization
+
+// UI strings in the browser's language, served by /i18n. The page's English
+// text stays in place until they arrive.
+let uiStrings = {};
+
+// t returns a UI string with its {name} placeholders filled from vars
+function t(key, vars = {}) {
+    const text = uiStrings[key] || key;
+    return text.replace(/\{(\w+)\}/g, (match, name) => (name in vars ? vars[name] : match));
+}
+
+async function loadStrings() {
+    const locale = navigator.language || 'en';
+    let response;
+    try {
+        response = await fetch(`/i18n/${encodeURIComponent(locale)}.json`);
+        if (!response.ok) {
+            return;
+        }
+        uiStrings = await response.json();
+    } catch (err) {
+        console.error('Error loading UI strings:', err);
+        return;
+    }
+    document.documentElement.lang = response.headers.get('Content-Language') || locale;
+    document.querySelectorAll('[data-i18n]').forEach((element) => {
+        element.textContent = t(element.dataset.i18n);
+    });
+    document.querySelectorAll('[data-i18n-aria-label]').forEach((element) => {
+        element.setAttribute('aria-label', t(element.dataset.i18nAriaLabel));
+    });
+}
 
 // Utility Functions
 
@@ -70,6 +124,29 @@ function hideError() {
     errorAlert.style.display = 'none';
 }
 
+// showQualityWarnings lists what may have hurt a transcript's accuracy, in
+// the UI's language where a string exists for the warning
+function showQualityWarnings(quality) {
+    qualityWarnings.replaceChildren();
+    const warnings = (quality && quality.warnings) || [];
+    for (const warning of warnings) {
+        const key = `quality.${warning.code}`;
+        const item = document.createElement('li');
+        item.textContent = uiStrings[key]
+            ? t(key, { snr: Math.round(quality.snr_db), rate: quality.sample_rate / 1000 })
+            : warning.message;
+        qualityWarnings.append(item);
+    }
+    if (warnings.length > 0 && quality.denoised) {
+        const item = document.createElement('li');
+        item.textContent = quality.enhanced
+            ? t('quality.enhanced', { before: Math.round(quality.snr_db), after: Math.round(quality.enhanced.snr_db) })
+            : t('quality.denoised');
+        qualityWarnings.append(item);
+    }
+    qualityAlert.style.display = warnings.length > 0 ? 'flex' : 'none';
+}
+
 function showLoading(message) {
     loadingMessage.textContent = message;
     loadingSpinner.style.display = 'block';
@@ -115,7 +192,7 @@ async function startRecording() {
                 // Clear file input since we have a recording
                 fileInput.value = '';
             } catch (err) {
-                showError('Error converting audio to WAV format: ' + err.message);
+                showError(t('error.convert', { error: err.message }));
             }
             
             // Stop all tracks
@@ -123,6 +200,11 @@ async function startRecording() {
         };
         
         mediaRecorder.start();
+        if (liveToggle.checked) {
+            startLiveTranscription(stream).catch((err) => {
+                showError(t('error.live', { error: err.message }));
+            });
+        }
         recordingStartTime = Date.now();
         timerInterval = setInterval(updateTimer, 1000);
         
@@ -131,18 +213,20 @@ async function startRecording() {
         stopRecordBtn.style.display = 'block';
         recordingTimer.style.display = 'block';
         timerDisplay.textContent = '00:00';
+        liveToggle.disabled = true;
         
     } catch (err) {
         if (err.name === 'NotAllowedError') {
-            showError('Microphone permission denied. Please allow microphone access to record audio.');
+            showError(t('error.mic_denied'));
         } else {
-            showError('Error accessing microphone: ' + err.message);
+            showError(t('error.mic', { error: err.message }));
         }
     }
 }
 
 function stopRecording() {
     if (mediaRecorder && mediaRecorder.state !== 'inactive') {
+        stopLiveTranscription();
         mediaRecorder.stop();
         clearInterval(timerInterval);
         
@@ -150,6 +234,108 @@ function stopRecording() {
         startRecordBtn.style.display = 'block';
         stopRecordBtn.style.display = 'none';
         recordingTimer.style.display = 'none';
+        liveToggle.disabled = false;
+    }
+}
+
+// Live Transcription Functions
+
+// While recording, live transcription streams the microphone to
+// /ws/transcribe as 16 kHz PCM and shows each segment as soon as the server
+// has transcribed it, after quick partial text when the server has a fast
+// model. Moments can be bookmarked meanwhile, and are saved
+// with the transcript. The recording is kept as usual, so it can still be
+// transcribed in full afterwards.
+const liveSampleRate = 16000;
+let liveSocket = null;
+let liveAudioContext = null;
+
+async function startLiveTranscription(stream) {
+    liveAudioContext = new AudioContext();
+    await liveAudioContext.audioWorklet.addModule('/static/pcm-worklet.js');
+    const source = liveAudioContext.createMediaStreamSource(stream);
+    const capture = new AudioWorkletNode(liveAudioContext, 'pcm-capture', {
+        processorOptions: { targetRate: liveSampleRate }
+    });
+    source.connect(capture);
+
+    const params = new URLSearchParams({ sample_rate: liveSampleRate });
+    const language = languageSelect.value;
+    if (language && language !== 'auto') {
+        params.set('language', language);
+    }
+    const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
+    const socket = new WebSocket(`${protocol}//${location.host}/ws/transcribe?${params}`);
+    socket.binaryType = 'arraybuffer';
+    liveSocket = socket;
+    let bookmarks = 0;
+    socket.onopen = () => {
+        bookmarkLabel.textContent = t('record.bookmark');
+        bookmarkBtn.style.display = 'block';
+    };
+    capture.port.onmessage = (event) => {
+        if (socket.readyState === WebSocket.OPEN) {
+            socket.send(event.data);
+        }
+    };
+
+    transcriptionCard.style.display = 'none';
+    summaryCard.style.display = 'none';
+    // Texts by segment id; a segment's final text replaces its partials
+    const texts = [];
+    const showTexts = () => {
+        transcriptionText.textContent = texts.filter(Boolean).join(' ');
+        transcriptionCard.style.display = 'block';
+    };
+    socket.onmessage = (event) => {
+        const message = JSON.parse(event.data);
+        switch (message.type) {
+            case 'partial':
+            case 'segment':
+                texts[message.data.id] = message.data.text;
+                showTexts();
+                break;
+            case 'bookmark':
+                bookmarks++;
+                bookmarkLabel.textContent = t('record.bookmarked', { count: bookmarks });
+                break;
+            case 'done':
+                if (message.data.text) {
+                    currentTranscription = message.data.text;
+                    currentTranscriptId = message.data.id || null;
+                    transcriptionText.textContent = currentTranscription;
+                    transcriptionCard.style.display = 'block';
+                    loadHistory();
+                }
+                break;
+            case 'error':
+                showError(t('error.live', { error: message.data.error }));
+                break;
+        }
+    };
+    socket.onerror = () => {
+        showError(t('error.live', { error: t('error.live_connection') }));
+    };
+}
+
+// stopLiveTranscription stops streaming; the server sends the text of the
+// audio still being transcribed before it closes the connection
+function stopLiveTranscription() {
+    if (liveAudioContext) {
+        liveAudioContext.close();
+        liveAudioContext = null;
+    }
+    if (liveSocket && liveSocket.readyState === WebSocket.OPEN) {
+        liveSocket.send(JSON.stringify({ type: 'stop' }));
+    }
+    liveSocket = null;
+    bookmarkBtn.style.display = 'none';
+}
+
+// bookmarkMoment flags the moment just spoken in the live transcription
+function bookmarkMoment() {
+    if (liveSocket && liveSocket.readyState === WebSocket.OPEN) {
+        liveSocket.send(JSON.stringify({ type: 'bookmark' }));
     }
 }
 
@@ -217,8 +403,9 @@ function writeString(view, offset, string) {
 function handleFileSelect(event) {
     const file = event.target.files[0];
     if (file) {
-        if (!file.name.toLowerCase().endsWith('.wav')) {
-            showError('Please select a WAV file');
+        // The server checks the format by the file's contents
+        if (!file.type.startsWith('audio/') && !/\.(wav|mp3|m4a|mp4|aac|flac|ogg|oga|opus|webm)$/i.test(file.name)) {
+            showError(t('error.wav_only'));
             fileInput.value = '';
             return;
         }
@@ -230,22 +417,55 @@ function handleFileSelect(event) {
 
 // Transcription Functions
 
+// estimateTranscription asks the server how long the WAV file will take,
+// returning a readable duration or null when it cannot tell
+async function estimateTranscription(blob) {
+    try {
+        const header = new DataView(await blob.slice(0, 44).arrayBuffer());
+        // Only a WAV header tells the duration without decoding the audio
+        if (header.byteLength < 44 || header.getUint32(0, false) !== 0x52494646) {
+            return null;
+        }
+        const byteRate = header.getUint32(28, true);
+        if (!byteRate) {
+            return null;
+        }
+        const duration = (blob.size - 44) / byteRate;
+        const response = await fetch(`/estimate?duration=${duration.toFixed(1)}`);
+        if (!response.ok) {
+            return null;
+        }
+        const seconds = (await response.json()).seconds;
+        return seconds < 90 ? t('estimate.seconds', { n: Math.max(seconds, 1) }) : t('estimate.minutes', { n: Math.round(seconds / 60) });
+    } catch (err) {
+        return null;
+    }
+}
+
 async function transcribeAudio() {
     if (!currentAudioBlob) {
-        showError('Please record or upload an audio file first');
+        showError(t('error.no_audio'));
         return;
     }
     
     try {
         hideError();
-        showLoading('Transcribing audio...');
+        showLoading(t('loading.transcribing'));
+        const estimate = await estimateTranscription(currentAudioBlob);
+        if (estimate) {
+            showLoading(t('loading.transcribing_estimate', { estimate }));
+        }
         
         // Hide previous results
         transcriptionCard.style.display = 'none';
         summaryCard.style.display = 'none';
         
         const formData = new FormData();
-        formData.append('file', currentAudioBlob, 'audio.wav');
+        // Fields read before the upload is forwarded go ahead of the file
+        if (enhanceToggle.checked) {
+            formData.append('enhance', 'true');
+        }
+        formData.append('file', currentAudioBlob, currentAudioBlob.name || 'audio.wav');
         
         // Add language parameter if not auto-detect
         const language = languageSelect.value;
@@ -253,27 +473,47 @@ async function transcribeAudio() {
             formData.append('language', language);
         }
         
+        if (currentAudioBlob.size >= asyncUploadBytes) {
+            await transcribeAsJob(currentAudioBlob, Object.fromEntries(
+                [...formData.entries()].filter(([name]) => name !== 'file')));
+            return;
+        }
+        
+        // Ask for Server-Sent Events so segments show up as they are decoded
         const response = await fetch('/transcribe', {
             method: 'POST',
+            headers: {
+                'Accept': 'text/event-stream'
+            },
             body: formData
         });
         
         if (!response.ok) {
             const errorText = await response.text();
-            throw new Error(`Transcription failed: ${errorText}`);
+            throw new Error(t('error.transcription', { error: errorText }));
         }
         
-        const result = await response.json();
+        transcriptionText.textContent = '';
+        currentTranscriptId = response.headers.get('X-Job-ID');
+        
+        const result = await readTranscriptionEvents(response, (partialText) => {
+            // Display partial transcription with escaped HTML
+            transcriptionText.textContent = partialText;
+            transcriptionCard.style.display = 'block';
+            hideLoading();
+        });
         
         if (!result.text) {
-            throw new Error('No transcription text in response');
+            throw new Error(t('error.no_text'));
         }
         
         currentTranscription = result.text;
         
         // Display transcription with escaped HTML
         transcriptionText.textContent = currentTranscription;
+        showQualityWarnings(result.audio_quality);
         transcriptionCard.style.display = 'block';
+        loadHistory();
         
     } catch (err) {
         showError(err.message);
@@ -282,17 +522,239 @@ async function transcribeAudio() {
     }
 }
 
+// Long recordings are uploaded in chunks with the tus protocol and queued
+// as a background job rather than held open on one request. An interrupted
+// upload carries on from where it stopped, also after a reload when the same
+// file is picked again, and the job ID is kept in localStorage, so a reload
+// picks the job up again instead of losing it.
+const asyncUploadBytes = 25 * 1024 * 1024;
+const pendingJobStorageKey = 'pendingJob';
+const jobPollInterval = 3000;
+const uploadChunkBytes = 8 * 1024 * 1024;
+const uploadRetryDelays = [1000, 3000, 5000, 10000, 20000, 30000];
+
+async function transcribeAsJob(blob, fields) {
+    const id = await uploadResumable(blob, fields);
+    localStorage.setItem(pendingJobStorageKey, id);
+    await pollJob(id);
+}
+
+// uploadResumable uploads blob to /files/ with the job's fields, and
+// resolves with the ID of the job started once the upload is complete
+async function uploadResumable(blob, fields) {
+    const name = blob.name || 'audio.wav';
+    const storageKey = `upload:${name}:${blob.size}:${blob.lastModified || ''}`;
+    let url = localStorage.getItem(storageKey);
+    let offset = url ? await uploadOffset(url) : null;
+    if (offset === null) {
+        url = await createUpload(blob.size, { ...fields, filename: name });
+        localStorage.setItem(storageKey, url);
+        offset = 0;
+    }
+    
+    let failures = 0;
+    while (true) {
+        showLoading(t('loading.uploading', { percent: Math.floor(offset * 100 / blob.size) }));
+        let response = null;
+        try {
+            response = await fetch(url, {
+                method: 'PATCH',
+                headers: {
+                    'Tus-Resumable': '1.0.0',
+                    'Upload-Offset': String(offset),
+                    'Content-Type': 'application/offset+octet-stream'
+                },
+                body: blob.slice(offset, offset + uploadChunkBytes)
+            });
+        } catch (err) {
+            // The connection dropped; retried below
+        }
+        if (response && response.ok) {
+            failures = 0;
+            offset = Number(response.headers.get('Upload-Offset'));
+            const jobId = response.headers.get('X-Job-ID');
+            if (jobId) {
+                localStorage.removeItem(storageKey);
+                return jobId;
+            }
+            continue;
+        }
+        // Conflicting offsets and busy or unreachable servers are retried;
+        // other errors will not go away
+        if (response && response.status < 500 && ![409, 423, 429].includes(response.status)) {
+            localStorage.removeItem(storageKey);
+            const errorText = await response.text();
+            throw new Error(t('error.transcription', { error: errorText }));
+        }
+        if (failures === uploadRetryDelays.length) {
+            throw new Error(t('error.upload_interrupted'));
+        }
+        showLoading(t('loading.upload_retrying'));
+        await new Promise((resolve) => setTimeout(resolve, uploadRetryDelays[failures++]));
+        let resumed;
+        try {
+            resumed = await uploadOffset(url);
+        } catch (err) {
+            // Still unreachable; the next attempt finds out again
+            continue;
+        }
+        if (resumed === null) {
+            localStorage.removeItem(storageKey);
+            throw new Error(t('error.upload_expired'));
+        }
+        offset = resumed;
+    }
+}
+
+// createUpload declares an upload of size bytes and returns its URL
+async function createUpload(size, metadata) {
+    const encoded = Object.entries(metadata).map(([key, value]) => {
+        const bytes = new TextEncoder().encode(value);
+        return `${key} ${btoa(String.fromCharCode(...bytes))}`;
+    });
+    const response = await fetch('/files/', {
+        method: 'POST',
+        headers: {
+            'Tus-Resumable': '1.0.0',
+            'Upload-Length': String(size),
+            'Upload-Metadata': encoded.join(',')
+        }
+    });
+    if (!response.ok) {
+        const errorText = await response.text();
+        throw new Error(t('error.transcription', { error: errorText }));
+    }
+    return response.headers.get('Location');
+}
+
+// uploadOffset returns how much of an upload the server has, or null when
+// the upload has expired
+async function uploadOffset(url) {
+    const response = await fetch(url, {
+        method: 'HEAD',
+        headers: { 'Tus-Resumable': '1.0.0' }
+    });
+    if (response.status === 404) {
+        return null;
+    }
+    if (!response.ok) {
+        throw new Error(t('error.upload_interrupted'));
+    }
+    return Number(response.headers.get('Upload-Offset'));
+}
+
+// pollJob shows a job's progress until it ends. It stops quietly when the
+// form is reset, which forgets the job.
+async function pollJob(id) {
+    while (localStorage.getItem(pendingJobStorageKey) === id) {
+        const response = await fetch(`/jobs/${encodeURIComponent(id)}`);
+        if (!response.ok) {
+            const errorText = await response.text();
+            localStorage.removeItem(pendingJobStorageKey);
+            throw new Error(t('error.transcription', { error: errorText }));
+        }
+        const job = await response.json();
+        if (job.status === 'completed') {
+            localStorage.removeItem(pendingJobStorageKey);
+            if (!job.text) {
+                throw new Error(t('error.no_text'));
+            }
+            currentTranscription = job.text;
+            currentTranscriptId = job.id;
+            transcriptionText.textContent = currentTranscription;
+            showQualityWarnings(job.audio_quality);
+            transcriptionCard.style.display = 'block';
+            loadHistory();
+            return;
+        }
+        if (job.status === 'failed') {
+            localStorage.removeItem(pendingJobStorageKey);
+            throw new Error(t('error.transcription', { error: job.error }));
+        }
+        if (job.status === 'running') {
+            showLoading(t('loading.job_progress', { n: job.progress.steps_done + 1, total: job.progress.steps_total }));
+        } else {
+            showLoading(t('loading.queued'));
+        }
+        await new Promise((resolve) => setTimeout(resolve, jobPollInterval));
+    }
+}
+
+// resumePendingJob picks up a job still running when the page was left
+async function resumePendingJob() {
+    const id = localStorage.getItem(pendingJobStorageKey);
+    if (!id) {
+        return;
+    }
+    try {
+        showLoading(t('loading.resuming'));
+        await pollJob(id);
+    } catch (err) {
+        showError(err.message);
+    } finally {
+        hideLoading();
+    }
+}
+
+// readTranscriptionEvents consumes the SSE stream from /transcribe, calling
+// onPartial with the text received so far, and resolves with the final result
+async function readTranscriptionEvents(response, onPartial) {
+    const reader = response.body.getReader();
+    const decoder = new TextDecoder();
+    let buffer = '';
+    let partialText = '';
+    
+    while (true) {
+        const { value, done } = await reader.read();
+        if (done) {
+            break;
+        }
+        buffer += decoder.decode(value, { stream: true });
+        
+        let boundary;
+        while ((boundary = buffer.indexOf('\n\n')) !== -1) {
+            const rawEvent = buffer.slice(0, boundary);
+            buffer = buffer.slice(boundary + 2);
+            
+            let eventName = 'message';
+            let data = '';
+            for (const line of rawEvent.split('\n')) {
+                if (line.startsWith('event:')) {
+                    eventName = line.slice(6).trim();
+                } else if (line.startsWith('data:')) {
+                    data += line.slice(5).trim();
+                }
+            }
+            const payload = JSON.parse(data);
+            
+            if (eventName === 'segment') {
+                partialText = (partialText + ' ' + payload.text.trim()).trim();
+                onPartial(partialText);
+            } else if (eventName === 'delta') {
+                partialText += payload.text;
+                onPartial(partialText);
+            } else if (eventName === 'error') {
+                throw new Error(t('error.transcription', { error: payload.error }));
+            } else if (eventName === 'done') {
+                return payload;
+            }
+        }
+    }
+    
+    throw new Error(t('error.stream_ended'));
+}
+
 // Summarization Functions
 
 async function summarizeTranscription() {
     if (!currentTranscription) {
-        showError('No transcription to summarize');
+        showError(t('error.no_transcription'));
         return;
     }
     
     try {
         hideError();
-        showLoading('Generating summary...');
+        showLoading(t('loading.summarizing'));
         
         summaryCard.style.display = 'none';
         
@@ -301,29 +763,24 @@ async function summarizeTranscription() {
             headers: {
                 'Content-Type': 'application/json'
             },
-            body: JSON.stringify({ text: currentTranscription })
+            body: JSON.stringify({
+                text: currentTranscription,
+                transcript_id: currentTranscriptId || undefined,
+                style: summaryStyle.value || undefined
+            })
         });
         
         if (!response.ok) {
             const errorText = await response.text();
-            throw new Error(`Summarization failed: ${errorText}`);
+            throw new Error(t('error.summarization', { error: errorText }));
         }
         
         const result = await response.json();
         
-        // Extract summary text from different response formats
-        let summaryContent = '';
-        if (result.choices && result.choices[0] && result.choices[0].message) {
-            // OpenAI format
-            summaryContent = result.choices[0].message.content;
-        } else if (result.response) {
-            // Harmony format
-            summaryContent = result.response;
-        } else if (result.text) {
-            // Fallback format
-            summaryContent = result.text;
-        } else {
-            throw new Error('Unable to extract summary from response');
+        // The server normalizes every backend format to { summary }
+        const summaryContent = result.summary;
+        if (!summaryContent) {
+            throw new Error(t('error.no_summary'));
         }
         
         // Parse Markdown and display
@@ -333,6 +790,7 @@ async function summarizeTranscription() {
         
         // Store raw text for copying
         summaryText.dataset.rawText = summaryContent;
+        loadHistory();
         
     } catch (err) {
         showError(err.message);
@@ -341,6 +799,110 @@ async function summarizeTranscription() {
     }
 }
 
+// Transcript History
+
+// The server keeps the transcripts made in this browser, so they can be
+// opened again after a reload
+async function loadHistory() {
+    try {
+        const response = await fetch('/api/transcripts?limit=10');
+        if (!response.ok) {
+            return;
+        }
+        renderHistory(await response.json());
+    } catch (err) {
+        console.warn('Could not load the history', err);
+    }
+}
+
+function formatDuration(seconds) {
+    const total = Math.round(seconds);
+    return `${Math.floor(total / 60)}:${String(total % 60).padStart(2, '0')}`;
+}
+
+// renderHistory lists the transcripts; titles come from file names, so the
+// list is built with textContent only
+function renderHistory(entries) {
+    historyList.replaceChildren();
+    for (const entry of entries) {
+        const item = document.createElement('li');
+        item.className = 'history-item';
+
+        const open = document.createElement('button');
+        open.type = 'button';
+        open.className = 'pf-v5-c-button pf-m-link pf-m-inline history-open';
+        open.textContent = entry.title || entry.filename || entry.id;
+        open.disabled = entry.status !== 'completed';
+        open.addEventListener('click', () => openTranscript(entry.id));
+
+        const meta = document.createElement('span');
+        meta.className = 'history-meta';
+        const parts = [new Date(entry.created_at).toLocaleString()];
+        if (entry.status !== 'completed') {
+            parts.push(t('history.pending'));
+        } else if (entry.duration) {
+            parts.push(formatDuration(entry.duration));
+        }
+        meta.textContent = parts.join(' · ');
+
+        const remove = document.createElement('button');
+        remove.type = 'button';
+        remove.className = 'pf-v5-c-button pf-m-plain';
+        remove.setAttribute('aria-label', t('history.delete'));
+        remove.title = t('history.delete');
+        remove.innerHTML = '<i class="fas fa-trash" aria-hidden="true"></i>';
+        remove.addEventListener('click', () => deleteTranscript(entry.id));
+
+        item.append(open, meta, remove);
+        historyList.append(item);
+    }
+    historyCard.style.display = entries.length > 0 ? 'block' : 'none';
+}
+
+// openTranscript shows a transcript of the history, with its summary
+async function openTranscript(id) {
+    try {
+        hideError();
+        const response = await fetch(`/api/transcripts/${encodeURIComponent(id)}`);
+        if (!response.ok) {
+            const errorText = await response.text();
+            throw new Error(t('error.history', { error: errorText }));
+        }
+        const job = await response.json();
+        currentTranscription = job.text;
+        currentTranscriptId = job.id;
+        transcriptionText.textContent = job.text;
+        showQualityWarnings(job.audio_quality);
+        transcriptionCard.style.display = 'block';
+        if (job.summary) {
+            summaryText.innerHTML = parseMarkdown(job.summary);
+            summaryText.dataset.rawText = job.summary;
+            summaryCard.style.display = 'block';
+        } else {
+            summaryCard.style.display = 'none';
+        }
+    } catch (err) {
+        showError(err.message);
+    }
+}
+
+async function deleteTranscript(id) {
+    try {
+        hideError();
+        const response = await fetch(`/api/transcripts/${encodeURIComponent(id)}`, { method: 'DELETE' });
+        if (!response.ok && response.status !== 404) {
+            const errorText = await response.text();
+            throw new Error(t('error.history_delete', { error: errorText }));
+        }
+        if (currentTranscriptId === id) {
+            currentTranscriptId = null;
+        }
+        loadHistory();
+    } catch (err) {
+        showError(err.message);
+    }
+}
+
 // Copy Functions
 
 async function copyTranscription() {
@@ -349,16 +911,16 @@ async function copyTranscription() {
     }
     
     try {
-        await navigator.clipboard.writeText(currentTranscription);
+        await navigator.clipboard.writeText(withDisclosure(currentTranscription));
         
         // Visual feedback
         const originalText = copyTranscriptionBtn.textContent;
-        copyTranscriptionBtn.textContent = 'Copied!';
+        copyTranscriptionBtn.textContent = t('copy.done');
         setTimeout(() => {
             copyTranscriptionBtn.textContent = originalText;
         }, 2000);
     } catch (err) {
-        showError('Failed to copy to clipboard: ' + err.message);
+        showError(t('error.clipboard', { error: err.message }));
     }
 }
 
@@ -369,17 +931,69 @@ async function copySummary() {
     }
     
     try {
-        await navigator.clipboard.writeText(rawText);
+        await navigator.clipboard.writeText(withDisclosure(rawText));
         
         // Visual feedback
         const originalText = copySummaryBtn.textContent;
-        copySummaryBtn.textContent = 'Copied!';
+        copySummaryBtn.textContent = t('copy.done');
         setTimeout(() => {
             copySummaryBtn.textContent = originalText;
         }, 2000);
     } catch (err) {
-        showError('Failed to copy to clipboard: ' + err.message);
+        showError(t('error.clipboard', { error: err.message }));
+    }
+}
+
+// Disclosure Functions
+
+// The acknowledged disclosure is remembered, so the banner only returns
+// when the server's disclosure text changes
+const disclosureStorageKey = 'acknowledgedDisclosure';
+
+async function loadDisclosure() {
+    try {
+        const response = await fetch('/disclosure');
+        if (!response.ok) {
+            return;
+        }
+        const data = await response.json();
+        recordingDisclosure = data.disclosure || '';
+    } catch (err) {
+        console.error('Error loading disclosure:', err);
+        return;
+    }
+
+    if (!recordingDisclosure || localStorage.getItem(disclosureStorageKey) === recordingDisclosure) {
+        return;
+    }
+    disclosureText.textContent = recordingDisclosure;
+    disclosureBanner.style.display = 'flex';
+    startRecordBtn.disabled = true;
+}
+
+function acknowledgeDisclosure() {
+    localStorage.setItem(disclosureStorageKey, recordingDisclosure);
+    disclosureBanner.style.display = 'none';
+    startRecordBtn.disabled = false;
+}
+
+// downloadSubtitles points a subtitle link at the export of the current
+// transcript, which is only possible once it is saved in the history
+function downloadSubtitles(event, format) {
+    if (!currentTranscriptId) {
+        event.preventDefault();
+        showError(t('error.subtitles'));
+        return;
+    }
+    event.currentTarget.href = `/api/transcripts/${encodeURIComponent(currentTranscriptId)}/export?format=${format}`;
+}
+
+// withDisclosure stamps copied text with the disclosure footer
+function withDisclosure(text) {
+    if (!recordingDisclosure) {
+        return text;
     }
+    return text + '\n\n---\n' + recordingDisclosure;
 }
 
 // Reset Functions
@@ -388,7 +1002,9 @@ function resetForm() {
     // Clear audio
     currentAudioBlob = null;
     currentTranscription = null;
+    currentTranscriptId = null;
     audioChunks = [];
+    localStorage.removeItem(pendingJobStorageKey);
     
     // Reset file input
     fileInput.value = '';
@@ -402,6 +1018,7 @@ function resetForm() {
     
     // Hide results
     transcriptionCard.style.display = 'none';
+    showQualityWarnings(null);
     summaryCard.style.display = 'none';
     
     // Hide error
@@ -414,5 +1031,10 @@ function resetForm() {
 }
 
 // Initialize
+loadStrings().then(() => {
+    resumePendingJob();
+    loadHistory();
+});
+loadDisclosure();
 console.log('Audio Transcription App initialized');
 
@@ -0,0 +1,43 @@
+// pcm-capture converts the microphone to 16-bit mono PCM at targetRate for
+// live transcription, posting about 100 ms of audio at a time. Each sample
+// is the average of the input samples it replaces, which keeps most of the
+// aliasing out of the lower rate.
+class PCMCapture extends AudioWorkletProcessor {
+    constructor(options) {
+        super();
+        const targetRate = options.processorOptions.targetRate;
+        this.step = sampleRate / targetRate;
+        this.position = 0;
+        this.sum = 0;
+        this.count = 0;
+        this.samples = new Int16Array(Math.round(targetRate / 10));
+        this.length = 0;
+    }
+
+    process(inputs) {
+        const input = inputs[0][0];
+        if (!input) {
+            return true;
+        }
+        for (const value of input) {
+            this.sum += value;
+            this.count++;
+            this.position++;
+            if (this.position < this.step) {
+                continue;
+            }
+            const sample = Math.max(-1, Math.min(1, this.sum / this.count));
+            this.samples[this.length++] = sample * 0x7fff;
+            this.position -= this.step;
+            this.sum = 0;
+            this.count = 0;
+            if (this.length === this.samples.length) {
+                this.port.postMessage(this.samples.buffer.slice(0));
+                this.length = 0;
+            }
+        }
+        return true;
+    }
+}
+
+registerProcessor('pcm-capture', PCMCapture);
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kvStore holds state that must be shared by every replica behind a load
+// balancer: job records, declared resources and rate limit counters. The
+// file store (see filestore.go) and the in-memory store serve a single
+// instance; Redis lets the service scale horizontally without sticky
+// sessions.
+type kvStore interface {
+	get(key string) ([]byte, bool, error)
+	// set stores value; a zero ttl keeps it until deleted
+	set(key string, value []byte, ttl time.Duration) error
+	delete(key string) error
+	// keys lists the keys starting with prefix
+	keys(prefix string) ([]string, error)
+	// incrBy adds n to a counter, starting its ttl when it is created
+	incrBy(key string, n int64, ttl time.Duration) (int64, error)
+	// shared reports whether other replicas see the same data
+	shared() bool
+}
+
+var state kvStore = newMemoryStore()
+
+// memoryStore is a process-local kvStore
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value   []byte
+	counter int64
+	expires time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: make(map[string]memoryEntry)}
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// lookup returns a live entry; the caller holds the lock
+func (m *memoryStore) lookup(key string) (memoryEntry, bool) {
+	entry, ok := m.entries[key]
+	if ok && entry.expired(time.Now()) {
+		delete(m.entries, key)
+		return memoryEntry{}, false
+	}
+	return entry, ok
+}
+
+func (m *memoryStore) get(key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.lookup(key)
+	return entry.value, ok, nil
+}
+
+func (m *memoryStore) set(key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := memoryEntry{value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	m.entries[key] = entry
+	return nil
+}
+
+func (m *memoryStore) delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *memoryStore) keys(prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var keys []string
+	for key, entry := range m.entries {
+		if entry.expired(now) {
+			delete(m.entries, key)
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *memoryStore) incrBy(key string, n int64, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.lookup(key)
+	if !ok && ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	entry.counter += n
+	m.entries[key] = entry
+	return entry.counter, nil
+}
+
+func (m *memoryStore) shared() bool {
+	return false
+}
+
+// initStateStore selects the configured store
+func initStateStore() {
+	switch config.StateStore {
+	case "memory":
+	case "file":
+		path := config.StateFile
+		if path == "" {
+			path = filepath.Join(config.StorageDir, "state.json")
+		}
+		store, err := newFileStore(path)
+		if err != nil {
+			log.Fatalf("Error reading the state file: %v", err)
+		}
+		state = store
+		logf(context.Background(), "State stored in %s", path)
+	case "redis":
+		store, err := newRedisStore(config.RedisURL)
+		if err != nil {
+			log.Fatalf("Error connecting to Redis: %v", err)
+		}
+		state = store
+		logf(context.Background(), "Shared state stored in Redis")
+	default:
+		log.Fatalf("Unsupported STATE_STORE %q (expected \"file\", \"memory\" or \"redis\")", config.StateStore)
+	}
+}
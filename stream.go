@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// eventWriter delivers incremental results to a client as they arrive
+type eventWriter interface {
+	send(event string, data any) error
+}
+
+// sseWriter emits Server-Sent Events
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	return &sseWriter{w: w, flusher: flusher}
+}
+
+func (s *sseWriter) send(event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+// ndjsonWriter emits one JSON object per line, tagged with its event type.
+// It is easier to consume than SSE from CLIs and data pipelines.
+type ndjsonWriter struct {
+	w       http.ResponseWriter
+	enc     *json.Encoder
+	flusher http.Flusher
+}
+
+// ndjsonEvent is a single line of an NDJSON stream
+type ndjsonEvent struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+func newNDJSONWriter(w http.ResponseWriter) *ndjsonWriter {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	return &ndjsonWriter{w: w, enc: json.NewEncoder(w), flusher: flusher}
+}
+
+func (n *ndjsonWriter) send(event string, data any) error {
+	if err := n.enc.Encode(ndjsonEvent{Type: event, Data: data}); err != nil {
+		return err
+	}
+	if n.flusher != nil {
+		n.flusher.Flush()
+	}
+	return nil
+}
+
+// Streaming output formats negotiated with the client
+const (
+	streamNone   = ""
+	streamSSE    = "sse"
+	streamNDJSON = "ndjson"
+)
+
+// streamFormat picks the incremental output format requested by the client
+// via the Accept header, or ?stream=true for SSE
+func streamFormat(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/x-ndjson"):
+		return streamNDJSON
+	case strings.Contains(accept, "text/event-stream"), r.URL.Query().Get("stream") == "true":
+		return streamSSE
+	}
+	return streamNone
+}
+
+// newEventWriter starts a streaming response in the given format
+func newEventWriter(w http.ResponseWriter, format string) eventWriter {
+	if format == streamNDJSON {
+		return newNDJSONWriter(w)
+	}
+	return newSSEWriter(w)
+}
+
+// streamProgress is the payload of a "progress" event
+type streamProgress struct {
+	Stage            string  `json:"stage"`
+	ProcessedSeconds float64 `json:"processed_seconds,omitempty"`
+}
+
+// streamError is the payload of an "error" event
+type streamError struct {
+	Error string `json:"error"`
+}
+
+// streamDelta is the payload of a "delta" event carrying partial text
+type streamDelta struct {
+	Text string `json:"text"`
+}
+
+// relayTranscription forwards a Whisper response to the client event by
+// event. Streaming backends (stream=true) answer with SSE, which is relayed
+// as segments or text deltas arrive; a regular JSON response is replayed as
+// its segments followed by the final result. decorate adds what the handler
+// knows about the recording to the final result.
+func relayTranscription(ctx context.Context, events eventWriter, contentType string, r io.Reader, decorate func(*TranscriptionResult)) (*TranscriptionResult, error) {
+	events.send("progress", streamProgress{Stage: "transcribing"})
+
+	if !strings.Contains(contentType, "text/event-stream") {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			logErrorf(ctx, "Error reading response: %v", err)
+			events.send("error", streamError{Error: "Error reading response"})
+			return nil, err
+		}
+		result, err := parseTranscriptionResponse(contentType, body)
+		if err != nil {
+			logErrorf(ctx, "Invalid API response: %v", err)
+			events.send("error", streamError{Error: err.Error()})
+			return nil, err
+		}
+		decorate(result)
+		if err := replayTranscription(events, result); err != nil {
+			return nil, err
+		}
+		logf(ctx, "Transcription successful")
+		return result, nil
+	}
+
+	var (
+		final    *TranscriptionResult
+		segments []Segment
+		deltas   strings.Builder
+	)
+	err := readSSE(r, func(data string) error {
+		var obj map[string]any
+		if err := json.Unmarshal([]byte(data), &obj); err != nil {
+			return &UpstreamError{Service: "transcription", Message: fmt.Sprintf("stream event %s is not JSON", describeBody(data))}
+		}
+
+		// OpenAI-style typed events
+		if eventType, ok := lookupString(obj, "type"); ok {
+			switch eventType {
+			case "transcript.text.delta":
+				delta, _ := lookupString(obj, "delta")
+				deltas.WriteString(delta)
+				return events.send("delta", streamDelta{Text: delta})
+			case "transcript.text.done":
+				text, _ := lookupString(obj, "text")
+				final = &TranscriptionResult{Text: strings.TrimSpace(text)}
+			}
+			return nil
+		}
+
+		// Segment-by-segment backends send one segment per event
+		if hasField(obj, "start") && hasField(obj, "text") && !hasField(obj, "segments") {
+			text, _ := lookupString(obj, "text")
+			start, _ := lookupFloat(obj, "start")
+			end, _ := lookupFloat(obj, "end")
+			id, ok := lookupFloat(obj, "id")
+			if !ok {
+				id = float64(len(segments))
+			}
+			seg := Segment{ID: int(id), Start: start, End: end, Text: text}
+			segments = append(segments, seg)
+			if err := events.send("segment", seg); err != nil {
+				return err
+			}
+			return events.send("progress", streamProgress{Stage: "transcribing", ProcessedSeconds: seg.End})
+		}
+
+		// Anything else must be a complete transcription
+		result, err := parseTranscriptionResponse("application/json", []byte(data))
+		if err != nil {
+			return err
+		}
+		final = result
+		return nil
+	})
+	if err != nil {
+		logErrorf(ctx, "Error relaying transcription stream: %v", err)
+		events.send("error", streamError{Error: err.Error()})
+		return nil, err
+	}
+
+	if final == nil {
+		final = &TranscriptionResult{Segments: segments}
+		if len(segments) > 0 {
+			parts := make([]string, 0, len(segments))
+			for _, seg := range segments {
+				parts = append(parts, strings.TrimSpace(seg.Text))
+			}
+			final.Text = strings.Join(parts, " ")
+			final.Duration = segments[len(segments)-1].End
+			tagSegmentLanguages(final)
+			formatParagraphs(final)
+		} else {
+			final.Text = strings.TrimSpace(deltas.String())
+		}
+	}
+	decorate(final)
+	events.send("done", final)
+	logf(ctx, "Transcription successful")
+	return final, nil
+}
+
+// replayTranscription sends a finished transcription as its segments
+// followed by the final result
+func replayTranscription(events eventWriter, result *TranscriptionResult) error {
+	for _, seg := range result.Segments {
+		if err := events.send("segment", seg); err != nil {
+			return err
+		}
+		events.send("progress", streamProgress{Stage: "transcribing", ProcessedSeconds: seg.End})
+	}
+	return events.send("done", result)
+}
+
+// relaySummary forwards an LLM chat completion to the client. Streamed
+// completions are relayed as "delta" events; a regular response is sent as
+// a single "done" event. decorate adds what the handler knows about the
+// request, such as the truncation of the text.
+func relaySummary(ctx context.Context, events eventWriter, contentType string, r io.Reader, decorate func(*SummaryResult)) (*SummaryResult, error) {
+	events.send("progress", streamProgress{Stage: "summarizing"})
+
+	if !strings.Contains(contentType, "text/event-stream") {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			logErrorf(ctx, "Error reading response: %v", err)
+			events.send("error", streamError{Error: "Error reading response"})
+			return nil, err
+		}
+		result, err := parseChatCompletionResponse(body)
+		if err != nil {
+			logErrorf(ctx, "Invalid API response: %v", err)
+			events.send("error", streamError{Error: err.Error()})
+			return nil, err
+		}
+		decorate(result)
+		events.send("done", result)
+		logf(ctx, "Summarization successful")
+		return result, nil
+	}
+
+	result := &SummaryResult{}
+	var summary strings.Builder
+	err := readSSE(r, func(data string) error {
+		var obj map[string]any
+		if err := json.Unmarshal([]byte(data), &obj); err != nil {
+			return &UpstreamError{Service: "LLM", Message: fmt.Sprintf("stream event %s is not JSON", describeBody(data))}
+		}
+		if model, ok := lookupString(obj, "model"); ok {
+			result.Model = model
+		}
+		raw, ok := lookupField(obj, "choices")
+		if !ok {
+			return &UpstreamError{Service: "LLM", Message: fmt.Sprintf("stream event with fields [%s], expected field \"choices\"", fieldNames(obj))}
+		}
+		choices, _ := raw.([]any)
+		if len(choices) == 0 {
+			// Usage-only chunks carry no choices
+			return nil
+		}
+		choice, _ := choices[0].(map[string]any)
+		delta, ok := lookupObject(choice, "delta", "message")
+		if !ok {
+			return nil
+		}
+		content, _ := lookupString(delta, "content")
+		if content == "" {
+			return nil
+		}
+		summary.WriteString(content)
+		return events.send("delta", streamDelta{Text: content})
+	})
+	if err != nil {
+		logErrorf(ctx, "Error relaying summary stream: %v", err)
+		events.send("error", streamError{Error: err.Error()})
+		return nil, err
+	}
+
+	result.Summary = strings.TrimSpace(summary.String())
+	decorate(result)
+	events.send("done", result)
+	logf(ctx, "Summarization successful")
+	return result, nil
+}
+
+// readSSE calls fn with the data of each event in an SSE stream until the
+// stream ends or a "[DONE]" sentinel is received
+func readSSE(r io.Reader, fn func(data string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+
+	var data []string
+	flush := func() error {
+		if len(data) == 0 {
+			return nil
+		}
+		payload := strings.Join(data, "\n")
+		data = data[:0]
+		if payload == "[DONE]" {
+			return io.EOF
+		}
+		return fn(payload)
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if err := flush(); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data = append(data, strings.TrimPrefix(value, " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
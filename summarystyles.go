@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Summaries are written under a system prompt: SUMMARY_SYSTEM_PROMPT, a
+// clear, concise summary of the main points by default. A request can ask
+// for one of the built-in styles instead, or send its own custom_prompt,
+// which takes precedence over both. The prompt applies to the summary the
+// caller gets; the parts of a chunked summary are summarized under
+// SUMMARY_SYSTEM_PROMPT.
+
+// Summary styles
+const (
+	styleBulletPoints   = "bullet_points"
+	styleExecutive      = "executive"
+	styleDetailed       = "detailed"
+	styleActionItems    = "action_items"
+	styleMeetingMinutes = "meeting_minutes"
+)
+
+// defaultSummaryPrompt is the system prompt without SUMMARY_SYSTEM_PROMPT
+const defaultSummaryPrompt = "You are a helpful assistant that summarizes transcribed audio. Provide a clear, concise summary of the main points."
+
+// maxCustomPromptLength caps the custom prompt of a request, in characters
+const maxCustomPromptLength = 4000
+
+// summaryStylePrompts are the system prompts of the summary styles
+var summaryStylePrompts = map[string]string{
+	styleBulletPoints:   "You are a helpful assistant that summarizes transcribed audio. Summarize the main points as a Markdown bulleted list, one point per bullet, without an introduction.",
+	styleExecutive:      "You are a helpful assistant that summarizes transcribed audio for busy executives. Write a short executive summary of at most five sentences: the purpose, the key conclusions, and any decisions, risks or requests that need attention.",
+	styleDetailed:       "You are a helpful assistant that summarizes transcribed audio. Write a detailed summary covering every topic in the order it came up, with the key facts, figures, arguments and conclusions of each, under a Markdown heading per topic.",
+	styleActionItems:    "You are a helpful assistant that extracts action items from transcribed audio. List every task, commitment and follow-up as a Markdown bulleted list, each with its owner and due date when they are mentioned. If there are none, say so.",
+	styleMeetingMinutes: "You are a helpful assistant that writes meeting minutes from transcribed audio. Use Markdown sections for the participants mentioned, the topics discussed, the decisions made, and the action items with their owners.",
+}
+
+// validSummaryStyle reports whether style is a summary style
+func validSummaryStyle(style string) bool {
+	_, ok := summaryStylePrompts[style]
+	return ok
+}
+
+// checkSummaryPrompt reports a style or custom prompt a request may not use
+func checkSummaryPrompt(style, custom string) error {
+	if style != "" && !validSummaryStyle(style) {
+		return errors.New("style must be bullet_points, executive, detailed, action_items or meeting_minutes")
+	}
+	if len([]rune(custom)) > maxCustomPromptLength {
+		return fmt.Errorf("custom_prompt must be at most %d characters", maxCustomPromptLength)
+	}
+	return nil
+}
+
+// summaryPrompt returns the system prompt of a summary: the custom prompt,
+// else the prompt of the style, else SUMMARY_SYSTEM_PROMPT
+func summaryPrompt(style, custom string) string {
+	if custom != "" {
+		return custom
+	}
+	if prompt, ok := summaryStylePrompts[style]; ok {
+		return prompt
+	}
+	return config.SummarySystemPrompt
+}
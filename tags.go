@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// The tags pipeline step asks the LLM for the topics of a transcript. With
+// TAG_TAXONOMY set, tags are chosen from that list only; otherwise the LLM
+// names the topics itself, normalized and capped at MAX_TAGS. Jobs can then
+// be listed by tag.
+
+// tagPattern is the normalized form of a tag: words joined by hyphens
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{N}]+(-[\p{L}\p{N}]+)*$`)
+
+// maxTagLength bounds open vocabulary tags, in characters
+const maxTagLength = 32
+
+// normalizeTag lowercases a tag and joins its words with hyphens, returning
+// "" when nothing usable remains
+func normalizeTag(tag string) string {
+	words := strings.FieldsFunc(strings.ToLower(tag), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	tag = strings.Join(words, "-")
+	if runes := []rune(tag); len(runes) > maxTagLength {
+		tag = strings.TrimRight(string(runes[:maxTagLength]), "-")
+	}
+	if !tagPattern.MatchString(tag) {
+		return ""
+	}
+	return tag
+}
+
+// tagTaxonomy returns the configured tags, normalized, or nil for an open
+// vocabulary
+func tagTaxonomy() []string {
+	var tags []string
+	for _, tag := range strings.Split(config.TagTaxonomy, ",") {
+		if tag = normalizeTag(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// tagsPrompt instructs the LLM to answer with a JSON array of tags
+func tagsPrompt(taxonomy []string, max int) string {
+	prompt := fmt.Sprintf("You classify transcribed audio by topic. Answer with a JSON array of at most %d short topic tags, most relevant first, without any other text. ", max)
+	if len(taxonomy) > 0 {
+		return prompt + "Only use tags from this list: " + strings.Join(taxonomy, ", ") + ". Answer with [] when none applies."
+	}
+	return prompt + "Use lowercase English nouns of one or two words, such as \"pricing\" or \"onboarding\"."
+}
+
+// newTagsRequest builds the chat completion request classifying text
+func newTagsRequest(model, text string, taxonomy []string, maxTags int) ChatCompletionRequest {
+	return ChatCompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: "system", Content: tagsPrompt(taxonomy, maxTags)},
+			{Role: "user", Content: "Transcription:\n\n" + text},
+		},
+		Temperature: 0,
+	}
+}
+
+// classifyText asks the LLM for the topic tags of text
+func classifyText(ctx context.Context, up Upstream, text string) ([]string, error) {
+	taxonomy, maxTags := tagTaxonomy(), max(config.MaxTags, 1)
+	var raw []string
+	if err := llmJSON(ctx, up, newTagsRequest(up.LLMModel, text, taxonomy, maxTags), &raw); err != nil {
+		return nil, err
+	}
+	return cleanTags(raw, taxonomy, maxTags), nil
+}
+
+// cleanTags normalizes and deduplicates tags, drops those outside the
+// taxonomy and keeps at most maxTags
+func cleanTags(raw []string, taxonomy []string, maxTags int) []string {
+	allowed := make(map[string]bool, len(taxonomy))
+	for _, tag := range taxonomy {
+		allowed[tag] = true
+	}
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range raw {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] || (len(allowed) > 0 && !allowed[tag]) {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+		if len(tags) == maxTags {
+			break
+		}
+	}
+	return tags
+}
+
+// hasTag reports whether a job is tagged with tag
+func hasTag(job Job, tag string) bool {
+	for _, t := range job.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
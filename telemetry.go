@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With TELEMETRY=true the server counts which features are used, so
+// maintainers and operators can see what matters: requests per route,
+// response formats, error categories and pipeline steps. Counters are
+// anonymous by construction: routes are recorded by their pattern (e.g.
+// "GET /shared/{token}"), never by path, and nothing identifies a user,
+// key, tenant or recording. They are aggregated per day in the state store,
+// kept for TELEMETRY_RETENTION_DAYS and shown at GET /admin/v1/telemetry.
+// Nothing leaves the deployment unless TELEMETRY_REPORT_URL is set, in
+// which case the leader posts each day's totals there once.
+
+// Counter groups
+const (
+	telemetryRequests = "requests"
+	telemetryFormats  = "formats"
+	telemetryErrors   = "errors"
+	telemetryFeatures = "features"
+)
+
+// telemetryKeyPrefix keys the daily counters, as
+// telemetry:<date>:<group>:<name>
+const telemetryKeyPrefix = "telemetry:"
+
+// telemetryReportedKey holds the last day reported to TELEMETRY_REPORT_URL
+const telemetryReportedKey = "telemetry_reported"
+
+// telemetryFlushInterval is how often counts are added to the state store
+const telemetryFlushInterval = time.Minute
+
+// telemetryReportCheckInterval is how often the leader checks whether a
+// day is due to be reported
+const telemetryReportCheckInterval = time.Hour
+
+// untrackedRoutes are probes and assets that say nothing about features
+var untrackedRoutes = map[string]bool{
+	"/healthz":    true,
+	"/readyz":     true,
+	"/debug/vars": true,
+	"/static/":    true,
+}
+
+// errorCategories name the error statuses; others count as client_other
+// or server_other
+var errorCategories = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusNotAcceptable:         "not_acceptable",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal",
+	http.StatusBadGateway:            "upstream",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "upstream_timeout",
+	http.StatusInsufficientStorage:   "storage_full",
+}
+
+// errorCategory names an error status, "" for successes
+func errorCategory(status int) string {
+	if category, ok := errorCategories[status]; ok {
+		return category
+	}
+	switch {
+	case status >= 500:
+		return "server_other"
+	case status >= 400:
+		return "client_other"
+	}
+	return ""
+}
+
+// telemetryCounts holds the counts not yet flushed, by group and name
+var telemetryCounts struct {
+	sync.Mutex
+	pending map[string]map[string]int64
+}
+
+// countTelemetry adds one to a counter when telemetry is enabled
+func countTelemetry(group, name string) {
+	if !config.Telemetry {
+		return
+	}
+	telemetryCounts.Lock()
+	defer telemetryCounts.Unlock()
+	if telemetryCounts.pending == nil {
+		telemetryCounts.pending = make(map[string]map[string]int64)
+	}
+	if telemetryCounts.pending[group] == nil {
+		telemetryCounts.pending[group] = make(map[string]int64)
+	}
+	telemetryCounts.pending[group][name]++
+}
+
+// flushTelemetry adds the pending counts to today's counters. Counts that
+// cannot be stored are dropped.
+func flushTelemetry() {
+	telemetryCounts.Lock()
+	pending := telemetryCounts.pending
+	telemetryCounts.pending = nil
+	telemetryCounts.Unlock()
+
+	day := time.Now().UTC().Format(time.DateOnly)
+	retention := time.Duration(config.TelemetryRetentionDays) * 24 * time.Hour
+	for group, counts := range pending {
+		for name, n := range counts {
+			if _, err := state.incrBy(telemetryKeyPrefix+day+":"+group+":"+name, n, retention); err != nil {
+				logErrorf(context.Background(), "Error storing telemetry: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// telemetryRecorder notes the status and format of a response
+type telemetryRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (t *telemetryRecorder) WriteHeader(code int) {
+	t.status = code
+	t.ResponseWriter.WriteHeader(code)
+}
+
+// Flush keeps streaming responses working through the wrapper
+func (t *telemetryRecorder) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets WebSocket upgrades hijack the connection through the wrapper
+func (t *telemetryRecorder) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// withTelemetry counts the requests handled by next
+func withTelemetry(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &telemetryRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// The mux sets the pattern that matched; patterns registered
+		// without a method get the request's
+		route := r.Pattern
+		if untrackedRoutes[route] {
+			return
+		}
+		switch {
+		case route == "":
+			route = "unmatched"
+		case !strings.Contains(route, " "):
+			route = r.Method + " " + route
+		}
+		countTelemetry(telemetryRequests, route)
+		if mediaType, _, err := mime.ParseMediaType(rec.Header().Get("Content-Type")); err == nil && rec.status < http.StatusBadRequest {
+			countTelemetry(telemetryFormats, mediaType)
+		}
+		if category := errorCategory(rec.status); category != "" {
+			countTelemetry(telemetryErrors, category)
+		}
+	})
+}
+
+// TelemetrySummary is the usage counted over a range of days
+type TelemetrySummary struct {
+	From     string           `json:"from"`
+	To       string           `json:"to"`
+	Requests map[string]int64 `json:"requests"`
+	Formats  map[string]int64 `json:"formats"`
+	Errors   map[string]int64 `json:"errors"`
+	Features map[string]int64 `json:"features"`
+}
+
+// summarizeTelemetry adds up the counters of the days from..to (inclusive,
+// formatted as dates)
+func summarizeTelemetry(from, to string) (TelemetrySummary, error) {
+	summary := TelemetrySummary{
+		From:     from,
+		To:       to,
+		Requests: make(map[string]int64),
+		Formats:  make(map[string]int64),
+		Errors:   make(map[string]int64),
+		Features: make(map[string]int64),
+	}
+	groups := map[string]map[string]int64{
+		telemetryRequests: summary.Requests,
+		telemetryFormats:  summary.Formats,
+		telemetryErrors:   summary.Errors,
+		telemetryFeatures: summary.Features,
+	}
+	keys, err := state.keys(telemetryKeyPrefix)
+	if err != nil {
+		return summary, err
+	}
+	retention := time.Duration(config.TelemetryRetentionDays) * 24 * time.Hour
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, telemetryKeyPrefix), ":", 3)
+		if len(parts) != 3 || parts[0] < from || parts[0] > to {
+			continue
+		}
+		counts, ok := groups[parts[1]]
+		if !ok {
+			continue
+		}
+		n, err := state.incrBy(key, 0, retention)
+		if err != nil {
+			return summary, err
+		}
+		counts[parts[2]] += n
+	}
+	return summary, nil
+}
+
+// handleTelemetry shows the usage of the last ?days= days (default 7),
+// today included
+func handleTelemetry(w http.ResponseWriter, r *http.Request) {
+	if !config.Telemetry {
+		integrationError(w, http.StatusNotFound, "Telemetry is disabled; set TELEMETRY=true to collect it")
+		return
+	}
+	days := 7
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > config.TelemetryRetentionDays {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("days must be between 1 and %d", config.TelemetryRetentionDays))
+			return
+		}
+		days = n
+	}
+	// Counts of this replica are included right away
+	flushTelemetry()
+	now := time.Now().UTC()
+	summary, err := summarizeTelemetry(now.AddDate(0, 0, 1-days).Format(time.DateOnly), now.Format(time.DateOnly))
+	if err != nil {
+		logErrorf(r.Context(), "Error reading telemetry: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error reading telemetry")
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// reportTelemetry posts the totals of a day to TELEMETRY_REPORT_URL
+func reportTelemetry(day string) error {
+	summary, err := summarizeTelemetry(day, day)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(config.TelemetryReportURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// runTelemetryReports reports each completed day once. Only the leader
+// reports, and the last day reported is stored, so a new leader does not
+// repeat it.
+func runTelemetryReports() {
+	ticker := time.NewTicker(telemetryReportCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !isLeader() {
+			continue
+		}
+		yesterday := time.Now().UTC().AddDate(0, 0, -1).Format(time.DateOnly)
+		last, _, err := state.get(telemetryReportedKey)
+		if err != nil {
+			logErrorf(context.Background(), "Error reading telemetry report state: %v", err)
+			continue
+		}
+		if string(last) >= yesterday {
+			continue
+		}
+		if err := reportTelemetry(yesterday); err != nil {
+			// Retried at the next check
+			logErrorf(context.Background(), "Error reporting telemetry: %v", err)
+			continue
+		}
+		logf(context.Background(), "Reported telemetry of %s", yesterday)
+		if err := state.set(telemetryReportedKey, []byte(yesterday), 0); err != nil {
+			logErrorf(context.Background(), "Error saving telemetry report state: %v", err)
+		}
+	}
+}
+
+// initTelemetry starts aggregating counts when telemetry is enabled
+func initTelemetry() {
+	if !config.Telemetry {
+		return
+	}
+	go func() {
+		for range time.Tick(telemetryFlushInterval) {
+			flushTelemetry()
+		}
+	}()
+	if config.TelemetryReportURL != "" {
+		go runTelemetryReports()
+		logf(context.Background(), "Telemetry enabled, kept for %d days and reported daily to TELEMETRY_REPORT_URL", config.TelemetryRetentionDays)
+		return
+	}
+	logf(context.Background(), "Telemetry enabled, kept locally for %d days", config.TelemetryRetentionDays)
+}
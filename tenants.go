@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Upstream is the set of inference backends serving a request. Empty fields
+// fall back to the server-wide configuration.
+type Upstream struct {
+	AudioURL    string `json:"audio_url,omitempty"`
+	AudioModel  string `json:"audio_model,omitempty"`
+	AudioAPIKey string `json:"audio_api_key,omitempty"`
+	LLMURL      string `json:"llm_url,omitempty"`
+	LLMModel    string `json:"llm_model,omitempty"`
+	LLMAPIKey   string `json:"llm_api_key,omitempty"`
+	// Headers carrying the keys; the default Authorization sends them as
+	// bearer tokens, other headers such as Azure OpenAI's api-key as is
+	AudioAPIKeyHeader string `json:"audio_api_key_header,omitempty"`
+	LLMAPIKeyHeader   string `json:"llm_api_key_header,omitempty"`
+}
+
+// headerNamePattern matches valid HTTP header names
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+.^_|~-]+$`)
+
+// validateHeaders checks the names of the API key headers
+func (u Upstream) validateHeaders() error {
+	for _, header := range []string{u.AudioAPIKeyHeader, u.LLMAPIKeyHeader} {
+		if header != "" && !headerNamePattern.MatchString(header) {
+			return fmt.Errorf("%q is not a header name", header)
+		}
+	}
+	return nil
+}
+
+// tenantRoute routes a tenant, identified by its API keys, to its upstreams
+type tenantRoute struct {
+	Upstream
+	APIKeys []string `json:"api_keys,omitempty"`
+	// Region pins all of the tenant's content to a data residency region
+	Region string `json:"region,omitempty"`
+}
+
+// tenantTable is the parsed TENANT_ROUTES
+var tenantTable = &secretTable[tenantRoute]{name: "TENANT_ROUTES", parse: parseTenantRoutes}
+
+// parseTenantRoutes decodes and validates a routing table
+func parseTenantRoutes(raw string) (map[string]tenantRoute, error) {
+	routes := make(map[string]tenantRoute)
+	if strings.TrimSpace(raw) == "" {
+		return routes, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &routes); err != nil {
+		return nil, err
+	}
+	for name, route := range routes {
+		if !externalIDPattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid tenant name %q", name)
+		}
+		if route.Region != "" {
+			if !knownRegion(route.Region) {
+				return nil, fmt.Errorf("tenant %q: unknown region %q", name, route.Region)
+			}
+			// Only the region's backends may process its content
+			if route.AudioURL != "" || route.LLMURL != "" || route.AudioAPIKey != "" || route.LLMAPIKey != "" || route.AudioAPIKeyHeader != "" || route.LLMAPIKeyHeader != "" {
+				return nil, fmt.Errorf("tenant %q: backends of region %q cannot be overridden", name, route.Region)
+			}
+		}
+		if route.AudioURL != "" && !validUpstreamURLs(route.AudioURL) {
+			return nil, fmt.Errorf("tenant %q: %q is not a list of http(s) URLs", name, route.AudioURL)
+		}
+		if route.LLMURL != "" && !validUpstreamURL(route.LLMURL) {
+			return nil, fmt.Errorf("tenant %q: %q is not an http(s) URL", name, route.LLMURL)
+		}
+		if err := route.validateHeaders(); err != nil {
+			return nil, fmt.Errorf("tenant %q: %v", name, err)
+		}
+	}
+	return routes, nil
+}
+
+// tenantRoutes returns the current routing table
+func tenantRoutes() map[string]tenantRoute {
+	return tenantTable.get(config.TenantRoutes.Value())
+}
+
+// validUpstreamURL reports whether u is an absolute http(s) URL
+func validUpstreamURL(u string) bool {
+	parsed, err := url.Parse(u)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// knownTenant reports whether name has a route
+func knownTenant(name string) bool {
+	_, ok := tenantRoutes()[name]
+	return ok
+}
+
+// defaultUpstream is the server-wide backend configuration
+func defaultUpstream() Upstream {
+	return Upstream{
+		AudioURL:    config.AudioInferenceURL,
+		AudioModel:  config.AudioModelName,
+		AudioAPIKey: config.AudioAPIKey.Value(),
+		LLMURL:      config.LLMInferenceURL,
+		LLMModel:    config.LLMModelName,
+		LLMAPIKey:   config.LLMAPIKey.Value(),
+
+		AudioAPIKeyHeader: config.AudioAPIKeyHeader,
+		LLMAPIKeyHeader:   config.LLMAPIKeyHeader,
+	}
+}
+
+// upstreamFor returns the backends for a tenant's request processed in
+// region; "" is the default tenant and region. A region that is no longer
+// configured is an error, never the default backends.
+func upstreamFor(tenant, region string) (Upstream, error) {
+	if err := checkRegion(region); err != nil {
+		return Upstream{}, err
+	}
+	up := defaultUpstream()
+	route := tenantRoutes()[tenant]
+	r, ok := regions()[region]
+	if !ok {
+		return overrideUpstream(up, route.Upstream), nil
+	}
+	// Content tagged with a region only ever reaches the region's backends;
+	// the tenant still picks its models
+	up = overrideUpstream(up, r.Upstream)
+	return overrideUpstream(up, Upstream{AudioModel: route.AudioModel, LLMModel: route.LLMModel}), nil
+}
+
+// overrideUpstream applies the fields set in o over up. A backend URL
+// override never inherits the credentials of the backend it replaces, nor
+// the header they are sent in.
+func overrideUpstream(up, o Upstream) Upstream {
+	if o.AudioURL != "" {
+		up.AudioURL, up.AudioAPIKey, up.AudioAPIKeyHeader = o.AudioURL, o.AudioAPIKey, o.AudioAPIKeyHeader
+	} else if o.AudioAPIKey != "" {
+		up.AudioAPIKey = o.AudioAPIKey
+	}
+	if o.AudioAPIKeyHeader != "" {
+		up.AudioAPIKeyHeader = o.AudioAPIKeyHeader
+	}
+	if o.AudioModel != "" {
+		up.AudioModel = o.AudioModel
+	}
+	if o.LLMURL != "" {
+		up.LLMURL, up.LLMAPIKey, up.LLMAPIKeyHeader = o.LLMURL, o.LLMAPIKey, o.LLMAPIKeyHeader
+	} else if o.LLMAPIKey != "" {
+		up.LLMAPIKey = o.LLMAPIKey
+	}
+	if o.LLMAPIKeyHeader != "" {
+		up.LLMAPIKeyHeader = o.LLMAPIKeyHeader
+	}
+	if o.LLMModel != "" {
+		up.LLMModel = o.LLMModel
+	}
+	return up
+}
+
+// audioBaseURL is the base URL of the Whisper backend, the first one when
+// AudioURL lists several to balance requests over
+func (u Upstream) audioBaseURL() string {
+	if urls := splitBackendURLs(u.AudioURL); len(urls) > 0 {
+		return urls[0]
+	}
+	return ""
+}
+
+// audioBackends returns the upstream once for each Whisper backend it lists
+func (u Upstream) audioBackends() []Upstream {
+	var ups []Upstream
+	for _, backend := range splitBackendURLs(u.AudioURL) {
+		up := u
+		up.AudioURL = backend
+		ups = append(ups, up)
+	}
+	return ups
+}
+
+// transcriptionURL is the Whisper transcription endpoint
+func (u Upstream) transcriptionURL() string {
+	return u.audioBaseURL() + "/v1/audio/transcriptions"
+}
+
+// translationURL is the Whisper translation endpoint, which answers in
+// English
+func (u Upstream) translationURL() string {
+	return u.audioBaseURL() + "/v1/audio/translations"
+}
+
+// chatURL is the LLM chat completions endpoint
+func (u Upstream) chatURL() string {
+	return u.LLMURL + "/v1/chat/completions"
+}
+
+// authorizeAudio authenticates a request to the Whisper backend
+func (u Upstream) authorizeAudio(req *http.Request) {
+	setAPIKey(req, u.AudioAPIKeyHeader, u.AudioAPIKey)
+}
+
+// authorizeLLM authenticates a request to the LLM backend
+func (u Upstream) authorizeLLM(req *http.Request) {
+	setAPIKey(req, u.LLMAPIKeyHeader, u.LLMAPIKey)
+}
+
+// setAPIKey authenticates an upstream request when the backend needs a key:
+// as a bearer token in Authorization, or in header as is
+func setAPIKey(req *http.Request, header, key string) {
+	switch {
+	case key == "":
+	case header == "" || strings.EqualFold(header, "Authorization"):
+		req.Header.Set("Authorization", "Bearer "+key)
+	default:
+		req.Header.Set(header, key)
+	}
+}
+
+// apiKeysConfigured reports whether any API key can authenticate
+func apiKeysConfigured() bool {
+	if config.IntegrationAPIKeys.Value() != "" || len(registry.list(kindAPIKeys)) > 0 {
+		return true
+	}
+	for _, route := range tenantRoutes() {
+		if len(route.APIKeys) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// requestAPIKey returns the key from X-API-Key or "Authorization: Bearer"
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	key, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return key
+}
+
+// initTenants validates the routing table at startup
+func initTenants() {
+	routes, err := parseTenantRoutes(config.TenantRoutes.Value())
+	if err != nil {
+		log.Fatalf("Invalid TENANT_ROUTES: %v", err)
+	}
+	if len(routes) > 0 {
+		logf(context.Background(), "Routing %d tenants to their own upstreams", len(routes))
+	}
+}
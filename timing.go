@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// JSON responses of /transcribe, /summarize and /memo, and background jobs,
+// carry a timing object that shows where the wait went:
+//
+//   - upload: receiving the audio (or downloading audio_url for jobs) and
+//     sending it to the backend
+//   - preprocess: reading the form and checking the audio
+//   - queue_wait: waiting for request memory and backend slots
+//   - asr: the speech-to-text backend, from the end of the audio to its answer
+//   - postprocess: normalizing the transcript, paragraphs and duplicate
+//     detection
+//   - llm: summaries, titles, tags and action items
+//
+// Stages are recorded on a stageTimer carried by the request context; the
+// backend clients record their part through stageTransport.
+
+// Stages of a request
+const (
+	stageUpload      = "upload"
+	stagePreprocess  = "preprocess"
+	stageQueue       = "queue_wait"
+	stageASR         = "asr"
+	stagePostprocess = "postprocess"
+	stageLLM         = "llm"
+)
+
+// Timing is the per-stage latency breakdown in milliseconds
+type Timing struct {
+	UploadMS      int64 `json:"upload_ms"`
+	PreprocessMS  int64 `json:"preprocess_ms"`
+	QueueWaitMS   int64 `json:"queue_wait_ms"`
+	ASRMS         int64 `json:"asr_ms"`
+	PostprocessMS int64 `json:"postprocess_ms"`
+	LLMMS         int64 `json:"llm_ms"`
+	// TotalMS includes time not attributed to a stage
+	TotalMS int64 `json:"total_ms"`
+}
+
+// stageTimer sums the time spent in each stage of a request. A nil timer
+// records nothing.
+type stageTimer struct {
+	start time.Time
+
+	mu     sync.Mutex
+	stages map[string]time.Duration
+}
+
+type stageTimerContextKey struct{}
+
+// newStageTimer starts timing now
+func newStageTimer() *stageTimer {
+	return &stageTimer{start: time.Now(), stages: make(map[string]time.Duration)}
+}
+
+// startTiming attaches a new stage timer to the request
+func startTiming(r *http.Request) (*http.Request, *stageTimer) {
+	t := newStageTimer()
+	return r.WithContext(withStageTimer(r.Context(), t)), t
+}
+
+// withStageTimer returns ctx carrying t
+func withStageTimer(ctx context.Context, t *stageTimer) context.Context {
+	return context.WithValue(ctx, stageTimerContextKey{}, t)
+}
+
+// stageTimerFrom returns the timer of ctx, or nil
+func stageTimerFrom(ctx context.Context) *stageTimer {
+	t, _ := ctx.Value(stageTimerContextKey{}).(*stageTimer)
+	return t
+}
+
+// add records d in stage
+func (t *stageTimer) add(stage string, d time.Duration) {
+	if t == nil || d <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stages[stage] += d
+}
+
+// since records the time elapsed since start in stage
+func (t *stageTimer) since(stage string, start time.Time) {
+	t.add(stage, time.Since(start))
+}
+
+// timing returns the breakdown so far
+func (t *stageTimer) timing() *Timing {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ms := func(stage string) int64 { return t.stages[stage].Milliseconds() }
+	return &Timing{
+		UploadMS:      ms(stageUpload),
+		PreprocessMS:  ms(stagePreprocess),
+		QueueWaitMS:   ms(stageQueue),
+		ASRMS:         ms(stageASR),
+		PostprocessMS: ms(stagePostprocess),
+		LLMMS:         ms(stageLLM),
+		TotalMS:       time.Since(t.start).Milliseconds(),
+	}
+}
+
+// stageTransport records backend calls on the timer of the request context,
+// until the response headers arrive. With split set, the time until the
+// request body was sent is recorded as upload, since audio uploaded by a
+// client is streamed to the backend as it arrives.
+type stageTransport struct {
+	stage string
+	split bool
+	next  http.RoundTripper
+}
+
+func (t *stageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timer := stageTimerFrom(req.Context())
+	if timer == nil {
+		return t.next.RoundTrip(req)
+	}
+	start := time.Now()
+	var body *sentBody
+	if t.split && req.Body != nil && req.Body != http.NoBody {
+		body = &sentBody{ReadCloser: req.Body}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	resp, err := t.next.RoundTrip(req)
+	end := time.Now()
+	if sent := body.sentAt(); !sent.IsZero() && sent.Before(end) {
+		timer.add(stageUpload, sent.Sub(start))
+		start = sent
+	}
+	timer.add(t.stage, end.Sub(start))
+	return resp, err
+}
+
+// sentBody notes when a request body was read to the end
+type sentBody struct {
+	io.ReadCloser
+
+	mu   sync.Mutex
+	sent time.Time
+}
+
+func (b *sentBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.mu.Lock()
+		if b.sent.IsZero() {
+			b.sent = time.Now()
+		}
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+// sentAt returns when the body was sent, or the zero time
+func (b *sentBody) sentAt() time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sent
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Jobs get a short descriptive title, so lists of transcriptions do not
+// read as a column of file names. The title is derived from the file name
+// and date when the job starts, and replaced by one the LLM suggests from
+// the transcript once it is transcribed.
+
+// maxTitleLength bounds titles, in characters
+const maxTitleLength = 80
+
+// titleTimeout bounds asking the LLM for a title; the fallback is kept when
+// it takes longer
+const titleTimeout = 30 * time.Second
+
+// titlePrompt asks for the title alone, without quotes or punctuation
+const titlePrompt = `You write titles for transcribed audio recordings. Answer with a concise, descriptive title of at most 8 words for the transcription, in its language, without quotes and without a trailing period.`
+
+// genericNameWords are the words recorders and phones put in file names,
+// which say nothing about the content
+var genericNameWords = map[string]bool{
+	"audio": true, "recording": true, "rec": true, "record": true, "voice": true,
+	"memo": true, "note": true, "new": true, "untitled": true, "file": true,
+	"track": true, "sound": true, "wav": true, "meeting": true, "call": true,
+}
+
+// fallbackTitle derives a title from an audio file name, or from the date
+// when the name is only generic words and numbers like
+// "recording_2024_03_01.wav"
+func fallbackTitle(filename string, at time.Time) string {
+	if unescaped, err := url.PathUnescape(filename); err == nil {
+		filename = cleanFilename(unescaped)
+	}
+	name := strings.TrimSuffix(filename, path.Ext(filename))
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '_' || r == '-' || r == '.' || r == '+' || unicode.IsSpace(r)
+	})
+	meaningful := false
+	for _, word := range words {
+		if !genericNameWords[strings.ToLower(word)] && strings.IndexFunc(word, unicode.IsLetter) >= 0 {
+			meaningful = true
+			break
+		}
+	}
+	if !meaningful {
+		return "Recording of " + at.UTC().Format("Jan 2, 2006 15:04 UTC")
+	}
+	return truncateTitle(strings.Join(words, " "))
+}
+
+// truncateTitle capitalizes a title and cuts it at a word boundary within
+// maxTitleLength
+func truncateTitle(title string) string {
+	runes := []rune(strings.TrimSpace(title))
+	if len(runes) == 0 {
+		return ""
+	}
+	runes[0] = unicode.ToUpper(runes[0])
+	if len(runes) > maxTitleLength {
+		cut := maxTitleLength - 1
+		for cut > maxTitleLength/2 && !unicode.IsSpace(runes[cut]) {
+			cut--
+		}
+		runes = append([]rune(strings.TrimRightFunc(string(runes[:cut]), unicode.IsSpace)), '…')
+	}
+	return string(runes)
+}
+
+// cleanTitle keeps the first line of the LLM's answer, without the quotes,
+// markdown and labels models add despite the prompt
+func cleanTitle(answer string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(answer), "\n")
+	line = strings.TrimSpace(strings.TrimLeft(line, "#*"))
+	if label, rest, ok := strings.Cut(line, ":"); ok && strings.EqualFold(strings.TrimSpace(label), "title") {
+		line = rest
+	}
+	line = strings.Trim(strings.TrimSpace(line), "\"'“”‘’*`")
+	line = strings.TrimSuffix(line, ".")
+	return truncateTitle(line)
+}
+
+// newTitleRequest builds the chat completion request for the title of text
+func newTitleRequest(model, text string) ChatCompletionRequest {
+	// The opening of a recording is enough to name it
+	const excerpt = 4000
+	if runes := []rune(text); len(runes) > excerpt {
+		text = string(runes[:excerpt])
+	}
+	return ChatCompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: "system", Content: titlePrompt},
+			{Role: "user", Content: "Transcription:\n\n" + text},
+		},
+		Temperature: 0,
+	}
+}
+
+// generateTitle asks the LLM for a title for text
+func generateTitle(ctx context.Context, up Upstream, text string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, titleTimeout)
+	defer cancel()
+	answer, err := llmText(ctx, up, newTitleRequest(up.LLMModel, text))
+	if err != nil {
+		return "", err
+	}
+	title := cleanTitle(answer)
+	if title == "" {
+		return "", fmt.Errorf("LLM backend returned an empty title")
+	}
+	return title, nil
+}
+
+// jobTitle names a job, falling back to its ID for jobs recorded before
+// titles existed
+func jobTitle(job Job) string {
+	if job.Title != "" {
+		return job.Title
+	}
+	if name := lastPathSegment(job.AudioURL); name != "" {
+		return fallbackTitle(name, job.CreatedAt)
+	}
+	return job.ID
+}
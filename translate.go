@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// The translate pipeline step translates a transcript segment by segment
+// into the pipeline's translate_to language, so the translation keeps the
+// timing of the original, e.g. for dubbing scripts. Segments are sent to
+// the LLM in batches to keep each answer well within its output limit.
+//
+// POST /translate translates on request, for teams who record in one
+// language and read in another: text as a whole, the segments returned by
+// /transcribe segment by segment, or an audio upload. Whisper translates
+// audio into English itself; audio for other languages is transcribed and
+// its segments translated by the LLM.
+
+// translateBatchSegments is the number of segments translated in one call
+const translateBatchSegments = 40
+
+// TranscriptTranslation is a transcript translated segment by segment
+type TranscriptTranslation struct {
+	Language string    `json:"language"`
+	Segments []Segment `json:"segments"`
+}
+
+// translatePrompt instructs the LLM to answer with JSON only; %s is the
+// target language tag
+const translatePrompt = `You translate transcript lines into the language with the tag %s, for subtitles and dubbing. The lines are given as "[ID] text". Translate each line on its own, keeping its meaning and register and about its length, and do not merge or split lines. Answer with a JSON array only, without any other text, with one object per line: {"id": ID, "text": "translation"}.`
+
+// translateTextPrompt instructs the LLM to translate text as a whole; %s
+// is the target language tag
+const translateTextPrompt = `You translate transcribed speech into the language with the tag %s. Keep the meaning, register and paragraphs of the text. Answer with the translation only, without notes or any other text.`
+
+// newTranslateRequest builds the chat completion request translating a
+// batch of segments
+func newTranslateRequest(model, language string, segments []Segment) ChatCompletionRequest {
+	var lines strings.Builder
+	for _, s := range segments {
+		fmt.Fprintf(&lines, "[%d] %s\n", s.ID, strings.TrimSpace(s.Text))
+	}
+	return ChatCompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: "system", Content: fmt.Sprintf(translatePrompt, language)},
+			{Role: "user", Content: lines.String()},
+		},
+		Temperature: 0,
+	}
+}
+
+// translateSegments translates a transcript into language. A transcript
+// without segments is translated as one segment spanning duration.
+func translateSegments(ctx context.Context, up Upstream, text string, duration float64, segments []Segment, language string) (*TranscriptTranslation, error) {
+	if len(segments) == 0 {
+		segments = []Segment{{Start: 0, End: duration, Text: text}}
+	}
+	translation := &TranscriptTranslation{Language: language}
+	for start := 0; start < len(segments); start += translateBatchSegments {
+		batch := segments[start:min(start+translateBatchSegments, len(segments))]
+		translated, err := translateBatch(ctx, up, language, batch)
+		if err != nil {
+			return nil, err
+		}
+		translation.Segments = append(translation.Segments, translated...)
+	}
+	return translation, nil
+}
+
+// translateBatch translates one batch of segments
+func translateBatch(ctx context.Context, up Upstream, language string, segments []Segment) ([]Segment, error) {
+	var raw []translatedLine
+	if err := llmJSON(ctx, up, newTranslateRequest(up.LLMModel, language, segments), &raw); err != nil {
+		return nil, err
+	}
+	return pairTranslation(raw, segments)
+}
+
+// translateText translates text into language as a whole
+func translateText(ctx context.Context, up Upstream, text, language string) (string, error) {
+	return llmText(ctx, up, ChatCompletionRequest{
+		Model: up.LLMModel,
+		Messages: []Message{
+			{Role: "system", Content: fmt.Sprintf(translateTextPrompt, language)},
+			{Role: "user", Content: text},
+		},
+		Temperature: 0,
+	})
+}
+
+// translatedLine is a segment as translated by the LLM
+type translatedLine struct {
+	ID   int    `json:"id"`
+	Text string `json:"text"`
+}
+
+// pairTranslation pairs the translated lines with their segments. A line
+// left untranslated fails the batch rather than slipping into the
+// translation in the original language.
+func pairTranslation(raw []translatedLine, segments []Segment) ([]Segment, error) {
+	texts := make(map[int]string, len(raw))
+	for _, line := range raw {
+		if text := strings.TrimSpace(line.Text); text != "" {
+			texts[line.ID] = text
+		}
+	}
+	translated := make([]Segment, len(segments))
+	for i, s := range segments {
+		text, ok := texts[s.ID]
+		if !ok && strings.TrimSpace(s.Text) != "" {
+			return nil, &UpstreamError{Service: "LLM", Message: fmt.Sprintf("translation answer has no line %d", s.ID)}
+		}
+		s.Text = text
+		translated[i] = s
+	}
+	return translated, nil
+}
+
+// TranslateRequest is the JSON body of POST /translate
+type TranslateRequest struct {
+	Text string `json:"text"`
+	// Segments of a transcript, translated segment by segment instead of
+	// text so the translation keeps their timing
+	Segments       []Segment `json:"segments,omitempty"`
+	TargetLanguage string    `json:"target_language"`
+}
+
+// TranslationResult is the response of POST /translate
+type TranslationResult struct {
+	Text     string `json:"text"`
+	Language string `json:"language"`
+	// SourceLanguage is the language audio was transcribed in before it
+	// was translated
+	SourceLanguage string    `json:"source_language,omitempty"`
+	Segments       []Segment `json:"segments,omitempty"`
+	Duration       float64   `json:"duration,omitempty"`
+	Timing         *Timing   `json:"timing,omitempty"`
+	// QuotaWarnings are set when the caller's workspace nearly used up
+	// a quota
+	QuotaWarnings []QuotaWarning `json:"quota_warnings,omitempty"`
+}
+
+// translationOf returns the translation made of a transcript's segments,
+// which are now all in the target language
+func translationOf(translation *TranscriptTranslation, duration float64) *TranslationResult {
+	texts := make([]string, 0, len(translation.Segments))
+	for i := range translation.Segments {
+		s := &translation.Segments[i]
+		s.Language = translation.Language
+		if text := strings.TrimSpace(s.Text); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return &TranslationResult{
+		Text:     strings.Join(texts, " "),
+		Language: translation.Language,
+		Segments: translation.Segments,
+		Duration: duration,
+	}
+}
+
+// handleTranslate translates text or segments sent as JSON, or an audio
+// file uploaded as multipart form data, into the target language
+func handleTranslate(w http.ResponseWriter, r *http.Request) {
+	logf(r.Context(), "Received translation request")
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	upload := mediaType == "multipart/form-data"
+	job, ok := startInteractiveJob(w, r, "translation", upload)
+	if !ok {
+		return
+	}
+	defer job.finish()
+	w, r = job, job.r
+
+	var result *TranslationResult
+	if upload {
+		result, ok = translateUpload(w, r, job.up, job.caller, job.jobRecorder)
+	} else {
+		result, ok = translateRequestText(w, r, job.up, job.jobRecorder)
+	}
+	if !ok {
+		return
+	}
+	logf(r.Context(), "Translation to %s successful", result.Language)
+	result.Timing = job.timer.timing()
+	result.QuotaWarnings = job.warnings
+	writeJSON(w, http.StatusOK, result)
+}
+
+// translateRequestText translates the text or segments of a JSON request.
+// It answers the request itself when it fails.
+func translateRequestText(w http.ResponseWriter, r *http.Request, up Upstream, job *jobRecorder) (*TranslationResult, bool) {
+	// Queue or reject the request when request buffers are over budget
+	lease, ok := admitRequest(w, r, bodyEstimate(r.ContentLength))
+	if !ok {
+		return nil, false
+	}
+	defer lease.release()
+
+	var req TranslateRequest
+	if err := json.NewDecoder(lease.reader(r.Body)).Decode(&req); err != nil {
+		logErrorf(r.Context(), "Error parsing JSON: %v", err)
+		http.Error(w, "Error parsing request body", http.StatusBadRequest)
+		return nil, false
+	}
+	defer r.Body.Close()
+	if !localePattern.MatchString(req.TargetLanguage) {
+		http.Error(w, "target_language must be a language tag such as de or pt-BR", http.StatusBadRequest)
+		return nil, false
+	}
+
+	if len(req.Segments) > 0 {
+		job.create(map[string]any{"segments": len(req.Segments)})
+		logf(r.Context(), "Translating %d segments to %s", len(req.Segments), req.TargetLanguage)
+		translation, err := translateSegments(r.Context(), up, "", 0, req.Segments, req.TargetLanguage)
+		if err != nil {
+			translationFailed(w, r, err)
+			return nil, false
+		}
+		return translationOf(translation, req.Segments[len(req.Segments)-1].End), true
+	}
+
+	if strings.TrimSpace(req.Text) == "" {
+		http.Error(w, "Text field is required", http.StatusBadRequest)
+		return nil, false
+	}
+	if len(req.Text) > config.SummaryMaxInputChars {
+		http.Error(w, fmt.Sprintf("Text over %d characters is too long to translate at once, send its segments instead", config.SummaryMaxInputChars), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	job.create(map[string]any{"text_length": len(req.Text)})
+	logf(r.Context(), "Translating text (length: %d characters) to %s", len(req.Text), req.TargetLanguage)
+	text, err := translateText(r.Context(), up, req.Text, req.TargetLanguage)
+	if err != nil {
+		translationFailed(w, r, err)
+		return nil, false
+	}
+	return &TranslationResult{Text: text, Language: req.TargetLanguage}, true
+}
+
+// translateUpload translates an uploaded audio file: into English by
+// Whisper, into other languages by transcribing it and translating its
+// segments. It answers the request itself when it fails.
+func translateUpload(w http.ResponseWriter, r *http.Request, up Upstream, caller principal, job *jobRecorder) (*TranslationResult, bool) {
+	// Queue or reject the upload when request buffers are over budget
+	lease, ok := admitRequest(w, r, uploadBufferEstimate)
+	if !ok {
+		return nil, false
+	}
+	defer lease.release()
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	r.Body = throttleUpload(r.Context(), r.Body)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		logErrorf(r.Context(), "Error parsing form: %v", err)
+		http.Error(w, "Error parsing form data", http.StatusBadRequest)
+		return nil, false
+	}
+	fields := make(map[string]string)
+	filePart, err := readFieldsUntilFile(reader, fields)
+	if err != nil {
+		logErrorf(r.Context(), "Error parsing form: %v", err)
+		http.Error(w, "Error parsing form data", http.StatusBadRequest)
+		return nil, false
+	}
+	if filePart == nil {
+		http.Error(w, "Error getting file from form", http.StatusBadRequest)
+		return nil, false
+	}
+	target := fields["target_language"]
+	if target == "" {
+		target = "en"
+	}
+	if !localePattern.MatchString(target) {
+		http.Error(w, "target_language must be a language tag such as de or pt-BR", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// Check the format by the magic bytes and convert audio other than WAV
+	filename := cleanFilename(filePart.FileName())
+	dir, err := ingestDir(tenantRegion(caller.Tenant))
+	if err != nil {
+		logErrorf(r.Context(), "Error preparing upload %s: %v", filename, err)
+		http.Error(w, regionUnavailableMessage, http.StatusServiceUnavailable)
+		return nil, false
+	}
+	audio, err := prepareUpload(r.Context(), filePart, filename, dir)
+	if err != nil {
+		logErrorf(r.Context(), "Error preparing upload %s: %v", filename, err)
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errUnsupportedAudio):
+			http.Error(w, "Unsupported audio format: upload WAV, MP3, M4A, FLAC, OGG or WebM", http.StatusBadRequest)
+		case errors.Is(err, errNoConverter):
+			http.Error(w, "Only WAV files are supported: converting other formats requires ffmpeg on the server", http.StatusUnsupportedMediaType)
+		case errors.Is(err, errConversion):
+			http.Error(w, "The audio could not be converted, it may be damaged", http.StatusBadRequest)
+		default:
+			http.Error(w, "Error receiving upload", http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	defer audio.Close()
+	job.create(map[string]any{"filename": filename})
+
+	if base, _, _ := strings.Cut(strings.ToLower(target), "-"); base == "en" {
+		logf(r.Context(), "Translating %s to English", filename)
+		transcript, err := translateAudio(r.Context(), up, audio, audio.Filename)
+		if err != nil {
+			translationFailed(w, r, err)
+			return nil, false
+		}
+		recordWorkspaceAudio(caller.Workspace, transcript.Duration)
+		return &TranslationResult{Text: transcript.Text, Language: target, Segments: transcript.Segments, Duration: transcript.Duration}, true
+	}
+
+	logf(r.Context(), "Transcribing %s to translate it to %s", filename, target)
+	transcript, err := transcribeAudio(r.Context(), up, audio, audio.Filename, "")
+	if err != nil {
+		translationFailed(w, r, err)
+		return nil, false
+	}
+	recordWorkspaceAudio(caller.Workspace, transcript.Duration)
+	translation, err := translateSegments(r.Context(), up, transcript.Text, transcript.Duration, transcript.Segments, target)
+	if err != nil {
+		translationFailed(w, r, err)
+		return nil, false
+	}
+	result := translationOf(translation, transcript.Duration)
+	result.SourceLanguage = languageCode(transcript.Language)
+	return result, true
+}
+
+// translationFailed answers a request whose translation failed
+func translationFailed(w http.ResponseWriter, r *http.Request, err error) {
+	logErrorf(r.Context(), "Error translating: %v", err)
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+	case upstreamBusy(w, err):
+	default:
+		http.Error(w, "Error calling translation service", http.StatusBadGateway)
+	}
+}
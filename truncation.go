@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Transcripts of long meetings can exceed what the LLM accepts. Text longer
+// than SUMMARY_MAX_INPUT_CHARS is reduced before it is summarized, with a
+// strategy chosen per request (falling back to SUMMARY_TRUNCATION):
+//
+//   - head: the beginning of the text
+//   - tail: the end of the text
+//   - smart-extract: the sentences that best represent the text's vocabulary,
+//     in their original order, always including the opening
+//   - chunked: every part is summarized on its own and the partial summaries
+//     are combined, at the cost of one more LLM call per part
+//
+// The prompt tells the LLM what it is given, and the result reports the
+// strategy applied.
+
+// Truncation strategies
+const (
+	truncateHead    = "head"
+	truncateTail    = "tail"
+	truncateSmart   = "smart-extract"
+	truncateChunked = "chunked"
+)
+
+// maxSummaryChunks bounds the LLM calls of a chunked summary
+const maxSummaryChunks = 16
+
+// maxSentenceChars splits run-on text without punctuation into pieces
+const maxSentenceChars = 500
+
+// omissionMarker marks text left out of an extract
+const omissionMarker = "[…]"
+
+// errTextTooLong is returned when even chunking cannot cover a text
+var errTextTooLong = errors.New("text is too long to summarize")
+
+// Truncation reports how a text over the input limit was reduced
+type Truncation struct {
+	Strategy   string `json:"strategy"`
+	InputChars int    `json:"input_chars"`
+	// SentChars is how much of the text reached the LLM
+	SentChars int `json:"sent_chars"`
+	Chunks    int `json:"chunks,omitempty"`
+}
+
+// validTruncation reports whether strategy is known
+func validTruncation(strategy string) bool {
+	switch strategy {
+	case truncateHead, truncateTail, truncateSmart, truncateChunked:
+		return true
+	}
+	return false
+}
+
+// splitSentences breaks text into sentences, splitting run-on text into
+// pieces of at most maxSentenceChars
+func splitSentences(text string) []string {
+	var sentences []string
+	var current []string
+	length := 0
+	for _, word := range strings.Fields(text) {
+		if length > 0 && length+1+len([]rune(word)) > maxSentenceChars {
+			sentences = append(sentences, strings.Join(current, " "))
+			current, length = nil, 0
+		}
+		current = append(current, word)
+		length += len([]rune(word)) + 1
+		if endsSentence(word) {
+			sentences = append(sentences, strings.Join(current, " "))
+			current, length = nil, 0
+		}
+	}
+	if len(current) > 0 {
+		sentences = append(sentences, strings.Join(current, " "))
+	}
+	return sentences
+}
+
+// headOf returns the beginning of text up to limit characters, cut at a
+// word boundary
+func headOf(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	cut := string(runes[:limit])
+	if i := strings.LastIndexAny(cut, " \n\t"); i > len(cut)/2 {
+		cut = cut[:i]
+	}
+	return strings.TrimSpace(cut)
+}
+
+// tailOf returns the end of text up to limit characters, cut at a word
+// boundary
+func tailOf(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	cut := string(runes[len(runes)-limit:])
+	if i := strings.IndexAny(cut, " \n\t"); i >= 0 && i < len(cut)/2 {
+		cut = cut[i:]
+	}
+	return strings.TrimSpace(cut)
+}
+
+// smartExtract picks the sentences whose content words recur most in the
+// text, up to limit characters, and returns them in order with omissions
+// marked. The first sentences are always kept, as they usually say what
+// the meeting is about.
+func smartExtract(text string, limit int) string {
+	sentences := splitSentences(text)
+	frequency := make(map[string]int)
+	words := make([]map[string]struct{}, len(sentences))
+	for i, sentence := range sentences {
+		words[i] = contentWords([]string{sentence})
+		for word := range words[i] {
+			frequency[word]++
+		}
+	}
+	type candidate struct {
+		index int
+		score float64
+	}
+	candidates := make([]candidate, len(sentences))
+	for i := range sentences {
+		score := 0.0
+		for word := range words[i] {
+			score += float64(frequency[word])
+		}
+		candidates[i] = candidate{i, score / float64(len(words[i])+1)}
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		// The opening comes first, then the best scores
+		if (candidates[a].index < 2) != (candidates[b].index < 2) {
+			return candidates[a].index < 2
+		}
+		return candidates[a].score > candidates[b].score
+	})
+
+	markerLength := len([]rune(omissionMarker)) + 2
+	chosen := make([]bool, len(sentences))
+	used := 0
+	for _, c := range candidates {
+		length := len([]rune(sentences[c.index])) + markerLength
+		if used+length > limit {
+			continue
+		}
+		chosen[c.index] = true
+		used += length
+	}
+
+	var parts []string
+	for i, sentence := range sentences {
+		if chosen[i] {
+			parts = append(parts, sentence)
+		} else if len(parts) == 0 || parts[len(parts)-1] != omissionMarker {
+			parts = append(parts, omissionMarker)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// chunkText groups the sentences of text into chunks of up to limit
+// characters
+func chunkText(text string, limit int) []string {
+	var chunks []string
+	var current strings.Builder
+	for _, sentence := range splitSentences(text) {
+		if current.Len() > 0 && len([]rune(current.String()))+1+len([]rune(sentence)) > limit {
+			chunks = append(chunks, current.String())
+			current.Reset()
+		}
+		if current.Len() > 0 {
+			current.WriteByte(' ')
+		}
+		current.WriteString(sentence)
+	}
+	if current.Len() > 0 {
+		chunks = append(chunks, current.String())
+	}
+	return chunks
+}
+
+// prepareSummary builds the request summarizing text under the system
+// prompt, reducing the text with strategy when it exceeds
+// SUMMARY_MAX_INPUT_CHARS. A chunked summary summarizes the parts first. The
+// truncation is nil when the text fits.
+func prepareSummary(ctx context.Context, up Upstream, text, strategy, prompt string) (ChatCompletionRequest, *Truncation, error) {
+	limit := config.SummaryMaxInputChars
+	inputChars := len([]rune(text))
+	if limit <= 0 || inputChars <= limit {
+		return newSummaryRequest(up.LLMModel, prompt, text), nil, nil
+	}
+	if strategy == "" {
+		strategy = config.SummaryTruncation
+	}
+	truncation := &Truncation{Strategy: strategy, InputChars: inputChars}
+
+	var instruction, sent string
+	switch strategy {
+	case truncateHead:
+		sent = headOf(text, limit)
+		instruction = "Please summarize the following transcription. It is too long to include in full, so only its beginning is given:"
+	case truncateTail:
+		sent = tailOf(text, limit)
+		instruction = "Please summarize the following transcription. It is too long to include in full, so only its end is given:"
+	case truncateSmart:
+		sent = smartExtract(text, limit)
+		instruction = fmt.Sprintf("Please summarize the following transcription. It is too long to include in full, so only excerpts are given; %s marks omitted passages:", omissionMarker)
+	case truncateChunked:
+		chunks := chunkText(text, limit)
+		if len(chunks) > maxSummaryChunks {
+			return ChatCompletionRequest{}, nil, fmt.Errorf("%w: %d characters would take %d parts of %d characters, at most %d are summarized", errTextTooLong, inputChars, len(chunks), limit, maxSummaryChunks)
+		}
+		partials := make([]string, 0, len(chunks))
+		for i, chunk := range chunks {
+			instruction := fmt.Sprintf("Please summarize part %d of %d of the following transcription:", i+1, len(chunks))
+			result, err := llmComplete(ctx, up, newSummaryPromptRequest(up.LLMModel, config.SummarySystemPrompt, instruction, chunk))
+			if err != nil {
+				return ChatCompletionRequest{}, nil, fmt.Errorf("summarizing part %d of %d: %w", i+1, len(chunks), err)
+			}
+			partials = append(partials, fmt.Sprintf("Part %d:\n%s", i+1, result.Summary))
+		}
+		truncation.Chunks = len(chunks)
+		truncation.SentChars = inputChars
+		instruction = "The following are summaries of consecutive parts of one transcription. Combine them into one summary of the whole transcription:"
+		return newSummaryPromptRequest(up.LLMModel, prompt, instruction, headOf(strings.Join(partials, "\n\n"), limit)), truncation, nil
+	default:
+		return ChatCompletionRequest{}, nil, fmt.Errorf("unknown truncation strategy %q", strategy)
+	}
+	truncation.SentChars = len([]rune(sent))
+	return newSummaryPromptRequest(up.LLMModel, prompt, instruction, sent), truncation, nil
+}
+
+// initTruncation logs the summary input limit
+func initTruncation() {
+	if config.SummaryMaxInputChars > 0 {
+		logf(context.Background(), "Summarizing up to %d characters per LLM call, longer text with the %s strategy", config.SummaryMaxInputChars, config.SummaryTruncation)
+	}
+}
@@ -0,0 +1,675 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A long recording uploaded over a flaky connection should not start over
+// on every interruption. Uploads to /files/ follow the tus protocol
+// (https://tus.io, version 1.0.0 with the creation, expiration and
+// termination extensions): POST /files/ declares an upload with its length
+// and the job's fields, PATCH appends bytes at an offset, and after an
+// interruption the client asks for the offset with HEAD and carries on from
+// there. The bytes received are kept in the ingest directory, and once the
+// last one arrives the recording is queued as a background job, as if it
+// had been sent to /jobs/transcribe. Uploads not completed within
+// uploadExpiry expire. One request writes to an upload at a time, even
+// with several replicas, holding a claim on it in the state store.
+
+// tusVersion is the version of the tus protocol spoken, and tusExtensions
+// the extensions supported
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+)
+
+// uploadKeyPrefix namespaces resumable uploads in the state store,
+// uploadClaimPrefix the counters the request writing to an upload claims
+// it with, and uploadCutPrefix the marks asking that request to stop
+const (
+	uploadKeyPrefix   = "upload:"
+	uploadClaimPrefix = "upload-claim:"
+	uploadCutPrefix   = "upload-cut:"
+)
+
+const (
+	// uploadExpiry is how long an upload may take to complete
+	uploadExpiry = 24 * time.Hour
+	// uploadIdleTimeout ends a PATCH that sends nothing for this long, so
+	// a connection that dropped silently does not hold the upload
+	uploadIdleTimeout = time.Minute
+	// uploadClaimTTL bounds the claim of one PATCH, so that of a replica
+	// that stopped expires; a longer PATCH ends for the client to resume
+	uploadClaimTTL = 15 * time.Minute
+	// uploadCutWait is how long a request waits for the one writing to
+	// the upload on another replica to stop
+	uploadCutWait = 5 * time.Second
+	// uploadCutCheck is how often a PATCH checks whether another replica
+	// asked it to stop
+	uploadCutCheck = time.Second
+)
+
+// uploadFields are the Upload-Metadata keys passed on to the job, as the
+// fields of /jobs/transcribe
+var uploadFields = []string{"pipeline", "title", "language", "languages", "enhance"}
+
+// errUploadCut ends a PATCH when the client has resumed the upload with
+// another one
+var errUploadCut = errors.New("upload resumed by another request")
+
+// errUploadBusy refuses a request while another replica writes to the
+// upload, and errUploadClaimExpired ends a PATCH that outlasted its claim
+var (
+	errUploadBusy         = errors.New("upload being written by another request")
+	errUploadClaimExpired = errors.New("upload claim expired")
+)
+
+// Upload is a resumable upload. The bytes received so far are in the file
+// at path, whose size is the offset.
+type Upload struct {
+	ID     string `json:"id"`
+	Length int64  `json:"length"`
+	// Format is the audio format, sniffed from the first bytes received
+	Format   string            `json:"format,omitempty"`
+	Filename string            `json:"filename,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	// Tenant, Workspace and CreatedBy are those of the principal that
+	// created the upload, the only one that may continue it
+	Tenant    string `json:"tenant,omitempty"`
+	Workspace string `json:"workspace,omitempty"`
+	CreatedBy string `json:"created_by,omitempty"`
+	Region    string `json:"region,omitempty"`
+	// JobID is the job started once the upload completed
+	JobID     string    `json:"job_id,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// path is the file holding the bytes received
+func (u *Upload) path() (string, error) {
+	dir, err := ingestDir(u.Region)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tus-"+u.ID), nil
+}
+
+// owner is the principal that created the upload
+func (u *Upload) owner() principal {
+	return principal{ID: u.CreatedBy, Tenant: u.Tenant, Workspace: u.Workspace}
+}
+
+// offset is the number of bytes received
+func (u *Upload) offset() (int64, error) {
+	if u.JobID != "" {
+		return u.Length, nil
+	}
+	path, err := u.path()
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// saveUpload records an upload until it expires
+func saveUpload(u *Upload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return state.set(uploadKeyPrefix+u.ID, data, time.Until(u.ExpiresAt))
+}
+
+// loadUpload returns the upload id when caller created it
+func loadUpload(caller principal, id string) (*Upload, bool) {
+	data, ok, err := state.get(uploadKeyPrefix + id)
+	if err != nil {
+		logErrorf(context.Background(), "Error loading upload %s: %v", id, err)
+		return nil, false
+	}
+	var u Upload
+	if !ok || json.Unmarshal(data, &u) != nil || u.CreatedBy != caller.ID || u.Tenant != caller.Tenant || u.Workspace != caller.Workspace {
+		return nil, false
+	}
+	return &u, true
+}
+
+// removeUpload forgets an upload and the bytes received
+func removeUpload(u *Upload) {
+	if err := state.delete(uploadKeyPrefix + u.ID); err != nil {
+		logErrorf(context.Background(), "Error removing upload %s: %v", u.ID, err)
+	}
+	if u.JobID != "" {
+		return
+	}
+	if path, err := u.path(); err == nil {
+		os.Remove(path)
+	}
+}
+
+// parseUploadMetadata decodes Upload-Metadata: comma-separated keys, each
+// followed by a space and its value in base64 unless it is empty
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if key == "" || err != nil {
+			return nil, errors.New("Upload-Metadata must be comma-separated keys with base64 values")
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// tusVersionSupported answers 412 to requests for another version of the
+// tus protocol
+func tusVersionSupported(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") == tusVersion {
+		return true
+	}
+	w.Header().Set("Tus-Version", tusVersion)
+	http.Error(w, "Tus-Resumable must be "+tusVersion, http.StatusPreconditionFailed)
+	return false
+}
+
+// setUploadHeaders reports the state of an upload
+func setUploadHeaders(w http.ResponseWriter, u *Upload, offset int64) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.Format(http.TimeFormat))
+	if u.JobID != "" {
+		w.Header().Set("X-Job-ID", u.JobID)
+	}
+}
+
+// uploadPatch is a request writing to an upload. On this replica it is the
+// one in uploadPatches; across replicas it holds the upload's claim in the
+// state store.
+type uploadPatch struct {
+	id   string
+	rc   *http.ResponseController
+	cut  atomic.Bool
+	done chan struct{}
+	// claimed is set once the claim is held; expired once the claim is
+	// about to expire
+	claimed bool
+	expired atomic.Bool
+}
+
+// uploadPatches are the requests writing to uploads on this replica, by
+// upload ID
+var uploadPatches = struct {
+	sync.Mutex
+	byID map[string]*uploadPatch
+}{byID: make(map[string]*uploadPatch)}
+
+// takeUpload makes the request of w the only one writing to upload id. A
+// client resuming after an interruption may be back before the server has
+// noticed the old connection is gone, so the earlier request is cut off:
+// at once on this replica, and on another one by asking it to stop and
+// waiting up to uploadCutWait for its claim, before giving up with
+// errUploadBusy.
+func takeUpload(id string, w http.ResponseWriter) (*uploadPatch, error) {
+	p := &uploadPatch{id: id, rc: http.NewResponseController(w), done: make(chan struct{})}
+	for {
+		uploadPatches.Lock()
+		earlier, ok := uploadPatches.byID[id]
+		if !ok {
+			uploadPatches.byID[id] = p
+			uploadPatches.Unlock()
+			break
+		}
+		// Cut while holding the lock, before the earlier request can
+		// return and its connection serve another one
+		earlier.cut.Store(true)
+		earlier.rc.SetReadDeadline(time.Now())
+		uploadPatches.Unlock()
+		<-earlier.done
+	}
+
+	giveUp := time.Now().Add(uploadCutWait)
+	for {
+		n, err := state.incrBy(uploadClaimPrefix+id, 1, uploadClaimTTL)
+		if err != nil {
+			p.release()
+			return nil, err
+		}
+		if n == 1 {
+			p.claimed = true
+			go p.watch(time.Now().Add(uploadClaimTTL))
+			if err := state.delete(uploadCutPrefix + id); err != nil {
+				logErrorf(context.Background(), "Error clearing cut of upload %s: %v", id, err)
+			}
+			return p, nil
+		}
+		if time.Now().After(giveUp) {
+			p.release()
+			return nil, errUploadBusy
+		}
+		if err := state.set(uploadCutPrefix+id, []byte{1}, uploadCutWait); err != nil {
+			p.release()
+			return nil, err
+		}
+		time.Sleep(uploadCutWait / 20)
+	}
+}
+
+// release lets the next request write to the upload
+func (p *uploadPatch) release() {
+	if p.claimed {
+		if err := state.delete(uploadClaimPrefix + p.id); err != nil {
+			logErrorf(context.Background(), "Error releasing upload %s: %v", p.id, err)
+		}
+	}
+	uploadPatches.Lock()
+	if uploadPatches.byID[p.id] == p {
+		delete(uploadPatches.byID, p.id)
+	}
+	uploadPatches.Unlock()
+	p.rc.SetReadDeadline(time.Time{})
+	close(p.done)
+}
+
+// watch cuts the request off when another replica asks it to stop, and
+// before it outlasts its claim, which expires at claimedUntil
+func (p *uploadPatch) watch(claimedUntil time.Time) {
+	ticker := time.NewTicker(uploadCutCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			// A read may wait uploadIdleTimeout, and must end while claimed
+			if now.Add(uploadIdleTimeout).After(claimedUntil) {
+				p.expired.Store(true)
+			} else if _, ok, err := state.get(uploadCutPrefix + p.id); err == nil && ok {
+				p.cut.Store(true)
+			} else {
+				continue
+			}
+			// As in takeUpload, under the lock and only while the request
+			// still writes to the upload
+			uploadPatches.Lock()
+			if uploadPatches.byID[p.id] == p {
+				p.rc.SetReadDeadline(now)
+			}
+			uploadPatches.Unlock()
+			return
+		}
+	}
+}
+
+// uploadReader reads a PATCH body until the request is cut off or nothing
+// arrives for uploadIdleTimeout
+type uploadReader struct {
+	patch *uploadPatch
+	body  io.Reader
+}
+
+func (r *uploadReader) Read(b []byte) (int, error) {
+	r.patch.rc.SetReadDeadline(time.Now().Add(uploadIdleTimeout))
+	// Checked after setting the deadline, which a cut then overrides
+	if r.patch.cut.Load() {
+		return 0, errUploadCut
+	}
+	if r.patch.expired.Load() {
+		return 0, errUploadClaimExpired
+	}
+	return r.body.Read(b)
+}
+
+// takeUploadOf checks that caller created upload id, makes the request
+// the only one writing to it, and returns the upload as that request
+// found it. It answers the request and returns false when it cannot.
+func takeUploadOf(w http.ResponseWriter, r *http.Request, caller principal) (*Upload, *uploadPatch, bool) {
+	id := r.PathValue("id")
+	// Only the owner may cut off a request writing to the upload
+	if _, ok := loadUpload(caller, id); !ok {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	patch, err := takeUpload(id, w)
+	if errors.Is(err, errUploadBusy) {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Upload is being written by another request, retry shortly", http.StatusLocked)
+		return nil, nil, false
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Upload %s: %v", id, err)
+		http.Error(w, "Error storing upload", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	// Reloaded, as the earlier request may have written to it since
+	u, ok := loadUpload(caller, id)
+	if !ok {
+		patch.release()
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	return u, patch, true
+}
+
+// handleUploadOptions describes the tus protocol supported
+func handleUploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUploadCreate creates a resumable upload of Upload-Length bytes,
+// with the job's fields in Upload-Metadata
+func handleUploadCreate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if !tusVersionSupported(w, r) {
+		return
+	}
+	caller, ok := browserPrincipal(w, r)
+	if !ok {
+		return
+	}
+	if refuseWhileShuttingDown(w, false) || refuseJobDuringMaintenance(w, false) || refuseWhenQueueFull(w, false) {
+		return
+	}
+	if refuseUnderDiskPressure(w, false) {
+		return
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Length is required: uploads of unknown length are not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		http.Error(w, "Upload-Length must be the size of the file in bytes", http.StatusBadRequest)
+		return
+	}
+	if length > maxUploadSize {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// tus clients name the file filename or name
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	fields := make(map[string]string)
+	for _, key := range uploadFields {
+		if value, ok := metadata[key]; ok {
+			fields[key] = value
+		}
+	}
+	req, err := jobRequest(caller, fields, filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, msg, ok := admitWorkspaceJob(w, caller.Workspace); !ok {
+		http.Error(w, msg, http.StatusTooManyRequests)
+		return
+	}
+
+	u := &Upload{
+		ID:        newID(),
+		Length:    length,
+		Filename:  filename,
+		Fields:    fields,
+		Tenant:    caller.Tenant,
+		Workspace: caller.Workspace,
+		CreatedBy: caller.ID,
+		Region:    req.Region,
+		ExpiresAt: time.Now().UTC().Add(uploadExpiry),
+	}
+	path, err := u.path()
+	if err != nil {
+		logErrorf(r.Context(), "Error creating upload of %s: %v", req.Filename, err)
+		http.Error(w, regionUnavailableMessage, http.StatusServiceUnavailable)
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o750)
+	if err == nil {
+		err = os.WriteFile(path, nil, 0o600)
+	}
+	if err == nil {
+		err = saveUpload(u)
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Error creating upload of %s: %v", req.Filename, err)
+		os.Remove(path)
+		http.Error(w, "Error creating upload", http.StatusInternalServerError)
+		return
+	}
+	logf(r.Context(), "Upload %s: created for %s (%d bytes)", u.ID, req.Filename, length)
+	w.Header().Set("Location", "/files/"+u.ID)
+	w.Header().Set("Upload-Expires", u.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleUploadHead reports how much of an upload has been received
+func handleUploadHead(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+	if !tusVersionSupported(w, r) {
+		return
+	}
+	caller, ok := browserPrincipal(w, r)
+	if !ok {
+		return
+	}
+	u, ok := loadUpload(caller, r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	offset, err := u.offset()
+	if err != nil {
+		logErrorf(r.Context(), "Upload %s: %v", u.ID, err)
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	setUploadHeaders(w, u, offset)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleUploadPatch appends the body to an upload at Upload-Offset, and
+// queues the job once the upload is complete
+func handleUploadPatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if !tusVersionSupported(w, r) {
+		return
+	}
+	caller, ok := browserPrincipal(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	start, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || start < 0 {
+		http.Error(w, "Upload-Offset must be the number of bytes already uploaded", http.StatusBadRequest)
+		return
+	}
+	if refuseWhileShuttingDown(w, false) {
+		return
+	}
+	if refuseUnderDiskPressure(w, false) {
+		return
+	}
+
+	u, patch, ok := takeUploadOf(w, r, caller)
+	if !ok {
+		return
+	}
+	defer patch.release()
+	offset, err := u.offset()
+	if err != nil {
+		logErrorf(r.Context(), "Upload %s: %v", u.ID, err)
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if start != offset {
+		http.Error(w, "Upload-Offset does not match the bytes received; ask for the offset with HEAD", http.StatusConflict)
+		return
+	}
+	remaining := u.Length - offset
+	if r.ContentLength > remaining {
+		http.Error(w, "The body goes past Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if remaining > 0 {
+		// offset found the file, so its region is configured
+		path, _ := u.path()
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			logErrorf(r.Context(), "Upload %s: %v", u.ID, err)
+			http.Error(w, "Error storing upload", http.StatusInternalServerError)
+			return
+		}
+		body := throttleUpload(r.Context(), http.MaxBytesReader(w, r.Body, remaining))
+		n, err := io.Copy(file, &uploadReader{patch: patch, body: body})
+		if cerr := file.Close(); cerr != nil {
+			logErrorf(r.Context(), "Upload %s: %v", u.ID, cerr)
+			os.Truncate(path, offset)
+			http.Error(w, "Error storing upload", http.StatusInternalServerError)
+			return
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			os.Truncate(path, offset)
+			http.Error(w, "The body goes past Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// What arrived before an interruption is kept for the client to
+		// resume from
+		if err != nil {
+			logWarnf(r.Context(), "Upload %s: interrupted at %d of %d bytes: %v", u.ID, offset+n, u.Length, err)
+		}
+		offset += n
+	}
+
+	if u.Format == "" && (offset >= audioSniffLen || offset == u.Length) {
+		if !sniffUpload(w, r, u) {
+			return
+		}
+	}
+	if offset == u.Length && u.JobID == "" {
+		if !completeUpload(w, r, u) {
+			return
+		}
+	}
+	setUploadHeaders(w, u, offset)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sniffUpload records the format of an upload from its first bytes, and
+// removes the upload when it is not audio the server can read
+func sniffUpload(w http.ResponseWriter, r *http.Request, u *Upload) bool {
+	var file *os.File
+	path, err := u.path()
+	if err == nil {
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Upload %s: %v", u.ID, err)
+		http.Error(w, "Error storing upload", http.StatusInternalServerError)
+		return false
+	}
+	header := make([]byte, audioSniffLen)
+	n, _ := io.ReadFull(file, header)
+	file.Close()
+	u.Format = sniffAudio(header[:n])
+	switch {
+	case u.Format == "":
+		removeUpload(u)
+		http.Error(w, "Unsupported audio format: upload WAV, MP3, M4A, FLAC, OGG or WebM", http.StatusBadRequest)
+		return false
+	case u.Format != audioWAV && !canConvertAudio():
+		removeUpload(u)
+		http.Error(w, "Only WAV files are supported: converting other formats requires ffmpeg on the server", http.StatusUnsupportedMediaType)
+		return false
+	}
+	if err := saveUpload(u); err != nil {
+		logErrorf(r.Context(), "Upload %s: %v", u.ID, err)
+		http.Error(w, "Error storing upload", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// completeUpload queues the job of a complete upload
+func completeUpload(w http.ResponseWriter, r *http.Request, u *Upload) bool {
+	req, err := jobRequest(u.owner(), u.Fields, u.Filename)
+	if err != nil {
+		// The pipeline was removed while the file was uploaded
+		removeUpload(u)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	// Named after its format, as receiveAudio names uploads
+	path, err := u.path()
+	recording := path + "." + u.Format
+	if err == nil {
+		err = os.Rename(path, recording)
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Upload %s: %v", u.ID, err)
+		http.Error(w, "Error storing upload", http.StatusInternalServerError)
+		return false
+	}
+	req.Recording = recording
+	job := startPipeline(r.Context(), req)
+	u.JobID = job.ID
+	if err := saveUpload(u); err != nil {
+		logErrorf(r.Context(), "Upload %s: error recording job %s: %v", u.ID, job.ID, err)
+	}
+	logf(r.Context(), "Job %s: queued resumable upload %s", job.ID, req.Filename)
+	return true
+}
+
+// handleUploadDelete ends an upload and discards the bytes received
+func handleUploadDelete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if !tusVersionSupported(w, r) {
+		return
+	}
+	caller, ok := browserPrincipal(w, r)
+	if !ok {
+		return
+	}
+	u, patch, ok := takeUploadOf(w, r, caller)
+	if !ok {
+		return
+	}
+	defer patch.release()
+	removeUpload(u)
+	logf(r.Context(), "Upload %s: terminated", u.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
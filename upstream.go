@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TranscriptionResult is the normalized transcription returned to clients,
+// independent of the exact JSON dialect spoken by the Whisper backend
+type TranscriptionResult struct {
+	Text     string    `json:"text"`
+	Language string    `json:"language,omitempty"`
+	Duration float64   `json:"duration,omitempty"`
+	Segments []Segment `json:"segments,omitempty"`
+	// Confidence rates the transcript from 0 to 1, from the backend's
+	// segment log probabilities or its language detection; 0 when the
+	// backend reports neither
+	Confidence float64 `json:"confidence,omitempty"`
+	// LanguageHint is the language of a list of languages the transcript
+	// was made with, and LanguagesTried the ones tried in order
+	LanguageHint   string   `json:"language_hint,omitempty"`
+	LanguagesTried []string `json:"languages_tried,omitempty"`
+	Timing         *Timing  `json:"timing,omitempty"`
+	// SpokenLanguages lists the languages of a transcript that switches
+	// between them, most spoken first
+	SpokenLanguages []string `json:"spoken_languages,omitempty"`
+	// AudioQuality is the assessment of the recording
+	AudioQuality *AudioQuality `json:"audio_quality,omitempty"`
+	// QuotaWarnings are set when the caller's workspace nearly used up
+	// a quota
+	QuotaWarnings []QuotaWarning `json:"quota_warnings,omitempty"`
+	// Gaps are the stretches of a chunked recording that could not be
+	// transcribed
+	Gaps []TranscriptGap `json:"gaps,omitempty"`
+}
+
+// Segment is a timestamped piece of a transcription
+type Segment struct {
+	ID    int     `json:"id"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+	// Speaker is set by backends that identify speakers (diarization)
+	Speaker string `json:"speaker,omitempty"`
+	// Language is the code of the language spoken in the segment
+	Language string `json:"language,omitempty"`
+}
+
+// SummaryResult is the normalized summarization returned to clients
+type SummaryResult struct {
+	Summary string  `json:"summary"`
+	Model   string  `json:"model,omitempty"`
+	Timing  *Timing `json:"timing,omitempty"`
+	// QuotaWarnings are set when the caller's workspace nearly used up
+	// a quota
+	QuotaWarnings []QuotaWarning `json:"quota_warnings,omitempty"`
+	// Truncation is set when the text was too long to summarize in full
+	Truncation *Truncation `json:"truncation,omitempty"`
+	// Range is set when only part of a transcript was summarized
+	Range *TranscriptRange `json:"range,omitempty"`
+}
+
+// UpstreamError describes an unusable response from an inference backend
+// in terms an operator can act on
+type UpstreamError struct {
+	Service string
+	Message string
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("%s backend returned an unexpected response: %s", e.Service, e.Message)
+}
+
+// parseTranscriptionResponse extracts a transcription from a Whisper-style
+// response body. Field names are matched case-insensitively, plain-text
+// bodies are accepted as-is and a missing "text" is rebuilt from segments.
+func parseTranscriptionResponse(contentType string, body []byte) (*TranscriptionResult, error) {
+	trimmed := strings.TrimSpace(string(body))
+	if trimmed == "" {
+		return nil, &UpstreamError{Service: "transcription", Message: "empty body, expected a JSON object with a \"text\" field"}
+	}
+
+	// Backends asked for response_format=text (or misconfigured ones) answer with bare text
+	if !strings.HasPrefix(trimmed, "{") {
+		if strings.Contains(contentType, "json") || strings.HasPrefix(trimmed, "[") {
+			return nil, &UpstreamError{Service: "transcription", Message: fmt.Sprintf("%s, expected a JSON object with a \"text\" field", describeBody(trimmed))}
+		}
+		return &TranscriptionResult{Text: trimmed}, nil
+	}
+
+	var obj map[string]any
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, &UpstreamError{Service: "transcription", Message: fmt.Sprintf("invalid JSON (%v)", err)}
+	}
+
+	// Some servers wrap the payload in a "result" or "data" envelope
+	if inner, ok := lookupObject(obj, "result", "data"); ok && !hasField(obj, "text", "segments") {
+		obj = inner
+	}
+
+	result := &TranscriptionResult{}
+	result.Language, _ = lookupString(obj, "language", "lang", "detected_language")
+	result.Duration, _ = lookupFloat(obj, "duration", "audio_duration")
+
+	// verbose_json rates each segment with its average log probability;
+	// the transcript's confidence is their mean weighted by duration
+	var logprobSum, logprobWeight float64
+	if raw, ok := lookupField(obj, "segments", "chunks"); ok {
+		items, ok := raw.([]any)
+		if !ok {
+			return nil, &UpstreamError{Service: "transcription", Message: fmt.Sprintf("field \"segments\" is %s, expected an array", describeValue(raw))}
+		}
+		for i, item := range items {
+			seg, ok := item.(map[string]any)
+			if !ok {
+				return nil, &UpstreamError{Service: "transcription", Message: fmt.Sprintf("segments[%d] is %s, expected an object", i, describeValue(item))}
+			}
+			text, ok := lookupString(seg, "text")
+			if !ok {
+				return nil, &UpstreamError{Service: "transcription", Message: fmt.Sprintf("segments[%d] has fields [%s], expected field \"text\"", i, fieldNames(seg))}
+			}
+			id, ok := lookupFloat(seg, "id")
+			if !ok {
+				id = float64(i)
+			}
+			start, _ := lookupFloat(seg, "start", "start_time")
+			end, _ := lookupFloat(seg, "end", "end_time")
+			speaker, _ := lookupString(seg, "speaker", "speaker_label")
+			language, _ := lookupString(seg, "language", "lang")
+			if logprob, ok := lookupFloat(seg, "avg_logprob"); ok {
+				weight := max(end-start, 0.01)
+				logprobSum += logprob * weight
+				logprobWeight += weight
+			}
+			result.Segments = append(result.Segments, Segment{ID: int(id), Start: start, End: end, Text: text, Speaker: strings.TrimSpace(speaker), Language: language})
+		}
+	}
+
+	text, ok := lookupString(obj, "text", "transcript", "transcription")
+	if !ok {
+		if len(result.Segments) == 0 {
+			return nil, &UpstreamError{Service: "transcription", Message: fmt.Sprintf("object with fields [%s], expected field \"text\" or \"segments\"", fieldNames(obj))}
+		}
+		parts := make([]string, 0, len(result.Segments))
+		for _, seg := range result.Segments {
+			parts = append(parts, strings.TrimSpace(seg.Text))
+		}
+		text = strings.Join(parts, " ")
+	}
+	result.Text = strings.TrimSpace(text)
+
+	if result.Duration == 0 && len(result.Segments) > 0 {
+		result.Duration = result.Segments[len(result.Segments)-1].End
+	}
+	if logprobWeight > 0 {
+		result.Confidence = math.Round(math.Exp(logprobSum/logprobWeight)*1000) / 1000
+	} else if p, ok := lookupFloat(obj, "language_probability"); ok && p > 0 && p <= 1 {
+		result.Confidence = p
+	}
+	tagSegmentLanguages(result)
+	formatParagraphs(result)
+
+	return result, nil
+}
+
+// parseChatCompletionResponse extracts the generated text from an
+// OpenAI-compatible chat completion, also accepting the Ollama/Harmony
+// "response" and "message" shapes and bare "text" fallbacks.
+func parseChatCompletionResponse(body []byte) (*SummaryResult, error) {
+	var obj map[string]any
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, &UpstreamError{Service: "LLM", Message: fmt.Sprintf("%s, expected a JSON chat completion object", describeBody(strings.TrimSpace(string(body))))}
+	}
+
+	result := &SummaryResult{}
+	result.Model, _ = lookupString(obj, "model")
+
+	if raw, ok := lookupField(obj, "choices"); ok {
+		choices, ok := raw.([]any)
+		if !ok || len(choices) == 0 {
+			return nil, &UpstreamError{Service: "LLM", Message: fmt.Sprintf("field \"choices\" is %s, expected a non-empty array", describeValue(raw))}
+		}
+		choice, ok := choices[0].(map[string]any)
+		if !ok {
+			return nil, &UpstreamError{Service: "LLM", Message: fmt.Sprintf("choices[0] is %s, expected an object", describeValue(choices[0]))}
+		}
+		if msg, ok := lookupObject(choice, "message", "delta"); ok {
+			if content, ok := lookupString(msg, "content"); ok {
+				result.Summary = strings.TrimSpace(content)
+				return result, nil
+			}
+			return nil, &UpstreamError{Service: "LLM", Message: fmt.Sprintf("choices[0].message has fields [%s], expected field \"content\"", fieldNames(msg))}
+		}
+		if text, ok := lookupString(choice, "text"); ok {
+			result.Summary = strings.TrimSpace(text)
+			return result, nil
+		}
+		return nil, &UpstreamError{Service: "LLM", Message: fmt.Sprintf("choices[0] has fields [%s], expected field \"message.content\" or \"text\"", fieldNames(choice))}
+	}
+
+	if msg, ok := lookupObject(obj, "message"); ok {
+		if content, ok := lookupString(msg, "content"); ok {
+			result.Summary = strings.TrimSpace(content)
+			return result, nil
+		}
+	}
+	if text, ok := lookupString(obj, "response", "text", "output", "content"); ok {
+		result.Summary = strings.TrimSpace(text)
+		return result, nil
+	}
+
+	if errObj, ok := lookupField(obj, "error"); ok {
+		return nil, &UpstreamError{Service: "LLM", Message: fmt.Sprintf("error object %s instead of a completion", describeValue(errObj))}
+	}
+	return nil, &UpstreamError{Service: "LLM", Message: fmt.Sprintf("object with fields [%s], expected field \"choices\"", fieldNames(obj))}
+}
+
+// normalizeKey folds case and drops separators so "Text", "TEXT" and
+// "start_time"/"startTime" compare equal
+func normalizeKey(key string) string {
+	key = strings.ToLower(key)
+	key = strings.ReplaceAll(key, "_", "")
+	return strings.ReplaceAll(key, "-", "")
+}
+
+// lookupField returns the first value found under any of names
+func lookupField(obj map[string]any, names ...string) (any, bool) {
+	for _, name := range names {
+		if v, ok := obj[name]; ok && v != nil {
+			return v, true
+		}
+	}
+	for _, name := range names {
+		want := normalizeKey(name)
+		for key, v := range obj {
+			if normalizeKey(key) == want && v != nil {
+				return v, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func hasField(obj map[string]any, names ...string) bool {
+	_, ok := lookupField(obj, names...)
+	return ok
+}
+
+func lookupString(obj map[string]any, names ...string) (string, bool) {
+	v, ok := lookupField(obj, names...)
+	if !ok {
+		return "", false
+	}
+	s, ok := v.(string)
+	return s, ok
+}
+
+// lookupFloat accepts both JSON numbers and numeric strings
+func lookupFloat(obj map[string]any, names ...string) (float64, bool) {
+	v, ok := lookupField(obj, names...)
+	if !ok {
+		return 0, false
+	}
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func lookupObject(obj map[string]any, names ...string) (map[string]any, bool) {
+	v, ok := lookupField(obj, names...)
+	if !ok {
+		return nil, false
+	}
+	m, ok := v.(map[string]any)
+	return m, ok
+}
+
+func fieldNames(obj map[string]any) string {
+	names := make([]string, 0, len(obj))
+	for key := range obj {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func describeValue(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []any:
+		return fmt.Sprintf("an array of %d items", len(t))
+	case map[string]any:
+		return fmt.Sprintf("an object with fields [%s]", fieldNames(t))
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// backendErrorMessage tells the client what a backend answering status
+// means for them. The backend's body is only logged, and its status is
+// never answered as the server's own.
+func backendErrorMessage(backend string, status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return fmt.Sprintf("The %s backend refused the server's credentials (status %d); ask the administrator to check its API key", backend, status)
+	case status == http.StatusNotFound:
+		return fmt.Sprintf("The %s backend does not serve the configured model or path (status %d); ask the administrator to check its URL and model name", backend, status)
+	case status == http.StatusRequestEntityTooLarge:
+		return fmt.Sprintf("The %s backend refused the request as too large (status %d); send a shorter recording or text", backend, status)
+	case status == http.StatusTooManyRequests || status >= 500:
+		return fmt.Sprintf("The %s backend is unavailable or overloaded (status %d); please retry later", backend, status)
+	}
+	return fmt.Sprintf("The %s backend rejected the request (status %d)", backend, status)
+}
+
+// describeBody summarizes a non-JSON body for error messages without
+// echoing arbitrarily large payloads back to the client
+func describeBody(body string) string {
+	const maxPreview = 120
+	if len(body) > maxPreview {
+		body = body[:maxPreview] + "..."
+	}
+	return fmt.Sprintf("%q", body)
+}
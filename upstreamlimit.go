@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Speech-to-text and LLM backends have different capacity, so each gets its
+// own cap on concurrent requests per backend host: AUDIO_MAX_CONCURRENCY and
+// LLM_MAX_CONCURRENCY. Requests over the cap wait in a queue for up to
+// UPSTREAM_QUEUE_TIMEOUT instead of reaching a backend that would answer
+// 429. A 429 that still comes back, for example from a backend shared with
+// other clients, is retried after its Retry-After when the request body can
+// be sent again.
+//
+// Requests from the web UI session are interactive: someone is waiting for
+// them. Presenting no API key is not enough, as scripts do too; the request
+// must carry the browser's session cookie and come from the app's page. They go ahead of queued API and background requests, and a share of
+// each backend's slots, INTERACTIVE_RESERVED_SHARE, is kept for them, so
+// bulk integrations cannot make the UI feel broken.
+
+// errUpstreamBusy is returned when a request waited too long for a slot
+var errUpstreamBusy = errors.New("backend is at its concurrency limit")
+
+// upstreamRetries is how many times a 429 answer is retried
+const upstreamRetries = 3
+
+// maxUpstreamRetryAfter bounds the wait before retrying a 429
+const maxUpstreamRetryAfter = 30 * time.Second
+
+var (
+	upstreamInFlight       = expvar.NewMap("upstream_in_flight")
+	upstreamQueued         = expvar.NewMap("upstream_queued_requests")
+	upstreamRejected       = expvar.NewInt("upstream_rejected_requests_total")
+	upstreamThrottledTotal = expvar.NewInt("upstream_throttled_total")
+)
+
+type interactiveContextKey struct{}
+
+// markInteractive tags the requests of web UI sessions as interactive: the
+// caller is the browser session the request presents, rather than an API
+// key or a session made for this request, and the page of the app sent it
+func markInteractive(r *http.Request, caller principal) *http.Request {
+	if caller.ID == "" || caller.ID != browserSession(r) || !sameOriginRequest(r) {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), interactiveContextKey{}, true))
+}
+
+// isInteractive reports whether ctx belongs to a web UI session request
+func isInteractive(ctx context.Context) bool {
+	interactive, _ := ctx.Value(interactiveContextKey{}).(bool)
+	return interactive
+}
+
+// reservedSlots is how many of limit slots are kept for interactive
+// requests; at least one slot stays available to the others
+func reservedSlots(limit int, share float64) int {
+	if limit <= 1 || share <= 0 {
+		return 0
+	}
+	return min(int(math.Ceil(float64(limit)*share)), limit-1)
+}
+
+// hostLimit counts the requests in flight to one backend host and queues
+// the others, interactive ones first
+type hostLimit struct {
+	mu      sync.Mutex
+	inUse   int
+	waiting [2][]chan struct{}
+}
+
+// Queues of hostLimit.waiting, in the order slots are granted
+const (
+	laneInteractive = 0
+	laneBulk        = 1
+)
+
+// grant hands free slots to queued requests; callers hold mu. A limit of 0,
+// set at runtime, lets every queued request through.
+func (h *hostLimit) grant(limit, reserved int) {
+	unlimited := limit <= 0
+	for {
+		switch {
+		case len(h.waiting[laneInteractive]) > 0 && (unlimited || h.inUse < limit):
+			close(h.waiting[laneInteractive][0])
+			h.waiting[laneInteractive] = h.waiting[laneInteractive][1:]
+		case len(h.waiting[laneBulk]) > 0 && (unlimited || h.inUse < limit-reserved):
+			close(h.waiting[laneBulk][0])
+			h.waiting[laneBulk] = h.waiting[laneBulk][1:]
+		default:
+			return
+		}
+		h.inUse++
+	}
+}
+
+// release frees a slot
+func (h *hostLimit) release(limit, reserved int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.inUse--
+	h.grant(limit, reserved)
+}
+
+// limitedTransport caps the concurrent requests to each backend host. A
+// slot is held until the response body is closed, so streamed answers count
+// until they end. The cap can be changed at runtime with setLimit.
+type limitedTransport struct {
+	kind         string
+	queueTimeout time.Duration
+	next         http.RoundTripper
+
+	mu       sync.Mutex
+	limit    int
+	reserved int
+	hosts    map[string]*hostLimit
+}
+
+// limits returns the cap and the slots reserved for interactive requests
+func (t *limitedTransport) limits() (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limit, t.reserved
+}
+
+// setLimit changes the cap. Queued requests get the slots a higher cap
+// frees; with a lower one, requests in flight finish and new ones wait.
+func (t *limitedTransport) setLimit(limit, reserved int) {
+	t.mu.Lock()
+	t.limit, t.reserved = limit, reserved
+	hosts := make([]*hostLimit, 0, len(t.hosts))
+	for _, h := range t.hosts {
+		hosts = append(hosts, h)
+	}
+	t.mu.Unlock()
+	for _, h := range hosts {
+		h.mu.Lock()
+		h.grant(limit, reserved)
+		h.mu.Unlock()
+	}
+}
+
+// hostLimit returns the counter of a backend host
+func (t *limitedTransport) hostLimit(host string) *hostLimit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.hosts == nil {
+		t.hosts = make(map[string]*hostLimit)
+	}
+	h, ok := t.hosts[host]
+	if !ok {
+		h = &hostLimit{}
+		t.hosts[host] = h
+	}
+	return h
+}
+
+// acquire waits for a slot of host h
+func (t *limitedTransport) acquire(ctx context.Context, h *hostLimit, key string) error {
+	total, reserved := t.limits()
+	lane, limit := laneBulk, total-reserved
+	if isInteractive(ctx) {
+		lane, limit = laneInteractive, total
+	}
+	h.mu.Lock()
+	// Queued requests of the same or a higher lane go first
+	queued := len(h.waiting[laneInteractive])
+	if lane == laneBulk {
+		queued += len(h.waiting[laneBulk])
+	}
+	if total <= 0 || queued == 0 && h.inUse < limit {
+		h.inUse++
+		h.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	h.waiting[lane] = append(h.waiting[lane], ready)
+	h.mu.Unlock()
+
+	upstreamQueued.Add(key, 1)
+	defer upstreamQueued.Add(key, -1)
+	defer stageTimerFrom(ctx).since(stageQueue, time.Now())
+	timer := time.NewTimer(t.queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = errUpstreamBusy
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, c := range h.waiting[lane] {
+		if c == ready {
+			h.waiting[lane] = append(h.waiting[lane][:i], h.waiting[lane][i+1:]...)
+			return err
+		}
+	}
+	// The slot was granted while giving up; pass it on
+	h.inUse--
+	h.grant(t.limits())
+	return err
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := t.kind + " " + req.URL.Host
+	var h *hostLimit
+	if limit, _ := t.limits(); limit > 0 {
+		h = t.hostLimit(req.URL.Host)
+		if err := t.acquire(req.Context(), h, key); err != nil {
+			if err == errUpstreamBusy {
+				upstreamRejected.Add(1)
+				logf(req.Context(), "Request to %s backend %s rejected: no slot within %s", t.kind, req.URL.Host, t.queueTimeout)
+			}
+			return nil, err
+		}
+	}
+
+	// Requests in flight are counted without a limit as well, for draining
+	upstreamInFlight.Add(key, 1)
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			upstreamInFlight.Add(key, -1)
+			if h != nil {
+				h.release(t.limits())
+			}
+		})
+	}
+	resp, err := t.send(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// send forwards req, retrying 429 answers when the body can be replayed
+func (t *limitedTransport) send(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt == upstreamRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		wait := time.Second << attempt
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		wait = min(wait, maxUpstreamRetryAfter)
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		upstreamThrottledTotal.Add(1)
+		logf(req.Context(), "Upstream %s backend %s answered 429, retrying in %s", t.kind, req.URL.Host, wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = retry
+	}
+}
+
+// releasingBody frees a backend slot when the response is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// concurrencyLimit describes a limit for the logs
+func concurrencyLimit(n, reserved int) string {
+	if n <= 0 {
+		return "unlimited"
+	}
+	if reserved > 0 {
+		return fmt.Sprintf("%d (%d reserved for the web UI)", n, reserved)
+	}
+	return strconv.Itoa(n)
+}
+
+// upstreamBusy answers 503 when a backend stayed at its concurrency limit
+func upstreamBusy(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, errUpstreamBusy) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(config.UpstreamQueueTimeout.Seconds())))
+	http.Error(w, "Server is busy, please retry later", http.StatusServiceUnavailable)
+	return true
+}
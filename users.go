@@ -0,0 +1,505 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Jobs started with a user_id belong to that user (the data subject). Their
+// job records, audit trail and, while under legal hold, their audio can be
+// exported or erased for a given user.
+
+// Audit-only event types, recorded in a user's trail but not published
+const (
+	EventLegalHoldPlaced   = "legal_hold.placed"
+	EventLegalHoldReleased = "legal_hold.released"
+	EventUserExported      = "user.exported"
+	EventTranscriptDeleted = "transcript.deleted"
+)
+
+// LegalHold exempts a user's data from retention deletion until the hold
+// is removed. Its ID is the user ID.
+type LegalHold struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+	// Reference identifies the matter, e.g. a case number
+	Reference string `json:"reference,omitempty"`
+}
+
+func (h *LegalHold) validate() error {
+	return nil
+}
+
+func (h *LegalHold) redacted() adminResource {
+	c := *h
+	return &c
+}
+
+// underLegalHold reports whether a user's data must be kept
+func underLegalHold(user string) bool {
+	if user == "" {
+		return false
+	}
+	_, ok := registry.get(kindLegalHolds, user)
+	return ok
+}
+
+// legalHoldDir holds audio of users under legal hold, per user, inside each
+// storage directory
+const legalHoldDir = "legal-hold"
+
+// heldAudioPath is where a held job's audio is kept
+func heldAudioPath(job Job) (string, error) {
+	dir, err := regionStorageDir(job.Region)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, legalHoldDir, job.UserID, job.ID+".wav"), nil
+}
+
+// releaseAudio removes fetched audio once its job is done, unless the user
+// is under legal hold, in which case it is moved aside and kept
+func releaseAudio(jobID string, req PipelineRequest, path string) {
+	if !underLegalHold(req.UserID) {
+		os.Remove(path)
+		return
+	}
+	held, err := heldAudioPath(Job{ID: jobID, Region: req.Region, UserID: req.UserID})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(held), 0o750)
+	}
+	if err == nil {
+		err = os.Rename(path, held)
+	}
+	if err != nil {
+		// Leave the file in place rather than lose held data
+		logErrorf(context.Background(), "Job %s: error keeping audio under legal hold: %v", jobID, err)
+	}
+}
+
+// auditKeyPrefix namespaces users' audit trails in the state store
+const auditKeyPrefix = "audit:"
+
+// auditRetention is how long a user's audit entries are kept from now
+func auditRetention(user string) time.Duration {
+	if underLegalHold(user) {
+		return 0
+	}
+	return pipelineJobs.retention
+}
+
+// recordAudit appends an event to a user's audit trail
+func recordAudit(user string, event CloudEvent) {
+	if user == "" {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		logErrorf(context.Background(), "Error encoding audit event for user %s: %v", user, err)
+		return
+	}
+	key := fmt.Sprintf("%s%s/%020d-%s", auditKeyPrefix, user, event.Time.UnixNano(), event.ID)
+	if err := state.set(key, data, auditRetention(user)); err != nil {
+		logErrorf(context.Background(), "Error recording audit event for user %s: %v", user, err)
+	}
+}
+
+// auditKeys lists the keys of a user's audit trail, oldest first
+func auditKeys(user string) ([]string, error) {
+	keys, err := state.keys(auditKeyPrefix + user + "/")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// auditTrail returns a user's audit events, oldest first
+func auditTrail(user string) ([]json.RawMessage, error) {
+	keys, err := auditKeys(user)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]json.RawMessage, 0, len(keys))
+	for _, key := range keys {
+		data, ok, err := state.get(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			events = append(events, data)
+		}
+	}
+	return events, nil
+}
+
+// applyRetention rewrites a user's job records and audit trail so their
+// expiry follows the current legal hold status. When a hold is released
+// the normal retention period starts again.
+func applyRetention(user string) error {
+	jobs, err := pipelineJobs.userJobs(user)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		pipelineJobs.retain(job.ID)
+	}
+	keys, err := auditKeys(user)
+	if err != nil {
+		return err
+	}
+	ttl := auditRetention(user)
+	for _, key := range keys {
+		data, ok, err := state.get(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := state.set(key, data, ttl); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// storageDirs lists the default and every region's storage directory
+func storageDirs() []string {
+	dirs := []string{config.StorageDir}
+	for _, region := range regions() {
+		dirs = append(dirs, region.StorageDir)
+	}
+	return dirs
+}
+
+// placeLegalHold exempts a user's existing data from retention
+func placeLegalHold(hold *LegalHold, created bool) {
+	if created {
+		recordAudit(hold.ID, newCloudEvent(EventLegalHoldPlaced, hold.ID, map[string]any{"reason": hold.Reason, "reference": hold.Reference}))
+	}
+	if err := applyRetention(hold.ID); err != nil {
+		logErrorf(context.Background(), "Error applying legal hold for user %s: %v", hold.ID, err)
+	}
+}
+
+// releaseLegalHold returns a user's data to normal retention. Held audio,
+// which would otherwise have been deleted after processing, is removed.
+func releaseLegalHold(user string) {
+	recordAudit(user, newCloudEvent(EventLegalHoldReleased, user, nil))
+	if err := applyRetention(user); err != nil {
+		logErrorf(context.Background(), "Error releasing legal hold for user %s: %v", user, err)
+	}
+	for _, dir := range storageDirs() {
+		if err := os.RemoveAll(filepath.Join(dir, legalHoldDir, user)); err != nil {
+			logErrorf(context.Background(), "Error removing held audio of user %s: %v", user, err)
+		}
+	}
+}
+
+// exportFile describes one file of an export bundle
+type exportFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// exportManifest is the last entry of an export bundle. Recipients verify
+// the bundle by checking every file against it, and the manifest itself
+// against the digest sent in the X-Manifest-SHA256 trailer and recorded in
+// the user's audit trail.
+type exportManifest struct {
+	UserID      string       `json:"user_id"`
+	GeneratedAt time.Time    `json:"generated_at"`
+	LegalHold   *LegalHold   `json:"legal_hold,omitempty"`
+	Files       []exportFile `json:"files"`
+}
+
+// exportWriter adds files to a zip archive, recording their checksums
+type exportWriter struct {
+	zip   *zip.Writer
+	files []exportFile
+}
+
+func (e *exportWriter) add(path string, src io.Reader) error {
+	w, err := e.zip.Create(path)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, hash), src)
+	if err != nil {
+		return err
+	}
+	e.files = append(e.files, exportFile{Path: path, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))})
+	return nil
+}
+
+// handleUserExport streams a zip bundle of a user's job records, held audio
+// and audit trail
+func handleUserExport(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !externalIDPattern.MatchString(user) {
+		integrationError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	jobs, err := pipelineJobs.userJobs(user)
+	if err != nil {
+		logErrorf(r.Context(), "Error listing jobs of user %s: %v", user, err)
+		integrationError(w, http.StatusInternalServerError, "Error reading user data")
+		return
+	}
+	events, err := auditTrail(user)
+	if err != nil {
+		logErrorf(r.Context(), "Error reading audit trail of user %s: %v", user, err)
+		integrationError(w, http.StatusInternalServerError, "Error reading user data")
+		return
+	}
+	manifest := exportManifest{UserID: user, GeneratedAt: time.Now().UTC(), Files: []exportFile{}}
+	if res, ok := registry.get(kindLegalHolds, user); ok {
+		manifest.LegalHold = res.(*LegalHold)
+	}
+	if len(jobs) == 0 && len(events) == 0 && manifest.LegalHold == nil {
+		integrationError(w, http.StatusNotFound, "No data for user")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	setAttachment(w, user+"-export", ".zip")
+	w.Header().Set("Trailer", "X-Manifest-SHA256")
+	export := &exportWriter{zip: zip.NewWriter(w)}
+
+	// Errors past this point can only abort the response
+	fail := func(err error) {
+		logErrorf(r.Context(), "Error exporting data of user %s: %v", user, err)
+		panic(http.ErrAbortHandler)
+	}
+	for _, job := range jobs {
+		data, err := json.MarshalIndent(struct {
+			Job
+			Disclosure string `json:"disclosure,omitempty"`
+		}{job, disclosureFooter(job.Consent)}, "", "  ")
+		if err != nil {
+			fail(err)
+		}
+		if err := export.add("transcripts/"+job.ID+".json", bytes.NewReader(data)); err != nil {
+			fail(err)
+		}
+		// The audio of a region no longer configured cannot be found
+		var files [][2]string
+		if held, err := heldAudioPath(job); err == nil {
+			files = append(files, [2]string{"audio/" + job.ID + ".wav", held})
+		}
+		if recording, err := recordingPath(job); err == nil && job.Recorded {
+			files = append(files, [2]string{"audio/" + job.ID + ".wav", recording})
+		}
+		for _, h := range job.Highlights {
+			if clip, err := clipPath(job, h.ID); err == nil {
+				files = append(files, [2]string{"clips/" + job.ID + "/" + h.ID + ".wav", clip})
+			}
+		}
+		for _, file := range files {
+			audio, err := os.Open(file[1])
+			if err != nil {
+				continue
+			}
+			err = export.add(file[0], audio)
+			audio.Close()
+			if err != nil {
+				fail(err)
+			}
+		}
+	}
+	var trail strings.Builder
+	for _, event := range events {
+		trail.Write(event)
+		trail.WriteByte('\n')
+	}
+	if err := export.add("audit.jsonl", strings.NewReader(trail.String())); err != nil {
+		fail(err)
+	}
+
+	manifest.Files = export.files
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		fail(err)
+	}
+	digest := sha256.Sum256(data)
+	manifestSHA := hex.EncodeToString(digest[:])
+	if err := export.add("manifest.json", bytes.NewReader(data)); err != nil {
+		fail(err)
+	}
+	if err := export.zip.Close(); err != nil {
+		fail(err)
+	}
+	w.Header().Set("X-Manifest-SHA256", manifestSHA)
+
+	logf(r.Context(), "Admin: exported data of user %s (%d transcripts)", user, len(jobs))
+	recordAudit(user, newCloudEvent(EventUserExported, user, map[string]any{"manifest_sha256": manifestSHA, "files": len(manifest.Files)}))
+}
+
+// userDataStore is a store holding personal data, erased per user on
+// request. Every store that keeps data derived from a user's jobs must be
+// listed in userDataStores so erasure stays complete.
+type userDataStore struct {
+	name  string
+	erase func(user string, jobs []Job) (int, error)
+}
+
+var userDataStores = []userDataStore{
+	{name: "audio", erase: eraseUserAudio},
+	{name: "transcripts", erase: eraseUserJobs},
+	{name: "scorecard_scores", erase: eraseUserScores},
+	{name: "feedback_examples", erase: eraseUserFeedback},
+	{name: "audit_trail", erase: eraseUserAudit},
+}
+
+// eraseUserAudio removes held audio and any download left behind by the
+// user's jobs
+func eraseUserAudio(user string, jobs []Job) (int, error) {
+	var paths []string
+	for _, dir := range storageDirs() {
+		held, err := filepath.Glob(filepath.Join(dir, legalHoldDir, user, "*"))
+		if err != nil {
+			return 0, err
+		}
+		paths = append(paths, held...)
+	}
+	for _, job := range jobs {
+		// Audio in a region no longer configured cannot be erased: fail
+		// rather than report the erasure complete
+		dir, err := ingestDir(job.Region)
+		if err != nil {
+			return 0, fmt.Errorf("job %s: %w", job.ID, err)
+		}
+		paths = append(paths, filepath.Join(dir, job.ID+".wav"))
+		for _, h := range job.Highlights {
+			clip, _ := clipPath(job, h.ID)
+			paths = append(paths, clip)
+		}
+		if src, err := keptAudioPath(job); err == nil {
+			paths = append(paths, src)
+		}
+		if recording, err := recordingPath(job); err == nil && job.Recorded {
+			paths = append(paths, recording)
+		}
+	}
+
+	deleted := 0
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err == nil {
+			deleted++
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return deleted, err
+		}
+	}
+	for _, dir := range storageDirs() {
+		os.Remove(filepath.Join(dir, legalHoldDir, user))
+	}
+	for _, job := range jobs {
+		if dir, err := clipsDir(job); err == nil {
+			os.Remove(dir)
+		}
+	}
+	return deleted, nil
+}
+
+// eraseUserJobs removes the user's job records with their transcripts and
+// summaries
+func eraseUserJobs(user string, jobs []Job) (int, error) {
+	for i, job := range jobs {
+		if err := pipelineJobs.remove(job.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(jobs), nil
+}
+
+// eraseUserAudit removes the user's audit trail
+func eraseUserAudit(user string, jobs []Job) (int, error) {
+	keys, err := auditKeys(user)
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		if err := state.delete(key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// erasureResult reports what was removed from one store
+type erasureResult struct {
+	Store   string `json:"store"`
+	Deleted int    `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// erasureReport is returned by the erasure endpoint as a record that the
+// request was honored
+type erasureReport struct {
+	UserID   string          `json:"user_id"`
+	ErasedAt time.Time       `json:"erased_at"`
+	Complete bool            `json:"complete"`
+	Stores   []erasureResult `json:"stores"`
+}
+
+// handleUserErase purges all data of a user from every store and reports
+// what was deleted. A user under legal hold or with jobs in progress is
+// refused, since their data must be kept or would be written again.
+func handleUserErase(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !externalIDPattern.MatchString(user) {
+		integrationError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	if underLegalHold(user) {
+		integrationError(w, http.StatusConflict, "User data is under legal hold")
+		return
+	}
+	jobs, err := pipelineJobs.userJobs(user)
+	if err != nil {
+		logErrorf(r.Context(), "Error listing jobs of user %s: %v", user, err)
+		integrationError(w, http.StatusInternalServerError, "Error reading user data")
+		return
+	}
+	for _, job := range jobs {
+		if job.Status == jobQueued || job.Status == jobRunning {
+			integrationError(w, http.StatusConflict, "User has jobs in progress, retry when they have finished")
+			return
+		}
+	}
+
+	report := erasureReport{UserID: user, ErasedAt: time.Now().UTC(), Complete: true, Stores: []erasureResult{}}
+	for _, store := range userDataStores {
+		deleted, err := store.erase(user, jobs)
+		result := erasureResult{Store: store.name, Deleted: deleted}
+		if err != nil {
+			logErrorf(r.Context(), "Error erasing %s of user %s: %v", store.name, user, err)
+			result.Error = err.Error()
+			report.Complete = false
+		}
+		report.Stores = append(report.Stores, result)
+	}
+
+	status := http.StatusOK
+	if !report.Complete {
+		status = http.StatusInternalServerError
+	}
+	logf(r.Context(), "Admin: erased data of user %s (complete: %t)", user, report.Complete)
+	writeJSON(w, status, report)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// Support requests and bug reports need to say which build they are about.
+// The version, commit, build date and build features are injected at build
+// time, as the Dockerfile does:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=3f2c1ab -X main.buildDate=2026-10-17T09:00:00Z" -o transcription-server *.go
+//
+// GET /version reports them with the Go version and the optional features
+// the configuration enables, every response carries the version in
+// X-App-Version, and the server logs it when it starts.
+
+// Build information, set with -ldflags "-X main.<name>=<value>"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+	// Comma-separated features the binary was built with, such as fips
+	buildFeatures = ""
+)
+
+// BuildInfo describes the running build
+type BuildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	BuildDate string   `json:"build_date,omitempty"`
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"`
+	Features  []string `json:"features,omitempty"`
+}
+
+// buildInfo returns the build information, without the features enabled by
+// the configuration. Builds from a git checkout without -ldflags fall back
+// to the revision Go records.
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// enabledFeatures lists the build features and the optional features
+// enabled by the configuration, sorted
+func enabledFeatures() []string {
+	features := []string{}
+	for _, feature := range strings.Split(buildFeatures, ",") {
+		if feature = strings.TrimSpace(feature); feature != "" {
+			features = append(features, feature)
+		}
+	}
+	for feature, enabled := range map[string]bool{
+		"admin_api":            config.AdminToken.Value() != "",
+		"airgapped":            config.Airgapped,
+		"auto_titles":          config.AutoTitles,
+		"digests":              config.SMTPURL.Value() != "",
+		"event_bus":            config.EventBusURL.Value() != "",
+		"fips_mode":            config.FIPSMode,
+		"integrations_api":     config.IntegrationAPIKeys.Value() != "",
+		"leader_election":      config.LeaderElection != "",
+		"paragraphs":           config.Paragraphs,
+		"recording_disclosure": config.RecordingDisclosure != "",
+		"redis":                config.StateStore == "redis",
+		"regions":              config.Regions.Value() != "",
+		"telemetry":            config.Telemetry,
+		"tenant_routes":        config.TenantRoutes.Value() != "",
+		"transcript_history":   config.TranscriptHistory,
+		"warmup":               config.WarmupOnStartup,
+		"webhooks":             config.HooksSecret.Value() != "",
+	} {
+		if enabled {
+			features = append(features, feature)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// versionLine describes the build in one line, for logs and --version
+func versionLine() string {
+	info := buildInfo()
+	line := "transcription-server " + info.Version
+	if info.Commit != "" {
+		line += " (commit " + info.Commit
+		if info.BuildDate != "" {
+			line += ", built " + info.BuildDate
+		}
+		line += ")"
+	}
+	return fmt.Sprintf("%s, %s %s", line, info.GoVersion, info.Platform)
+}
+
+// withVersion adds the version to every response
+func withVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-App-Version", version)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleVersion reports the running build
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	info := buildInfo()
+	info.Features = enabledFeatures()
+	writeJSON(w, http.StatusOK, info)
+}
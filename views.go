@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Completed transcriptions can be shared through links that render them as
+// server-side HTML, so they read well without the single-page app and with
+// JavaScript disabled. Each view has a print-friendly variant.
+
+// EventTranscriptShared is recorded in the user's audit trail when a share
+// link is created
+const EventTranscriptShared = "transcript.shared"
+
+// ShareLink grants read access to one transcription to anyone holding its
+// token. Only a hash of the token is stored.
+type ShareLink struct {
+	JobID     string    `json:"job_id"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// shareKeyPrefix namespaces share links in the state store, keyed by the
+// hash of their token
+const shareKeyPrefix = "share:"
+
+// Lifetimes of share links
+const (
+	defaultShareTTL = 7 * 24 * time.Hour
+	maxShareTTL     = 90 * 24 * time.Hour
+)
+
+// views are the parsed templates in templates/
+var views *template.Template
+
+var viewFuncs = template.FuncMap{
+	"brand":         func() Branding { return branding },
+	"timestamp":     formatTimestamp,
+	"jobTitle":      jobTitle,
+	"feedEntryBody": feedEntryBody,
+	"paragraphs":    splitParagraphs,
+	"duration": func(seconds float64) string {
+		return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+	},
+}
+
+// transcriptView is the data rendered by transcript.html
+type transcriptView struct {
+	Title      string
+	Job        Job
+	Disclosure string
+	Print      bool
+	PrintURL   string
+}
+
+// handleShareCreate creates a link to the server-rendered view of a
+// completed transcription
+func handleShareCreate(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	job, ok := pipelineJobs.get(r.PathValue("id"))
+	if !ok || !p.sees(job) {
+		integrationError(w, http.StatusNotFound, "Transcription not found")
+		return
+	}
+	if job.Status != jobCompleted {
+		integrationError(w, http.StatusConflict, "Transcription is not completed")
+		return
+	}
+	var req struct {
+		ExpiresIn string `json:"expires_in"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&req); err != nil {
+			integrationError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+	ttl := defaultShareTTL
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 || d > maxShareTTL {
+			integrationError(w, http.StatusBadRequest, fmt.Sprintf("expires_in must be a positive duration of at most %s", maxShareTTL))
+			return
+		}
+		ttl = d
+	}
+
+	token := randomToken("")
+	now := time.Now().UTC()
+	link := ShareLink{JobID: job.ID, CreatedBy: p.ID, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+	data, err := json.Marshal(link)
+	if err == nil {
+		err = state.set(shareKeyPrefix+hashAPIKey(token), data, ttl)
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Error saving share link for job %s: %v", job.ID, err)
+		integrationError(w, http.StatusInternalServerError, "Error creating share link")
+		return
+	}
+	logf(r.Context(), "Job %s shared by %s until %s", job.ID, p.ID, link.ExpiresAt.Format(time.RFC3339))
+	recordAudit(job.UserID, newCloudEvent(EventTranscriptShared, job.ID, map[string]any{"shared_by": p.ID, "expires_at": link.ExpiresAt}))
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"url":        "/shared/" + token,
+		"print_url":  "/shared/" + token + "/print",
+		"expires_at": link.ExpiresAt,
+	})
+}
+
+// sharedJob resolves a share token to its link and transcription
+func sharedJob(token string) (ShareLink, Job, bool) {
+	data, ok, err := shareState.get(shareKeyPrefix + hashAPIKey(token))
+	if err != nil {
+		logErrorf(context.Background(), "Error reading share link: %v", err)
+	}
+	var link ShareLink
+	if !ok || json.Unmarshal(data, &link) != nil {
+		return ShareLink{}, Job{}, false
+	}
+	job, ok := pipelineJobs.getFrom(shareState, link.JobID)
+	return link, job, ok
+}
+
+// handleSharedView renders a shared transcription as HTML
+func handleSharedView(w http.ResponseWriter, r *http.Request) {
+	renderTranscript(w, r, false)
+}
+
+// handleSharedPrint renders the print-friendly variant
+func handleSharedPrint(w http.ResponseWriter, r *http.Request) {
+	renderTranscript(w, r, true)
+}
+
+func renderTranscript(w http.ResponseWriter, r *http.Request, print bool) {
+	// The token is the credential: keep it out of caches, referrers and
+	// search engines
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+
+	token := r.PathValue("token")
+	key := hashAPIKey(token)
+	if print {
+		key += "/print"
+	}
+	page, err := sharePages.page(key, func() (*sharePage, error) {
+		expires := time.Now().Add(config.ShareCacheTTL)
+		link, job, ok := sharedJob(token)
+		if !ok || job.Status != jobCompleted {
+			return &sharePage{expires: expires}, nil
+		}
+		view := transcriptView{
+			Title:      jobTitle(job),
+			Job:        job,
+			Disclosure: disclosureFooter(job.Consent),
+			Print:      print,
+			PrintURL:   "/shared/" + token + "/print",
+		}
+		body, err := executeView("transcript.html", view)
+		if err != nil {
+			return nil, err
+		}
+		if link.ExpiresAt.Before(expires) {
+			expires = link.ExpiresAt
+		}
+		return &sharePage{jobID: job.ID, body: body, expires: expires}, nil
+	})
+	switch {
+	case errors.Is(err, errShareBusy):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many requests for shared transcripts, please retry", http.StatusServiceUnavailable)
+	case err != nil:
+		logErrorf(r.Context(), "Error rendering transcript.html: %v", err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	case page.body == nil:
+		http.Error(w, "This link is invalid or has expired", http.StatusNotFound)
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page.body)
+	}
+}
+
+// renderView renders a template as an HTML page. It renders fully before
+// writing, so a template error yields a clean 500.
+func renderView(w http.ResponseWriter, name string, data any) {
+	body, err := executeView(name, data)
+	if err != nil {
+		logErrorf(context.Background(), "Error rendering %s: %v", name, err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(body)
+}
+
+// executeView renders a template into memory
+func executeView(name string, data any) ([]byte, error) {
+	t := views
+	// Templates being edited in STATIC_DIR are parsed again on every render
+	if config.StaticDir != "" {
+		var err error
+		if t, err = parseViews(); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// lastPathSegment returns the file name at the end of a URL
+func lastPathSegment(u string) string {
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		u = u[:i]
+	}
+	return u[strings.LastIndex(u, "/")+1:]
+}
+
+// parseViews parses the HTML templates of the assets
+func parseViews() (*template.Template, error) {
+	return template.New("").Funcs(viewFuncs).ParseFS(assets, "templates/*.html")
+}
+
+// initViews parses the HTML templates
+func initViews() {
+	var err error
+	views, err = parseViews()
+	if err != nil {
+		log.Fatalf("Error parsing templates: %v", err)
+	}
+}
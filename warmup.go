@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Servers such as llama.cpp and whisper.cpp load models on the first
+// request, which then takes minutes. A warm-up sends every configured
+// backend a tiny request: a second of silence to the ASR backends and a
+// one-token completion to the LLMs. It runs from POST /admin/v1/warmup and,
+// with WARMUP_ON_STARTUP, in the background at startup, during which
+// /readyz reports the replica as not ready.
+
+// warmupClient waits for models to load, longer than regular requests
+var warmupClient *http.Client
+
+// WarmupResult is the outcome of warming up one backend
+type WarmupResult struct {
+	Backend  string `json:"backend"`
+	Scope    string `json:"scope"`
+	URL      string `json:"url"`
+	Model    string `json:"model"`
+	OK       bool   `json:"ok"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// warmupState is reported by /readyz while the startup warm-up runs
+var warmupState struct {
+	sync.Mutex
+	running bool
+	failed  int
+}
+
+// silentWAV returns one second of 16kHz mono silence
+func silentWAV() []byte {
+	const rate = 16000
+	return pcmToWAV(make([]byte, rate*2), rate)
+}
+
+// warmupRequest sends req and fails on anything but 200
+func warmupRequest(req *http.Request) error {
+	resp, err := warmupClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, describeBody(string(body)))
+	}
+	return nil
+}
+
+// warmUpAudio transcribes a second of silence
+func warmUpAudio(ctx context.Context, up Upstream) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("model", up.AudioModel)
+	part, err := writer.CreateFormFile("file", "warmup.wav")
+	if err != nil {
+		return err
+	}
+	part.Write(silentWAV())
+	writer.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", up.transcriptionURL(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	up.authorizeAudio(req)
+	return warmupRequest(req)
+}
+
+// warmUpLLM asks for a one-token completion
+func warmUpLLM(ctx context.Context, up Upstream) error {
+	jsonData, err := json.Marshal(ChatCompletionRequest{
+		Model:     up.LLMModel,
+		Messages:  []Message{{Role: "user", Content: "Reply with OK."}},
+		MaxTokens: 1,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", up.chatURL(), bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	up.authorizeLLM(req)
+	return warmupRequest(req)
+}
+
+// warmUp warms every distinct backend of the default configuration,
+// regions and tenants in parallel
+func warmUp(ctx context.Context) []WarmupResult {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results []WarmupResult
+	)
+	run := func(backend, scope, url, model string, fn func(context.Context) error) {
+		defer wg.Done()
+		start := time.Now()
+		err := fn(ctx)
+		result := WarmupResult{Backend: backend, Scope: scope, URL: url, Model: model, OK: err == nil, Duration: time.Since(start).Round(time.Millisecond).String()}
+		if err != nil {
+			result.Error = err.Error()
+			logWarnf(ctx, "Warm-up of %s backend %s (%s) failed after %s: %v", backend, url, model, result.Duration, err)
+		} else {
+			logf(ctx, "Warmed up %s backend %s (%s) in %s", backend, url, model, result.Duration)
+		}
+		mu.Lock()
+		results = append(results, result)
+		mu.Unlock()
+	}
+
+	seen := make(map[string]bool)
+	scopes, ups := selfTestUpstreams()
+	for _, scope := range scopes {
+		up := ups[scope]
+		// Each Whisper backend of a list loads its own model
+		for _, audio := range up.audioBackends() {
+			if key := "audio " + audio.AudioURL + " " + audio.AudioModel; !seen[key] {
+				seen[key] = true
+				wg.Add(1)
+				go run("audio", scope, audio.AudioURL, audio.AudioModel, func(ctx context.Context) error { return warmUpAudio(ctx, audio) })
+			}
+		}
+		if key := "llm " + up.LLMURL + " " + up.LLMModel; !seen[key] {
+			seen[key] = true
+			wg.Add(1)
+			go run("llm", scope, up.LLMURL, up.LLMModel, func(ctx context.Context) error { return warmUpLLM(ctx, up) })
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+// handleWarmup warms up the backends and reports how long each took. It
+// waits for the models to load, which can take minutes.
+func handleWarmup(w http.ResponseWriter, r *http.Request) {
+	results := warmUp(r.Context())
+	writeJSON(w, http.StatusOK, results)
+}
+
+// warmupCheck is the /readyz check of the startup warm-up
+func warmupCheck() (CheckResult, bool) {
+	warmupState.Lock()
+	defer warmupState.Unlock()
+	if !config.WarmupOnStartup {
+		return CheckResult{}, false
+	}
+	if warmupState.running {
+		return CheckResult{OK: false, Detail: "warming up the backends"}, true
+	}
+	if warmupState.failed > 0 {
+		return CheckResult{OK: true, Detail: fmt.Sprintf("%d backend(s) failed to warm up", warmupState.failed)}, true
+	}
+	return CheckResult{OK: true}, true
+}
+
+// initWarmup creates the warm-up client and starts the startup warm-up
+func initWarmup() {
+	warmupClient = &http.Client{Transport: newUpstreamTransport(), Timeout: config.WarmupTimeout}
+	if !config.WarmupOnStartup {
+		return
+	}
+	warmupState.running = true
+	go func() {
+		failed := 0
+		for _, result := range warmUp(context.Background()) {
+			if !result.OK {
+				failed++
+			}
+		}
+		warmupState.Lock()
+		warmupState.running, warmupState.failed = false, failed
+		warmupState.Unlock()
+	}()
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestSilentWAV(t *testing.T) {
+	a := readWAVBytes(t, silentWAV())
+	if a.sampleRate != 16000 || a.blockAlign != 2 || !a.pcm16 {
+		t.Errorf("got sample rate %d, block size %d, 16-bit PCM %v; want 16000, 2, true", a.sampleRate, a.blockAlign, a.pcm16)
+	}
+	if a.dataSize != 32000 {
+		t.Fatalf("data is %d bytes, want a second of audio", a.dataSize)
+	}
+	data, err := io.ReadAll(io.NewSectionReader(a.file, a.dataOffset, a.dataSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, make([]byte, 32000)) {
+		t.Error("audio is not silent")
+	}
+}
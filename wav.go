@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// WAV files are a RIFF header followed by chunks, each an ID, a length and
+// a body padded to an even size. Recordings are read from files, uploads
+// and streams in several places, which all walk the chunks with walkWAV.
+
+var (
+	errNotWAV = errors.New("not WAV audio")
+	// errWAVShort is returned when the audio ends inside its header or its
+	// fmt chunk, as a stream does until more of it arrives
+	errWAVShort      = errors.New("WAV audio ends inside its header")
+	errWAVFormat     = errors.New("WAV audio has a damaged fmt chunk")
+	errWAVFormatLate = errors.New("WAV audio has no fmt chunk before its data")
+)
+
+// wavFormatSize is the size of the fmt chunk of PCM audio; other encodings
+// only add to it
+const wavFormatSize = 16
+
+// walkWAV calls fn with the ID, body offset and length of each chunk of the
+// WAV audio in the first size bytes of r, in order, until fn returns true
+// or an error, and reports whether fn stopped it. Every fmt chunk is
+// checked to hold a whole PCM format before fn is called with it.
+func walkWAV(r io.ReaderAt, size int64, fn func(id string, body, length int64) (bool, error)) (bool, error) {
+	header := make([]byte, 12)
+	if size < int64(len(header)) {
+		return false, errWAVShort
+	}
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return false, err
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return false, errNotWAV
+	}
+	chunk := header[:8]
+	for offset := int64(12); offset+8 <= size; {
+		if _, err := r.ReadAt(chunk, offset); err != nil {
+			return false, err
+		}
+		id := string(chunk[:4])
+		length := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		if id == "fmt " {
+			if length < wavFormatSize {
+				return false, errWAVFormat
+			}
+			if offset+8+length > size {
+				return false, errWAVShort
+			}
+		}
+		if stop, err := fn(id, offset+8, length); stop || err != nil {
+			return stop, err
+		}
+		offset += 8 + length + length%2
+	}
+	return false, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Webhook delivery metrics exported on /debug/vars
+var (
+	webhooksDelivered = expvar.NewInt("webhooks_delivered_total")
+	webhooksFailed    = expvar.NewInt("webhooks_failed_total")
+	webhooksDropped   = expvar.NewInt("webhooks_dropped_total")
+)
+
+// webhookAttempts is how many times a delivery is tried before giving up
+const webhookAttempts = 3
+
+// webhookDelivery is a serialized event bound for one integration
+type webhookDelivery struct {
+	integration *Integration
+	eventType   string
+	payload     []byte
+}
+
+var (
+	webhookQueue  = make(chan webhookDelivery, eventQueueSize)
+	webhookClient *http.Client
+)
+
+// dispatchWebhooks queues event for every integration subscribed to it
+func dispatchWebhooks(event CloudEvent) {
+	for _, integration := range registry.integrations() {
+		if integration.wants(event.Type) {
+			deliverWebhook(integration, event)
+		}
+	}
+}
+
+// deliverWebhook queues event for a single integration
+func deliverWebhook(integration *Integration, event CloudEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logErrorf(context.Background(), "Error encoding %s event: %v", event.Type, err)
+		return
+	}
+	select {
+	case webhookQueue <- webhookDelivery{integration: integration, eventType: event.Type, payload: payload}:
+	default:
+		webhooksDropped.Add(1)
+		logWarnf(context.Background(), "Webhook queue full, dropping %s event for integration %s", event.Type, integration.ID)
+	}
+}
+
+// runWebhookDelivery sends queued events, retrying with backoff
+func runWebhookDelivery() {
+	for delivery := range webhookQueue {
+		var err error
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			if err = delivery.integration.post(delivery.payload); err == nil {
+				break
+			}
+			if attempt < webhookAttempts {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+		if err != nil {
+			webhooksFailed.Add(1)
+			logErrorf(context.Background(), "Error delivering %s event to integration %s: %v", delivery.eventType, delivery.integration.ID, err)
+			continue
+		}
+		webhooksDelivered.Add(1)
+	}
+}
+
+// post sends a structured-mode CloudEvent, signed like inbound hooks when
+// the integration has a secret
+func (i *Integration) post(payload []byte) error {
+	req, err := http.NewRequest("POST", i.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", cloudEventContentType)
+	if i.Secret != "" {
+		req.Header.Set(hookSignatureHeader, signPayload(i.Secret, payload))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal WebSocket server (RFC 6455), enough for live transcription:
+// the client sends audio in binary messages and receives JSON in text
+// messages. Like the NATS client it speaks the protocol directly instead
+// of pulling in a module. Extensions such as compression are not
+// negotiated.
+
+// websocketGUID is appended to the client's key to compute the accept key
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// Close status codes
+const (
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseUnsupported   = 1003
+	wsClosePolicy        = 1008
+	wsCloseTooBig        = 1009
+	wsCloseInternalError = 1011
+)
+
+// wsWriteTimeout bounds sending a frame to a client that stopped reading
+const wsWriteTimeout = 10 * time.Second
+
+// errWebSocketClosed is returned by readMessage once the client has closed
+// the connection
+var errWebSocketClosed = errors.New("websocket closed by the client")
+
+// wsConn is a server-side WebSocket connection. Messages are read by one
+// goroutine; writes may come from several.
+type wsConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	maxMessage int64
+
+	mu     sync.Mutex
+	writer *bufio.Writer
+	closed bool
+}
+
+// headerHasToken reports whether a comma-separated header lists token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether a browser's request comes from a page served
+// by this server. Requests without an Origin header are not from a browser.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// upgradeWebSocket completes the opening handshake, answering the request
+// with an error when it is not a valid WebSocket request. Messages larger
+// than maxMessage bytes close the connection.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, maxMessage int64) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket"):
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("not a WebSocket request")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	case key == "":
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	case !sameOrigin(r):
+		http.Error(w, "Cross-origin WebSocket requests are not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("cross-origin request from %s", r.Header.Get("Origin"))
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	c := &wsConn{conn: conn, reader: rw.Reader, writer: rw.Writer, maxMessage: maxMessage}
+	conn.SetDeadline(time.Time{})
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	fmt.Fprintf(c.writer, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := c.writer.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// readMessage returns the next text or binary message, answering pings
+// and reassembling fragmented messages. It returns errWebSocketClosed when
+// the client closes the connection; on protocol errors the connection is
+// closed with the matching status code.
+func (c *wsConn) readMessage() (int, []byte, error) {
+	opcode := -1
+	var message []byte
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			return 0, nil, err
+		}
+		fin, op := header[0]&0x80 != 0, int(header[0]&0x0f)
+		length := int64(header[1] & 0x7f)
+		if header[0]&0x70 != 0 || header[1]&0x80 == 0 {
+			// Reserved bits need an extension; clients must mask
+			return 0, nil, c.fail(wsCloseProtocolError, "invalid frame header")
+		}
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			length = int64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			length = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+		}
+		control := op >= wsClose
+		if control && (!fin || length > 125) {
+			return 0, nil, c.fail(wsCloseProtocolError, "invalid control frame")
+		}
+		if !control && int64(len(message))+length > c.maxMessage {
+			return 0, nil, c.fail(wsCloseTooBig, "message too large")
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return 0, nil, err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return 0, nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch op {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.close(code, "")
+			return 0, nil, errWebSocketClosed
+		case wsText, wsBinary:
+			if opcode >= 0 {
+				return 0, nil, c.fail(wsCloseProtocolError, "new message inside a fragmented message")
+			}
+			opcode = op
+		case wsContinuation:
+			if opcode < 0 {
+				return 0, nil, c.fail(wsCloseProtocolError, "continuation outside a fragmented message")
+			}
+		default:
+			return 0, nil, c.fail(wsCloseProtocolError, "unknown opcode")
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// writeFrame sends a single unfragmented frame
+func (c *wsConn) writeFrame(op int, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errWebSocketClosed
+	}
+	header := []byte{0x80 | byte(op)}
+	switch n := len(payload); {
+	case n <= 125:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	c.writer.Write(header)
+	c.writer.Write(payload)
+	return c.writer.Flush()
+}
+
+// writeJSON sends v as a text message
+func (c *wsConn) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsText, data)
+}
+
+// close sends a close frame with code and reason, then closes the
+// connection. Closing twice does nothing.
+func (c *wsConn) close(code int, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason[:min(len(reason), 123)]...)
+	c.writeFrame(wsClose, payload)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.conn.Close()
+	}
+}
+
+// fail closes the connection after a protocol violation and returns the
+// error describing it
+func (c *wsConn) fail(code int, reason string) error {
+	c.close(code, reason)
+	return fmt.Errorf("websocket: %s", reason)
+}
+
+// setReadDeadline bounds the wait for the next message
+func (c *wsConn) setReadDeadline(t time.Time) {
+	c.conn.SetReadDeadline(t)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A workspace groups the API keys of a team. Members share a transcript
+// library, and their usage rolls up to the workspace's monthly quota.
+// Workspaces are declared through the admin API; members join by redeeming
+// an invitation, which issues them their own API key.
+
+// Workspace is a team sharing a transcript library and a quota
+type Workspace struct {
+	ID     string         `json:"id"`
+	Name   string         `json:"name,omitempty"`
+	Tenant string         `json:"tenant,omitempty"`
+	Quota  WorkspaceQuota `json:"quota"`
+}
+
+// WorkspaceQuota limits a workspace's usage per calendar month (UTC); zero
+// means unlimited
+type WorkspaceQuota struct {
+	JobsPerMonth         int64   `json:"jobs_per_month,omitempty"`
+	AudioMinutesPerMonth float64 `json:"audio_minutes_per_month,omitempty"`
+}
+
+func (ws *Workspace) validate() error {
+	if ws.Tenant != "" && !knownTenant(ws.Tenant) {
+		return fmt.Errorf("tenant %q is not in TENANT_ROUTES", ws.Tenant)
+	}
+	if ws.Quota.JobsPerMonth < 0 || ws.Quota.AudioMinutesPerMonth < 0 {
+		return errors.New("quota limits cannot be negative")
+	}
+	return nil
+}
+
+func (ws *Workspace) redacted() adminResource {
+	c := *ws
+	return &c
+}
+
+// workspace returns a declared workspace
+func (r *adminRegistry) workspace(id string) (*Workspace, bool) {
+	res, ok := r.get(kindWorkspaces, id)
+	if !ok {
+		return nil, false
+	}
+	return res.(*Workspace), true
+}
+
+// WorkspaceUsage is a workspace's consumption in the current month
+type WorkspaceUsage struct {
+	Month        string         `json:"month"`
+	Jobs         int64          `json:"jobs"`
+	AudioMinutes float64        `json:"audio_minutes"`
+	Quota        WorkspaceQuota `json:"quota"`
+}
+
+// usageKeyPrefix namespaces usage counters in the state store
+const usageKeyPrefix = "usage:"
+
+// usageRetention keeps a month's counters until after it has ended
+const usageRetention = 62 * 24 * time.Hour
+
+func usageKey(workspace, counter string) string {
+	return usageKeyPrefix + workspace + ":" + time.Now().UTC().Format("2006-01") + ":" + counter
+}
+
+// readCounter returns a usage counter, which incrBy stores as an integer
+func readCounter(key string) int64 {
+	n, err := state.incrBy(key, 0, usageRetention)
+	if err != nil {
+		logErrorf(context.Background(), "Error reading usage counter %s: %v", key, err)
+	}
+	return n
+}
+
+// workspaceUsage returns the current month's usage of a workspace
+func workspaceUsage(ws *Workspace) WorkspaceUsage {
+	return WorkspaceUsage{
+		Month:        time.Now().UTC().Format("2006-01"),
+		Jobs:         readCounter(usageKey(ws.ID, "jobs")),
+		AudioMinutes: float64(readCounter(usageKey(ws.ID, "audio_ms"))) / float64(time.Minute/time.Millisecond),
+		Quota:        ws.Quota,
+	}
+}
+
+// admitWorkspaceJob counts a new job against the workspace's quota and
+// returns a message for the client when the quota is used up, or warnings
+// when it nearly is. The remaining quota is reported in headers. Keys
+// outside a workspace are not limited.
+func admitWorkspaceJob(w http.ResponseWriter, workspace string) ([]QuotaWarning, string, bool) {
+	ws, ok := registry.workspace(workspace)
+	if !ok {
+		return nil, "", true
+	}
+	usage := workspaceUsage(ws)
+	if ws.Quota.AudioMinutesPerMonth > 0 && usage.AudioMinutes >= ws.Quota.AudioMinutesPerMonth {
+		setQuotaHeaders(w, ws, usage)
+		return nil, "Workspace audio quota for this month is used up", false
+	}
+	jobs, err := state.incrBy(usageKey(ws.ID, "jobs"), 1, usageRetention)
+	if err != nil {
+		// Fail open like the other shared counters
+		logErrorf(context.Background(), "Error counting usage of workspace %s: %v", ws.ID, err)
+		return nil, "", true
+	}
+	if ws.Quota.JobsPerMonth > 0 && jobs > ws.Quota.JobsPerMonth {
+		state.incrBy(usageKey(ws.ID, "jobs"), -1, usageRetention)
+		setQuotaHeaders(w, ws, usage)
+		return nil, "Workspace job quota for this month is used up", false
+	}
+	usage.Jobs = jobs
+	setQuotaHeaders(w, ws, usage)
+	warnings := quotaWarnings(ws, usage)
+	announceQuotaWarnings(ws, warnings)
+	return warnings, "", true
+}
+
+// recordWorkspaceAudio adds transcribed audio to the workspace's usage
+func recordWorkspaceAudio(workspace string, seconds float64) {
+	if workspace == "" || seconds <= 0 {
+		return
+	}
+	ms := int64(math.Ceil(seconds * 1000))
+	if _, err := state.incrBy(usageKey(workspace, "audio_ms"), ms, usageRetention); err != nil {
+		logErrorf(context.Background(), "Error counting usage of workspace %s: %v", workspace, err)
+	}
+}
+
+// Invitation lets someone join a workspace with a role. Only a hash of
+// its token is stored; the token is returned once, when it is created.
+type Invitation struct {
+	ID        string    `json:"id"`
+	Workspace string    `json:"workspace"`
+	Role      string    `json:"role"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// invitationRecord is how an invitation is kept in the state store
+type invitationRecord struct {
+	Invitation
+	TokenHash string `json:"token_sha256"`
+}
+
+// invitationKeyPrefix namespaces invitations in the state store, keyed by
+// the hash of their token, and invitationClaimPrefix the counters a
+// redemption claims them with
+const (
+	invitationKeyPrefix   = "invitation:"
+	invitationClaimPrefix = "invitation-claim:"
+)
+
+// defaultInvitationTTL is how long an invitation can be redeemed
+const defaultInvitationTTL = 7 * 24 * time.Hour
+
+// randomToken returns a random hex token with the given prefix
+func randomToken(prefix string) string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// workspaceInvitations lists a workspace's pending invitations
+func workspaceInvitations(workspace string) ([]invitationRecord, error) {
+	keys, err := state.keys(invitationKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	invitations := []invitationRecord{}
+	for _, key := range keys {
+		data, ok, err := state.get(key)
+		if err != nil {
+			return nil, err
+		}
+		var inv invitationRecord
+		if !ok || json.Unmarshal(data, &inv) != nil || inv.Workspace != workspace {
+			continue
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, nil
+}
+
+// handleInvitationCreate issues an invitation to a workspace
+func handleInvitationCreate(w http.ResponseWriter, r *http.Request) {
+	ws, ok := registry.workspace(r.PathValue("id"))
+	if !ok {
+		integrationError(w, http.StatusNotFound, "Workspace not found")
+		return
+	}
+	var req struct {
+		Role      string `json:"role"`
+		Email     string `json:"email"`
+		ExpiresIn string `json:"expires_in"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&req); err != nil {
+		integrationError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Role == "" {
+		req.Role = roleEditor
+	}
+	// Workspace members administer nothing beyond their workspace
+	if req.Role != roleViewer && req.Role != roleEditor {
+		integrationError(w, http.StatusBadRequest, "role must be viewer or editor")
+		return
+	}
+	ttl := defaultInvitationTTL
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			integrationError(w, http.StatusBadRequest, "expires_in must be a positive duration such as 72h")
+			return
+		}
+		ttl = d
+	}
+
+	token := randomToken("inv_")
+	hash := hashAPIKey(token)
+	now := time.Now().UTC()
+	inv := invitationRecord{
+		Invitation: Invitation{
+			ID:        hash[:16],
+			Workspace: ws.ID,
+			Role:      req.Role,
+			Email:     req.Email,
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+		},
+		TokenHash: hash,
+	}
+	data, err := json.Marshal(inv)
+	if err == nil {
+		err = state.set(invitationKeyPrefix+hash, data, ttl)
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Error saving invitation to workspace %s: %v", ws.ID, err)
+		integrationError(w, http.StatusInternalServerError, "Error saving invitation")
+		return
+	}
+	logf(r.Context(), "Admin: invited %s to workspace %s as %s", inv.ID, ws.ID, inv.Role)
+	writeJSON(w, http.StatusCreated, struct {
+		Invitation
+		Token string `json:"token"`
+	}{inv.Invitation, token})
+}
+
+// handleInvitationList lists a workspace's pending invitations
+func handleInvitationList(w http.ResponseWriter, r *http.Request) {
+	invitations, err := workspaceInvitations(r.PathValue("id"))
+	if err != nil {
+		logErrorf(r.Context(), "Error listing invitations: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error listing invitations")
+		return
+	}
+	items := make([]Invitation, 0, len(invitations))
+	for _, inv := range invitations {
+		items = append(items, inv.Invitation)
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// handleInvitationDelete revokes a pending invitation
+func handleInvitationDelete(w http.ResponseWriter, r *http.Request) {
+	invitations, err := workspaceInvitations(r.PathValue("id"))
+	if err != nil {
+		logErrorf(r.Context(), "Error listing invitations: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error revoking invitation")
+		return
+	}
+	for _, inv := range invitations {
+		if inv.ID == r.PathValue("invitation") {
+			if err := state.delete(invitationKeyPrefix + inv.TokenHash); err != nil {
+				logErrorf(r.Context(), "Error revoking invitation %s: %v", inv.ID, err)
+				integrationError(w, http.StatusInternalServerError, "Error revoking invitation")
+				return
+			}
+			logf(r.Context(), "Admin: revoked invitation %s", inv.ID)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWorkspaceUsage reports a workspace's usage to admins
+func handleWorkspaceUsage(w http.ResponseWriter, r *http.Request) {
+	ws, ok := registry.workspace(r.PathValue("id"))
+	if !ok {
+		integrationError(w, http.StatusNotFound, "Workspace not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, workspaceUsage(ws))
+}
+
+// handleInvitationAccept redeems an invitation token for a new API key in
+// the workspace. The token is the credential, so no API key is needed.
+func handleInvitationAccept(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token       string `json:"token"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookPayloadSize)).Decode(&req); err != nil || req.Token == "" {
+		integrationError(w, http.StatusBadRequest, "token is required")
+		return
+	}
+	key := invitationKeyPrefix + hashAPIKey(req.Token)
+	data, ok, err := state.get(key)
+	var inv invitationRecord
+	if err == nil && ok {
+		err = json.Unmarshal(data, &inv)
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Error reading invitation: %v", err)
+		integrationError(w, http.StatusInternalServerError, "Error reading invitation")
+		return
+	}
+	if !ok {
+		integrationError(w, http.StatusNotFound, "Invitation not found or expired")
+		return
+	}
+	ws, ok := registry.workspace(inv.Workspace)
+	if !ok {
+		integrationError(w, http.StatusNotFound, "Workspace no longer exists")
+		return
+	}
+	// Redeem once, even on several replicas: the first request to claim
+	// the invitation wins
+	n, err := state.incrBy(invitationClaimPrefix+inv.ID, 1, max(time.Until(inv.ExpiresAt), time.Minute))
+	if err != nil {
+		logErrorf(r.Context(), "Error redeeming invitation %s: %v", inv.ID, err)
+		integrationError(w, http.StatusInternalServerError, "Error redeeming invitation")
+		return
+	}
+	if n != 1 {
+		integrationError(w, http.StatusNotFound, "Invitation not found or expired")
+		return
+	}
+	if err := state.delete(key); err != nil {
+		logErrorf(r.Context(), "Error removing invitation %s: %v", inv.ID, err)
+	}
+
+	secret := randomToken("key_")
+	apiKey := &APIKey{
+		ID:          ws.ID + "-" + inv.ID[:8],
+		Description: strings.TrimSpace(req.Description),
+		Key:         secret,
+		Workspace:   ws.ID,
+		Role:        inv.Role,
+	}
+	if apiKey.Description == "" {
+		apiKey.Description = "Invited " + inv.Email
+	}
+	if err := apiKey.validate(); err == nil {
+		_, err = registry.put(kindAPIKeys, apiKey.ID, apiKey)
+	}
+	if err != nil {
+		logErrorf(r.Context(), "Error issuing key for invitation %s: %v", inv.ID, err)
+		integrationError(w, http.StatusInternalServerError, "Error issuing API key")
+		return
+	}
+	logf(r.Context(), "Invitation %s redeemed for workspace %s", inv.ID, ws.ID)
+	writeJSON(w, http.StatusCreated, map[string]string{"id": apiKey.ID, "key": secret, "workspace": ws.ID, "role": apiKey.Role})
+}
+
+// handleIntegrationWorkspace shows members their workspace and its usage
+func handleIntegrationWorkspace(w http.ResponseWriter, r *http.Request) {
+	ws, ok := registry.workspace(principalFrom(r.Context()).Workspace)
+	if !ok {
+		integrationError(w, http.StatusNotFound, "API key does not belong to a workspace")
+		return
+	}
+	usage := workspaceUsage(ws)
+	setQuotaHeaders(w, ws, usage)
+	writeJSON(w, http.StatusOK, map[string]any{"id": ws.ID, "name": ws.Name, "usage": usage, "quota_warnings": quotaWarnings(ws, usage)})
+}